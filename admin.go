@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+var errNotAdmin = errors.New("user is not an admin")
+
+// authenticateAdmin validates the request's JWT and checks that it belongs
+// to an admin, responding with the appropriate error when it doesn't.
+func (cfg *apiConfig) authenticateAdmin(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return uuid.Nil, false
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return uuid.Nil, false
+	}
+
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return uuid.Nil, false
+	}
+	if user == nil || !user.IsAdmin {
+		respondWithError(w, http.StatusForbidden, "Admin access required", errNotAdmin)
+		return uuid.Nil, false
+	}
+	return userID, true
+}
+
+func (cfg *apiConfig) handlerUserTierUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Tier string `json:"tier" validate:"required,max=50"`
+	}
+
+	userID, ok := pathUUID(w, r, "userID")
+	if !ok {
+		return
+	}
+
+	adminID, ok := cfg.authenticateAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+
+	found, err := cfg.db.SetUserTier(userID, params.Tier)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update tier", err)
+		return
+	}
+	if !found {
+		respondWithError(w, http.StatusNotFound, "User not found", nil)
+		return
+	}
+
+	err = cfg.db.CreateAuditEntry(database.AuditEntry{
+		ActorID: &adminID,
+		Action:  "user_tier_changed",
+		Details: fmt.Sprintf("user %s moved to tier %s", userID, params.Tier),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write audit entry", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
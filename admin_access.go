@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+)
+
+// adminAccess decides which connections may reach the operational routes
+// under /admin/, so they aren't exposed just because the public API is.
+// Admin accounts still have to sign in on top of it.
+type adminAccess struct {
+	// allow, when not empty, lists the only networks admin routes are
+	// served to
+	allow []netip.Prefix
+	// deny lists networks refused even if allow covers them
+	deny []netip.Prefix
+	// requireClientCert also asks for a TLS client certificate signed by
+	// the admin CA
+	requireClientCert bool
+}
+
+// parseNetworks reads a comma-separated list of CIDRs. A bare address
+// stands for itself alone.
+func parseNetworks(s string) ([]netip.Prefix, error) {
+	var networks []netip.Prefix
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			addr, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, err
+			}
+			networks = append(networks, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, prefix.Masked())
+	}
+	return networks, nil
+}
+
+func (a adminAccess) enabled() bool {
+	return len(a.allow) > 0 || len(a.deny) > 0 || a.requireClientCert
+}
+
+// check returns why the connection r came in on can't use admin routes,
+// or nil if it can. The address checked is the connecting one, so behind
+// a proxy it's the proxy's.
+func (a adminAccess) check(r *http.Request) error {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return err
+	}
+	addr := addrPort.Addr().Unmap()
+	contains := func(p netip.Prefix) bool { return p.Contains(addr) }
+	if slices.ContainsFunc(a.deny, contains) {
+		return fmt.Errorf("%s is in ADMIN_DENIED_NETWORKS", addr)
+	}
+	if len(a.allow) > 0 && !slices.ContainsFunc(a.allow, contains) {
+		return fmt.Errorf("%s isn't in ADMIN_ALLOWED_NETWORKS", addr)
+	}
+	if a.requireClientCert && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+		return errors.New("no client certificate from the admin CA")
+	}
+	return nil
+}
+
+// adminAccessGuard refuses requests for /admin/ routes from connections
+// adminAccess doesn't let through, before any handler sees them.
+func (cfg *apiConfig) adminAccessGuard(access adminAccess, next http.Handler) http.Handler {
+	if !access.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/admin/") {
+			if err := access.check(r); err != nil {
+				cfg.metrics.add("tubely_admin_requests_refused_total", 1)
+				respondWithError(w, http.StatusForbidden, "Admin routes can't be reached from this connection", err)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminClientTLSConfig asks TLS clients for a certificate and verifies any
+// they send against the CAs in caFile. Clients without one can still use
+// the public API; adminAccess turns them away from admin routes.
+func adminClientTLSConfig(caFile string) (*tls.Config, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}, nil
+}
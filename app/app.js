@@ -130,7 +130,7 @@ async function uploadThumbnail(videoID) {
   setUploadButtonState(true, uploadBtnSelector);
 
   try {
-    const res = await fetch(`/api/thumbnail_upload/${videoID}`, {
+    const res = await fetch(`/api/videos/${videoID}/thumbnail`, {
       method: 'POST',
       headers: {
         Authorization: `Bearer ${localStorage.getItem('token')}`,
@@ -158,12 +158,15 @@ async function uploadVideoFile(videoID) {
 
   const formData = new FormData();
   formData.append('video', videoFile);
+  formData.append('trim_dead_air', document.getElementById('trim-dead-air').checked);
+  formData.append('watermark', document.getElementById('watermark').checked);
+  formData.append('encrypt', document.getElementById('encrypt').checked);
 
   uploadBtnSelector = 'upload-video-btn';
   setUploadButtonState(true, uploadBtnSelector);
 
   try {
-    const res = await fetch(`/api/video_upload/${videoID}`, {
+    const res = await fetch(`/api/videos/${videoID}/file`, {
       method: 'POST',
       headers: {
         Authorization: `Bearer ${localStorage.getItem('token')}`,
@@ -268,6 +271,13 @@ function viewVideo(video) {
   if (videoPlayer) {
     if (!video.video_url) {
       videoPlayer.style.display = 'none';
+    } else if (video.encrypted) {
+      // Encrypted videos only play through the signed stream proxy
+      videoPlayer.style.display = 'block';
+      getStreamURL(video.id).then((url) => {
+        videoPlayer.src = url;
+        videoPlayer.load();
+      });
     } else {
       videoPlayer.style.display = 'block';
       videoPlayer.src = video.video_url;
@@ -276,6 +286,20 @@ function viewVideo(video) {
   }
 }
 
+async function getStreamURL(videoID) {
+  const res = await fetch(`/api/videos/${videoID}/stream_url`, {
+    method: 'POST',
+    headers: {
+      Authorization: `Bearer ${localStorage.getItem('token')}`,
+    },
+  });
+  const data = await res.json();
+  if (!res.ok) {
+    throw new Error(`Failed to get stream URL: ${data.error}`);
+  }
+  return data.url;
+}
+
 async function deleteVideo() {
   if (!currentVideo) {
     alert('No video selected for deletion.');
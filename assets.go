@@ -1,12 +1,170 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
 )
 
+// assetShardPrefixLength is how many characters of a filename are decoded
+// to pick its assets subdirectory. Thumbnail filenames are base64 content
+// hashes, and the first byte of the hash, in hex, spreads them evenly over
+// 256 directories.
+const assetShardPrefixLength = 4
+
 func (cfg apiConfig) ensureAssetsDir() error {
 	if _, err := os.Stat(cfg.assetsRoot); os.IsNotExist(err) {
 		return os.Mkdir(cfg.assetsRoot, 0755)
 	}
 	return nil
 }
+
+// ensureDir creates a working directory used by an optional feature.
+func ensureDir(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return os.MkdirAll(path, 0755)
+	}
+	return nil
+}
+
+// syncDir flushes a directory's entries to disk, so a file just renamed
+// into it is still there under its new name after a crash.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// assetPathFromURL maps a thumbnail URL served from the assets base URL, or
+// from /assets before one was configured, back to the file on disk. It
+// reports false for URLs that point anywhere else.
+func (cfg apiConfig) assetPathFromURL(rawURL string) (string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", false
+	}
+	if !strings.HasPrefix(rawURL, cfg.assetsBaseURL+"/") && !strings.HasPrefix(u.Path, "/assets/") {
+		return "", false
+	}
+	name := path.Base(u.Path)
+	if !validAssetName(name) {
+		return "", false
+	}
+	return cfg.assetPath(name), true
+}
+
+// validAssetName reports whether name could be a file this app stored in
+// the assets directory, rather than a path or hidden file.
+func validAssetName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`)
+}
+
+// shardedAssetPath is where a file is stored in the assets directory: under
+// a subdirectory named after the first byte of the content hash its name
+// starts with, like 3f/P9…png, so no one directory grows too large to
+// list. Names that don't start with a hash stay at the top.
+func (cfg apiConfig) shardedAssetPath(name string) string {
+	if len(name) < assetShardPrefixLength {
+		return filepath.Join(cfg.assetsRoot, name)
+	}
+	prefix, err := base64.RawURLEncoding.DecodeString(name[:assetShardPrefixLength])
+	if err != nil {
+		return filepath.Join(cfg.assetsRoot, name)
+	}
+	return filepath.Join(cfg.assetsRoot, hex.EncodeToString(prefix[:1]), name)
+}
+
+// assetPath finds a stored file by name. Files saved before the directory
+// was sharded stay at the top until shardAssets moves them, so that's
+// checked when the sharded path doesn't exist.
+func (cfg apiConfig) assetPath(name string) string {
+	sharded := cfg.shardedAssetPath(name)
+	if _, err := os.Stat(sharded); errors.Is(err, os.ErrNotExist) {
+		flat := filepath.Join(cfg.assetsRoot, name)
+		if _, err := os.Stat(flat); err == nil {
+			return flat
+		}
+	}
+	return sharded
+}
+
+// handlerAsset serves a file from the assets directory by name, wherever
+// in the shards it's stored.
+func (cfg *apiConfig) handlerAsset(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/assets/")
+	if !validAssetName(name) {
+		http.NotFound(w, r)
+		return
+	}
+	if !cfg.validAssetSignature(r) {
+		respondWithError(w, http.StatusForbidden, "Asset URL is unsigned or has expired", nil)
+		return
+	}
+	file, err := os.Open(cfg.assetPath(name))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, name, info.ModTime(), file)
+}
+
+// shardAssets moves files saved at the top of the assets directory, before
+// it was sharded, into their subdirectories. Their URLs don't change. It is
+// safe to run on several nodes sharing the directory at once, and while the
+// files are being served.
+func (cfg *apiConfig) shardAssets() error {
+	entries, err := os.ReadDir(cfg.assetsRoot)
+	if err != nil {
+		return err
+	}
+	moved := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || !validAssetName(name) || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		flat := filepath.Join(cfg.assetsRoot, name)
+		sharded := cfg.shardedAssetPath(name)
+		if sharded == flat {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(sharded), 0755); err != nil {
+			return err
+		}
+		if _, err := os.Stat(sharded); err == nil {
+			// The same content was saved again since; names are hashes
+			if err := os.Remove(flat); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+		if err := os.Rename(flat, sharded); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				// Another node got to it first
+				continue
+			}
+			return err
+		}
+		moved++
+	}
+	if moved > 0 {
+		log.Printf("Moved %d assets into sharded directories", moved)
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// An audio description track narrates what happens on screen for viewers
+// who can't see it. The owner uploads it once; it's kept in the bucket and
+// muxed into the video's file as an extra audio stream, flagged so players
+// list it as descriptions, every time a file is packaged for the video.
+const (
+	maxAudioDescriptionSize   = 200 << 20 // 200 MB
+	audioDescriptionKeyPrefix = "audio_descriptions/"
+	audioDescriptionTitle     = "Audio description"
+)
+
+// audioDescriptionTypes maps the accepted media types of a track to the
+// extension it's stored under.
+var audioDescriptionTypes = map[string]string{
+	"audio/mp4":   ".m4a",
+	"audio/x-m4a": ".m4a",
+	"audio/aac":   ".aac",
+	"audio/mpeg":  ".mp3",
+}
+
+// countAudioStreams reports how many audio streams a file has.
+func countAudioStreams(input string) (int, error) {
+	cmd := mediaCommand("ffprobe",
+		"-v", "error",
+		"-select_streams", "a",
+		"-show_entries", "stream=index",
+		"-of", "csv=p=0",
+		input,
+	)
+	out, err := cmd.Output()
+	recordCommand("audio_description", cmd)
+	if err != nil {
+		return 0, fmt.Errorf("could not run ffprobe: %w", err)
+	}
+	return len(strings.Fields(string(out))), nil
+}
+
+// muxAudioDescription writes a copy of the video with the first audio
+// stream of trackPath added as its last audio stream. With replace, the
+// video's own last audio stream, an earlier description, is left out. Only
+// the description is encoded; everything else is copied.
+func muxAudioDescription(videoPath, trackPath string, replace bool) (string, error) {
+	streams, err := countAudioStreams(videoPath)
+	if err != nil {
+		return "", err
+	}
+	args := []string{"-y", "-i", videoPath, "-i", trackPath, "-map", "0"}
+	if replace && streams > 0 {
+		streams--
+		args = append(args, "-map", "-0:a:"+strconv.Itoa(streams))
+	}
+	index := strconv.Itoa(streams)
+	outputPath := videoPath + ".described.mp4"
+	args = append(args,
+		"-map", "1:a:0",
+		"-c", "copy",
+		"-c:a:"+index, "aac",
+		"-disposition:a:"+index, "descriptions",
+		"-metadata:s:a:"+index, "title="+audioDescriptionTitle,
+		"-f", "mp4",
+		outputPath,
+	)
+	if err := runFFmpeg("audio_description", args...); err != nil {
+		os.Remove(outputPath)
+		return "", err
+	}
+	return outputPath, nil
+}
+
+// removeAudioDescription writes a copy of the video without its last audio
+// stream, which is where muxAudioDescription puts the description.
+func removeAudioDescription(videoPath string) (string, error) {
+	streams, err := countAudioStreams(videoPath)
+	if err != nil {
+		return "", err
+	}
+	if streams == 0 {
+		return videoPath, nil
+	}
+	outputPath := videoPath + ".undescribed.mp4"
+	err = runFFmpeg("audio_description",
+		"-y",
+		"-i", videoPath,
+		"-map", "0",
+		"-map", "-0:a:"+strconv.Itoa(streams-1),
+		"-c", "copy",
+		"-f", "mp4",
+		outputPath,
+	)
+	if err != nil {
+		os.Remove(outputPath)
+		return "", err
+	}
+	return outputPath, nil
+}
+
+// repackageVideo downloads the video's file, runs it through transform and
+// stores the result as the video's new file, encrypted with a fresh data
+// key if the old one was. The caller saves the returned video.
+func (cfg *apiConfig) repackageVideo(ctx context.Context, video database.Video, transform func(string) (string, error)) (database.Video, error) {
+	input, err := cfg.videoGetObjectInput(ctx, video)
+	if err != nil {
+		return database.Video{}, err
+	}
+	filePath, err := cfg.downloadObject(ctx, input)
+	if err != nil {
+		return database.Video{}, err
+	}
+	defer os.Remove(filePath)
+	outputPath, err := transform(filePath)
+	if err != nil {
+		return database.Video{}, err
+	}
+	if outputPath != filePath {
+		defer os.Remove(outputPath)
+	}
+
+	var sseKey *sseCustomerKey
+	var wrappedKey []byte
+	if video.Encrypted {
+		var dataKey []byte
+		dataKey, wrappedKey, err = cfg.newDataKey(ctx)
+		if err != nil {
+			return database.Video{}, err
+		}
+		sseKey = newSSECustomerKey(dataKey)
+	}
+	stored, err := cfg.storeVideo(ctx, outputPath, videoObjectNameOf(video), sseKey)
+	if err != nil {
+		return database.Video{}, err
+	}
+	if video.Encrypted {
+		if err := cfg.db.PutVideoKey(video.ID, stored.key, wrappedKey); err != nil {
+			return database.Video{}, err
+		}
+	} else {
+		videoURL := cfg.videoDeliveryURL(stored.key)
+		video.VideoURL = &videoURL
+	}
+	stored.describe(&video)
+	cfg.recordStoredVideo(video, video.UserID, stored, wrappedKey)
+	return video, nil
+}
+
+// audioDescriptionVideo loads the video an audio description request is
+// about and checks the caller may edit it. It responds and reports false on
+// failure.
+func (cfg *apiConfig) audioDescriptionVideo(w http.ResponseWriter, r *http.Request) (database.Video, uuid.UUID, bool) {
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
+		return database.Video{}, uuid.Nil, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.Video{}, uuid.Nil, false
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return database.Video{}, uuid.Nil, false
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return database.Video{}, uuid.Nil, false
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return database.Video{}, uuid.Nil, false
+	}
+	allowed, err := cfg.canAccessVideo(userID, video, permEdit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video permissions", err)
+		return database.Video{}, uuid.Nil, false
+	}
+	if !allowed {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return database.Video{}, uuid.Nil, false
+	}
+	return video, userID, true
+}
+
+// handlerAudioDescriptionUpload sets a video's audio description track,
+// replacing any earlier one. A video that already has a file gets it muxed
+// in right away; otherwise it's muxed into the first upload.
+func (cfg *apiConfig) handlerAudioDescriptionUpload(w http.ResponseWriter, r *http.Request) {
+	video, userID, ok := cfg.audioDescriptionVideo(w, r)
+	if !ok {
+		return
+	}
+
+	mediaTypes := slices.Sorted(maps.Keys(audioDescriptionTypes))
+	file, mediaType, ok := streamFormFile(w, r, "audio", maxAudioDescriptionSize, nil, mediaTypes...)
+	if !ok {
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	streams, err := countAudioStreams(file.Name())
+	if err != nil || streams == 0 {
+		respondWithValidationError(w, map[string]string{"audio": "must be an audio file"}, err)
+		return
+	}
+
+	release, err := cfg.processing.acquire(r.Context(), userID, priorityInteractive)
+	if err != nil {
+		respondWithError(w, http.StatusServiceUnavailable, "Gave up waiting for a processing slot", err)
+		return
+	}
+	defer release()
+
+	repackaged := video.VideoURL != nil
+	if repackaged {
+		replace := video.AudioDescriptionKey != nil
+		video, err = cfg.repackageVideo(r.Context(), video, func(filePath string) (string, error) {
+			return muxAudioDescription(filePath, file.Name(), replace)
+		})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't add audio description to video", err)
+			return
+		}
+	}
+
+	key := audioDescriptionKeyPrefix + video.ID.String() + audioDescriptionTypes[mediaType]
+	_, err = cfg.s3Client.PutObject(r.Context(), &s3.PutObjectInput{
+		Bucket:      &cfg.s3Bucket,
+		Key:         &key,
+		Body:        file,
+		ContentType: &mediaType,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't store audio description", err)
+		return
+	}
+	previousKey := video.AudioDescriptionKey
+	video.AudioDescriptionKey = &key
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	if previousKey != nil && *previousKey != key {
+		cfg.deleteAudioDescriptionTrack(r.Context(), *previousKey)
+	}
+
+	video, err = cfg.db.GetVideo(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if repackaged {
+		cfg.recordVideoEvent(video, database.VideoEventProcessed, userID, processedEventPayload(video))
+	}
+	cfg.signVideoAssets(&video)
+	respondWithJSON(w, http.StatusOK, video)
+}
+
+// handlerAudioDescriptionDelete removes a video's audio description track,
+// from its file too.
+func (cfg *apiConfig) handlerAudioDescriptionDelete(w http.ResponseWriter, r *http.Request) {
+	video, userID, ok := cfg.audioDescriptionVideo(w, r)
+	if !ok {
+		return
+	}
+	if video.AudioDescriptionKey == nil {
+		respondWithError(w, http.StatusNotFound, "Video has no audio description", nil)
+		return
+	}
+
+	repackaged := video.VideoURL != nil
+	if repackaged {
+		release, err := cfg.processing.acquire(r.Context(), userID, priorityInteractive)
+		if err != nil {
+			respondWithError(w, http.StatusServiceUnavailable, "Gave up waiting for a processing slot", err)
+			return
+		}
+		defer release()
+		video, err = cfg.repackageVideo(r.Context(), video, removeAudioDescription)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't remove audio description from video", err)
+			return
+		}
+	}
+
+	key := *video.AudioDescriptionKey
+	video.AudioDescriptionKey = nil
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	cfg.deleteAudioDescriptionTrack(r.Context(), key)
+
+	video, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if repackaged {
+		cfg.recordVideoEvent(video, database.VideoEventProcessed, userID, processedEventPayload(video))
+	}
+	cfg.signVideoAssets(&video)
+	respondWithJSON(w, http.StatusOK, video)
+}
+
+// deleteAudioDescriptionTrack deletes a track the video no longer uses. A
+// leftover track only costs storage, so failures are just logged.
+func (cfg *apiConfig) deleteAudioDescriptionTrack(ctx context.Context, key string) {
+	if err := cfg.deleteS3ObjectVerified(ctx, key); err != nil {
+		log.Printf("Couldn't delete audio description track %s: %v", key, err)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// autoThumbnailAt is how far into a video, as a fraction of its duration,
+// its automatic thumbnail is taken unless the owner picked a poster time;
+// the first frames are often black.
+const autoThumbnailAt = 0.1
+
+var (
+	errNoVideoFile        = errors.New("video has no uploaded file")
+	errEncryptedThumbnail = errors.New("thumbnails can't be taken from encrypted videos")
+)
+
+// posterTime is where the automatic thumbnail of video is taken from.
+func posterTime(video database.Video) float64 {
+	if video.PosterTimeSeconds != nil {
+		return *video.PosterTimeSeconds
+	}
+	if video.DurationSeconds != nil {
+		return *video.DurationSeconds * autoThumbnailAt
+	}
+	return 0
+}
+
+// enqueueAutoThumbnail queues a job that makes a frame of the video its
+// thumbnail.
+func (cfg *apiConfig) enqueueAutoThumbnail(video database.Video, userID uuid.UUID) (database.Job, error) {
+	job, err := cfg.db.EnqueueJob(database.JobKindAutoThumbnail, video.ID, userID, int(priorityBackground))
+	if err != nil {
+		return database.Job{}, err
+	}
+	cfg.metrics.add(`tubely_jobs_enqueued_total{kind="`+database.JobKindAutoThumbnail+`"}`, 1)
+	return job, nil
+}
+
+// setAutoThumbnail takes the frame at the video's poster time from its
+// stored file and makes it the video's thumbnail, replacing whatever
+// thumbnail it had. The same frame gives the same thumbnail, so running it
+// again changes nothing unless the poster time or the file did.
+func (cfg *apiConfig) setAutoThumbnail(ctx context.Context, video database.Video, userID uuid.UUID) error {
+	if video.VideoURL == nil {
+		return errNoVideoFile
+	}
+	if video.Encrypted {
+		return errEncryptedThumbnail
+	}
+	sourceKey, err := cfg.videoObjectKey(video)
+	if err != nil {
+		return err
+	}
+	sourceURL, err := cfg.presignGetObject(ctx, sourceKey, 5*time.Minute)
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "tubely-auto-thumbnail-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	framePath := filepath.Join(dir, "frame.jpg")
+	if err := extractFrame(sourceURL, posterTime(video), framePath); err != nil {
+		return err
+	}
+	frame, err := os.Open(framePath)
+	if err != nil {
+		return err
+	}
+	defer frame.Close()
+
+	superseded, changed, err := cfg.setVideoThumbnail(ctx, &video, frame, ".jpg")
+	if err != nil || !changed {
+		return err
+	}
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		return err
+	}
+	cfg.recordVideoEvent(video, database.VideoEventThumbnailChanged, userID, map[string]any{"thumbnail_url": video.ThumbnailURL})
+	for _, previousURL := range superseded {
+		cfg.removeUnusedThumbnail(previousURL)
+	}
+	return nil
+}
+
+// runAutoThumbnailJob sets the automatic thumbnail of the job's video. A
+// video that was deleted in the meantime leaves nothing to do.
+func (cfg *apiConfig) runAutoThumbnailJob(ctx context.Context, job database.Job) string {
+	video, err := cfg.db.GetVideo(job.SubjectID)
+	if err != nil {
+		return cfg.retryOrFailJob(ctx, job, database.UploadSession{}, &uploadError{msg: "Couldn't get video", err: err, retryable: true})
+	}
+	if video.ID != uuid.Nil {
+		err = cfg.setAutoThumbnail(ctx, video, job.UserID)
+	}
+	if err != nil {
+		retryable := !errors.Is(err, errNoVideoFile) && !errors.Is(err, errEncryptedThumbnail) && !errors.Is(err, errFrameOutOfRange)
+		return cfg.retryOrFailJob(ctx, job, database.UploadSession{}, &uploadError{msg: "Couldn't take thumbnail from video", err: err, retryable: retryable})
+	}
+	if err := cfg.db.CompleteJob(job.ID); err != nil {
+		log.Printf("Couldn't mark job %s completed: %v", job.ID, err)
+	}
+	return "completed"
+}
+
+// handlerVideoPosterTimeUpdate sets where in the video its automatic
+// thumbnail is taken from, or with null goes back to the server's choice,
+// and queues a job to take it again. The new thumbnail replaces the
+// current one, even if it was uploaded.
+func (cfg *apiConfig) handlerVideoPosterTimeUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		PosterTimeSeconds *float64 `json:"poster_time_seconds" validate:"min=0"`
+	}
+	type response struct {
+		Video database.Video `json:"video"`
+		JobID *uuid.UUID     `json:"job_id"`
+	}
+
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	allowed, err := cfg.canAccessVideo(userID, video, permEdit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video permissions", err)
+		return
+	}
+	if !allowed {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if params.PosterTimeSeconds != nil && video.DurationSeconds != nil && *params.PosterTimeSeconds >= *video.DurationSeconds {
+		respondWithValidationError(w, map[string]string{
+			"poster_time_seconds": fmt.Sprintf("must be before the end of the video, at %.3f seconds", *video.DurationSeconds),
+		}, nil)
+		return
+	}
+	if video.Encrypted {
+		respondWithError(w, http.StatusBadRequest, errEncryptedThumbnail.Error(), nil)
+		return
+	}
+
+	resp := response{Video: video}
+	unchanged := (params.PosterTimeSeconds == nil && video.PosterTimeSeconds == nil) ||
+		(params.PosterTimeSeconds != nil && video.PosterTimeSeconds != nil && *params.PosterTimeSeconds == *video.PosterTimeSeconds)
+	if unchanged {
+		cfg.signVideoAssets(&resp.Video)
+		respondWithJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	video.PosterTimeSeconds = params.PosterTimeSeconds
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	// Without a file yet, the poster time is used once one is uploaded
+	if video.VideoURL != nil {
+		job, err := cfg.enqueueAutoThumbnail(video, userID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't queue thumbnail job", err)
+			return
+		}
+		resp.JobID = &job.ID
+	}
+
+	resp.Video, err = cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	cfg.signVideoAssets(&resp.Video)
+	respondWithJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	// backupPrefix is where database backups are kept in the bucket. Keys
+	// are named for when the backup was taken, so they sort oldest first.
+	backupPrefix = "backups/"
+	// backupTimeFormat is filesystem- and URL-safe, and sorts by time.
+	backupTimeFormat = "20060102T150405.000Z"
+
+	// Object metadata recorded with each backup
+	backupMetaWrappedKey = "wrapped-key"
+	backupMetaSHA256     = "sha256"
+)
+
+type backupInfo struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// backupDatabase snapshots the database, uploads the snapshot encrypted
+// with a fresh SSE-C data key and deletes all but the newest retain
+// backups. The data key is wrapped like a video's and kept in the object's
+// metadata, so a backup can be restored without the database it came from.
+func (cfg *apiConfig) backupDatabase(ctx context.Context, retain int) (backupInfo, error) {
+	dir, err := os.MkdirTemp("", "tubely-backup-*")
+	if err != nil {
+		return backupInfo{}, err
+	}
+	defer os.RemoveAll(dir)
+	snapshotPath := filepath.Join(dir, "tubely.db")
+
+	start := time.Now()
+	if err := cfg.db.Snapshot(snapshotPath); err != nil {
+		return backupInfo{}, fmt.Errorf("couldn't snapshot database: %w", err)
+	}
+	file, err := os.Open(snapshotPath)
+	if err != nil {
+		return backupInfo{}, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return backupInfo{}, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return backupInfo{}, err
+	}
+
+	dataKey, wrappedKey, err := cfg.newDataKey(ctx)
+	if err != nil {
+		return backupInfo{}, err
+	}
+	key := backupPrefix + "tubely-" + start.UTC().Format(backupTimeFormat) + ".db"
+	contentType := "application/vnd.sqlite3"
+	input := &s3.PutObjectInput{
+		Bucket:      &cfg.s3Bucket,
+		Key:         &key,
+		ContentType: &contentType,
+		Metadata: map[string]string{
+			backupMetaWrappedKey: base64.StdEncoding.EncodeToString(wrappedKey),
+			backupMetaSHA256:     hex.EncodeToString(hash.Sum(nil)),
+		},
+	}
+	newSSECustomerKey(dataKey).applyToPut(input)
+	if err := cfg.putObjectFromFile(ctx, input, file); err != nil {
+		return backupInfo{}, fmt.Errorf("couldn't upload backup: %w", err)
+	}
+	cfg.metrics.add("tubely_db_backups_total", 1)
+	cfg.metrics.set("tubely_db_backup_bytes", float64(size))
+	cfg.metrics.set("tubely_db_backup_last_success_timestamp_seconds", float64(time.Now().Unix()))
+	log.Printf("Backed up database to %s: %d bytes in %s", key, size, time.Since(start).Round(time.Millisecond))
+
+	if err := cfg.rotateBackups(ctx, retain); err != nil {
+		log.Printf("Couldn't delete old backups: %v", err)
+	}
+	return backupInfo{Key: key, Size: size, LastModified: start.UTC()}, nil
+}
+
+// listBackups returns the backups in the bucket, oldest first.
+func (cfg *apiConfig) listBackups(ctx context.Context) ([]backupInfo, error) {
+	prefix := backupPrefix
+	var backups []backupInfo
+	paginator := s3.NewListObjectsV2Paginator(cfg.s3Client, &s3.ListObjectsV2Input{
+		Bucket: &cfg.s3Bucket,
+		Prefix: &prefix,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			if obj.Key == nil || !strings.HasSuffix(*obj.Key, ".db") {
+				continue
+			}
+			backup := backupInfo{Key: *obj.Key}
+			if obj.Size != nil {
+				backup.Size = *obj.Size
+			}
+			if obj.LastModified != nil {
+				backup.LastModified = *obj.LastModified
+			}
+			backups = append(backups, backup)
+		}
+	}
+	slices.SortFunc(backups, func(a, b backupInfo) int { return strings.Compare(a.Key, b.Key) })
+	return backups, nil
+}
+
+// rotateBackups deletes all but the newest retain backups.
+func (cfg *apiConfig) rotateBackups(ctx context.Context, retain int) error {
+	backups, err := cfg.listBackups(ctx)
+	if err != nil {
+		return err
+	}
+	if len(backups) <= retain {
+		return nil
+	}
+	for _, backup := range backups[:len(backups)-retain] {
+		_, err := cfg.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: &cfg.s3Bucket, Key: &backup.Key})
+		if err != nil {
+			return fmt.Errorf("couldn't delete backup %s: %w", backup.Key, err)
+		}
+		log.Printf("Deleted old backup %s", backup.Key)
+	}
+	return nil
+}
+
+// restoreBackup downloads a backup, checks it decrypts to the database
+// that was uploaded and replaces the database at pathToDB with it. The old
+// database is kept next to it. Every node must be stopped while it runs.
+func (cfg *apiConfig) restoreBackup(ctx context.Context, key, pathToDB string) (string, error) {
+	if key == "latest" {
+		backups, err := cfg.listBackups(ctx)
+		if err != nil {
+			return "", err
+		}
+		if len(backups) == 0 {
+			return "", errors.New("there are no backups")
+		}
+		key = backups[len(backups)-1].Key
+	}
+	if cfg.keyWrapper == nil {
+		return "", errEncryptionDisabled
+	}
+
+	head, err := cfg.s3Client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &cfg.s3Bucket, Key: &key})
+	if err != nil {
+		return "", fmt.Errorf("couldn't find backup %s: %w", key, err)
+	}
+	wrappedKey, err := base64.StdEncoding.DecodeString(head.Metadata[backupMetaWrappedKey])
+	if err != nil || len(wrappedKey) == 0 {
+		return "", fmt.Errorf("backup %s has no usable data key", key)
+	}
+	dataKey, err := cfg.keyWrapper.Unwrap(ctx, wrappedKey)
+	if err != nil {
+		return "", fmt.Errorf("couldn't unwrap the data key of backup %s, check the encryption key is the one it was taken with: %w", key, err)
+	}
+	input := &s3.GetObjectInput{Bucket: &cfg.s3Bucket, Key: &key}
+	newSSECustomerKey(dataKey).applyToGet(input)
+	out, err := cfg.s3Client.GetObject(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("couldn't download backup %s: %w", key, err)
+	}
+	defer out.Body.Close()
+
+	// The download goes next to the database so the final rename doesn't
+	// cross filesystems
+	restored, err := os.CreateTemp(filepath.Dir(pathToDB), ".tubely-restore-*.db")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(restored.Name())
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(restored, hash), out.Body)
+	if closeErr := restored.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("couldn't download backup %s: %w", key, err)
+	}
+	if want := head.Metadata[backupMetaSHA256]; want != "" && want != hex.EncodeToString(hash.Sum(nil)) {
+		return "", fmt.Errorf("backup %s doesn't match its checksum", key)
+	}
+	if err := checkSQLiteIntegrity(restored.Name()); err != nil {
+		return "", fmt.Errorf("backup %s is damaged: %w", key, err)
+	}
+
+	// Keep the database being replaced, with its WAL, in case the wrong
+	// backup was picked
+	if err := cfg.db.Close(); err != nil {
+		return "", err
+	}
+	keptPath := pathToDB + ".before-restore-" + time.Now().UTC().Format(backupTimeFormat)
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.Rename(pathToDB+suffix, keptPath+suffix); err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	if err := os.Rename(restored.Name(), pathToDB); err != nil {
+		return "", err
+	}
+	return keptPath, nil
+}
+
+// checkSQLiteIntegrity opens a database file read-only and runs SQLite's
+// own consistency check on it.
+func checkSQLiteIntegrity(path string) error {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var result string
+	if err := db.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return err
+	}
+	if result != "ok" {
+		return errors.New(result)
+	}
+	return nil
+}
+
+// runRestoreCommand restores the database from a backup and exits; see
+// restoreBackup.
+func (cfg *apiConfig) runRestoreCommand(key, pathToDB string) {
+	keptPath, err := cfg.restoreBackup(context.Background(), key, pathToDB)
+	if err != nil {
+		log.Fatalf("Couldn't restore backup: %v", err)
+	}
+	log.Printf("Restored %s from backup; the previous database was moved to %s", pathToDB, keptPath)
+}
+
+func (cfg *apiConfig) handlerBackupsRetrieve(w http.ResponseWriter, r *http.Request) {
+	if _, ok := cfg.authenticateAdmin(w, r); !ok {
+		return
+	}
+
+	backups, err := cfg.listBackups(r.Context())
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't list backups", err)
+		return
+	}
+	if backups == nil {
+		backups = []backupInfo{}
+	}
+	respondWithJSON(w, http.StatusOK, backups)
+}
+
+// handlerBackupCreate takes a backup right away, for example before an
+// upgrade, on top of the scheduled ones.
+func (cfg *apiConfig) handlerBackupCreate(w http.ResponseWriter, r *http.Request) {
+	adminID, ok := cfg.authenticateAdmin(w, r)
+	if !ok {
+		return
+	}
+	if cfg.keyWrapper == nil {
+		respondWithError(w, http.StatusConflict, "Backups need encryption at rest to be configured", nil)
+		return
+	}
+
+	backup, err := cfg.backupDatabase(r.Context(), cfg.backupRetain)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't back up database", err)
+		return
+	}
+	err = cfg.db.CreateAuditEntry(database.AuditEntry{
+		ActorID: &adminID,
+		Action:  "database_backup_created",
+		Details: backup.Key,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write audit entry", err)
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, backup)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// bandwidthLimits holds per-connection transfer caps in bytes per second.
+// Zero means unlimited.
+type bandwidthLimits struct {
+	defaultRate int64
+	tiers       map[string]int64
+}
+
+// parseBandwidthLimits reads the global default and a "tier=rate,..." list of
+// per-tier overrides.
+func parseBandwidthLimits(defaultSpec, tierSpec string) (bandwidthLimits, error) {
+	limits := bandwidthLimits{tiers: map[string]int64{}}
+	if defaultSpec != "" {
+		rate, err := strconv.ParseInt(defaultSpec, 10, 64)
+		if err != nil || rate < 0 {
+			return bandwidthLimits{}, fmt.Errorf("invalid bandwidth limit %q", defaultSpec)
+		}
+		limits.defaultRate = rate
+	}
+	for _, entry := range strings.Split(tierSpec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		tier, rateString, ok := strings.Cut(entry, "=")
+		rate, err := strconv.ParseInt(strings.TrimSpace(rateString), 10, 64)
+		if !ok || err != nil || rate < 0 {
+			return bandwidthLimits{}, fmt.Errorf("invalid tier bandwidth limit %q", entry)
+		}
+		limits.tiers[strings.TrimSpace(tier)] = rate
+	}
+	return limits, nil
+}
+
+func (b bandwidthLimits) forTier(tier string) int64 {
+	if rate, ok := b.tiers[tier]; ok {
+		return rate
+	}
+	return b.defaultRate
+}
+
+// userBandwidth looks up the transfer cap that applies to a user's
+// connections. Lookup failures fall back to the default rather than failing
+// the request over a throttling detail.
+func (cfg *apiConfig) userBandwidth(userID uuid.UUID) int64 {
+	user, err := cfg.db.GetUser(userID)
+	if err != nil || user == nil {
+		return cfg.bandwidth.defaultRate
+	}
+	return cfg.bandwidth.forTier(user.Tier)
+}
+
+// byteThrottle is a token bucket counted in bytes, refilled at rate bytes
+// per second and holding at most one second's worth.
+type byteThrottle struct {
+	rate     int64
+	tokens   float64
+	lastSeen time.Time
+}
+
+func newByteThrottle(rate int64) *byteThrottle {
+	return &byteThrottle{rate: rate, tokens: float64(rate), lastSeen: time.Now()}
+}
+
+// wait blocks until n bytes may be transferred.
+func (t *byteThrottle) wait(n int) {
+	now := time.Now()
+	t.tokens = min(float64(t.rate), t.tokens+now.Sub(t.lastSeen).Seconds()*float64(t.rate))
+	t.lastSeen = now
+	t.tokens -= float64(n)
+	if t.tokens < 0 {
+		time.Sleep(time.Duration(-t.tokens / float64(t.rate) * float64(time.Second)))
+	}
+}
+
+// chunk caps a single read or write so one call can't overdraw the bucket
+// by more than a second of transfer.
+func (t *byteThrottle) chunk(n int) int {
+	return int(min(int64(n), t.rate))
+}
+
+type throttledReadCloser struct {
+	io.ReadCloser
+	throttle *byteThrottle
+}
+
+func (r *throttledReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p[:r.throttle.chunk(len(p))])
+	r.throttle.wait(n)
+	return n, err
+}
+
+type throttledWriter struct {
+	io.Writer
+	throttle *byteThrottle
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p[:w.throttle.chunk(len(p))]
+		w.throttle.wait(len(chunk))
+		n, err := w.Writer.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// throttleBody limits how fast a request body is read. A zero rate leaves it
+// untouched.
+func throttleBody(body io.ReadCloser, rate int64) io.ReadCloser {
+	if rate <= 0 {
+		return body
+	}
+	return &throttledReadCloser{ReadCloser: body, throttle: newByteThrottle(rate)}
+}
+
+// throttleResponse limits how fast a response is written. A zero rate
+// leaves it untouched.
+func throttleResponse(w http.ResponseWriter, rate int64) io.Writer {
+	if rate <= 0 {
+		return w
+	}
+	return &throttledWriter{Writer: w, throttle: newByteThrottle(rate)}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// A bucket import onboards an existing library: it walks the MP4s under a
+// prefix, in key order, and puts each through the upload pipeline as a new
+// video of one user, with a thumbnail taken from the video itself. Like the
+// thumbnail migration it remembers how far it got, and objects it already
+// imported are skipped, so running it again only picks up what's new.
+const (
+	bucketImportIdle      = "idle"
+	bucketImportRunning   = "running"
+	bucketImportPaused    = "paused"
+	bucketImportCompleted = "completed"
+
+	bucketImportStateKey    = "bucket_import:state"
+	bucketImportProgressKey = "bucket_import:progress"
+
+	// bucketImportInterval is how often the task checks whether an import
+	// is running. Each run works for most of an interval, but always
+	// finishes the object it's on.
+	bucketImportInterval = 10 * time.Second
+)
+
+// Outcomes of importing one object
+const (
+	importImported = "imported"
+	importSkipped  = "skipped"
+	importFailed   = "failed"
+)
+
+type bucketImportProgress struct {
+	Bucket string    `json:"bucket"`
+	Prefix string    `json:"prefix"`
+	UserID uuid.UUID `json:"user_id"`
+	// Cursor is the last key dealt with
+	Cursor    string    `json:"cursor"`
+	Imported  int       `json:"imported"`
+	Skipped   int       `json:"skipped"`
+	Failed    int       `json:"failed"`
+	LastError string    `json:"last_error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type bucketImportStatus struct {
+	State string `json:"state"`
+	bucketImportProgress
+}
+
+func (cfg *apiConfig) bucketImportStatus() (bucketImportStatus, error) {
+	status := bucketImportStatus{State: bucketImportIdle}
+	state, found, err := cfg.db.GetSetting(bucketImportStateKey)
+	if err != nil {
+		return status, err
+	}
+	if found {
+		status.State = state
+	}
+	value, found, err := cfg.db.GetSetting(bucketImportProgressKey)
+	if err != nil {
+		return status, err
+	}
+	if found {
+		if err := json.Unmarshal([]byte(value), &status.bucketImportProgress); err != nil {
+			return status, fmt.Errorf("invalid bucket import progress: %w", err)
+		}
+	}
+	return status, nil
+}
+
+func (cfg *apiConfig) saveBucketImportProgress(progress bucketImportProgress) error {
+	progress.UpdatedAt = time.Now().UTC()
+	value, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	return cfg.db.PutSetting(bucketImportProgressKey, string(value))
+}
+
+// importBucket is the import's periodic task. It works for up to budget
+// and stops early as soon as an admin pauses the import.
+func (cfg *apiConfig) importBucket(ctx context.Context, budget time.Duration) error {
+	status, err := cfg.bucketImportStatus()
+	if err != nil || status.State != bucketImportRunning {
+		return err
+	}
+	progress := status.bucketImportProgress
+
+	deadline := time.Now().Add(budget)
+	keepGoing := func() (bool, error) {
+		if !time.Now().Before(deadline) || ctx.Err() != nil {
+			return false, nil
+		}
+		state, _, err := cfg.db.GetSetting(bucketImportStateKey)
+		return state == bucketImportRunning, err
+	}
+	done, err := cfg.runBucketImport(ctx, &progress, keepGoing, cfg.saveBucketImportProgress)
+	if err != nil || !done {
+		return err
+	}
+	log.Printf("Bucket import of s3://%s/%s completed: %d imported, %d skipped, %d failed",
+		progress.Bucket, progress.Prefix, progress.Imported, progress.Skipped, progress.Failed)
+	return cfg.db.PutSetting(bucketImportStateKey, bucketImportCompleted)
+}
+
+// runBucketImport imports the objects after progress.Cursor one at a time,
+// calling save after each, for as long as keepGoing allows. It reports
+// whether it reached the end of the listing.
+func (cfg *apiConfig) runBucketImport(ctx context.Context, progress *bucketImportProgress, keepGoing func() (bool, error), save func(bucketImportProgress) error) (bool, error) {
+	input := &s3.ListObjectsV2Input{Bucket: &progress.Bucket, Prefix: &progress.Prefix}
+	if progress.Cursor != "" {
+		input.StartAfter = &progress.Cursor
+	}
+	paginator := s3.NewListObjectsV2Paginator(cfg.s3Client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return false, fmt.Errorf("couldn't list s3://%s/%s: %w", progress.Bucket, progress.Prefix, err)
+		}
+		for _, obj := range page.Contents {
+			ok, err := keepGoing()
+			if err != nil || !ok {
+				return false, err
+			}
+
+			outcome, videoID, err := cfg.importObject(ctx, progress.Bucket, obj, progress.UserID)
+			cfg.metrics.add(`tubely_bucket_import_objects_total{result="`+outcome+`"}`, 1)
+			switch outcome {
+			case importImported:
+				progress.Imported++
+				log.Printf("Imported s3://%s/%s as video %s", progress.Bucket, *obj.Key, videoID)
+			case importSkipped:
+				progress.Skipped++
+			case importFailed:
+				progress.Failed++
+				progress.LastError = fmt.Sprintf("%s: %v", *obj.Key, err)
+				log.Printf("Couldn't import s3://%s/%s: %v", progress.Bucket, *obj.Key, err)
+			}
+			progress.Cursor = *obj.Key
+			if err := save(*progress); err != nil {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
+
+// importObject turns one object into a video of userID. Objects that aren't
+// MP4s, were imported before or belong to the app itself are skipped.
+func (cfg *apiConfig) importObject(ctx context.Context, bucket string, obj types.Object, userID uuid.UUID) (string, uuid.UUID, error) {
+	key := *obj.Key
+	ext := strings.ToLower(path.Ext(key))
+	if ext != ".mp4" && ext != ".m4v" && ext != ".mov" {
+		return importSkipped, uuid.Nil, nil
+	}
+	if bucket == cfg.s3Bucket && (mediaKey(key) || strings.HasPrefix(key, backupPrefix)) {
+		return importSkipped, uuid.Nil, nil
+	}
+	var etag string
+	if obj.ETag != nil {
+		etag = *obj.ETag
+	}
+	previous, err := cfg.db.GetVideoImport(bucket, key)
+	if err != nil {
+		return importFailed, uuid.Nil, err
+	}
+	if previous.VideoID != uuid.Nil && previous.ETag == etag {
+		return importSkipped, uuid.Nil, nil
+	}
+
+	// 1. Probe the start of the object, so files that aren't videos, or
+	// that would be refused anyway, aren't downloaded in full
+	headRange := fmt.Sprintf("bytes=0-%d", maxProbeSize-1)
+	headPath, err := cfg.downloadObject(ctx, &s3.GetObjectInput{Bucket: &bucket, Key: &key, Range: &headRange})
+	if err != nil {
+		return importFailed, uuid.Nil, err
+	}
+	defer os.Remove(headPath)
+	contentType, err := sniffFileContentType(headPath)
+	if err != nil {
+		return importFailed, uuid.Nil, err
+	}
+	if contentType != "video/mp4" && contentType != "video/quicktime" {
+		return importSkipped, uuid.Nil, nil
+	}
+	// A head that doesn't describe the streams just means the moov box is
+	// at the end; the pipeline checks the whole file again either way
+	info, err := cfg.probeStreamInfo(headPath)
+	if errors.Is(err, errNoVideoStream) {
+		return importFailed, uuid.Nil, errors.New("file doesn't contain a video stream")
+	}
+	if err == nil {
+		if err := cfg.checkStreamInfo(info); err != nil {
+			return importFailed, uuid.Nil, err
+		}
+	}
+
+	// 2. Download it and put it through the pipeline as a new video
+	filePath, err := cfg.downloadObject(ctx, &s3.GetObjectInput{Bucket: &bucket, Key: &key})
+	if err != nil {
+		return importFailed, uuid.Nil, err
+	}
+	defer os.Remove(filePath)
+
+	created, err := cfg.createVideo(database.CreateVideoParams{
+		Title:  strings.TrimSuffix(path.Base(key), path.Ext(key)),
+		UserID: userID,
+	}, "", uuid.Nil, map[string]any{"imported_from": "s3://" + bucket + "/" + key})
+	if err != nil {
+		return importFailed, uuid.Nil, err
+	}
+
+	release, err := cfg.processing.acquire(ctx, userID, priorityBackground)
+	if err != nil {
+		cfg.discardImportedVideo(created)
+		return importFailed, uuid.Nil, err
+	}
+	video, err := cfg.processVideoUpload(ctx, created, userID, filePath, path.Base(key), database.UploadOptions{})
+	release()
+	if err != nil {
+		cfg.discardImportedVideo(created)
+		return importFailed, uuid.Nil, err
+	}
+
+	// 3. The video stands without a thumbnail; one can be uploaded later
+	if _, err := cfg.enqueueAutoThumbnail(video, userID); err != nil {
+		log.Printf("Couldn't queue a thumbnail for imported video %s: %v", video.ID, err)
+	}
+
+	err = cfg.db.PutVideoImport(database.VideoImport{Bucket: bucket, S3Key: key, ETag: etag, VideoID: video.ID})
+	if err != nil {
+		return importFailed, video.ID, err
+	}
+	return importImported, video.ID, nil
+}
+
+// discardImportedVideo removes the record of a video whose import failed,
+// so the next run's retry doesn't leave a second one behind.
+func (cfg *apiConfig) discardImportedVideo(video database.Video) {
+	if err := cfg.db.DeleteVideo(video.ID); err != nil {
+		log.Printf("Couldn't remove video %s after its import failed: %v", video.ID, err)
+	}
+}
+
+// parseImportSource splits s3://bucket/prefix, or bucket/prefix, into its
+// parts.
+func parseImportSource(source string) (string, string, error) {
+	source = strings.TrimPrefix(source, "s3://")
+	bucket, prefix, _ := strings.Cut(source, "/")
+	if bucket == "" {
+		return "", "", errors.New("source must be s3://bucket/prefix")
+	}
+	return bucket, prefix, nil
+}
+
+// runImportCommand imports a whole bucket prefix for the user with the
+// given email and exits. It keeps its progress to itself, so it can run
+// alongside an import started through the admin API.
+func (cfg *apiConfig) runImportCommand(source, email string) {
+	bucket, prefix, err := parseImportSource(source)
+	if err != nil {
+		log.Fatalf("Invalid -import: %v", err)
+	}
+	if email == "" {
+		log.Fatal("-import needs -import-user, the email of the account the videos will belong to")
+	}
+	user, err := cfg.db.GetUserByEmail(email)
+	if err != nil {
+		log.Fatalf("Couldn't get user: %v", err)
+	}
+	if user.ID == uuid.Nil {
+		log.Fatalf("There is no user with email %s", email)
+	}
+
+	progress := bucketImportProgress{Bucket: bucket, Prefix: prefix, UserID: user.ID}
+	keepGoing := func() (bool, error) { return true, nil }
+	save := func(bucketImportProgress) error { return nil }
+	if _, err := cfg.runBucketImport(context.Background(), &progress, keepGoing, save); err != nil {
+		log.Fatalf("Couldn't import bucket: %v", err)
+	}
+	log.Printf("Imported %d videos from s3://%s/%s; skipped %d objects, %d failed",
+		progress.Imported, bucket, prefix, progress.Skipped, progress.Failed)
+}
+
+func (cfg *apiConfig) handlerBucketImportGet(w http.ResponseWriter, r *http.Request) {
+	if _, ok := cfg.authenticateAdmin(w, r); !ok {
+		return
+	}
+
+	status, err := cfg.bucketImportStatus()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get bucket import", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, status)
+}
+
+// handlerBucketImportCreate starts importing a bucket prefix for a user.
+// The bucket defaults to the app's own, where objects the app stored
+// itself are left out. One import runs at a time.
+func (cfg *apiConfig) handlerBucketImportCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Bucket string    `json:"bucket"`
+		Prefix string    `json:"prefix"`
+		UserID uuid.UUID `json:"user_id" validate:"required"`
+	}
+
+	adminID, ok := cfg.authenticateAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+	if params.Bucket == "" {
+		params.Bucket = cfg.s3Bucket
+	}
+	user, err := cfg.db.GetUser(params.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if user == nil {
+		respondWithValidationError(w, map[string]string{"user_id": "must be an existing user"}, nil)
+		return
+	}
+
+	status, err := cfg.bucketImportStatus()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get bucket import", err)
+		return
+	}
+	if status.State == bucketImportRunning || status.State == bucketImportPaused {
+		respondWithError(w, http.StatusConflict, "Another import hasn't finished; cancel it with DELETE /admin/import first", nil)
+		return
+	}
+	// Checked now so a bucket the app can't read is reported here rather
+	// than in the task's log
+	maxKeys := int32(1)
+	_, err = cfg.s3Client.ListObjectsV2(r.Context(), &s3.ListObjectsV2Input{Bucket: &params.Bucket, Prefix: &params.Prefix, MaxKeys: &maxKeys})
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't list bucket", err)
+		return
+	}
+
+	status.bucketImportProgress = bucketImportProgress{Bucket: params.Bucket, Prefix: params.Prefix, UserID: user.ID}
+	if err := cfg.saveBucketImportProgress(status.bucketImportProgress); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't start bucket import", err)
+		return
+	}
+	if err := cfg.db.PutSetting(bucketImportStateKey, bucketImportRunning); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't start bucket import", err)
+		return
+	}
+	status.State = bucketImportRunning
+
+	err = cfg.db.CreateAuditEntry(database.AuditEntry{
+		ActorID: &adminID,
+		Action:  "bucket_import_started",
+		Details: fmt.Sprintf("s3://%s/%s for user %s", params.Bucket, params.Prefix, user.ID),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write audit entry", err)
+		return
+	}
+	respondWithJSON(w, http.StatusAccepted, status)
+}
+
+// handlerBucketImportUpdate pauses and resumes the import.
+func (cfg *apiConfig) handlerBucketImportUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		State string `json:"state" validate:"required"`
+	}
+
+	adminID, ok := cfg.authenticateAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+	if params.State != bucketImportRunning && params.State != bucketImportPaused {
+		respondWithValidationError(w, map[string]string{"state": "must be running or paused"}, nil)
+		return
+	}
+
+	status, err := cfg.bucketImportStatus()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get bucket import", err)
+		return
+	}
+	if status.State != bucketImportRunning && status.State != bucketImportPaused {
+		respondWithError(w, http.StatusConflict, "No import is in progress; start one with POST /admin/import", nil)
+		return
+	}
+	if err := cfg.db.PutSetting(bucketImportStateKey, params.State); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update bucket import", err)
+		return
+	}
+	status.State = params.State
+
+	err = cfg.db.CreateAuditEntry(database.AuditEntry{
+		ActorID: &adminID,
+		Action:  "bucket_import_" + params.State,
+		Details: fmt.Sprintf("%d imported, %d skipped, %d failed so far", status.Imported, status.Skipped, status.Failed),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write audit entry", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, status)
+}
+
+// handlerBucketImportDelete cancels the import. Videos imported so far are
+// kept, and a new import of the same prefix skips them.
+func (cfg *apiConfig) handlerBucketImportDelete(w http.ResponseWriter, r *http.Request) {
+	adminID, ok := cfg.authenticateAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	status, err := cfg.bucketImportStatus()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get bucket import", err)
+		return
+	}
+	if status.State != bucketImportRunning && status.State != bucketImportPaused {
+		respondWithError(w, http.StatusConflict, "No import is in progress", nil)
+		return
+	}
+	if err := cfg.db.PutSetting(bucketImportStateKey, bucketImportIdle); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't cancel bucket import", err)
+		return
+	}
+	status.State = bucketImportIdle
+
+	err = cfg.db.CreateAuditEntry(database.AuditEntry{
+		ActorID: &adminID,
+		Action:  "bucket_import_cancelled",
+		Details: fmt.Sprintf("%d imported, %d skipped, %d failed", status.Imported, status.Skipped, status.Failed),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write audit entry", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, status)
+}
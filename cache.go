@@ -8,3 +8,13 @@ func noCacheMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// cacheControlMiddleware sets a fixed Cache-Control on every response. Only
+// mark responses immutable for files whose URL changes whenever their
+// content does.
+func cacheControlMiddleware(cacheControl string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", cacheControl)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/google/uuid"
+)
+
+const (
+	// cdnInvalidationTimeout bounds a single invalidation call, which runs
+	// in the background after the change that triggered it.
+	cdnInvalidationTimeout = 30 * time.Second
+	// cdnInvalidationBatch keeps each call well inside CloudFront's limit
+	// of 3,000 paths per invalidation.
+	cdnInvalidationBatch = 1000
+)
+
+// cdnInvalidator evicts paths from the CDN in front of videos and
+// thumbnails, so replaced or taken-down content stops being served before
+// its cache lifetime runs out.
+type cdnInvalidator interface {
+	Invalidate(ctx context.Context, paths []string) error
+}
+
+// cloudFrontInvalidator creates CloudFront invalidations. It signs the one
+// REST call it needs itself rather than pulling in the CloudFront SDK.
+type cloudFrontInvalidator struct {
+	httpClient     *http.Client
+	credentials    aws.CredentialsProvider
+	distributionID string
+}
+
+func (c cloudFrontInvalidator) Invalidate(ctx context.Context, paths []string) error {
+	type invalidationPaths struct {
+		Quantity int      `xml:"Quantity"`
+		Items    []string `xml:"Items>Path"`
+	}
+	type invalidationBatch struct {
+		XMLName         xml.Name          `xml:"http://cloudfront.amazonaws.com/doc/2020-05-31/ InvalidationBatch"`
+		CallerReference string            `xml:"CallerReference"`
+		Paths           invalidationPaths `xml:"Paths"`
+	}
+
+	body, err := xml.Marshal(invalidationBatch{
+		CallerReference: uuid.NewString(),
+		Paths:           invalidationPaths{Quantity: len(paths), Items: paths},
+	})
+	if err != nil {
+		return err
+	}
+	body = append([]byte(xml.Header), body...)
+
+	endpoint := fmt.Sprintf("https://cloudfront.amazonaws.com/2020-05-31/distribution/%s/invalidation", url.PathEscape(c.distributionID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/xml")
+
+	creds, err := c.credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get AWS credentials: %w", err)
+	}
+	payloadHash := sha256.Sum256(body)
+	// CloudFront is a global service signed in us-east-1
+	if err := v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(payloadHash[:]), "cloudfront", "us-east-1", time.Now()); err != nil {
+		return fmt.Errorf("could not sign invalidation request: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("CloudFront returned %s: %s", resp.Status, detail)
+	}
+	return nil
+}
+
+// webhookInvalidator posts the paths as JSON to an operator-supplied URL,
+// for CDNs other than CloudFront.
+type webhookInvalidator struct {
+	httpClient *http.Client
+	url        string
+}
+
+func (wh webhookInvalidator) Invalidate(ctx context.Context, paths []string) error {
+	body, err := json.Marshal(map[string][]string{"paths": paths})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := wh.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("invalidation webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// invalidateCDN evicts the given video and thumbnail URLs from the CDN in
+// the background. It does nothing unless an invalidator is configured.
+func (cfg *apiConfig) invalidateCDN(urls ...string) {
+	if cfg.cdn == nil {
+		return
+	}
+	var paths []string
+	for _, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Path == "" || u.Path == "/" {
+			continue
+		}
+		paths = append(paths, u.EscapedPath())
+	}
+	if len(paths) == 0 {
+		return
+	}
+
+	go func() {
+		for batch := range slices.Chunk(paths, cdnInvalidationBatch) {
+			ctx, cancel := context.WithTimeout(context.Background(), cdnInvalidationTimeout)
+			err := cfg.cdn.Invalidate(ctx, batch)
+			cancel()
+			if err != nil {
+				cfg.metrics.add(`tubely_cdn_invalidations_total{result="error"}`, 1)
+				log.Printf("Couldn't invalidate %d paths on the CDN: %v", len(batch), err)
+				continue
+			}
+			cfg.metrics.add(`tubely_cdn_invalidations_total{result="ok"}`, 1)
+		}
+	}()
+}
@@ -0,0 +1,376 @@
+// Command smoketest runs one user's worth of traffic against a Tubely
+// deployment: it signs up, logs in, uploads a thumbnail and a video, waits
+// for processing, plays the result back and deletes everything again. It
+// exits non-zero on the first failed step, so it can gate a deploy.
+//
+//	go run ./cmd/smoketest -base-url https://tubely.example.com
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type client struct {
+	baseURL    string
+	httpClient *http.Client
+	token      string
+}
+
+type apiError struct {
+	status int
+	body   string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.status, e.body)
+}
+
+// video holds the fields of the API's video JSON the test looks at.
+type video struct {
+	ID           string  `json:"id"`
+	ThumbnailURL *string `json:"thumbnail_url"`
+	VideoURL     *string `json:"video_url"`
+	Encrypted    bool    `json:"encrypted"`
+}
+
+type uploadSession struct {
+	ID     string  `json:"id"`
+	Status string  `json:"status"`
+	Error  *string `json:"error"`
+}
+
+func main() {
+	baseURL := flag.String("base-url", "http://localhost:8091", "deployment to test")
+	videoPath := flag.String("video", "samples/boots-video-horizontal.mp4", "MP4 file to upload")
+	thumbnailPath := flag.String("thumbnail", "samples/boots-image-horizontal.png", "JPEG or PNG file to upload")
+	timeout := flag.Duration("timeout", 5*time.Minute, "give up on the whole run after this long")
+	pollInterval := flag.Duration("poll-interval", 2*time.Second, "how often to check on processing")
+	flag.Parse()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	c := &client{
+		baseURL:    strings.TrimSuffix(*baseURL, "/"),
+		httpClient: &http.Client{Timeout: *timeout},
+	}
+	if err := run(ctx, c, *videoPath, *thumbnailPath, *pollInterval); err != nil {
+		log.Printf("FAIL %v", err)
+		os.Exit(1)
+	}
+	log.Print("PASS")
+}
+
+func run(ctx context.Context, c *client, videoPath, thumbnailPath string, pollInterval time.Duration) (err error) {
+	suffix := make([]byte, 6)
+	rand.Read(suffix)
+	email := "smoketest+" + hex.EncodeToString(suffix) + "@example.com"
+	password := hex.EncodeToString(suffix) + "-Smoke1"
+
+	if err := step("sign up", func() error {
+		return c.do(ctx, http.MethodPost, "/api/users", map[string]string{"email": email, "password": password}, http.StatusCreated, nil)
+	}); err != nil {
+		return err
+	}
+	if err := step("log in", func() error {
+		var resp struct {
+			Token string `json:"token"`
+		}
+		if err := c.do(ctx, http.MethodPost, "/api/login", map[string]string{"email": email, "password": password}, http.StatusOK, &resp); err != nil {
+			return err
+		}
+		c.token = resp.Token
+		return nil
+	}); err != nil {
+		return err
+	}
+	// Runs even when a later step fails, so a red deploy doesn't also leave
+	// test accounts and objects behind
+	defer func() {
+		cleanupErr := step("delete account", func() error {
+			return c.do(context.WithoutCancel(ctx), http.MethodDelete, "/api/users/me", nil, http.StatusAccepted, nil)
+		})
+		if err == nil {
+			err = cleanupErr
+		}
+	}()
+
+	var v video
+	if err := step("create video", func() error {
+		return c.do(ctx, http.MethodPost, "/api/videos", map[string]string{"title": "Smoke test", "description": "Created by cmd/smoketest"}, http.StatusCreated, &v)
+	}); err != nil {
+		return err
+	}
+
+	if err := step("upload thumbnail", func() error {
+		if err := c.upload(ctx, "/api/videos/"+v.ID+"/thumbnail", "thumbnail", thumbnailPath, http.StatusOK, &v); err != nil {
+			return err
+		}
+		if v.ThumbnailURL == nil {
+			return errors.New("response has no thumbnail_url")
+		}
+		return c.fetch(ctx, *v.ThumbnailURL, "")
+	}); err != nil {
+		return err
+	}
+
+	if err := step("upload video", func() error {
+		body, status, err := c.uploadRaw(ctx, "/api/videos/"+v.ID+"/file", "video", videoPath)
+		if err != nil {
+			return err
+		}
+		switch status {
+		case http.StatusOK:
+			return nil
+		case http.StatusAccepted:
+			// An API node queued it for a worker
+			var session uploadSession
+			if err := json.Unmarshal(body, &session); err != nil {
+				return err
+			}
+			return c.waitForSession(ctx, session.ID, pollInterval)
+		default:
+			return &apiError{status: status, body: string(body)}
+		}
+	}); err != nil {
+		return err
+	}
+
+	if err := step("wait for processing", func() error {
+		for {
+			if err := c.do(ctx, http.MethodGet, "/api/videos/"+v.ID, nil, http.StatusOK, &v); err != nil {
+				return err
+			}
+			if v.VideoURL != nil {
+				return nil
+			}
+			if err := sleep(ctx, pollInterval); err != nil {
+				return err
+			}
+		}
+	}); err != nil {
+		return err
+	}
+
+	if !v.Encrypted {
+		if err := step("fetch video URL", func() error {
+			return c.fetch(ctx, *v.VideoURL, "bytes=0-1023")
+		}); err != nil {
+			return err
+		}
+	}
+	if err := step("fetch signed stream URL", func() error {
+		var resp struct {
+			URL string `json:"url"`
+		}
+		if err := c.do(ctx, http.MethodPost, "/api/videos/"+v.ID+"/stream_url", nil, http.StatusOK, &resp); err != nil {
+			return err
+		}
+		return c.fetch(ctx, resp.URL, "bytes=0-1023")
+	}); err != nil {
+		return err
+	}
+
+	return step("delete video", func() error {
+		if err := c.do(ctx, http.MethodDelete, "/api/videos/"+v.ID, nil, http.StatusNoContent, nil); err != nil {
+			return err
+		}
+		err := c.do(ctx, http.MethodGet, "/api/videos/"+v.ID, nil, http.StatusOK, nil)
+		var apiErr *apiError
+		if errors.As(err, &apiErr) && apiErr.status == http.StatusNotFound {
+			return nil
+		}
+		return fmt.Errorf("video is still there after deletion: %v", err)
+	})
+}
+
+// step runs and times one named part of the test.
+func step(name string, fn func() error) error {
+	start := time.Now()
+	if err := fn(); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	log.Printf("ok   %-24s %s", name, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+func (c *client) waitForSession(ctx context.Context, sessionID string, pollInterval time.Duration) error {
+	for {
+		var session uploadSession
+		if err := c.do(ctx, http.MethodGet, "/api/upload-sessions/"+sessionID, nil, http.StatusOK, &session); err != nil {
+			return err
+		}
+		switch session.Status {
+		case "completed":
+			return nil
+		case "failed":
+			if session.Error != nil {
+				return fmt.Errorf("processing failed: %s", *session.Error)
+			}
+			return errors.New("processing failed")
+		}
+		if err := sleep(ctx, pollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// do sends a JSON request to the API and decodes the response into out,
+// which may be nil. Any status other than want is an *apiError.
+func (c *client) do(ctx context.Context, method, path string, in any, want int, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.send(req, want, out)
+}
+
+func (c *client) send(req *http.Request, want int, out any) error {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != want {
+		return &apiError{status: resp.StatusCode, body: strings.TrimSpace(string(data))}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// upload posts a file as the only part of a multipart form.
+func (c *client) upload(ctx context.Context, path, field, filePath string, want int, out any) error {
+	body, status, err := c.uploadRaw(ctx, path, field, filePath)
+	if err != nil {
+		return err
+	}
+	if status != want {
+		return &apiError{status: status, body: strings.TrimSpace(string(body))}
+	}
+	return json.Unmarshal(body, out)
+}
+
+func (c *client) uploadRaw(ctx context.Context, path, field, filePath string) ([]byte, int, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	contentType := map[string]string{
+		".mp4":  "video/mp4",
+		".png":  "image/png",
+		".jpg":  "image/jpeg",
+		".jpeg": "image/jpeg",
+	}[strings.ToLower(filepath.Ext(filePath))]
+	if contentType == "" {
+		return nil, 0, fmt.Errorf("don't know the content type of %s", filePath)
+	}
+
+	// Streamed, so large sample videos aren't held in memory
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q; filename=%q`, field, filepath.Base(filePath)))
+		header.Set("Content-Type", contentType)
+		part, err := form.CreatePart(header)
+		if err == nil {
+			_, err = io.Copy(part, file)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, pr)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	return body, resp.StatusCode, err
+}
+
+// fetch checks that a media URL, which may be on a CDN rather than the API,
+// serves content. A non-empty byteRange asks for just the start of it.
+func (c *client) fetch(ctx context.Context, url, byteRange string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("%s returned HTTP %d", url, resp.StatusCode)
+	}
+	if n == 0 {
+		return fmt.Errorf("%s returned an empty body", url)
+	}
+	return nil
+}
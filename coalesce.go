@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// flightGroup coalesces concurrent calls for the same key: the first caller
+// runs the call and those arriving while it's in flight wait for its result
+// instead of repeating it. Nothing is kept once it returns, so it never
+// serves a stale result. The zero value is ready to use.
+type flightGroup[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall[T]
+}
+
+type flightCall[T any] struct {
+	done chan struct{}
+	val  T
+	err  error
+}
+
+// do runs fn for key, or waits for the run already in flight. shared
+// reports whether the result came from another caller's run.
+func (g *flightGroup[T]) do(key string, fn func() (T, error)) (val T, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*flightCall[T]{}
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-call.done
+		return call.val, call.err, true
+	}
+	call := &flightCall[T]{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(call.done)
+	}()
+	call.val, call.err = fn()
+	return call.val, call.err, false
+}
+
+// coalescers share the work of identical lookups made at once, as when a
+// video goes viral and every viewer's player asks for the same thing.
+type coalescers struct {
+	videos   flightGroup[database.Video]
+	presigns flightGroup[string]
+}
+
+// getVideoShared is GetVideo for the hot read paths, coalesced per video.
+// Callers waiting on the same lookup get copies of one Video, sharing its
+// slices and maps, so they mustn't modify those in place. primary reads
+// from the primary database, for callers that must see their own writes.
+func (cfg *apiConfig) getVideoShared(videoID uuid.UUID, primary bool) (database.Video, error) {
+	db, key := cfg.db, "id:"+videoID.String()
+	if primary {
+		db, key = cfg.db.Primary(), "primary:"+videoID.String()
+	}
+	video, err, shared := cfg.coalesce.videos.do(key, func() (database.Video, error) {
+		return db.GetVideo(videoID)
+	})
+	if shared {
+		cfg.metrics.add(`tubely_coalesced_requests_total{kind="video"}`, 1)
+	}
+	return video, err
+}
+
+// getVideoByURLShared is GetVideoByURL coalesced per URL, with the same
+// caveat as getVideoShared.
+func (cfg *apiConfig) getVideoByURLShared(videoURL string) (database.Video, error) {
+	video, err, shared := cfg.coalesce.videos.do("url:"+videoURL, func() (database.Video, error) {
+		return cfg.db.GetVideoByURL(videoURL)
+	})
+	if shared {
+		cfg.metrics.add(`tubely_coalesced_requests_total{kind="video"}`, 1)
+	}
+	return video, err
+}
+
+// presignGetShared presigns a GET of an unencrypted object, sharing one
+// URL among the requests for the same object that arrive while it's being
+// made. The presign outlives the request that started it, so the others
+// don't fail when that one's client goes away.
+func (cfg *apiConfig) presignGetShared(ctx context.Context, input *s3.GetObjectInput, expires time.Duration) (string, error) {
+	key := expires.String() + "\x00" + aws.ToString(input.Bucket) + "\x00" + aws.ToString(input.Key) + "\x00" + aws.ToString(input.ResponseContentDisposition)
+	url, err, shared := cfg.coalesce.presigns.do(key, func() (string, error) {
+		presigned, err := s3.NewPresignClient(cfg.s3Client).PresignGetObject(context.WithoutCancel(ctx), input, s3.WithPresignExpires(expires))
+		if err != nil {
+			return "", err
+		}
+		return presigned.URL, nil
+	})
+	if shared {
+		cfg.metrics.add(`tubely_coalesced_requests_total{kind="presign"}`, 1)
+	}
+	return url, err
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// What happens to an upload with a stream in a codec the deployment doesn't
+// accept: refuse it, re-encode that stream into an accepted codec, or store
+// it as it is.
+const (
+	codecMismatchReject      = "reject"
+	codecMismatchTranscode   = "transcode"
+	codecMismatchPassThrough = "pass-through"
+)
+
+// defaultVideoCodecs are the codecs browsers can play out of an MP4.
+var defaultVideoCodecs = []string{"h264", "hevc", "vp9", "av1"}
+
+// videoEncoders and audioEncoders are the ffmpeg encoders used to transcode
+// into each codec, by ffprobe's codec name.
+var (
+	videoEncoders = map[string]string{
+		"h264": "libx264",
+		"hevc": "libx265",
+		"vp9":  "libvpx-vp9",
+		"av1":  "libaom-av1",
+	}
+	audioEncoders = map[string]string{
+		"aac":  "aac",
+		"opus": "libopus",
+		"mp3":  "libmp3lame",
+	}
+)
+
+// codecRule is what a deployment accepts for one kind of stream.
+type codecRule struct {
+	allowed  []string // empty accepts any codec
+	mismatch string
+	encoders map[string]string
+}
+
+type codecPolicy struct {
+	video codecRule
+	audio codecRule
+}
+
+// newCodecRule reads a comma-separated codec list and a mismatch policy.
+// Transcoding needs an encoder for the first listed codec, which is what
+// mismatched streams are converted to.
+func newCodecRule(allowed, mismatch string, defaultAllowed []string, defaultMismatch string, encoders map[string]string) (codecRule, error) {
+	rule := codecRule{allowed: defaultAllowed, mismatch: defaultMismatch, encoders: encoders}
+	if allowed = strings.TrimSpace(allowed); allowed != "" {
+		rule.allowed = nil
+		for _, codec := range strings.Split(allowed, ",") {
+			if codec = strings.ToLower(strings.TrimSpace(codec)); codec != "" {
+				rule.allowed = append(rule.allowed, codec)
+			}
+		}
+	}
+	if mismatch != "" {
+		rule.mismatch = mismatch
+	}
+
+	switch rule.mismatch {
+	case codecMismatchReject, codecMismatchPassThrough:
+	case codecMismatchTranscode:
+		if len(rule.allowed) == 0 {
+			return rule, fmt.Errorf("transcoding needs a list of allowed codecs")
+		}
+		if _, ok := encoders[rule.allowed[0]]; !ok {
+			return rule, fmt.Errorf("can't transcode to %s; list one of %s first", rule.allowed[0], strings.Join(slices.Sorted(maps.Keys(encoders)), ", "))
+		}
+	default:
+		return rule, fmt.Errorf("mismatch policy must be %s, %s or %s", codecMismatchReject, codecMismatchTranscode, codecMismatchPassThrough)
+	}
+	return rule, nil
+}
+
+// accepts reports whether a stream in codec can be stored as it is. A file
+// without that kind of stream has nothing to check.
+func (r codecRule) accepts(codec string) bool {
+	return codec == "" || len(r.allowed) == 0 || slices.Contains(r.allowed, codec)
+}
+
+// transcodeEncoder returns the encoder a stream in codec has to go through,
+// or "" when it's stored as it is.
+func (r codecRule) transcodeEncoder(codec string) string {
+	if r.accepts(codec) || r.mismatch != codecMismatchTranscode {
+		return ""
+	}
+	return r.encoders[r.allowed[0]]
+}
+
+// checkCodecs refuses files with a stream in a codec the policy rejects.
+func (p codecPolicy) checkCodecs(info streamInfo) error {
+	if !p.video.accepts(info.videoCodec) && p.video.mismatch == codecMismatchReject {
+		return &videoValidationError{
+			Code:   "unsupported_codec",
+			Reason: fmt.Sprintf("Unsupported video codec %q", info.videoCodec),
+		}
+	}
+	if !p.audio.accepts(info.audioCodec) && p.audio.mismatch == codecMismatchReject {
+		return &videoValidationError{
+			Code:   "unsupported_audio_codec",
+			Reason: fmt.Sprintf("Unsupported audio codec %q", info.audioCodec),
+		}
+	}
+	return nil
+}
+
+// conformCodecs re-encodes whichever streams the policy transcodes,
+// copying the other. It returns filePath itself when nothing needs to
+// change.
+func (cfg *apiConfig) conformCodecs(filePath string, info streamInfo) (string, error) {
+	videoEncoder := cfg.codecs.video.transcodeEncoder(info.videoCodec)
+	audioEncoder := cfg.codecs.audio.transcodeEncoder(info.audioCodec)
+	if videoEncoder == "" && audioEncoder == "" {
+		if !cfg.codecs.video.accepts(info.videoCodec) || !cfg.codecs.audio.accepts(info.audioCodec) {
+			cfg.metrics.add(`tubely_codec_mismatches_total{action="pass-through"}`, 1)
+		}
+		return filePath, nil
+	}
+
+	args := []string{"-i", filePath, "-map", "0:v:0", "-map", "0:a?"}
+	if videoEncoder != "" {
+		args = append(args, "-c:v", videoEncoder, "-pix_fmt", "yuv420p")
+	} else {
+		args = append(args, "-c:v", "copy")
+	}
+	if audioEncoder != "" {
+		args = append(args, "-c:a", audioEncoder)
+	} else {
+		args = append(args, "-c:a", "copy")
+	}
+	transcodedFilePath := filePath + ".transcoded"
+	args = append(args, "-f", "mp4", transcodedFilePath)
+	if err := runFFmpeg("transcode", args...); err != nil {
+		return "", err
+	}
+	cfg.metrics.add(`tubely_codec_mismatches_total{action="transcode"}`, 1)
+	return transcodedFilePath, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxZstdWindow bounds the memory a single zstd stream can make the decoder
+// allocate.
+const maxZstdWindow = 32 << 20 // 32 MB
+
+type decodedBody struct {
+	io.Reader
+	closers []func() error
+}
+
+func (b *decodedBody) Close() error {
+	var firstErr error
+	for _, close := range b.closers {
+		if err := close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// decodeRequestBody transparently decompresses a gzip or zstd encoded upload
+// and caps the decompressed size at maxBytes, so a small compressed body
+// can't expand without bound. Identity bodies get the same cap. It responds
+// with an error and reports false for unsupported or corrupt encodings.
+func decodeRequestBody(w http.ResponseWriter, r *http.Request, maxBytes int64) bool {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	body := r.Body
+
+	switch encoding {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Couldn't read gzip-encoded body", err)
+			return false
+		}
+		r.Body = &decodedBody{Reader: gz, closers: []func() error{gz.Close, body.Close}}
+	case "zstd":
+		zr, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(maxZstdWindow))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Couldn't read zstd-encoded body", err)
+			return false
+		}
+		r.Body = &decodedBody{Reader: zr, closers: []func() error{func() error { zr.Close(); return nil }, body.Close}}
+	default:
+		w.Header().Set("Accept-Encoding", "gzip, zstd")
+		respondWithErrorCode(w, http.StatusUnsupportedMediaType, "unsupported_encoding", fmt.Sprintf("Unsupported Content-Encoding %q", encoding), nil)
+		return false
+	}
+
+	if encoding != "" && encoding != "identity" {
+		// Anything downstream now sees the decoded bytes
+		r.Header.Del("Content-Encoding")
+		r.ContentLength = -1
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+	return true
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// mediaCORS lets players and pages on other origins read media responses,
+// including the headers they size and seek by, and answers their OPTIONS
+// requests. Media access is granted by URL or bearer token rather than
+// cookies, so credentials are never allowed. An empty origin list allows
+// any origin.
+func mediaCORS(origins []string, next http.Handler) http.Handler {
+	const methods = "GET, HEAD, OPTIONS"
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" {
+			w.Header().Add("Vary", "Origin")
+			switch {
+			case len(origins) == 0:
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			case slices.Contains(origins, origin):
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+			w.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Range, Accept-Ranges, Content-Disposition")
+		}
+
+		if r.Method != http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Allow", methods)
+		if r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Range")
+			w.Header().Set("Access-Control-Max-Age", "86400")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// parseOrigins reads a comma-separated list of origins. "*" or an empty
+// list allows any origin.
+func parseOrigins(s string) []string {
+	var origins []string
+	for _, origin := range strings.Split(s, ",") {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		if origin == "*" {
+			return nil
+		}
+		if origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// envelopeContentType marks an enveloped response, so clients can tell
+// which shape they got.
+const envelopeContentType = `application/json; profile="envelope"`
+
+// envelope is the shape of an enveloped API response. Exactly one of data
+// and error is non-null, and meta is always there.
+type envelope struct {
+	Data  json.RawMessage `json:"data"`
+	Error *envelopeError  `json:"error"`
+	Meta  envelopeMeta    `json:"meta"`
+}
+
+type envelopeError struct {
+	Message string            `json:"message"`
+	Code    string            `json:"code,omitempty"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+type envelopeMeta struct {
+	Status     int    `json:"status"`
+	APIVersion string `json:"api_version,omitempty"`
+	// Pagination is set when there's a next page, mirroring the Link header
+	Pagination *envelopePagination `json:"pagination,omitempty"`
+}
+
+type envelopePagination struct {
+	NextURL    string `json:"next_url"`
+	NextCursor string `json:"next_cursor"`
+}
+
+// responseEnvelope wraps the JSON responses of /api/ routes in an envelope,
+// for frontends that expect every response in one {data, error, meta} shape.
+// Handlers stay unaware of it: their bodies become data, or error for a
+// failure, and what they say in headers, like the next page, goes in meta.
+// byDefault decides for clients that don't choose with the Accept profile.
+// Other responses, like streamed video, pass through untouched.
+func responseEnvelope(byDefault bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept")
+		if !wantsEnvelope(r, byDefault) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ew := &envelopeWriter{ResponseWriter: w}
+		next.ServeHTTP(ew, r)
+		ew.finish()
+	})
+}
+
+// wantsEnvelope reads the client's choice from the profile of the JSON it
+// accepts: profile="envelope" or profile="bare".
+func wantsEnvelope(r *http.Request, byDefault bool) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil || mediaType != "application/json" {
+			continue
+		}
+		switch params["profile"] {
+		case "envelope":
+			return true
+		case "bare":
+			return false
+		}
+	}
+	return byDefault
+}
+
+// envelopeWriter holds back a JSON response until the handler is done, so
+// it can be wrapped. Anything else is written straight through.
+type envelopeWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	wrapping    bool
+	body        bytes.Buffer
+}
+
+func (ew *envelopeWriter) WriteHeader(code int) {
+	if ew.wroteHeader {
+		return
+	}
+	ew.wroteHeader = true
+	ew.status = code
+	mediaType, _, _ := mime.ParseMediaType(ew.Header().Get("Content-Type"))
+	if mediaType == "application/json" && code != http.StatusNoContent && code != http.StatusNotModified {
+		ew.wrapping = true
+		return
+	}
+	ew.ResponseWriter.WriteHeader(code)
+}
+
+func (ew *envelopeWriter) Write(p []byte) (int, error) {
+	if !ew.wroteHeader {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.wrapping {
+		return ew.body.Write(p)
+	}
+	return ew.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. to extend
+// deadlines.
+func (ew *envelopeWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
+
+func (ew *envelopeWriter) finish() {
+	if !ew.wrapping {
+		return
+	}
+	resp := envelope{Meta: envelopeMeta{
+		Status:     ew.status,
+		APIVersion: ew.Header().Get("API-Version"),
+		Pagination: nextPage(ew.Header()),
+	}}
+	var failure struct {
+		Error  *string           `json:"error"`
+		Code   string            `json:"code"`
+		Fields map[string]string `json:"fields"`
+	}
+	if ew.status >= 400 && json.Unmarshal(ew.body.Bytes(), &failure) == nil && failure.Error != nil {
+		resp.Error = &envelopeError{Message: *failure.Error, Code: failure.Code, Fields: failure.Fields}
+	} else if ew.body.Len() > 0 {
+		resp.Data = ew.body.Bytes()
+	}
+
+	dat, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Error marshalling response envelope: %s", err)
+		ew.ResponseWriter.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ew.Header().Set("Content-Type", envelopeContentType)
+	ew.Header().Del("Content-Length")
+	ew.ResponseWriter.WriteHeader(ew.status)
+	ew.ResponseWriter.Write(dat)
+}
+
+// nextPage finds the next page a handler linked to with setNextPageLink.
+func nextPage(header http.Header) *envelopePagination {
+	for _, link := range header.Values("Link") {
+		target, params, ok := strings.Cut(link, ";")
+		if !ok || !strings.Contains(params, `rel="next"`) {
+			continue
+		}
+		nextURL := strings.Trim(strings.TrimSpace(target), "<>")
+		u, err := url.Parse(nextURL)
+		if err != nil {
+			continue
+		}
+		return &envelopePagination{NextURL: nextURL, NextCursor: u.Query().Get("cursor")}
+	}
+	return nil
+}
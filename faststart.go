@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+)
+
+// errNoNativeFastStart means the container needs more than a moov move to
+// become fast-start (fragmented, compressed moov, offsets that would need
+// widening to co64, or not an MP4 at all), so ffmpeg has to remux it.
+var errNoNativeFastStart = errors.New("container can't be fast-started in place")
+
+// fastStart returns a fast-start copy of the video at filePath. It first
+// tries relocateMoov, which only moves the metadata box and lets the kernel
+// copy the media data, and falls back to a full ffmpeg remux when the
+// container doesn't allow that.
+func (cfg *apiConfig) fastStart(filePath string) (string, error) {
+	processedFilePath, err := relocateMoov(filePath)
+	if err == nil {
+		cfg.metrics.add(`tubely_faststart_total{method="relocate"}`, 1)
+		return processedFilePath, nil
+	}
+	if !errors.Is(err, errNoNativeFastStart) {
+		log.Printf("Couldn't relocate moov of %s, remuxing with ffmpeg: %v", filePath, err)
+	}
+
+	cfg.metrics.add(`tubely_faststart_total{method="ffmpeg"}`, 1)
+	return processVideoForFastStart(filePath)
+}
+
+type mp4Atom struct {
+	atomType   string
+	offset     int64
+	size       int64
+	headerSize int64
+}
+
+// relocateMoov does what qt-faststart does: when the moov box sits after the
+// media data, it writes a copy of the file with moov moved in front of the
+// first mdat and every chunk offset adjusted by moov's size. Media bytes are
+// copied file to file without passing through userspace. A file that is
+// already fast-start is hard linked instead of copied.
+func relocateMoov(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	atoms, err := readTopLevelAtoms(f, stat.Size())
+	if err != nil {
+		return "", err
+	}
+
+	moovIndex, mdatIndex := -1, -1
+	for i, atom := range atoms {
+		switch atom.atomType {
+		case "moov":
+			if moovIndex != -1 {
+				return "", errNoNativeFastStart
+			}
+			moovIndex = i
+		case "mdat":
+			if mdatIndex == -1 {
+				mdatIndex = i
+			}
+		case "moof":
+			return "", errNoNativeFastStart
+		}
+	}
+	if moovIndex == -1 || mdatIndex == -1 {
+		return "", errNoNativeFastStart
+	}
+
+	processedFilePath := filePath + ".processing"
+	if moovIndex < mdatIndex {
+		if err := os.Link(filePath, processedFilePath); err != nil {
+			return "", err
+		}
+		return processedFilePath, nil
+	}
+
+	moov := atoms[moovIndex]
+	if moov.size > maxMoovSize {
+		return "", errNoNativeFastStart
+	}
+	moovData := make([]byte, moov.size)
+	if _, err := f.ReadAt(moovData, moov.offset); err != nil {
+		return "", err
+	}
+	if binary.BigEndian.Uint32(moovData[:4]) == 0 {
+		// moov ran to the end of the file; it won't once it moves
+		binary.BigEndian.PutUint32(moovData[:4], uint32(moov.size))
+	}
+
+	insertAt := atoms[mdatIndex].offset
+	err = patchChunkOffsets(moovData[moov.headerSize:], insertAt, moov.offset, moov.size)
+	if err != nil {
+		return "", err
+	}
+
+	out, err := os.Create(processedFilePath)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	err = copyFileRange(out, f, 0, insertAt)
+	if err == nil {
+		_, err = out.Write(moovData)
+	}
+	if err == nil {
+		err = copyFileRange(out, f, insertAt, moov.offset-insertAt)
+	}
+	if err == nil {
+		tail := moov.offset + moov.size
+		err = copyFileRange(out, f, tail, stat.Size()-tail)
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		os.Remove(processedFilePath)
+		return "", err
+	}
+	return processedFilePath, nil
+}
+
+// readTopLevelAtoms lists the top-level boxes of a file, failing with
+// errNoNativeFastStart when the layout doesn't parse as MP4.
+func readTopLevelAtoms(f *os.File, fileSize int64) ([]mp4Atom, error) {
+	var atoms []mp4Atom
+	header := make([]byte, 16)
+	for offset := int64(0); offset < fileSize; {
+		if len(atoms) == maxTopLevelAtoms || fileSize-offset < 8 {
+			return nil, errNoNativeFastStart
+		}
+		if _, err := f.ReadAt(header[:8], offset); err != nil {
+			return nil, err
+		}
+		atom := mp4Atom{
+			atomType:   string(header[4:8]),
+			offset:     offset,
+			size:       int64(binary.BigEndian.Uint32(header[:4])),
+			headerSize: 8,
+		}
+		switch atom.size {
+		case 0:
+			atom.size = fileSize - offset
+		case 1:
+			if _, err := f.ReadAt(header[8:16], offset+8); err != nil {
+				return nil, errNoNativeFastStart
+			}
+			largeSize := binary.BigEndian.Uint64(header[8:16])
+			if largeSize > uint64(fileSize) {
+				return nil, errNoNativeFastStart
+			}
+			atom.size = int64(largeSize)
+			atom.headerSize = 16
+		}
+		if atom.size < atom.headerSize || atom.size > fileSize-offset {
+			return nil, errNoNativeFastStart
+		}
+		atoms = append(atoms, atom)
+		offset += atom.size
+	}
+	return atoms, nil
+}
+
+// patchChunkOffsets walks the boxes in data down to every stco and co64
+// table and adds shift to each chunk offset in [from, to), the range of the
+// file that moves when moov is inserted at from.
+func patchChunkOffsets(data []byte, from, to, shift int64) error {
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return errNoNativeFastStart
+		}
+		size := uint64(binary.BigEndian.Uint32(data[:4]))
+		atomType := string(data[4:8])
+		headerSize := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return errNoNativeFastStart
+			}
+			size = binary.BigEndian.Uint64(data[8:16])
+			headerSize = 16
+		}
+		if size < headerSize || size > uint64(len(data)) {
+			return errNoNativeFastStart
+		}
+		body := data[headerSize:size]
+
+		switch atomType {
+		case "trak", "mdia", "minf", "stbl":
+			if err := patchChunkOffsets(body, from, to, shift); err != nil {
+				return err
+			}
+		case "cmov":
+			return errNoNativeFastStart
+		case "stco", "co64":
+			entrySize := 4
+			if atomType == "co64" {
+				entrySize = 8
+			}
+			if len(body) < 8 {
+				return errNoNativeFastStart
+			}
+			count := uint64(binary.BigEndian.Uint32(body[4:8]))
+			if count*uint64(entrySize) > uint64(len(body)-8) {
+				return errNoNativeFastStart
+			}
+			for i := 0; i < int(count); i++ {
+				entry := body[8+i*entrySize : 8+(i+1)*entrySize]
+				if entrySize == 4 {
+					offset := int64(binary.BigEndian.Uint32(entry))
+					if offset < from || offset >= to {
+						continue
+					}
+					if offset+shift > math.MaxUint32 {
+						return errNoNativeFastStart
+					}
+					binary.BigEndian.PutUint32(entry, uint32(offset+shift))
+				} else {
+					offset := int64(binary.BigEndian.Uint64(entry))
+					if offset < from || offset >= to {
+						continue
+					}
+					binary.BigEndian.PutUint64(entry, uint64(offset+shift))
+				}
+			}
+		}
+
+		data = data[size:]
+	}
+	return nil
+}
+
+// copyFileRange copies n bytes starting at offset from src to the end of
+// dst. Handing io.Copy a limited *os.File lets it use copy_file_range.
+func copyFileRange(dst, src *os.File, offset, n int64) error {
+	if n == 0 {
+		return nil
+	}
+	if _, err := src.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	written, err := io.Copy(dst, io.LimitReader(src, n))
+	if err != nil {
+		return err
+	}
+	if written != n {
+		return fmt.Errorf("short copy: %d of %d bytes", written, n)
+	}
+	return nil
+}
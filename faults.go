@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// The layers faults can be injected into.
+const (
+	faultLayerS3     = "s3"
+	faultLayerFFmpeg = "ffmpeg"
+	faultLayerDB     = "db"
+)
+
+var faultLayers = []string{faultLayerS3, faultLayerFFmpeg, faultLayerDB}
+
+var errInjectedFault = errors.New("injected fault")
+
+// faults injects failures and delays into S3 calls, ffmpeg runs and
+// database writes, so retries, cleanup and clients can be tried against a
+// misbehaving backend in development and staging. It's nil, injecting
+// nothing, unless configured. ffmpeg runs are free functions with no
+// apiConfig at hand, so like processUsage it's package-level.
+var faults *faultInjector
+
+type faultInjector struct {
+	layers  map[string]faultRates
+	metrics *metricsRegistry
+}
+
+// faultRates are the chances, from 0 to 1, that a call fails or is
+// delayed. Delays are random, up to maxDelay.
+type faultRates struct {
+	fail     float64
+	delay    float64
+	maxDelay time.Duration
+}
+
+// parseFaultInjection reads a "layer=rate,..." list of failure rates and a
+// "layer=rate:max,..." list of delay rates with their longest delay, like
+// "s3=0.2:2s".
+func parseFaultInjection(failSpec, delaySpec string) (map[string]faultRates, error) {
+	layers := map[string]faultRates{}
+	entries := func(spec string, parse func(layer, value string) error) error {
+		for _, entry := range strings.Split(spec, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			layer, value, ok := strings.Cut(entry, "=")
+			layer = strings.TrimSpace(layer)
+			if !ok || !slices.Contains(faultLayers, layer) {
+				return fmt.Errorf("invalid fault %q; layers are %s", entry, strings.Join(faultLayers, ", "))
+			}
+			if err := parse(layer, strings.TrimSpace(value)); err != nil {
+				return fmt.Errorf("invalid fault %q: %w", entry, err)
+			}
+		}
+		return nil
+	}
+
+	err := entries(failSpec, func(layer, value string) error {
+		rate, err := parseFaultRate(value)
+		if err != nil {
+			return err
+		}
+		rates := layers[layer]
+		rates.fail = rate
+		layers[layer] = rates
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = entries(delaySpec, func(layer, value string) error {
+		rateString, maxString, ok := strings.Cut(value, ":")
+		if !ok {
+			return errors.New("want rate:max delay, like 0.2:2s")
+		}
+		rate, err := parseFaultRate(rateString)
+		if err != nil {
+			return err
+		}
+		maxDelay, err := time.ParseDuration(maxString)
+		if err != nil || maxDelay <= 0 {
+			return errors.New("the max delay must be a positive duration")
+		}
+		rates := layers[layer]
+		rates.delay, rates.maxDelay = rate, maxDelay
+		layers[layer] = rates
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return layers, nil
+}
+
+func parseFaultRate(value string) (float64, error) {
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return 0, errors.New("rates must be from 0 to 1")
+	}
+	return rate, nil
+}
+
+// inject delays a call into layer and fails it, by chance, returning
+// errInjectedFault for a failure.
+func (f *faultInjector) inject(layer string) error {
+	if f == nil {
+		return nil
+	}
+	rates, ok := f.layers[layer]
+	if !ok {
+		return nil
+	}
+	if rates.delay > 0 && rand.Float64() < rates.delay {
+		f.metrics.add(`tubely_faults_injected_total{layer="`+layer+`",kind="delay"}`, 1)
+		time.Sleep(rand.N(rates.maxDelay))
+	}
+	if rates.fail > 0 && rand.Float64() < rates.fail {
+		f.metrics.add(`tubely_faults_injected_total{layer="`+layer+`",kind="fail"}`, 1)
+		return fmt.Errorf("%w in %s", errInjectedFault, layer)
+	}
+	return nil
+}
+
+// failDBWrite is the hook the database asks before each write.
+func (f *faultInjector) failDBWrite() bool {
+	return f.inject(faultLayerDB) != nil
+}
+
+// applyS3 adds fault injection to an S3 client's calls. Faults come before
+// the SDK's own retries, so each one fails the call outright, as an outage
+// that outlasted them would.
+func (f *faultInjector) applyS3(o *s3.Options) {
+	if f == nil {
+		return
+	}
+	o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("InjectFaults",
+			func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+				if err := f.inject(faultLayerS3); err != nil {
+					return middleware.InitializeOutput{}, middleware.Metadata{}, err
+				}
+				return next.HandleInitialize(ctx, in)
+			}), middleware.Before)
+	})
+}
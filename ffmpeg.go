@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ffmpegStderrLimit is how much of the end of ffmpeg's log an ffmpegError
+// keeps. The lines that explain a failure come last.
+const ffmpegStderrLimit = 16 << 10
+
+// ffmpegError is a failed ffmpeg run on a pipeline input, together with the
+// tail of what ffmpeg logged.
+type ffmpegError struct {
+	err    error
+	stderr string
+}
+
+func (e *ffmpegError) Error() string {
+	lines := strings.Split(strings.TrimSpace(e.stderr), "\n")
+	if last := lines[len(lines)-1]; last != "" {
+		return fmt.Sprintf("could not run ffmpeg: %v: %s", e.err, last)
+	}
+	return fmt.Sprintf("could not run ffmpeg: %v", e.err)
+}
+
+func (e *ffmpegError) Unwrap() error {
+	return e.err
+}
+
+// tailBuffer keeps the last limit bytes written to it.
+type tailBuffer struct {
+	limit int
+	buf   []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if over := len(t.buf) - t.limit; over > 0 {
+		t.buf = append(t.buf[:0], t.buf[over:]...)
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	return string(t.buf)
+}
+
+// runFFmpeg runs ffmpeg with args and returns an *ffmpegError if it fails.
+// task names what the run is for in the process usage metrics.
+func runFFmpeg(task string, args ...string) error {
+	if err := faults.inject(faultLayerFFmpeg); err != nil {
+		return &ffmpegError{err: err}
+	}
+	stderr := &tailBuffer{limit: ffmpegStderrLimit}
+	cmd := mediaCommand("ffmpeg", args...)
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	recordCommand(task, cmd)
+	if err != nil {
+		return &ffmpegError{err: err, stderr: stderr.String()}
+	}
+	return nil
+}
+
+// newFFmpegError is for callers that capture ffmpeg's whole log themselves.
+func newFFmpegError(err error, stderr string) *ffmpegError {
+	if len(stderr) > ffmpegStderrLimit {
+		stderr = stderr[len(stderr)-ffmpegStderrLimit:]
+	}
+	return &ffmpegError{err: err, stderr: stderr}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+	"github.com/google/uuid"
+)
+
+// geoResolver tells which country a request comes from, as an upper-case
+// ISO 3166-1 alpha-2 code, or "" when it can't tell.
+type geoResolver interface {
+	Country(r *http.Request) (string, error)
+}
+
+// headerGeoResolver trusts a country header set by the CDN or load balancer
+// in front of the server, like CloudFront-Viewer-Country or CF-IPCountry.
+// Clients can set it themselves if they can reach the server directly.
+type headerGeoResolver struct {
+	header string
+}
+
+func (g headerGeoResolver) Country(r *http.Request) (string, error) {
+	country := strings.ToUpper(strings.TrimSpace(r.Header.Get(g.header)))
+	if !validCountryCode(country) {
+		return "", nil
+	}
+	return country, nil
+}
+
+// geoNetwork is one row of a rangeGeoResolver's database.
+type geoNetwork struct {
+	prefix  netip.Prefix
+	country string
+}
+
+// rangeGeoResolver looks up the connecting address in a list of networks
+// loaded from a CSV file of "network,country" rows, like those the free
+// GeoIP databases can be exported to. The networks mustn't overlap.
+type rangeGeoResolver struct {
+	networks []geoNetwork
+}
+
+// loadRangeGeoResolver reads a rangeGeoResolver's database. Blank lines,
+// lines starting with # and a header row are skipped.
+func loadRangeGeoResolver(path string) (rangeGeoResolver, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return rangeGeoResolver{}, err
+	}
+	defer file.Close()
+
+	var networks []geoNetwork
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		network, country, _ := strings.Cut(text, ",")
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(network))
+		if err != nil {
+			if line == 1 {
+				continue
+			}
+			return rangeGeoResolver{}, fmt.Errorf("line %d: %w", line, err)
+		}
+		country = strings.ToUpper(strings.TrimSpace(country))
+		if !validCountryCode(country) {
+			return rangeGeoResolver{}, fmt.Errorf("line %d: %q isn't a country code", line, country)
+		}
+		networks = append(networks, geoNetwork{prefix: prefix.Masked(), country: country})
+	}
+	if err := scanner.Err(); err != nil {
+		return rangeGeoResolver{}, err
+	}
+	slices.SortFunc(networks, func(a, b geoNetwork) int {
+		return a.prefix.Addr().Compare(b.prefix.Addr())
+	})
+	return rangeGeoResolver{networks: networks}, nil
+}
+
+func (g rangeGeoResolver) Country(r *http.Request) (string, error) {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return "", err
+	}
+	addr := addrPort.Addr().Unmap()
+	// The network holding addr, if any, is the last one starting at or
+	// before it
+	i, found := slices.BinarySearchFunc(g.networks, addr, func(n geoNetwork, addr netip.Addr) int {
+		return n.prefix.Addr().Compare(addr)
+	})
+	if !found {
+		i--
+	}
+	if i < 0 || !g.networks[i].prefix.Contains(addr) {
+		return "", nil
+	}
+	return g.networks[i].country, nil
+}
+
+func validCountryCode(code string) bool {
+	if len(code) != 2 {
+		return false
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// geoCountry resolves the country a request comes from, or "" when there
+// is no resolver or it can't tell.
+func (cfg *apiConfig) geoCountry(r *http.Request) string {
+	if cfg.geo == nil {
+		return ""
+	}
+	country, err := cfg.geo.Country(r)
+	if err != nil {
+		log.Printf("Couldn't resolve the country of %s: %v", r.RemoteAddr, err)
+		return ""
+	}
+	return country
+}
+
+// geoPermits reports whether video may be played in country. An unknown
+// country is outside every allow list but isn't on any deny list.
+func geoPermits(video database.Video, country string) bool {
+	if len(video.GeoAllow) > 0 {
+		return slices.Contains(video.GeoAllow, country)
+	}
+	return !slices.Contains(video.GeoDeny, country)
+}
+
+// checkGeoRestriction reports whether the request's country may play the
+// video, and the country it resolved. Videos without rules skip the lookup.
+func (cfg *apiConfig) checkGeoRestriction(r *http.Request, video database.Video) (string, bool) {
+	if len(video.GeoAllow) == 0 && len(video.GeoDeny) == 0 {
+		return "", true
+	}
+	country := cfg.geoCountry(r)
+	if geoPermits(video, country) {
+		return country, true
+	}
+	cfg.metrics.add("tubely_geo_blocked_total", 1)
+	return country, false
+}
+
+// overrideGeoRestriction lets admins play a video outside the countries it
+// is licensed for, for support and takedown reviews. Every override is
+// audited; it reports false for anyone else.
+func (cfg *apiConfig) overrideGeoRestriction(userID uuid.UUID, video database.Video, country string) (bool, error) {
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		return false, err
+	}
+	if user == nil || !user.IsAdmin {
+		return false, nil
+	}
+	if country == "" {
+		country = "unknown"
+	}
+	err = cfg.db.CreateAuditEntry(database.AuditEntry{
+		ActorID: &userID,
+		Action:  "geo_restriction_overridden",
+		VideoID: &video.ID,
+		Details: "country: " + country,
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func respondGeoBlocked(w http.ResponseWriter) {
+	respondWithError(w, http.StatusUnavailableForLegalReasons, "This video isn't available in your country", nil)
+}
+
+// handlerVideoGeoRestrictionUpdate replaces a video's allow or deny list.
+// Editors of the video and admins can change it; an empty body lifts the
+// restriction.
+func (cfg *apiConfig) handlerVideoGeoRestrictionUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Allow []string `json:"allow" validate:"max=250"`
+		Deny  []string `json:"deny" validate:"max=250"`
+	}
+
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+	fields := map[string]string{}
+	allow, err := normalizeCountries(params.Allow)
+	if err != nil {
+		fields["allow"] = err.Error()
+	}
+	deny, err := normalizeCountries(params.Deny)
+	if err != nil {
+		fields["deny"] = err.Error()
+	}
+	if len(allow) > 0 && len(deny) > 0 {
+		fields["deny"] = "can't be combined with an allow list"
+	}
+	if len(fields) > 0 {
+		respondWithValidationError(w, fields, nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	allowed, err := cfg.canAccessVideo(userID, video, permEdit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video permissions", err)
+		return
+	}
+	if !allowed {
+		user, err := cfg.db.GetUser(userID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+			return
+		}
+		if user == nil || !user.IsAdmin {
+			respondWithError(w, http.StatusNotFound, "Video not found", nil)
+			return
+		}
+	}
+	if len(allow) > 0 || len(deny) > 0 {
+		if cfg.geo == nil {
+			respondWithError(w, http.StatusConflict, "Geo-restriction needs GEOIP_HEADER or GEOIP_CSV to be configured", nil)
+			return
+		}
+		// Anything else hands out URLs straight to storage, which can't
+		// be restricted
+		if mode := cfg.urls.Mode(); mode != media.DeliveryPresigned && mode != media.DeliveryProxy {
+			respondWithError(w, http.StatusConflict, "Geo-restriction needs VIDEO_URL_MODE to be presigned or proxy", nil)
+			return
+		}
+	}
+
+	video.GeoAllow = allow
+	video.GeoDeny = deny
+	if err := cfg.db.SetVideoGeoRestriction(video.ID, allow, deny); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	details := "none"
+	if len(allow) > 0 {
+		details = "allow: " + strings.Join(allow, ",")
+	} else if len(deny) > 0 {
+		details = "deny: " + strings.Join(deny, ",")
+	}
+	err = cfg.db.CreateAuditEntry(database.AuditEntry{
+		ActorID: &userID,
+		Action:  "geo_restriction_updated",
+		VideoID: &video.ID,
+		Details: details,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write audit entry", err)
+		return
+	}
+
+	video, err = cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	cfg.signVideoAssets(&video)
+	respondWithJSON(w, http.StatusOK, video)
+}
+
+// normalizeCountries upper-cases and sorts a list of country codes and
+// drops duplicates.
+func normalizeCountries(codes []string) ([]string, error) {
+	countries := []string{}
+	for _, code := range codes {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if !validCountryCode(code) {
+			return nil, errors.New("must be ISO 3166-1 alpha-2 country codes, like US or DE")
+		}
+		countries = append(countries, code)
+	}
+	slices.Sort(countries)
+	return slices.Compact(countries), nil
+}
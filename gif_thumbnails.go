@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+)
+
+// Animated thumbnails are decoded by every browser that shows them, frame
+// by frame, so GIFs get tighter limits than still images.
+const (
+	maxGIFSide   = 1280
+	maxGIFFrames = 300
+)
+
+// checkGIFLimits rejects GIFs too large or too long to make a reasonable
+// thumbnail. Frames are counted from the block structure, without
+// decompressing any of them. The reader is rewound afterwards.
+func checkGIFLimits(r io.ReadSeeker, width, height int) error {
+	if width > maxGIFSide || height > maxGIFSide {
+		return fmt.Errorf("animated image is %dx%d, but neither side may exceed %d pixels", width, height, maxGIFSide)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	frames, err := countGIFFrames(bufio.NewReader(r), maxGIFFrames+1)
+	if err != nil {
+		return fmt.Errorf("couldn't read GIF: %w", err)
+	}
+	if frames > maxGIFFrames {
+		return fmt.Errorf("animated image has more than %d frames", maxGIFFrames)
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	return err
+}
+
+// countGIFFrames walks a GIF's blocks and counts its image descriptors,
+// stopping early once it has seen limit of them.
+func countGIFFrames(r *bufio.Reader, limit int) (int, error) {
+	var header [13]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	if string(header[:3]) != "GIF" {
+		return 0, errors.New("not a GIF")
+	}
+	if header[10]&0x80 != 0 {
+		if err := skipBytes(r, colorTableSize(header[10])); err != nil {
+			return 0, err
+		}
+	}
+
+	frames := 0
+	for frames < limit {
+		introducer, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch introducer {
+		case 0x21: // extension: a label, then data sub-blocks
+			if _, err := r.ReadByte(); err != nil {
+				return 0, err
+			}
+			if err := skipSubBlocks(r); err != nil {
+				return 0, err
+			}
+		case 0x2C: // image descriptor
+			var descriptor [9]byte
+			if _, err := io.ReadFull(r, descriptor[:]); err != nil {
+				return 0, err
+			}
+			if descriptor[8]&0x80 != 0 {
+				if err := skipBytes(r, colorTableSize(descriptor[8])); err != nil {
+					return 0, err
+				}
+			}
+			// LZW minimum code size, then the compressed pixels
+			if _, err := r.ReadByte(); err != nil {
+				return 0, err
+			}
+			if err := skipSubBlocks(r); err != nil {
+				return 0, err
+			}
+			frames++
+		case 0x3B: // trailer
+			return frames, nil
+		default:
+			return 0, fmt.Errorf("unexpected block 0x%02x", introducer)
+		}
+	}
+	return frames, nil
+}
+
+func colorTableSize(flags byte) int {
+	return 3 << ((flags & 0x07) + 1)
+}
+
+func skipSubBlocks(r *bufio.Reader) error {
+	for {
+		size, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			return nil
+		}
+		if err := skipBytes(r, int(size)); err != nil {
+			return err
+		}
+	}
+}
+
+func skipBytes(r *bufio.Reader, n int) error {
+	_, err := r.Discard(n)
+	return err
+}
+
+// gifPosterFrame renders a GIF's first frame onto the full canvas as a PNG,
+// for use where the thumbnail shouldn't animate.
+func gifPosterFrame(r io.ReadSeeker) ([]byte, error) {
+	canvas, err := gifFirstFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, canvas); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gifFirstFrame decodes only a GIF's first frame and draws it onto a canvas
+// of the GIF's full size.
+func gifFirstFrame(r io.ReadSeeker) (image.Image, error) {
+	config, err := gif.DecodeConfig(r)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	frame, err := gif.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// The first frame may cover only part of the canvas
+	canvas := image.NewNRGBA(image.Rect(0, 0, config.Width, config.Height))
+	draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Src)
+	return canvas, nil
+}
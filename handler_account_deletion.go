@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerUsersDeleteMe erases the caller's account. Database rows are removed
+// before responding; S3 objects and thumbnail files are removed in the
+// background and the outcome is recorded on the returned deletion report.
+func (cfg *apiConfig) handlerUsersDeleteMe(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	// An organization can't be left without an owner, so sole owners have to
+	// hand the role over before leaving
+	orgs, err := cfg.db.GetOrganizationsForUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve organizations", err)
+		return
+	}
+	for _, org := range orgs {
+		if org.Role != database.OrgRoleOwner {
+			continue
+		}
+		owners, err := cfg.db.CountOrgOwners(org.ID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't count organization owners", err)
+			return
+		}
+		if owners <= 1 {
+			respondWithError(w, http.StatusConflict, fmt.Sprintf("You are the only owner of %q; make someone else an owner first", org.Name), nil)
+			return
+		}
+	}
+
+	videos, err := cfg.db.GetVideos(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+
+	report := database.DeletionReport{
+		UserID:   userID,
+		Status:   database.DeletionStatusInProgress,
+		Failures: []string{},
+	}
+
+	// Collect everything that lives outside the database before the rows
+	// that point at it are gone. Videos under legal hold are kept, and the
+	// deletion is flagged for review instead.
+	var objectKeys, thumbnailURLs []string
+	var deletable []database.Video
+	for _, video := range videos {
+		if video.OrgID != nil {
+			// Organization videos stay with the organization
+			continue
+		}
+		if video.LegalHold {
+			report.VideosHeld++
+			// No actor: the user is about to be deleted, and the audit log
+			// mustn't point back at them
+			err := cfg.db.CreateAuditEntry(database.AuditEntry{
+				Action:  "deletion_blocked_by_legal_hold",
+				VideoID: &video.ID,
+				Details: "account deletion requested",
+			})
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Couldn't write audit entry", err)
+				return
+			}
+			continue
+		}
+		deletable = append(deletable, video)
+		keys, err := cfg.videoStorageKeys(video)
+		if err != nil {
+			report.Failures = append(report.Failures, fmt.Sprintf("video %s: %v", video.ID, err))
+		}
+		objectKeys = append(objectKeys, keys...)
+		thumbnailURLs = append(thumbnailURLs, video.ThumbnailURLs()...)
+	}
+
+	for _, video := range deletable {
+		if video.Encrypted {
+			if err := cfg.db.DeleteVideoKey(video.ID); err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Couldn't delete video key", err)
+				return
+			}
+		}
+		if err := cfg.db.DeleteVideo(video.ID); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
+			return
+		}
+		cfg.recordVideoEvent(video, database.VideoEventDeleted, userID, map[string]any{"reason": "account_deleted"})
+		report.VideosDeleted++
+	}
+
+	report.SessionsRevoked, err = cfg.db.DeleteRefreshTokensForUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke sessions", err)
+		return
+	}
+
+	if _, err := cfg.db.DeleteSigningKeysForUser(userID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke signing keys", err)
+		return
+	}
+
+	packageKeys, err := cfg.db.DeleteVideoPackagesForUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video packages", err)
+		return
+	}
+	objectKeys = append(objectKeys, packageKeys...)
+
+	if err := cfg.db.DeleteOrgMembershipsForUser(userID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't leave organizations", err)
+		return
+	}
+
+	if err := os.Remove(cfg.userWatermarkPath(userID)); err != nil && !os.IsNotExist(err) {
+		report.Failures = append(report.Failures, fmt.Sprintf("watermark: %v", err))
+	}
+
+	quarantinePrefixes, err := cfg.db.DeleteUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete user", err)
+		return
+	}
+	for _, prefix := range quarantinePrefixes {
+		for _, name := range []string{quarantineInputObject, quarantineStderrObject, quarantineProbeObject} {
+			objectKeys = append(objectKeys, prefix+name)
+		}
+	}
+
+	report, err = cfg.db.CreateDeletionReport(report)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create deletion report", err)
+		return
+	}
+
+	go cfg.purgeDeletedUserStorage(report, objectKeys, thumbnailURLs)
+
+	respondWithJSON(w, http.StatusAccepted, report)
+}
+
+// handlerDeletionReportGet lets a former user follow the background cleanup.
+// Report IDs are random UUIDs handed out once, and the account they belong
+// to no longer exists, so possession of the ID is the only credential.
+func (cfg *apiConfig) handlerDeletionReportGet(w http.ResponseWriter, r *http.Request) {
+	reportID, err := uuid.Parse(r.PathValue("reportID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid report ID", err)
+		return
+	}
+
+	// The purge runs in the background and updates the report as it goes
+	report, err := cfg.db.Primary().GetDeletionReport(reportID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get deletion report", err)
+		return
+	}
+	if report.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Deletion report not found", nil)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, report)
+}
+
+// purgeDeletedUserStorage deletes a former user's S3 objects and thumbnail
+// files, confirming each object is really gone with a HeadObject call.
+func (cfg *apiConfig) purgeDeletedUserStorage(report database.DeletionReport, objectKeys, thumbnailURLs []string) {
+	ctx := context.Background()
+
+	var deletedURLs []string
+	for _, key := range objectKeys {
+		if err := cfg.deleteS3ObjectVerified(ctx, key); err != nil {
+			report.Failures = append(report.Failures, fmt.Sprintf("object %s: %v", key, err))
+			continue
+		}
+		report.ObjectsDeleted++
+		deletedURLs = append(deletedURLs, cfg.videoDeliveryURL(key))
+	}
+
+	for _, thumbnailURL := range thumbnailURLs {
+		stored, err := cfg.deleteThumbnail(ctx, thumbnailURL)
+		if err != nil {
+			report.Failures = append(report.Failures, fmt.Sprintf("thumbnail %s: %v", thumbnailURL, err))
+			continue
+		}
+		if stored {
+			report.ThumbnailsDeleted++
+			deletedURLs = append(deletedURLs, thumbnailURL)
+		}
+	}
+	cfg.invalidateCDN(deletedURLs...)
+
+	report.Status = database.DeletionStatusCompleted
+	if len(report.Failures) > 0 {
+		report.Status = database.DeletionStatusFailed
+	}
+	if report.VideosHeld > 0 {
+		// An admin may already have lifted the holds and erased the videos
+		held, err := cfg.heldVideos(report.UserID)
+		if err != nil {
+			log.Printf("Couldn't check held videos of deletion report %s: %v", report.ID, err)
+		}
+		if err != nil || len(held) > 0 {
+			report.Status = database.DeletionStatusNeedsReview
+		}
+	}
+	if err := cfg.db.CompleteDeletionReport(report); err != nil {
+		log.Printf("Couldn't complete deletion report %s: %v", report.ID, err)
+	}
+}
+
+// heldVideos returns the videos a deleted user left behind because they
+// were under legal hold.
+func (cfg *apiConfig) heldVideos(userID uuid.UUID) ([]database.Video, error) {
+	videos, err := cfg.db.Primary().GetVideos(userID)
+	if err != nil {
+		return nil, err
+	}
+	held := []database.Video{}
+	for _, video := range videos {
+		if video.OrgID == nil {
+			held = append(held, video)
+		}
+	}
+	return held, nil
+}
+
+// handlerDeletionReviewsRetrieve lists the account deletions that kept
+// videos under legal hold, each with the videos still waiting. Lifting a
+// video's hold erases it.
+func (cfg *apiConfig) handlerDeletionReviewsRetrieve(w http.ResponseWriter, r *http.Request) {
+	type review struct {
+		database.DeletionReport
+		HeldVideos []database.Video `json:"held_videos"`
+	}
+
+	if _, ok := cfg.authenticateAdmin(w, r); !ok {
+		return
+	}
+
+	reports, err := cfg.db.Primary().GetDeletionReportsNeedingReview()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve deletion reports", err)
+		return
+	}
+	reviews := make([]review, 0, len(reports))
+	for _, report := range reports {
+		held, err := cfg.heldVideos(report.UserID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve held videos", err)
+			return
+		}
+		for i := range held {
+			cfg.signVideoAssets(&held[i])
+		}
+		reviews = append(reviews, review{DeletionReport: report, HeldVideos: held})
+	}
+	respondWithJSON(w, http.StatusOK, reviews)
+}
+
+// eraseHeldVideo finishes deleting a video its owner's account deletion
+// kept because of a legal hold, now that the hold is lifted. Its storage is
+// removed in the background, as it would have been with the account.
+func (cfg *apiConfig) eraseHeldVideo(video database.Video, adminID uuid.UUID) error {
+	objectKeys, err := cfg.videoStorageKeys(video)
+	if err != nil {
+		return fmt.Errorf("couldn't locate video objects: %w", err)
+	}
+	thumbnailURLs := video.ThumbnailURLs()
+
+	if video.Encrypted {
+		if err := cfg.db.DeleteVideoKey(video.ID); err != nil {
+			return fmt.Errorf("couldn't delete video key: %w", err)
+		}
+	}
+	if err := cfg.db.DeleteVideo(video.ID); err != nil {
+		return fmt.Errorf("couldn't delete video: %w", err)
+	}
+	// The owner is gone, and the event mustn't point back at them
+	anonymous := video
+	anonymous.UserID = uuid.Nil
+	cfg.recordVideoEvent(anonymous, database.VideoEventDeleted, adminID, map[string]any{"reason": "account_deleted"})
+
+	held, err := cfg.heldVideos(video.UserID)
+	if err != nil {
+		return fmt.Errorf("couldn't check held videos: %w", err)
+	}
+	if err := cfg.db.RecordHeldVideoErased(video.UserID, len(held) == 0); err != nil {
+		return fmt.Errorf("couldn't update deletion report: %w", err)
+	}
+
+	go func() {
+		ctx := context.Background()
+		var deletedURLs []string
+		for _, key := range objectKeys {
+			if err := cfg.deleteS3ObjectVerified(ctx, key); err != nil {
+				log.Printf("Couldn't delete object %s of erased video %s: %v", key, video.ID, err)
+				continue
+			}
+			deletedURLs = append(deletedURLs, cfg.videoDeliveryURL(key))
+		}
+		for _, thumbnailURL := range thumbnailURLs {
+			stored, err := cfg.deleteThumbnail(ctx, thumbnailURL)
+			if err != nil {
+				log.Printf("Couldn't delete thumbnail %s of erased video %s: %v", thumbnailURL, video.ID, err)
+				continue
+			}
+			if stored {
+				deletedURLs = append(deletedURLs, thumbnailURL)
+			}
+		}
+		cfg.invalidateCDN(deletedURLs...)
+	}()
+	return nil
+}
+
+// videoStorageKeys lists the bucket keys a video's files are stored under:
+// its current file and every earlier one in its history.
+func (cfg *apiConfig) videoStorageKeys(video database.Video) ([]string, error) {
+	var keys []string
+	seen := map[string]bool{}
+	if video.VideoURL != nil {
+		key, err := cfg.videoObjectKey(video)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		seen[key] = true
+	}
+	objects, err := cfg.db.GetVideoObjects(video.ID)
+	if err != nil {
+		return keys, err
+	}
+	for _, object := range objects {
+		if !seen[object.S3Key] {
+			keys = append(keys, object.S3Key)
+			seen[object.S3Key] = true
+		}
+	}
+	return keys, nil
+}
+
+// deleteS3ObjectVerified deletes every version of an object, and its delete
+// markers, then checks that listing the versions again finds none. On a
+// versioned bucket a plain DeleteObject would only hide the object behind a
+// new delete marker.
+func (cfg *apiConfig) deleteS3ObjectVerified(ctx context.Context, key string) error {
+	versions, err := cfg.listObjectVersions(ctx, key)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		_, err := cfg.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket:    &cfg.s3Bucket,
+			Key:       &key,
+			VersionId: &version.VersionID,
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't delete version %s: %w", version.VersionID, err)
+		}
+	}
+
+	versions, err = cfg.listObjectVersions(ctx, key)
+	if err != nil {
+		return fmt.Errorf("couldn't verify deletion: %w", err)
+	}
+	if len(versions) > 0 {
+		return fmt.Errorf("%d versions of the object still exist after deletion", len(versions))
+	}
+	return nil
+}
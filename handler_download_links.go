@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultDownloadLinkTTL = 24 * time.Hour
+	maxDownloadLinkTTL     = 30 * 24 * time.Hour
+	// downloadRedirectTTL only has to cover the browser following the
+	// redirect; the link's own expiry is enforced before it is issued.
+	downloadRedirectTTL = 5 * time.Minute
+)
+
+func hashDownloadToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// handlerDownloadLinkCreate issues a share link for downloading a video's
+// file, independent of the video's visibility. The token is only returned
+// here; the server keeps a hash.
+func (cfg *apiConfig) handlerDownloadLinkCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ExpiresInSeconds int `json:"expires_in_seconds" validate:"min=0"`
+		MaxUses          int `json:"max_uses" validate:"min=0,max=1000"`
+	}
+	type response struct {
+		database.DownloadLink
+		URL string `json:"url"`
+	}
+
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+	ttl := defaultDownloadLinkTTL
+	if params.ExpiresInSeconds > 0 {
+		ttl = min(time.Duration(params.ExpiresInSeconds)*time.Second, maxDownloadLinkTTL)
+	}
+	maxUses := params.MaxUses
+	if maxUses == 0 {
+		maxUses = 1
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	allowed, err := cfg.canAccessVideo(userID, video, permEdit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video permissions", err)
+		return
+	}
+	if !allowed {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusBadRequest, "Video has no uploaded file", nil)
+		return
+	}
+
+	linkToken, err := auth.MakeRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate link token", err)
+		return
+	}
+	link, err := cfg.db.CreateDownloadLink(database.DownloadLink{
+		ExpiresAt: time.Now().Add(ttl),
+		VideoID:   videoID,
+		CreatedBy: userID,
+		MaxUses:   maxUses,
+	}, hashDownloadToken(linkToken))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create download link", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, response{
+		DownloadLink: link,
+		URL:          cfg.urls.Server("/api/downloads/" + linkToken),
+	})
+}
+
+func (cfg *apiConfig) handlerDownloadLinksRetrieve(w http.ResponseWriter, r *http.Request) {
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	allowed := false
+	if video.ID != uuid.Nil {
+		allowed, err = cfg.canAccessVideo(userID, video, permEdit)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check video permissions", err)
+			return
+		}
+	}
+	if !allowed {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	links, err := cfg.db.GetDownloadLinksForVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve download links", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, links)
+}
+
+func (cfg *apiConfig) handlerDownloadLinkRevoke(w http.ResponseWriter, r *http.Request) {
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
+		return
+	}
+	linkID, ok := pathUUID(w, r, "linkID")
+	if !ok {
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	allowed := false
+	if video.ID != uuid.Nil {
+		allowed, err = cfg.canAccessVideo(userID, video, permEdit)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check video permissions", err)
+			return
+		}
+	}
+	if !allowed {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	found, err := cfg.db.RevokeDownloadLink(videoID, linkID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke download link", err)
+		return
+	}
+	if !found {
+		respondWithError(w, http.StatusNotFound, "Download link not found", nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerDownload spends one use of a share link and hands over the file.
+// Unencrypted videos are redirected to a short-lived presigned URL;
+// encrypted ones have to be proxied, since only the server can supply their
+// SSE-C key. A HEAD request reports the file's size and type without
+// spending a use.
+func (cfg *apiConfig) handlerDownload(w http.ResponseWriter, r *http.Request) {
+	tokenHash := hashDownloadToken(r.PathValue("token"))
+	link, ok, err := cfg.db.PeekDownloadLink(tokenHash)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check download link", err)
+		return
+	}
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Download link is invalid, expired or used up", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(link.VideoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.VideoURL == nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	// Checked before the link is used, so a blocked attempt doesn't use
+	// up one of its downloads
+	if _, permitted := cfg.checkGeoRestriction(r, video); !permitted {
+		respondGeoBlocked(w)
+		return
+	}
+
+	// Players and unfurlers probe links first; that isn't a download
+	if r.Method != http.MethodHead {
+		_, ok, err = cfg.db.UseDownloadLink(tokenHash)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check download link", err)
+			return
+		}
+		if !ok {
+			respondWithError(w, http.StatusNotFound, "Download link is invalid, expired or used up", nil)
+			return
+		}
+	}
+
+	input, err := cfg.videoGetObjectInput(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't locate video object", err)
+		return
+	}
+	disposition := media.ContentDisposition("attachment", videoDownloadName(video), ".mp4")
+	input.ResponseContentDisposition = &disposition
+
+	// A presigned URL is only good for GET, so HEAD is answered here
+	if !video.Encrypted && r.Method != http.MethodHead {
+		presigned, err := cfg.presignGetShared(r.Context(), input, downloadRedirectTTL)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't create download URL", err)
+			return
+		}
+		http.Redirect(w, r, presigned, http.StatusFound)
+		return
+	}
+
+	out, err := cfg.getVideoObject(r.Context(), r.Method, input)
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't fetch video from storage", err)
+		return
+	}
+	defer out.Body.Close()
+
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("Cache-Control", "private, no-store")
+	if out.ContentLength != nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(*out.ContentLength, 10))
+	}
+	cfg.buffers.copy(throttleResponse(w, cfg.userBandwidth(video.UserID)), out.Body)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+var errLegalHold = errors.New("video is under legal hold")
+
+// handlerLegalHoldUpdate places or lifts a legal hold on a video. Lifting
+// the hold on a video whose owner has deleted their account erases it and
+// answers 204.
+func (cfg *apiConfig) handlerLegalHoldUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Hold   bool   `json:"hold"`
+		Reason string `json:"reason" validate:"required,max=1000"`
+	}
+
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
+		return
+	}
+
+	adminID, ok := cfg.authenticateAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	// Mirror the hold onto the object itself so nobody can delete it from
+	// outside the app either
+	if cfg.s3ObjectLock && video.VideoURL != nil {
+		key, err := cfg.videoObjectKey(video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't locate video object", err)
+			return
+		}
+		status := types.ObjectLockLegalHoldStatusOff
+		if params.Hold {
+			status = types.ObjectLockLegalHoldStatusOn
+		}
+		_, err = cfg.s3Client.PutObjectLegalHold(r.Context(), &s3.PutObjectLegalHoldInput{
+			Bucket:    &cfg.s3Bucket,
+			Key:       &key,
+			LegalHold: &types.ObjectLockLegalHold{Status: status},
+		})
+		if err != nil {
+			respondWithError(w, http.StatusBadGateway, "Couldn't set S3 object legal hold", err)
+			return
+		}
+	}
+
+	found, err := cfg.db.SetVideoLegalHold(videoID, params.Hold)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	if !found {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	action := "legal_hold_removed"
+	if params.Hold {
+		action = "legal_hold_placed"
+	}
+	err = cfg.db.CreateAuditEntry(database.AuditEntry{
+		ActorID: &adminID,
+		Action:  action,
+		VideoID: &video.ID,
+		Details: params.Reason,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write audit entry", err)
+		return
+	}
+
+	// A video kept back from its owner's account deletion goes once
+	// nothing holds it anymore
+	if !params.Hold && video.OrgID == nil {
+		owner, err := cfg.db.GetUser(video.UserID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get video owner", err)
+			return
+		}
+		if owner == nil {
+			if err := cfg.eraseHeldVideo(video, adminID); err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Couldn't erase video", err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	video, err = cfg.db.Primary().GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	cfg.signVideoAssets(&video)
+	respondWithJSON(w, http.StatusOK, video)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func (cfg *apiConfig) handlerStreamKeyRotate(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		StreamKey string `json:"stream_key"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	streamKey, err := auth.MakeRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate stream key", err)
+		return
+	}
+	err = cfg.db.UpdateUserStreamKey(userID, streamKey)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save stream key", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{StreamKey: streamKey})
+}
+
+func (cfg *apiConfig) handlerLiveSessionCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Title       string `json:"title" validate:"required,max=200"`
+		Description string `json:"description" validate:"max=5000"`
+	}
+
+	if cfg.liveIngest == nil {
+		respondWithError(w, http.StatusServiceUnavailable, "Live ingest is not enabled on this server", nil)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+
+	user, err := cfg.db.GetUser(userID)
+	if err != nil || user == nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if user.StreamKey == nil {
+		streamKey, err := auth.MakeRefreshToken()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't generate stream key", err)
+			return
+		}
+		if err := cfg.db.UpdateUserStreamKey(userID, streamKey); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't save stream key", err)
+			return
+		}
+		user.StreamKey = &streamKey
+	}
+
+	video, err := cfg.createVideo(database.CreateVideoParams{
+		Title:       params.Title,
+		Description: params.Description,
+		UserID:      userID,
+	}, "", userID, map[string]any{"source": "live"})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create video", err)
+		return
+	}
+
+	session, err := cfg.startLiveSession(video, *user.StreamKey)
+	if errors.Is(err, errNoFreeIngestPort) {
+		respondWithError(w, http.StatusServiceUnavailable, "All live ingest slots are busy, try again later", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't start live session", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, session)
+}
+
+func (cfg *apiConfig) handlerLiveSessionGet(w http.ResponseWriter, r *http.Request) {
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	if cfg.liveIngest == nil {
+		respondWithError(w, http.StatusNotFound, "Live session not found", nil)
+		return
+	}
+	session, ok := cfg.liveIngest.session(videoID)
+	if !ok || session.userID != userID {
+		respondWithError(w, http.StatusNotFound, "Live session not found", nil)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, session)
+}
@@ -2,17 +2,21 @@ package main
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
 	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
 )
 
 func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		Password string `json:"password"`
 		Email    string `json:"email"`
+		// CaptchaToken is only needed after repeated failures
+		CaptchaToken string `json:"captcha_token"`
 	}
 	type response struct {
 		database.User
@@ -28,21 +32,47 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	subjects := loginSubjects(r, params.Email)
+	if !cfg.checkLoginThrottle(w, r, subjects, params.CaptchaToken) {
+		return
+	}
+
 	user, err := cfg.db.GetUserByEmail(params.Email)
 	if err != nil {
+		cfg.recordLoginFailure(subjects)
 		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password", err)
 		return
 	}
 
-	err = auth.CheckPasswordHash(params.Password, user.Password)
+	rehash, err := cfg.passwords.Check(params.Password, user.Password)
 	if err != nil {
+		cfg.recordLoginFailure(subjects)
 		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password", err)
 		return
 	}
+	// Checked only once the password is right, so it doesn't tell anyone
+	// else the account exists
+	if user.Disabled {
+		respondWithErrorCode(w, http.StatusForbidden, "account_disabled", "This account is disabled", errUserDisabled)
+		return
+	}
+	// The password is only in hand at sign-in, so that's when hashes from
+	// bcrypt or older settings are brought up to date
+	if rehash {
+		if err := cfg.upgradePasswordHash(user.ID, params.Password); err != nil {
+			log.Printf("Couldn't upgrade password hash for user %s: %v", user.ID, err)
+		}
+	}
+	// Only the account is cleared: one good password mustn't reset the
+	// count of an address trying many accounts
+	if err := cfg.db.ClearLoginFailures(subjects[0]); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't clear failed sign-ins", err)
+		return
+	}
 
 	accessToken, err := auth.MakeJWT(
 		user.ID,
-		cfg.jwtSecret,
+		cfg.jwtSecret.get(),
 		time.Hour*24*30,
 	)
 	if err != nil {
@@ -72,3 +102,15 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 		RefreshToken: refreshToken,
 	})
 }
+
+func (cfg *apiConfig) upgradePasswordHash(userID uuid.UUID, password string) error {
+	hashedPassword, err := cfg.passwords.Hash(password)
+	if err != nil {
+		return err
+	}
+	if err := cfg.db.UpdateUserPassword(userID, hashedPassword); err != nil {
+		return err
+	}
+	cfg.metrics.add("tubely_password_rehashes_total", 1)
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+)
+
+// handlerMedia serves unencrypted videos and bucket thumbnails when their
+// URLs point at this server: the presigned delivery mode redirects to a
+// short-lived S3 URL, so the bucket can stay private without the bytes
+// passing through here, and the proxy mode streams the object itself. Only
+// keys the app files media under are served.
+func (cfg *apiConfig) handlerMedia(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if cfg.urls.Mode() != media.DeliveryPresigned && cfg.urls.Mode() != media.DeliveryProxy {
+		respondWithError(w, http.StatusNotFound, "Media isn't served from this server", nil)
+		return
+	}
+	if !mediaKey(key) {
+		respondWithError(w, http.StatusNotFound, "Media not found", nil)
+		return
+	}
+	if strings.HasPrefix(key, thumbnailKeyPrefix) {
+		if !cfg.validAssetSignature(r) {
+			respondWithError(w, http.StatusForbidden, "Asset URL is unsigned or has expired", nil)
+			return
+		}
+	} else {
+		video, err := cfg.getVideoByURLShared(cfg.videoDeliveryURL(key))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+			return
+		}
+		if _, permitted := cfg.checkGeoRestriction(r, video); !permitted {
+			respondGeoBlocked(w)
+			return
+		}
+	}
+	input := &s3.GetObjectInput{Bucket: &cfg.s3Bucket, Key: &key}
+
+	// A presigned URL is only good for GET, so HEAD is answered here
+	if cfg.urls.Mode() == media.DeliveryPresigned && r.Method != http.MethodHead {
+		presigned, err := cfg.presignGetShared(r.Context(), input, streamURLTTL)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't create media URL", err)
+			return
+		}
+		// The presigned URL expires, so the redirect mustn't be cached past it
+		w.Header().Set("Cache-Control", "private, no-store")
+		http.Redirect(w, r, presigned, http.StatusFound)
+		return
+	}
+
+	if cfg.streamCache != nil && r.Method == http.MethodGet {
+		served, err := cfg.streamFromCache(w, r, input, cfg.bandwidth.defaultRate, func(head *s3.GetObjectOutput) {
+			setMediaHeaders(w, head)
+		})
+		if err != nil {
+			respondWithMediaError(w, err)
+			return
+		}
+		if served {
+			return
+		}
+	}
+
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		input.Range = &rangeHeader
+	}
+	out, err := cfg.getVideoObject(r.Context(), r.Method, input)
+	if err != nil {
+		respondWithMediaError(w, err)
+		return
+	}
+	defer out.Body.Close()
+
+	setMediaHeaders(w, out)
+	w.Header().Set("Accept-Ranges", "bytes")
+	if out.ContentLength != nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(*out.ContentLength, 10))
+	}
+	status := http.StatusOK
+	if out.ContentRange != nil {
+		w.Header().Set("Content-Range", *out.ContentRange)
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+
+	if _, err := cfg.buffers.copy(throttleResponse(w, cfg.bandwidth.defaultRate), out.Body); err != nil {
+		// Players routinely abort range requests mid-body; nothing to report
+		return
+	}
+}
+
+// setMediaHeaders passes on the headers an object was stored with.
+func setMediaHeaders(w http.ResponseWriter, out *s3.GetObjectOutput) {
+	contentType := "application/octet-stream"
+	if out.ContentType != nil {
+		contentType = *out.ContentType
+	}
+	w.Header().Set("Content-Type", contentType)
+	if out.CacheControl != nil {
+		w.Header().Set("Cache-Control", *out.CacheControl)
+	}
+	if out.ContentDisposition != nil {
+		w.Header().Set("Content-Disposition", *out.ContentDisposition)
+	}
+	if out.ETag != nil {
+		w.Header().Set("ETag", *out.ETag)
+	}
+}
+
+func respondWithMediaError(w http.ResponseWriter, err error) {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	if errors.As(err, &noSuchKey) || errors.As(err, &notFound) {
+		respondWithError(w, http.StatusNotFound, "Media not found", err)
+		return
+	}
+	respondWithError(w, http.StatusBadGateway, "Couldn't fetch media from storage", err)
+}
+
+// mediaKey reports whether key is somewhere the app stores videos or
+// thumbnails, as opposed to staging areas, quarantine and the like.
+func mediaKey(key string) bool {
+	if strings.Contains(key, "..") {
+		return false
+	}
+	for _, prefix := range append(slices.Clone(media.KeyPrefixes), thumbnailKeyPrefix) {
+		if rest, ok := strings.CutPrefix(key, prefix); ok && rest != "" {
+			return true
+		}
+	}
+	return false
+}
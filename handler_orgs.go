@@ -0,0 +1,251 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerOrgCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name string `json:"name" validate:"required,max=100"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+
+	org, err := cfg.db.CreateOrganization(params.Name, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create organization", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, org)
+}
+
+func (cfg *apiConfig) handlerOrgsRetrieve(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	orgs, err := cfg.db.GetOrganizationsForUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve organizations", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, orgs)
+}
+
+func (cfg *apiConfig) handlerOrgMembersRetrieve(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := pathUUID(w, r, "orgID")
+	if !ok {
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	role, err := cfg.db.GetOrgMemberRole(orgID, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check membership", err)
+		return
+	}
+	if role == "" {
+		respondWithError(w, http.StatusNotFound, "Organization not found", nil)
+		return
+	}
+
+	members, err := cfg.db.GetOrgMembers(orgID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve members", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, members)
+}
+
+// handlerOrgMemberPut adds a user to the organization by email, or changes
+// the role of an existing member. Only admins and owners can do this, and
+// only owners can create other owners.
+func (cfg *apiConfig) handlerOrgMemberPut(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string `json:"email" validate:"required"`
+		Role  string `json:"role" validate:"required"`
+	}
+
+	orgID, ok := pathUUID(w, r, "orgID")
+	if !ok {
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+	if !database.ValidOrgRole(params.Role) {
+		respondWithValidationError(w, map[string]string{"role": "must be owner, admin, uploader or viewer"}, nil)
+		return
+	}
+
+	callerRole, err := cfg.db.GetOrgMemberRole(orgID, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check membership", err)
+		return
+	}
+	if callerRole != database.OrgRoleOwner && callerRole != database.OrgRoleAdmin {
+		respondWithError(w, http.StatusForbidden, "Only organization admins can manage members", nil)
+		return
+	}
+
+	member, err := cfg.db.GetUserByEmail(params.Email)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if member.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "No user with that email", nil)
+		return
+	}
+
+	currentRole, err := cfg.db.GetOrgMemberRole(orgID, member.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check membership", err)
+		return
+	}
+	if (params.Role == database.OrgRoleOwner || currentRole == database.OrgRoleOwner) && callerRole != database.OrgRoleOwner {
+		respondWithError(w, http.StatusForbidden, "Only owners can grant or change the owner role", nil)
+		return
+	}
+	if currentRole == database.OrgRoleOwner && params.Role != database.OrgRoleOwner {
+		if ok := cfg.keepsAnOwner(w, orgID); !ok {
+			return
+		}
+	}
+
+	if err := cfg.db.PutOrgMember(orgID, member.ID, params.Role); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update membership", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, database.OrgMember{
+		UserID: member.ID,
+		Email:  member.Email,
+		Role:   params.Role,
+	})
+}
+
+// handlerOrgMemberDelete removes a member. Admins can remove anyone but
+// owners, and every member can remove themselves.
+func (cfg *apiConfig) handlerOrgMemberDelete(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := pathUUID(w, r, "orgID")
+	if !ok {
+		return
+	}
+	memberID, ok := pathUUID(w, r, "userID")
+	if !ok {
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	callerRole, err := cfg.db.GetOrgMemberRole(orgID, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check membership", err)
+		return
+	}
+	memberRole, err := cfg.db.GetOrgMemberRole(orgID, memberID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check membership", err)
+		return
+	}
+	if memberRole == "" {
+		respondWithError(w, http.StatusNotFound, "Member not found", nil)
+		return
+	}
+
+	allowed := memberID == userID ||
+		callerRole == database.OrgRoleOwner ||
+		(callerRole == database.OrgRoleAdmin && memberRole != database.OrgRoleOwner)
+	if !allowed {
+		respondWithError(w, http.StatusForbidden, "You can't remove this member", nil)
+		return
+	}
+	if memberRole == database.OrgRoleOwner {
+		if ok := cfg.keepsAnOwner(w, orgID); !ok {
+			return
+		}
+	}
+
+	if _, err := cfg.db.DeleteOrgMember(orgID, memberID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't remove member", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// keepsAnOwner refuses to demote or remove an organization's last owner,
+// which would leave nobody able to manage it.
+func (cfg *apiConfig) keepsAnOwner(w http.ResponseWriter, orgID uuid.UUID) bool {
+	owners, err := cfg.db.CountOrgOwners(orgID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't count owners", err)
+		return false
+	}
+	if owners <= 1 {
+		respondWithError(w, http.StatusConflict, "An organization must keep at least one owner", nil)
+		return false
+	}
+	return true
+}
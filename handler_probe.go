@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+)
+
+// maxProbeSize caps how much of a file POST /api/probe reads. MP4s with
+// their metadata at the front describe themselves in far less.
+const maxProbeSize = 8 << 20 // 8 MB
+
+type probeProblem struct {
+	Code   string `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// handlerProbe inspects the start of a file a client is about to upload and
+// reports what it is and whether the whole upload would be accepted, so the
+// client can give up before sending a gigabyte that would be refused. The
+// body is the raw first bytes of the file. The optional size and
+// checksum_sha256 query parameters, describing the whole file, are checked
+// against the upload limit and the quarantine.
+//
+// Only what can be told from the start of the file is checked. A file that
+// passes can still fail once it's all there, e.g. if it's truncated.
+func (cfg *apiConfig) handlerProbe(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Container      string         `json:"container"`
+		VideoCodec     *string        `json:"video_codec"`
+		AudioCodec     *string        `json:"audio_codec"`
+		AudioLanguages []string       `json:"audio_languages"`
+		Width          int            `json:"width"`
+		Height         int            `json:"height"`
+		Duration       float64        `json:"duration"`
+		AspectRatio    string         `json:"aspect_ratio"`
+		Accepted       bool           `json:"accepted"`
+		Transcode      bool           `json:"transcode"`
+		Problems       []probeProblem `json:"problems"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	if _, err := cfg.validateJWT(token); err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	var size int64
+	if v := r.URL.Query().Get("size"); v != "" {
+		size, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || size < 1 {
+			respondWithValidationError(w, map[string]string{"size": "must be a positive number of bytes"}, err)
+			return
+		}
+	}
+	checksum := strings.ToLower(r.URL.Query().Get("checksum_sha256"))
+	if checksum != "" {
+		if digest, err := hex.DecodeString(checksum); err != nil || len(digest) != sha256.Size {
+			respondWithValidationError(w, map[string]string{"checksum_sha256": "must be a hex-encoded SHA-256 digest"}, err)
+			return
+		}
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxProbeSize)
+	tempFile, err := os.CreateTemp("", "tubely-probe-*.mp4")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create temp file", err)
+		return
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+	if _, err := cfg.buffers.copy(tempFile, r.Body); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondWithErrorCode(w, http.StatusRequestEntityTooLarge, "request_too_large", "Send at most the first 8 MB of the file", err)
+			return
+		}
+		respondWithError(w, http.StatusBadRequest, "Couldn't read request body", err)
+		return
+	}
+
+	resp := response{AudioLanguages: []string{}, Problems: []probeProblem{}}
+	header := make([]byte, 512)
+	n, _ := tempFile.ReadAt(header, 0)
+	if n == 0 {
+		respondWithValidationError(w, map[string]string{"body": "must hold the start of the file"}, nil)
+		return
+	}
+	resp.Container = media.SniffContentType(header[:n])
+
+	if size > maxVideoUploadSize {
+		resp.Problems = append(resp.Problems, probeProblem{Code: "request_too_large", Reason: "File is larger than the 1 GB upload limit"})
+	}
+	if checksum != "" {
+		failure, err := cfg.db.GetInputFailure(checksum)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check file against quarantine", err)
+			return
+		}
+		if failure.QuarantinedAt != nil {
+			resp.Problems = append(resp.Problems, probeProblem{Code: "input_quarantined", Reason: quarantinedUploadError(failure).msg})
+		}
+	}
+
+	if resp.Container != "video/mp4" && resp.Container != "video/quicktime" {
+		resp.Problems = append(resp.Problems, probeProblem{Code: "unsupported_container", Reason: "File isn't an MP4"})
+		respondWithJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	info, err := cfg.probeStreamInfo(tempFile.Name())
+	switch {
+	case errors.Is(err, errNoVideoStream):
+		resp.Problems = append(resp.Problems, probeProblem{Code: "no_video_stream", Reason: "File doesn't contain a video stream"})
+	case err != nil:
+		resp.Problems = append(resp.Problems, probeProblem{
+			Code:   "metadata_not_found",
+			Reason: "The start of the file doesn't describe its streams; send more of it, or move the moov box to the front",
+		})
+	default:
+		if info.videoCodec != "" {
+			resp.VideoCodec = &info.videoCodec
+		}
+		if info.audioCodec != "" {
+			resp.AudioCodec = &info.audioCodec
+		}
+		resp.AudioLanguages = append(resp.AudioLanguages, info.audioLanguages...)
+		resp.Width, resp.Height = info.width, info.height
+		resp.Duration = info.duration
+		resp.AspectRatio = media.AspectRatioOf(info.width, info.height)
+
+		var validationErr *videoValidationError
+		if err := cfg.checkStreamInfo(info); errors.As(err, &validationErr) {
+			resp.Problems = append(resp.Problems, probeProblem{Code: validationErr.Code, Reason: validationErr.Reason})
+		}
+		resp.Transcode = cfg.codecs.video.transcodeEncoder(info.videoCodec) != "" ||
+			cfg.codecs.audio.transcodeEncoder(info.audioCodec) != ""
+	}
+
+	resp.Accepted = len(resp.Problems) == 0
+	respondWithJSON(w, http.StatusOK, resp)
+}
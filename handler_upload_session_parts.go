@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	// minUploadPartSize keeps per-request overhead small relative to the
+	// data; only a file smaller than this may be sent as a single part.
+	minUploadPartSize = 1 << 20 // 1 MB
+	maxUploadParts    = 10000
+)
+
+// uploadPartsPath is the staging file a proxy session's file is written
+// into. A multi-part session's parts each go at their own offset, so the
+// file is reassembled as the parts arrive in whatever order.
+func (cfg *apiConfig) uploadPartsPath(sessionID uuid.UUID) string {
+	return filepath.Join(cfg.uploadPartsRoot, sessionID.String()+".mp4")
+}
+
+// handlerUploadSessionPartPut receives part n of a multi-part session. Parts
+// can be sent concurrently and re-sent; the latest upload of a part wins.
+func (cfg *apiConfig) handlerUploadSessionPartPut(w http.ResponseWriter, r *http.Request) {
+	session, userID, ok := cfg.uploadSessionForRequest(w, r)
+	if !ok {
+		return
+	}
+	if session.PartSize == 0 {
+		respondWithError(w, http.StatusConflict, "This session doesn't upload in parts", nil)
+		return
+	}
+	if session.Status != database.UploadStatusPending {
+		respondWithError(w, http.StatusConflict, fmt.Sprintf("Upload session is %s", session.Status), nil)
+		return
+	}
+	if time.Now().After(session.ExpiresAt) {
+		respondWithError(w, http.StatusConflict, "Upload session has expired", nil)
+		return
+	}
+	partNumber, err := strconv.Atoi(r.PathValue("n"))
+	if err != nil || partNumber < 1 || partNumber > session.PartCount() {
+		respondWithValidationError(w, map[string]string{"n": fmt.Sprintf("must be a part number from 1 to %d", session.PartCount())}, err)
+		return
+	}
+
+	offset := int64(partNumber-1) * session.PartSize
+	partSize := min(session.PartSize, session.Size-offset)
+
+	file, err := os.OpenFile(cfg.uploadPartsPath(session.ID), os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open upload staging file", err)
+		return
+	}
+	defer file.Close()
+
+	r.Body = throttleBody(r.Body, cfg.userBandwidth(userID))
+	if !decodeRequestBody(w, r, partSize) {
+		return
+	}
+	hash := sha256.New()
+	written, err := cfg.buffers.copy(io.MultiWriter(io.NewOffsetWriter(file, offset), hash), r.Body)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondWithErrorCode(w, http.StatusRequestEntityTooLarge, "part_size_mismatch", fmt.Sprintf("Part %d must be exactly %d bytes", partNumber, partSize), err)
+			return
+		}
+		respondWithError(w, http.StatusBadRequest, "Couldn't read part body", err)
+		return
+	}
+	if written != partSize {
+		respondWithErrorCode(w, http.StatusBadRequest, "part_size_mismatch", fmt.Sprintf("Part %d must be exactly %d bytes, got %d", partNumber, partSize, written), nil)
+		return
+	}
+
+	part := database.UploadSessionPart{
+		PartNumber:     partNumber,
+		Size:           written,
+		ChecksumSHA256: hex.EncodeToString(hash.Sum(nil)),
+		ReceivedAt:     time.Now().UTC(),
+	}
+	if err := cfg.db.PutUploadSessionPart(session.ID, part); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record part", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, part)
+}
+
+// partManifest lists the SHA-256 of every part of a multi-part session as
+// the client computed it before sending, so a corrupted part can be named
+// instead of only failing the whole file's checksum.
+type partManifest struct {
+	Parts []partManifestEntry `json:"parts" validate:"required"`
+}
+
+type partManifestEntry struct {
+	PartNumber     int    `json:"part_number"`
+	ChecksumSHA256 string `json:"checksum_sha256"`
+}
+
+// checksums returns the manifest's checksum of each part by number, or the
+// problems that keep it from covering the session's parts exactly once.
+func (m partManifest) checksums(partCount int) (map[int]string, map[string]string) {
+	checksums := make(map[int]string, len(m.Parts))
+	fields := map[string]string{}
+	for i, part := range m.Parts {
+		field := fmt.Sprintf("parts[%d]", i)
+		if part.PartNumber < 1 || part.PartNumber > partCount {
+			fields[field+".part_number"] = fmt.Sprintf("must be a part number from 1 to %d", partCount)
+			continue
+		}
+		if _, ok := checksums[part.PartNumber]; ok {
+			fields[field+".part_number"] = "is listed more than once"
+			continue
+		}
+		checksum := strings.ToLower(part.ChecksumSHA256)
+		if sum, err := hex.DecodeString(checksum); err != nil || len(sum) != sha256.Size {
+			fields[field+".checksum_sha256"] = "must be a hex-encoded SHA-256 digest"
+			continue
+		}
+		checksums[part.PartNumber] = checksum
+	}
+	if len(fields) == 0 && len(checksums) != partCount {
+		fields["parts"] = fmt.Sprintf("must list all %d parts", partCount)
+	}
+	return checksums, fields
+}
+
+// verifyUploadParts checks every part against the manifest, reporting why
+// each one that doesn't match is wrong. A part whose bytes hashed
+// differently on arrival was corrupted on the way; one that matched then
+// is read back from the staging file, which catches damage since, like two
+// uploads of the same part overlapping.
+func (cfg *apiConfig) verifyUploadParts(session database.UploadSession, parts []database.UploadSessionPart, manifest map[int]string) (map[int]string, error) {
+	file, err := os.Open(cfg.uploadPartsPath(session.ID))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	corrupted := map[int]string{}
+	for _, part := range parts {
+		if part.ChecksumSHA256 != manifest[part.PartNumber] {
+			corrupted[part.PartNumber] = "was corrupted in transit: the bytes received don't match the manifest"
+			continue
+		}
+		hash := sha256.New()
+		offset := int64(part.PartNumber-1) * session.PartSize
+		if _, err := cfg.buffers.copy(hash, io.NewSectionReader(file, offset, part.Size)); err != nil {
+			return nil, err
+		}
+		if hex.EncodeToString(hash.Sum(nil)) != part.ChecksumSHA256 {
+			corrupted[part.PartNumber] = "was damaged after it was received"
+		}
+	}
+	return corrupted, nil
+}
+
+// respondWithCorruptedParts names the parts to upload again. The session
+// stays pending, so re-sending them and completing again is enough.
+func respondWithCorruptedParts(w http.ResponseWriter, corrupted map[int]string) {
+	type response struct {
+		Error  string            `json:"error"`
+		Code   string            `json:"code"`
+		Fields map[string]string `json:"fields"`
+	}
+
+	numbers := make([]int, 0, len(corrupted))
+	for n := range corrupted {
+		numbers = append(numbers, n)
+	}
+	slices.Sort(numbers)
+	listed := make([]string, 0, len(numbers))
+	fields := make(map[string]string, len(numbers))
+	for _, n := range numbers {
+		listed = append(listed, strconv.Itoa(n))
+		fields[fmt.Sprintf("parts.%d", n)] = corrupted[n]
+	}
+	if len(listed) > 20 {
+		listed = append(listed[:20], "...")
+	}
+	msg := fmt.Sprintf("Part %s is corrupted; upload it again", listed[0])
+	if len(numbers) > 1 {
+		msg = fmt.Sprintf("Parts %s are corrupted; upload them again", strings.Join(listed, ", "))
+	}
+	respondWithJSON(w, http.StatusUnprocessableEntity, response{
+		Error:  msg,
+		Code:   "part_checksum_mismatch",
+		Fields: fields,
+	})
+}
+
+// completeUploadSessionParts finalizes a multi-part session once every part
+// has arrived. With a manifest of the parts' checksums in the body, each
+// part is checked against it first. The reassembled file is then checked
+// against the declared checksum like any other session upload.
+func (cfg *apiConfig) completeUploadSessionParts(w http.ResponseWriter, r *http.Request, session database.UploadSession) {
+	var manifest map[int]string
+	if r.ContentLength != 0 {
+		params, ok := decodeJSON[partManifest](w, r)
+		if !ok {
+			return
+		}
+		checksums, fields := params.checksums(session.PartCount())
+		if len(fields) > 0 {
+			respondWithValidationError(w, fields, nil)
+			return
+		}
+		manifest = checksums
+	}
+
+	if !cfg.claimUploadSession(w, session) {
+		return
+	}
+
+	parts, err := cfg.db.GetUploadSessionParts(session.ID)
+	if err != nil {
+		cfg.releaseUploadSession(session)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload session parts", err)
+		return
+	}
+	received := make(map[int]bool, len(parts))
+	for _, part := range parts {
+		received[part.PartNumber] = true
+	}
+	var missing []string
+	for n := 1; n <= session.PartCount(); n++ {
+		if !received[n] {
+			missing = append(missing, strconv.Itoa(n))
+		}
+	}
+	if len(missing) > 0 {
+		cfg.releaseUploadSession(session)
+		if len(missing) > 20 {
+			missing = append(missing[:20], "...")
+		}
+		respondWithError(w, http.StatusConflict, "Missing parts: "+strings.Join(missing, ", "), nil)
+		return
+	}
+	if manifest != nil {
+		corrupted, err := cfg.verifyUploadParts(session, parts, manifest)
+		if err != nil {
+			cfg.releaseUploadSession(session)
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check received parts", err)
+			return
+		}
+		if len(corrupted) > 0 {
+			cfg.releaseUploadSession(session)
+			cfg.metrics.add("tubely_upload_parts_corrupted_total", float64(len(corrupted)))
+			respondWithCorruptedParts(w, corrupted)
+			return
+		}
+	}
+
+	// The reassembled file stays while a retry could still need it
+	filePath := cfg.uploadPartsPath(session.ID)
+	if err := cfg.completeUploadSession(w, r, session, filePath); err == nil || !isRetryableUpload(err) {
+		os.Remove(filePath)
+	}
+}
+
+// removeAbandonedUploadParts deletes staging files whose session is gone,
+// expired or no longer accepting parts.
+func (cfg *apiConfig) removeAbandonedUploadParts(ctx context.Context) error {
+	entries, err := os.ReadDir(cfg.uploadPartsRoot)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		sessionID, err := uuid.Parse(strings.TrimSuffix(entry.Name(), ".mp4"))
+		if err != nil {
+			continue
+		}
+		session, err := cfg.db.GetUploadSession(sessionID)
+		if err != nil {
+			return err
+		}
+		// Processing sessions are still reading their file
+		if session.Status == database.UploadStatusProcessing {
+			continue
+		}
+		if session.ID != uuid.Nil && session.Status == database.UploadStatusPending && time.Now().Before(session.ExpiresAt) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(cfg.uploadPartsRoot, entry.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
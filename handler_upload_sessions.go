@@ -0,0 +1,690 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+	"github.com/google/uuid"
+)
+
+// uploadSessionTTL is how long a client has to send and finalize the file it
+// declared.
+const uploadSessionTTL = 24 * time.Hour
+
+// uploadSessionStagingKey is where presigned uploads land before they are
+// verified and processed.
+func uploadSessionStagingKey(sessionID uuid.UUID) string {
+	return "uploads/" + sessionID.String() + ".mp4"
+}
+
+// handlerUploadSessionCreate checks everything about an upload that can be
+// known before the file is sent, so a doomed upload fails before any bytes
+// move. The response says where to send the file: back to the API for proxy
+// sessions, or straight to S3 for presigned ones.
+func (cfg *apiConfig) handlerUploadSessionCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		VideoID        string `json:"video_id" validate:"required,uuid"`
+		Filename       string `json:"filename" validate:"required,max=255"`
+		Size           int64  `json:"size" validate:"required,min=1,max=1073741824"`
+		ContentType    string `json:"content_type" validate:"required"`
+		ChecksumSHA256 string `json:"checksum_sha256" validate:"required"`
+		Target         string `json:"target"`
+		PartSize       int64  `json:"part_size" validate:"min=0,max=1073741824"`
+		IntroVideoID   string `json:"intro_video_id"`
+		OutroVideoID   string `json:"outro_video_id"`
+		uploadFlags
+	}
+	type response struct {
+		database.UploadSession
+		UploadMethod  string      `json:"upload_method"`
+		UploadURL     string      `json:"upload_url"`
+		UploadHeaders http.Header `json:"upload_headers,omitempty"`
+		CompleteURL   string      `json:"complete_url,omitempty"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+	settings, err := cfg.db.GetUserSettings(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get settings", err)
+		return
+	}
+	opts := params.uploadFlags.options(settings.UploadDefaults)
+	opts.IntroVideoID = params.IntroVideoID
+	opts.OutroVideoID = params.OutroVideoID
+
+	fields := map[string]string{}
+	if mediaType, _, err := mime.ParseMediaType(params.ContentType); err != nil || mediaType != "video/mp4" {
+		fields["content_type"] = "must be video/mp4"
+	}
+	if !strings.EqualFold(filepath.Ext(params.Filename), ".mp4") {
+		fields["filename"] = "must have a .mp4 extension"
+	}
+	params.ChecksumSHA256 = strings.ToLower(params.ChecksumSHA256)
+	if checksum, err := hex.DecodeString(params.ChecksumSHA256); err != nil || len(checksum) != sha256.Size {
+		fields["checksum_sha256"] = "must be a hex-encoded SHA-256 digest"
+	}
+	if params.Target == "" {
+		params.Target = database.UploadTargetProxy
+	}
+	switch params.Target {
+	case database.UploadTargetProxy:
+	case database.UploadTargetPresigned:
+		if opts.Encrypt {
+			// The staged object would sit in the bucket unencrypted
+			fields["target"] = "must be proxy for encrypted uploads"
+		}
+	default:
+		fields["target"] = "must be proxy or presigned"
+	}
+	if params.PartSize > 0 {
+		switch {
+		case params.Target != database.UploadTargetProxy:
+			fields["part_size"] = "is only supported for proxy uploads"
+		case params.PartSize < minUploadPartSize && params.PartSize < params.Size:
+			fields["part_size"] = fmt.Sprintf("must be at least %d bytes", minUploadPartSize)
+		case (params.Size+params.PartSize-1)/params.PartSize > maxUploadParts:
+			fields["part_size"] = fmt.Sprintf("must split the file into at most %d parts", maxUploadParts)
+		}
+	}
+	if len(fields) > 0 {
+		respondWithValidationError(w, fields, nil)
+		return
+	}
+	videoID := uuid.MustParse(params.VideoID)
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	allowed := false
+	if video.ID != uuid.Nil {
+		allowed, err = cfg.canAccessVideo(userID, video, permEdit)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check video permissions", err)
+			return
+		}
+	}
+	if !allowed {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.LegalHold {
+		respondWithError(w, http.StatusConflict, "This video is under legal hold and its file can't be replaced", nil)
+		return
+	}
+
+	// Processing options that are bound to fail would otherwise only be
+	// noticed after the whole file has arrived
+	if opts.Encrypt && cfg.keyWrapper == nil {
+		respondWithError(w, http.StatusBadRequest, "Encryption at rest is not enabled on this server", errEncryptionDisabled)
+		return
+	}
+	if opts.Watermark {
+		if _, err := cfg.resolveWatermark(userID); errors.Is(err, errNoWatermark) {
+			respondWithError(w, http.StatusBadRequest, "No watermark image is configured for this account", err)
+			return
+		} else if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't find watermark image", err)
+			return
+		}
+	}
+	user, err := cfg.db.GetUser(userID)
+	if err != nil || user == nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if _, err := cfg.stitchClipKey(userID, params.IntroVideoID, user.IntroVideoID); err != nil {
+		respondWithStitchError(w, err)
+		return
+	}
+	if _, err := cfg.stitchClipKey(userID, params.OutroVideoID, user.OutroVideoID); err != nil {
+		respondWithStitchError(w, err)
+		return
+	}
+
+	session, err := cfg.db.CreateUploadSession(database.UploadSession{
+		ExpiresAt:      time.Now().Add(uploadSessionTTL),
+		UserID:         userID,
+		VideoID:        videoID,
+		Filename:       media.SanitizeFilename(params.Filename),
+		Size:           params.Size,
+		ContentType:    params.ContentType,
+		ChecksumSHA256: params.ChecksumSHA256,
+		Target:         params.Target,
+		PartSize:       params.PartSize,
+		UploadOptions:  opts,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload session", err)
+		return
+	}
+	cfg.recordVideoEvent(video, database.VideoEventUploadStarted, userID, map[string]any{"upload_session_id": session.ID})
+
+	sessionURL := cfg.urls.Server("/api/upload-sessions/" + session.ID.String())
+	if session.PartSize > 0 {
+		respondWithJSON(w, http.StatusCreated, response{
+			UploadSession: session,
+			UploadMethod:  http.MethodPut,
+			UploadURL:     sessionURL + "/parts/{n}",
+			CompleteURL:   sessionURL + "/complete",
+		})
+		return
+	}
+	if session.Target == database.UploadTargetProxy {
+		respondWithJSON(w, http.StatusCreated, response{
+			UploadSession: session,
+			UploadMethod:  http.MethodPut,
+			UploadURL:     sessionURL,
+		})
+		return
+	}
+
+	// S3 enforces the declared length and checksum on the presigned PUT
+	// itself; finalizing checks them again before processing
+	checksum, _ := hex.DecodeString(session.ChecksumSHA256)
+	encodedChecksum := base64.StdEncoding.EncodeToString(checksum)
+	stagingKey := uploadSessionStagingKey(session.ID)
+	presigned, err := s3.NewPresignClient(cfg.s3Client).PresignPutObject(r.Context(), &s3.PutObjectInput{
+		Bucket:         &cfg.s3Bucket,
+		Key:            &stagingKey,
+		ContentType:    &session.ContentType,
+		ContentLength:  &session.Size,
+		ChecksumSHA256: &encodedChecksum,
+	}, s3.WithPresignExpires(uploadSessionTTL))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload URL", err)
+		return
+	}
+	headers := presigned.SignedHeader.Clone()
+	headers.Del("Host")
+
+	respondWithJSON(w, http.StatusCreated, response{
+		UploadSession: session,
+		UploadMethod:  presigned.Method,
+		UploadURL:     presigned.URL,
+		UploadHeaders: headers,
+		CompleteURL:   sessionURL + "/complete",
+	})
+}
+
+func (cfg *apiConfig) handlerUploadSessionGet(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		database.UploadSession
+		Parts []database.UploadSessionPart `json:"parts,omitempty"`
+	}
+
+	session, _, ok := cfg.uploadSessionForRequest(w, r)
+	if !ok {
+		return
+	}
+
+	// Listing the parts that made it lets a client resume after a crash
+	var parts []database.UploadSessionPart
+	if session.PartSize > 0 {
+		var err error
+		parts, err = cfg.db.Primary().GetUploadSessionParts(session.ID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get upload session parts", err)
+			return
+		}
+		for _, part := range parts {
+			session.BytesReceived += part.Size
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, response{UploadSession: session, Parts: parts})
+}
+
+// uploadProgressInterval is how often a proxy upload records how much of
+// the file it has kept, which bounds what a restart makes the client send
+// again.
+const uploadProgressInterval = 8 << 20 // 8 MB
+
+// handlerUploadSessionUpload receives the raw file of a proxy session,
+// rejecting it as soon as it runs past the declared size. The file is kept
+// as it arrives, so an interrupted upload, even one cut off by a restart,
+// resumes from bytes_received: the client sends the rest with a
+// Content-Range header like "bytes 1048576-5242879/5242880".
+func (cfg *apiConfig) handlerUploadSessionUpload(w http.ResponseWriter, r *http.Request) {
+	session, userID, ok := cfg.uploadSessionForRequest(w, r)
+	if !ok {
+		return
+	}
+	if session.Target != database.UploadTargetProxy {
+		respondWithError(w, http.StatusConflict, "This session uploads directly to S3; finalize it with POST /complete", nil)
+		return
+	}
+	if session.PartSize > 0 {
+		respondWithError(w, http.StatusConflict, "This session uploads in parts; PUT each one to /parts/{n}", nil)
+		return
+	}
+	offset, err := parseUploadContentRange(r.Header.Get("Content-Range"), session.Size)
+	if err != nil {
+		respondWithValidationError(w, map[string]string{"Content-Range": err.Error()}, err)
+		return
+	}
+	if received := cfg.receivedUploadBytes(session); offset > received {
+		respondWithErrorCode(w, http.StatusConflict, "offset_mismatch", fmt.Sprintf("Only %d bytes have been received; resume from there", received), nil)
+		return
+	}
+	release, ok := cfg.lockVideoUpload(w, session.VideoID, &session.ID)
+	if !ok {
+		return
+	}
+	defer release()
+	ctx, timings := withUploadTimings(r.Context(), session.Timings)
+	r = r.WithContext(ctx)
+	r.Body = throttleBody(r.Body, cfg.userBandwidth(userID))
+	if !decodeRequestBody(w, r, session.Size-offset) {
+		return
+	}
+	if !cfg.claimUploadSession(w, session) {
+		return
+	}
+
+	filePath := cfg.uploadPartsPath(session.ID)
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		cfg.releaseUploadSession(session)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open upload staging file", err)
+		return
+	}
+	defer file.Close()
+	if err := file.Truncate(offset); err != nil {
+		cfg.releaseUploadSession(session)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't prepare upload staging file", err)
+		return
+	}
+
+	recordProgress := func(written int64) {
+		if err := cfg.db.SetUploadSessionBytesReceived(session.ID, offset+written); err != nil {
+			log.Printf("Couldn't record progress of upload session %s: %v", session.ID, err)
+		}
+	}
+	progress := &progressWriter{w: io.NewOffsetWriter(file, offset), interval: uploadProgressInterval, report: recordProgress}
+	stopCopy := timings.track(stepCopy)
+	written, err := cfg.buffers.copy(progress, r.Body)
+	stopCopy()
+	recordProgress(written)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			os.Remove(filePath)
+			cfg.failUploadSession(w, session, http.StatusRequestEntityTooLarge, "size_mismatch",
+				fmt.Sprintf("Upload is larger than the declared %d bytes", session.Size))
+			return
+		}
+		// A dropped connection says nothing about the file, so the
+		// client can resume on the same session
+		cfg.releaseUploadSession(session)
+		respondWithError(w, http.StatusBadRequest, "Couldn't read upload body", err)
+		return
+	}
+	if offset+written < session.Size {
+		cfg.releaseUploadSession(session)
+		respondWithErrorCode(w, http.StatusBadRequest, "size_mismatch",
+			fmt.Sprintf("Received %d of the declared %d bytes; send the rest with a Content-Range header", offset+written, session.Size), nil)
+		return
+	}
+
+	// The file stays while a retry could still need it
+	if err := cfg.completeUploadSession(w, r, session, filePath); err == nil || !isRetryableUpload(err) {
+		os.Remove(filePath)
+	}
+}
+
+// parseUploadContentRange reads where a resumed proxy upload starts from a
+// Content-Range header, which has to run to the end of the file. Without the
+// header the body is the whole file.
+func parseUploadContentRange(header string, size int64) (int64, error) {
+	if header == "" {
+		return 0, nil
+	}
+	var first, last, total int64
+	if _, err := fmt.Sscanf(header, "bytes %d-%d/%d", &first, &last, &total); err != nil {
+		return 0, fmt.Errorf("must look like \"bytes 1024-%d/%d\"", size-1, size)
+	}
+	if total != size || last != size-1 || first < 0 || first > last {
+		return 0, fmt.Errorf("must run to the end of the declared %d bytes", size)
+	}
+	return first, nil
+}
+
+// receivedUploadBytes is how much of a proxy session's file this node has
+// kept. The staging file is local, so another node may have less than the
+// session records.
+func (cfg *apiConfig) receivedUploadBytes(session database.UploadSession) int64 {
+	info, err := os.Stat(cfg.uploadPartsPath(session.ID))
+	if err != nil {
+		return 0
+	}
+	return min(session.BytesReceived, info.Size())
+}
+
+// progressWriter calls report with the number of bytes written every
+// interval bytes, so a long copy can record how far it got.
+type progressWriter struct {
+	w        io.Writer
+	interval int64
+	report   func(written int64)
+	written  int64
+	reported int64
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.written += int64(n)
+	if p.written-p.reported >= p.interval {
+		p.report(p.written)
+		p.reported = p.written
+	}
+	return n, err
+}
+
+// handlerUploadSessionComplete finalizes a presigned session once the client
+// has PUT the file to S3, or a multi-part session once every part is in.
+func (cfg *apiConfig) handlerUploadSessionComplete(w http.ResponseWriter, r *http.Request) {
+	session, _, ok := cfg.uploadSessionForRequest(w, r)
+	if !ok {
+		return
+	}
+	release, ok := cfg.lockVideoUpload(w, session.VideoID, &session.ID)
+	if !ok {
+		return
+	}
+	defer release()
+	ctx, timings := withUploadTimings(r.Context(), session.Timings)
+	r = r.WithContext(ctx)
+	if session.PartSize > 0 {
+		cfg.completeUploadSessionParts(w, r, session)
+		return
+	}
+	if session.Target == database.UploadTargetProxy {
+		cfg.completeUploadSessionReceived(w, r, session)
+		return
+	}
+	if !cfg.claimUploadSession(w, session) {
+		return
+	}
+
+	stagingKey := uploadSessionStagingKey(session.ID)
+	head, err := cfg.s3Client.HeadObject(r.Context(), &s3.HeadObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &stagingKey,
+	})
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		cfg.releaseUploadSession(session)
+		respondWithError(w, http.StatusConflict, "The file hasn't been uploaded to S3 yet", err)
+		return
+	}
+	if err != nil {
+		cfg.releaseUploadSession(session)
+		respondWithError(w, http.StatusBadGateway, "Couldn't check staged upload", err)
+		return
+	}
+	if head.ContentLength == nil || *head.ContentLength != session.Size {
+		cfg.failUploadSession(w, session, http.StatusUnprocessableEntity, "size_mismatch",
+			fmt.Sprintf("Uploaded file doesn't match the declared size of %d bytes", session.Size))
+		return
+	}
+
+	// The staged object is already where a worker will look for it
+	if cfg.role == roleAPI {
+		cfg.queueUploadSession(w, r, session, "")
+		return
+	}
+
+	stopS3 := timings.track(stepS3)
+	filePath, err := cfg.downloadS3Object(r.Context(), stagingKey)
+	stopS3()
+	if err != nil {
+		cfg.releaseUploadSession(session)
+		respondWithError(w, http.StatusBadGateway, "Couldn't fetch staged upload", err)
+		return
+	}
+	defer os.Remove(filePath)
+
+	// Keep the staged object while a retry could still need it
+	if err := cfg.completeUploadSession(w, r, session, filePath); err == nil || !isRetryableUpload(err) {
+		cfg.deleteStagedUpload(r.Context(), session.ID)
+	}
+}
+
+// completeUploadSessionReceived finalizes a proxy session from the file
+// already received, as when its processing was interrupted by a restart or
+// failed in a way worth retrying, so the client doesn't have to send the
+// file again.
+func (cfg *apiConfig) completeUploadSessionReceived(w http.ResponseWriter, r *http.Request, session database.UploadSession) {
+	if received := cfg.receivedUploadBytes(session); received < session.Size {
+		respondWithErrorCode(w, http.StatusConflict, "offset_mismatch",
+			fmt.Sprintf("Only %d of %d bytes have been received; PUT the rest to the session URL", received, session.Size), nil)
+		return
+	}
+	if !cfg.claimUploadSession(w, session) {
+		return
+	}
+	filePath := cfg.uploadPartsPath(session.ID)
+	if err := cfg.completeUploadSession(w, r, session, filePath); err == nil || !isRetryableUpload(err) {
+		os.Remove(filePath)
+	}
+}
+
+// completeUploadSession processes a received file in a processing slot and
+// responds with the stored video, or queues it for a worker when this node
+// only serves the API. Retryable failures hand the session back to the
+// client as pending.
+func (cfg *apiConfig) completeUploadSession(w http.ResponseWriter, r *http.Request, session database.UploadSession, filePath string) error {
+	if cfg.role == roleAPI {
+		return cfg.queueUploadSession(w, r, session, filePath)
+	}
+
+	release, err := cfg.processing.acquire(r.Context(), session.UserID, priorityInteractive)
+	if err != nil {
+		cfg.releaseUploadSession(session)
+		respondWithError(w, http.StatusServiceUnavailable, "Gave up waiting for a processing slot", err)
+		return &uploadError{status: http.StatusServiceUnavailable, msg: "Gave up waiting for a processing slot", err: err, retryable: true}
+	}
+	video, err := cfg.processUploadSession(r.Context(), session, filePath)
+	release()
+	timings := uploadTimingsFrom(r.Context())
+	cfg.recordUploadTimings(session.VideoID, session.ID, timings)
+	if err != nil {
+		if isRetryableUpload(err) {
+			cfg.releaseUploadSession(session)
+		} else {
+			cfg.recordUploadSessionFailure(session, err)
+		}
+		respondWithUploadError(w, err)
+		return err
+	}
+
+	if err := cfg.db.SetUploadSessionStatus(session.ID, database.UploadStatusCompleted, nil); err != nil {
+		log.Printf("Couldn't mark upload session %s completed: %v", session.ID, err)
+	}
+	cfg.signVideoAssets(&video)
+	respondWithJSON(w, http.StatusOK, timedUploadResponse{Video: video, Timings: timings, Receipt: cfg.latestUploadReceipt(video.ID)})
+	return nil
+}
+
+// processUploadSession checks a received file against the session's
+// declaration and hands it to the regular upload pipeline. Errors are
+// *uploadError; recording the outcome on the session is up to the caller.
+func (cfg *apiConfig) processUploadSession(ctx context.Context, session database.UploadSession, filePath string) (database.Video, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return database.Video{}, &uploadError{status: http.StatusInternalServerError, msg: "Couldn't open received file", err: err, retryable: true}
+	}
+	hash := sha256.New()
+	stopCopy := uploadTimingsFrom(ctx).track(stepCopy)
+	size, err := cfg.buffers.copy(hash, file)
+	stopCopy()
+	file.Close()
+	if err != nil {
+		return database.Video{}, &uploadError{status: http.StatusInternalServerError, msg: "Couldn't read received file", err: err, retryable: true}
+	}
+	if size != session.Size {
+		return database.Video{}, &uploadError{status: http.StatusUnprocessableEntity, code: "size_mismatch",
+			msg: fmt.Sprintf("Received %d bytes but %d were declared", size, session.Size)}
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != session.ChecksumSHA256 {
+		return database.Video{}, &uploadError{status: http.StatusUnprocessableEntity, code: "checksum_mismatch",
+			msg: "Received file doesn't match the declared SHA-256 checksum"}
+	}
+
+	// Permissions may have changed since the session was created
+	video, err := cfg.db.GetVideo(session.VideoID)
+	if err != nil {
+		return database.Video{}, &uploadError{status: http.StatusInternalServerError, msg: "Couldn't get video", err: err, retryable: true}
+	}
+	allowed := false
+	if video.ID != uuid.Nil {
+		allowed, err = cfg.canAccessVideo(session.UserID, video, permEdit)
+		if err != nil {
+			return database.Video{}, &uploadError{status: http.StatusInternalServerError, msg: "Couldn't check video permissions", err: err, retryable: true}
+		}
+	}
+	if !allowed {
+		return database.Video{}, &uploadError{status: http.StatusNotFound, code: "video_not_found", msg: "Video not found"}
+	}
+	if video.LegalHold {
+		return database.Video{}, &uploadError{status: http.StatusConflict, code: "legal_hold", msg: "This video is under legal hold and its file can't be replaced"}
+	}
+
+	return cfg.processVideoUpload(ctx, video, session.UserID, filePath, session.Filename, session.UploadOptions)
+}
+
+// deleteStagedUpload removes a session's staged object once nothing will
+// read it again.
+func (cfg *apiConfig) deleteStagedUpload(ctx context.Context, sessionID uuid.UUID) {
+	stagingKey := uploadSessionStagingKey(sessionID)
+	if _, err := cfg.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &stagingKey,
+	}); err != nil {
+		log.Printf("Couldn't delete staged upload %s: %v", stagingKey, err)
+	}
+}
+
+// uploadSessionForRequest authenticates the caller and loads the session in
+// the path, responding with an error and reporting false unless it exists
+// and belongs to them.
+func (cfg *apiConfig) uploadSessionForRequest(w http.ResponseWriter, r *http.Request) (database.UploadSession, uuid.UUID, bool) {
+	sessionID, ok := pathUUID(w, r, "sessionID")
+	if !ok {
+		return database.UploadSession{}, uuid.Nil, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.UploadSession{}, uuid.Nil, false
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return database.UploadSession{}, uuid.Nil, false
+	}
+
+	// Clients poll sessions while other nodes assemble and process them,
+	// so a lagging replica would show a finished upload as still going
+	session, err := cfg.db.Primary().GetUploadSession(sessionID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload session", err)
+		return database.UploadSession{}, uuid.Nil, false
+	}
+	if session.ID == uuid.Nil || session.UserID != userID {
+		respondWithError(w, http.StatusNotFound, "Upload session not found", nil)
+		return database.UploadSession{}, uuid.Nil, false
+	}
+	// A restart can leave a session processing with nothing working on it
+	if session.Status == database.UploadStatusProcessing {
+		recovered, err := cfg.db.RecoverUploadSession(session.ID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check upload session", err)
+			return database.UploadSession{}, uuid.Nil, false
+		}
+		if recovered {
+			log.Printf("Recovered interrupted upload session %s", session.ID)
+			session.Status = database.UploadStatusPending
+		}
+	}
+	return session, userID, true
+}
+
+// claimUploadSession takes exclusive hold of a pending session for the
+// current request, so the same file can't be finalized twice.
+func (cfg *apiConfig) claimUploadSession(w http.ResponseWriter, session database.UploadSession) bool {
+	if session.Status != database.UploadStatusPending {
+		respondWithError(w, http.StatusConflict, fmt.Sprintf("Upload session is %s", session.Status), nil)
+		return false
+	}
+	claimed, err := cfg.db.ClaimUploadSession(session.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't claim upload session", err)
+		return false
+	}
+	if !claimed {
+		respondWithError(w, http.StatusConflict, "Upload session has expired or is already being finalized", nil)
+		return false
+	}
+	return true
+}
+
+func (cfg *apiConfig) releaseUploadSession(session database.UploadSession) {
+	if err := cfg.db.SetUploadSessionStatus(session.ID, database.UploadStatusPending, nil); err != nil {
+		log.Printf("Couldn't release upload session %s: %v", session.ID, err)
+	}
+}
+
+// failUploadSession ends a session whose upload contradicts its declaration.
+// The client has to start a new session for a corrected file.
+func (cfg *apiConfig) failUploadSession(w http.ResponseWriter, session database.UploadSession, status int, code, msg string) {
+	cfg.recordUploadSessionFailure(session, &uploadError{msg: msg})
+	respondWithErrorCode(w, status, code, msg, nil)
+}
+
+// recordUploadSessionFailure marks a session failed with the reason its
+// owner will see.
+func (cfg *apiConfig) recordUploadSessionFailure(session database.UploadSession, err error) {
+	failure := err.Error()
+	var uploadErr *uploadError
+	if errors.As(err, &uploadErr) {
+		failure = uploadErr.msg
+	}
+	if err := cfg.db.SetUploadSessionStatus(session.ID, database.UploadStatusFailed, &failure); err != nil {
+		log.Printf("Couldn't mark upload session %s failed: %v", session.ID, err)
+	}
+}
@@ -1,19 +1,94 @@
 package main
 
 import (
-	"crypto/rand"
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
-	"mime"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
+// removeUnusedThumbnail deletes a stored thumbnail once no video references
+// it any more.
+func (cfg *apiConfig) removeUnusedThumbnail(thumbnailURL string) {
+	count, err := cfg.db.CountVideosWithThumbnail(thumbnailURL)
+	if err != nil || count > 0 {
+		return
+	}
+	stored, err := cfg.deleteThumbnail(context.Background(), thumbnailURL)
+	if err != nil {
+		log.Printf("Couldn't remove superseded thumbnail %s: %v", thumbnailURL, err)
+		return
+	}
+	if stored {
+		cfg.invalidateCDN(thumbnailURL)
+	}
+}
+
+// thumbnailMediaTypes are the image types accepted as thumbnails. GIFs may
+// be animated, within the limits in checkGIFLimits.
+var thumbnailMediaTypes = []string{"image/jpeg", "image/png", "image/gif"}
+
+// setVideoThumbnail stores an image and points the video at it. Animated
+// GIFs also get a still poster of their first frame, and every image gets
+// the enabled variants. It reports whether
+// anything changed, and returns the URLs the video no longer uses, for the
+// caller to remove once the video is saved.
+func (cfg *apiConfig) setVideoThumbnail(ctx context.Context, video *database.Video, file io.ReadSeeker, fileExt string) ([]string, bool, error) {
+	thumbnailURL, err := cfg.storeThumbnail(ctx, file, fileExt)
+	if err != nil {
+		return nil, false, err
+	}
+	var posterURL *string
+	if fileExt == ".gif" {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, false, err
+		}
+		poster, err := gifPosterFrame(file)
+		if err != nil {
+			return nil, false, fmt.Errorf("couldn't render poster frame: %w", err)
+		}
+		url, err := cfg.storeThumbnail(ctx, bytes.NewReader(poster), ".png")
+		if err != nil {
+			return nil, false, err
+		}
+		posterURL = &url
+	}
+
+	if video.ThumbnailURL != nil && *video.ThumbnailURL == thumbnailURL {
+		return nil, false, nil
+	}
+	var superseded []string
+	for _, previousURL := range video.ThumbnailURLs() {
+		if previousURL != thumbnailURL && (posterURL == nil || previousURL != *posterURL) {
+			superseded = append(superseded, previousURL)
+		}
+	}
+	video.ThumbnailURL = &thumbnailURL
+	video.ThumbnailPosterURL = posterURL
+
+	// The upload stands without its variants; converting the thumbnail
+	// later fills in any that fail here
+	variants, err := cfg.ensureThumbnailVariants(ctx, thumbnailURL, file, fileExt)
+	if err != nil {
+		log.Printf("Couldn't generate variants of thumbnail %s: %v", thumbnailURL, err)
+		variants = map[string]string{}
+	}
+	video.ThumbnailVariants = variants
+	return superseded, true, nil
+}
+
 // getFileExtension determines the correct file extension from a Content-Type header.
 func getFileExtension(contentType string) (string, error) {
 	switch contentType {
@@ -29,10 +104,8 @@ func getFileExtension(contentType string) (string, error) {
 }
 
 func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Request) {
-	videoIDString := r.PathValue("videoID")
-	videoID, err := uuid.Parse(videoIDString)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
 		return
 	}
 
@@ -42,7 +115,7 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := cfg.validateJWT(token)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
@@ -50,99 +123,184 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 
 	fmt.Println("uploading thumbnail for video", videoID, "by user", userID)
 
-	// 1. Parse the form data
-	const maxMemory = 10 << 20 // 10 MB
-	err = r.ParseMultipartForm(maxMemory)
+	// 1. Get the video's metadata from the database, so an upload that
+	// isn't allowed is refused before its body is received
+	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Failed to parse form data", err)
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
 		return
 	}
 
-	// 2. Get the image data from the form
-	file, header, err := r.FormFile("thumbnail")
+	// Check if the authenticated user is the video owner
+	allowed, err := cfg.canAccessVideo(userID, video, permEdit)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't get thumbnail file from form", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video permissions", err)
+		return
+	}
+	if !allowed {
+		respondWithError(w, http.StatusUnauthorized, "You are not authorized to upload a thumbnail for this video", nil)
 		return
 	}
-	defer file.Close()
 
-	// 3. Get the media type from the file's Content-Type header
-	mediaType := header.Header.Get("Content-Type")
-	if mediaType == "" {
-		respondWithError(w, http.StatusBadRequest, "Content-Type header is missing", nil)
+	// 2. Stream the image, which must be a JPEG, PNG or GIF, to a temp
+	// file. Oversized images are refused from their header alone, as soon
+	// as it arrives and before anything downstream tries to decode them.
+	file, parsedMediaType, ok := streamFormFile(w, r, cfg.uploadFields.thumbnail, maxThumbnailSize, func(head io.Reader, mediaType string) error {
+		_, err := checkImageHeader(head, strings.TrimPrefix(mediaType, "image/"))
+		return err
+	}, thumbnailMediaTypes...)
+	if !ok {
 		return
 	}
+	defer os.Remove(file.Name())
+	defer file.Close()
 
-	// Parse the media type to get the core type (e.g., "image/jpeg" from "image/jpeg; charset=utf-8")
-	parsedMediaType, _, err := mime.ParseMediaType(mediaType)
+	// Determine the file extension from the Content-Type
+	fileExt, err := getFileExtension(parsedMediaType)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Failed to parse media type", err)
+		respondWithError(w, http.StatusBadRequest, err.Error(), nil)
 		return
 	}
 
-	// 4. Validate that the media type is either a JPEG or PNG image
-	if parsedMediaType != "image/jpeg" && parsedMediaType != "image/png" {
-		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Unsupported file type: %s. Only JPEG and PNG are allowed.", parsedMediaType), nil)
+	// GIFs are also checked for their frame count, which needs all of them
+	if err := checkImageDimensions(file, strings.TrimPrefix(parsedMediaType, "image/")); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
 		return
 	}
 
-	// Determine the file extension from the Content-Type
-	fileExt, err := getFileExtension(parsedMediaType)
+	// 3. Store it under its content-hashed name and point the video at it
+	superseded, changed, err := cfg.setVideoThumbnail(r.Context(), &video, file, fileExt)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, err.Error(), nil)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't store thumbnail", err)
+		return
+	}
+	if !changed {
+		// A retried or repeated upload of the same image changes nothing
+		cfg.signVideoAssets(&video)
+		respondWithJSON(w, http.StatusOK, video)
 		return
 	}
 
-	// 5. Use crypto/rand.Read to generate a unique base64 filename
-	randBytes := make([]byte, 32)
-	if _, err := rand.Read(randBytes); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could not generate random filename", err)
+	// 4. Update the record in the database
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video metadata", err)
 		return
 	}
-	filename := base64.RawURLEncoding.EncodeToString(randBytes) + fileExt
+	cfg.recordVideoEvent(video, database.VideoEventThumbnailChanged, userID, map[string]any{"thumbnail_url": video.ThumbnailURL})
 
-	// 6. Create a unique file path on disk
-	filePath := filepath.Join(cfg.assetsRoot, filename)
+	// 5. Remove the superseded files unless a clip still shares them
+	for _, previousURL := range superseded {
+		cfg.removeUnusedThumbnail(previousURL)
+	}
 
-	// 7. Create the new file on the filesystem
-	dst, err := os.Create(filePath)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create file on disk", err)
+	// 6. Respond with the updated JSON
+	cfg.signVideoAssets(&video)
+	respondWithJSON(w, http.StatusOK, video)
+}
+
+// handlerThumbnailConvert generates the enabled variants that a video's
+// current thumbnail doesn't have yet, so enabling a new size doesn't need
+// every thumbnail uploaded again. It responds with the updated video.
+func (cfg *apiConfig) handlerThumbnailConvert(w http.ResponseWriter, r *http.Request) {
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
 		return
 	}
-	defer dst.Close()
 
-	// 8. Copy the contents from the form file to the new file on disk
-	_, err = io.Copy(dst, file)
+	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't save file to disk", err)
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
 
-	// 9. Get the video's metadata from the database
 	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
 		return
 	}
-
-	// Check if the authenticated user is the video owner
-	if video.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "You are not authorized to upload a thumbnail for this video", nil)
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
 		return
 	}
-
-	// 10. Update the video metadata with the new thumbnail URL
-	thumbnailURL := fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, filename)
-	video.ThumbnailURL = &thumbnailURL // Pass a pointer to the string
-
-	// 11. Update the record in the database
-	err = cfg.db.UpdateVideo(video)
+	allowed, err := cfg.canAccessVideo(userID, video, permEdit)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't update video metadata", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video permissions", err)
+		return
+	}
+	if !allowed {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
 		return
 	}
 
-	// 12. Respond with the updated JSON
+	variants, err := cfg.convertVideoThumbnail(r.Context(), video)
+	switch {
+	case errors.Is(err, errNoVariantsEnabled):
+		respondWithError(w, http.StatusConflict, "No thumbnail variants are enabled", nil)
+		return
+	case errors.Is(err, errNoThumbnail):
+		respondWithError(w, http.StatusConflict, "Video has no thumbnail", nil)
+		return
+	case errors.Is(err, errThumbnailNotStored):
+		respondWithError(w, http.StatusConflict, "Thumbnail isn't stored by this server", nil)
+		return
+	case err != nil:
+		respondWithError(w, http.StatusInternalServerError, "Couldn't convert thumbnail", err)
+		return
+	}
+	video.ThumbnailVariants = variants
+	cfg.signVideoAssets(&video)
 	respondWithJSON(w, http.StatusOK, video)
 }
+
+// saveThumbnailFile copies an image into the assets directory under a name
+// derived from its content, in that name's shard, and returns the name. A new image always gets a
+// new URL, so clients holding the old one can't show a stale thumbnail. An
+// identical image is already there under that name; leaving it alone keeps
+// its Last-Modified stable for caches.
+//
+// The image is written to a hidden temporary file, which is never served,
+// and renamed into place only once it's complete and on disk, so a failed
+// or interrupted copy can't leave a truncated thumbnail under its name and
+// the upload can simply be retried.
+func (cfg *apiConfig) saveThumbnailFile(src io.Reader, fileExt string) (string, error) {
+	tmp, err := os.CreateTemp(cfg.assetsRoot, ".upload-*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	if _, err := cfg.buffers.copy(io.MultiWriter(tmp, hash), src); err != nil {
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	filename := base64.RawURLEncoding.EncodeToString(hash.Sum(nil)) + fileExt
+	finalPath := cfg.assetPath(filename)
+	if _, err := os.Stat(finalPath); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(finalPath), 0755); err != nil {
+			return "", err
+		}
+		if err := os.Rename(tmp.Name(), finalPath); err != nil {
+			return "", err
+		}
+		if err := syncDir(filepath.Dir(finalPath)); err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", err
+	}
+	return filename, nil
+}
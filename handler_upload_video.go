@@ -1,26 +1,30 @@
 package main
 
 import (
-	"bytes"
-	"crypto/rand"
-	"encoding/base64"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"mime"
+	"log"
+	"mime/multipart"
 	"net/http"
 	"os"
-	"os/exec"
+	"slices"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
 	"github.com/google/uuid"
 )
 
+// maxVideoUploadSize caps the size of an uploaded video file.
+const maxVideoUploadSize = 1 << 30 // 1 GB
+
 func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
 	// 1. Set upload limit to 1 GB
-	const maxUploadSize = 1 << 30 // 1 GB
-	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	r.Body = http.MaxBytesReader(w, r.Body, maxVideoUploadSize)
 
 	// 2. Extract and parse videoID from URL
 	videoIDString := r.PathValue("videoID")
@@ -36,7 +40,7 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := cfg.validateJWT(token)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
@@ -48,28 +52,69 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusNotFound, "Video not found", err)
 		return
 	}
-	if video.UserID != userID {
+	allowed, err := cfg.canAccessVideo(userID, video, permEdit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video permissions", err)
+		return
+	}
+	if !allowed {
 		respondWithError(w, http.StatusUnauthorized, "You are not authorized to upload this video", nil)
 		return
 	}
-
-	// 5. Parse the uploaded video file from form data
-	file, header, err := r.FormFile("video")
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't get video file from form", err)
+	if video.LegalHold {
+		respondWithError(w, http.StatusConflict, "This video is under legal hold and its file can't be replaced", nil)
+		return
+	}
+	release, ok := cfg.lockVideoUpload(w, videoID, nil)
+	if !ok {
+		return
+	}
+	defer release()
+	cfg.recordVideoEvent(video, database.VideoEventUploadStarted, userID, nil)
+	ctx, timings := withUploadTimings(r.Context(), nil)
+	r = r.WithContext(ctx)
+	r.Body = throttleBody(r.Body, cfg.userBandwidth(userID))
+	if !decodeRequestBody(w, r, maxVideoUploadSize) {
 		return
 	}
-	defer file.Close()
 
-	// 6. Validate the uploaded file is a video/mp4
-	contentType := header.Header.Get("Content-Type")
-	parsedMediaType, _, err := mime.ParseMediaType(contentType)
+	// 5. Parse the form. Besides the video it may carry a thumbnail and
+	// JSON metadata, so a richer upload UI needs only the one request.
+	// Every part is checked before anything is stored.
+	stopParse := timings.track(stepParse)
+	err = r.ParseMultipartForm(32 << 20)
+	stopParse()
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Failed to parse media type", err)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondWithErrorCode(w, http.StatusRequestEntityTooLarge, "request_too_large", "Request body is too large", err)
+			return
+		}
+		respondWithValidationError(w, map[string]string{"body": "must be multipart form data"}, err)
 		return
 	}
-	if parsedMediaType != "video/mp4" {
-		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Unsupported file type: %s. Only MP4 videos are allowed.", parsedMediaType), nil)
+	problems := map[string]string{}
+
+	// 6. The video file itself must be a video/mp4
+	var file multipart.File
+	var header *multipart.FileHeader
+	if headers := r.MultipartForm.File[cfg.uploadFields.video]; len(headers) == 0 {
+		problems[cfg.uploadFields.video] = "is required"
+	} else if _, problem := partMediaType(headers[0], "video/mp4"); problem != "" {
+		problems[cfg.uploadFields.video] = problem
+	} else {
+		header = headers[0]
+		file, err = header.Open()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get video file from form", err)
+			return
+		}
+		defer file.Close()
+	}
+	extras := cfg.readUploadExtras(r.MultipartForm, problems)
+	defer extras.Close()
+	if len(problems) > 0 {
+		respondWithValidationError(w, problems, nil)
 		return
 	}
 
@@ -83,7 +128,10 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 	defer tempFile.Close()
 
 	// 8. Copy contents over
-	if _, err := io.Copy(tempFile, file); err != nil {
+	stopCopy := timings.track(stepCopy)
+	_, err = cfg.buffers.copy(tempFile, file)
+	stopCopy()
+	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't copy video to temp file", err)
 		return
 	}
@@ -94,141 +142,531 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// 10. Process the video for fast start
-	processedFilePath, err := processVideoForFastStart(tempFile.Name())
+	// 10. Apply the thumbnail and metadata sent along with the video
+	video, err = cfg.applyUploadExtras(r, video, extras)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't process video for fast start", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't apply upload metadata", err)
 		return
 	}
-	defer os.Remove(processedFilePath)
 
-	// 11. Get aspect ratio and determine S3 key prefix
-	aspectRatio, err := getVideoAspectRatio(tempFile.Name())
+	// 11. Validate, process and store the file, with the processing
+	// options the form leaves out taken from the uploader's settings
+	settings, err := cfg.db.GetUserSettings(userID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't get video aspect ratio", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get settings", err)
+		return
+	}
+	opts := formUploadFlags(r).options(settings.UploadDefaults)
+	opts.IntroVideoID = r.FormValue("intro_video_id")
+	opts.OutroVideoID = r.FormValue("outro_video_id")
+	if cfg.role == roleAPI {
+		cfg.queueDirectUpload(w, r, video, userID, media.SanitizeFilename(header.Filename), tempFile.Name(), opts)
 		return
 	}
+	cfg.finishVideoUpload(w, r, video, userID, tempFile.Name(), header.Filename, opts)
+}
 
-	var s3KeyPrefix string
-	switch aspectRatio {
-	case "16:9":
-		s3KeyPrefix = "landscape"
-	case "9:16":
-		s3KeyPrefix = "portrait"
-	default:
-		s3KeyPrefix = "other"
+// uploadError is a failed upload together with how to report it: the HTTP
+// status and message for callers that respond synchronously, and whether the
+// worker should try the same file again later.
+type uploadError struct {
+	status    int
+	code      string
+	msg       string
+	err       error
+	retryable bool
+}
+
+func (e *uploadError) Error() string {
+	if e.err == nil {
+		return e.msg
+	}
+	return e.msg + ": " + e.err.Error()
+}
+
+func (e *uploadError) Unwrap() error {
+	return e.err
+}
+
+func isRetryableUpload(err error) bool {
+	if errors.Is(err, database.ErrUnavailable) {
+		return true
 	}
+	var uploadErr *uploadError
+	return errors.As(err, &uploadErr) && uploadErr.retryable
+}
 
-	// 12. Put the processed video into S3
-	randBytes := make([]byte, 32)
-	if _, err := rand.Read(randBytes); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could not generate random filename for S3 key", err)
+func respondWithUploadError(w http.ResponseWriter, err error) {
+	var uploadErr *uploadError
+	if !errors.As(err, &uploadErr) {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't process upload", err)
 		return
 	}
-	s3Key := s3KeyPrefix + "/" + base64.RawURLEncoding.EncodeToString(randBytes) + ".mp4"
+	if uploadErr.code != "" {
+		respondWithErrorCode(w, uploadErr.status, uploadErr.code, uploadErr.msg, uploadErr.err)
+		return
+	}
+	respondWithError(w, uploadErr.status, uploadErr.msg, uploadErr.err)
+}
 
-	processedFile, err := os.Open(processedFilePath)
+// finishVideoUpload runs a fully received upload through processVideoUpload
+// in a processing slot and responds with the stored video.
+func (cfg *apiConfig) finishVideoUpload(w http.ResponseWriter, r *http.Request, video database.Video, userID uuid.UUID, filePath, filename string, opts database.UploadOptions) {
+	timings := uploadTimingsFrom(r.Context())
+	release, err := cfg.processing.acquire(r.Context(), userID, priorityInteractive)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't open processed video file", err)
+		respondWithError(w, http.StatusServiceUnavailable, "Gave up waiting for a processing slot", err)
 		return
 	}
-	defer processedFile.Close()
+	defer release()
 
-	putObjectInput := &s3.PutObjectInput{
-		Bucket:      &cfg.s3Bucket,
-		Key:         &s3Key,
-		Body:        processedFile,
-		ContentType: &contentType,
-		// The ACL field has been removed to align with buckets that have ACLs disabled
+	processed, err := cfg.processVideoUpload(r.Context(), video, userID, filePath, filename, opts)
+	cfg.recordUploadTimings(video.ID, uuid.Nil, timings)
+	if err != nil {
+		respondWithUploadError(w, err)
+		return
 	}
+	cfg.signVideoAssets(&processed)
+	respondWithJSON(w, http.StatusOK, timedUploadResponse{Video: processed, Timings: timings, Receipt: cfg.latestUploadReceipt(processed.ID)})
+}
 
-	if _, err := cfg.s3Client.PutObject(r.Context(), putObjectInput); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't upload file to S3", err)
-		return
+// timedUploadResponse is the video a synchronous upload stored, along with
+// how long each step took and the receipt for the stored file.
+type timedUploadResponse struct {
+	database.Video
+	Timings *uploadTimings `json:"timings"`
+	Receipt *string        `json:"receipt,omitempty"`
+}
+
+// processVideoUpload takes a fully received upload from validation through to
+// the updated video record. filename is the name the client gave the file,
+// if any. Errors are *uploadError. It is shared by the multipart endpoint,
+// upload sessions and the worker.
+//
+// Files ffmpeg keeps failing on are quarantined rather than retried forever,
+// and uploads of a quarantined file are refused before any work is done.
+func (cfg *apiConfig) processVideoUpload(ctx context.Context, video database.Video, userID uuid.UUID, filePath, filename string, opts database.UploadOptions) (database.Video, error) {
+	timings := uploadTimingsFrom(ctx)
+	stopCopy := timings.track(stepCopy)
+	checksum, err := hashFile(filePath, cfg.buffers)
+	stopCopy()
+	if err != nil {
+		return database.Video{}, &uploadError{status: http.StatusInternalServerError, msg: "Couldn't read uploaded video", err: err, retryable: true}
+	}
+	stopDB := timings.track(stepDB)
+	failure, err := cfg.db.GetInputFailure(checksum)
+	stopDB()
+	if err != nil {
+		return database.Video{}, &uploadError{status: http.StatusInternalServerError, msg: "Couldn't check upload against quarantine", err: err, retryable: true}
+	}
+	if failure.QuarantinedAt != nil {
+		return database.Video{}, quarantinedUploadError(failure)
 	}
 
-	// 13. Update the video record in the database with the cloudfront URL
-	videoURL := fmt.Sprintf("https://%s/%s", cfg.s3CfDistribution, s3Key)
-	video.VideoURL = &videoURL
-	if err := cfg.db.UpdateVideo(video); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't update video record", err)
-		return
+	processed, err := cfg.runVideoPipeline(ctx, video, userID, filePath, filename, opts)
+	var ffErr *ffmpegError
+	if errors.As(err, &ffErr) {
+		return database.Video{}, cfg.recordFFmpegFailure(ctx, video, userID, filePath, checksum, ffErr, err)
+	}
+	if err != nil {
+		return database.Video{}, err
 	}
 
-	// 14. Respond with the updated video
-	respondWithJSON(w, http.StatusOK, video)
+	if failure.Failures > 0 {
+		// Whatever broke ffmpeg before wasn't the file after all
+		if err := cfg.db.DeleteInputFailure(checksum); err != nil {
+			log.Printf("Couldn't clear ffmpeg failures for %s: %v", checksum, err)
+		}
+	}
+	return processed, nil
 }
 
-// getVideoAspectRatio uses ffprobe to determine the video's aspect ratio.
-func getVideoAspectRatio(filePath string) (string, error) {
-	// A simple struct to unmarshal the relevant parts of the ffprobe output
-	type ProbeStream struct {
-		Width  int `json:"width"`
-		Height int `json:"height"`
+// uploadedFilename cleans up the name a client gave an uploaded file, which
+// can carry directories, control characters or a whole path from the
+// client's disk. It returns nil if there's no usable name.
+func uploadedFilename(name string) *string {
+	name = media.SanitizeFilename(name)
+	if name == "" {
+		return nil
 	}
-	type ProbeOutput struct {
-		Streams []ProbeStream `json:"streams"`
+	return &name
+}
+
+// runVideoPipeline is the body of processVideoUpload.
+func (cfg *apiConfig) runVideoPipeline(ctx context.Context, video database.Video, userID uuid.UUID, filePath, filename string, opts database.UploadOptions) (database.Video, error) {
+	timings := uploadTimingsFrom(ctx)
+
+	// 1. Make sure there is actually a playable video in the file, in
+	// codecs the deployment accepts or converts
+	stopProbe := timings.track(stepProbe)
+	info, err := cfg.validateVideoFile(filePath)
+	stopProbe()
+	if err != nil {
+		var validationErr *videoValidationError
+		if errors.As(err, &validationErr) {
+			// Keep the reason on the record so the uploader can see why the
+			// file was refused after the fact
+			video.ValidationError = &validationErr.Reason
+			if err := cfg.db.SetVideoValidationError(video.ID, validationErr.Reason); err != nil {
+				return database.Video{}, &uploadError{status: http.StatusInternalServerError, msg: "Couldn't record validation failure", err: err, retryable: true}
+			}
+			return database.Video{}, &uploadError{status: http.StatusUnprocessableEntity, code: validationErr.Code, msg: validationErr.Error(), err: err}
+		}
+		return database.Video{}, &uploadError{status: http.StatusInternalServerError, msg: "Couldn't inspect uploaded video", err: err}
 	}
 
-	cmd := exec.Command("ffprobe",
-		"-v", "error",
-		"-print_format", "json",
-		"-show_streams",
-		filePath,
-	)
+	sourceFilePath := filePath
+	stopRemux := timings.track(stepRemux)
+	conformedFilePath, err := cfg.conformCodecs(sourceFilePath, info)
+	stopRemux()
+	if err != nil {
+		return database.Video{}, &uploadError{status: http.StatusInternalServerError, msg: "Couldn't transcode video", err: err}
+	}
+	if conformedFilePath != sourceFilePath {
+		defer os.Remove(conformedFilePath)
+		sourceFilePath = conformedFilePath
+	}
+
+	// 2. Optionally trim leading/trailing silence and black frames
+	if opts.TrimDeadAir {
+		stopRemux := timings.track(stepRemux)
+		trimmedFilePath, trimStart, trimEnd, err := cfg.trimDeadAir(sourceFilePath)
+		stopRemux()
+		if err != nil {
+			return database.Video{}, &uploadError{status: http.StatusInternalServerError, msg: "Couldn't trim dead air from video", err: err}
+		}
+		if trimmedFilePath != sourceFilePath {
+			defer os.Remove(trimmedFilePath)
+			sourceFilePath = trimmedFilePath
+		}
+		video.TrimStartSeconds = &trimStart
+		video.TrimEndSeconds = &trimEnd
+	}
+
+	// 3. Stitch the user's intro/outro clips around the upload
+	stopDB := timings.track(stepDB)
+	user, err := cfg.db.GetUser(userID)
+	stopDB()
+	if err != nil || user == nil {
+		return database.Video{}, &uploadError{status: http.StatusInternalServerError, msg: "Couldn't get user", err: err, retryable: true}
+	}
+	introKey, err := cfg.stitchClipKey(userID, opts.IntroVideoID, user.IntroVideoID)
+	if err != nil {
+		return database.Video{}, stitchUploadError(err)
+	}
+	outroKey, err := cfg.stitchClipKey(userID, opts.OutroVideoID, user.OutroVideoID)
+	if err != nil {
+		return database.Video{}, stitchUploadError(err)
+	}
+	if introKey != "" || outroKey != "" {
+		var introPath, outroPath string
+		stopS3 := timings.track(stepS3)
+		if introKey != "" {
+			introPath, err = cfg.downloadS3Object(ctx, introKey)
+			if err != nil {
+				return database.Video{}, &uploadError{status: http.StatusInternalServerError, msg: "Couldn't download intro clip", err: err, retryable: true}
+			}
+			defer os.Remove(introPath)
+		}
+		if outroKey != "" {
+			outroPath, err = cfg.downloadS3Object(ctx, outroKey)
+			if err != nil {
+				return database.Video{}, &uploadError{status: http.StatusInternalServerError, msg: "Couldn't download outro clip", err: err, retryable: true}
+			}
+			defer os.Remove(outroPath)
+		}
+		stopS3()
+		stopRemux := timings.track(stepRemux)
+		stitchedFilePath, err := cfg.stitchVideo(sourceFilePath, introPath, outroPath)
+		stopRemux()
+		if err != nil {
+			return database.Video{}, &uploadError{status: http.StatusInternalServerError, msg: "Couldn't stitch intro/outro onto video", err: err}
+		}
+		defer os.Remove(stitchedFilePath)
+		sourceFilePath = stitchedFilePath
+	}
+
+	// 4. Optionally burn in the user's or deployment's watermark
+	if opts.Watermark {
+		watermarkPath, err := cfg.resolveWatermark(userID)
+		if errors.Is(err, errNoWatermark) {
+			return database.Video{}, &uploadError{status: http.StatusBadRequest, msg: "No watermark image is configured for this account", err: err}
+		}
+		if err != nil {
+			return database.Video{}, &uploadError{status: http.StatusInternalServerError, msg: "Couldn't find watermark image", err: err}
+		}
+		settings, err := cfg.watermarkSettings(userID)
+		if err != nil {
+			return database.Video{}, &uploadError{status: http.StatusInternalServerError, msg: "Couldn't get watermark settings", err: err, retryable: true}
+		}
+		stopRemux := timings.track(stepRemux)
+		watermarkedFilePath, err := cfg.applyWatermark(sourceFilePath, watermarkPath, settings)
+		stopRemux()
+		if err != nil {
+			return database.Video{}, &uploadError{status: http.StatusInternalServerError, msg: "Couldn't apply watermark to video", err: err}
+		}
+		defer os.Remove(watermarkedFilePath)
+		sourceFilePath = watermarkedFilePath
+	}
+	video.Watermarked = opts.Watermark
+
+	// 5. Mux in the owner's audio description track, if they uploaded one
+	if video.AudioDescriptionKey != nil {
+		stopS3 := timings.track(stepS3)
+		trackPath, err := cfg.downloadS3Object(ctx, *video.AudioDescriptionKey)
+		stopS3()
+		if err != nil {
+			return database.Video{}, &uploadError{status: http.StatusInternalServerError, msg: "Couldn't download audio description", err: err, retryable: true}
+		}
+		defer os.Remove(trackPath)
+		stopRemux := timings.track(stepRemux)
+		describedFilePath, err := muxAudioDescription(sourceFilePath, trackPath, false)
+		stopRemux()
+		if err != nil {
+			return database.Video{}, &uploadError{status: http.StatusInternalServerError, msg: "Couldn't add audio description to video", err: err}
+		}
+		defer os.Remove(describedFilePath)
+		sourceFilePath = describedFilePath
+	}
+
+	// 6. Let the deployment's own hook refuse or replace the file
+	stopHook := timings.track(stepRemux)
+	hookedFilePath, verdict, err := cfg.runPreStoreHook(ctx, video, userID, sourceFilePath)
+	stopHook()
+	if errors.Is(err, errRejectedByHook) {
+		video.ValidationError = &verdict.Reason
+		if err := cfg.db.SetVideoValidationError(video.ID, verdict.Reason); err != nil {
+			return database.Video{}, &uploadError{status: http.StatusInternalServerError, msg: "Couldn't record validation failure", err: err, retryable: true}
+		}
+		return database.Video{}, &uploadError{status: http.StatusUnprocessableEntity, code: "rejected_by_hook", msg: verdict.Reason, err: err}
+	}
+	if err != nil {
+		return database.Video{}, &uploadError{status: http.StatusInternalServerError, msg: "Processing hook failed", err: err, retryable: true}
+	}
+	if hookedFilePath != sourceFilePath {
+		defer os.Remove(hookedFilePath)
+		sourceFilePath = hookedFilePath
+	}
 
-	var out bytes.Buffer
-	cmd.Stdout = &out
+	// 7. Generate a per-video data key if encryption at rest was requested
+	var sseKey *sseCustomerKey
+	var wrappedKey []byte
+	if opts.Encrypt {
+		var dataKey []byte
+		dataKey, wrappedKey, err = cfg.newDataKey(ctx)
+		if errors.Is(err, errEncryptionDisabled) {
+			return database.Video{}, &uploadError{status: http.StatusBadRequest, msg: "Encryption at rest is not enabled on this server", err: err}
+		}
+		if err != nil {
+			return database.Video{}, &uploadError{status: http.StatusInternalServerError, msg: "Couldn't generate encryption key", err: err, retryable: true}
+		}
+		sseKey = newSSECustomerKey(dataKey)
+	}
 
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("could not run ffprobe: %w", err)
+	// 8. Fast-start the video and put it into S3, under the name it was
+	// uploaded with. A file sent without one doesn't keep the name of the
+	// file it replaces.
+	video.OriginalFilename = uploadedFilename(filename)
+	stored, err := cfg.storeVideo(ctx, sourceFilePath, videoObjectNameOf(video), sseKey)
+	if err != nil {
+		return database.Video{}, &uploadError{status: http.StatusInternalServerError, msg: "Couldn't store processed video", err: err, retryable: true}
 	}
 
-	var probeOutput ProbeOutput
-	if err := json.Unmarshal(out.Bytes(), &probeOutput); err != nil {
-		return "", fmt.Errorf("could not unmarshal ffprobe output: %w", err)
+	// 9. Record the key and point encrypted videos at the authenticated
+	// stream proxy, everything else at cloudfront
+	defer timings.track(stepDB)()
+	if opts.Encrypt {
+		if err := cfg.db.PutVideoKey(video.ID, stored.key, wrappedKey); err != nil {
+			return database.Video{}, &uploadError{status: http.StatusInternalServerError, msg: "Couldn't save encryption key", err: err, retryable: true}
+		}
+		videoURL := cfg.videoStreamURL(video.ID)
+		video.VideoURL = &videoURL
+	} else {
+		if video.Encrypted {
+			if err := cfg.db.DeleteVideoKey(video.ID); err != nil {
+				return database.Video{}, &uploadError{status: http.StatusInternalServerError, msg: "Couldn't remove old encryption key", err: err, retryable: true}
+			}
+		}
+		videoURL := cfg.videoDeliveryURL(stored.key)
+		video.VideoURL = &videoURL
+	}
+	video.Encrypted = opts.Encrypt
+	video.ValidationError = nil
+	stored.describe(&video)
+
+	// 10. Update the video record in the database. Only what processing
+	// changed is written, so edits made meanwhile are kept
+	if err := cfg.db.UpdateVideoFile(video); err != nil {
+		return database.Video{}, &uploadError{status: http.StatusInternalServerError, msg: "Couldn't update video record", err: err, retryable: true}
+	}
+	cfg.recordStoredVideo(video, userID, stored, wrappedKey)
+	tags, err := cfg.addHookTags(video.ID, verdict.Tags)
+	if err != nil {
+		return database.Video{}, &uploadError{status: http.StatusInternalServerError, msg: "Couldn't save tags from processing hook", err: err, retryable: true}
+	}
+	for _, tag := range tags {
+		if !slices.Contains(video.Tags, tag) {
+			video.Tags = append(video.Tags, tag)
+		}
+	}
+	slices.Sort(video.Tags)
+
+	cfg.recordVideoEvent(video, database.VideoEventProcessed, userID, processedEventPayload(video))
+	if video.PosterTimeSeconds != nil {
+		// The new file has a new frame at the owner's poster time
+		if _, err := cfg.enqueueAutoThumbnail(video, userID); err != nil {
+			log.Printf("Couldn't queue thumbnail for video %s: %v", video.ID, err)
+		}
+	}
+	cfg.runPostProcessHook(video, userID)
+	return video, nil
+}
+
+// storedVideo describes the object storeVideo put in the bucket.
+type storedVideo struct {
+	key             string
+	durationSeconds float64
+	// audioLanguages are the ISO 639-2 languages of its audio tracks
+	audioLanguages []string
+	checksumSHA256 string
+	size           int64
+	// versionID is empty unless the bucket is versioned
+	versionID string
+}
+
+// storeVideo is the shared tail of every video pipeline: it fast-starts the
+// processed file, files it under an aspect-ratio prefix in S3 and describes
+// the object it stored. Browsers are offered the video's download name to
+// save it as. A non-nil sseKey stores the object with SSE-C.
+func (cfg *apiConfig) storeVideo(ctx context.Context, filePath string, name videoObjectName, sseKey *sseCustomerKey) (storedVideo, error) {
+	ctx = withS3Principal(ctx, name.userID)
+	timings := uploadTimingsFrom(ctx)
+	stopRemux := timings.track(stepRemux)
+	processedFilePath, err := cfg.fastStart(filePath)
+	stopRemux()
+	if err != nil {
+		return storedVideo{}, fmt.Errorf("couldn't process video for fast start: %w", err)
+	}
+	defer os.Remove(processedFilePath)
+
+	stopProbe := timings.track(stepProbe)
+	probed, err := cfg.prober.Probe(processedFilePath)
+	stopProbe()
+	if err != nil {
+		return storedVideo{}, fmt.Errorf("couldn't get video aspect ratio: %w", err)
+	}
+
+	defer timings.track(stepS3)()
+	s3Key, err := cfg.newVideoObjectKey(ctx, media.KeyPrefix(probed.AspectRatio()), name)
+	if err != nil {
+		return storedVideo{}, err
 	}
 
-	if len(probeOutput.Streams) == 0 {
-		return "other", nil
+	processedFile, err := os.Open(processedFilePath)
+	if err != nil {
+		return storedVideo{}, fmt.Errorf("couldn't open processed video file: %w", err)
 	}
+	defer processedFile.Close()
 
-	width := float64(probeOutput.Streams[0].Width)
-	height := float64(probeOutput.Streams[0].Height)
+	contentType, err := sniffFileContentType(processedFilePath)
+	if err != nil {
+		return storedVideo{}, fmt.Errorf("couldn't read processed video file: %w", err)
+	}
+	putObjectInput := &s3.PutObjectInput{
+		Bucket:      &cfg.s3Bucket,
+		Key:         &s3Key,
+		ContentType: &contentType,
+		// The ACL field has been removed to align with buckets that have ACLs disabled
+	}
+	cfg.videoHeaders.applyToPut(putObjectInput, name.filename, ".mp4")
+	sseKey.applyToPut(putObjectInput)
 
-	if height == 0 {
-		return "other", nil
+	if err := cfg.storeObjectDeduplicated(ctx, putObjectInput, processedFile); err != nil {
+		return storedVideo{}, fmt.Errorf("couldn't upload file to S3: %w", err)
 	}
 
-	ratio := width / height
+	stored := storedVideo{key: s3Key, durationSeconds: probed.Duration, audioLanguages: probed.AudioLanguages}
+	stored.checksumSHA256, err = hashFile(processedFilePath, cfg.buffers)
+	if err != nil {
+		return storedVideo{}, fmt.Errorf("couldn't hash processed video file: %w", err)
+	}
+	head := &s3.HeadObjectInput{Bucket: &cfg.s3Bucket, Key: &s3Key}
+	sseKey.applyToHead(head)
+	out, err := cfg.s3Client.HeadObject(ctx, head)
+	if err != nil {
+		return storedVideo{}, fmt.Errorf("couldn't check stored video: %w", err)
+	}
+	stored.size = aws.ToInt64(out.ContentLength)
+	stored.versionID = aws.ToString(out.VersionId)
+	return stored, nil
+}
 
-	// Check for a landscape (16:9) aspect ratio with a small tolerance
-	if ratio > 1.7 && ratio < 1.8 {
-		return "16:9", nil
+// describe copies what was learned about the stored file onto the video
+// whose file it now is. A video without a primary language takes the first
+// language its audio is tagged with.
+func (s storedVideo) describe(video *database.Video) {
+	video.DurationSeconds = &s.durationSeconds
+	video.AudioLanguages = append([]string{}, s.audioLanguages...)
+	if video.Language != nil {
+		return
+	}
+	for _, language := range s.audioLanguages {
+		if language != media.LanguageUndetermined {
+			video.Language = &language
+			return
+		}
 	}
+}
+
+// videoDeliveryURL is the public URL for an unencrypted object, in the
+// deployment's delivery mode.
+func (cfg *apiConfig) videoDeliveryURL(s3Key string) string {
+	return cfg.urls.Object(s3Key)
+}
+
+// videoStreamURL is the authenticated proxy URL used for encrypted videos,
+// which CloudFront can't serve.
+func (cfg *apiConfig) videoStreamURL(videoID uuid.UUID) string {
+	return cfg.urls.Stream(videoID.String())
+}
 
-	// Check for a portrait (9:16) aspect ratio with a small tolerance
-	if ratio > 0.55 && ratio < 0.57 {
-		return "9:16", nil
+func stitchUploadError(err error) *uploadError {
+	if errors.Is(err, errInvalidStitchClip) {
+		return &uploadError{status: http.StatusBadRequest, msg: err.Error(), err: err}
 	}
+	return &uploadError{status: http.StatusInternalServerError, msg: "Couldn't resolve intro/outro clip", err: err, retryable: true}
+}
 
-	return "other", nil
+func respondWithStitchError(w http.ResponseWriter, err error) {
+	respondWithUploadError(w, stitchUploadError(err))
 }
 
-// processVideoForFastStart creates a new video file with "fast start" encoding.
+// getVideoDuration reads the container duration in seconds.
+func (cfg *apiConfig) getVideoDuration(filePath string) (float64, error) {
+	info, err := cfg.prober.Probe(filePath)
+	if err != nil {
+		return 0, err
+	}
+	if info.Duration <= 0 {
+		return 0, fmt.Errorf("%s has no duration", filePath)
+	}
+	return info.Duration, nil
+}
+
+// processVideoForFastStart creates a new video file with "fast start" encoding
+// by remuxing it with ffmpeg.
 func processVideoForFastStart(filePath string) (string, error) {
 	processedFilePath := filePath + ".processing"
 
-	cmd := exec.Command("ffmpeg",
+	err := runFFmpeg("faststart",
 		"-i", filePath,
 		"-c", "copy",
 		"-movflags", "faststart",
 		"-f", "mp4",
 		processedFilePath,
 	)
-
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("could not run ffmpeg: %w", err)
+	if err != nil {
+		return "", err
 	}
 
 	return processedFilePath, nil
@@ -1,33 +1,25 @@
 package main
 
 import (
-	"encoding/json"
 	"net/http"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
 )
 
 func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
-		Password string `json:"password"`
-		Email    string `json:"email"`
+		Password string `json:"password" validate:"required,max=72"`
+		Email    string `json:"email" validate:"required,max=254"`
 	}
 
-	decoder := json.NewDecoder(r.Body)
-	params := parameters{}
-	err := decoder.Decode(&params)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters", err)
-		return
-	}
-
-	if params.Password == "" || params.Email == "" {
-		respondWithError(w, http.StatusBadRequest, "Email and password are required", nil)
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
 		return
 	}
 
-	hashedPassword, err := auth.HashPassword(params.Password)
+	hashedPassword, err := cfg.passwords.Hash(params.Password)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't hash password", err)
 		return
@@ -44,3 +36,63 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 
 	respondWithJSON(w, http.StatusCreated, user)
 }
+
+func (cfg *apiConfig) handlerUsersIntroOutroUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		IntroVideoID *uuid.UUID `json:"intro_video_id"`
+		OutroVideoID *uuid.UUID `json:"outro_video_id"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+
+	for _, clipID := range []*uuid.UUID{params.IntroVideoID, params.OutroVideoID} {
+		if clipID == nil {
+			continue
+		}
+		clip, err := cfg.db.GetVideo(*clipID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+			return
+		}
+		if clip.UserID != userID {
+			respondWithError(w, http.StatusNotFound, "Intro/outro video not found", nil)
+			return
+		}
+		if clip.VideoURL == nil {
+			respondWithError(w, http.StatusBadRequest, "Intro/outro video has no uploaded file", nil)
+			return
+		}
+		if clip.Encrypted {
+			respondWithError(w, http.StatusBadRequest, "Encrypted videos can't be used as an intro/outro", nil)
+			return
+		}
+	}
+
+	err = cfg.db.UpdateUserIntroOutro(userID, params.IntroVideoID, params.OutroVideoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update intro/outro", err)
+		return
+	}
+
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, user)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func (cfg *apiConfig) handlerVideoClipCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		StartSeconds float64 `json:"start_seconds" validate:"min=0"`
+		EndSeconds   float64 `json:"end_seconds" validate:"required"`
+		Title        string  `json:"title" validate:"max=200"`
+	}
+
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+	if params.EndSeconds <= params.StartSeconds {
+		respondWithValidationError(w, map[string]string{"end_seconds": "must be greater than start_seconds"}, nil)
+		return
+	}
+
+	source, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	allowed, err := cfg.canAccessVideo(userID, source, permEdit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video permissions", err)
+		return
+	}
+	if !allowed {
+		respondWithError(w, http.StatusUnauthorized, "You are not authorized to clip this video", nil)
+		return
+	}
+	if source.VideoURL == nil {
+		respondWithError(w, http.StatusBadRequest, "Video has no uploaded file to clip", nil)
+		return
+	}
+	if source.Encrypted {
+		respondWithError(w, http.StatusBadRequest, "Encrypted videos can't be clipped", nil)
+		return
+	}
+
+	sourceKey, err := cfg.s3KeyFromURL(*source.VideoURL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find source object", err)
+		return
+	}
+	sourceURL, err := cfg.presignGetObject(r.Context(), sourceKey, 15*time.Minute)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't access source video", err)
+		return
+	}
+
+	release, err := cfg.processing.acquire(r.Context(), userID, priorityInteractive)
+	if err != nil {
+		respondWithError(w, http.StatusServiceUnavailable, "Gave up waiting for a processing slot", err)
+		return
+	}
+	defer release()
+
+	duration, err := cfg.getVideoDuration(sourceURL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't probe source video", err)
+		return
+	}
+	if params.EndSeconds > duration {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("end_seconds is past the end of the video (%.3fs)", duration), nil)
+		return
+	}
+
+	clipFilePath, err := extractClip(sourceURL, params.StartSeconds, params.EndSeconds)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't cut clip", err)
+		return
+	}
+	defer os.Remove(clipFilePath)
+
+	title := params.Title
+	if title == "" {
+		title = source.Title + " (clip)"
+	}
+	// The record comes first so the object key can name it; it is removed
+	// again if the clip can't be stored
+	clip, err := cfg.db.CreateVideo(database.CreateVideoParams{
+		Title:       title,
+		Description: source.Description,
+		UserID:      userID,
+		OrgID:       source.OrgID,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create clip video", err)
+		return
+	}
+	stored, err := cfg.storeVideo(r.Context(), clipFilePath, videoObjectNameOf(clip), nil)
+	if err != nil {
+		if err := cfg.db.DeleteVideo(clip.ID); err != nil {
+			log.Printf("Couldn't remove clip draft %s: %v", clip.ID, err)
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't store clip", err)
+		return
+	}
+	videoURL := cfg.videoDeliveryURL(stored.key)
+	clip.VideoURL = &videoURL
+	clip.ThumbnailURL = source.ThumbnailURL
+	clip.ThumbnailPosterURL = source.ThumbnailPosterURL
+	clip.ParentVideoID = &source.ID
+	clip.Language = source.Language
+	stored.describe(&clip)
+	// A clip is licensed where its source is
+	clip.GeoAllow = source.GeoAllow
+	clip.GeoDeny = source.GeoDeny
+	err = cfg.db.UpdateVideo(clip)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update clip video", err)
+		return
+	}
+	cfg.recordStoredVideo(clip, userID, stored, nil)
+	cfg.recordVideoEvent(clip, database.VideoEventCreated, userID, map[string]any{"parent_video_id": source.ID})
+	cfg.recordVideoEvent(clip, database.VideoEventProcessed, userID, processedEventPayload(clip))
+
+	cfg.signVideoAssets(&clip)
+	respondWithJSON(w, http.StatusCreated, clip)
+}
+
+// extractClip re-encodes the [start, end) range of the input into a new temp
+// file. Seeking before -i lets ffmpeg use range requests against remote input.
+func extractClip(input string, start, end float64) (string, error) {
+	clipFile, err := os.CreateTemp("", "tubely-clip-*.mp4")
+	if err != nil {
+		return "", err
+	}
+	clipFile.Close()
+
+	if err := faults.inject(faultLayerFFmpeg); err != nil {
+		os.Remove(clipFile.Name())
+		return "", fmt.Errorf("could not run ffmpeg: %w", err)
+	}
+	cmd := remoteMediaCommand("ffmpeg",
+		"-y",
+		"-ss", strconv.FormatFloat(start, 'f', 3, 64),
+		"-i", input,
+		"-t", strconv.FormatFloat(end-start, 'f', 3, 64),
+		"-c:v", "libx264",
+		"-c:a", "aac",
+		"-f", "mp4",
+		clipFile.Name(),
+	)
+	err = cmd.Run()
+	recordCommand("clip", cmd)
+	if err != nil {
+		os.Remove(clipFile.Name())
+		return "", fmt.Errorf("could not run ffmpeg: %w", err)
+	}
+
+	return clipFile.Name(), nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerVideoDuplicate creates a private draft from an existing video,
+// copying its title, description, thumbnail and tags. With copy_file set the
+// uploaded file is duplicated too, using a server-side S3 copy.
+func (cfg *apiConfig) handlerVideoDuplicate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Title    string `json:"title" validate:"max=200"`
+		CopyFile bool   `json:"copy_file"`
+	}
+
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+
+	source, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if source.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	allowed, err := cfg.canAccessVideo(userID, source, permEdit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video permissions", err)
+		return
+	}
+	if !allowed {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if params.CopyFile && source.VideoURL == nil {
+		respondWithError(w, http.StatusBadRequest, "Video has no uploaded file to copy", nil)
+		return
+	}
+	if params.CopyFile && source.Encrypted {
+		respondWithError(w, http.StatusBadRequest, "Encrypted videos can't be copied", nil)
+		return
+	}
+
+	var sourceKey string
+	if params.CopyFile {
+		sourceKey, err = cfg.videoObjectKey(source)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't locate video object", err)
+			return
+		}
+	}
+
+	title := params.Title
+	if title == "" {
+		title = source.Title + " (copy)"
+	}
+	duplicate, err := cfg.db.CreateVideo(database.CreateVideoParams{
+		Title:       title,
+		Description: source.Description,
+		UserID:      userID,
+		OrgID:       source.OrgID,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create video", err)
+		return
+	}
+	duplicate.ThumbnailURL = source.ThumbnailURL
+	duplicate.ThumbnailPosterURL = source.ThumbnailPosterURL
+	duplicate.GeoAllow = source.GeoAllow
+	duplicate.GeoDeny = source.GeoDeny
+	duplicate.Language = source.Language
+	if params.CopyFile {
+		duplicate.OriginalFilename = source.OriginalFilename
+		duplicate.AudioLanguages = source.AudioLanguages
+	}
+
+	// The copy is named after the new record, which is removed again if
+	// the copy fails so no half-made draft is left behind
+	if params.CopyFile {
+		copyKey, err := cfg.copyS3Object(r.Context(), sourceKey, videoObjectNameOf(duplicate))
+		if err != nil {
+			if err := cfg.db.DeleteVideo(duplicate.ID); err != nil {
+				log.Printf("Couldn't remove duplicate draft %s: %v", duplicate.ID, err)
+			}
+			respondWithError(w, http.StatusBadGateway, "Couldn't copy video file", err)
+			return
+		}
+		deliveryURL := cfg.videoDeliveryURL(copyKey)
+		duplicate.VideoURL = &deliveryURL
+	}
+	if params.CopyFile {
+		duplicate.TrimStartSeconds = source.TrimStartSeconds
+		duplicate.TrimEndSeconds = source.TrimEndSeconds
+		duplicate.Watermarked = source.Watermarked
+		duplicate.DurationSeconds = source.DurationSeconds
+	}
+	if err := cfg.db.UpdateVideo(duplicate); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	cfg.recordVideoEvent(duplicate, database.VideoEventCreated, userID, map[string]any{"source_video_id": source.ID})
+	if duplicate.VideoURL != nil {
+		cfg.recordVideoEvent(duplicate, database.VideoEventProcessed, userID, processedEventPayload(duplicate))
+	}
+	for _, tag := range source.Tags {
+		if err := cfg.db.AddVideoTag(duplicate.ID, tag); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't copy tags", err)
+			return
+		}
+	}
+
+	duplicate, err = cfg.db.GetVideo(duplicate.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	cfg.signVideoAssets(&duplicate)
+	respondWithJSON(w, http.StatusCreated, duplicate)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerVideoFrameGet(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	timestamp, err := strconv.ParseFloat(r.URL.Query().Get("t"), 64)
+	if err != nil || timestamp < 0 {
+		respondWithError(w, http.StatusBadRequest, "t must be a non-negative number of seconds", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	allowed, err := cfg.canAccessVideo(userID, video, permView)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video permissions", err)
+		return
+	}
+	if !allowed {
+		respondWithError(w, http.StatusUnauthorized, "You are not authorized to view frames of this video", nil)
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusBadRequest, "Video has no uploaded file", nil)
+		return
+	}
+	if video.Encrypted {
+		respondWithError(w, http.StatusBadRequest, "Frames can't be extracted from encrypted videos", nil)
+		return
+	}
+
+	// Frames are cached per source file, so replacing the video naturally
+	// invalidates frames taken from the previous upload.
+	sourceHash := sha256.Sum256([]byte(*video.VideoURL))
+	framePath := filepath.Join(
+		cfg.frameCacheRoot,
+		fmt.Sprintf("%s-%s-%d.jpg", videoID, hex.EncodeToString(sourceHash[:8]), int64(timestamp*1000)),
+	)
+
+	if _, err := os.Stat(framePath); os.IsNotExist(err) {
+		if !cfg.frameLimiter.allow(userID.String()) {
+			w.Header().Set("Retry-After", "1")
+			respondWithError(w, http.StatusTooManyRequests, "Too many frame requests, slow down", nil)
+			return
+		}
+
+		sourceKey, err := cfg.s3KeyFromURL(*video.VideoURL)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't find source object", err)
+			return
+		}
+		sourceURL, err := cfg.presignGetObject(r.Context(), sourceKey, 5*time.Minute)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't access source video", err)
+			return
+		}
+
+		err = extractFrame(sourceURL, timestamp, framePath)
+		if errors.Is(err, errFrameOutOfRange) {
+			respondWithError(w, http.StatusBadRequest, "t is past the end of the video", err)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't extract frame", err)
+			return
+		}
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read frame cache", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	http.ServeFile(w, r, framePath)
+}
+
+var errFrameOutOfRange = errors.New("no frame at requested timestamp")
+
+// extractFrame decodes the single frame at timestamp into a JPEG at
+// outputPath. The frame is written to a temp name first so a concurrent
+// request never serves a half-written cache entry.
+func extractFrame(input string, timestamp float64, outputPath string) error {
+	tempPath := outputPath + ".tmp"
+	defer os.Remove(tempPath)
+
+	if err := faults.inject(faultLayerFFmpeg); err != nil {
+		return fmt.Errorf("could not run ffmpeg: %w", err)
+	}
+	cmd := remoteMediaCommand("ffmpeg",
+		"-y",
+		"-ss", strconv.FormatFloat(timestamp, 'f', 3, 64),
+		"-i", input,
+		"-frames:v", "1",
+		"-c:v", "mjpeg",
+		"-q:v", "2",
+		"-f", "image2",
+		tempPath,
+	)
+	err := cmd.Run()
+	recordCommand("frame", cmd)
+	if err != nil {
+		return fmt.Errorf("could not run ffmpeg: %w", err)
+	}
+
+	info, err := os.Stat(tempPath)
+	if os.IsNotExist(err) || (err == nil && info.Size() == 0) {
+		return errFrameOutOfRange
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempPath, outputPath)
+}
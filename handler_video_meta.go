@@ -1,17 +1,23 @@
 package main
 
 import (
-	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
 	"github.com/google/uuid"
 )
 
 func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
-		database.CreateVideoParams
+		Title       string     `json:"title" validate:"required,max=200"`
+		Description string     `json:"description" validate:"max=5000"`
+		OrgID       *uuid.UUID `json:"org_id"`
+		// Visibility defaults to the user's default visibility
+		Visibility string `json:"visibility"`
 	}
 
 	token, err := auth.GetBearerToken(r.Header)
@@ -19,22 +25,38 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := cfg.validateJWT(token)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
 
-	decoder := json.NewDecoder(r.Body)
-	params := parameters{}
-	err = decoder.Decode(&params)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters", err)
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+	if params.Visibility != "" && !database.ValidVisibility(params.Visibility) {
+		respondWithValidationError(w, map[string]string{"visibility": "must be private, unlisted or public"}, nil)
 		return
 	}
-	params.UserID = userID
+	if params.OrgID != nil {
+		allowed, err := cfg.canUploadToOrg(userID, *params.OrgID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check organization membership", err)
+			return
+		}
+		if !allowed {
+			respondWithError(w, http.StatusForbidden, "You can't create videos in this organization", nil)
+			return
+		}
+	}
 
-	video, err := cfg.db.CreateVideo(params.CreateVideoParams)
+	video, err := cfg.createVideo(database.CreateVideoParams{
+		Title:       params.Title,
+		Description: params.Description,
+		UserID:      userID,
+		OrgID:       params.OrgID,
+	}, params.Visibility, userID, nil)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create video", err)
 		return
@@ -44,10 +66,8 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 }
 
 func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Request) {
-	videoIDString := r.PathValue("videoID")
-	videoID, err := uuid.Parse(videoIDString)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
 		return
 	}
 
@@ -56,7 +76,7 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := cfg.validateJWT(token)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
@@ -67,34 +87,110 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
 		return
 	}
-	if video.UserID != userID {
+	allowed, err := cfg.canAccessVideo(userID, video, permDelete)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video permissions", err)
+		return
+	}
+	if !allowed {
 		respondWithError(w, http.StatusForbidden, "You can't delete this video", err)
 		return
 	}
+	if video.LegalHold {
+		respondWithError(w, http.StatusConflict, "This video is under legal hold and can't be deleted", nil)
+		return
+	}
+
+	if video.Encrypted {
+		err = cfg.db.DeleteVideoKey(videoID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't delete video key", err)
+			return
+		}
+	}
 
 	err = cfg.db.DeleteVideo(videoID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
 		return
 	}
+	cfg.recordVideoEvent(video, database.VideoEventDeleted, userID, nil)
+
+	// A deleted video should stop playing from edge caches too
+	var cachedURLs []string
+	if video.VideoURL != nil && !video.Encrypted {
+		cachedURLs = append(cachedURLs, *video.VideoURL)
+	}
+	cachedURLs = append(cachedURLs, video.ThumbnailURLs()...)
+	cfg.invalidateCDN(cachedURLs...)
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// handlerVideoGet returns a video the caller can view. Private videos look
+// the same as missing ones to everyone else. video_url is null where the
+// video is geo-restricted.
 func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
-	videoIDString := r.PathValue("videoID")
-	videoID, err := uuid.Parse(videoIDString)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
 		return
 	}
 
-	video, err := cfg.db.GetVideo(videoID)
+	// Signing in is optional, since videos that aren't private are for
+	// anyone, but a token that's sent must be valid
+	userID := uuid.Nil
+	if r.Header.Get("Authorization") != "" {
+		token, err := auth.GetBearerToken(r.Header)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+			return
+		}
+		userID, err = cfg.validateJWT(token)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+			return
+		}
+	}
+
+	// Read from the primary: this is what editors and upload clients poll
+	// right after changing a video, and a stale ETag would hide the change
+	video, err := cfg.getVideoShared(videoID, true)
 	if err != nil {
 		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
 		return
 	}
+	allowed := false
+	if video.ID != uuid.Nil {
+		allowed, err = cfg.canViewVideo(userID, video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check video permissions", err)
+			return
+		}
+	}
+	if !allowed {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
 
+	// Viewers where the video is blocked still get its details, but not
+	// the file's URL, which would get around the block on streaming and
+	// downloads
+	_, permitted := cfg.checkGeoRestriction(r, video)
+	if !permitted {
+		video.VideoURL = nil
+	}
+
+	// A cached copy's signed thumbnail URLs would expire while its ETag
+	// still matched, so it's only revalidated when URLs aren't signed.
+	// Nor is it for a blocked viewer, whose copy might have the file's URL
+	etag := videoETag(video)
+	w.Header().Set("ETag", etag)
+	if permitted && cfg.assetURLTTL == 0 && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	cfg.signVideoAssets(&video)
 	respondWithJSON(w, http.StatusOK, video)
 }
 
@@ -104,17 +200,181 @@ func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Reque
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := cfg.validateJWT(token)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
 
-	videos, err := cfg.db.GetVideos(userID)
+	// Without limit or cursor the whole list is returned, as it always was
+	query := r.URL.Query()
+	if !query.Has("limit") && !query.Has("cursor") {
+		videos, err := cfg.db.GetAccessibleVideos(userID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+			return
+		}
+		cfg.signVideoListAssets(videos)
+		respondWithJSON(w, http.StatusOK, videos)
+		return
+	}
+
+	limit, cursor, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+	// Fetching one extra row tells us whether there is a next page
+	videos, err := cfg.db.GetAccessibleVideosPage(userID, cursor, limit+1)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
 		return
 	}
+	if len(videos) > limit {
+		videos = videos[:limit]
+		setNextPageLink(w, r, limit, encodeVideoCursor(videos[limit-1].Video))
+	}
 
+	cfg.signVideoListAssets(videos)
 	respondWithJSON(w, http.StatusOK, videos)
 }
+
+// videoETag derives a weak validator from the video's last update time,
+// which every write to the video changes. It's weak because the response
+// also depends on who asks: a blocked viewer gets no video URL.
+func videoETag(video database.Video) string {
+	return fmt.Sprintf(`W/"%x"`, video.UpdatedAt.UnixNano())
+}
+
+// etagMatches reports whether an If-None-Match or If-Match header lists
+// the given ETag, using the weak comparison: the W/ prefix is ignored on
+// both sides. If-Match would call for the strong comparison, which a weak
+// ETag never passes; the update time it's made from still tells whether
+// the video changed, which is all If-Match is used for here.
+func etagMatches(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// videoLanguageProblem is how a primary language that isn't one is
+// reported.
+const videoLanguageProblem = "must be an ISO 639-2 language code, like eng"
+
+// parseVideoLanguage checks a primary language sent by a client, returning
+// nil for an empty one, which clears it.
+func parseVideoLanguage(value string) (*string, bool) {
+	if value == "" {
+		return nil, true
+	}
+	language := media.NormalizeLanguage(value)
+	if language == "" {
+		return nil, false
+	}
+	return &language, true
+}
+
+// handlerVideoMetaUpdate edits a video's title, description and primary
+// language. Clients must send the ETag they last saw in If-Match, so two
+// concurrent edits can't silently overwrite each other.
+func (cfg *apiConfig) handlerVideoMetaUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Title       *string `json:"title" validate:"min=1,max=200"`
+		Description *string `json:"description" validate:"max=5000"`
+		Language    *string `json:"language"`
+	}
+
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		respondWithError(w, http.StatusPreconditionRequired, "If-Match header is required", nil)
+		return
+	}
+
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+	var language *string
+	if params.Language != nil {
+		if language, ok = parseVideoLanguage(*params.Language); !ok {
+			respondWithValidationError(w, map[string]string{"language": videoLanguageProblem}, nil)
+			return
+		}
+	}
+
+	// A replica could be behind the ETag the client last saw
+	video, err := cfg.db.Primary().GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	allowed, err := cfg.canAccessVideo(userID, video, permEdit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video permissions", err)
+		return
+	}
+	if !allowed {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if !etagMatches(ifMatch, videoETag(video)) {
+		w.Header().Set("ETag", videoETag(video))
+		respondWithError(w, http.StatusPreconditionFailed, "Video was modified since it was fetched", nil)
+		return
+	}
+
+	if params.Title != nil {
+		video.Title = *params.Title
+	}
+	if params.Description != nil {
+		video.Description = *params.Description
+	}
+	if params.Language != nil {
+		video.Language = language
+	}
+	// Another edit may have passed the check above at the same time, so
+	// the write only happens if the video is still as it was loaded
+	updated, err := cfg.db.UpdateVideoIfUnmodified(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	video, err = cfg.db.Primary().GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if !updated {
+		w.Header().Set("ETag", videoETag(video))
+		respondWithError(w, http.StatusPreconditionFailed, "Video was modified since it was fetched", nil)
+		return
+	}
+	w.Header().Set("ETag", videoETag(video))
+	cfg.signVideoAssets(&video)
+	respondWithJSON(w, http.StatusOK, video)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Limits on the key/value metadata integrators can attach to a video. They
+// keep a video's metadata small enough to load with it without thinking.
+const (
+	maxMetadataKeys        = 50
+	maxMetadataValueLength = 1024
+)
+
+// metadataKey allows identifier-like keys such as "crm.campaign_id" or
+// "external:id", up to 64 characters.
+var metadataKey = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:-]{0,63}$`)
+
+type videoMetadataResponse struct {
+	Metadata map[string]string `json:"metadata"`
+}
+
+// videoForMetadata authenticates the request and loads the video it names,
+// checking the caller has perm on it.
+func (cfg *apiConfig) videoForMetadata(w http.ResponseWriter, r *http.Request, perm videoPermission) (uuid.UUID, bool) {
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
+		return uuid.Nil, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return uuid.Nil, false
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return uuid.Nil, false
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return uuid.Nil, false
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return uuid.Nil, false
+	}
+	allowed, err := cfg.canAccessVideo(userID, video, perm)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video permissions", err)
+		return uuid.Nil, false
+	}
+	if !allowed {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return uuid.Nil, false
+	}
+	return videoID, true
+}
+
+func (cfg *apiConfig) handlerVideoMetadataGet(w http.ResponseWriter, r *http.Request) {
+	videoID, ok := cfg.videoForMetadata(w, r, permView)
+	if !ok {
+		return
+	}
+
+	metadata, err := cfg.db.GetVideoMetadata(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video metadata", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, videoMetadataResponse{Metadata: metadata})
+}
+
+// handlerVideoMetadataUpdate merges the posted keys into a video's metadata:
+// keys with a string value are set, keys set to null are removed, and keys
+// left out are kept.
+func (cfg *apiConfig) handlerVideoMetadataUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Metadata map[string]*string `json:"metadata"`
+	}
+
+	videoID, ok := cfg.videoForMetadata(w, r, permEdit)
+	if !ok {
+		return
+	}
+
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+	if len(params.Metadata) == 0 {
+		respondWithValidationError(w, map[string]string{"metadata": "must set or remove at least one key"}, nil)
+		return
+	}
+	fields := map[string]string{}
+	for key, value := range params.Metadata {
+		field := "metadata." + key
+		if !metadataKey.MatchString(key) {
+			fields[field] = "must be 1-64 letters, digits, '_', '.', ':' or '-', starting with a letter or digit"
+		} else if value != nil && len(*value) > maxMetadataValueLength {
+			fields[field] = "must be at most " + strconv.Itoa(maxMetadataValueLength) + " bytes"
+		}
+	}
+	if len(fields) > 0 {
+		respondWithValidationError(w, fields, nil)
+		return
+	}
+
+	metadata, err := cfg.db.PatchVideoMetadata(videoID, params.Metadata, maxMetadataKeys)
+	if errors.Is(err, database.ErrTooManyMetadataKeys) {
+		respondWithValidationError(w, map[string]string{"metadata": fmt.Sprintf("can't have more than %d keys", maxMetadataKeys)}, err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video metadata", err)
+		return
+	}
+	if metadata == nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, videoMetadataResponse{Metadata: metadata})
+}
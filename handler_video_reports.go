@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultReportQueueSize = 50
+	maxReportQueueSize     = 100
+)
+
+// handlerVideoReportCreate reports a video the caller can view for review
+// by a moderator. A user has at most one open report per video; reporting
+// again returns that one with a 200 rather than filing another. Once
+// cfg.reportFlagThreshold users have open reports on a video, it's flagged,
+// which keeps it out of the trending feed and related videos until a
+// moderator dismisses the reports.
+func (cfg *apiConfig) handlerVideoReportCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Reason  string `json:"reason" validate:"required"`
+		Details string `json:"details" validate:"max=1000"`
+	}
+
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+	if !slices.Contains(database.ReportReasons, params.Reason) {
+		respondWithValidationError(w, map[string]string{"reason": "must be one of " + strings.Join(database.ReportReasons, ", ")}, nil)
+		return
+	}
+
+	video, err := cfg.getVideoShared(videoID, true)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	allowed := false
+	if video.ID != uuid.Nil {
+		allowed, err = cfg.canViewVideo(userID, video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check video permissions", err)
+			return
+		}
+	}
+	if !allowed {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	report, duplicate, flagged, err := cfg.db.CreateVideoReport(database.VideoReport{
+		VideoID:    videoID,
+		ReporterID: userID,
+		Reason:     params.Reason,
+		Details:    strings.TrimSpace(params.Details),
+	}, cfg.reportFlagThreshold)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't file report", err)
+		return
+	}
+	if duplicate {
+		respondWithJSON(w, http.StatusOK, report)
+		return
+	}
+	cfg.metrics.add(`tubely_video_reports_total{reason="`+report.Reason+`"}`, 1)
+	if flagged {
+		cfg.metrics.add("tubely_videos_flagged_total", 1)
+		cfg.recordVideoEvent(video, database.VideoEventFlagged, uuid.Nil, map[string]any{"reporters": cfg.reportFlagThreshold})
+	}
+	respondWithJSON(w, http.StatusCreated, report)
+}
+
+// handlerReportsRetrieve is the moderation queue: videos with open
+// reports, flagged ones first, each with its reports. limit is from 1 to
+// 100 and defaults to 50.
+func (cfg *apiConfig) handlerReportsRetrieve(w http.ResponseWriter, r *http.Request) {
+	if _, ok := cfg.authenticateAdmin(w, r); !ok {
+		return
+	}
+
+	limit := defaultReportQueueSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxReportQueueSize {
+			respondWithValidationError(w, map[string]string{"limit": fmt.Sprintf("must be a number from 1 to %d", maxReportQueueSize)}, nil)
+			return
+		}
+		limit = n
+	}
+
+	queue, err := cfg.db.GetReportedVideos(limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve reports", err)
+		return
+	}
+	for i := range queue {
+		cfg.signVideoAssets(&queue[i].Video)
+	}
+	respondWithJSON(w, http.StatusOK, queue)
+}
+
+// handlerReportsResolve closes a video's open reports. Dismissing them
+// unflags the video. Upholding them with "removed" makes the video private
+// and leaves it flagged, so it stays out of the feeds even if its owner
+// makes it public again. Either way the decision is audited.
+func (cfg *apiConfig) handlerReportsResolve(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Resolution string `json:"resolution" validate:"required"`
+		Note       string `json:"note" validate:"max=1000"`
+	}
+	type response struct {
+		Resolved int64          `json:"resolved"`
+		Video    database.Video `json:"video"`
+	}
+
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
+		return
+	}
+
+	adminID, ok := cfg.authenticateAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+	if params.Resolution != database.ReportDismissed && params.Resolution != database.ReportRemoved {
+		respondWithValidationError(w, map[string]string{"resolution": "must be dismissed or removed"}, nil)
+		return
+	}
+
+	video, err := cfg.db.Primary().GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	resolved, err := cfg.db.ResolveVideoReports(videoID, adminID, params.Resolution)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't resolve reports", err)
+		return
+	}
+	if resolved == 0 {
+		respondWithError(w, http.StatusNotFound, "Video has no open reports", nil)
+		return
+	}
+
+	if params.Resolution == database.ReportRemoved && video.Visibility != database.VisibilityPrivate {
+		video.Visibility = database.VisibilityPrivate
+		if err := cfg.db.UpdateVideo(video); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+			return
+		}
+	}
+
+	err = cfg.db.CreateAuditEntry(database.AuditEntry{
+		ActorID: &adminID,
+		Action:  "reports_" + params.Resolution,
+		VideoID: &video.ID,
+		Details: params.Note,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write audit entry", err)
+		return
+	}
+
+	video, err = cfg.db.Primary().GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	cfg.signVideoAssets(&video)
+	respondWithJSON(w, http.StatusOK, response{Resolved: resolved, Video: video})
+}
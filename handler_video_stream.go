@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// streamURLTTL is how long a signed stream URL stays valid. Players re-request
+// ranges throughout playback, so it has to outlive a typical viewing session.
+const streamURLTTL = 4 * time.Hour
+
+// streamSigningKey is the key stream URLs are signed with. It's derived
+// from the JWT secret rather than being it, so a stream signature can't be
+// turned into, or help forge, anything else signed with the secret.
+func (cfg *apiConfig) streamSigningKey() []byte {
+	mac := hmac.New(sha256.New, []byte(cfg.jwtSecret.get()))
+	mac.Write([]byte("stream-url"))
+	return mac.Sum(nil)
+}
+
+// signStreamURL signs a video ID and expiry so a <video> element, which can't
+// send an Authorization header, can still reach the authenticated proxy.
+// URLs made for an admin overriding the video's geo-restriction say so in
+// what's signed.
+func (cfg *apiConfig) signStreamURL(videoID uuid.UUID, expires int64, geoOverride bool) string {
+	mac := hmac.New(sha256.New, cfg.streamSigningKey())
+	fmt.Fprintf(mac, "stream:%s:%d", videoID, expires)
+	if geoOverride {
+		fmt.Fprint(mac, ":geo-override")
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validStreamSignature reports whether the request carries a valid stream
+// signature, and whether it overrides the video's geo-restriction.
+func (cfg *apiConfig) validStreamSignature(videoID uuid.UUID, r *http.Request) (valid, geoOverride bool) {
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false, false
+	}
+	signature, err := hex.DecodeString(r.URL.Query().Get("signature"))
+	if err != nil {
+		return false, false
+	}
+	geoOverride = r.URL.Query().Get("geo_override") == "1"
+	expected, _ := hex.DecodeString(cfg.signStreamURL(videoID, expires, geoOverride))
+	if !hmac.Equal(signature, expected) {
+		return false, false
+	}
+	return true, geoOverride
+}
+
+func (cfg *apiConfig) handlerVideoStreamURLCreate(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		URL       string    `json:"url"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.getVideoShared(videoID, false)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	allowed, err := cfg.canAccessVideo(userID, video, permView)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video permissions", err)
+		return
+	}
+	if !allowed {
+		respondWithError(w, http.StatusUnauthorized, "You are not authorized to stream this video", nil)
+		return
+	}
+	geoOverride, ok := cfg.streamGeoCheck(w, r, userID, video)
+	if !ok {
+		return
+	}
+
+	expiresAt := time.Now().Add(streamURLTTL).UTC()
+	signature := cfg.signStreamURL(videoID, expiresAt.Unix(), geoOverride)
+	url := fmt.Sprintf("%s?expires=%d&signature=%s", cfg.videoStreamURL(videoID), expiresAt.Unix(), signature)
+	if geoOverride {
+		url += "&geo_override=1"
+	}
+	respondWithJSON(w, http.StatusOK, response{
+		URL:       url,
+		ExpiresAt: expiresAt,
+	})
+}
+
+// streamGeoCheck applies the video's geo-restriction to an authenticated
+// viewer, letting admins override it. It responds and reports false when
+// the viewer is blocked, and reports whether an override was used.
+func (cfg *apiConfig) streamGeoCheck(w http.ResponseWriter, r *http.Request, userID uuid.UUID, video database.Video) (geoOverride, ok bool) {
+	country, permitted := cfg.checkGeoRestriction(r, video)
+	if permitted {
+		return false, true
+	}
+	overridden, err := cfg.overrideGeoRestriction(userID, video, country)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check geo-restriction override", err)
+		return false, false
+	}
+	if !overridden {
+		respondGeoBlocked(w)
+		return false, false
+	}
+	return true, true
+}
+
+// handlerVideoStream proxies the video object from S3, forwarding range
+// requests. It is the only playback path for SSE-C encrypted videos, since
+// reading them requires the unwrapped data key.
+func (cfg *apiConfig) handlerVideoStream(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	video, err := cfg.getVideoShared(videoID, false)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+
+	// Admins override a geo-restriction through a stream URL, so it's
+	// audited once rather than on every range request
+	signed, geoOverride := cfg.validStreamSignature(videoID, r)
+	if !geoOverride {
+		if _, permitted := cfg.checkGeoRestriction(r, video); !permitted {
+			respondGeoBlocked(w)
+			return
+		}
+	}
+	if !signed {
+		token, err := auth.GetBearerToken(r.Header)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT or a valid stream signature", err)
+			return
+		}
+		userID, err := cfg.validateJWT(token)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+			return
+		}
+		allowed, err := cfg.canAccessVideo(userID, video, permView)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check video permissions", err)
+			return
+		}
+		if !allowed {
+			respondWithError(w, http.StatusUnauthorized, "You are not authorized to stream this video", nil)
+			return
+		}
+	}
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusNotFound, "Video has no uploaded file", nil)
+		return
+	}
+
+	input, err := cfg.videoGetObjectInput(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't locate video object", err)
+		return
+	}
+	if cfg.streamCache != nil && r.Method == http.MethodGet {
+		served, err := cfg.streamFromCache(w, r, input, cfg.userBandwidth(video.UserID), func(*s3.GetObjectOutput) {
+			w.Header().Set("Content-Type", "video/mp4")
+			w.Header().Set("Cache-Control", "private, no-store")
+		})
+		if err != nil {
+			respondWithError(w, http.StatusBadGateway, "Couldn't fetch video from storage", err)
+			return
+		}
+		if served {
+			return
+		}
+	}
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		input.Range = &rangeHeader
+	}
+
+	out, err := cfg.getVideoObject(r.Context(), r.Method, input)
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't fetch video from storage", err)
+		return
+	}
+	defer out.Body.Close()
+
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Cache-Control", "private, no-store")
+	if out.ContentLength != nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(*out.ContentLength, 10))
+	}
+	status := http.StatusOK
+	if out.ContentRange != nil {
+		w.Header().Set("Content-Range", *out.ContentRange)
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+
+	if _, err := cfg.buffers.copy(throttleResponse(w, cfg.userBandwidth(video.UserID)), out.Body); err != nil {
+		// Players routinely abort range requests mid-body; nothing to report
+		return
+	}
+}
+
+// getVideoObject fetches an object for the proxy endpoints. A HEAD request
+// only needs its size, range and headers, which S3 reports without sending
+// the body, so the output then has an empty one.
+func (cfg *apiConfig) getVideoObject(ctx context.Context, method string, input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	if method != http.MethodHead {
+		return cfg.s3Client.GetObject(ctx, input)
+	}
+	head, err := cfg.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:               input.Bucket,
+		Key:                  input.Key,
+		Range:                input.Range,
+		SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+		SSECustomerKey:       input.SSECustomerKey,
+		SSECustomerKeyMD5:    input.SSECustomerKeyMD5,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3.GetObjectOutput{
+		Body:               http.NoBody,
+		ContentLength:      head.ContentLength,
+		ContentRange:       head.ContentRange,
+		ContentType:        head.ContentType,
+		CacheControl:       head.CacheControl,
+		ContentDisposition: head.ContentDisposition,
+		ETag:               head.ETag,
+	}, nil
+}
+
+// videoGetObjectInput builds the GetObject request for a video's file,
+// unwrapping its data key from the keystore when it is encrypted.
+func (cfg *apiConfig) videoGetObjectInput(ctx context.Context, video database.Video) (*s3.GetObjectInput, error) {
+	key, err := cfg.videoObjectKey(video)
+	if err != nil {
+		return nil, err
+	}
+	input := &s3.GetObjectInput{Bucket: &cfg.s3Bucket, Key: &key}
+	if !video.Encrypted {
+		return input, nil
+	}
+
+	if cfg.keyWrapper == nil {
+		return nil, errEncryptionDisabled
+	}
+	videoKey, err := cfg.db.GetVideoKey(video.ID)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := cfg.keyWrapper.Unwrap(ctx, videoKey.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	newSSECustomerKey(dataKey).applyToGet(input)
+	return input, nil
+}
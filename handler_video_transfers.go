@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerVideoTransferCreate offers a video to another user (by email) or to
+// an organization. Nothing moves until the recipient accepts.
+func (cfg *apiConfig) handlerVideoTransferCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ToEmail string     `json:"to_email"`
+		ToOrgID *uuid.UUID `json:"to_org_id"`
+	}
+
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+	if (params.ToEmail == "") == (params.ToOrgID == nil) {
+		respondWithValidationError(w, map[string]string{"to_email": "or to_org_id is required, but not both"}, nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	allowed, err := cfg.canAccessVideo(userID, video, permDelete)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video permissions", err)
+		return
+	}
+	if !allowed {
+		respondWithError(w, http.StatusForbidden, "You can't transfer this video", nil)
+		return
+	}
+
+	transfer := database.VideoTransfer{VideoID: videoID, FromUserID: userID}
+	if params.ToOrgID != nil {
+		org, err := cfg.db.GetOrganization(*params.ToOrgID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get organization", err)
+			return
+		}
+		if org.ID == uuid.Nil {
+			respondWithError(w, http.StatusNotFound, "Organization not found", nil)
+			return
+		}
+		if video.OrgID != nil && *video.OrgID == org.ID {
+			respondWithError(w, http.StatusBadRequest, "Video already belongs to this organization", nil)
+			return
+		}
+		transfer.ToOrgID = &org.ID
+	} else {
+		recipient, err := cfg.db.GetUserByEmail(params.ToEmail)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+			return
+		}
+		if recipient.ID == uuid.Nil {
+			respondWithError(w, http.StatusNotFound, "No user with that email", nil)
+			return
+		}
+		if video.OrgID == nil && recipient.ID == video.UserID {
+			respondWithError(w, http.StatusBadRequest, "Video already belongs to this user", nil)
+			return
+		}
+		transfer.ToUserID = &recipient.ID
+	}
+
+	transfer, err = cfg.db.CreateVideoTransfer(transfer)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create transfer", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, transfer)
+}
+
+func (cfg *apiConfig) handlerVideoTransfersRetrieve(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	transfers, err := cfg.db.GetIncomingVideoTransfers(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve transfers", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, transfers)
+}
+
+// handlerVideoTransferResolve accepts or declines a pending transfer on
+// behalf of its recipient, or cancels it on behalf of its sender.
+func (cfg *apiConfig) handlerVideoTransferResolve(w http.ResponseWriter, r *http.Request) {
+	transferID, ok := pathUUID(w, r, "transferID")
+	if !ok {
+		return
+	}
+
+	var status string
+	switch r.PathValue("action") {
+	case "accept":
+		status = database.TransferStatusAccepted
+	case "decline":
+		status = database.TransferStatusDeclined
+	case "cancel":
+		status = database.TransferStatusCancelled
+	default:
+		respondWithError(w, http.StatusNotFound, "Unknown transfer action", nil)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	transfer, err := cfg.db.GetVideoTransfer(transferID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get transfer", err)
+		return
+	}
+	if transfer.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Transfer not found", nil)
+		return
+	}
+
+	var allowed bool
+	if status == database.TransferStatusCancelled {
+		allowed = transfer.FromUserID == userID
+	} else {
+		allowed, err = cfg.isTransferRecipient(userID, transfer)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check transfer recipient", err)
+			return
+		}
+	}
+	if !allowed {
+		respondWithError(w, http.StatusNotFound, "Transfer not found", nil)
+		return
+	}
+
+	// The sender may have lost their role or left the organization since
+	// offering the video; if so the offer lapses rather than moving it
+	if status == database.TransferStatusAccepted {
+		senderAllowed, err := cfg.senderCanTransfer(transfer)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check video permissions", err)
+			return
+		}
+		if !senderAllowed {
+			if _, err := cfg.db.ResolveVideoTransfer(transfer, database.TransferStatusCancelled); err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Couldn't resolve transfer", err)
+				return
+			}
+			respondWithError(w, http.StatusConflict, "The sender can no longer transfer this video", nil)
+			return
+		}
+	}
+
+	resolved, err := cfg.db.ResolveVideoTransfer(transfer, status)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't resolve transfer", err)
+		return
+	}
+	if !resolved {
+		respondWithError(w, http.StatusConflict, "Transfer is no longer pending", nil)
+		return
+	}
+
+	if status == database.TransferStatusAccepted {
+		recipient := fmt.Sprintf("user %s", transfer.ToUserID)
+		if transfer.ToOrgID != nil {
+			recipient = fmt.Sprintf("organization %s", transfer.ToOrgID)
+		}
+		err = cfg.db.CreateAuditEntry(database.AuditEntry{
+			ActorID: &userID,
+			Action:  "video_transferred",
+			VideoID: &transfer.VideoID,
+			Details: fmt.Sprintf("from user %s to %s", transfer.FromUserID, recipient),
+		})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't write audit entry", err)
+			return
+		}
+	}
+
+	transfer, err = cfg.db.GetVideoTransfer(transferID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get transfer", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, transfer)
+}
+
+// senderCanTransfer reports whether whoever offered a transfer could still
+// offer it now.
+func (cfg *apiConfig) senderCanTransfer(transfer database.VideoTransfer) (bool, error) {
+	video, err := cfg.db.Primary().GetVideo(transfer.VideoID)
+	if err != nil {
+		return false, err
+	}
+	if video.ID == uuid.Nil {
+		return false, nil
+	}
+	return cfg.canAccessVideo(transfer.FromUserID, video, permDelete)
+}
+
+// isTransferRecipient reports whether the user can accept a transfer: it is
+// addressed to them, or to an organization they own or administer.
+func (cfg *apiConfig) isTransferRecipient(userID uuid.UUID, transfer database.VideoTransfer) (bool, error) {
+	if transfer.ToUserID != nil {
+		return *transfer.ToUserID == userID, nil
+	}
+	role, err := cfg.db.GetOrgMemberRole(*transfer.ToOrgID, userID)
+	if err != nil {
+		return false, err
+	}
+	return role == database.OrgRoleOwner || role == database.OrgRoleAdmin, nil
+}
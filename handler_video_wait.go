@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultWaitTimeout = 30 * time.Second
+	// maxWaitTimeout stays under the idle timeouts of common proxies, which
+	// would otherwise cut a quiet request off first
+	maxWaitTimeout = 60 * time.Second
+	// waitPollInterval is how often a waiting request checks the status.
+	// Processing may finish on another node, so the database is the only
+	// place to look.
+	waitPollInterval = 500 * time.Millisecond
+)
+
+var videoStatuses = []string{
+	database.VideoStatusAwaitingUpload,
+	database.VideoStatusProcessing,
+	database.VideoStatusReady,
+	database.VideoStatusFailed,
+}
+
+// handlerVideoWait long-polls a video's processing status, for scripts that
+// just want to wait for an upload to be ready without a streaming client.
+// It answers as soon as the status differs from the one the caller last saw,
+// or, once the timeout passes, with the status unchanged.
+func (cfg *apiConfig) handlerVideoWait(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		database.VideoListItem
+		// Changed is false when the wait timed out
+		Changed bool `json:"changed"`
+	}
+
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	query := r.URL.Query()
+	fields := map[string]string{}
+	timeout := defaultWaitTimeout
+	if v := query.Get("timeout"); v != "" {
+		timeout, err = time.ParseDuration(v)
+		if err != nil || timeout <= 0 || timeout > maxWaitTimeout {
+			fields["timeout"] = "must be a duration up to " + maxWaitTimeout.String() + ", like 30s"
+		}
+	}
+	seen := query.Get("status")
+	if seen != "" && !slices.Contains(videoStatuses, seen) {
+		fields["status"] = "must be one of awaiting_upload, processing, ready or failed"
+	}
+	if len(fields) > 0 {
+		respondWithValidationError(w, fields, nil)
+		return
+	}
+
+	// Read from the primary, so a script that just uploaded sees the
+	// processing it started
+	db := cfg.db.Primary()
+	item, err := db.GetVideoListItem(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if item.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	allowed, err := cfg.canAccessVideo(userID, item.Video, permView)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video access", err)
+		return
+	}
+	if !allowed {
+		respondWithError(w, http.StatusForbidden, "You can't view this video", nil)
+		return
+	}
+	if seen == "" {
+		seen = item.Status
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(waitPollInterval)
+	defer ticker.Stop()
+	for item.Status == seen {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-deadline.C:
+			cfg.signVideoAssets(&item.Video)
+			respondWithJSON(w, http.StatusOK, response{VideoListItem: item})
+			return
+		case <-ticker.C:
+		}
+		item, err = db.GetVideoListItem(videoID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+			return
+		}
+		if item.ID == uuid.Nil {
+			respondWithError(w, http.StatusNotFound, "Video was deleted", nil)
+			return
+		}
+	}
+
+	cfg.signVideoAssets(&item.Video)
+	respondWithJSON(w, http.StatusOK, response{VideoListItem: item, Changed: true})
+}
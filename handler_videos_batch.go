@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	batchActionDelete        = "delete"
+	batchActionSetVisibility = "set-visibility"
+	batchActionAddTag        = "add-tag"
+	// batchActionConvertThumbnail queues a job per video rather than
+	// decoding every image within the request
+	batchActionConvertThumbnail = "convert-thumbnail"
+)
+
+const maxTagLength = 50
+
+type batchItemResult struct {
+	VideoID uuid.UUID `json:"video_id"`
+	OK      bool      `json:"ok"`
+	Error   string    `json:"error,omitempty"`
+	// JobID is the queued job, for actions that run in the background
+	JobID *uuid.UUID `json:"job_id,omitempty"`
+}
+
+// normalizeTag lowercases and trims a tag, reporting false for tags that are
+// empty, too long or contain a comma.
+func normalizeTag(tag string) (string, bool) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" || len(tag) > maxTagLength || strings.Contains(tag, ",") {
+		return "", false
+	}
+	return tag, true
+}
+
+// handlerVideosBatch applies one action to many videos. Each video is
+// checked and processed on its own, so one failure doesn't stop the rest;
+// the response lists the outcome per video.
+func (cfg *apiConfig) handlerVideosBatch(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Action     string      `json:"action" validate:"required"`
+		VideoIDs   []uuid.UUID `json:"video_ids" validate:"required,min=1,max=500"`
+		Visibility string      `json:"visibility"`
+		Tag        string      `json:"tag"`
+	}
+	type response struct {
+		Succeeded int               `json:"succeeded"`
+		Failed    int               `json:"failed"`
+		Results   []batchItemResult `json:"results"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+	switch params.Action {
+	case batchActionDelete:
+	case batchActionSetVisibility:
+		if !database.ValidVisibility(params.Visibility) {
+			respondWithValidationError(w, map[string]string{"visibility": "must be private, unlisted or public"}, nil)
+			return
+		}
+	case batchActionAddTag:
+		params.Tag, ok = normalizeTag(params.Tag)
+		if !ok {
+			respondWithValidationError(w, map[string]string{"tag": "must be 1-50 characters without commas"}, nil)
+			return
+		}
+	case batchActionConvertThumbnail:
+		if len(cfg.thumbnailVariants) == 0 {
+			respondWithError(w, http.StatusConflict, "No thumbnail variants are enabled", nil)
+			return
+		}
+	default:
+		respondWithValidationError(w, map[string]string{"action": "must be delete, set-visibility, add-tag or convert-thumbnail"}, nil)
+		return
+	}
+
+	resp := response{Results: make([]batchItemResult, 0, len(params.VideoIDs))}
+	var objectKeys, thumbnailURLs []string
+	seen := map[uuid.UUID]bool{}
+	for _, videoID := range params.VideoIDs {
+		if seen[videoID] {
+			continue
+		}
+		seen[videoID] = true
+
+		result := batchItemResult{VideoID: videoID}
+		video, err := cfg.db.GetVideo(videoID)
+		allowed := false
+		if err == nil && video.ID != uuid.Nil {
+			allowed, err = cfg.canAccessVideo(userID, video, batchActionPermission(params.Action))
+		}
+		switch {
+		case err != nil:
+			result.Error = "couldn't get video"
+		case !allowed:
+			result.Error = "video not found"
+		default:
+			switch params.Action {
+			case batchActionDelete:
+				var key string
+				key, err = cfg.deleteVideoRecord(video)
+				if err == nil {
+					cfg.recordVideoEvent(video, database.VideoEventDeleted, userID, nil)
+					if key != "" {
+						objectKeys = append(objectKeys, key)
+					}
+					if video.AudioDescriptionKey != nil {
+						objectKeys = append(objectKeys, *video.AudioDescriptionKey)
+					}
+					thumbnailURLs = append(thumbnailURLs, video.ThumbnailURLs()...)
+				}
+			case batchActionSetVisibility:
+				wasPublic := video.Visibility == database.VisibilityPublic
+				video.Visibility = params.Visibility
+				err = cfg.db.UpdateVideo(video)
+				if err == nil && !wasPublic && video.Visibility == database.VisibilityPublic {
+					cfg.recordVideoEvent(video, database.VideoEventPublished, userID, nil)
+				}
+			case batchActionAddTag:
+				err = cfg.db.AddVideoTag(video.ID, params.Tag)
+			case batchActionConvertThumbnail:
+				if video.ThumbnailURL == nil {
+					err = errNoThumbnail
+					break
+				}
+				var job database.Job
+				job, err = cfg.db.EnqueueJob(database.JobKindThumbnailVariants, video.ID, userID, int(priorityBackground))
+				if err == nil {
+					result.JobID = &job.ID
+				}
+			}
+			if err != nil {
+				log.Printf("Batch %s failed for video %s: %v", params.Action, videoID, err)
+				result.Error = err.Error()
+			} else {
+				result.OK = true
+			}
+		}
+
+		if result.OK {
+			resp.Succeeded++
+		} else {
+			resp.Failed++
+		}
+		resp.Results = append(resp.Results, result)
+	}
+
+	if len(objectKeys) > 0 || len(thumbnailURLs) > 0 {
+		go cfg.purgeVideoStorage(objectKeys, thumbnailURLs)
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func batchActionPermission(action string) videoPermission {
+	if action == batchActionDelete {
+		return permDelete
+	}
+	return permEdit
+}
+
+// deleteVideoRecord removes a video and its key from the database, returning
+// the S3 key of its file (if any) for the caller to clean up. Videos under
+// legal hold are refused.
+func (cfg *apiConfig) deleteVideoRecord(video database.Video) (string, error) {
+	if video.LegalHold {
+		return "", errLegalHold
+	}
+
+	var key string
+	if video.VideoURL != nil {
+		var err error
+		key, err = cfg.videoObjectKey(video)
+		if err != nil {
+			return "", err
+		}
+	}
+	if video.Encrypted {
+		if err := cfg.db.DeleteVideoKey(video.ID); err != nil {
+			return "", err
+		}
+	}
+	if err := cfg.db.DeleteVideo(video.ID); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// purgeVideoStorage deletes the S3 objects and thumbnail files left behind
+// by deleted videos.
+func (cfg *apiConfig) purgeVideoStorage(objectKeys, thumbnailURLs []string) {
+	ctx := context.Background()
+	var deletedURLs []string
+	for _, key := range objectKeys {
+		if err := cfg.deleteS3ObjectVerified(ctx, key); err != nil {
+			log.Printf("Couldn't delete object %s: %v", key, err)
+			continue
+		}
+		deletedURLs = append(deletedURLs, cfg.videoDeliveryURL(key))
+	}
+	cfg.invalidateCDN(deletedURLs...)
+	for _, thumbnailURL := range thumbnailURLs {
+		cfg.removeUnusedThumbnail(thumbnailURL)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// handlerWatermarkUpload stores the caller's watermark image. The form may
+// also set position, opacity and scale; those left out keep their values.
+func (cfg *apiConfig) handlerWatermarkUpload(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	// Watermarks need an alpha channel to blend properly, so only PNG is accepted
+	const maxWatermarkSize = 10 << 20 // 10 MB
+	file, _, ok := formFile(w, r, "watermark", maxWatermarkSize, "image/png")
+	if !ok {
+		return
+	}
+	defer file.Close()
+
+	// The declared type is the client's word for it; the file itself has
+	// to decode as a PNG
+	if err := checkImageDimensions(file, "png"); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	settings, err := cfg.watermarkSettings(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get watermark settings", err)
+		return
+	}
+	problems := map[string]string{}
+	if v := r.FormValue("position"); v != "" {
+		settings.Position = v
+	}
+	for field, value := range map[string]*float64{"opacity": &settings.Opacity, "scale": &settings.Scale} {
+		v := r.FormValue(field)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			problems[field] = "must be a number"
+			continue
+		}
+		*value = n
+	}
+	for field, problem := range watermarkSettingsProblems(settings) {
+		if _, ok := problems[field]; !ok {
+			problems[field] = problem
+		}
+	}
+	if len(problems) > 0 {
+		respondWithValidationError(w, problems, nil)
+		return
+	}
+
+	dst, err := os.Create(cfg.userWatermarkPath(userID))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create file on disk", err)
+		return
+	}
+	defer dst.Close()
+
+	if _, err := cfg.buffers.copy(dst, file); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save file to disk", err)
+		return
+	}
+
+	if err := cfg.db.UpdateWatermarkSettings(userID, settings); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save watermark settings", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerWatermarkGet returns how the caller's videos are watermarked, and
+// whether they've uploaded their own image rather than using the
+// deployment's.
+func (cfg *apiConfig) handlerWatermarkGet(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		database.WatermarkSettings
+		CustomImage bool `json:"custom_image"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	settings, err := cfg.watermarkSettings(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get watermark settings", err)
+		return
+	}
+	_, err = os.Stat(cfg.userWatermarkPath(userID))
+	if err != nil && !os.IsNotExist(err) {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check watermark image", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, response{WatermarkSettings: settings, CustomImage: err == nil})
+}
+
+// handlerWatermarkUpdate changes where and how the caller's watermark is
+// laid over their videos. Fields left out keep their values.
+func (cfg *apiConfig) handlerWatermarkUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Position *string  `json:"position"`
+		Opacity  *float64 `json:"opacity"`
+		Scale    *float64 `json:"scale"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+
+	settings, err := cfg.watermarkSettings(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get watermark settings", err)
+		return
+	}
+	if params.Position != nil {
+		settings.Position = *params.Position
+	}
+	if params.Opacity != nil {
+		settings.Opacity = *params.Opacity
+	}
+	if params.Scale != nil {
+		settings.Scale = *params.Scale
+	}
+	if problems := watermarkSettingsProblems(settings); len(problems) > 0 {
+		respondWithValidationError(w, problems, nil)
+		return
+	}
+
+	if err := cfg.db.UpdateWatermarkSettings(userID, settings); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save watermark settings", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, settings)
+}
+
+// handlerWatermarkDelete removes the caller's watermark image and settings,
+// so the deployment's apply again.
+func (cfg *apiConfig) handlerWatermarkDelete(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	err = os.Remove(cfg.userWatermarkPath(userID))
+	if err != nil && !os.IsNotExist(err) {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete watermark", err)
+		return
+	}
+	if err := cfg.db.DeleteWatermarkSettings(userID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete watermark settings", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
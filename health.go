@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// handlerReadyz tells a load balancer whether to send this node traffic.
+// It isn't authenticated, so it only reports the state of the database
+// connection, not what's in it. While the primary database is unreachable
+// the node answers 503, and keeps answering it until a check succeeds.
+func (cfg *apiConfig) handlerReadyz(w http.ResponseWriter, r *http.Request) {
+	type replica struct {
+		Path       string  `json:"path"`
+		LagSeconds float64 `json:"lag_seconds"`
+		Usable     bool    `json:"usable"`
+	}
+	type response struct {
+		Status   string          `json:"status"`
+		Database database.Health `json:"database"`
+		Replicas []replica       `json:"replicas,omitempty"`
+	}
+
+	health, err := cfg.db.Health()
+	resp := response{Status: "ok", Database: health}
+	for _, status := range cfg.db.ReplicaStatus() {
+		resp.Replicas = append(resp.Replicas, replica{Path: status.Path, LagSeconds: status.Lag.Seconds(), Usable: status.Usable})
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if err != nil {
+		resp.Status = "unavailable"
+		w.Header().Set("Retry-After", "5")
+		respondWithJSON(w, http.StatusServiceUnavailable, resp)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	hookStagePreStore    = "pre_store"
+	hookStagePostProcess = "post_process"
+
+	// hookOutputLimit caps how much of a hook's reply is read.
+	hookOutputLimit = 64 << 10
+)
+
+// hookEvent describes the upload a processing hook is called for.
+type hookEvent struct {
+	Stage   string    `json:"stage"`
+	VideoID uuid.UUID `json:"video_id"`
+	UserID  uuid.UUID `json:"user_id"`
+	Title   string    `json:"title"`
+	// VideoURL is where the stored video is served from. It is only set
+	// for post_process.
+	VideoURL string `json:"video_url,omitempty"`
+}
+
+// hookResult is what a hook may answer with. A non-empty Reason refuses the
+// upload, and is ignored after the video has been stored. Tags are added to
+// the video, e.g. by a classifier.
+type hookResult struct {
+	Reason string   `json:"reason"`
+	Tags   []string `json:"tags"`
+}
+
+// processingHook lets a deployment add its own steps to the upload pipeline,
+// like a corporate watermark or a content classifier, without changing it.
+// PreStore runs on the processed file just before it's stored and may
+// return the path of a replacement file, or "" to store it as is. An error
+// from PreStore fails the upload. PostProcess runs in the background once
+// the video is stored.
+type processingHook interface {
+	PreStore(ctx context.Context, event hookEvent, filePath string) (string, hookResult, error)
+	PostProcess(ctx context.Context, event hookEvent) (hookResult, error)
+}
+
+// commandHook runs an operator-supplied executable. It's called with the
+// stage as its first argument, the event as JSON on stdin, and may print a
+// hookResult as JSON on stdout. For pre_store it also gets the path of the
+// file and a path it may write a replacement to.
+type commandHook struct {
+	path    string
+	timeout time.Duration
+}
+
+func (c commandHook) PreStore(ctx context.Context, event hookEvent, filePath string) (string, hookResult, error) {
+	outputPath := filePath + ".hooked"
+	result, err := c.run(ctx, event, filePath, outputPath)
+	if err != nil {
+		os.Remove(outputPath)
+		return "", hookResult{}, err
+	}
+	if stat, err := os.Stat(outputPath); err != nil || stat.Size() == 0 {
+		os.Remove(outputPath)
+		return "", result, nil
+	}
+	return outputPath, result, nil
+}
+
+func (c commandHook) PostProcess(ctx context.Context, event hookEvent) (hookResult, error) {
+	return c.run(ctx, event)
+}
+
+func (c commandHook) run(ctx context.Context, event hookEvent, args ...string) (hookResult, error) {
+	input, err := json.Marshal(event)
+	if err != nil {
+		return hookResult{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	var stdout bytes.Buffer
+	stderr := &tailBuffer{limit: hookOutputLimit}
+	cmd := exec.CommandContext(ctx, c.path, append([]string{event.Stage}, args...)...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+		if last := lines[len(lines)-1]; last != "" {
+			return hookResult{}, fmt.Errorf("hook command failed: %w: %s", err, last)
+		}
+		return hookResult{}, fmt.Errorf("hook command failed: %w", err)
+	}
+	return parseHookResult(io.LimitReader(&stdout, hookOutputLimit))
+}
+
+// webhookHook posts the event as JSON to an operator-supplied URL and reads
+// a hookResult from a 2xx response. The file itself isn't sent, so a
+// webhook can refuse or tag an upload but not change it.
+type webhookHook struct {
+	httpClient    *http.Client
+	url           string
+	signingSecret *rotatingSecret
+}
+
+func (wh webhookHook) PreStore(ctx context.Context, event hookEvent, filePath string) (string, hookResult, error) {
+	result, err := wh.post(ctx, event)
+	return "", result, err
+}
+
+func (wh webhookHook) PostProcess(ctx context.Context, event hookEvent) (hookResult, error) {
+	return wh.post(ctx, event)
+}
+
+func (wh webhookHook) post(ctx context.Context, event hookEvent) (hookResult, error) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return hookResult{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.url, bytes.NewReader(body))
+	if err != nil {
+		return hookResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signWebhook(req, body, wh.signingSecret)
+
+	resp, err := wh.httpClient.Do(req)
+	if err != nil {
+		return hookResult{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return hookResult{}, fmt.Errorf("hook webhook returned %s", resp.Status)
+	}
+	return parseHookResult(io.LimitReader(resp.Body, hookOutputLimit))
+}
+
+// parseHookResult reads a hook's reply. Saying nothing is the same as
+// accepting the upload unchanged.
+func parseHookResult(r io.Reader) (hookResult, error) {
+	var result hookResult
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return hookResult{}, err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return result, nil
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return hookResult{}, fmt.Errorf("couldn't parse hook reply: %w", err)
+	}
+	return result, nil
+}
+
+// errRejectedByHook is wrapped by the uploadError for an upload a
+// pre-store hook refused.
+var errRejectedByHook = errors.New("upload rejected by processing hook")
+
+// runPreStoreHook hands the processed file to the configured hook, if any,
+// and returns the path of the file to store in its place. The caller owns a
+// returned path that differs from filePath.
+func (cfg *apiConfig) runPreStoreHook(ctx context.Context, video database.Video, userID uuid.UUID, filePath string) (string, hookResult, error) {
+	if cfg.hook == nil {
+		return filePath, hookResult{}, nil
+	}
+	event := hookEvent{Stage: hookStagePreStore, VideoID: video.ID, UserID: userID, Title: video.Title}
+	replacementPath, result, err := cfg.hook.PreStore(ctx, event, filePath)
+	if err != nil {
+		cfg.metrics.add(`tubely_processing_hooks_total{stage="pre_store",result="error"}`, 1)
+		return "", hookResult{}, err
+	}
+	if result.Reason != "" {
+		cfg.metrics.add(`tubely_processing_hooks_total{stage="pre_store",result="rejected"}`, 1)
+		if replacementPath != "" {
+			os.Remove(replacementPath)
+		}
+		return "", result, fmt.Errorf("%w: %s", errRejectedByHook, result.Reason)
+	}
+	cfg.metrics.add(`tubely_processing_hooks_total{stage="pre_store",result="ok"}`, 1)
+	if replacementPath == "" {
+		replacementPath = filePath
+	}
+	return replacementPath, result, nil
+}
+
+// runPostProcessHook tells the configured hook, if any, about a stored
+// video in the background and tags the video with what it answers.
+func (cfg *apiConfig) runPostProcessHook(video database.Video, userID uuid.UUID) {
+	if cfg.hook == nil {
+		return
+	}
+	event := hookEvent{Stage: hookStagePostProcess, VideoID: video.ID, UserID: userID, Title: video.Title}
+	if video.VideoURL != nil {
+		event.VideoURL = *video.VideoURL
+	}
+
+	go func() {
+		result, err := cfg.hook.PostProcess(context.Background(), event)
+		if err != nil {
+			cfg.metrics.add(`tubely_processing_hooks_total{stage="post_process",result="error"}`, 1)
+			log.Printf("Post-process hook failed for video %s: %v", video.ID, err)
+			return
+		}
+		cfg.metrics.add(`tubely_processing_hooks_total{stage="post_process",result="ok"}`, 1)
+		if _, err := cfg.addHookTags(video.ID, result.Tags); err != nil {
+			log.Printf("Couldn't save tags from post-process hook for video %s: %v", video.ID, err)
+		}
+	}()
+}
+
+// addHookTags adds the tags a hook answered with to a video and returns the
+// ones that were valid. Invalid tags are skipped rather than failing the
+// upload over them.
+func (cfg *apiConfig) addHookTags(videoID uuid.UUID, tags []string) ([]string, error) {
+	var added []string
+	for _, raw := range tags {
+		tag, ok := normalizeTag(raw)
+		if !ok {
+			log.Printf("Ignoring invalid tag %q from processing hook for video %s", raw, videoID)
+			continue
+		}
+		if err := cfg.db.AddVideoTag(videoID, tag); err != nil {
+			return added, err
+		}
+		added = append(added, tag)
+	}
+	return added, nil
+}
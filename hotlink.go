@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+)
+
+// hotlinkGuard refuses media requests made by pages on origins outside the
+// allowlist, so other sites can't embed a deployment's thumbnails and videos
+// and have it pay for the bandwidth. The origin comes from the Origin
+// header, or failing that the Referer. Requests with neither, like a link
+// opened directly or a player that strips them, are let through. An empty
+// allowlist turns the guard off.
+func hotlinkGuard(origins []string, next http.Handler) http.Handler {
+	if len(origins) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := requestOrigin(r); origin != "" && !slices.Contains(origins, origin) {
+			respondWithError(w, http.StatusForbidden, "Media can't be embedded on this site", nil)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestOrigin is the origin of the page a request was made from, or ""
+// when the request doesn't say.
+func requestOrigin(r *http.Request) string {
+	if origin := r.Header.Get("Origin"); origin != "" && origin != "null" {
+		return origin
+	}
+	referer, err := url.Parse(r.Header.Get("Referer"))
+	if err != nil || referer.Scheme == "" || referer.Host == "" {
+		return ""
+	}
+	return referer.Scheme + "://" + referer.Host
+}
+
+// assetURLExpiry is when asset URLs signed now expire. It moves in steps of
+// the TTL, so every response in a step hands out the same URL and browsers
+// and CDNs can cache it; a URL stays valid for between one and two TTLs.
+func (cfg *apiConfig) assetURLExpiry(now time.Time) int64 {
+	step := int64(cfg.assetURLTTL / time.Second)
+	return (now.Unix()/step + 2) * step
+}
+
+// signAsset signs a thumbnail's filename and expiry. Thumbnail filenames
+// are content hashes, so the name alone picks out the file wherever it's
+// served from.
+func (cfg *apiConfig) signAsset(name string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(cfg.jwtSecret.get()))
+	fmt.Fprintf(mac, "asset:%s:%d", name, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validAssetSignature reports whether a request for a thumbnail carries an
+// unexpired signature for it. Everything passes when signing is off.
+func (cfg *apiConfig) validAssetSignature(r *http.Request) bool {
+	if cfg.assetURLTTL == 0 {
+		return true
+	}
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	signature, err := hex.DecodeString(r.URL.Query().Get("signature"))
+	if err != nil {
+		return false
+	}
+	expected, _ := hex.DecodeString(cfg.signAsset(path.Base(r.URL.Path), expires))
+	return hmac.Equal(signature, expected)
+}
+
+// signAssetURL adds an expiring signature to a thumbnail URL this server
+// serves. URLs pointing anywhere else are returned as they are.
+func (cfg *apiConfig) signAssetURL(rawURL string, expires int64) string {
+	_, onDisk := cfg.assetPathFromURL(rawURL)
+	_, inBucket := cfg.thumbnailKeyFromURL(rawURL)
+	mode := cfg.urls.Mode()
+	if !onDisk && !(inBucket && (mode == media.DeliveryPresigned || mode == media.DeliveryProxy)) {
+		return rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	query := u.Query()
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("signature", cfg.signAsset(path.Base(u.Path), expires))
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// signVideoAssets signs the thumbnail URLs of a video about to be sent to a
+// client, when asset URL signing is on. The stored URLs stay unsigned.
+func (cfg *apiConfig) signVideoAssets(video *database.Video) {
+	if cfg.assetURLTTL == 0 {
+		return
+	}
+	expires := cfg.assetURLExpiry(time.Now())
+	// Copies of a video share its URL strings, so they're replaced rather
+	// than written through
+	for _, u := range []**string{&video.ThumbnailURL, &video.ThumbnailPosterURL} {
+		if *u != nil {
+			signed := cfg.signAssetURL(**u, expires)
+			*u = &signed
+		}
+	}
+	variants := make(map[string]string, len(video.ThumbnailVariants))
+	for name, u := range video.ThumbnailVariants {
+		variants[name] = cfg.signAssetURL(u, expires)
+	}
+	video.ThumbnailVariants = variants
+}
+
+// signVideoListAssets is signVideoAssets for a listing.
+func (cfg *apiConfig) signVideoListAssets(videos []database.VideoListItem) {
+	for i := range videos {
+		cfg.signVideoAssets(&videos[i].Video)
+	}
+}
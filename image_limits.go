@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+)
+
+// Upper bounds for uploaded images. A small compressed file can declare
+// enormous dimensions and exhaust memory once something decodes it, so these
+// are checked against the header before the pixels are ever read.
+const (
+	maxImageSide   = 8192
+	maxImagePixels = 40_000_000
+)
+
+// checkImageDimensions reads only the image header and rejects images that
+// aren't of the expected format or exceed the dimension limits. The reader
+// is rewound afterwards so the caller can still copy the whole file.
+func checkImageDimensions(r io.ReadSeeker, expectedFormat string) error {
+	config, err := checkImageHeader(r, expectedFormat)
+	if err != nil {
+		return err
+	}
+	if expectedFormat == "gif" {
+		return checkGIFLimits(r, config.Width, config.Height)
+	}
+
+	_, err = r.Seek(0, io.SeekStart)
+	return err
+}
+
+// checkImageHeader applies the format and dimension checks to the start of
+// an image, which is all it reads. It works on a stream that's still
+// arriving, so an oversized image can be refused before the rest of it is
+// received.
+func checkImageHeader(r io.Reader, expectedFormat string) (image.Config, error) {
+	config, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return config, fmt.Errorf("couldn't read image header: %w", err)
+	}
+	if format != expectedFormat {
+		return config, fmt.Errorf("file content is %s, not %s", format, expectedFormat)
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return config, fmt.Errorf("image has invalid dimensions %dx%d", config.Width, config.Height)
+	}
+	if config.Width > maxImageSide || config.Height > maxImageSide {
+		return config, fmt.Errorf("image is %dx%d, but neither side may exceed %d pixels", config.Width, config.Height, maxImageSide)
+	}
+	if int64(config.Width)*int64(config.Height) > maxImagePixels {
+		return config, fmt.Errorf("image has %d pixels, more than the limit of %d", int64(config.Width)*int64(config.Height), maxImagePixels)
+	}
+	return config, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// verifyStoredObjects re-checks a sample of stored objects against the size
+// and SHA-256 recorded when they were stored, to catch bit rot and objects
+// changed or removed behind the app's back. Each run takes the objects
+// checked longest ago, so the whole bucket is covered over time. Objects
+// without a recorded checksum, like encrypted videos, aren't checked.
+func (cfg *apiConfig) verifyStoredObjects(ctx context.Context, sampleSize int) error {
+	objects, err := cfg.db.GetObjectsToVerify(sampleSize)
+	if err != nil {
+		return fmt.Errorf("couldn't get objects to verify: %w", err)
+	}
+
+	for _, object := range objects {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		check, err := cfg.verifyStoredObject(ctx, object)
+		if err != nil {
+			// S3 being unreachable says nothing about the object
+			log.Printf("Couldn't verify %s: %v", object.S3Key, err)
+			continue
+		}
+		if check.Status == database.IntegrityMissing {
+			// Deleting a video leaves its checksum behind; that object is
+			// supposed to be gone
+			count, err := cfg.db.CountVideosWithVideoURL(cfg.videoDeliveryURL(object.S3Key))
+			if err != nil {
+				return err
+			}
+			if count == 0 {
+				if err := cfg.db.DeleteObjectChecksum(object.S3Key); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		if err := cfg.db.PutObjectIntegrityCheck(check); err != nil {
+			return err
+		}
+		cfg.metrics.add(`tubely_integrity_checks_total{result="`+check.Status+`"}`, 1)
+		if check.Status != database.IntegrityOK {
+			log.Printf("Integrity check of %s failed: %s", object.S3Key, check.Detail)
+		}
+	}
+
+	stats, err := cfg.db.GetObjectIntegrityStats()
+	if err != nil {
+		return err
+	}
+	cfg.metrics.set("tubely_integrity_problems", float64(stats.Problems))
+	return nil
+}
+
+// verifyStoredObject compares one object's size from HeadObject, then its
+// content, with what was recorded. The content is streamed through the hash
+// rather than saved.
+func (cfg *apiConfig) verifyStoredObject(ctx context.Context, object database.ObjectChecksum) (database.ObjectIntegrityCheck, error) {
+	check := database.ObjectIntegrityCheck{S3Key: object.S3Key, Status: database.IntegrityOK, CheckedAt: time.Now()}
+
+	head, err := cfg.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &object.S3Key,
+	})
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		check.Status = database.IntegrityMissing
+		check.Detail = "Object isn't in the bucket"
+		return check, nil
+	}
+	if err != nil {
+		return check, err
+	}
+	if head.ContentLength == nil || *head.ContentLength != object.Size {
+		var size int64
+		if head.ContentLength != nil {
+			size = *head.ContentLength
+		}
+		check.Status = database.IntegritySizeMismatch
+		check.Detail = fmt.Sprintf("Object has %d bytes, %d were stored", size, object.Size)
+		return check, nil
+	}
+
+	out, err := cfg.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &object.S3Key,
+	})
+	if err != nil {
+		return check, err
+	}
+	defer out.Body.Close()
+	hash := sha256.New()
+	if _, err := cfg.buffers.copy(hash, out.Body); err != nil {
+		return check, err
+	}
+	if checksum := hex.EncodeToString(hash.Sum(nil)); checksum != object.ChecksumSHA256 {
+		check.Status = database.IntegrityChecksumMismatch
+		check.Detail = fmt.Sprintf("Object's SHA-256 is %s, %s was stored", checksum, object.ChecksumSHA256)
+	}
+	return check, nil
+}
+
+// handlerIntegrityRetrieve reports how much of the bucket has been
+// re-verified and every object that failed its latest check.
+func (cfg *apiConfig) handlerIntegrityRetrieve(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		database.ObjectIntegrityStats
+		Failures []database.ObjectIntegrityCheck `json:"failures"`
+	}
+
+	if _, ok := cfg.authenticateAdmin(w, r); !ok {
+		return
+	}
+
+	stats, err := cfg.db.GetObjectIntegrityStats()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get integrity stats", err)
+		return
+	}
+	failures, err := cfg.db.GetObjectIntegrityProblems()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get integrity failures", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, response{ObjectIntegrityStats: stats, Failures: failures})
+}
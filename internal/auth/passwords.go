@@ -0,0 +1,221 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrPasswordMismatch is returned when a password doesn't match its hash.
+	ErrPasswordMismatch = errors.New("password doesn't match")
+	// ErrWrongPepper is returned for hashes made with a pepper other than
+	// the hasher's.
+	ErrWrongPepper = errors.New("password hash was made with a different pepper")
+)
+
+// Argon2Params are the cost settings of Argon2id password hashes. Memory
+// is in KiB.
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2Params follow the OWASP recommendation of 64 MiB, 3
+// iterations and 2 lanes; use Tune to fit them to the server.
+var DefaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// PasswordHasher hashes new passwords with Argon2id and checks passwords
+// against Argon2id hashes and the bcrypt hashes made before it.
+//
+// With a pepper, passwords are HMACed with it before hashing, so the hashes
+// are no use to anyone who has the database but not the pepper. Hashes
+// record a short ID of the pepper they were made with, in the PHC string's
+// keyid parameter. Hashes made with one of the PreviousPeppers still match,
+// so the pepper can be rotated without locking anyone out, and are made
+// again with the current pepper.
+type PasswordHasher struct {
+	Params          Argon2Params
+	Pepper          []byte
+	PreviousPeppers [][]byte
+}
+
+// Hash returns the PHC string of a new Argon2id hash of password.
+func (h PasswordHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.Params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	p := h.Params
+	key := argon2.IDKey(h.pepper(password, h.Pepper), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+
+	settings := fmt.Sprintf("m=%d,t=%d,p=%d", p.Memory, p.Iterations, p.Parallelism)
+	if len(h.Pepper) > 0 {
+		settings += ",keyid=" + pepperID(h.Pepper)
+	}
+	return fmt.Sprintf("$argon2id$v=%d$%s$%s$%s",
+		argon2.Version,
+		settings,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Check compares password with a stored hash. When they match, it also
+// reports whether the hash should be replaced with a new one from Hash:
+// because it's bcrypt, has other cost settings, or lacks the current pepper.
+func (h PasswordHasher) Check(password, hash string) (rehash bool, err error) {
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+			return false, ErrPasswordMismatch
+		}
+		return true, nil
+	}
+
+	stored, err := parseArgon2Hash(hash)
+	if err != nil {
+		return false, err
+	}
+	var pepper []byte
+	if stored.keyID != "" {
+		pepper = h.pepperByID(stored.keyID)
+		if pepper == nil {
+			return false, ErrWrongPepper
+		}
+	}
+	p := stored.params
+	key := argon2.IDKey(h.pepper(password, pepper), stored.salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	if subtle.ConstantTimeCompare(key, stored.key) != 1 {
+		return false, ErrPasswordMismatch
+	}
+	rehash = p.Memory != h.Params.Memory ||
+		p.Iterations != h.Params.Iterations ||
+		p.Parallelism != h.Params.Parallelism ||
+		!bytes.Equal(pepper, h.Pepper)
+	return rehash, nil
+}
+
+// pepperByID returns the current or previous pepper with the given ID, or
+// nil if there's none.
+func (h PasswordHasher) pepperByID(id string) []byte {
+	for _, pepper := range append([][]byte{h.Pepper}, h.PreviousPeppers...) {
+		if len(pepper) > 0 && pepperID(pepper) == id {
+			return pepper
+		}
+	}
+	return nil
+}
+
+// Tune raises Iterations until hashing a password takes at least target,
+// and returns how long the last hash took. Memory and parallelism are left
+// as configured, since they're bounded by the machine rather than by time.
+func (h *PasswordHasher) Tune(target time.Duration) (time.Duration, error) {
+	for {
+		start := time.Now()
+		if _, err := h.Hash("benchmark password"); err != nil {
+			return 0, err
+		}
+		took := time.Since(start)
+		if took >= target || h.Params.Iterations >= 100 {
+			return took, nil
+		}
+		h.Params.Iterations++
+	}
+}
+
+func (h PasswordHasher) pepper(password string, pepper []byte) []byte {
+	if len(pepper) == 0 {
+		return []byte(password)
+	}
+	mac := hmac.New(sha256.New, pepper)
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+// pepperID names a pepper in hashes without giving it away.
+func pepperID(pepper []byte) string {
+	sum := sha256.Sum256(pepper)
+	return hex.EncodeToString(sum[:4])
+}
+
+type argon2Hash struct {
+	params Argon2Params
+	keyID  string
+	salt   []byte
+	key    []byte
+}
+
+// parseArgon2Hash reads a PHC string like
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>.
+func parseArgon2Hash(hash string) (argon2Hash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return argon2Hash{}, errors.New("malformed argon2id hash")
+	}
+	if parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return argon2Hash{}, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+
+	var stored argon2Hash
+	for _, setting := range strings.Split(parts[3], ",") {
+		name, value, _ := strings.Cut(setting, "=")
+		var n uint64
+		var err error
+		switch name {
+		case "m", "t", "p":
+			_, err = fmt.Sscan(value, &n)
+		case "keyid":
+			stored.keyID = value
+			continue
+		default:
+			continue
+		}
+		if err != nil {
+			return argon2Hash{}, fmt.Errorf("malformed argon2id setting %q", setting)
+		}
+		switch name {
+		case "m":
+			stored.params.Memory = uint32(n)
+		case "t":
+			stored.params.Iterations = uint32(n)
+		case "p":
+			stored.params.Parallelism = uint8(n)
+		}
+	}
+
+	var err error
+	stored.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return argon2Hash{}, fmt.Errorf("malformed argon2id salt: %w", err)
+	}
+	stored.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return argon2Hash{}, fmt.Errorf("malformed argon2id key: %w", err)
+	}
+	stored.params.SaltLength = uint32(len(stored.salt))
+	stored.params.KeyLength = uint32(len(stored.key))
+	if stored.params.Memory == 0 || stored.params.Iterations == 0 || stored.params.Parallelism == 0 || len(stored.key) == 0 {
+		return argon2Hash{}, errors.New("malformed argon2id hash")
+	}
+	return stored, nil
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// UploadReceipt is what a signed upload receipt attests: that a video's
+// file was stored as a particular object with particular content.
+type UploadReceipt struct {
+	VideoID        uuid.UUID `json:"video_id"`
+	UserID         uuid.UUID `json:"user_id"`
+	Bucket         string    `json:"bucket"`
+	Key            string    `json:"key"`
+	VersionID      string    `json:"version_id,omitempty"`
+	ChecksumSHA256 string    `json:"checksum_sha256"`
+	Size           int64     `json:"size"`
+	jwt.RegisteredClaims
+}
+
+// ReceiptKeyID names a receipt signing key by its public half, so
+// verifiers can pick the right one once keys have been rotated.
+func ReceiptKeyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// MakeUploadReceipt signs a receipt as a compact JWS with EdDSA. Receipts
+// don't expire: they're evidence of what was stored at the time.
+func MakeUploadReceipt(receipt UploadReceipt, issuer string, key ed25519.PrivateKey) (string, error) {
+	receipt.RegisteredClaims = jwt.RegisteredClaims{
+		Issuer:   issuer,
+		Subject:  receipt.VideoID.String(),
+		IssuedAt: jwt.NewNumericDate(time.Now().UTC()),
+		ID:       uuid.NewString(),
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, receipt)
+	token.Header["kid"] = ReceiptKeyID(key.Public().(ed25519.PublicKey))
+	return token.SignedString(key)
+}
+
+// ParseUploadReceipt checks a receipt's signature against the public keys
+// it may have been signed with and returns what it attests.
+func ParseUploadReceipt(receipt string, keys []ed25519.PublicKey) (UploadReceipt, error) {
+	var claims UploadReceipt
+	_, err := jwt.ParseWithClaims(receipt, &claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		for _, key := range keys {
+			if ReceiptKeyID(key) == kid {
+				return key, nil
+			}
+		}
+		return nil, errors.New("receipt was signed with an unknown key")
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}))
+	if err != nil {
+		return UploadReceipt{}, err
+	}
+	return claims, nil
+}
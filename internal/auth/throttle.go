@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrLockedOut is returned for sign-ins refused because of earlier failures.
+var ErrLockedOut = errors.New("too many failed sign-in attempts")
+
+// LoginThrottle is the policy for slowing down password guessing. Each
+// account and each address gets FreeAttempts failures; after that every
+// failure locks it out, for BaseLockout at first and twice as long each
+// time after, up to MaxLockout. Failures are forgotten once Window passes
+// without one.
+type LoginThrottle struct {
+	FreeAttempts int
+	BaseLockout  time.Duration
+	MaxLockout   time.Duration
+	Window       time.Duration
+	// CaptchaAfter is how many failures make a sign-in need a CAPTCHA,
+	// when one is configured. Zero never asks for one.
+	CaptchaAfter int
+}
+
+// DefaultLoginThrottle allows 5 failures, then locks out for 1 minute,
+// then 2, 4 and so on up to an hour.
+var DefaultLoginThrottle = LoginThrottle{
+	FreeAttempts: 5,
+	BaseLockout:  time.Minute,
+	MaxLockout:   time.Hour,
+	Window:       24 * time.Hour,
+	CaptchaAfter: 3,
+}
+
+// Lockout is how long to lock out after the given number of failures in a
+// row; zero while they're within the free attempts.
+func (t LoginThrottle) Lockout(failures int) time.Duration {
+	over := failures - t.FreeAttempts
+	if over <= 0 {
+		return 0
+	}
+	lockout := t.BaseLockout
+	for i := 1; i < over && lockout < t.MaxLockout; i++ {
+		lockout *= 2
+	}
+	return min(lockout, t.MaxLockout)
+}
+
+// NeedsCaptcha reports whether a sign-in after the given number of failures
+// must come with a solved CAPTCHA.
+func (t LoginThrottle) NeedsCaptcha(failures int) bool {
+	return t.CaptchaAfter > 0 && failures >= t.CaptchaAfter
+}
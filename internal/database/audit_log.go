@@ -0,0 +1,62 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type AuditEntry struct {
+	ID        uuid.UUID  `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	ActorID   *uuid.UUID `json:"actor_id"`
+	Action    string     `json:"action"`
+	VideoID   *uuid.UUID `json:"video_id"`
+	Details   string     `json:"details"`
+}
+
+func (c Client) CreateAuditEntry(entry AuditEntry) error {
+	query := `
+	INSERT INTO audit_log (
+		id,
+		created_at,
+		actor_id,
+		action,
+		video_id,
+		details
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, uuid.New(), entry.ActorID, entry.Action, entry.VideoID, entry.Details)
+	return err
+}
+
+func (c Client) GetAuditEntriesForVideo(videoID uuid.UUID) ([]AuditEntry, error) {
+	query := `
+	SELECT id, created_at, actor_id, action, video_id, details
+	FROM audit_log
+	WHERE video_id = ?
+	ORDER BY created_at ASC
+	`
+	rows, err := c.db.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		if err := rows.Scan(
+			&entry.ID,
+			&entry.CreatedAt,
+			&entry.ActorID,
+			&entry.Action,
+			&entry.VideoID,
+			&entry.Details,
+		); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
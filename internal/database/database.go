@@ -8,19 +8,31 @@ import (
 )
 
 type Client struct {
-	db *sql.DB
+	db handle
 }
 
-func NewClient(pathToDB string) (Client, error) {
-	db, err := sql.Open("sqlite3", pathToDB)
+// NewClient opens the database at pathToDB, and the read replicas in
+// replicas if there are any.
+func NewClient(pathToDB string, replicas ReplicaConfig) (Client, error) {
+	reader, writer, err := openPrimary(pathToDB)
 	if err != nil {
 		return Client{}, err
 	}
-	c := Client{db}
+	p := &pool{primary: reader, writer: writer, maxLag: replicas.MaxLag}
+	c := Client{db: handle{pool: p}}
 	err = c.autoMigrate()
 	if err != nil {
 		return Client{}, err
 	}
+	// Replicas are only read from once they've seen a heartbeat, so the
+	// primary's schema is in place before any are opened
+	p.replicas, err = openReplicas(replicas)
+	if err != nil {
+		return Client{}, err
+	}
+	if len(p.replicas) > 0 {
+		go p.watch()
+	}
 	return c, nil
 
 }
@@ -72,6 +84,733 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+
+	videoColumns := []struct {
+		name       string
+		definition string
+	}{
+		{"trim_start_seconds", "REAL"},
+		{"trim_end_seconds", "REAL"},
+		{"watermarked", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"parent_video_id", "TEXT REFERENCES videos(id)"},
+		{"encrypted", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"legal_hold", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"validation_error", "TEXT"},
+		{"visibility", "TEXT NOT NULL DEFAULT 'private'"},
+		{"org_id", "TEXT REFERENCES organizations(id)"},
+		{"thumbnail_poster_url", "TEXT"},
+		{"duration_seconds", "REAL"},
+		{"metadata", "TEXT NOT NULL DEFAULT '{}'"},
+		{"poster_time_seconds", "REAL"},
+		{"audio_description_key", "TEXT"},
+		{"geo_allow", "TEXT NOT NULL DEFAULT ''"},
+		{"geo_deny", "TEXT NOT NULL DEFAULT ''"},
+		{"original_filename", "TEXT"},
+		{"audio_languages", "TEXT NOT NULL DEFAULT ''"},
+		{"language", "TEXT"},
+		{"flagged", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	}
+	for _, col := range videoColumns {
+		err = c.addColumnIfNotExists("videos", col.name, col.definition)
+		if err != nil {
+			return err
+		}
+	}
+	// The video listing counts clips per video
+	_, err = c.db.Exec("CREATE INDEX IF NOT EXISTS idx_videos_parent_video_id ON videos(parent_video_id)")
+	if err != nil {
+		return err
+	}
+	// Media requests find the video they're for by its URL
+	_, err = c.db.Exec("CREATE INDEX IF NOT EXISTS idx_videos_video_url ON videos(video_url)")
+	if err != nil {
+		return err
+	}
+
+	organizationTable := `
+	CREATE TABLE IF NOT EXISTS organizations (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		name TEXT NOT NULL
+	);
+	`
+	_, err = c.db.Exec(organizationTable)
+	if err != nil {
+		return err
+	}
+
+	organizationMemberTable := `
+	CREATE TABLE IF NOT EXISTS organization_members (
+		org_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		role TEXT NOT NULL,
+		PRIMARY KEY(org_id, user_id),
+		FOREIGN KEY(org_id) REFERENCES organizations(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(organizationMemberTable)
+	if err != nil {
+		return err
+	}
+
+	videoTransferTable := `
+	CREATE TABLE IF NOT EXISTS video_transfers (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		resolved_at TIMESTAMP,
+		video_id TEXT NOT NULL,
+		from_user_id TEXT NOT NULL,
+		to_user_id TEXT,
+		to_org_id TEXT,
+		status TEXT NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(videoTransferTable)
+	if err != nil {
+		return err
+	}
+
+	downloadLinkTable := `
+	CREATE TABLE IF NOT EXISTS download_links (
+		id TEXT PRIMARY KEY,
+		token_hash TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL,
+		video_id TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		max_uses INTEGER NOT NULL,
+		uses INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(downloadLinkTable)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec("CREATE INDEX IF NOT EXISTS idx_download_links_video_id ON download_links(video_id)")
+	if err != nil {
+		return err
+	}
+
+	uploadSessionTable := `
+	CREATE TABLE IF NOT EXISTS upload_sessions (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL,
+		user_id TEXT NOT NULL,
+		video_id TEXT NOT NULL,
+		filename TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		content_type TEXT NOT NULL,
+		checksum_sha256 TEXT NOT NULL,
+		target TEXT NOT NULL,
+		status TEXT NOT NULL,
+		error TEXT,
+		trim_dead_air BOOLEAN NOT NULL DEFAULT FALSE,
+		intro_video_id TEXT NOT NULL DEFAULT '',
+		outro_video_id TEXT NOT NULL DEFAULT '',
+		watermark BOOLEAN NOT NULL DEFAULT FALSE,
+		encrypt BOOLEAN NOT NULL DEFAULT FALSE,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(uploadSessionTable)
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("upload_sessions", "part_size", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("upload_sessions", "timings", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("upload_sessions", "bytes_received", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec("CREATE INDEX IF NOT EXISTS idx_upload_sessions_video_id ON upload_sessions(video_id, created_at)")
+	if err != nil {
+		return err
+	}
+
+	uploadSessionPartTable := `
+	CREATE TABLE IF NOT EXISTS upload_session_parts (
+		session_id TEXT NOT NULL,
+		part_number INTEGER NOT NULL,
+		size INTEGER NOT NULL,
+		checksum_sha256 TEXT NOT NULL,
+		received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(session_id, part_number),
+		FOREIGN KEY(session_id) REFERENCES upload_sessions(id)
+	);
+	`
+	_, err = c.db.Exec(uploadSessionPartTable)
+	if err != nil {
+		return err
+	}
+
+	videoTagTable := `
+	CREATE TABLE IF NOT EXISTS video_tags (
+		video_id TEXT NOT NULL,
+		tag TEXT NOT NULL,
+		PRIMARY KEY(video_id, tag),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(videoTagTable)
+	if err != nil {
+		return err
+	}
+
+	videoKeyTable := `
+	CREATE TABLE IF NOT EXISTS video_keys (
+		video_id TEXT PRIMARY KEY,
+		s3_key TEXT NOT NULL,
+		wrapped_key BLOB NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(videoKeyTable)
+	if err != nil {
+		return err
+	}
+
+	deletionReportTable := `
+	CREATE TABLE IF NOT EXISTS deletion_reports (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		completed_at TIMESTAMP,
+		user_id TEXT NOT NULL,
+		status TEXT NOT NULL,
+		videos_deleted INTEGER NOT NULL DEFAULT 0,
+		sessions_revoked INTEGER NOT NULL DEFAULT 0,
+		thumbnails_deleted INTEGER NOT NULL DEFAULT 0,
+		objects_deleted INTEGER NOT NULL DEFAULT 0,
+		failures TEXT NOT NULL DEFAULT '[]'
+	);
+	`
+	_, err = c.db.Exec(deletionReportTable)
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("deletion_reports", "videos_held", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	auditLogTable := `
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		actor_id TEXT,
+		action TEXT NOT NULL,
+		video_id TEXT,
+		details TEXT NOT NULL DEFAULT ''
+	);
+	`
+	_, err = c.db.Exec(auditLogTable)
+	if err != nil {
+		return err
+	}
+
+	// Events outlive their video, so there's no foreign key; owner_id
+	// lets the owner read a deleted video's history
+	videoEventTable := `
+	CREATE TABLE IF NOT EXISTS video_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		owner_id TEXT NOT NULL,
+		actor_id TEXT,
+		type TEXT NOT NULL,
+		payload TEXT NOT NULL DEFAULT '{}',
+		delivered_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_video_events_video_id ON video_events(video_id, id);
+	CREATE INDEX IF NOT EXISTS idx_video_events_undelivered ON video_events(id) WHERE delivered_at IS NULL;
+	`
+	_, err = c.db.Exec(videoEventTable)
+	if err != nil {
+		return err
+	}
+
+	jobTable := `
+	CREATE TABLE IF NOT EXISTS jobs (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP NOT NULL,
+		kind TEXT NOT NULL,
+		subject_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		priority INTEGER NOT NULL DEFAULT 0,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		error TEXT,
+		worker TEXT,
+		lease_expires_at TIMESTAMP,
+		run_after TIMESTAMP NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_jobs_status ON jobs(status, run_after);
+	`
+	_, err = c.db.Exec(jobTable)
+	if err != nil {
+		return err
+	}
+
+	thumbnailVariantTable := `
+	CREATE TABLE IF NOT EXISTS thumbnail_variants (
+		source_url TEXT NOT NULL,
+		variant TEXT NOT NULL,
+		url TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		PRIMARY KEY(source_url, variant)
+	);
+	`
+	_, err = c.db.Exec(thumbnailVariantTable)
+	if err != nil {
+		return err
+	}
+
+	videoUploadLockTable := `
+	CREATE TABLE IF NOT EXISTS video_upload_locks (
+		video_id TEXT PRIMARY KEY,
+		holder TEXT NOT NULL,
+		session_id TEXT,
+		acquired_at TIMESTAMP NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	);
+	`
+	_, err = c.db.Exec(videoUploadLockTable)
+	if err != nil {
+		return err
+	}
+
+	s3MultipartUploadTable := `
+	CREATE TABLE IF NOT EXISTS s3_multipart_uploads (
+		upload_id TEXT PRIMARY KEY,
+		key TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		part_size INTEGER NOT NULL,
+		sse_customer_key_md5 TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL
+	);
+	`
+	_, err = c.db.Exec(s3MultipartUploadTable)
+	if err != nil {
+		return err
+	}
+
+	s3MultipartPartTable := `
+	CREATE TABLE IF NOT EXISTS s3_multipart_parts (
+		upload_id TEXT NOT NULL,
+		part_number INTEGER NOT NULL,
+		etag TEXT NOT NULL,
+		checksum_crc32 TEXT NOT NULL,
+		PRIMARY KEY(upload_id, part_number),
+		FOREIGN KEY(upload_id) REFERENCES s3_multipart_uploads(upload_id)
+	);
+	`
+	_, err = c.db.Exec(s3MultipartPartTable)
+	if err != nil {
+		return err
+	}
+
+	taskLeaseTable := `
+	CREATE TABLE IF NOT EXISTS task_leases (
+		name TEXT PRIMARY KEY,
+		holder TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	);
+	`
+	_, err = c.db.Exec(taskLeaseTable)
+	if err != nil {
+		return err
+	}
+
+	inputFailureTable := `
+	CREATE TABLE IF NOT EXISTS input_failures (
+		checksum_sha256 TEXT PRIMARY KEY,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		failures INTEGER NOT NULL,
+		last_error TEXT NOT NULL,
+		quarantine_prefix TEXT,
+		quarantined_at TIMESTAMP
+	);
+	`
+	_, err = c.db.Exec(inputFailureTable)
+	if err != nil {
+		return err
+	}
+
+	objectChecksumTable := `
+	CREATE TABLE IF NOT EXISTS object_checksums (
+		s3_key TEXT PRIMARY KEY,
+		checksum_sha256 TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_object_checksums_checksum ON object_checksums(checksum_sha256);
+	`
+	_, err = c.db.Exec(objectChecksumTable)
+	if err != nil {
+		return err
+	}
+
+	objectIntegrityTable := `
+	CREATE TABLE IF NOT EXISTS object_integrity_checks (
+		s3_key TEXT PRIMARY KEY,
+		status TEXT NOT NULL,
+		detail TEXT NOT NULL DEFAULT '',
+		checked_at TIMESTAMP NOT NULL
+	);
+	`
+	_, err = c.db.Exec(objectIntegrityTable)
+	if err != nil {
+		return err
+	}
+
+	settingTable := `
+	CREATE TABLE IF NOT EXISTS settings (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+	_, err = c.db.Exec(settingTable)
+	if err != nil {
+		return err
+	}
+
+	// Objects brought in by a bucket import, so running it again skips
+	// them; there's no foreign key, so deleting the video doesn't bring
+	// the object back on the next run
+	videoImportTable := `
+	CREATE TABLE IF NOT EXISTS video_imports (
+		bucket TEXT NOT NULL,
+		s3_key TEXT NOT NULL,
+		etag TEXT NOT NULL,
+		video_id TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (bucket, s3_key)
+	);
+	`
+	_, err = c.db.Exec(videoImportTable)
+	if err != nil {
+		return err
+	}
+
+	// Failed sign-ins are counted per account and per address, so nodes
+	// share lockouts
+	loginAttemptTable := `
+	CREATE TABLE IF NOT EXISTS login_attempts (
+		subject TEXT PRIMARY KEY,
+		failures INTEGER NOT NULL,
+		last_failure_at TIMESTAMP NOT NULL,
+		locked_until TIMESTAMP NOT NULL
+	);
+	`
+	_, err = c.db.Exec(loginAttemptTable)
+	if err != nil {
+		return err
+	}
+
+	signingKeyTable := `
+	CREATE TABLE IF NOT EXISTS signing_keys (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		last_used_at TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(signingKeyTable)
+	if err != nil {
+		return err
+	}
+
+	// Signatures of accepted requests are kept for as long as they'd be
+	// accepted, so a captured request can't be sent again
+	requestSignatureTable := `
+	CREATE TABLE IF NOT EXISTS request_signatures (
+		signature TEXT PRIMARY KEY,
+		expires_at TIMESTAMP NOT NULL
+	);
+	`
+	_, err = c.db.Exec(requestSignatureTable)
+	if err != nil {
+		return err
+	}
+
+	uploadReceiptTable := `
+	CREATE TABLE IF NOT EXISTS upload_receipts (
+		id TEXT PRIMARY KEY,
+		video_id TEXT NOT NULL,
+		receipt TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(uploadReceiptTable)
+	if err != nil {
+		return err
+	}
+
+	videoObjectTable := `
+	CREATE TABLE IF NOT EXISTS video_objects (
+		id TEXT PRIMARY KEY,
+		video_id TEXT NOT NULL,
+		s3_key TEXT NOT NULL,
+		version_id TEXT NOT NULL DEFAULT '',
+		size INTEGER NOT NULL,
+		checksum_sha256 TEXT NOT NULL,
+		duration_seconds REAL NOT NULL,
+		encrypted BOOLEAN NOT NULL DEFAULT FALSE,
+		wrapped_key BLOB,
+		created_at TIMESTAMP NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(videoObjectTable)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec("CREATE INDEX IF NOT EXISTS idx_video_objects_video_id ON video_objects(video_id)")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("video_objects", "audio_languages", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+
+	videoPackageTable := `
+	CREATE TABLE IF NOT EXISTS video_packages (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		title TEXT NOT NULL,
+		video_ids TEXT NOT NULL,
+		status TEXT NOT NULL,
+		s3_key TEXT,
+		size INTEGER,
+		error TEXT,
+		created_at TIMESTAMP NOT NULL,
+		completed_at TIMESTAMP,
+		expires_at TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(videoPackageTable)
+	if err != nil {
+		return err
+	}
+
+	// Read replicas report how far they've caught up by the newest of
+	// these stamps they've received
+	replicationHeartbeatTable := `
+	CREATE TABLE IF NOT EXISTS replication_heartbeat (
+		id INTEGER PRIMARY KEY,
+		written_at INTEGER NOT NULL
+	);
+	`
+	_, err = c.db.Exec(replicationHeartbeatTable)
+	if err != nil {
+		return err
+	}
+
+	// Views are counted per video per hour, so a popular video adds a row
+	// an hour rather than one per play
+	videoViewsTable := `
+	CREATE TABLE IF NOT EXISTS video_views (
+		video_id TEXT NOT NULL,
+		hour TIMESTAMP NOT NULL,
+		views INTEGER NOT NULL,
+		PRIMARY KEY(video_id, hour),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(videoViewsTable)
+	if err != nil {
+		return err
+	}
+
+	videoLikesTable := `
+	CREATE TABLE IF NOT EXISTS video_likes (
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		PRIMARY KEY(video_id, user_id),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(videoLikesTable)
+	if err != nil {
+		return err
+	}
+
+	trendingVideosTable := `
+	CREATE TABLE IF NOT EXISTS trending_videos (
+		video_id TEXT PRIMARY KEY,
+		score REAL NOT NULL,
+		computed_at TIMESTAMP NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(trendingVideosTable)
+	if err != nil {
+		return err
+	}
+
+	videoReportsTable := `
+	CREATE TABLE IF NOT EXISTS video_reports (
+		id TEXT PRIMARY KEY,
+		video_id TEXT NOT NULL,
+		reporter_id TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		details TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL,
+		resolved_at TIMESTAMP,
+		resolution TEXT,
+		resolved_by TEXT,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(videoReportsTable)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec("CREATE INDEX IF NOT EXISTS idx_video_reports_video_id ON video_reports(video_id, resolved_at)")
+	if err != nil {
+		return err
+	}
+
+	userSettingsTable := `
+	CREATE TABLE IF NOT EXISTS user_settings (
+		user_id TEXT PRIMARY KEY,
+		default_visibility TEXT NOT NULL,
+		trim_dead_air BOOLEAN NOT NULL DEFAULT FALSE,
+		watermark BOOLEAN NOT NULL DEFAULT FALSE,
+		encrypt BOOLEAN NOT NULL DEFAULT FALSE,
+		updated_at TIMESTAMP NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(userSettingsTable)
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("user_settings", "watch_history", "BOOLEAN NOT NULL DEFAULT FALSE")
+	if err != nil {
+		return err
+	}
+
+	watchHistoryTable := `
+	CREATE TABLE IF NOT EXISTS watch_history (
+		user_id TEXT NOT NULL,
+		video_id TEXT NOT NULL,
+		position_seconds REAL NOT NULL,
+		watched_at TIMESTAMP NOT NULL,
+		PRIMARY KEY(user_id, video_id),
+		FOREIGN KEY(user_id) REFERENCES users(id),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(watchHistoryTable)
+	if err != nil {
+		return err
+	}
+
+	watchLaterTable := `
+	CREATE TABLE IF NOT EXISTS watch_later (
+		user_id TEXT NOT NULL,
+		video_id TEXT NOT NULL,
+		added_at TIMESTAMP NOT NULL,
+		PRIMARY KEY(user_id, video_id),
+		FOREIGN KEY(user_id) REFERENCES users(id),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(watchLaterTable)
+	if err != nil {
+		return err
+	}
+
+	watermarkSettingsTable := `
+	CREATE TABLE IF NOT EXISTS watermark_settings (
+		user_id TEXT PRIMARY KEY,
+		position TEXT NOT NULL,
+		opacity REAL NOT NULL,
+		scale REAL NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(watermarkSettingsTable)
+	if err != nil {
+		return err
+	}
+
+	userColumns := []struct {
+		name       string
+		definition string
+	}{
+		{"intro_video_id", "TEXT"},
+		{"outro_video_id", "TEXT"},
+		{"is_admin", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"stream_key", "TEXT"},
+		{"tier", "TEXT NOT NULL DEFAULT 'standard'"},
+		{"disabled", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	}
+	for _, col := range userColumns {
+		err = c.addColumnIfNotExists("users", col.name, col.definition)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumnIfNotExists adds a column to an existing table, so databases
+// created before the column was introduced are migrated in place.
+func (c *Client) addColumnIfNotExists(table, column, definition string) error {
+	rows, err := c.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    int
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = c.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
 	return nil
 }
 
@@ -82,8 +821,113 @@ func (c Client) Reset() error {
 	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
 		return fmt.Errorf("failed to reset table users: %w", err)
 	}
+	if _, err := c.db.Exec("DELETE FROM audit_log"); err != nil {
+		return fmt.Errorf("failed to reset table audit_log: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_events"); err != nil {
+		return fmt.Errorf("failed to reset table video_events: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_imports"); err != nil {
+		return fmt.Errorf("failed to reset table video_imports: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM login_attempts"); err != nil {
+		return fmt.Errorf("failed to reset table login_attempts: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_views"); err != nil {
+		return fmt.Errorf("failed to reset table video_views: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_likes"); err != nil {
+		return fmt.Errorf("failed to reset table video_likes: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM trending_videos"); err != nil {
+		return fmt.Errorf("failed to reset table trending_videos: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_reports"); err != nil {
+		return fmt.Errorf("failed to reset table video_reports: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM user_settings"); err != nil {
+		return fmt.Errorf("failed to reset table user_settings: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM watch_history"); err != nil {
+		return fmt.Errorf("failed to reset table watch_history: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM watch_later"); err != nil {
+		return fmt.Errorf("failed to reset table watch_later: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM watermark_settings"); err != nil {
+		return fmt.Errorf("failed to reset table watermark_settings: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM signing_keys"); err != nil {
+		return fmt.Errorf("failed to reset table signing_keys: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM request_signatures"); err != nil {
+		return fmt.Errorf("failed to reset table request_signatures: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM upload_receipts"); err != nil {
+		return fmt.Errorf("failed to reset table upload_receipts: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_objects"); err != nil {
+		return fmt.Errorf("failed to reset table video_objects: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_packages"); err != nil {
+		return fmt.Errorf("failed to reset table video_packages: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM deletion_reports"); err != nil {
+		return fmt.Errorf("failed to reset table deletion_reports: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM organization_members"); err != nil {
+		return fmt.Errorf("failed to reset table organization_members: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_transfers"); err != nil {
+		return fmt.Errorf("failed to reset table video_transfers: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM download_links"); err != nil {
+		return fmt.Errorf("failed to reset table download_links: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM upload_session_parts"); err != nil {
+		return fmt.Errorf("failed to reset table upload_session_parts: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM upload_sessions"); err != nil {
+		return fmt.Errorf("failed to reset table upload_sessions: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM task_leases"); err != nil {
+		return fmt.Errorf("failed to reset table task_leases: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM thumbnail_variants"); err != nil {
+		return fmt.Errorf("failed to reset table thumbnail_variants: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_upload_locks"); err != nil {
+		return fmt.Errorf("failed to reset table video_upload_locks: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM s3_multipart_parts"); err != nil {
+		return fmt.Errorf("failed to reset table s3_multipart_parts: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM s3_multipart_uploads"); err != nil {
+		return fmt.Errorf("failed to reset table s3_multipart_uploads: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM jobs"); err != nil {
+		return fmt.Errorf("failed to reset table jobs: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM input_failures"); err != nil {
+		return fmt.Errorf("failed to reset table input_failures: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM object_checksums"); err != nil {
+		return fmt.Errorf("failed to reset table object_checksums: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM object_integrity_checks"); err != nil {
+		return fmt.Errorf("failed to reset table object_integrity_checks: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_tags"); err != nil {
+		return fmt.Errorf("failed to reset table video_tags: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_keys"); err != nil {
+		return fmt.Errorf("failed to reset table video_keys: %w", err)
+	}
 	if _, err := c.db.Exec("DELETE FROM videos"); err != nil {
 		return fmt.Errorf("failed to reset table videos: %w", err)
 	}
+	if _, err := c.db.Exec("DELETE FROM organizations"); err != nil {
+		return fmt.Errorf("failed to reset table organizations: %w", err)
+	}
 	return nil
 }
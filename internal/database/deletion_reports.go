@@ -0,0 +1,198 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DeletionStatusInProgress = "in_progress"
+	DeletionStatusCompleted  = "completed"
+	DeletionStatusFailed     = "completed_with_errors"
+	// DeletionStatusNeedsReview means some videos were kept because they are
+	// under legal hold and someone has to decide what happens to them.
+	DeletionStatusNeedsReview = "needs_review"
+)
+
+// DeletionReport records what an account deletion removed. It outlives the
+// user it describes, so it holds no personal data beyond the user ID.
+type DeletionReport struct {
+	ID                uuid.UUID  `json:"id"`
+	CreatedAt         time.Time  `json:"created_at"`
+	CompletedAt       *time.Time `json:"completed_at"`
+	UserID            uuid.UUID  `json:"user_id"`
+	Status            string     `json:"status"`
+	VideosDeleted     int        `json:"videos_deleted"`
+	VideosHeld        int        `json:"videos_held"`
+	SessionsRevoked   int        `json:"sessions_revoked"`
+	ThumbnailsDeleted int        `json:"thumbnails_deleted"`
+	ObjectsDeleted    int        `json:"objects_deleted"`
+	Failures          []string   `json:"failures"`
+}
+
+func (c Client) CreateDeletionReport(report DeletionReport) (DeletionReport, error) {
+	id := uuid.New()
+	failures, err := json.Marshal(report.Failures)
+	if err != nil {
+		return DeletionReport{}, err
+	}
+	query := `
+	INSERT INTO deletion_reports (
+		id,
+		created_at,
+		user_id,
+		status,
+		videos_deleted,
+		videos_held,
+		sessions_revoked,
+		thumbnails_deleted,
+		objects_deleted,
+		failures
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err = c.db.Exec(
+		query,
+		id,
+		report.UserID,
+		report.Status,
+		report.VideosDeleted,
+		report.VideosHeld,
+		report.SessionsRevoked,
+		report.ThumbnailsDeleted,
+		report.ObjectsDeleted,
+		string(failures),
+	)
+	if err != nil {
+		return DeletionReport{}, err
+	}
+	return c.GetDeletionReport(id)
+}
+
+// deletionReportColumns is the column list scanDeletionReport expects.
+const deletionReportColumns = `
+		id,
+		created_at,
+		completed_at,
+		user_id,
+		status,
+		videos_deleted,
+		videos_held,
+		sessions_revoked,
+		thumbnails_deleted,
+		objects_deleted,
+		failures`
+
+func scanDeletionReport(row rowScanner) (DeletionReport, error) {
+	var report DeletionReport
+	var failures string
+	err := row.Scan(
+		&report.ID,
+		&report.CreatedAt,
+		&report.CompletedAt,
+		&report.UserID,
+		&report.Status,
+		&report.VideosDeleted,
+		&report.VideosHeld,
+		&report.SessionsRevoked,
+		&report.ThumbnailsDeleted,
+		&report.ObjectsDeleted,
+		&failures,
+	)
+	if err != nil {
+		return DeletionReport{}, err
+	}
+	if err := json.Unmarshal([]byte(failures), &report.Failures); err != nil {
+		return DeletionReport{}, err
+	}
+	return report, nil
+}
+
+func (c Client) GetDeletionReport(id uuid.UUID) (DeletionReport, error) {
+	query := `
+	SELECT` + deletionReportColumns + `
+	FROM deletion_reports
+	WHERE id = ?
+	`
+	report, err := scanDeletionReport(c.db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return DeletionReport{}, nil
+	}
+	return report, err
+}
+
+// GetDeletionReportsNeedingReview returns the account deletions that kept
+// videos under legal hold, oldest first.
+func (c Client) GetDeletionReportsNeedingReview() ([]DeletionReport, error) {
+	query := `
+	SELECT` + deletionReportColumns + `
+	FROM deletion_reports
+	WHERE status = ?
+	ORDER BY created_at ASC
+	`
+	rows, err := c.db.Query(query, DeletionStatusNeedsReview)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := []DeletionReport{}
+	for rows.Next() {
+		report, err := scanDeletionReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, rows.Err()
+}
+
+// RecordHeldVideoErased counts a video erased after its legal hold was
+// lifted toward the deletion of the user's account. Once none of their
+// videos are left, the deletion no longer needs review.
+func (c Client) RecordHeldVideoErased(userID uuid.UUID, reviewDone bool) error {
+	query := `
+	UPDATE deletion_reports
+	SET
+		videos_deleted = videos_deleted + 1,
+		status = CASE
+			WHEN NOT ? OR status != ? THEN status
+			WHEN failures = '[]' THEN ?
+			ELSE ?
+		END
+	WHERE user_id = ?
+	`
+	_, err := c.db.Exec(query, reviewDone, DeletionStatusNeedsReview, DeletionStatusCompleted, DeletionStatusFailed, userID)
+	return err
+}
+
+// CompleteDeletionReport records the outcome of the asynchronous storage
+// cleanup that follows an account deletion.
+func (c Client) CompleteDeletionReport(report DeletionReport) error {
+	failures, err := json.Marshal(report.Failures)
+	if err != nil {
+		return err
+	}
+	query := `
+	UPDATE deletion_reports
+	SET
+		completed_at = CURRENT_TIMESTAMP,
+		status = ?,
+		thumbnails_deleted = ?,
+		objects_deleted = ?,
+		failures = ?
+	WHERE id = ?
+	`
+	_, err = c.db.Exec(
+		query,
+		report.Status,
+		report.ThumbnailsDeleted,
+		report.ObjectsDeleted,
+		string(failures),
+		report.ID,
+	)
+	return err
+}
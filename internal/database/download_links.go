@@ -0,0 +1,144 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DownloadLink lets anyone holding its token download a video a limited
+// number of times before it expires. Only a hash of the token is stored.
+type DownloadLink struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	VideoID   uuid.UUID `json:"video_id"`
+	CreatedBy uuid.UUID `json:"created_by"`
+	MaxUses   int       `json:"max_uses"`
+	Uses      int       `json:"uses"`
+}
+
+func (c Client) CreateDownloadLink(link DownloadLink, tokenHash string) (DownloadLink, error) {
+	link.ID = uuid.New()
+	query := `
+	INSERT INTO download_links (
+		id,
+		token_hash,
+		created_at,
+		expires_at,
+		video_id,
+		created_by,
+		max_uses,
+		uses
+	) VALUES (?, ?, CURRENT_TIMESTAMP, ?, ?, ?, ?, 0)
+	`
+	_, err := c.db.Exec(query, link.ID, tokenHash, link.ExpiresAt.UTC(), link.VideoID, link.CreatedBy, link.MaxUses)
+	if err != nil {
+		return DownloadLink{}, err
+	}
+	return c.getDownloadLink("id", link.ID)
+}
+
+// UseDownloadLink spends one use of the link with the given token hash and
+// returns it. It reports false when the link doesn't exist, has expired or
+// has no uses left. The check and the increment are a single statement, so
+// concurrent requests can't overspend a link.
+func (c Client) UseDownloadLink(tokenHash string) (DownloadLink, bool, error) {
+	query := `
+	UPDATE download_links
+	SET uses = uses + 1
+	WHERE token_hash = ? AND uses < max_uses AND expires_at > ?
+	`
+	result, err := c.db.Exec(query, tokenHash, time.Now().UTC())
+	if err != nil {
+		return DownloadLink{}, false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		return DownloadLink{}, false, err
+	}
+	link, err := c.getDownloadLink("token_hash", tokenHash)
+	return link, err == nil, err
+}
+
+// PeekDownloadLink returns a download link that can still be used, without
+// using it up.
+func (c Client) PeekDownloadLink(tokenHash string) (DownloadLink, bool, error) {
+	link, err := c.getDownloadLink("token_hash", tokenHash)
+	if err != nil || link.ID == uuid.Nil {
+		return DownloadLink{}, false, err
+	}
+	if link.Uses >= link.MaxUses || !link.ExpiresAt.After(time.Now().UTC()) {
+		return DownloadLink{}, false, nil
+	}
+	return link, true, nil
+}
+
+func (c Client) GetDownloadLinksForVideo(videoID uuid.UUID) ([]DownloadLink, error) {
+	query := `
+	SELECT id, created_at, expires_at, video_id, created_by, max_uses, uses
+	FROM download_links
+	WHERE video_id = ?
+	ORDER BY created_at DESC
+	`
+	rows, err := c.db.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []DownloadLink{}
+	for rows.Next() {
+		link, err := scanDownloadLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// RevokeDownloadLink uses up a link's remaining downloads, reporting whether
+// a link with that ID exists for the video.
+func (c Client) RevokeDownloadLink(videoID, linkID uuid.UUID) (bool, error) {
+	query := `
+	UPDATE download_links
+	SET max_uses = uses
+	WHERE id = ? AND video_id = ?
+	`
+	result, err := c.db.Exec(query, linkID, videoID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (c Client) getDownloadLink(column string, value any) (DownloadLink, error) {
+	query := `
+	SELECT id, created_at, expires_at, video_id, created_by, max_uses, uses
+	FROM download_links
+	WHERE ` + column + ` = ?
+	`
+	link, err := scanDownloadLink(c.db.QueryRow(query, value))
+	if errors.Is(err, sql.ErrNoRows) {
+		return DownloadLink{}, nil
+	}
+	return link, err
+}
+
+func scanDownloadLink(row rowScanner) (DownloadLink, error) {
+	var link DownloadLink
+	err := row.Scan(
+		&link.ID,
+		&link.CreatedAt,
+		&link.ExpiresAt,
+		&link.VideoID,
+		&link.CreatedBy,
+		&link.MaxUses,
+		&link.Uses,
+	)
+	return link, err
+}
@@ -0,0 +1,214 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	// busyAttempts is how many times a statement is tried while the
+	// database is locked by another connection or process. The driver
+	// already waits out most locks itself; retrying covers the ones
+	// SQLite gives up on at once to avoid a deadlock.
+	busyAttempts = 3
+	// busyBackoff is the wait before the first retry; it doubles after each.
+	busyBackoff = 25 * time.Millisecond
+
+	// breakerThreshold is how many calls in a row have to fail with the
+	// database unreachable before calls stop being attempted.
+	breakerThreshold = 5
+	// breakerCooldown is how long calls fail fast once the breaker opens,
+	// before one is let through to see whether the database is back.
+	breakerCooldown = 10 * time.Second
+)
+
+// ErrUnavailable is wrapped by the errors of calls that failed because the
+// database couldn't be reached or stayed locked, as opposed to a bad query
+// or a constraint. Callers can answer 503 rather than 500 for these.
+var ErrUnavailable = errors.New("database unavailable")
+
+// errInjectedFault is what an injected write failure returns: the error
+// SQLite gives when the database is locked.
+var errInjectedFault = sqlite3.Error{Code: sqlite3.ErrBusy}
+
+// Breaker states, as reported by Health.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// Health is the state of the primary database connection.
+type Health struct {
+	Breaker             string     `json:"breaker"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastErrorAt         *time.Time `json:"last_error_at,omitempty"`
+	Retries             int64      `json:"retries"`
+	Rejected            int64      `json:"rejected"`
+}
+
+// breaker stops sending calls to a database that keeps failing, so
+// requests fail at once instead of each waiting out its own retries. After
+// breakerCooldown one call is let through; it closes the breaker again if
+// it succeeds.
+type breaker struct {
+	mu          sync.Mutex
+	failures    int
+	openUntil   time.Time
+	probing     bool
+	lastErr     error
+	lastErrorAt time.Time
+
+	retries  atomic.Int64
+	rejected atomic.Int64
+}
+
+// allow reports whether a call may go ahead.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < breakerThreshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		b.rejected.Add(1)
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record notes how a call that was allowed went.
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if !unavailable(err) {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	b.lastErr = err
+	b.lastErrorAt = time.Now()
+	if b.failures >= breakerThreshold {
+		b.openUntil = b.lastErrorAt.Add(breakerCooldown)
+	}
+}
+
+func (b *breaker) health() Health {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	h := Health{
+		Breaker:             BreakerClosed,
+		ConsecutiveFailures: b.failures,
+		Retries:             b.retries.Load(),
+		Rejected:            b.rejected.Load(),
+	}
+	if b.lastErr != nil {
+		h.LastError = b.lastErr.Error()
+		lastErrorAt := b.lastErrorAt
+		h.LastErrorAt = &lastErrorAt
+	}
+	if b.failures >= breakerThreshold {
+		h.Breaker = BreakerOpen
+		if !time.Now().Before(b.openUntil) {
+			h.Breaker = BreakerHalfOpen
+		}
+	}
+	return h
+}
+
+// busy reports whether err means another connection holds a lock the
+// statement needed, so trying again shortly may succeed.
+func busy(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) &&
+		(sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
+
+// unavailable reports whether err means the database itself is in trouble,
+// rather than the statement.
+func unavailable(err error) bool {
+	if busy(err) {
+		return true
+	}
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	switch sqliteErr.Code {
+	case sqlite3.ErrIoErr, sqlite3.ErrCantOpen, sqlite3.ErrFull, sqlite3.ErrNotADB, sqlite3.ErrCorrupt:
+		return true
+	}
+	return false
+}
+
+// call runs fn against the primary through the breaker, retrying while the
+// database is busy.
+func (b *breaker) call(fn func() error) error {
+	if !b.allow() {
+		return fmt.Errorf("%w: too many recent failures", ErrUnavailable)
+	}
+	backoff := busyBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if !busy(err) || attempt == busyAttempts {
+			break
+		}
+		b.retries.Add(1)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	b.record(err)
+	if unavailable(err) {
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	return err
+}
+
+// row defers a QueryRow until it's scanned, which is when SQLite actually
+// runs the statement, so it can go through the breaker and be retried.
+type row struct {
+	db      *sql.DB
+	breaker *breaker
+	query   string
+	args    []any
+	after   func()
+	fault   func() bool
+}
+
+func (r *row) Scan(dest ...any) error {
+	scan := func() error {
+		if r.fault != nil && r.fault() {
+			return errInjectedFault
+		}
+		return r.db.QueryRow(r.query, r.args...).Scan(dest...)
+	}
+	if r.breaker == nil {
+		return scan()
+	}
+	err := r.breaker.call(scan)
+	if r.after != nil {
+		r.after()
+	}
+	return err
+}
+
+// Health checks the primary answers, going through the breaker like any
+// other call, and reports the breaker's state.
+func (c Client) Health() (Health, error) {
+	// Reading the schema touches the file, which SELECT 1 wouldn't
+	var tables int
+	err := c.db.breaker.call(func() error {
+		return c.db.primary.QueryRow("SELECT COUNT(*) FROM sqlite_master").Scan(&tables)
+	})
+	return c.db.breaker.health(), err
+}
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// InputFailure counts how often ffmpeg has failed on one uploaded file,
+// identified by its content hash. Once the file is quarantined, a copy of
+// it and the diagnostics sit under QuarantinePrefix in the bucket and
+// uploads of the same content are refused.
+type InputFailure struct {
+	ChecksumSHA256   string     `json:"checksum_sha256"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+	VideoID          uuid.UUID  `json:"video_id"`
+	UserID           uuid.UUID  `json:"user_id"`
+	Failures         int        `json:"failures"`
+	LastError        string     `json:"last_error"`
+	QuarantinePrefix *string    `json:"quarantine_prefix"`
+	QuarantinedAt    *time.Time `json:"quarantined_at"`
+}
+
+const inputFailureColumns = `
+		checksum_sha256,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		failures,
+		last_error,
+		quarantine_prefix,
+		quarantined_at`
+
+func scanInputFailure(row rowScanner) (InputFailure, error) {
+	var failure InputFailure
+	var videoID, userID string
+	err := row.Scan(
+		&failure.ChecksumSHA256,
+		&failure.CreatedAt,
+		&failure.UpdatedAt,
+		&videoID,
+		&userID,
+		&failure.Failures,
+		&failure.LastError,
+		&failure.QuarantinePrefix,
+		&failure.QuarantinedAt,
+	)
+	if err != nil {
+		return InputFailure{}, err
+	}
+	failure.VideoID, _ = uuid.Parse(videoID)
+	failure.UserID, _ = uuid.Parse(userID)
+	return failure, nil
+}
+
+// RecordInputFailure adds one ffmpeg failure to the file's count and returns
+// the updated record.
+func (c Client) RecordInputFailure(checksum string, videoID, userID uuid.UUID, lastError string) (InputFailure, error) {
+	now := time.Now().UTC()
+	query := `
+	INSERT INTO input_failures (checksum_sha256, created_at, updated_at, video_id, user_id, failures, last_error)
+	VALUES (?, ?, ?, ?, ?, 1, ?)
+	ON CONFLICT(checksum_sha256) DO UPDATE SET
+		updated_at = excluded.updated_at,
+		video_id = excluded.video_id,
+		user_id = excluded.user_id,
+		failures = input_failures.failures + 1,
+		last_error = excluded.last_error
+	RETURNING` + inputFailureColumns
+	return scanInputFailure(c.db.QueryRow(query, checksum, now, now, videoID.String(), userID.String(), lastError))
+}
+
+func (c Client) MarkInputQuarantined(checksum, prefix string) error {
+	query := `
+	UPDATE input_failures
+	SET quarantine_prefix = ?, quarantined_at = ?
+	WHERE checksum_sha256 = ?
+	`
+	_, err := c.db.Exec(query, prefix, time.Now().UTC(), checksum)
+	return err
+}
+
+// GetInputFailure returns the failure record for a file, or an empty
+// InputFailure if ffmpeg has never failed on it.
+func (c Client) GetInputFailure(checksum string) (InputFailure, error) {
+	query := `
+	SELECT` + inputFailureColumns + `
+	FROM input_failures
+	WHERE checksum_sha256 = ?
+	`
+	failure, err := scanInputFailure(c.db.QueryRow(query, checksum))
+	if errors.Is(err, sql.ErrNoRows) {
+		return InputFailure{}, nil
+	}
+	return failure, err
+}
+
+func (c Client) GetQuarantinedInputs() ([]InputFailure, error) {
+	query := `
+	SELECT` + inputFailureColumns + `
+	FROM input_failures
+	WHERE quarantined_at IS NOT NULL
+	ORDER BY quarantined_at DESC
+	`
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	failures := []InputFailure{}
+	for rows.Next() {
+		failure, err := scanInputFailure(rows)
+		if err != nil {
+			return nil, err
+		}
+		failures = append(failures, failure)
+	}
+	return failures, rows.Err()
+}
+
+// DeleteInputFailure forgets a file's failures, which also lifts its
+// quarantine.
+func (c Client) DeleteInputFailure(checksum string) error {
+	_, err := c.db.Exec("DELETE FROM input_failures WHERE checksum_sha256 = ?", checksum)
+	return err
+}
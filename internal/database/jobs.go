@@ -0,0 +1,184 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	JobKindUploadSession     = "upload_session"
+	JobKindThumbnailVariants = "thumbnail_variants"
+	JobKindAutoThumbnail     = "auto_thumbnail"
+	JobKindVideoPackage      = "video_package"
+)
+
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusCompleted = "completed"
+	JobStatusFailed    = "failed"
+)
+
+// Job is a unit of processing handed from an API node to the workers.
+// SubjectID identifies what the job works on: an upload session for
+// JobKindUploadSession, a video for JobKindThumbnailVariants and
+// JobKindAutoThumbnail, a video package for JobKindVideoPackage. A running
+// job belongs to Worker until its lease expires, after which any worker may
+// take it over.
+type Job struct {
+	ID             uuid.UUID  `json:"id"`
+	CreatedAt      time.Time  `json:"created_at"`
+	Kind           string     `json:"kind"`
+	SubjectID      uuid.UUID  `json:"subject_id"`
+	UserID         uuid.UUID  `json:"user_id"`
+	Priority       int        `json:"priority"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	Error          *string    `json:"error"`
+	Worker         *string    `json:"worker"`
+	LeaseExpiresAt *time.Time `json:"lease_expires_at"`
+	RunAfter       time.Time  `json:"run_after"`
+}
+
+const jobColumns = `
+		id,
+		created_at,
+		kind,
+		subject_id,
+		user_id,
+		priority,
+		status,
+		attempts,
+		error,
+		worker,
+		lease_expires_at,
+		run_after`
+
+func scanJob(row rowScanner) (Job, error) {
+	var job Job
+	err := row.Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.Kind,
+		&job.SubjectID,
+		&job.UserID,
+		&job.Priority,
+		&job.Status,
+		&job.Attempts,
+		&job.Error,
+		&job.Worker,
+		&job.LeaseExpiresAt,
+		&job.RunAfter,
+	)
+	return job, err
+}
+
+func (c Client) EnqueueJob(kind string, subjectID, userID uuid.UUID, priority int) (Job, error) {
+	id := uuid.New()
+	now := time.Now().UTC()
+	query := `
+	INSERT INTO jobs (id, created_at, kind, subject_id, user_id, priority, status, attempts, run_after)
+	VALUES (?, ?, ?, ?, ?, ?, ?, 0, ?)
+	`
+	_, err := c.db.Exec(query, id, now, kind, subjectID, userID, priority, JobStatusQueued, now)
+	if err != nil {
+		return Job{}, err
+	}
+	return c.GetJob(id)
+}
+
+func (c Client) GetJob(id uuid.UUID) (Job, error) {
+	query := `SELECT` + jobColumns + `
+	FROM jobs
+	WHERE id = ?
+	`
+	job, err := scanJob(c.db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Job{}, nil
+	}
+	return job, err
+}
+
+// ClaimJob leases the next runnable job to worker, returning an empty Job
+// when there is none. Queued jobs whose run_after has passed and running
+// jobs whose lease ran out are both runnable. The most urgent priority goes
+// first, then the user with the fewest jobs running, then the oldest job.
+func (c Client) ClaimJob(worker string, lease time.Duration) (Job, error) {
+	now := time.Now().UTC()
+	query := `
+	UPDATE jobs
+	SET status = ?, worker = ?, lease_expires_at = ?, attempts = attempts + 1
+	WHERE id = (
+		SELECT j.id FROM jobs j
+		WHERE (j.status = ? AND j.run_after <= ?)
+			OR (j.status = ? AND j.lease_expires_at < ?)
+		ORDER BY
+			j.priority,
+			(SELECT COUNT(*) FROM jobs r
+				WHERE r.user_id = j.user_id AND r.status = ? AND r.lease_expires_at >= ?),
+			j.created_at
+		LIMIT 1
+	)
+	RETURNING` + jobColumns
+	job, err := scanJob(c.db.QueryRow(query,
+		JobStatusRunning, worker, now.Add(lease),
+		JobStatusQueued, now,
+		JobStatusRunning, now,
+		JobStatusRunning, now,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Job{}, nil
+	}
+	return job, err
+}
+
+// ExtendJobLease keeps a long job leased to the worker running it,
+// reporting false if the lease was lost to another worker.
+func (c Client) ExtendJobLease(id uuid.UUID, worker string, lease time.Duration) (bool, error) {
+	query := `
+	UPDATE jobs
+	SET lease_expires_at = ?
+	WHERE id = ? AND worker = ? AND status = ?
+	`
+	result, err := c.db.Exec(query, time.Now().UTC().Add(lease), id, worker, JobStatusRunning)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (c Client) CompleteJob(id uuid.UUID) error {
+	query := `
+	UPDATE jobs
+	SET status = ?, error = NULL, lease_expires_at = NULL
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, JobStatusCompleted, id)
+	return err
+}
+
+func (c Client) FailJob(id uuid.UUID, failure string) error {
+	query := `
+	UPDATE jobs
+	SET status = ?, error = ?, lease_expires_at = NULL
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, JobStatusFailed, failure, id)
+	return err
+}
+
+// RetryJob puts a job back in the queue to run again no earlier than
+// runAfter.
+func (c Client) RetryJob(id uuid.UUID, failure string, runAfter time.Time) error {
+	query := `
+	UPDATE jobs
+	SET status = ?, error = ?, worker = NULL, lease_expires_at = NULL, run_after = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, JobStatusQueued, failure, runAfter.UTC(), id)
+	return err
+}
@@ -0,0 +1,105 @@
+package database
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+// LoginAttempts counts the failed sign-ins in a row for one subject, an
+// account or an address, and how long it is locked out for.
+type LoginAttempts struct {
+	Subject       string    `json:"subject"`
+	Failures      int       `json:"failures"`
+	LastFailureAt time.Time `json:"last_failure_at"`
+	LockedUntil   time.Time `json:"locked_until"`
+}
+
+// LoginAccountSubject is the subject an account's failed sign-ins are
+// counted against. It's a hash of the email, so the email isn't kept for
+// addresses that aren't accounts or written into lockout audit entries.
+func LoginAccountSubject(email string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return "account:" + hex.EncodeToString(sum[:16])
+}
+
+// GetLoginAttempts returns the subject's failures. Failures older than
+// window are forgotten, so a subject without recent ones has none.
+func (c Client) GetLoginAttempts(subject string, window time.Duration) (LoginAttempts, error) {
+	query := `
+	SELECT subject, failures, last_failure_at, locked_until
+	FROM login_attempts
+	WHERE subject = ? AND last_failure_at > ?
+	`
+	var attempts LoginAttempts
+	err := c.db.QueryRow(query, subject, time.Now().UTC().Add(-window)).Scan(
+		&attempts.Subject,
+		&attempts.Failures,
+		&attempts.LastFailureAt,
+		&attempts.LockedUntil,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return LoginAttempts{Subject: subject}, nil
+	}
+	return attempts, err
+}
+
+// RecordLoginFailure counts another failure for the subject, starting over
+// if the last one was longer than window ago, and locks it out for as long
+// as lockout says for the new count. It returns the updated attempts.
+func (c Client) RecordLoginFailure(subject string, window time.Duration, lockout func(failures int) time.Duration) (LoginAttempts, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return LoginAttempts{}, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	var failures int
+	err = tx.QueryRow(
+		"SELECT failures FROM login_attempts WHERE subject = ? AND last_failure_at > ?",
+		subject, now.Add(-window),
+	).Scan(&failures)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return LoginAttempts{}, err
+	}
+	attempts := LoginAttempts{
+		Subject:       subject,
+		Failures:      failures + 1,
+		LastFailureAt: now,
+	}
+	attempts.LockedUntil = now.Add(lockout(attempts.Failures))
+
+	query := `
+	INSERT INTO login_attempts (subject, failures, last_failure_at, locked_until)
+	VALUES (?, ?, ?, ?)
+	ON CONFLICT(subject) DO UPDATE SET
+		failures = excluded.failures,
+		last_failure_at = excluded.last_failure_at,
+		locked_until = excluded.locked_until
+	`
+	_, err = tx.Exec(query, attempts.Subject, attempts.Failures, attempts.LastFailureAt, attempts.LockedUntil)
+	if err != nil {
+		return LoginAttempts{}, err
+	}
+	return attempts, tx.Commit()
+}
+
+// ClearLoginFailures forgets the subject's failures after a successful
+// sign-in.
+func (c Client) ClearLoginFailures(subject string) error {
+	_, err := c.db.Exec("DELETE FROM login_attempts WHERE subject = ?", subject)
+	return err
+}
+
+// DeleteStaleLoginAttempts forgets failures older than window.
+func (c Client) DeleteStaleLoginAttempts(window time.Duration) (int64, error) {
+	result, err := c.db.Exec("DELETE FROM login_attempts WHERE last_failure_at <= ?", time.Now().UTC().Add(-window))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
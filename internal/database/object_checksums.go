@@ -0,0 +1,72 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// ObjectChecksum records the content hash of an unencrypted object stored
+// by the app, so identical output can be copied server-side instead of
+// uploaded again.
+type ObjectChecksum struct {
+	S3Key          string
+	ChecksumSHA256 string
+	Size           int64
+}
+
+func (c Client) PutObjectChecksum(object ObjectChecksum) error {
+	query := `
+	INSERT INTO object_checksums (s3_key, checksum_sha256, size, created_at)
+	VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+	ON CONFLICT(s3_key) DO UPDATE SET
+		checksum_sha256 = excluded.checksum_sha256,
+		size = excluded.size,
+		created_at = excluded.created_at
+	`
+	_, err := c.db.Exec(query, object.S3Key, object.ChecksumSHA256, object.Size)
+	return err
+}
+
+// GetObjectByChecksum returns the most recently stored object with the given
+// content, or an empty ObjectChecksum if there is none.
+func (c Client) GetObjectByChecksum(checksum string, size int64) (ObjectChecksum, error) {
+	query := `
+	SELECT s3_key, checksum_sha256, size
+	FROM object_checksums
+	WHERE checksum_sha256 = ? AND size = ?
+	ORDER BY created_at DESC
+	LIMIT 1
+	`
+	var object ObjectChecksum
+	err := c.db.QueryRow(query, checksum, size).Scan(&object.S3Key, &object.ChecksumSHA256, &object.Size)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ObjectChecksum{}, nil
+	}
+	return object, err
+}
+
+// GetObjectSizes returns the recorded size of every object with a checksum,
+// by key.
+func (c Client) GetObjectSizes() (map[string]int64, error) {
+	rows, err := c.db.Query("SELECT s3_key, size FROM object_checksums")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sizes := map[string]int64{}
+	for rows.Next() {
+		var key string
+		var size int64
+		if err := rows.Scan(&key, &size); err != nil {
+			return nil, err
+		}
+		sizes[key] = size
+	}
+	return sizes, rows.Err()
+}
+
+func (c Client) DeleteObjectChecksum(s3Key string) error {
+	_, err := c.db.Exec("DELETE FROM object_checksums WHERE s3_key = ?", s3Key)
+	return err
+}
@@ -0,0 +1,113 @@
+package database
+
+import (
+	"time"
+)
+
+const (
+	IntegrityOK               = "ok"
+	IntegrityMissing          = "missing"
+	IntegritySizeMismatch     = "size_mismatch"
+	IntegrityChecksumMismatch = "checksum_mismatch"
+)
+
+// ObjectIntegrityCheck is the latest re-verification of a stored object
+// against the size and checksum recorded when it was stored.
+type ObjectIntegrityCheck struct {
+	S3Key     string    `json:"s3_key"`
+	Status    string    `json:"status"`
+	Detail    string    `json:"detail"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// ObjectIntegrityStats counts the objects with a recorded checksum, how
+// many have been re-verified, and how many of those failed.
+type ObjectIntegrityStats struct {
+	Objects  int `json:"objects"`
+	Checked  int `json:"checked"`
+	Problems int `json:"problems"`
+}
+
+// GetObjectsToVerify returns up to limit objects with a recorded checksum,
+// those never checked first and then those checked longest ago, so repeated
+// runs cycle through every object.
+func (c Client) GetObjectsToVerify(limit int) ([]ObjectChecksum, error) {
+	query := `
+	SELECT o.s3_key, o.checksum_sha256, o.size
+	FROM object_checksums o
+	LEFT JOIN object_integrity_checks i ON i.s3_key = o.s3_key
+	ORDER BY i.checked_at IS NOT NULL, i.checked_at, o.s3_key
+	LIMIT ?
+	`
+	rows, err := c.db.Query(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var objects []ObjectChecksum
+	for rows.Next() {
+		var object ObjectChecksum
+		if err := rows.Scan(&object.S3Key, &object.ChecksumSHA256, &object.Size); err != nil {
+			return nil, err
+		}
+		objects = append(objects, object)
+	}
+	return objects, rows.Err()
+}
+
+func (c Client) PutObjectIntegrityCheck(check ObjectIntegrityCheck) error {
+	query := `
+	INSERT INTO object_integrity_checks (s3_key, status, detail, checked_at)
+	VALUES (?, ?, ?, ?)
+	ON CONFLICT(s3_key) DO UPDATE SET
+		status = excluded.status,
+		detail = excluded.detail,
+		checked_at = excluded.checked_at
+	`
+	_, err := c.db.Exec(query, check.S3Key, check.Status, check.Detail, check.CheckedAt.UTC())
+	return err
+}
+
+// GetObjectIntegrityStats only counts checks of objects that still have a
+// recorded checksum.
+func (c Client) GetObjectIntegrityStats() (ObjectIntegrityStats, error) {
+	query := `
+	SELECT
+		COUNT(*),
+		COUNT(i.s3_key),
+		COUNT(CASE WHEN i.status != ? THEN 1 END)
+	FROM object_checksums o
+	LEFT JOIN object_integrity_checks i ON i.s3_key = o.s3_key
+	`
+	var stats ObjectIntegrityStats
+	err := c.db.QueryRow(query, IntegrityOK).Scan(&stats.Objects, &stats.Checked, &stats.Problems)
+	return stats, err
+}
+
+// GetObjectIntegrityProblems returns the failed checks of objects that still
+// have a recorded checksum, most recent first.
+func (c Client) GetObjectIntegrityProblems() ([]ObjectIntegrityCheck, error) {
+	query := `
+	SELECT i.s3_key, i.status, i.detail, i.checked_at
+	FROM object_integrity_checks i
+	JOIN object_checksums o ON o.s3_key = i.s3_key
+	WHERE i.status != ?
+	ORDER BY i.checked_at DESC
+	`
+	rows, err := c.db.Query(query, IntegrityOK)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checks := []ObjectIntegrityCheck{}
+	for rows.Next() {
+		var check ObjectIntegrityCheck
+		if err := rows.Scan(&check.S3Key, &check.Status, &check.Detail, &check.CheckedAt); err != nil {
+			return nil, err
+		}
+		checks = append(checks, check)
+	}
+	return checks, rows.Err()
+}
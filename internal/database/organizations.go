@@ -0,0 +1,209 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Organization roles, from most to least privileged.
+const (
+	OrgRoleOwner    = "owner"
+	OrgRoleAdmin    = "admin"
+	OrgRoleUploader = "uploader"
+	OrgRoleViewer   = "viewer"
+)
+
+// ValidOrgRole reports whether role is one of the organization roles.
+func ValidOrgRole(role string) bool {
+	switch role {
+	case OrgRoleOwner, OrgRoleAdmin, OrgRoleUploader, OrgRoleViewer:
+		return true
+	}
+	return false
+}
+
+type Organization struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Name      string    `json:"name"`
+}
+
+// OrganizationMembership is an organization as seen by one of its members.
+type OrganizationMembership struct {
+	Organization
+	Role string `json:"role"`
+}
+
+type OrgMember struct {
+	UserID uuid.UUID `json:"user_id"`
+	Email  string    `json:"email"`
+	Role   string    `json:"role"`
+}
+
+// CreateOrganization creates an organization with ownerID as its first
+// owner.
+func (c Client) CreateOrganization(name string, ownerID uuid.UUID) (Organization, error) {
+	id := uuid.New()
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return Organization{}, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+	INSERT INTO organizations (id, created_at, name)
+	VALUES (?, CURRENT_TIMESTAMP, ?)
+	`, id, name)
+	if err != nil {
+		return Organization{}, err
+	}
+	_, err = tx.Exec(`
+	INSERT INTO organization_members (org_id, user_id, role)
+	VALUES (?, ?, ?)
+	`, id, ownerID.String(), OrgRoleOwner)
+	if err != nil {
+		return Organization{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Organization{}, err
+	}
+
+	return c.GetOrganization(id)
+}
+
+// GetOrganization returns an empty Organization when none has the given ID.
+func (c Client) GetOrganization(id uuid.UUID) (Organization, error) {
+	query := `
+	SELECT id, created_at, name
+	FROM organizations
+	WHERE id = ?
+	`
+	var org Organization
+	err := c.db.QueryRow(query, id).Scan(&org.ID, &org.CreatedAt, &org.Name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Organization{}, nil
+	}
+	return org, err
+}
+
+func (c Client) GetOrganizationsForUser(userID uuid.UUID) ([]OrganizationMembership, error) {
+	query := `
+	SELECT o.id, o.created_at, o.name, m.role
+	FROM organizations o
+	JOIN organization_members m ON m.org_id = o.id
+	WHERE m.user_id = ?
+	ORDER BY o.name
+	`
+	rows, err := c.db.Query(query, userID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberships := []OrganizationMembership{}
+	for rows.Next() {
+		var m OrganizationMembership
+		if err := rows.Scan(&m.ID, &m.CreatedAt, &m.Name, &m.Role); err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, m)
+	}
+	return memberships, rows.Err()
+}
+
+// GetOrgMemberRole returns the user's role in the organization, or "" when
+// they aren't a member.
+func (c Client) GetOrgMemberRole(orgID, userID uuid.UUID) (string, error) {
+	query := `
+	SELECT role
+	FROM organization_members
+	WHERE org_id = ? AND user_id = ?
+	`
+	var role string
+	err := c.db.QueryRow(query, orgID, userID.String()).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return role, err
+}
+
+func (c Client) GetOrgMembers(orgID uuid.UUID) ([]OrgMember, error) {
+	query := `
+	SELECT u.id, u.email, m.role
+	FROM organization_members m
+	JOIN users u ON u.id = m.user_id
+	WHERE m.org_id = ?
+	ORDER BY u.email
+	`
+	rows, err := c.db.Query(query, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []OrgMember{}
+	for rows.Next() {
+		var member OrgMember
+		var id string
+		if err := rows.Scan(&id, &member.Email, &member.Role); err != nil {
+			return nil, err
+		}
+		member.UserID, err = uuid.Parse(id)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+// PutOrgMember adds a user to an organization or changes their role.
+func (c Client) PutOrgMember(orgID, userID uuid.UUID, role string) error {
+	query := `
+	INSERT INTO organization_members (org_id, user_id, role)
+	VALUES (?, ?, ?)
+	ON CONFLICT(org_id, user_id) DO UPDATE SET role = excluded.role
+	`
+	_, err := c.db.Exec(query, orgID, userID.String(), role)
+	return err
+}
+
+// DeleteOrgMember removes a user from an organization, reporting whether
+// they were a member.
+func (c Client) DeleteOrgMember(orgID, userID uuid.UUID) (bool, error) {
+	query := `
+	DELETE FROM organization_members
+	WHERE org_id = ? AND user_id = ?
+	`
+	result, err := c.db.Exec(query, orgID, userID.String())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (c Client) DeleteOrgMembershipsForUser(userID uuid.UUID) error {
+	query := `
+	DELETE FROM organization_members
+	WHERE user_id = ?
+	`
+	_, err := c.db.Exec(query, userID.String())
+	return err
+}
+
+// CountOrgOwners is used to keep every organization with at least one owner.
+func (c Client) CountOrgOwners(orgID uuid.UUID) (int, error) {
+	query := `
+	SELECT COUNT(*)
+	FROM organization_members
+	WHERE org_id = ? AND role = ?
+	`
+	var count int
+	err := c.db.QueryRow(query, orgID, OrgRoleOwner).Scan(&count)
+	return count, err
+}
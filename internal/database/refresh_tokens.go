@@ -81,3 +81,18 @@ func (c Client) DeleteRefreshToken(token string) error {
 	_, err := c.db.Exec(query, token)
 	return err
 }
+
+// DeleteRefreshTokensForUser removes every session belonging to a user and
+// returns how many there were.
+func (c Client) DeleteRefreshTokensForUser(userID uuid.UUID) (int, error) {
+	query := `
+		DELETE FROM refresh_tokens
+		WHERE user_id = ?
+	`
+	result, err := c.db.Exec(query, userID.String())
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
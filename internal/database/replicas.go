@@ -0,0 +1,259 @@
+package database
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// replicaHeartbeatInterval is how often the primary stamps the time into
+// replication_heartbeat and how often replicas are checked for it. A
+// replica is as fresh as the last stamp that has reached it.
+const replicaHeartbeatInterval = time.Second
+
+// ReplicaConfig lists read-only copies of the database kept up to date by
+// an external replicator, like LiteFS or Litestream. With none, everything
+// goes to the primary.
+type ReplicaConfig struct {
+	Paths []string
+	// MaxLag is how far behind the primary a replica may be and still
+	// serve reads.
+	MaxLag time.Duration
+}
+
+// ReplicaStatus is what the pool last saw of a replica.
+type ReplicaStatus struct {
+	Path   string
+	Lag    time.Duration
+	Usable bool
+	Reads  int64
+}
+
+// pool sends writes to the primary and plain SELECTs to a replica that is
+// within MaxLag and has caught up with this process's own last write, so a
+// request always sees what an earlier request on the same node wrote.
+// Anything else, including every read while no replica qualifies, goes to
+// the primary.
+type pool struct {
+	// primary serves reads from the primary database, and writer takes
+	// every statement that might write to it
+	primary   *sql.DB
+	writer    *sql.DB
+	replicas  []*replica
+	maxLag    time.Duration
+	lastWrite atomic.Int64
+	next      atomic.Uint64
+	breaker   breaker
+	// writeFault, when set, is asked before every write whether to fail it
+	writeFault func() bool
+}
+
+type replica struct {
+	path string
+	db   *sql.DB
+	// caughtUpTo is the newest heartbeat seen on the replica, in Unix
+	// nanoseconds; 0 when it couldn't be read.
+	caughtUpTo atomic.Int64
+	reads      atomic.Int64
+}
+
+func openReplicas(config ReplicaConfig) ([]*replica, error) {
+	var replicas []*replica
+	for _, path := range config.Paths {
+		db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+		if err != nil {
+			return nil, err
+		}
+		replicas = append(replicas, &replica{path: path, db: db})
+	}
+	return replicas, nil
+}
+
+// watch stamps heartbeats on the primary and reads them back from each
+// replica for as long as the process runs.
+func (p *pool) watch() {
+	for range time.Tick(replicaHeartbeatInterval) {
+		// Every node stamps; the newest stamp wins, so a node with a slow
+		// clock can't make replicas look further behind than they are
+		_, err := p.writer.Exec(`
+		INSERT INTO replication_heartbeat (id, written_at) VALUES (1, ?)
+		ON CONFLICT(id) DO UPDATE SET written_at = MAX(written_at, excluded.written_at)
+		`, time.Now().UnixNano())
+		if err != nil {
+			log.Printf("Couldn't write replication heartbeat: %v", err)
+		}
+		for _, r := range p.replicas {
+			var writtenAt int64
+			if err := r.db.QueryRow("SELECT written_at FROM replication_heartbeat WHERE id = 1").Scan(&writtenAt); err != nil {
+				if r.caughtUpTo.Swap(0) != 0 {
+					log.Printf("Couldn't read replication heartbeat from %s: %v", r.path, err)
+				}
+				continue
+			}
+			r.caughtUpTo.Store(writtenAt)
+		}
+	}
+}
+
+// usable reports whether a replica may serve a read right now.
+func (p *pool) usable(r *replica, now int64) bool {
+	caughtUpTo := r.caughtUpTo.Load()
+	return caughtUpTo != 0 &&
+		caughtUpTo >= p.lastWrite.Load() &&
+		time.Duration(now-caughtUpTo) <= p.maxLag
+}
+
+// reader picks where a read goes, taking turns between usable replicas.
+func (p *pool) reader() *sql.DB {
+	if len(p.replicas) == 0 {
+		return p.primary
+	}
+	now := time.Now().UnixNano()
+	start := p.next.Add(1)
+	for i := range p.replicas {
+		r := p.replicas[(start+uint64(i))%uint64(len(p.replicas))]
+		if p.usable(r, now) {
+			r.reads.Add(1)
+			return r.db
+		}
+	}
+	return p.primary
+}
+
+func (p *pool) noteWrite() {
+	if len(p.replicas) > 0 {
+		p.lastWrite.Store(time.Now().UnixNano())
+	}
+}
+
+func (p *pool) status() []ReplicaStatus {
+	now := time.Now().UnixNano()
+	var statuses []ReplicaStatus
+	for _, r := range p.replicas {
+		status := ReplicaStatus{Path: r.path, Usable: p.usable(r, now), Reads: r.reads.Load()}
+		if caughtUpTo := r.caughtUpTo.Load(); caughtUpTo != 0 {
+			status.Lag = time.Duration(now - caughtUpTo)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// handle is how Client methods reach the database. It has the *sql.DB
+// methods they use and routes each call through the pool.
+type handle struct {
+	*pool
+	primaryOnly bool
+}
+
+// isRead reports whether a statement only reads. Statements like
+// INSERT ... RETURNING come back with rows but still have to run on the
+// primary.
+func isRead(query string) bool {
+	query = strings.TrimSpace(query)
+	return len(query) >= 6 && strings.EqualFold(query[:6], "SELECT")
+}
+
+// write runs fn on the primary through the breaker, like any call, unless
+// an injected fault fails it first.
+func (h handle) write(fn func() error) error {
+	return h.breaker.call(func() error {
+		if h.writeFault != nil && h.writeFault() {
+			return errInjectedFault
+		}
+		return fn()
+	})
+}
+
+func (h handle) Exec(query string, args ...any) (sql.Result, error) {
+	var result sql.Result
+	err := h.write(func() error {
+		var err error
+		result, err = h.writer.Exec(query, args...)
+		return err
+	})
+	h.noteWrite()
+	return result, err
+}
+
+func (h handle) Query(query string, args ...any) (*sql.Rows, error) {
+	db, call := h.writer, h.write
+	if isRead(query) {
+		db, call = h.primary, h.breaker.call
+		if !h.primaryOnly {
+			if replica := h.reader(); replica != h.primary {
+				return replica.Query(query, args...)
+			}
+		}
+	} else {
+		defer h.noteWrite()
+	}
+	var rows *sql.Rows
+	err := call(func() error {
+		var err error
+		rows, err = db.Query(query, args...)
+		return err
+	})
+	return rows, err
+}
+
+func (h handle) QueryRow(query string, args ...any) *row {
+	if !isRead(query) {
+		return &row{db: h.writer, breaker: &h.breaker, query: query, args: args, after: h.noteWrite, fault: h.writeFault}
+	}
+	if !h.primaryOnly {
+		if replica := h.reader(); replica != h.primary {
+			return &row{db: replica, query: query, args: args}
+		}
+	}
+	return &row{db: h.primary, breaker: &h.breaker, query: query, args: args}
+}
+
+func (h handle) Begin() (*tx, error) {
+	var sqlTx *sql.Tx
+	err := h.write(func() error {
+		var err error
+		sqlTx, err = h.writer.Begin()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &tx{Tx: sqlTx, pool: h.pool}, nil
+}
+
+// tx is a transaction on the primary that counts as a write once it
+// commits.
+type tx struct {
+	*sql.Tx
+	pool *pool
+}
+
+func (t *tx) Commit() error {
+	err := t.Tx.Commit()
+	t.pool.noteWrite()
+	return err
+}
+
+// Primary returns a client whose reads all go to the primary, for requests
+// that have to see writes made on other nodes as soon as they're made,
+// like polling the status of an upload a worker is processing.
+func (c Client) Primary() Client {
+	return Client{db: handle{pool: c.db.pool, primaryOnly: true}}
+}
+
+// InjectWriteFaults has every write on the primary first ask fail whether
+// to fail, for exercising how callers cope with a struggling database. An
+// injected failure looks like the database being locked, so it is retried
+// and trips the breaker like a real one. fail may also sleep, to delay the
+// write. It must be set before the client is used.
+func (c Client) InjectWriteFaults(fail func() bool) {
+	c.db.writeFault = fail
+}
+
+// ReplicaStatus reports the lag and use of each read replica.
+func (c Client) ReplicaStatus() []ReplicaStatus {
+	return c.db.status()
+}
@@ -0,0 +1,237 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The reasons a video can be reported for.
+const (
+	ReportReasonSpam       = "spam"
+	ReportReasonHarassment = "harassment"
+	ReportReasonHate       = "hate"
+	ReportReasonViolence   = "violence"
+	ReportReasonSexual     = "sexual"
+	ReportReasonCopyright  = "copyright"
+	ReportReasonOther      = "other"
+)
+
+var ReportReasons = []string{
+	ReportReasonSpam,
+	ReportReasonHarassment,
+	ReportReasonHate,
+	ReportReasonViolence,
+	ReportReasonSexual,
+	ReportReasonCopyright,
+	ReportReasonOther,
+}
+
+// How a moderator resolved a video's reports: dismissed as unfounded, or
+// upheld by taking the video down.
+const (
+	ReportDismissed = "dismissed"
+	ReportRemoved   = "removed"
+)
+
+type VideoReport struct {
+	ID         uuid.UUID  `json:"id"`
+	VideoID    uuid.UUID  `json:"video_id"`
+	ReporterID uuid.UUID  `json:"reporter_id"`
+	Reason     string     `json:"reason"`
+	Details    string     `json:"details"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ResolvedAt *time.Time `json:"resolved_at"`
+	Resolution *string    `json:"resolution"`
+	ResolvedBy *uuid.UUID `json:"resolved_by"`
+}
+
+// ReportedVideo is a video in the moderation queue with its open reports,
+// oldest first.
+type ReportedVideo struct {
+	Video   Video         `json:"video"`
+	Reports []VideoReport `json:"reports"`
+}
+
+const videoReportColumns = `
+		id,
+		video_id,
+		reporter_id,
+		reason,
+		details,
+		created_at,
+		resolved_at,
+		resolution,
+		resolved_by`
+
+func scanVideoReport(row rowScanner) (VideoReport, error) {
+	var report VideoReport
+	err := row.Scan(
+		&report.ID,
+		&report.VideoID,
+		&report.ReporterID,
+		&report.Reason,
+		&report.Details,
+		&report.CreatedAt,
+		&report.ResolvedAt,
+		&report.Resolution,
+		&report.ResolvedBy,
+	)
+	return report, err
+}
+
+// CreateVideoReport files a report unless its reporter already has an open
+// one on the video, in which case that one is returned and duplicate is
+// true. Once flagThreshold users have open reports on the video, it's
+// flagged; flagged reports whether this report was the one that did it.
+func (c Client) CreateVideoReport(report VideoReport, flagThreshold int) (filed VideoReport, duplicate, flagged bool, err error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return VideoReport{}, false, false, err
+	}
+	defer tx.Rollback()
+
+	existing, err := scanVideoReport(tx.QueryRow(`
+	SELECT`+videoReportColumns+`
+	FROM video_reports
+	WHERE video_id = ? AND reporter_id = ? AND resolved_at IS NULL
+	`, report.VideoID, report.ReporterID))
+	if err == nil {
+		return existing, true, false, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return VideoReport{}, false, false, err
+	}
+
+	report.ID = uuid.New()
+	report.CreatedAt = time.Now().UTC()
+	_, err = tx.Exec(`
+	INSERT INTO video_reports (id, video_id, reporter_id, reason, details, created_at)
+	VALUES (?, ?, ?, ?, ?, ?)
+	`, report.ID, report.VideoID, report.ReporterID, report.Reason, report.Details, report.CreatedAt)
+	if err != nil {
+		return VideoReport{}, false, false, err
+	}
+
+	var reporters int
+	err = tx.QueryRow(
+		"SELECT COUNT(DISTINCT reporter_id) FROM video_reports WHERE video_id = ? AND resolved_at IS NULL",
+		report.VideoID,
+	).Scan(&reporters)
+	if err != nil {
+		return VideoReport{}, false, false, err
+	}
+	if reporters >= flagThreshold {
+		result, err := tx.Exec("UPDATE videos SET flagged = TRUE WHERE id = ? AND NOT flagged", report.VideoID)
+		if err != nil {
+			return VideoReport{}, false, false, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return VideoReport{}, false, false, err
+		}
+		flagged = n > 0
+	}
+	return report, false, flagged, tx.Commit()
+}
+
+// GetReportedVideos returns up to limit videos with open reports, flagged
+// ones first, then those reported most, then those waiting longest.
+func (c Client) GetReportedVideos(limit int) ([]ReportedVideo, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	JOIN (
+		SELECT video_id, COUNT(*) AS reports, MIN(created_at) AS first_reported_at
+		FROM video_reports
+		WHERE resolved_at IS NULL
+		GROUP BY video_id
+	) AS open_reports ON open_reports.video_id = videos.id
+	ORDER BY videos.flagged DESC, open_reports.reports DESC, open_reports.first_reported_at, videos.id
+	LIMIT ?
+	`
+	rows, err := c.db.Query(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	queue := []ReportedVideo{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		queue = append(queue, ReportedVideo{Video: video, Reports: []VideoReport{}})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// Done with the videos before reading their reports, which may need
+	// the same connection
+	rows.Close()
+
+	for i := range queue {
+		reports, err := c.queryVideoReports(`
+		SELECT`+videoReportColumns+`
+		FROM video_reports
+		WHERE video_id = ? AND resolved_at IS NULL
+		ORDER BY created_at, id
+		`, queue[i].Video.ID)
+		if err != nil {
+			return nil, err
+		}
+		queue[i].Reports = reports
+	}
+	return queue, nil
+}
+
+func (c Client) queryVideoReports(query string, args ...any) ([]VideoReport, error) {
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := []VideoReport{}
+	for rows.Next() {
+		report, err := scanVideoReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, rows.Err()
+}
+
+// ResolveVideoReports closes the video's open reports with the moderator's
+// resolution, returning how many there were. Dismissing them unflags the
+// video; upholding them leaves it flagged.
+func (c Client) ResolveVideoReports(videoID, moderatorID uuid.UUID, resolution string) (int64, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+	UPDATE video_reports
+	SET resolved_at = ?, resolution = ?, resolved_by = ?
+	WHERE video_id = ? AND resolved_at IS NULL
+	`, time.Now().UTC(), resolution, moderatorID, videoID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if resolution == ReportDismissed {
+		if _, err := tx.Exec("UPDATE videos SET flagged = FALSE WHERE id = ?", videoID); err != nil {
+			return 0, err
+		}
+	}
+	return n, tx.Commit()
+}
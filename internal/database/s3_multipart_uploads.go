@@ -0,0 +1,107 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// S3MultipartUpload is an S3 multipart upload the app has started and not
+// yet completed or aborted, with the parts S3 has accepted so far. It
+// outlives the process, so an upload interrupted by a restart can carry on
+// from the parts that made it instead of starting over.
+type S3MultipartUpload struct {
+	UploadID string
+	Key      string
+	Size     int64
+	PartSize int64
+	// SSECustomerKeyMD5 identifies the SSE-C key the parts were encrypted
+	// with; every part of an upload has to use the same one.
+	SSECustomerKeyMD5 string
+	CreatedAt         time.Time
+	Parts             []S3MultipartPart
+}
+
+type S3MultipartPart struct {
+	PartNumber    int
+	ETag          string
+	ChecksumCRC32 string
+}
+
+func (c Client) CreateS3MultipartUpload(upload S3MultipartUpload) error {
+	query := `
+	INSERT INTO s3_multipart_uploads (upload_id, key, size, part_size, sse_customer_key_md5, created_at)
+	VALUES (?, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, upload.UploadID, upload.Key, upload.Size, upload.PartSize, upload.SSECustomerKeyMD5, time.Now().UTC())
+	return err
+}
+
+// GetS3MultipartUpload returns the most recent unfinished upload to key with
+// its parts, or an empty S3MultipartUpload if there is none.
+func (c Client) GetS3MultipartUpload(key string) (S3MultipartUpload, error) {
+	query := `
+	SELECT upload_id, key, size, part_size, sse_customer_key_md5, created_at
+	FROM s3_multipart_uploads
+	WHERE key = ?
+	ORDER BY created_at DESC
+	LIMIT 1
+	`
+	var upload S3MultipartUpload
+	err := c.db.QueryRow(query, key).Scan(
+		&upload.UploadID,
+		&upload.Key,
+		&upload.Size,
+		&upload.PartSize,
+		&upload.SSECustomerKeyMD5,
+		&upload.CreatedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return S3MultipartUpload{}, nil
+	}
+	if err != nil {
+		return S3MultipartUpload{}, err
+	}
+
+	rows, err := c.db.Query(`
+	SELECT part_number, etag, checksum_crc32
+	FROM s3_multipart_parts
+	WHERE upload_id = ?
+	ORDER BY part_number
+	`, upload.UploadID)
+	if err != nil {
+		return S3MultipartUpload{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var part S3MultipartPart
+		if err := rows.Scan(&part.PartNumber, &part.ETag, &part.ChecksumCRC32); err != nil {
+			return S3MultipartUpload{}, err
+		}
+		upload.Parts = append(upload.Parts, part)
+	}
+	return upload, rows.Err()
+}
+
+// PutS3MultipartPart records a part S3 has accepted, replacing any earlier
+// upload of the same part number.
+func (c Client) PutS3MultipartPart(uploadID string, part S3MultipartPart) error {
+	query := `
+	INSERT INTO s3_multipart_parts (upload_id, part_number, etag, checksum_crc32)
+	VALUES (?, ?, ?, ?)
+	ON CONFLICT(upload_id, part_number) DO UPDATE SET
+		etag = excluded.etag,
+		checksum_crc32 = excluded.checksum_crc32
+	`
+	_, err := c.db.Exec(query, uploadID, part.PartNumber, part.ETag, part.ChecksumCRC32)
+	return err
+}
+
+// DeleteS3MultipartUpload forgets an upload once it's completed or aborted.
+func (c Client) DeleteS3MultipartUpload(uploadID string) error {
+	if _, err := c.db.Exec("DELETE FROM s3_multipart_parts WHERE upload_id = ?", uploadID); err != nil {
+		return err
+	}
+	_, err := c.db.Exec("DELETE FROM s3_multipart_uploads WHERE upload_id = ?", uploadID)
+	return err
+}
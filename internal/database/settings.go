@@ -0,0 +1,32 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// GetSetting returns the stored value of a runtime setting, reporting false
+// if it has never been set.
+func (c Client) GetSetting(key string) (string, bool, error) {
+	var value string
+	err := c.db.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+func (c Client) PutSetting(key, value string) error {
+	query := `
+	INSERT INTO settings (key, value, updated_at)
+	VALUES (?, ?, CURRENT_TIMESTAMP)
+	ON CONFLICT(key) DO UPDATE SET
+		value = excluded.value,
+		updated_at = excluded.updated_at
+	`
+	_, err := c.db.Exec(query, key, value)
+	return err
+}
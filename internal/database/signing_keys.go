@@ -0,0 +1,135 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SigningKey is a secret a server-side integration signs its requests with
+// instead of sending a bearer token. The secret is only returned when the
+// key is created.
+type SigningKey struct {
+	ID         uuid.UUID  `json:"id"`
+	UserID     uuid.UUID  `json:"user_id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+func (c Client) CreateSigningKey(userID uuid.UUID, name, secret string) (SigningKey, error) {
+	key := SigningKey{
+		ID:        uuid.New(),
+		UserID:    userID,
+		Name:      name,
+		CreatedAt: time.Now().UTC(),
+	}
+	query := `
+	INSERT INTO signing_keys (id, user_id, name, secret, created_at)
+	VALUES (?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, key.ID, key.UserID, key.Name, secret, key.CreatedAt)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	return key, nil
+}
+
+// GetSigningKey returns a key and its secret. The key's ID is zero if there
+// is none.
+func (c Client) GetSigningKey(id uuid.UUID) (SigningKey, string, error) {
+	query := `
+	SELECT id, user_id, name, created_at, last_used_at, secret
+	FROM signing_keys
+	WHERE id = ?
+	`
+	var key SigningKey
+	var secret string
+	err := c.db.QueryRow(query, id).Scan(&key.ID, &key.UserID, &key.Name, &key.CreatedAt, &key.LastUsedAt, &secret)
+	if errors.Is(err, sql.ErrNoRows) {
+		return SigningKey{}, "", nil
+	}
+	return key, secret, err
+}
+
+func (c Client) GetSigningKeysForUser(userID uuid.UUID) ([]SigningKey, error) {
+	query := `
+	SELECT id, user_id, name, created_at, last_used_at
+	FROM signing_keys
+	WHERE user_id = ?
+	ORDER BY created_at DESC
+	`
+	rows, err := c.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []SigningKey{}
+	for rows.Next() {
+		var key SigningKey
+		if err := rows.Scan(&key.ID, &key.UserID, &key.Name, &key.CreatedAt, &key.LastUsedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// TouchSigningKey records that a key was just used.
+func (c Client) TouchSigningKey(id uuid.UUID) error {
+	_, err := c.db.Exec("UPDATE signing_keys SET last_used_at = ? WHERE id = ?", time.Now().UTC(), id)
+	return err
+}
+
+// DeleteSigningKey revokes one of the user's keys, reporting whether it
+// existed.
+func (c Client) DeleteSigningKey(userID, id uuid.UUID) (bool, error) {
+	result, err := c.db.Exec("DELETE FROM signing_keys WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteSigningKeysForUser revokes every key of a user and returns how many
+// there were.
+func (c Client) DeleteSigningKeysForUser(userID uuid.UUID) (int, error) {
+	result, err := c.db.Exec("DELETE FROM signing_keys WHERE user_id = ?", userID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// RecordRequestSignature remembers a request signature until expiresAt. It
+// reports false if the signature was already recorded, meaning the request
+// is being replayed. Recording is a single insert, so two nodes can't both
+// accept the same request.
+func (c Client) RecordRequestSignature(signature string, expiresAt time.Time) (bool, error) {
+	query := `
+	INSERT INTO request_signatures (signature, expires_at)
+	VALUES (?, ?)
+	ON CONFLICT(signature) DO NOTHING
+	`
+	result, err := c.db.Exec(query, signature, expiresAt.UTC())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteExpiredRequestSignatures forgets signatures too old to be accepted
+// anyway.
+func (c Client) DeleteExpiredRequestSignatures() (int64, error) {
+	result, err := c.db.Exec("DELETE FROM request_signatures WHERE expires_at <= ?", time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,69 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// busyTimeoutMillis is how long a connection waits on another's lock
+// before SQLite gives up with "database is locked".
+const busyTimeoutMillis = 5000
+
+// openPrimary opens the primary database twice: a pool of connections for
+// reads, and a single connection every write goes through. SQLite only
+// allows one writer at a time anyway; queueing writes in database/sql
+// instead of letting them race for the lock means a burst of uploads
+// finishing together waits its turn rather than failing the final update.
+// In WAL mode, reads carry on while a write is in progress.
+func openPrimary(pathToDB string) (reader, writer *sql.DB, err error) {
+	// Transactions take the write lock when they begin. A deferred
+	// transaction that reads first and then tries to write can fail with
+	// SQLITE_BUSY straight away, without waiting for busy_timeout
+	writer, err = sql.Open("sqlite3", sqliteDSN(pathToDB, "_journal_mode=WAL", "_synchronous=NORMAL", "_txlock=immediate"))
+	if err != nil {
+		return nil, nil, err
+	}
+	writer.SetMaxOpenConns(1)
+	// WAL mode is a property of the file, so the writer sets it before any
+	// reader connects
+	if err := writer.Ping(); err != nil {
+		writer.Close()
+		return nil, nil, err
+	}
+
+	reader, err = sql.Open("sqlite3", sqliteDSN(pathToDB))
+	if err != nil {
+		writer.Close()
+		return nil, nil, err
+	}
+	return reader, writer, nil
+}
+
+// sqliteDSN adds driver parameters to a database path, which may already
+// have some of its own.
+func sqliteDSN(pathToDB string, params ...string) string {
+	params = append(params, "_busy_timeout="+strconv.Itoa(busyTimeoutMillis))
+	sep := "?"
+	if strings.Contains(pathToDB, "?") {
+		sep = "&"
+	}
+	return pathToDB + sep + strings.Join(params, "&")
+}
+
+// Snapshot writes a consistent copy of the primary database to path, which
+// must not exist yet. It reads from a snapshot of its own, so writes carry
+// on while it runs.
+func (c Client) Snapshot(path string) error {
+	return c.db.breaker.call(func() error {
+		_, err := c.db.primary.Exec("VACUUM INTO ?", path)
+		return err
+	})
+}
+
+// Close closes the primary database's connections. Replicas are left to
+// the process exiting.
+func (c Client) Close() error {
+	return errors.Join(c.db.primary.Close(), c.db.writer.Close())
+}
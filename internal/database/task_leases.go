@@ -0,0 +1,27 @@
+package database
+
+import (
+	"time"
+)
+
+// AcquireTaskLease makes holder the only instance allowed to run the named
+// task until ttl from now. It succeeds when nobody holds the lease, when the
+// current lease has expired, or when holder already has it, in which case
+// the lease is renewed.
+func (c Client) AcquireTaskLease(name, holder string, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	query := `
+	INSERT INTO task_leases (name, holder, expires_at)
+	VALUES (?, ?, ?)
+	ON CONFLICT(name) DO UPDATE SET
+		holder = excluded.holder,
+		expires_at = excluded.expires_at
+	WHERE task_leases.holder = excluded.holder OR task_leases.expires_at < ?
+	`
+	result, err := c.db.Exec(query, name, holder, now.Add(ttl), now)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
@@ -0,0 +1,59 @@
+package database
+
+import (
+	"time"
+)
+
+// Thumbnail variants are resized or re-encoded copies of a stored thumbnail,
+// named like "640.jpg". They belong to the source image rather than to a
+// video, so clips and duplicates sharing a thumbnail share its variants.
+
+// GetThumbnailVariants returns the variants of a thumbnail by name.
+func (c Client) GetThumbnailVariants(sourceURL string) (map[string]string, error) {
+	query := `
+	SELECT variant, url
+	FROM thumbnail_variants
+	WHERE source_url = ?
+	`
+	rows, err := c.db.Query(query, sourceURL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	variants := map[string]string{}
+	for rows.Next() {
+		var variant, url string
+		if err := rows.Scan(&variant, &url); err != nil {
+			return nil, err
+		}
+		variants[variant] = url
+	}
+	return variants, rows.Err()
+}
+
+func (c Client) PutThumbnailVariant(sourceURL, variant, url string) error {
+	query := `
+	INSERT INTO thumbnail_variants (source_url, variant, url, created_at)
+	VALUES (?, ?, ?, ?)
+	ON CONFLICT(source_url, variant) DO UPDATE SET
+		url = excluded.url,
+		created_at = excluded.created_at
+	`
+	_, err := c.db.Exec(query, sourceURL, variant, url, time.Now().UTC())
+	return err
+}
+
+// CountOtherThumbnailVariants counts variants of thumbnails other than
+// sourceURL stored at url. Variants are named by content, so the same image
+// can be a variant of more than one thumbnail.
+func (c Client) CountOtherThumbnailVariants(url, sourceURL string) (int, error) {
+	var count int
+	err := c.db.QueryRow("SELECT COUNT(*) FROM thumbnail_variants WHERE url = ? AND source_url != ?", url, sourceURL).Scan(&count)
+	return count, err
+}
+
+func (c Client) DeleteThumbnailVariants(sourceURL string) error {
+	_, err := c.db.Exec("DELETE FROM thumbnail_variants WHERE source_url = ?", sourceURL)
+	return err
+}
@@ -0,0 +1,173 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TrendingActivity is views or likes a video got at a time: the views of
+// an hour, or a single like.
+type TrendingActivity struct {
+	VideoID uuid.UUID
+	At      time.Time
+	Views   int
+	Likes   int
+}
+
+// TrendingScore is a video's place in the trending feed.
+type TrendingScore struct {
+	VideoID uuid.UUID
+	Score   float64
+}
+
+type TrendingVideo struct {
+	Video
+	Score float64 `json:"score"`
+}
+
+// RecordVideoView counts a view of the video in the hour it happened.
+func (c Client) RecordVideoView(videoID uuid.UUID, at time.Time) error {
+	query := `
+	INSERT INTO video_views (video_id, hour, views)
+	VALUES (?, ?, 1)
+	ON CONFLICT(video_id, hour) DO UPDATE SET views = views + 1
+	`
+	_, err := c.db.Exec(query, videoID, at.UTC().Truncate(time.Hour))
+	return err
+}
+
+// SetVideoLike records or withdraws the user's like of the video. Liking
+// twice keeps the first like's time.
+func (c Client) SetVideoLike(videoID, userID uuid.UUID, liked bool) error {
+	if !liked {
+		_, err := c.db.Exec("DELETE FROM video_likes WHERE video_id = ? AND user_id = ?", videoID, userID)
+		return err
+	}
+	query := `
+	INSERT INTO video_likes (video_id, user_id, created_at)
+	VALUES (?, ?, ?)
+	ON CONFLICT(video_id, user_id) DO NOTHING
+	`
+	_, err := c.db.Exec(query, videoID, userID, time.Now().UTC())
+	return err
+}
+
+// GetVideoLikes returns how many users like the video, and whether userID
+// is one of them.
+func (c Client) GetVideoLikes(videoID, userID uuid.UUID) (int, bool, error) {
+	var likes int
+	var liked bool
+	err := c.db.QueryRow(
+		"SELECT COUNT(*), COALESCE(SUM(user_id = ?), 0) > 0 FROM video_likes WHERE video_id = ?",
+		userID, videoID,
+	).Scan(&likes, &liked)
+	return likes, liked, err
+}
+
+// GetTrendingActivity returns the views and likes since the given time of
+// public videos with a file that aren't flagged, the ones that can trend.
+func (c Client) GetTrendingActivity(since time.Time) ([]TrendingActivity, error) {
+	activity := []TrendingActivity{}
+	for _, query := range []string{`
+	SELECT video_views.video_id, video_views.hour, video_views.views, 0
+	FROM video_views
+	JOIN videos ON videos.id = video_views.video_id
+	WHERE video_views.hour >= ?
+		AND videos.visibility = '` + VisibilityPublic + `'
+		AND videos.video_url IS NOT NULL
+		AND NOT videos.flagged
+	`, `
+	SELECT video_likes.video_id, video_likes.created_at, 0, 1
+	FROM video_likes
+	JOIN videos ON videos.id = video_likes.video_id
+	WHERE video_likes.created_at >= ?
+		AND videos.visibility = '` + VisibilityPublic + `'
+		AND videos.video_url IS NOT NULL
+		AND NOT videos.flagged
+	`} {
+		rows, err := c.db.Query(query, since.UTC())
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var a TrendingActivity
+			if err := rows.Scan(&a.VideoID, &a.At, &a.Views, &a.Likes); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			activity = append(activity, a)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return activity, nil
+}
+
+// ReplaceTrendingVideos makes scores the whole trending feed.
+func (c Client) ReplaceTrendingVideos(scores []TrendingScore, computedAt time.Time) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM trending_videos"); err != nil {
+		return err
+	}
+	for _, s := range scores {
+		_, err := tx.Exec(
+			"INSERT INTO trending_videos (video_id, score, computed_at) VALUES (?, ?, ?)",
+			s.VideoID, s.Score, computedAt.UTC(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetTrendingVideos returns up to limit videos of the trending feed, best
+// first. Videos made private or flagged since the feed was computed are
+// left out.
+func (c Client) GetTrendingVideos(limit int) ([]TrendingVideo, error) {
+	query := `
+	SELECT` + videoColumns + `, trending_videos.score
+	FROM trending_videos
+	JOIN videos ON videos.id = trending_videos.video_id
+	WHERE videos.visibility = '` + VisibilityPublic + `'
+		AND videos.video_url IS NOT NULL
+		AND NOT videos.flagged
+	ORDER BY trending_videos.score DESC, videos.created_at DESC
+	LIMIT ?
+	`
+	rows, err := c.db.Query(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []TrendingVideo{}
+	for rows.Next() {
+		var video TrendingVideo
+		video.Video, err = scanVideo(rows, &video.Score)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+	return videos, rows.Err()
+}
+
+// DeleteVideoViewsBefore forgets the view counts of hours before the given
+// time, which are too old to count toward trending.
+func (c Client) DeleteVideoViewsBefore(before time.Time) (int64, error) {
+	result, err := c.db.Exec("DELETE FROM video_views WHERE hour < ?", before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
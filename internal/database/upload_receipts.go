@@ -0,0 +1,50 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UploadReceipt is a signed receipt issued for a stored upload, kept so
+// its owner can fetch it again later.
+type UploadReceipt struct {
+	ID        uuid.UUID `json:"id"`
+	VideoID   uuid.UUID `json:"video_id"`
+	Receipt   string    `json:"receipt"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (c Client) CreateUploadReceipt(receipt UploadReceipt) error {
+	query := `
+	INSERT INTO upload_receipts (id, video_id, receipt, created_at)
+	VALUES (?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, receipt.ID, receipt.VideoID, receipt.Receipt, receipt.CreatedAt.UTC())
+	return err
+}
+
+// GetUploadReceiptsForVideo lists a video's receipts, newest first.
+func (c Client) GetUploadReceiptsForVideo(videoID uuid.UUID) ([]UploadReceipt, error) {
+	query := `
+	SELECT id, video_id, receipt, created_at
+	FROM upload_receipts
+	WHERE video_id = ?
+	ORDER BY created_at DESC
+	`
+	rows, err := c.db.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	receipts := []UploadReceipt{}
+	for rows.Next() {
+		var receipt UploadReceipt
+		if err := rows.Scan(&receipt.ID, &receipt.VideoID, &receipt.Receipt, &receipt.CreatedAt); err != nil {
+			return nil, err
+		}
+		receipts = append(receipts, receipt)
+	}
+	return receipts, rows.Err()
+}
@@ -0,0 +1,309 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	UploadTargetProxy     = "proxy"
+	UploadTargetPresigned = "presigned"
+)
+
+const (
+	UploadStatusPending    = "pending"
+	UploadStatusProcessing = "processing"
+	UploadStatusCompleted  = "completed"
+	UploadStatusFailed     = "failed"
+)
+
+// UploadOptions are the processing choices that the multipart upload
+// endpoint takes as form values, declared up front for an upload session.
+type UploadOptions struct {
+	TrimDeadAir  bool   `json:"trim_dead_air"`
+	IntroVideoID string `json:"intro_video_id"`
+	OutroVideoID string `json:"outro_video_id"`
+	Watermark    bool   `json:"watermark"`
+	Encrypt      bool   `json:"encrypt"`
+}
+
+// UploadSession is a video upload whose file was described before any of
+// it was sent. Finalizing checks the received bytes against the declared
+// size and SHA-256 checksum. A non-zero PartSize means a proxy session
+// receives the file as numbered parts of that size, the last one shorter.
+// Otherwise BytesReceived is how much of a proxy session's file has been
+// kept so far, which is where an interrupted upload resumes.
+type UploadSession struct {
+	ID             uuid.UUID `json:"id"`
+	CreatedAt      time.Time `json:"created_at"`
+	ExpiresAt      time.Time `json:"expires_at"`
+	UserID         uuid.UUID `json:"user_id"`
+	VideoID        uuid.UUID `json:"video_id"`
+	Filename       string    `json:"filename"`
+	Size           int64     `json:"size"`
+	ContentType    string    `json:"content_type"`
+	ChecksumSHA256 string    `json:"checksum_sha256"`
+	Target         string    `json:"target"`
+	PartSize       int64     `json:"part_size"`
+	BytesReceived  int64     `json:"bytes_received"`
+	Status         string    `json:"status"`
+	Error          *string   `json:"error"`
+	// Timings is how long each processing step has taken so far, as a JSON
+	// object of milliseconds, or null before processing starts.
+	Timings json.RawMessage `json:"timings"`
+	UploadOptions
+}
+
+const uploadSessionColumns = `
+		id,
+		created_at,
+		expires_at,
+		user_id,
+		video_id,
+		filename,
+		size,
+		content_type,
+		checksum_sha256,
+		target,
+		part_size,
+		bytes_received,
+		status,
+		error,
+		trim_dead_air,
+		intro_video_id,
+		outro_video_id,
+		watermark,
+		encrypt,
+		timings`
+
+func scanUploadSession(row rowScanner) (UploadSession, error) {
+	var session UploadSession
+	var timings sql.NullString
+	err := row.Scan(
+		&session.ID,
+		&session.CreatedAt,
+		&session.ExpiresAt,
+		&session.UserID,
+		&session.VideoID,
+		&session.Filename,
+		&session.Size,
+		&session.ContentType,
+		&session.ChecksumSHA256,
+		&session.Target,
+		&session.PartSize,
+		&session.BytesReceived,
+		&session.Status,
+		&session.Error,
+		&session.TrimDeadAir,
+		&session.IntroVideoID,
+		&session.OutroVideoID,
+		&session.Watermark,
+		&session.Encrypt,
+		&timings,
+	)
+	if timings.Valid {
+		session.Timings = json.RawMessage(timings.String)
+	}
+	return session, err
+}
+
+func (c Client) CreateUploadSession(session UploadSession) (UploadSession, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO upload_sessions (
+		id,
+		created_at,
+		expires_at,
+		user_id,
+		video_id,
+		filename,
+		size,
+		content_type,
+		checksum_sha256,
+		target,
+		part_size,
+		status,
+		trim_dead_air,
+		intro_video_id,
+		outro_video_id,
+		watermark,
+		encrypt
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query,
+		id,
+		session.ExpiresAt.UTC(),
+		session.UserID,
+		session.VideoID,
+		session.Filename,
+		session.Size,
+		session.ContentType,
+		session.ChecksumSHA256,
+		session.Target,
+		session.PartSize,
+		UploadStatusPending,
+		session.TrimDeadAir,
+		session.IntroVideoID,
+		session.OutroVideoID,
+		session.Watermark,
+		session.Encrypt,
+	)
+	if err != nil {
+		return UploadSession{}, err
+	}
+	return c.GetUploadSession(id)
+}
+
+func (c Client) GetUploadSession(id uuid.UUID) (UploadSession, error) {
+	query := `SELECT` + uploadSessionColumns + `
+	FROM upload_sessions
+	WHERE id = ?
+	`
+	session, err := scanUploadSession(c.db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return UploadSession{}, nil
+	}
+	return session, err
+}
+
+// ClaimUploadSession moves a pending, unexpired session to processing,
+// reporting false if another request got there first or it has expired.
+func (c Client) ClaimUploadSession(id uuid.UUID) (bool, error) {
+	query := `
+	UPDATE upload_sessions
+	SET status = ?
+	WHERE id = ? AND status = ? AND expires_at > ?
+	`
+	result, err := c.db.Exec(query, UploadStatusProcessing, id, UploadStatusPending, time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// RecoverUploadSession hands a session back to its client as pending when
+// it's stuck processing with nothing processing it: no request holds the
+// video's upload lock for it and no job for it is queued or running. That's
+// what a restart leaves behind for a request that was interrupted.
+func (c Client) RecoverUploadSession(id uuid.UUID) (bool, error) {
+	now := time.Now().UTC()
+	query := `
+	UPDATE upload_sessions
+	SET status = ?
+	WHERE id = ? AND status = ?
+		AND NOT EXISTS (
+			SELECT 1 FROM video_upload_locks
+			WHERE session_id = upload_sessions.id AND expires_at > ?
+		)
+		AND NOT EXISTS (
+			SELECT 1 FROM jobs
+			WHERE kind = ? AND subject_id = upload_sessions.id AND status IN (?, ?)
+		)
+	`
+	result, err := c.db.Exec(query,
+		UploadStatusPending, id, UploadStatusProcessing,
+		now,
+		JobKindUploadSession, JobStatusQueued, JobStatusRunning,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// SetUploadSessionStatus records what became of a claimed session: completed,
+// failed with a reason, or back to pending so the client can retry.
+func (c Client) SetUploadSessionStatus(id uuid.UUID, status string, failure *string) error {
+	query := `
+	UPDATE upload_sessions
+	SET status = ?, error = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, status, failure, id)
+	return err
+}
+
+// SetUploadSessionTimings records how long the session's processing steps
+// have taken so far.
+func (c Client) SetUploadSessionTimings(id uuid.UUID, timings json.RawMessage) error {
+	query := `
+	UPDATE upload_sessions
+	SET timings = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, string(timings), id)
+	return err
+}
+
+// SetUploadSessionBytesReceived records how much of a proxy session's file
+// is safely on disk.
+func (c Client) SetUploadSessionBytesReceived(id uuid.UUID, n int64) error {
+	query := `
+	UPDATE upload_sessions
+	SET bytes_received = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, n, id)
+	return err
+}
+
+// PartCount is the number of parts a multi-part session is split into.
+func (s UploadSession) PartCount() int {
+	if s.PartSize <= 0 {
+		return 0
+	}
+	return int((s.Size + s.PartSize - 1) / s.PartSize)
+}
+
+// UploadSessionPart is one received part of a multi-part session.
+type UploadSessionPart struct {
+	PartNumber     int       `json:"part_number"`
+	Size           int64     `json:"size"`
+	ChecksumSHA256 string    `json:"checksum_sha256"`
+	ReceivedAt     time.Time `json:"received_at"`
+}
+
+// PutUploadSessionPart records a received part, replacing any earlier
+// upload of the same part number.
+func (c Client) PutUploadSessionPart(sessionID uuid.UUID, part UploadSessionPart) error {
+	query := `
+	INSERT INTO upload_session_parts (session_id, part_number, size, checksum_sha256, received_at)
+	VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+	ON CONFLICT(session_id, part_number) DO UPDATE SET
+		size = excluded.size,
+		checksum_sha256 = excluded.checksum_sha256,
+		received_at = excluded.received_at
+	`
+	_, err := c.db.Exec(query, sessionID, part.PartNumber, part.Size, part.ChecksumSHA256)
+	return err
+}
+
+func (c Client) GetUploadSessionParts(sessionID uuid.UUID) ([]UploadSessionPart, error) {
+	query := `
+	SELECT part_number, size, checksum_sha256, received_at
+	FROM upload_session_parts
+	WHERE session_id = ?
+	ORDER BY part_number
+	`
+	rows, err := c.db.Query(query, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	parts := []UploadSessionPart{}
+	for rows.Next() {
+		var part UploadSessionPart
+		if err := rows.Scan(&part.PartNumber, &part.Size, &part.ChecksumSHA256, &part.ReceivedAt); err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+	return parts, rows.Err()
+}
@@ -0,0 +1,75 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+// UserSettings are a user's preferences: defaults for new videos and
+// uploads, used where a request doesn't say otherwise, and whether their
+// playback history is kept.
+type UserSettings struct {
+	// DefaultVisibility is the visibility new videos start out with.
+	DefaultVisibility string `json:"default_visibility"`
+	// UploadDefaults are the processing options of uploads that don't set
+	// their own.
+	UploadDefaults UploadDefaults `json:"upload_defaults"`
+	// WatchHistory opts the user in to keeping their playback history,
+	// which is also where resume positions come from.
+	WatchHistory bool `json:"watch_history"`
+}
+
+// UploadDefaults are the processing options that can be defaulted per
+// user: the parts of UploadOptions that aren't about a particular video.
+type UploadDefaults struct {
+	TrimDeadAir bool `json:"trim_dead_air"`
+	Watermark   bool `json:"watermark"`
+	Encrypt     bool `json:"encrypt"`
+}
+
+// GetUserSettings returns the user's settings, or the defaults if they've
+// never changed them.
+func (c Client) GetUserSettings(userID uuid.UUID) (UserSettings, error) {
+	settings := UserSettings{DefaultVisibility: VisibilityPrivate}
+	err := c.db.QueryRow(`
+	SELECT default_visibility, trim_dead_air, watermark, encrypt, watch_history
+	FROM user_settings
+	WHERE user_id = ?
+	`, userID).Scan(
+		&settings.DefaultVisibility,
+		&settings.UploadDefaults.TrimDeadAir,
+		&settings.UploadDefaults.Watermark,
+		&settings.UploadDefaults.Encrypt,
+		&settings.WatchHistory,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return settings, nil
+	}
+	return settings, err
+}
+
+// UpdateUserSettings replaces the user's settings.
+func (c Client) UpdateUserSettings(userID uuid.UUID, settings UserSettings) error {
+	query := `
+	INSERT INTO user_settings (user_id, default_visibility, trim_dead_air, watermark, encrypt, watch_history, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+	ON CONFLICT(user_id) DO UPDATE SET
+		default_visibility = excluded.default_visibility,
+		trim_dead_air = excluded.trim_dead_air,
+		watermark = excluded.watermark,
+		encrypt = excluded.encrypt,
+		watch_history = excluded.watch_history,
+		updated_at = excluded.updated_at
+	`
+	_, err := c.db.Exec(query,
+		userID,
+		settings.DefaultVisibility,
+		settings.UploadDefaults.TrimDeadAir,
+		settings.UploadDefaults.Watermark,
+		settings.UploadDefaults.Encrypt,
+		settings.WatchHistory,
+	)
+	return err
+}
@@ -9,9 +9,15 @@ import (
 )
 
 type User struct {
-	ID        uuid.UUID `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID           uuid.UUID  `json:"id"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+	IntroVideoID *uuid.UUID `json:"intro_video_id"`
+	OutroVideoID *uuid.UUID `json:"outro_video_id"`
+	IsAdmin      bool       `json:"is_admin"`
+	StreamKey    *string    `json:"-"`
+	Tier         string     `json:"tier"`
+	Disabled     bool       `json:"disabled"`
 	CreateUserParams
 }
 
@@ -20,6 +26,47 @@ type CreateUserParams struct {
 	Password string `json:"password"`
 }
 
+// userColumns is the column list shared by every query that loads a full
+// User, in the order expected by scanUser.
+const userColumns = `
+		u.id,
+		u.created_at,
+		u.updated_at,
+		u.email,
+		u.password,
+		u.intro_video_id,
+		u.outro_video_id,
+		u.is_admin,
+		u.stream_key,
+		u.tier,
+		u.disabled`
+
+func scanUser(row rowScanner) (User, error) {
+	var user User
+	var id string
+	err := row.Scan(
+		&id,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.Email,
+		&user.Password,
+		&user.IntroVideoID,
+		&user.OutroVideoID,
+		&user.IsAdmin,
+		&user.StreamKey,
+		&user.Tier,
+		&user.Disabled,
+	)
+	if err != nil {
+		return User{}, err
+	}
+	user.ID, err = uuid.Parse(id)
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
 func (c Client) GetUsers() ([]User, error) {
 	query := `
 		SELECT
@@ -53,47 +100,35 @@ func (c Client) GetUsers() ([]User, error) {
 
 func (c Client) GetUserByEmail(email string) (User, error) {
 	query := `
-		SELECT id, created_at, updated_at, email, password
-		FROM users
-		WHERE email = ?
+		SELECT` + userColumns + `
+		FROM users u
+		WHERE u.email = ?
 	`
-	var user User
-	var id string
-	err := c.db.QueryRow(query, email).Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password)
+	user, err := scanUser(c.db.QueryRow(query, email))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return User{}, nil
 		}
 		return User{}, err
 	}
-	user.ID, err = uuid.Parse(id)
-	if err != nil {
-		return User{}, err
-	}
 	return user, nil
 }
 
 func (c Client) GetUserByRefreshToken(token string) (*User, error) {
 	query := `
-		SELECT u.id, u.email, u.created_at, u.updated_at, u.password
+		SELECT` + userColumns + `
 		FROM users u
 		JOIN refresh_tokens rt ON u.id = rt.user_id
 		WHERE rt.token = ?
 	`
 
-	var user User
-	var id string
-	err := c.db.QueryRow(query, token).Scan(&id, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.Password)
+	user, err := scanUser(c.db.QueryRow(query, token))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
 		}
 		return nil, err
 	}
-	user.ID, err = uuid.Parse(id)
-	if err != nil {
-		return nil, err
-	}
 
 	return &user, nil
 }
@@ -117,31 +152,203 @@ func (c Client) CreateUser(params CreateUserParams) (*User, error) {
 
 func (c Client) GetUser(id uuid.UUID) (*User, error) {
 	query := `
-		SELECT id, created_at, updated_at, email, password
-		FROM users
-		WHERE id = ?
+		SELECT` + userColumns + `
+		FROM users u
+		WHERE u.id = ?
 	`
-	var user User
-	var idStr string
-	err := c.db.QueryRow(query, id.String()).Scan(&idStr, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password)
+	user, err := scanUser(c.db.QueryRow(query, id.String()))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
 		}
 		return nil, err
 	}
-	user.ID, err = uuid.Parse(idStr)
+	return &user, nil
+}
+
+// UpdateUserIntroOutro sets the clips stitched onto the start and end of the
+// user's uploads. A nil ID clears that side.
+func (c Client) UpdateUserIntroOutro(id uuid.UUID, introVideoID, outroVideoID *uuid.UUID) error {
+	query := `
+		UPDATE users
+		SET
+			intro_video_id = ?,
+			outro_video_id = ?,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err := c.db.Exec(query, introVideoID, outroVideoID, id.String())
+	return err
+}
+
+// UpdateUserPassword replaces the user's password hash, as when a sign-in
+// upgrades it to the current hashing settings.
+func (c Client) UpdateUserPassword(id uuid.UUID, hashedPassword string) error {
+	query := `
+		UPDATE users
+		SET password = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err := c.db.Exec(query, hashedPassword, id.String())
+	return err
+}
+
+// deletedUserPlaceholder stands in for a deleted user's ID and email in the
+// audit log and video event payloads.
+const deletedUserPlaceholder = "[deleted user]"
+
+// DeleteUser removes a user and their personal data. The audit log, video
+// events and reports they filed are kept, but no longer say which of them
+// were the user's doing or mention their ID or email. It returns the
+// prefixes of their quarantined uploads, whose copies the caller has to
+// remove from storage.
+func (c Client) DeleteUser(id uuid.UUID) ([]string, error) {
+	tx, err := c.db.Begin()
 	if err != nil {
 		return nil, err
 	}
-	return &user, nil
+	defer tx.Rollback()
+
+	var email string
+	err = tx.QueryRow("SELECT email FROM users WHERE id = ?", id.String()).Scan(&email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, table := range []string{"video_likes", "user_settings", "watch_history", "watch_later", "watermark_settings", "upload_sessions", "jobs"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE user_id = ?", id); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM video_transfers WHERE from_user_id = ? OR to_user_id = ?", id, id); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM login_attempts WHERE subject = ?", LoginAccountSubject(email)); err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query("DELETE FROM input_failures WHERE user_id = ? RETURNING quarantine_prefix", id)
+	if err != nil {
+		return nil, err
+	}
+	quarantinePrefixes := []string{}
+	for rows.Next() {
+		var prefix sql.NullString
+		if err := rows.Scan(&prefix); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if prefix.Valid {
+			quarantinePrefixes = append(quarantinePrefixes, prefix.String)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Columns that have to hold an ID get the nil UUID
+	anonymize := []string{
+		"UPDATE audit_log SET actor_id = NULL WHERE actor_id = ?",
+		"UPDATE video_events SET actor_id = NULL WHERE actor_id = ?",
+		"UPDATE video_events SET owner_id = '" + uuid.Nil.String() + "' WHERE owner_id = ?",
+		"UPDATE video_reports SET reporter_id = '" + uuid.Nil.String() + "' WHERE reporter_id = ?",
+	}
+	for _, query := range anonymize {
+		if _, err := tx.Exec(query, id); err != nil {
+			return nil, err
+		}
+	}
+	for _, identifier := range []string{id.String(), email} {
+		for _, query := range []string{
+			"UPDATE audit_log SET details = REPLACE(details, ?, ?) WHERE instr(details, ?) > 0",
+			"UPDATE video_events SET payload = REPLACE(payload, ?, ?) WHERE instr(payload, ?) > 0",
+		} {
+			if _, err := tx.Exec(query, identifier, deletedUserPlaceholder, identifier); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM users WHERE id = ?", id.String()); err != nil {
+		return nil, err
+	}
+	return quarantinePrefixes, tx.Commit()
 }
 
-func (c Client) DeleteUser(id uuid.UUID) error {
+// SetUserAdmin grants or revokes admin rights for the user with the given
+// email, reporting whether such a user exists.
+func (c Client) SetUserAdmin(email string, isAdmin bool) (bool, error) {
 	query := `
-		DELETE FROM users
+		UPDATE users
+		SET is_admin = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE email = ?
+	`
+	result, err := c.db.Exec(query, isAdmin, email)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// UpdateUserStreamKey replaces the token that authorizes the user's live
+// ingest sessions.
+func (c Client) UpdateUserStreamKey(id uuid.UUID, streamKey string) error {
+	query := `
+		UPDATE users
+		SET stream_key = ?, updated_at = CURRENT_TIMESTAMP
 		WHERE id = ?
 	`
-	_, err := c.db.Exec(query, id.String())
+	_, err := c.db.Exec(query, streamKey, id.String())
 	return err
 }
+
+// SetUserTier moves a user to a different service tier, reporting whether
+// the user exists.
+func (c Client) SetUserTier(id uuid.UUID, tier string) (bool, error) {
+	query := `
+		UPDATE users
+		SET tier = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	result, err := c.db.Exec(query, tier, id.String())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// SetUserDisabled locks a user out of, or lets them back into, their
+// account, reporting whether the user exists.
+func (c Client) SetUserDisabled(id uuid.UUID, disabled bool) (bool, error) {
+	query := `
+		UPDATE users
+		SET disabled = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	result, err := c.db.Exec(query, disabled, id.String())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// IsUserDisabled reports whether the user's account is disabled. It
+// returns sql.ErrNoRows for unknown users, so callers can tell a deleted
+// account from an enabled one.
+func (c Client) IsUserDisabled(id uuid.UUID) (bool, error) {
+	query := `
+		SELECT disabled
+		FROM users
+		WHERE id = ?
+	`
+	var disabled bool
+	err := c.db.QueryRow(query, id.String()).Scan(&disabled)
+	return disabled, err
+}
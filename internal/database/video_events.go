@@ -0,0 +1,103 @@
+package database
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Video lifecycle event types.
+const (
+	VideoEventCreated          = "created"
+	VideoEventUploadStarted    = "upload_started"
+	VideoEventProcessed        = "processed"
+	VideoEventPublished        = "published"
+	VideoEventThumbnailChanged = "thumbnail_changed"
+	VideoEventDeleted          = "deleted"
+	VideoEventFlagged          = "flagged"
+)
+
+// VideoEvent is one transition in a video's life. Payload holds what
+// changed, and differs by type.
+type VideoEvent struct {
+	ID        int64           `json:"id"`
+	CreatedAt time.Time       `json:"created_at"`
+	VideoID   uuid.UUID       `json:"video_id"`
+	OwnerID   uuid.UUID       `json:"owner_id"`
+	ActorID   *uuid.UUID      `json:"actor_id"`
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+const videoEventColumns = `id, created_at, video_id, owner_id, actor_id, type, payload`
+
+func (c Client) CreateVideoEvent(event VideoEvent) error {
+	payload := event.Payload
+	if len(payload) == 0 {
+		payload = json.RawMessage("{}")
+	}
+	query := `
+	INSERT INTO video_events (video_id, owner_id, actor_id, type, payload)
+	VALUES (?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, event.VideoID, event.OwnerID, event.ActorID, event.Type, string(payload))
+	return err
+}
+
+// GetVideoEvents returns a video's events, oldest first.
+func (c Client) GetVideoEvents(videoID uuid.UUID) ([]VideoEvent, error) {
+	query := `
+	SELECT ` + videoEventColumns + `
+	FROM video_events
+	WHERE video_id = ?
+	ORDER BY id
+	`
+	return c.queryVideoEvents(query, videoID)
+}
+
+// GetUndeliveredVideoEvents returns up to limit events that haven't been
+// sent to the events webhook yet, oldest first.
+func (c Client) GetUndeliveredVideoEvents(limit int) ([]VideoEvent, error) {
+	query := `
+	SELECT ` + videoEventColumns + `
+	FROM video_events
+	WHERE delivered_at IS NULL
+	ORDER BY id
+	LIMIT ?
+	`
+	return c.queryVideoEvents(query, limit)
+}
+
+func (c Client) MarkVideoEventDelivered(id int64) error {
+	_, err := c.db.Exec("UPDATE video_events SET delivered_at = CURRENT_TIMESTAMP WHERE id = ?", id)
+	return err
+}
+
+func (c Client) queryVideoEvents(query string, args ...any) ([]VideoEvent, error) {
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []VideoEvent{}
+	for rows.Next() {
+		var event VideoEvent
+		var payload string
+		if err := rows.Scan(
+			&event.ID,
+			&event.CreatedAt,
+			&event.VideoID,
+			&event.OwnerID,
+			&event.ActorID,
+			&event.Type,
+			&payload,
+		); err != nil {
+			return nil, err
+		}
+		event.Payload = json.RawMessage(payload)
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
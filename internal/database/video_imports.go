@@ -0,0 +1,51 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// VideoImport is an object a bucket import turned into a video. The ETag
+// tells whether the object has been replaced since.
+type VideoImport struct {
+	Bucket    string    `json:"bucket"`
+	S3Key     string    `json:"s3_key"`
+	ETag      string    `json:"etag"`
+	VideoID   uuid.UUID `json:"video_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (c Client) GetVideoImport(bucket, s3Key string) (VideoImport, error) {
+	query := `
+	SELECT bucket, s3_key, etag, video_id, created_at
+	FROM video_imports
+	WHERE bucket = ? AND s3_key = ?
+	`
+	var imported VideoImport
+	err := c.db.QueryRow(query, bucket, s3Key).Scan(&imported.Bucket, &imported.S3Key, &imported.ETag, &imported.VideoID, &imported.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return VideoImport{}, nil
+		}
+		return VideoImport{}, err
+	}
+	return imported, nil
+}
+
+// PutVideoImport records an import, replacing the record of an earlier
+// import of the same object.
+func (c Client) PutVideoImport(imported VideoImport) error {
+	query := `
+	INSERT INTO video_imports (bucket, s3_key, etag, video_id, created_at)
+	VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+	ON CONFLICT(bucket, s3_key) DO UPDATE SET
+		etag = excluded.etag,
+		video_id = excluded.video_id,
+		created_at = CURRENT_TIMESTAMP
+	`
+	_, err := c.db.Exec(query, imported.Bucket, imported.S3Key, imported.ETag, imported.VideoID)
+	return err
+}
@@ -0,0 +1,57 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// VideoKey is a keystore entry for a video stored with SSE-C. The data key is
+// only ever persisted in wrapped form.
+type VideoKey struct {
+	VideoID    uuid.UUID `json:"video_id"`
+	S3Key      string    `json:"s3_key"`
+	WrappedKey []byte    `json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func (c Client) PutVideoKey(videoID uuid.UUID, s3Key string, wrappedKey []byte) error {
+	query := `
+	INSERT INTO video_keys (video_id, s3_key, wrapped_key, created_at)
+	VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+	ON CONFLICT(video_id) DO UPDATE SET
+		s3_key = excluded.s3_key,
+		wrapped_key = excluded.wrapped_key,
+		created_at = CURRENT_TIMESTAMP
+	`
+	_, err := c.db.Exec(query, videoID, s3Key, wrappedKey)
+	return err
+}
+
+func (c Client) GetVideoKey(videoID uuid.UUID) (VideoKey, error) {
+	query := `
+	SELECT video_id, s3_key, wrapped_key, created_at
+	FROM video_keys
+	WHERE video_id = ?
+	`
+	var key VideoKey
+	err := c.db.QueryRow(query, videoID).Scan(&key.VideoID, &key.S3Key, &key.WrappedKey, &key.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return VideoKey{}, nil
+		}
+		return VideoKey{}, err
+	}
+	return key, nil
+}
+
+func (c Client) DeleteVideoKey(videoID uuid.UUID) error {
+	query := `
+	DELETE FROM video_keys
+	WHERE video_id = ?
+	`
+	_, err := c.db.Exec(query, videoID)
+	return err
+}
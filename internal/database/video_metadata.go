@@ -0,0 +1,83 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+// ErrTooManyMetadataKeys is returned by PatchVideoMetadata when the patch
+// would leave the video with more keys than allowed.
+var ErrTooManyMetadataKeys = errors.New("too many metadata keys")
+
+// GetVideoMetadata returns the key/value pairs clients have attached to a
+// video. It returns nil when the video doesn't exist.
+func (c Client) GetVideoMetadata(videoID uuid.UUID) (map[string]string, error) {
+	var raw string
+	err := c.db.QueryRow("SELECT metadata FROM videos WHERE id = ?", videoID).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeMetadata(raw)
+}
+
+// PatchVideoMetadata sets the keys in patch with a value and removes those
+// set to nil, leaving other keys alone, and returns the result. The read
+// and write happen in one transaction, so concurrent patches to different
+// keys don't lose each other's changes.
+func (c Client) PatchVideoMetadata(videoID uuid.UUID, patch map[string]*string, maxKeys int) (map[string]string, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var raw string
+	err = tx.QueryRow("SELECT metadata FROM videos WHERE id = ?", videoID).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := decodeMetadata(raw)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range patch {
+		if value == nil {
+			delete(metadata, key)
+			continue
+		}
+		metadata[key] = *value
+	}
+	if len(metadata) > maxKeys {
+		return nil, ErrTooManyMetadataKeys
+	}
+
+	encoded, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("UPDATE videos SET metadata = ? WHERE id = ?", string(encoded), videoID)
+	if err != nil {
+		return nil, err
+	}
+	return metadata, tx.Commit()
+}
+
+func decodeMetadata(raw string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if raw == "" {
+		return metadata, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
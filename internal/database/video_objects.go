@@ -0,0 +1,94 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// VideoObject is one file a video has been stored as. Every upload gets a
+// new key, so a video's objects are the history of its files. VersionID is
+// the S3 version written, and is empty unless the bucket is versioned.
+type VideoObject struct {
+	ID              uuid.UUID `json:"id"`
+	VideoID         uuid.UUID `json:"video_id"`
+	S3Key           string    `json:"s3_key"`
+	VersionID       string    `json:"version_id"`
+	Size            int64     `json:"size"`
+	ChecksumSHA256  string    `json:"checksum_sha256"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	// AudioLanguages is empty for files stored before languages were
+	// probed.
+	AudioLanguages []string  `json:"audio_languages"`
+	Encrypted      bool      `json:"encrypted"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// CreateVideoObject records a stored file. The wrapped data key of an
+// encrypted one is kept with it, since the keystore only holds the key of
+// the video's current file.
+func (c Client) CreateVideoObject(object VideoObject, wrappedKey []byte) error {
+	query := `
+	INSERT INTO video_objects (id, video_id, s3_key, version_id, size, checksum_sha256, duration_seconds, audio_languages, encrypted, wrapped_key, created_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, object.ID, object.VideoID, object.S3Key, object.VersionID, object.Size,
+		object.ChecksumSHA256, object.DurationSeconds, strings.Join(object.AudioLanguages, ","), object.Encrypted, wrappedKey, object.CreatedAt.UTC())
+	return err
+}
+
+// GetVideoObjects lists the files a video has been stored as, newest
+// first.
+func (c Client) GetVideoObjects(videoID uuid.UUID) ([]VideoObject, error) {
+	query := `
+	SELECT id, video_id, s3_key, version_id, size, checksum_sha256, duration_seconds, audio_languages, encrypted, created_at
+	FROM video_objects
+	WHERE video_id = ?
+	ORDER BY created_at DESC
+	`
+	rows, err := c.db.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	objects := []VideoObject{}
+	for rows.Next() {
+		var object VideoObject
+		var audioLanguages string
+		err := rows.Scan(&object.ID, &object.VideoID, &object.S3Key, &object.VersionID, &object.Size,
+			&object.ChecksumSHA256, &object.DurationSeconds, &audioLanguages, &object.Encrypted, &object.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		object.AudioLanguages = splitList(audioLanguages)
+		objects = append(objects, object)
+	}
+	return objects, rows.Err()
+}
+
+// GetVideoObject returns the latest record of a video's file under s3Key,
+// with its wrapped data key if it was encrypted. The object's ID is zero if
+// the video was never stored there.
+func (c Client) GetVideoObject(videoID uuid.UUID, s3Key string) (VideoObject, []byte, error) {
+	query := `
+	SELECT id, video_id, s3_key, version_id, size, checksum_sha256, duration_seconds, audio_languages, encrypted, created_at, wrapped_key
+	FROM video_objects
+	WHERE video_id = ? AND s3_key = ?
+	ORDER BY created_at DESC
+	LIMIT 1
+	`
+	var object VideoObject
+	var audioLanguages string
+	var wrappedKey []byte
+	err := c.db.QueryRow(query, videoID, s3Key).Scan(&object.ID, &object.VideoID, &object.S3Key, &object.VersionID,
+		&object.Size, &object.ChecksumSHA256, &object.DurationSeconds, &audioLanguages, &object.Encrypted, &object.CreatedAt, &wrappedKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return VideoObject{}, nil, nil
+	}
+	object.AudioLanguages = splitList(audioLanguages)
+	return object, wrappedKey, err
+}
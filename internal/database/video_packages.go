@@ -0,0 +1,203 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	PackageStatusQueued   = "queued"
+	PackageStatusBuilding = "building"
+	PackageStatusReady    = "ready"
+	PackageStatusFailed   = "failed"
+)
+
+// VideoPackage is a zip of a list of videos, in order, for downloading them
+// all at once. S3Key is set once it's ready.
+type VideoPackage struct {
+	ID          uuid.UUID   `json:"id"`
+	UserID      uuid.UUID   `json:"user_id"`
+	Title       string      `json:"title"`
+	VideoIDs    []uuid.UUID `json:"video_ids"`
+	Status      string      `json:"status"`
+	S3Key       *string     `json:"-"`
+	Size        *int64      `json:"size"`
+	Error       *string     `json:"error"`
+	CreatedAt   time.Time   `json:"created_at"`
+	CompletedAt *time.Time  `json:"completed_at"`
+	ExpiresAt   *time.Time  `json:"expires_at"`
+}
+
+const videoPackageColumns = `
+		id,
+		user_id,
+		title,
+		video_ids,
+		status,
+		s3_key,
+		size,
+		error,
+		created_at,
+		completed_at,
+		expires_at`
+
+func scanVideoPackage(row rowScanner) (VideoPackage, error) {
+	var pkg VideoPackage
+	var videoIDs string
+	err := row.Scan(
+		&pkg.ID,
+		&pkg.UserID,
+		&pkg.Title,
+		&videoIDs,
+		&pkg.Status,
+		&pkg.S3Key,
+		&pkg.Size,
+		&pkg.Error,
+		&pkg.CreatedAt,
+		&pkg.CompletedAt,
+		&pkg.ExpiresAt,
+	)
+	if err != nil {
+		return pkg, err
+	}
+	pkg.VideoIDs = []uuid.UUID{}
+	for _, id := range strings.Split(videoIDs, ",") {
+		if id == "" {
+			continue
+		}
+		parsed, err := uuid.Parse(id)
+		if err != nil {
+			return pkg, err
+		}
+		pkg.VideoIDs = append(pkg.VideoIDs, parsed)
+	}
+	return pkg, nil
+}
+
+func (c Client) CreateVideoPackage(userID uuid.UUID, title string, videoIDs []uuid.UUID) (VideoPackage, error) {
+	ids := make([]string, len(videoIDs))
+	for i, id := range videoIDs {
+		ids[i] = id.String()
+	}
+	pkg := VideoPackage{
+		ID:        uuid.New(),
+		UserID:    userID,
+		Title:     title,
+		VideoIDs:  videoIDs,
+		Status:    PackageStatusQueued,
+		CreatedAt: time.Now().UTC(),
+	}
+	query := `
+	INSERT INTO video_packages (id, user_id, title, video_ids, status, created_at)
+	VALUES (?, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, pkg.ID, pkg.UserID, pkg.Title, strings.Join(ids, ","), pkg.Status, pkg.CreatedAt)
+	if err != nil {
+		return VideoPackage{}, err
+	}
+	return pkg, nil
+}
+
+// GetVideoPackage returns a package, with a zero ID if there is none.
+func (c Client) GetVideoPackage(id uuid.UUID) (VideoPackage, error) {
+	query := `SELECT` + videoPackageColumns + `
+	FROM video_packages
+	WHERE id = ?
+	`
+	pkg, err := scanVideoPackage(c.db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return VideoPackage{}, nil
+	}
+	return pkg, err
+}
+
+func (c Client) GetVideoPackagesForUser(userID uuid.UUID) ([]VideoPackage, error) {
+	query := `SELECT` + videoPackageColumns + `
+	FROM video_packages
+	WHERE user_id = ?
+	ORDER BY created_at DESC
+	`
+	return c.queryVideoPackages(query, userID)
+}
+
+// GetExpiredVideoPackages returns ready packages whose zip is past its
+// expiry.
+func (c Client) GetExpiredVideoPackages() ([]VideoPackage, error) {
+	query := `SELECT` + videoPackageColumns + `
+	FROM video_packages
+	WHERE expires_at <= ?
+	`
+	return c.queryVideoPackages(query, time.Now().UTC())
+}
+
+func (c Client) queryVideoPackages(query string, args ...any) ([]VideoPackage, error) {
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	packages := []VideoPackage{}
+	for rows.Next() {
+		pkg, err := scanVideoPackage(rows)
+		if err != nil {
+			return nil, err
+		}
+		packages = append(packages, pkg)
+	}
+	return packages, rows.Err()
+}
+
+// SetVideoPackageBuilding marks a package as being assembled.
+func (c Client) SetVideoPackageBuilding(id uuid.UUID) error {
+	_, err := c.db.Exec("UPDATE video_packages SET status = ?, error = NULL WHERE id = ?", PackageStatusBuilding, id)
+	return err
+}
+
+// CompleteVideoPackage records where a package's zip was stored and until
+// when it is kept.
+func (c Client) CompleteVideoPackage(id uuid.UUID, s3Key string, size int64, expiresAt time.Time) error {
+	query := `
+	UPDATE video_packages
+	SET status = ?, s3_key = ?, size = ?, error = NULL, completed_at = ?, expires_at = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, PackageStatusReady, s3Key, size, time.Now().UTC(), expiresAt.UTC(), id)
+	return err
+}
+
+func (c Client) FailVideoPackage(id uuid.UUID, reason string) error {
+	_, err := c.db.Exec("UPDATE video_packages SET status = ?, error = ? WHERE id = ?", PackageStatusFailed, reason, id)
+	return err
+}
+
+func (c Client) DeleteVideoPackage(id uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM video_packages WHERE id = ?", id)
+	return err
+}
+
+// DeleteVideoPackagesForUser forgets every package of a user and returns
+// the keys of their zips, which the caller deletes from the bucket.
+func (c Client) DeleteVideoPackagesForUser(userID uuid.UUID) ([]string, error) {
+	rows, err := c.db.Query("DELETE FROM video_packages WHERE user_id = ? RETURNING s3_key", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var key sql.NullString
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		if key.Valid {
+			keys = append(keys, key.String)
+		}
+	}
+	return keys, rows.Err()
+}
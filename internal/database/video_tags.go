@@ -0,0 +1,29 @@
+package database
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// AddVideoTag tags a video. Adding a tag the video already has is a no-op.
+// Tags must not contain commas, since videoColumns aggregates them into a
+// comma-separated list.
+func (c Client) AddVideoTag(videoID uuid.UUID, tag string) error {
+	query := `
+	INSERT OR IGNORE INTO video_tags (video_id, tag)
+	VALUES (?, ?)
+	`
+	_, err := c.db.Exec(query, videoID, tag)
+	return err
+}
+
+func splitTags(list string) []string {
+	if list == "" {
+		return []string{}
+	}
+	tags := strings.Split(list, ",")
+	sort.Strings(tags)
+	return tags
+}
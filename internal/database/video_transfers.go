@@ -0,0 +1,183 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	TransferStatusPending   = "pending"
+	TransferStatusAccepted  = "accepted"
+	TransferStatusDeclined  = "declined"
+	TransferStatusCancelled = "cancelled"
+)
+
+// VideoTransfer is an offer to hand a video to another user or organization.
+// Exactly one of ToUserID and ToOrgID is set.
+type VideoTransfer struct {
+	ID         uuid.UUID  `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ResolvedAt *time.Time `json:"resolved_at"`
+	VideoID    uuid.UUID  `json:"video_id"`
+	FromUserID uuid.UUID  `json:"from_user_id"`
+	ToUserID   *uuid.UUID `json:"to_user_id"`
+	ToOrgID    *uuid.UUID `json:"to_org_id"`
+	Status     string     `json:"status"`
+}
+
+const videoTransferColumns = `
+		id,
+		created_at,
+		resolved_at,
+		video_id,
+		from_user_id,
+		to_user_id,
+		to_org_id,
+		status`
+
+func scanVideoTransfer(row rowScanner) (VideoTransfer, error) {
+	var transfer VideoTransfer
+	err := row.Scan(
+		&transfer.ID,
+		&transfer.CreatedAt,
+		&transfer.ResolvedAt,
+		&transfer.VideoID,
+		&transfer.FromUserID,
+		&transfer.ToUserID,
+		&transfer.ToOrgID,
+		&transfer.Status,
+	)
+	return transfer, err
+}
+
+// CreateVideoTransfer records a pending transfer. Any earlier pending
+// transfer of the same video is cancelled, so a video only ever has one
+// open offer.
+func (c Client) CreateVideoTransfer(transfer VideoTransfer) (VideoTransfer, error) {
+	id := uuid.New()
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return VideoTransfer{}, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+	UPDATE video_transfers
+	SET status = ?, resolved_at = CURRENT_TIMESTAMP
+	WHERE video_id = ? AND status = ?
+	`, TransferStatusCancelled, transfer.VideoID, TransferStatusPending)
+	if err != nil {
+		return VideoTransfer{}, err
+	}
+	_, err = tx.Exec(`
+	INSERT INTO video_transfers (
+		id,
+		created_at,
+		video_id,
+		from_user_id,
+		to_user_id,
+		to_org_id,
+		status
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
+	`, id, transfer.VideoID, transfer.FromUserID, transfer.ToUserID, transfer.ToOrgID, TransferStatusPending)
+	if err != nil {
+		return VideoTransfer{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return VideoTransfer{}, err
+	}
+
+	return c.GetVideoTransfer(id)
+}
+
+// GetVideoTransfer returns an empty VideoTransfer when none has the given ID.
+func (c Client) GetVideoTransfer(id uuid.UUID) (VideoTransfer, error) {
+	query := `
+	SELECT` + videoTransferColumns + `
+	FROM video_transfers
+	WHERE id = ?
+	`
+	transfer, err := scanVideoTransfer(c.db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return VideoTransfer{}, nil
+	}
+	return transfer, err
+}
+
+// GetIncomingVideoTransfers lists pending transfers the user can accept:
+// those addressed to them and those addressed to organizations they own or
+// administer.
+func (c Client) GetIncomingVideoTransfers(userID uuid.UUID) ([]VideoTransfer, error) {
+	query := `
+	SELECT` + videoTransferColumns + `
+	FROM video_transfers
+	WHERE status = ?
+		AND (to_user_id = ? OR to_org_id IN (
+			SELECT org_id FROM organization_members
+			WHERE user_id = ? AND role IN (?, ?)
+		))
+	ORDER BY created_at DESC
+	`
+	rows, err := c.db.Query(query, TransferStatusPending, userID, userID.String(), OrgRoleOwner, OrgRoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transfers := []VideoTransfer{}
+	for rows.Next() {
+		transfer, err := scanVideoTransfer(rows)
+		if err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, transfer)
+	}
+	return transfers, rows.Err()
+}
+
+// ResolveVideoTransfer closes a pending transfer. Accepting moves the video
+// in the same transaction; it reports false if the transfer was no longer
+// pending.
+func (c Client) ResolveVideoTransfer(transfer VideoTransfer, status string) (bool, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+	UPDATE video_transfers
+	SET status = ?, resolved_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND status = ?
+	`, status, transfer.ID, TransferStatusPending)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+
+	if status == TransferStatusAccepted {
+		// Transfers to a user make them the uploader of a personal video;
+		// transfers to an organization keep the uploader on record
+		var query string
+		var args []any
+		if transfer.ToUserID != nil {
+			query = `UPDATE videos SET user_id = ?, org_id = NULL, updated_at = ? WHERE id = ?`
+			args = []any{*transfer.ToUserID, time.Now().UTC(), transfer.VideoID}
+		} else {
+			query = `UPDATE videos SET org_id = ?, updated_at = ? WHERE id = ?`
+			args = []any{transfer.ToOrgID, time.Now().UTC(), transfer.VideoID}
+		}
+		if _, err := tx.Exec(query, args...); err != nil {
+			return false, err
+		}
+	}
+
+	return true, tx.Commit()
+}
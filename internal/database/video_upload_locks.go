@@ -0,0 +1,119 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// VideoUploadLock is the claim one request holds on a video while it
+// receives and stores a new file for it. SessionID is set when the request
+// is finishing an upload session.
+type VideoUploadLock struct {
+	VideoID    uuid.UUID  `json:"video_id"`
+	Holder     string     `json:"holder"`
+	SessionID  *uuid.UUID `json:"session_id"`
+	AcquiredAt time.Time  `json:"acquired_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+}
+
+// AcquireVideoUploadLock makes holder the only request allowed to upload a
+// file for the video until ttl from now. It fails while another holder's
+// lock is unexpired, and while an upload job for the video is queued or
+// running, since that job will write the video's file when it gets to run.
+func (c Client) AcquireVideoUploadLock(videoID uuid.UUID, holder string, sessionID *uuid.UUID, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	query := `
+	INSERT INTO video_upload_locks (video_id, holder, session_id, acquired_at, expires_at)
+	SELECT ?, ?, ?, ?, ?
+	WHERE NOT EXISTS (
+		SELECT 1 FROM jobs
+		WHERE kind = ? AND status IN (?, ?)
+			AND subject_id IN (SELECT id FROM upload_sessions WHERE video_id = ?)
+	)
+	ON CONFLICT(video_id) DO UPDATE SET
+		holder = excluded.holder,
+		session_id = excluded.session_id,
+		acquired_at = excluded.acquired_at,
+		expires_at = excluded.expires_at
+	WHERE video_upload_locks.expires_at < ?
+	`
+	result, err := c.db.Exec(query,
+		videoID, holder, sessionID, now, now.Add(ttl),
+		JobKindUploadSession, JobStatusQueued, JobStatusRunning, videoID,
+		now,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// ExtendVideoUploadLock keeps a lock held through a long upload, reporting
+// false if it expired and was taken over.
+func (c Client) ExtendVideoUploadLock(videoID uuid.UUID, holder string, ttl time.Duration) (bool, error) {
+	query := `
+	UPDATE video_upload_locks
+	SET expires_at = ?
+	WHERE video_id = ? AND holder = ?
+	`
+	result, err := c.db.Exec(query, time.Now().UTC().Add(ttl), videoID, holder)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// ReleaseVideoUploadLock gives up holder's lock. A lock that has since been
+// taken over is left alone.
+func (c Client) ReleaseVideoUploadLock(videoID uuid.UUID, holder string) error {
+	query := `
+	DELETE FROM video_upload_locks
+	WHERE video_id = ? AND holder = ?
+	`
+	_, err := c.db.Exec(query, videoID, holder)
+	return err
+}
+
+// GetVideoUploadLock returns the unexpired lock on the video, or an empty
+// one when nobody holds it.
+func (c Client) GetVideoUploadLock(videoID uuid.UUID) (VideoUploadLock, error) {
+	query := `
+	SELECT video_id, holder, session_id, acquired_at, expires_at
+	FROM video_upload_locks
+	WHERE video_id = ? AND expires_at >= ?
+	`
+	var lock VideoUploadLock
+	err := c.db.QueryRow(query, videoID, time.Now().UTC()).Scan(
+		&lock.VideoID,
+		&lock.Holder,
+		&lock.SessionID,
+		&lock.AcquiredAt,
+		&lock.ExpiresAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return VideoUploadLock{}, nil
+	}
+	return lock, err
+}
+
+// GetActiveVideoUploadJob returns the queued or running upload job for the
+// video, or an empty Job when there is none.
+func (c Client) GetActiveVideoUploadJob(videoID uuid.UUID) (Job, error) {
+	query := `SELECT` + jobColumns + `
+	FROM jobs
+	WHERE kind = ? AND status IN (?, ?)
+		AND subject_id IN (SELECT id FROM upload_sessions WHERE video_id = ?)
+	ORDER BY created_at
+	LIMIT 1
+	`
+	job, err := scanJob(c.db.QueryRow(query, JobKindUploadSession, JobStatusQueued, JobStatusRunning, videoID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Job{}, nil
+	}
+	return job, err
+}
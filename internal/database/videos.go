@@ -2,7 +2,9 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -13,19 +15,73 @@ type Video struct {
 	CreatedAt    time.Time `json:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at"`
 	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	// ThumbnailPosterURL is a still of an animated thumbnail's first frame,
+	// for places that shouldn't animate. It is null for still thumbnails.
+	ThumbnailPosterURL *string `json:"thumbnail_poster_url"`
+	// ThumbnailVariants maps variant names like "640.jpg" to the URLs of
+	// resized copies of the thumbnail.
+	ThumbnailVariants map[string]string `json:"thumbnail_variants"`
+	VideoURL          *string           `json:"video_url"`
+	TrimStartSeconds  *float64          `json:"trim_start_seconds"`
+	TrimEndSeconds    *float64          `json:"trim_end_seconds"`
+	DurationSeconds   *float64          `json:"duration_seconds"`
+	Watermarked       bool              `json:"watermarked"`
+	ParentVideoID     *uuid.UUID        `json:"parent_video_id"`
+	Encrypted         bool              `json:"encrypted"`
+	LegalHold         bool              `json:"legal_hold"`
+	ValidationError   *string           `json:"validation_error"`
+	Visibility        string            `json:"visibility"`
+	Tags              []string          `json:"tags"`
+	// PosterTimeSeconds is where in the video its automatic thumbnail is
+	// taken from. Null leaves the choice to the server.
+	PosterTimeSeconds *float64 `json:"poster_time_seconds"`
+	// AudioDescriptionKey is where the owner's audio description track is
+	// kept, to be muxed into every file uploaded for the video.
+	AudioDescriptionKey *string `json:"-"`
+	// AudioDescription reports whether the video's file carries an audio
+	// description stream.
+	AudioDescription bool `json:"audio_description"`
+	// GeoAllow and GeoDeny restrict where the video can be played, as ISO
+	// 3166-1 alpha-2 country codes. At most one of them is non-empty.
+	GeoAllow []string `json:"geo_allow"`
+	GeoDeny  []string `json:"geo_deny"`
+	// OriginalFilename is the sanitized name the video's file was uploaded
+	// under, offered again when it's downloaded. It is null when the file
+	// came without a name.
+	OriginalFilename *string `json:"original_filename"`
+	// AudioLanguages holds the ISO 639-2 language of each audio track of
+	// the video's file, in order, with "und" for tracks that aren't tagged.
+	AudioLanguages []string `json:"audio_languages"`
+	// Language is the video's primary language, as an ISO 639-2 code.
+	Language *string `json:"language"`
+	// Flagged marks a video enough users have reported to await a
+	// moderator. Only reports and moderators change it, so UpdateVideo
+	// leaves it alone.
+	Flagged bool `json:"flagged"`
 	CreateVideoParams
 }
 
+const (
+	VisibilityPrivate  = "private"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPublic   = "public"
+)
+
+// ValidVisibility reports whether v is one of the visibility levels.
+func ValidVisibility(v string) bool {
+	return v == VisibilityPrivate || v == VisibilityUnlisted || v == VisibilityPublic
+}
+
 type CreateVideoParams struct {
-	Title       string    `json:"title"`
-	Description string    `json:"description"`
-	UserID      uuid.UUID `json:"user_id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	UserID      uuid.UUID  `json:"user_id"`
+	OrgID       *uuid.UUID `json:"org_id"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
+// videoColumns is the column list shared by every query that loads a full
+// Video, in the order expected by scanVideo.
+const videoColumns = `
 		id,
 		created_at,
 		updated_at,
@@ -33,7 +89,99 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 		description,
 		thumbnail_url,
 		video_url,
-		user_id
+		user_id,
+		trim_start_seconds,
+		trim_end_seconds,
+		watermarked,
+		parent_video_id,
+		encrypted,
+		legal_hold,
+		validation_error,
+		visibility,
+		org_id,
+		thumbnail_poster_url,
+		duration_seconds,
+		poster_time_seconds,
+		audio_description_key,
+		geo_allow,
+		geo_deny,
+		original_filename,
+		audio_languages,
+		language,
+		flagged,
+		(SELECT json_group_object(variant, url) FROM thumbnail_variants WHERE source_url = videos.thumbnail_url),
+		(SELECT group_concat(tag) FROM video_tags WHERE video_id = videos.id)`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanVideo scans the columns in videoColumns, then any extra columns a
+// query selects after them into extra.
+func scanVideo(row rowScanner, extra ...any) (Video, error) {
+	var video Video
+	var variants, tags sql.NullString
+	var geoAllow, geoDeny, audioLanguages string
+	err := row.Scan(append([]any{
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.VideoURL,
+		&video.UserID,
+		&video.TrimStartSeconds,
+		&video.TrimEndSeconds,
+		&video.Watermarked,
+		&video.ParentVideoID,
+		&video.Encrypted,
+		&video.LegalHold,
+		&video.ValidationError,
+		&video.Visibility,
+		&video.OrgID,
+		&video.ThumbnailPosterURL,
+		&video.DurationSeconds,
+		&video.PosterTimeSeconds,
+		&video.AudioDescriptionKey,
+		&geoAllow,
+		&geoDeny,
+		&video.OriginalFilename,
+		&audioLanguages,
+		&video.Language,
+		&video.Flagged,
+		&variants,
+		&tags,
+	}, extra...)...)
+	if err != nil {
+		return video, err
+	}
+	video.ThumbnailVariants = map[string]string{}
+	if variants.Valid {
+		if err := json.Unmarshal([]byte(variants.String), &video.ThumbnailVariants); err != nil {
+			return video, err
+		}
+	}
+	video.Tags = splitTags(tags.String)
+	video.GeoAllow = splitList(geoAllow)
+	video.GeoDeny = splitList(geoDeny)
+	video.AudioLanguages = splitList(audioLanguages)
+	video.AudioDescription = video.AudioDescriptionKey != nil && video.VideoURL != nil
+	return video, nil
+}
+
+// splitList splits a stored list of codes, like a geo allow list or the
+// languages of a video's audio tracks.
+func splitList(list string) []string {
+	if list == "" {
+		return []string{}
+	}
+	return strings.Split(list, ",")
+}
+
+func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE user_id = ?
 	ORDER BY created_at DESC
@@ -47,17 +195,8 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
@@ -66,6 +205,195 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 	return videos, nil
 }
 
+// Video statuses, as shown in listings.
+const (
+	VideoStatusAwaitingUpload = "awaiting_upload"
+	VideoStatusProcessing     = "processing"
+	VideoStatusReady          = "ready"
+	VideoStatusFailed         = "failed"
+)
+
+// VideoListItem is a video as listed in a grid: the video plus its status
+// and what hangs off it, which would otherwise take a lookup per video.
+type VideoListItem struct {
+	Video
+	Status string      `json:"status"`
+	Counts VideoCounts `json:"counts"`
+}
+
+type VideoCounts struct {
+	Clips int `json:"clips"`
+	// DownloadLinks counts the links that are still usable.
+	DownloadLinks int `json:"download_links"`
+}
+
+// videoListColumns adds what a listing shows beyond the video itself, in
+// the order expected by scanVideoListItem. They are correlated subqueries
+// on indexed columns, so a page of videos is still one round trip. The
+// current time is bound twice, ahead of the query's own arguments.
+const videoListColumns = videoColumns + `,
+		CASE
+			WHEN EXISTS (SELECT 1 FROM video_upload_locks WHERE video_id = videos.id AND expires_at >= ?)
+				OR EXISTS (SELECT 1 FROM upload_sessions WHERE video_id = videos.id AND status = '` + UploadStatusProcessing + `')
+				THEN '` + VideoStatusProcessing + `'
+			WHEN video_url IS NOT NULL THEN '` + VideoStatusReady + `'
+			WHEN validation_error IS NOT NULL
+				OR (SELECT status FROM upload_sessions WHERE video_id = videos.id ORDER BY created_at DESC LIMIT 1) = '` + UploadStatusFailed + `'
+				THEN '` + VideoStatusFailed + `'
+			ELSE '` + VideoStatusAwaitingUpload + `'
+		END,
+		(SELECT COUNT(*) FROM videos AS clips WHERE clips.parent_video_id = videos.id),
+		(SELECT COUNT(*) FROM download_links WHERE video_id = videos.id AND uses < max_uses AND expires_at > ?)`
+
+func scanVideoListItem(row rowScanner) (VideoListItem, error) {
+	var item VideoListItem
+	video, err := scanVideo(row, &item.Status, &item.Counts.Clips, &item.Counts.DownloadLinks)
+	item.Video = video
+	return item, err
+}
+
+// GetAccessibleVideos lists the user's own videos together with those of
+// every organization they belong to.
+func (c Client) GetAccessibleVideos(userID uuid.UUID) ([]VideoListItem, error) {
+	query := `
+	SELECT` + videoListColumns + `
+	FROM videos
+	WHERE (user_id = ? AND org_id IS NULL)
+		OR org_id IN (SELECT org_id FROM organization_members WHERE user_id = ?)
+	ORDER BY created_at DESC, id DESC
+	`
+	now := time.Now().UTC()
+	return c.queryVideoListItems(query, now, now, userID, userID.String())
+}
+
+// VideoCursor is a position in a newest-first video listing: the created_at
+// and ID of the last video already returned. Listings ordered by another
+// time, like when a video was watched, keep that time in CreatedAt.
+type VideoCursor struct {
+	CreatedAt time.Time
+	ID        uuid.UUID
+}
+
+// GetAccessibleVideosPage returns up to limit videos of the same listing as
+// GetAccessibleVideos, continuing after the cursor if one is given.
+func (c Client) GetAccessibleVideosPage(userID uuid.UUID, after *VideoCursor, limit int) ([]VideoListItem, error) {
+	query := `
+	SELECT` + videoListColumns + `
+	FROM videos
+	WHERE ((user_id = ? AND org_id IS NULL)
+		OR org_id IN (SELECT org_id FROM organization_members WHERE user_id = ?))
+	`
+	now := time.Now().UTC()
+	args := []any{now, now, userID, userID.String()}
+	if after != nil {
+		// created_at is written by CURRENT_TIMESTAMP, so compare against
+		// the same text layout rather than the driver's time encoding
+		createdAt := after.CreatedAt.UTC().Format(time.DateTime)
+		query += `AND (created_at < ? OR (created_at = ? AND id < ?))
+	`
+		args = append(args, createdAt, createdAt, after.ID)
+	}
+	query += `ORDER BY created_at DESC, id DESC
+	LIMIT ?
+	`
+	args = append(args, limit)
+	return c.queryVideoListItems(query, args...)
+}
+
+// RelatedVideo is a candidate for a video's related videos: a video that
+// shares tags or an uploader with it.
+type RelatedVideo struct {
+	Video
+	SharedTags   int  `json:"shared_tags"`
+	SameUploader bool `json:"same_uploader"`
+}
+
+// GetRelatedVideos returns up to limit videos with a file that share tags
+// or an uploader with video, those sharing the most tags first, then the
+// newest. Public videos are candidates for anyone. Videos viewerID can see
+// in their own listing are candidates too, unless viewerID is uuid.Nil.
+func (c Client) GetRelatedVideos(video Video, viewerID uuid.UUID, limit int) ([]RelatedVideo, error) {
+	query := `
+	SELECT` + videoColumns + `,
+		(SELECT COUNT(*) FROM video_tags
+			WHERE video_tags.video_id = videos.id
+			AND tag IN (SELECT tag FROM video_tags WHERE video_id = ?)) AS shared_tags,
+		user_id = ?
+	FROM videos
+	WHERE id != ?
+		AND video_url IS NOT NULL
+		AND NOT flagged
+		AND (visibility = '` + VisibilityPublic + `'
+			OR (user_id = ? AND org_id IS NULL)
+			OR org_id IN (SELECT org_id FROM organization_members WHERE user_id = ?))
+		AND (user_id = ? OR EXISTS (
+			SELECT 1 FROM video_tags
+			WHERE video_tags.video_id = videos.id
+			AND tag IN (SELECT tag FROM video_tags WHERE video_id = ?)))
+	ORDER BY shared_tags DESC, created_at DESC, id DESC
+	LIMIT ?
+	`
+	rows, err := c.db.Query(query,
+		video.ID,
+		video.UserID,
+		video.ID,
+		viewerID, viewerID.String(),
+		video.UserID,
+		video.ID,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	related := []RelatedVideo{}
+	for rows.Next() {
+		var candidate RelatedVideo
+		candidate.Video, err = scanVideo(rows, &candidate.SharedTags, &candidate.SameUploader)
+		if err != nil {
+			return nil, err
+		}
+		related = append(related, candidate)
+	}
+	return related, rows.Err()
+}
+
+// GetVideoListItem returns one video as a listing shows it, with its
+// status. The item is empty if the video doesn't exist.
+func (c Client) GetVideoListItem(id uuid.UUID) (VideoListItem, error) {
+	query := `
+	SELECT` + videoListColumns + `
+	FROM videos
+	WHERE id = ?
+	`
+	now := time.Now().UTC()
+	items, err := c.queryVideoListItems(query, now, now, id)
+	if err != nil || len(items) == 0 {
+		return VideoListItem{}, err
+	}
+	return items[0], nil
+}
+
+func (c Client) queryVideoListItems(query string, args ...any) ([]VideoListItem, error) {
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []VideoListItem{}
+	for rows.Next() {
+		item, err := scanVideoListItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
 func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 	id := uuid.New()
 	query := `
@@ -75,10 +403,11 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 		updated_at,
 		title,
 		description,
-		user_id
-	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+		user_id,
+		org_id
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, id, params.Title, params.Description, params.UserID)
+	_, err := c.db.Exec(query, id, params.Title, params.Description, params.UserID, params.OrgID)
 	if err != nil {
 		return Video{}, err
 	}
@@ -88,29 +417,12 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 
 func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE id = ?
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.db.QueryRow(query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -121,35 +433,385 @@ func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	return video, nil
 }
 
+// GetVideoByURL returns the video whose file is served from videoURL.
+func (c Client) GetVideoByURL(videoURL string) (Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE video_url = ?
+	`
+
+	video, err := scanVideo(c.db.QueryRow(query, videoURL))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Video{}, nil
+		}
+		return Video{}, err
+	}
+
+	return video, nil
+}
+
+// execer is what can run a write: the client's handle or a transaction.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// UpdateVideo writes a video's fields back. It leaves the owner alone,
+// which only a transfer changes, so a write from a video loaded before one
+// was accepted can't move the video back.
 func (c Client) UpdateVideo(video Video) error {
+	return updateVideo(c.db, video)
+}
+
+// UpdateVideoIfUnmodified is UpdateVideo for a video that must not have
+// been written since it was loaded, with video.UpdatedAt as it was then.
+// It reports false, changing nothing, if it has been or no longer exists.
+func (c Client) UpdateVideoIfUnmodified(video Video) (bool, error) {
+	// The transaction holds the write lock from the start, so nothing can
+	// change the video between the check and the update
+	tx, err := c.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var updatedAt time.Time
+	err = tx.QueryRow("SELECT updated_at FROM videos WHERE id = ?", video.ID).Scan(&updatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !updatedAt.Equal(video.UpdatedAt) {
+		return false, nil
+	}
+	if err := updateVideo(tx, video); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func updateVideo(db execer, video Video) error {
 	query := `
 	UPDATE videos
 	SET
+		updated_at = ?,
 		title = ?,
 		description = ?,
 		thumbnail_url = ?,
 		video_url = ?,
-		user_id = ?
+		trim_start_seconds = ?,
+		trim_end_seconds = ?,
+		watermarked = ?,
+		parent_video_id = ?,
+		encrypted = ?,
+		validation_error = ?,
+		visibility = ?,
+		thumbnail_poster_url = ?,
+		duration_seconds = ?,
+		poster_time_seconds = ?,
+		audio_description_key = ?,
+		geo_allow = ?,
+		geo_deny = ?,
+		original_filename = ?,
+		audio_languages = ?,
+		language = ?
 	WHERE id = ?
 	`
 
-	_, err := c.db.Exec(
+	_, err := db.Exec(
 		query,
+		time.Now().UTC(),
 		video.Title,
 		video.Description,
 		&video.ThumbnailURL,
 		&video.VideoURL,
-		video.UserID,
+		video.TrimStartSeconds,
+		video.TrimEndSeconds,
+		video.Watermarked,
+		video.ParentVideoID,
+		video.Encrypted,
+		video.ValidationError,
+		video.Visibility,
+		video.ThumbnailPosterURL,
+		video.DurationSeconds,
+		video.PosterTimeSeconds,
+		video.AudioDescriptionKey,
+		strings.Join(video.GeoAllow, ","),
+		strings.Join(video.GeoDeny, ","),
+		video.OriginalFilename,
+		strings.Join(video.AudioLanguages, ","),
+		video.Language,
+		video.ID,
+	)
+	return err
+}
+
+// UpdateVideoFile records a newly processed file: its URL and what was
+// done to it and learned from it. The rest of the video, which can be
+// edited while the file is processed, is left alone, and the primary
+// language is only filled in if there isn't one yet.
+func (c Client) UpdateVideoFile(video Video) error {
+	query := `
+	UPDATE videos
+	SET
+		updated_at = ?,
+		video_url = ?,
+		trim_start_seconds = ?,
+		trim_end_seconds = ?,
+		watermarked = ?,
+		encrypted = ?,
+		validation_error = ?,
+		duration_seconds = ?,
+		original_filename = ?,
+		audio_languages = ?,
+		language = COALESCE(language, ?)
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(
+		query,
+		time.Now().UTC(),
+		&video.VideoURL,
+		video.TrimStartSeconds,
+		video.TrimEndSeconds,
+		video.Watermarked,
+		video.Encrypted,
+		video.ValidationError,
+		video.DurationSeconds,
+		video.OriginalFilename,
+		strings.Join(video.AudioLanguages, ","),
+		video.Language,
 		video.ID,
 	)
 	return err
 }
 
+// SetVideoValidationError records why a video's file was refused, leaving
+// the rest of the video alone.
+func (c Client) SetVideoValidationError(id uuid.UUID, reason string) error {
+	query := `
+	UPDATE videos
+	SET validation_error = ?, updated_at = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, reason, time.Now().UTC(), id)
+	return err
+}
+
+// SetVideoGeoRestriction replaces the countries a video is allowed or
+// denied in, leaving the rest of the video alone.
+func (c Client) SetVideoGeoRestriction(id uuid.UUID, allow, deny []string) error {
+	query := `
+	UPDATE videos
+	SET geo_allow = ?, geo_deny = ?, updated_at = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, strings.Join(allow, ","), strings.Join(deny, ","), time.Now().UTC(), id)
+	return err
+}
+
+// SetVideoLegalHold places or lifts a legal hold on a video, reporting
+// whether the video exists. UpdateVideo leaves the hold alone, so a write
+// from a video loaded before the hold changed can't undo it.
+func (c Client) SetVideoLegalHold(id uuid.UUID, hold bool) (bool, error) {
+	query := `
+	UPDATE videos
+	SET legal_hold = ?, updated_at = ?
+	WHERE id = ?
+	`
+	result, err := c.db.Exec(query, hold, time.Now().UTC(), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
 func (c Client) DeleteVideo(id uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM video_tags WHERE video_id = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec("DELETE FROM video_transfers WHERE video_id = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec("DELETE FROM download_links WHERE video_id = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec("DELETE FROM upload_receipts WHERE video_id = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec("DELETE FROM video_objects WHERE video_id = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec("DELETE FROM video_views WHERE video_id = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec("DELETE FROM video_likes WHERE video_id = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec("DELETE FROM trending_videos WHERE video_id = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec("DELETE FROM video_reports WHERE video_id = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec("DELETE FROM watch_history WHERE video_id = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec("DELETE FROM watch_later WHERE video_id = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec("DELETE FROM upload_session_parts WHERE session_id IN (SELECT id FROM upload_sessions WHERE video_id = ?)", id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec("DELETE FROM upload_sessions WHERE video_id = ?", id)
+	if err != nil {
+		return err
+	}
+
 	query := `
 	DELETE FROM videos
 	WHERE id = ?
 	`
-	_, err := c.db.Exec(query, id)
+	_, err = c.db.Exec(query, id)
 	return err
 }
+
+// ThumbnailURLs lists every stored image the video's thumbnail is made of.
+func (v Video) ThumbnailURLs() []string {
+	var urls []string
+	for _, url := range []*string{v.ThumbnailURL, v.ThumbnailPosterURL} {
+		if url != nil {
+			urls = append(urls, *url)
+		}
+	}
+	return urls
+}
+
+// CountVideosWithThumbnail reports how many videos use the given thumbnail
+// or poster URL. Clips share their source's thumbnail, so a file can only be
+// removed once nothing points at it.
+func (c Client) CountVideosWithThumbnail(thumbnailURL string) (int, error) {
+	query := `
+	SELECT COUNT(*)
+	FROM videos
+	WHERE thumbnail_url = ? OR thumbnail_poster_url = ?
+	`
+	var count int
+	err := c.db.QueryRow(query, thumbnailURL, thumbnailURL).Scan(&count)
+	return count, err
+}
+
+// VideoObjectRef is what's needed to find a video's file in the bucket:
+// its URL, or for encrypted videos the key in the keystore.
+type VideoObjectRef struct {
+	VideoID   uuid.UUID
+	VideoURL  string
+	Encrypted bool
+	S3Key     string
+	UpdatedAt time.Time
+}
+
+// GetVideoObjectRefs returns a reference for every video with a file.
+func (c Client) GetVideoObjectRefs() ([]VideoObjectRef, error) {
+	query := `
+	SELECT v.id, v.video_url, v.encrypted, COALESCE(k.s3_key, ''), v.updated_at
+	FROM videos v
+	LEFT JOIN video_keys k ON k.video_id = v.id
+	WHERE v.video_url IS NOT NULL
+	`
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var refs []VideoObjectRef
+	for rows.Next() {
+		var ref VideoObjectRef
+		if err := rows.Scan(&ref.VideoID, &ref.VideoURL, &ref.Encrypted, &ref.S3Key, &ref.UpdatedAt); err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	return refs, rows.Err()
+}
+
+// CountVideosWithVideoURL reports how many videos play the given URL.
+func (c Client) CountVideosWithVideoURL(videoURL string) (int, error) {
+	var count int
+	err := c.db.QueryRow("SELECT COUNT(*) FROM videos WHERE video_url = ?", videoURL).Scan(&count)
+	return count, err
+}
+
+// GetThumbnailURLsAfter returns up to limit distinct thumbnail and poster
+// URLs that sort after the given one, in order, for walking every thumbnail
+// in batches.
+func (c Client) GetThumbnailURLsAfter(after string, limit int) ([]string, error) {
+	query := `
+	SELECT url FROM (
+		SELECT thumbnail_url AS url FROM videos
+		UNION
+		SELECT thumbnail_poster_url FROM videos
+		UNION
+		SELECT url FROM thumbnail_variants
+	)
+	WHERE url > ?
+	ORDER BY url
+	LIMIT ?
+	`
+	rows, err := c.db.Query(query, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var urls []string
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return nil, err
+		}
+		urls = append(urls, url)
+	}
+	return urls, rows.Err()
+}
+
+// ReplaceThumbnailURL points every video using oldURL, as its thumbnail or
+// poster, and every variant record using it, at newURL instead. It returns
+// how many videos it changed.
+func (c Client) ReplaceThumbnailURL(oldURL, newURL string) (int64, error) {
+	query := `
+	UPDATE videos
+	SET
+		thumbnail_url = CASE WHEN thumbnail_url = ? THEN ? ELSE thumbnail_url END,
+		thumbnail_poster_url = CASE WHEN thumbnail_poster_url = ? THEN ? ELSE thumbnail_poster_url END,
+		updated_at = ?
+	WHERE thumbnail_url = ? OR thumbnail_poster_url = ?
+	`
+	result, err := c.db.Exec(query, oldURL, newURL, oldURL, newURL, time.Now().UTC(), oldURL, oldURL)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.db.Exec("UPDATE thumbnail_variants SET source_url = ? WHERE source_url = ?", newURL, oldURL); err != nil {
+		return 0, err
+	}
+	if _, err := c.db.Exec("UPDATE thumbnail_variants SET url = ? WHERE url = ?", newURL, oldURL); err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,197 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// WatchProgress is how far a user got in a video, and when.
+type WatchProgress struct {
+	PositionSeconds float64   `json:"position_seconds"`
+	WatchedAt       time.Time `json:"watched_at"`
+}
+
+// HistoryEntry is a video in a user's playback history.
+type HistoryEntry struct {
+	Video
+	WatchProgress
+}
+
+// WatchLaterEntry is a video on a user's watch-later list, with how far
+// they've watched it, if they have.
+type WatchLaterEntry struct {
+	Video
+	AddedAt  time.Time      `json:"added_at"`
+	Progress *WatchProgress `json:"progress"`
+}
+
+// viewableByUser limits a query on videos to those the user given twice
+// as its arguments can view: anything not private, their own videos and
+// their organizations'.
+const viewableByUser = `
+		(videos.visibility != '` + VisibilityPrivate + `'
+			OR (videos.user_id = ? AND videos.org_id IS NULL)
+			OR videos.org_id IN (SELECT org_id FROM organization_members WHERE user_id = ?))`
+
+// RecordWatchProgress saves the user's position in the video as of now.
+func (c Client) RecordWatchProgress(userID, videoID uuid.UUID, positionSeconds float64) error {
+	query := `
+	INSERT INTO watch_history (user_id, video_id, position_seconds, watched_at)
+	VALUES (?, ?, ?, ?)
+	ON CONFLICT(user_id, video_id) DO UPDATE SET
+		position_seconds = excluded.position_seconds,
+		watched_at = excluded.watched_at
+	`
+	_, err := c.db.Exec(query, userID, videoID, positionSeconds, time.Now().UTC())
+	return err
+}
+
+// GetWatchProgress returns the user's last position in the video, or nil
+// if it isn't in their history.
+func (c Client) GetWatchProgress(userID, videoID uuid.UUID) (*WatchProgress, error) {
+	var progress WatchProgress
+	err := c.db.QueryRow(
+		"SELECT position_seconds, watched_at FROM watch_history WHERE user_id = ? AND video_id = ?",
+		userID, videoID,
+	).Scan(&progress.PositionSeconds, &progress.WatchedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &progress, nil
+}
+
+// GetWatchHistoryPage returns up to limit videos of the user's history
+// they can still view, most recently watched first, continuing after the
+// cursor if one is given. The cursor's time is when its video was watched.
+func (c Client) GetWatchHistoryPage(userID uuid.UUID, after *VideoCursor, limit int) ([]HistoryEntry, error) {
+	query := `
+	SELECT` + videoColumns + `, history.position_seconds, history.watched_at
+	FROM videos
+	JOIN (SELECT video_id, position_seconds, watched_at FROM watch_history WHERE user_id = ?) AS history
+		ON history.video_id = videos.id
+	WHERE` + viewableByUser + `
+	`
+	args := []any{userID, userID, userID.String()}
+	if after != nil {
+		watchedAt := after.CreatedAt.UTC()
+		query += `AND (history.watched_at < ? OR (history.watched_at = ? AND videos.id < ?))
+	`
+		args = append(args, watchedAt, watchedAt, after.ID)
+	}
+	query += `ORDER BY history.watched_at DESC, videos.id DESC
+	LIMIT ?
+	`
+	args = append(args, limit)
+
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []HistoryEntry{}
+	for rows.Next() {
+		var entry HistoryEntry
+		entry.Video, err = scanVideo(rows, &entry.PositionSeconds, &entry.WatchedAt)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// DeleteWatchHistoryEntry removes the video from the user's history,
+// reporting whether it was there.
+func (c Client) DeleteWatchHistoryEntry(userID, videoID uuid.UUID) (bool, error) {
+	result, err := c.db.Exec("DELETE FROM watch_history WHERE user_id = ? AND video_id = ?", userID, videoID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// ClearWatchHistory removes every video from the user's history.
+func (c Client) ClearWatchHistory(userID uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM watch_history WHERE user_id = ?", userID)
+	return err
+}
+
+// AddToWatchLater puts the video on the user's watch-later list. Adding it
+// again keeps its place.
+func (c Client) AddToWatchLater(userID, videoID uuid.UUID) error {
+	query := `
+	INSERT INTO watch_later (user_id, video_id, added_at)
+	VALUES (?, ?, ?)
+	ON CONFLICT(user_id, video_id) DO NOTHING
+	`
+	_, err := c.db.Exec(query, userID, videoID, time.Now().UTC())
+	return err
+}
+
+// RemoveFromWatchLater takes the video off the user's watch-later list,
+// reporting whether it was on it.
+func (c Client) RemoveFromWatchLater(userID, videoID uuid.UUID) (bool, error) {
+	result, err := c.db.Exec("DELETE FROM watch_later WHERE user_id = ? AND video_id = ?", userID, videoID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// GetWatchLaterPage returns up to limit videos of the user's watch-later
+// list they can still view, most recently added first, continuing after
+// the cursor if one is given. The cursor's time is when its video was
+// added.
+func (c Client) GetWatchLaterPage(userID uuid.UUID, after *VideoCursor, limit int) ([]WatchLaterEntry, error) {
+	query := `
+	SELECT` + videoColumns + `, later.added_at, history.position_seconds, history.watched_at
+	FROM videos
+	JOIN (SELECT video_id, added_at FROM watch_later WHERE user_id = ?) AS later
+		ON later.video_id = videos.id
+	LEFT JOIN (SELECT video_id, position_seconds, watched_at FROM watch_history WHERE user_id = ?) AS history
+		ON history.video_id = videos.id
+	WHERE` + viewableByUser + `
+	`
+	args := []any{userID, userID, userID, userID.String()}
+	if after != nil {
+		addedAt := after.CreatedAt.UTC()
+		query += `AND (later.added_at < ? OR (later.added_at = ? AND videos.id < ?))
+	`
+		args = append(args, addedAt, addedAt, after.ID)
+	}
+	query += `ORDER BY later.added_at DESC, videos.id DESC
+	LIMIT ?
+	`
+	args = append(args, limit)
+
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []WatchLaterEntry{}
+	for rows.Next() {
+		var entry WatchLaterEntry
+		var position sql.NullFloat64
+		var watchedAt sql.NullTime
+		entry.Video, err = scanVideo(rows, &entry.AddedAt, &position, &watchedAt)
+		if err != nil {
+			return nil, err
+		}
+		if position.Valid && watchedAt.Valid {
+			entry.Progress = &WatchProgress{PositionSeconds: position.Float64, WatchedAt: watchedAt.Time}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
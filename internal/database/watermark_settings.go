@@ -0,0 +1,57 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+// WatermarkSettings are how a user's watermark is laid over their videos.
+type WatermarkSettings struct {
+	// Position is a corner, like "bottom-right", or "center".
+	Position string `json:"position"`
+	// Opacity is from just above 0, nearly transparent, to 1.
+	Opacity float64 `json:"opacity"`
+	// Scale is the watermark's width as a fraction of the video's.
+	Scale float64 `json:"scale"`
+}
+
+// GetWatermarkSettings returns the user's watermark settings, or nil if
+// they've never set them.
+func (c Client) GetWatermarkSettings(userID uuid.UUID) (*WatermarkSettings, error) {
+	var settings WatermarkSettings
+	err := c.db.QueryRow(
+		"SELECT position, opacity, scale FROM watermark_settings WHERE user_id = ?",
+		userID,
+	).Scan(&settings.Position, &settings.Opacity, &settings.Scale)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// UpdateWatermarkSettings replaces the user's watermark settings.
+func (c Client) UpdateWatermarkSettings(userID uuid.UUID, settings WatermarkSettings) error {
+	query := `
+	INSERT INTO watermark_settings (user_id, position, opacity, scale, updated_at)
+	VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+	ON CONFLICT(user_id) DO UPDATE SET
+		position = excluded.position,
+		opacity = excluded.opacity,
+		scale = excluded.scale,
+		updated_at = excluded.updated_at
+	`
+	_, err := c.db.Exec(query, userID, settings.Position, settings.Opacity, settings.Scale)
+	return err
+}
+
+// DeleteWatermarkSettings forgets the user's watermark settings, so the
+// deployment's apply again.
+func (c Client) DeleteWatermarkSettings(userID uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM watermark_settings WHERE user_id = ?", userID)
+	return err
+}
@@ -0,0 +1,77 @@
+package media
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"unicode"
+)
+
+// maxFilenameLength keeps Content-Disposition headers a sane size.
+const maxFilenameLength = 200
+
+// SniffContentType identifies a media file from its first bytes. ISO BMFF
+// files are told apart by their ftyp major brand, which the standard
+// library's sniffer doesn't look at.
+func SniffContentType(header []byte) string {
+	if len(header) >= 12 && string(header[4:8]) == "ftyp" {
+		switch string(header[8:12]) {
+		case "qt  ":
+			return "video/quicktime"
+		case "M4A ", "M4B ":
+			return "audio/mp4"
+		default:
+			return "video/mp4"
+		}
+	}
+	if bytes.HasPrefix(header, []byte{0x1a, 0x45, 0xdf, 0xa3}) {
+		if bytes.Contains(header, []byte("webm")) {
+			return "video/webm"
+		}
+		return "video/x-matroska"
+	}
+	return http.DetectContentType(header)
+}
+
+// SanitizeFilename reduces a user-supplied name, such as a video title, to
+// something safe to offer as a download name: no directories, no control
+// characters or quotes, and a bounded length. It returns "" when nothing
+// usable is left.
+func SanitizeFilename(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = path.Base(name)
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsSpace(r):
+			return ' '
+		case unicode.IsControl(r), r == '"', r == '/', r == unicode.ReplacementChar:
+			return -1
+		default:
+			return r
+		}
+	}, name)
+	name = strings.Trim(strings.Join(strings.Fields(name), " "), ". ")
+	if runes := []rune(name); len(runes) > maxFilenameLength {
+		name = strings.TrimSpace(string(runes[:maxFilenameLength]))
+	}
+	return name
+}
+
+// ContentDisposition builds an inline or attachment Content-Disposition
+// header offering filename, sanitized, with ext appended unless it is
+// already there. Non-ASCII names are carried in RFC 2231 form.
+func ContentDisposition(disposition, filename, ext string) string {
+	filename = SanitizeFilename(filename)
+	if filename == "" {
+		return disposition
+	}
+	if !strings.EqualFold(path.Ext(filename), ext) {
+		filename += ext
+	}
+	if header := mime.FormatMediaType(disposition, map[string]string{"filename": filename}); header != "" {
+		return header
+	}
+	return disposition
+}
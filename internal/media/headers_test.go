@@ -0,0 +1,70 @@
+package media
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSniffContentType(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		want   string
+	}{
+		{"isom", []byte("\x00\x00\x00\x20ftypisom\x00\x00\x02\x00"), "video/mp4"},
+		{"quicktime", []byte("\x00\x00\x00\x14ftypqt  \x00\x00\x02\x00"), "video/quicktime"},
+		{"m4a", []byte("\x00\x00\x00\x20ftypM4A \x00\x00\x00\x00"), "audio/mp4"},
+		{"matroska", []byte("\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x88matroska"), "video/x-matroska"},
+		{"webm", []byte("\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x84webm"), "video/webm"},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"), "image/png"},
+		{"unknown", []byte{0x00, 0x01, 0x02}, "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SniffContentType(tt.header); got != tt.want {
+				t.Errorf("SniffContentType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Boots the Bear", "Boots the Bear"},
+		{"../../etc/passwd", "passwd"},
+		{`C:\Users\boots\clip.mp4`, "clip.mp4"},
+		{"say \"hi\"\r\nX-Injected: 1", "say hi X-Injected: 1"},
+		{"  tabs\tand   spaces  ", "tabs and spaces"},
+		{"...", ""},
+		{"", ""},
+		{"Café ☕", "Café ☕"},
+		{strings.Repeat("a", 300), strings.Repeat("a", maxFilenameLength)},
+	}
+	for _, tt := range tests {
+		if got := SanitizeFilename(tt.name); got != tt.want {
+			t.Errorf("SanitizeFilename(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		disposition string
+		filename    string
+		want        string
+	}{
+		{"inline", "Boots the Bear", `inline; filename="Boots the Bear.mp4"`},
+		{"attachment", "clip.MP4", `attachment; filename=clip.MP4`},
+		{"attachment", "Café", `attachment; filename*=utf-8''Caf%C3%A9.mp4`},
+		{"inline", "", "inline"},
+		{"attachment", "\r\n", "attachment"},
+	}
+	for _, tt := range tests {
+		if got := ContentDisposition(tt.disposition, tt.filename, ".mp4"); got != tt.want {
+			t.Errorf("ContentDisposition(%q, %q) = %q, want %q", tt.disposition, tt.filename, got, tt.want)
+		}
+	}
+}
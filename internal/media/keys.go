@@ -0,0 +1,101 @@
+package media
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// KeyPrefixes are the top-level prefixes video objects are filed under.
+var KeyPrefixes = []string{"landscape/", "portrait/", "other/"}
+
+// KeyPrefix returns the prefix a video with the given aspect ratio is
+// filed under.
+func KeyPrefix(aspectRatio string) string {
+	switch aspectRatio {
+	case AspectLandscape:
+		return "landscape"
+	case AspectPortrait:
+		return "portrait"
+	default:
+		return "other"
+	}
+}
+
+// ObjectKey builds an object key under prefix from random bytes supplied
+// by the caller.
+func ObjectKey(prefix string, random []byte) string {
+	return prefix + "/" + base64.RawURLEncoding.EncodeToString(random) + ".mp4"
+}
+
+// maxSlugLength bounds the title part of descriptive keys.
+const maxSlugLength = 60
+
+// Slugify reduces a title to lowercase ASCII letters, digits and single
+// hyphens, so it can't add path segments, dot segments or anything else
+// with meaning to S3 or a URL. Accented Latin letters lose their accents;
+// other characters become word breaks. It returns "untitled" when nothing
+// is left.
+func Slugify(title string) string {
+	var sb strings.Builder
+	pendingHyphen := false
+	for _, r := range strings.ToLower(title) {
+		if folded, ok := foldAccents[r]; ok {
+			r = folded
+		}
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			hyphen := pendingHyphen && sb.Len() > 0
+			if hyphen && sb.Len()+2 > maxSlugLength || sb.Len()+1 > maxSlugLength {
+				break
+			}
+			if hyphen {
+				sb.WriteByte('-')
+			}
+			pendingHyphen = false
+			sb.WriteRune(r)
+			continue
+		}
+		pendingHyphen = true
+	}
+	slug := sb.String()
+	if slug == "" {
+		return "untitled"
+	}
+	return slug
+}
+
+var foldAccents = map[rune]rune{
+	'à': 'a', 'á': 'a', 'â': 'a', 'ã': 'a', 'ä': 'a', 'å': 'a',
+	'ç': 'c',
+	'è': 'e', 'é': 'e', 'ê': 'e', 'ë': 'e',
+	'ì': 'i', 'í': 'i', 'î': 'i', 'ï': 'i',
+	'ñ': 'n',
+	'ò': 'o', 'ó': 'o', 'ô': 'o', 'õ': 'o', 'ö': 'o', 'ø': 'o',
+	'ù': 'u', 'ú': 'u', 'û': 'u', 'ü': 'u',
+	'ý': 'y', 'ÿ': 'y',
+}
+
+// DescriptiveObjectKey builds a key that tells someone browsing the bucket
+// whose video an object is and roughly what it shows:
+// prefix/userID/videoID/slug-random.mp4. The random suffix keeps each
+// upload of the same video distinct.
+func DescriptiveObjectKey(prefix, userID, videoID, title string, random []byte) string {
+	return fmt.Sprintf("%s/%s/%s/%s-%s.mp4", prefix, userID, videoID, Slugify(title), base64.RawURLEncoding.EncodeToString(random))
+}
+
+// KeyFromURL recovers the object key from a delivery URL served from the
+// root of its host, where the key is the URL path without its leading
+// slash. That was the only layout before delivery URLs were built from
+// templates; see URLBuilder.ObjectKey for the rest.
+func KeyFromURL(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("could not parse video URL: %w", err)
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if key == "" {
+		return "", fmt.Errorf("video URL %q has no object key", rawURL)
+	}
+	return key, nil
+}
@@ -0,0 +1,121 @@
+package media
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKeyPrefix(t *testing.T) {
+	tests := []struct {
+		aspectRatio string
+		want        string
+	}{
+		{AspectLandscape, "landscape"},
+		{AspectPortrait, "portrait"},
+		{AspectOther, "other"},
+		{"", "other"},
+		{"4:3", "other"},
+	}
+	for _, tt := range tests {
+		if got := KeyPrefix(tt.aspectRatio); got != tt.want {
+			t.Errorf("KeyPrefix(%q) = %q, want %q", tt.aspectRatio, got, tt.want)
+		}
+		if !containsPrefix(KeyPrefixes, KeyPrefix(tt.aspectRatio)+"/") {
+			t.Errorf("KeyPrefix(%q) isn't listed in KeyPrefixes", tt.aspectRatio)
+		}
+	}
+}
+
+func containsPrefix(prefixes []string, prefix string) bool {
+	for _, p := range prefixes {
+		if p == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+func TestObjectKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		random []byte
+		want   string
+	}{
+		{"zeros", "landscape", make([]byte, 32), "landscape/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA.mp4"},
+		{"url safe alphabet", "portrait", []byte{0xfb, 0xef, 0xbe, 0xff, 0xff, 0xff}, "portrait/----____.mp4"},
+		{"no padding", "other", []byte{1}, "other/AQ.mp4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ObjectKey(tt.prefix, tt.random)
+			if got != tt.want {
+				t.Errorf("ObjectKey() = %q, want %q", got, tt.want)
+			}
+			if strings.ContainsAny(got, "+=") {
+				t.Errorf("ObjectKey() = %q isn't URL safe", got)
+			}
+		})
+	}
+}
+
+func TestKeyFromURL(t *testing.T) {
+	tests := []struct {
+		rawURL  string
+		want    string
+		wantErr bool
+	}{
+		{"https://cdn.example.com/other/x.mp4?v=2", "other/x.mp4", false},
+		{"https://cdn.example.com/", "", true},
+		{"https://cdn.example.com", "", true},
+		{"://bad", "", true},
+	}
+	for _, tt := range tests {
+		got, err := KeyFromURL(tt.rawURL)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("KeyFromURL(%q) error = %v, wantErr %v", tt.rawURL, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("KeyFromURL(%q) = %q, want %q", tt.rawURL, got, tt.want)
+		}
+	}
+}
+
+func TestSlugify(t *testing.T) {
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{"Boots the Bear", "boots-the-bear"},
+		{"  Leading & trailing!  ", "leading-trailing"},
+		{"Crème Brûlée", "creme-brulee"},
+		{"../../etc/passwd", "etc-passwd"},
+		{"a/b\\c?d#e%2Ff", "a-b-c-d-e-2ff"},
+		{"日本語", "untitled"},
+		{"", "untitled"},
+		{"--", "untitled"},
+		{strings.Repeat("ab ", 40), strings.TrimSuffix(strings.Repeat("ab-", 20), "-")},
+	}
+	for _, tt := range tests {
+		got := Slugify(tt.title)
+		if got != tt.want {
+			t.Errorf("Slugify(%q) = %q, want %q", tt.title, got, tt.want)
+		}
+		if len(got) > maxSlugLength {
+			t.Errorf("Slugify(%q) is %d bytes long", tt.title, len(got))
+		}
+	}
+}
+
+func TestDescriptiveObjectKey(t *testing.T) {
+	got := DescriptiveObjectKey("landscape", "5f766366-8507-497c-aa1c-b2257635db28", "56ba725d-faad-43ed-9bbf-839c7dfa7354", "My/../Trip", []byte{0xfb, 0xff, 0x00, 0x01, 0x02, 0x03})
+	want := "landscape/5f766366-8507-497c-aa1c-b2257635db28/56ba725d-faad-43ed-9bbf-839c7dfa7354/my-trip--_8AAQID.mp4"
+	if got != want {
+		t.Errorf("DescriptiveObjectKey() = %q, want %q", got, want)
+	}
+	key, err := KeyFromURL("https://cdn.example.com/" + got)
+	if err != nil || key != got {
+		t.Errorf("KeyFromURL round trip = %q, %v", key, err)
+	}
+}
@@ -0,0 +1,284 @@
+package media
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+// maxMoovSize caps how much metadata NativeMP4 will read into memory.
+const maxMoovSize = 64 << 20 // 64 MB
+
+var ErrNotMP4 = errors.New("not an MP4 file")
+
+// mp4Codecs maps sample entry types to the codec names ffprobe reports.
+var mp4Codecs = map[string]string{
+	"avc1": "h264",
+	"avc3": "h264",
+	"hvc1": "hevc",
+	"hev1": "hevc",
+	"av01": "av1",
+	"vp09": "vp9",
+	"vp08": "vp8",
+	"mp4v": "mpeg4",
+	"mp4a": "aac",
+	"Opus": "opus",
+	"fLaC": "flac",
+	"ac-3": "ac3",
+	"ec-3": "eac3",
+	".mp3": "mp3",
+}
+
+// NativeMP4 probes MP4 and QuickTime files by parsing their moov box, for
+// deployments without ffprobe. It only reads local files, and reports the
+// container's duration from mvhd.
+type NativeMP4 struct{}
+
+func (NativeMP4) Probe(path string) (Info, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Info{}, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return Info{}, err
+	}
+	moov, err := readMoov(f, stat.Size())
+	if err != nil {
+		return Info{}, err
+	}
+	return parseMoov(moov)
+}
+
+// readMoov walks the top-level boxes of the file and returns the body of
+// the moov box.
+func readMoov(f *os.File, fileSize int64) ([]byte, error) {
+	header := make([]byte, 16)
+	for offset := int64(0); offset+8 <= fileSize; {
+		if _, err := f.ReadAt(header[:8], offset); err != nil {
+			return nil, err
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		boxType := string(header[4:8])
+		headerSize := int64(8)
+		switch size {
+		case 0:
+			size = fileSize - offset
+		case 1:
+			if _, err := f.ReadAt(header[8:16], offset+8); err != nil {
+				return nil, ErrNotMP4
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		}
+		if size < headerSize || size > fileSize-offset {
+			return nil, ErrNotMP4
+		}
+		if offset == 0 && boxType != "ftyp" && boxType != "moov" && boxType != "wide" && boxType != "free" {
+			return nil, ErrNotMP4
+		}
+
+		if boxType == "moov" {
+			if size > maxMoovSize {
+				return nil, fmt.Errorf("moov box is %d bytes, more than the limit of %d", size, maxMoovSize)
+			}
+			moov := make([]byte, size-headerSize)
+			if _, err := f.ReadAt(moov, offset+headerSize); err != nil {
+				return nil, err
+			}
+			return moov, nil
+		}
+		offset += size
+	}
+	return nil, ErrNotMP4
+}
+
+// childBoxes splits data into boxes, returning their types and bodies.
+func childBoxes(data []byte) ([]string, [][]byte, error) {
+	var types []string
+	var bodies [][]byte
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, nil, ErrNotMP4
+		}
+		size := uint64(binary.BigEndian.Uint32(data[:4]))
+		headerSize := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, nil, ErrNotMP4
+			}
+			size = binary.BigEndian.Uint64(data[8:16])
+			headerSize = 16
+		}
+		if size < headerSize || size > uint64(len(data)) {
+			return nil, nil, ErrNotMP4
+		}
+		types = append(types, string(data[4:8]))
+		bodies = append(bodies, data[headerSize:size])
+		data = data[size:]
+	}
+	return types, bodies, nil
+}
+
+// findBox follows a path of box types down from data and returns the body
+// of the first match.
+func findBox(data []byte, path ...string) ([]byte, bool) {
+	for _, want := range path {
+		types, bodies, err := childBoxes(data)
+		if err != nil {
+			return nil, false
+		}
+		found := false
+		for i, boxType := range types {
+			if boxType == want {
+				data = bodies[i]
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+func parseMoov(moov []byte) (Info, error) {
+	var info Info
+
+	mvhd, ok := findBox(moov, "mvhd")
+	if !ok {
+		return Info{}, fmt.Errorf("%w: missing mvhd box", ErrNotMP4)
+	}
+	info.Duration = parseMvhdDuration(mvhd)
+
+	types, bodies, err := childBoxes(moov)
+	if err != nil {
+		return Info{}, err
+	}
+	for i, boxType := range types {
+		if boxType != "trak" {
+			continue
+		}
+		trak := bodies[i]
+		hdlr, ok := findBox(trak, "mdia", "hdlr")
+		if !ok || len(hdlr) < 12 {
+			continue
+		}
+		entry, ok := firstSampleEntry(trak)
+		if !ok {
+			continue
+		}
+		codec := sampleEntryCodec(entry)
+
+		switch string(hdlr[8:12]) {
+		case "vide":
+			if info.VideoCodec != "" || len(entry) < 36 {
+				continue
+			}
+			info.VideoCodec = codec
+			info.Width = int(binary.BigEndian.Uint16(entry[32:34]))
+			info.Height = int(binary.BigEndian.Uint16(entry[34:36]))
+			if tkhd, ok := findBox(trak, "tkhd"); ok {
+				info.Rotation = parseTkhdRotation(tkhd)
+			}
+		case "soun":
+			if info.AudioCodec == "" {
+				info.AudioCodec = codec
+			}
+			language := LanguageUndetermined
+			if mdhd, ok := findBox(trak, "mdia", "mdhd"); ok {
+				language = parseMdhdLanguage(mdhd)
+			}
+			info.AudioLanguages = append(info.AudioLanguages, language)
+		}
+	}
+	return info, nil
+}
+
+// firstSampleEntry returns the first entry of a track's stsd box, header
+// included.
+func firstSampleEntry(trak []byte) ([]byte, bool) {
+	stsd, ok := findBox(trak, "mdia", "minf", "stbl", "stsd")
+	if !ok || len(stsd) < 16 {
+		return nil, false
+	}
+	entries := stsd[8:]
+	size := binary.BigEndian.Uint32(entries[:4])
+	if size < 8 || uint64(size) > uint64(len(entries)) {
+		return nil, false
+	}
+	return entries[:size], true
+}
+
+func sampleEntryCodec(entry []byte) string {
+	fourcc := string(entry[4:8])
+	if codec, ok := mp4Codecs[fourcc]; ok {
+		return codec
+	}
+	return strings.TrimSpace(fourcc)
+}
+
+func parseMvhdDuration(mvhd []byte) float64 {
+	var timescale uint32
+	var duration uint64
+	switch {
+	case len(mvhd) >= 32 && mvhd[0] == 1:
+		timescale = binary.BigEndian.Uint32(mvhd[20:24])
+		duration = binary.BigEndian.Uint64(mvhd[24:32])
+	case len(mvhd) >= 20 && mvhd[0] == 0:
+		timescale = binary.BigEndian.Uint32(mvhd[12:16])
+		duration = uint64(binary.BigEndian.Uint32(mvhd[16:20]))
+	}
+	if timescale == 0 {
+		return 0
+	}
+	return float64(duration) / float64(timescale)
+}
+
+// parseMdhdLanguage reads a track's ISO 639-2 language, which is packed as
+// three 5-bit letters offset from 0x60, or "und" if it's missing or
+// malformed.
+func parseMdhdLanguage(mdhd []byte) string {
+	offset := 20
+	if len(mdhd) > 0 && mdhd[0] == 1 {
+		offset = 32
+	}
+	if len(mdhd) < offset+2 {
+		return LanguageUndetermined
+	}
+	packed := binary.BigEndian.Uint16(mdhd[offset:])
+	letters := []byte{
+		byte(packed>>10&0x1f) + 0x60,
+		byte(packed>>5&0x1f) + 0x60,
+		byte(packed&0x1f) + 0x60,
+	}
+	if language := NormalizeLanguage(string(letters)); language != "" {
+		return language
+	}
+	return LanguageUndetermined
+}
+
+// parseTkhdRotation reads the clockwise display rotation from the track's
+// transformation matrix, rounded to a quarter turn.
+func parseTkhdRotation(tkhd []byte) int {
+	matrixOffset := 40
+	if len(tkhd) > 0 && tkhd[0] == 1 {
+		matrixOffset = 52
+	}
+	if len(tkhd) < matrixOffset+36 {
+		return 0
+	}
+	a := float64(int32(binary.BigEndian.Uint32(tkhd[matrixOffset:])))
+	b := float64(int32(binary.BigEndian.Uint32(tkhd[matrixOffset+4:])))
+	degrees := math.Atan2(b, a) * 180 / math.Pi
+	return normalizeRotation(int(math.Round(degrees/90)) * 90)
+}
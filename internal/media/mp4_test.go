@@ -0,0 +1,201 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func mp4Box(boxType string, body ...[]byte) []byte {
+	data := bytes.Join(body, nil)
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(8+len(data)))
+	copy(header[4:], boxType)
+	return append(header, data...)
+}
+
+func mvhdBox(timescale, duration uint32) []byte {
+	body := make([]byte, 100)
+	binary.BigEndian.PutUint32(body[12:], timescale)
+	binary.BigEndian.PutUint32(body[16:], duration)
+	return mp4Box("mvhd", body)
+}
+
+// tkhdBox builds a version 0 tkhd with the matrix {a, b, c, d}, in 16.16
+// fixed point.
+func tkhdBox(a, b, c, d int32) []byte {
+	body := make([]byte, 84)
+	for i, v := range []int32{a, b, 0, c, d, 0, 0, 0, 0x40000000} {
+		binary.BigEndian.PutUint32(body[40+4*i:], uint32(v))
+	}
+	return mp4Box("tkhd", body)
+}
+
+func trakBox(tkhd []byte, handler, fourcc string, width, height uint16) []byte {
+	hdlr := make([]byte, 24)
+	copy(hdlr[8:], handler)
+
+	entry := make([]byte, 78)
+	binary.BigEndian.PutUint16(entry[24:], width)
+	binary.BigEndian.PutUint16(entry[26:], height)
+	stsd := make([]byte, 8)
+	binary.BigEndian.PutUint32(stsd[4:], 1)
+
+	return mp4Box("trak",
+		tkhd,
+		mp4Box("mdia",
+			mp4Box("mdhd", make([]byte, 24)),
+			mp4Box("hdlr", hdlr),
+			mp4Box("minf", mp4Box("stbl", mp4Box("stsd", stsd, mp4Box(fourcc, entry)))),
+		),
+	)
+}
+
+// withLanguage returns a copy of trak with its version 0 mdhd tagged with
+// an ISO 639-2 language.
+func withLanguage(trak []byte, language string) []byte {
+	tagged := bytes.Clone(trak)
+	offset := bytes.Index(tagged, []byte("mdhd")) + 4 + 20
+	packed := uint16(language[0]-0x60)<<10 | uint16(language[1]-0x60)<<5 | uint16(language[2]-0x60)
+	binary.BigEndian.PutUint16(tagged[offset:], packed)
+	return tagged
+}
+
+func writeMP4(t *testing.T, boxes ...[]byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "video.mp4")
+	if err := os.WriteFile(path, bytes.Join(boxes, nil), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNativeMP4Probe(t *testing.T) {
+	const one = 0x10000
+	ftyp := mp4Box("ftyp", []byte("isom\x00\x00\x02\x00isomavc1"))
+	mdat := mp4Box("mdat", make([]byte, 64))
+	audio := trakBox(tkhdBox(one, 0, 0, one), "soun", "mp4a", 0, 0)
+
+	tests := []struct {
+		name  string
+		boxes [][]byte
+		want  Info
+	}{
+		{
+			name: "landscape, moov last",
+			boxes: [][]byte{ftyp, mdat, mp4Box("moov",
+				mvhdBox(1000, 12345),
+				trakBox(tkhdBox(one, 0, 0, one), "vide", "avc1", 1920, 1080),
+				audio,
+			)},
+			want: Info{Width: 1920, Height: 1080, Duration: 12.345, VideoCodec: "h264", AudioCodec: "aac", AudioLanguages: []string{"und"}},
+		},
+		{
+			name: "phone portrait, rotated a quarter turn",
+			boxes: [][]byte{ftyp, mp4Box("moov",
+				mvhdBox(600, 18600),
+				trakBox(tkhdBox(0, one, -one, 0), "vide", "hvc1", 1920, 1080),
+				audio,
+			), mdat},
+			want: Info{Width: 1920, Height: 1080, Rotation: 90, Duration: 31, VideoCodec: "hevc", AudioCodec: "aac", AudioLanguages: []string{"und"}},
+		},
+		{
+			name: "upside down",
+			boxes: [][]byte{ftyp, mp4Box("moov",
+				mvhdBox(1, 5),
+				trakBox(tkhdBox(-one, 0, 0, -one), "vide", "av01", 1280, 720),
+			), mdat},
+			want: Info{Width: 1280, Height: 720, Rotation: 180, Duration: 5, VideoCodec: "av1"},
+		},
+		{
+			name: "audio track first",
+			boxes: [][]byte{ftyp, mp4Box("moov",
+				mvhdBox(1, 60),
+				audio,
+				trakBox(tkhdBox(0, -one, one, 0), "vide", "avc1", 1280, 720),
+			), mdat},
+			want: Info{Width: 1280, Height: 720, Rotation: 270, Duration: 60, VideoCodec: "h264", AudioCodec: "aac", AudioLanguages: []string{"und"}},
+		},
+		{
+			name:  "audio only",
+			boxes: [][]byte{ftyp, mp4Box("moov", mvhdBox(44100, 441000), audio), mdat},
+			want:  Info{Duration: 10, AudioCodec: "aac", AudioLanguages: []string{"und"}},
+		},
+		{
+			name: "audio tracks in two languages",
+			boxes: [][]byte{ftyp, mp4Box("moov",
+				mvhdBox(1, 60),
+				trakBox(tkhdBox(one, 0, 0, one), "vide", "avc1", 1920, 1080),
+				withLanguage(audio, "eng"),
+				withLanguage(audio, "spa"),
+			), mdat},
+			want: Info{Width: 1920, Height: 1080, Duration: 60, VideoCodec: "h264", AudioCodec: "aac", AudioLanguages: []string{"eng", "spa"}},
+		},
+		{
+			name: "unknown codec keeps its fourcc",
+			boxes: [][]byte{ftyp, mp4Box("moov",
+				mvhdBox(1, 1),
+				trakBox(tkhdBox(one, 0, 0, one), "vide", "xyz ", 640, 480),
+			), mdat},
+			want: Info{Width: 640, Height: 480, Duration: 1, VideoCodec: "xyz"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NativeMP4{}.Probe(writeMP4(t, tt.boxes...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Probe() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNativeMP4ProbeRejectsOtherFiles(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"matroska", []byte("\x1a\x45\xdf\xa3\x93\x42\x82\x88matroska")},
+		{"empty", nil},
+		{"no moov", bytes.Join([][]byte{mp4Box("ftyp", []byte("isom")), mp4Box("mdat", make([]byte, 16))}, nil)},
+		{"truncated box", mp4Box("ftyp", []byte("isom"))[:10]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "file")
+			if err := os.WriteFile(path, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := (NativeMP4{}).Probe(path); !errors.Is(err, ErrNotMP4) {
+				t.Errorf("Probe() error = %v, want ErrNotMP4", err)
+			}
+		})
+	}
+}
+
+func TestInfoAspectRatio(t *testing.T) {
+	tests := []struct {
+		name string
+		info Info
+		want string
+	}{
+		{"landscape", Info{Width: 1920, Height: 1080, VideoCodec: "h264"}, AspectLandscape},
+		{"rotated landscape is portrait", Info{Width: 1920, Height: 1080, Rotation: 90, VideoCodec: "h264"}, AspectPortrait},
+		{"upside down stays landscape", Info{Width: 1920, Height: 1080, Rotation: 180, VideoCodec: "h264"}, AspectLandscape},
+		{"no video stream", Info{Width: 1920, Height: 1080, AudioCodec: "aac", AudioLanguages: []string{"und"}}, AspectOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.info.AspectRatio(); got != tt.want {
+				t.Errorf("AspectRatio() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+// Package media holds the pure parts of the video pipeline: probing media
+// files, choosing where an object is filed, and building the URLs videos are
+// delivered from. Apart from the FFprobe prober, nothing here runs a binary
+// or touches the network, so it can be tested against recorded fixtures.
+package media
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	AspectLandscape = "16:9"
+	AspectPortrait  = "9:16"
+	AspectOther     = "other"
+)
+
+// ProbeOutput is the subset of `ffprobe -print_format json -show_streams
+// -show_format` output the pipeline uses.
+type ProbeOutput struct {
+	Streams []ProbeStream `json:"streams"`
+	Format  ProbeFormat   `json:"format"`
+}
+
+type ProbeStream struct {
+	Index        int               `json:"index"`
+	CodecName    string            `json:"codec_name"`
+	CodecType    string            `json:"codec_type"`
+	Width        int               `json:"width"`
+	Height       int               `json:"height"`
+	Tags         map[string]string `json:"tags"`
+	SideDataList []ProbeSideData   `json:"side_data_list"`
+}
+
+type ProbeSideData struct {
+	SideDataType string  `json:"side_data_type"`
+	Rotation     float64 `json:"rotation"`
+}
+
+type ProbeFormat struct {
+	Duration string `json:"duration"`
+}
+
+func ParseProbeOutput(data []byte) (ProbeOutput, error) {
+	var probe ProbeOutput
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return ProbeOutput{}, fmt.Errorf("could not unmarshal ffprobe output: %w", err)
+	}
+	return probe, nil
+}
+
+// Rotation returns how far the stream is rotated clockwise for display, in
+// degrees normalized to [0, 360). Newer ffprobe reports the display matrix
+// angle, which is counterclockwise; older versions a clockwise "rotate" tag.
+func (s ProbeStream) Rotation() int {
+	for _, sideData := range s.SideDataList {
+		if sideData.SideDataType == "Display Matrix" && sideData.Rotation != 0 {
+			return normalizeRotation(-int(sideData.Rotation))
+		}
+	}
+	degrees, _ := strconv.Atoi(s.Tags["rotate"])
+	return normalizeRotation(degrees)
+}
+
+func normalizeRotation(degrees int) int {
+	return ((degrees % 360) + 360) % 360
+}
+
+// LanguageUndetermined is the ISO 639-2 code for a stream whose language
+// isn't known.
+const LanguageUndetermined = "und"
+
+// NormalizeLanguage returns code in lower case if it's a three-letter ISO
+// 639-2 language code, the kind containers tag streams with, or "" if it
+// isn't one.
+func NormalizeLanguage(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	if len(code) != 3 {
+		return ""
+	}
+	for _, r := range code {
+		if r < 'a' || r > 'z' {
+			return ""
+		}
+	}
+	return code
+}
+
+// Language returns the stream's language, or "und" if it isn't tagged with
+// one.
+func (s ProbeStream) Language() string {
+	if language := NormalizeLanguage(s.Tags["language"]); language != "" {
+		return language
+	}
+	return LanguageUndetermined
+}
+
+// Info summarizes the first video and audio streams of the probed file,
+// and the languages of all its audio streams.
+func (p ProbeOutput) Info() Info {
+	var info Info
+	for _, stream := range p.Streams {
+		switch {
+		case stream.CodecType == "video" && info.VideoCodec == "":
+			info.VideoCodec = stream.CodecName
+			info.Width = stream.Width
+			info.Height = stream.Height
+			info.Rotation = stream.Rotation()
+		case stream.CodecType == "audio":
+			if info.AudioCodec == "" {
+				info.AudioCodec = stream.CodecName
+			}
+			info.AudioLanguages = append(info.AudioLanguages, stream.Language())
+		}
+	}
+	info.Duration, _ = strconv.ParseFloat(p.Format.Duration, 64)
+	return info
+}
+
+// AspectRatio classifies the video as 16:9, 9:16 or other. Files without a
+// video stream are "other".
+func AspectRatio(probe ProbeOutput) string {
+	return probe.Info().AspectRatio()
+}
+
+// AspectRatioOf classifies a width and height the same way AspectRatio does.
+func AspectRatioOf(width, height int) string {
+	if height == 0 {
+		return AspectOther
+	}
+
+	ratio := float64(width) / float64(height)
+	if ratio > 1.7 && ratio < 1.8 {
+		return AspectLandscape
+	}
+	if ratio > 0.55 && ratio < 0.57 {
+		return AspectPortrait
+	}
+	return AspectOther
+}
+
+// Duration returns the container duration in seconds.
+func Duration(probe ProbeOutput) (float64, error) {
+	duration, err := strconv.ParseFloat(probe.Format.Duration, 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse duration %q: %w", probe.Format.Duration, err)
+	}
+	return duration, nil
+}
@@ -0,0 +1,175 @@
+package media
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// probeSummary is everything the pipeline derives from one ffprobe run.
+type probeSummary struct {
+	AspectRatio string  `json:"aspect_ratio"`
+	KeyPrefix   string  `json:"key_prefix"`
+	VideoCodec  string  `json:"video_codec"`
+	AudioCodec  string  `json:"audio_codec"`
+	Rotation    int     `json:"rotation"`
+	Width       int     `json:"display_width"`
+	Height      int     `json:"display_height"`
+	Duration    float64 `json:"duration"`
+	// AudioLanguages is left out for files without audio
+	AudioLanguages []string `json:"audio_languages,omitempty"`
+}
+
+func TestProbeGolden(t *testing.T) {
+	fixtures, err := filepath.Glob(filepath.Join("testdata", "ffprobe", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) == 0 {
+		t.Fatal("no ffprobe fixtures found")
+	}
+
+	for _, fixture := range fixtures {
+		name := strings.TrimSuffix(filepath.Base(fixture), ".json")
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile(fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			probe, err := ParseProbeOutput(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			info := probe.Info()
+			summary := probeSummary{
+				AspectRatio:    AspectRatio(probe),
+				VideoCodec:     info.VideoCodec,
+				AudioCodec:     info.AudioCodec,
+				Rotation:       info.Rotation,
+				AudioLanguages: info.AudioLanguages,
+			}
+			summary.KeyPrefix = KeyPrefix(summary.AspectRatio)
+			summary.Width, summary.Height = info.DisplayDimensions()
+			summary.Duration, err = Duration(probe)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := json.MarshalIndent(summary, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			goldenPath := strings.TrimSuffix(fixture, ".json") + ".golden"
+			if *update {
+				if err := os.WriteFile(goldenPath, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatalf("missing golden file (run with -update): %v", err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("summary changed\ngot:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestAspectRatioOf(t *testing.T) {
+	tests := []struct {
+		name   string
+		width  int
+		height int
+		want   string
+	}{
+		{"1080p", 1920, 1080, AspectLandscape},
+		{"720p", 1280, 720, AspectLandscape},
+		{"odd encoder rounding", 854, 480, AspectLandscape},
+		{"vertical 1080p", 1080, 1920, AspectPortrait},
+		{"vertical 720p", 720, 1280, AspectPortrait},
+		{"square", 1080, 1080, AspectOther},
+		{"4:3", 640, 480, AspectOther},
+		{"ultrawide", 2560, 1080, AspectOther},
+		{"zero height", 1920, 0, AspectOther},
+		{"zero size", 0, 0, AspectOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := AspectRatioOf(tt.width, tt.height); got != tt.want {
+				t.Errorf("AspectRatioOf(%d, %d) = %q, want %q", tt.width, tt.height, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRotation(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream ProbeStream
+		want   int
+	}{
+		{"none", ProbeStream{}, 0},
+		{"display matrix is counterclockwise", ProbeStream{SideDataList: []ProbeSideData{{SideDataType: "Display Matrix", Rotation: -90}}}, 90},
+		{"display matrix wins over tag", ProbeStream{
+			Tags:         map[string]string{"rotate": "180"},
+			SideDataList: []ProbeSideData{{SideDataType: "Display Matrix", Rotation: 90}},
+		}, 270},
+		{"other side data ignored", ProbeStream{SideDataList: []ProbeSideData{{SideDataType: "Spherical Mapping", Rotation: 90}}}, 0},
+		{"tag", ProbeStream{Tags: map[string]string{"rotate": "90"}}, 90},
+		{"full turn", ProbeStream{Tags: map[string]string{"rotate": "360"}}, 0},
+		{"garbage tag", ProbeStream{Tags: map[string]string{"rotate": "sideways"}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.stream.Rotation(); got != tt.want {
+				t.Errorf("Rotation() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeLanguage(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"eng", "eng"},
+		{"FRA", "fra"},
+		{" deu ", "deu"},
+		{"und", "und"},
+		{"en", ""},
+		{"en-US", ""},
+		{"e1g", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := NormalizeLanguage(tt.code); got != tt.want {
+			t.Errorf("NormalizeLanguage(%q) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestParseProbeOutputErrors(t *testing.T) {
+	if _, err := ParseProbeOutput([]byte("Invalid data found when processing input")); err == nil {
+		t.Error("expected an error for non-JSON output")
+	}
+	probe, err := ParseProbeOutput([]byte(`{"streams": [], "format": {}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := AspectRatio(probe); got != AspectOther {
+		t.Errorf("AspectRatio of empty probe = %q, want %q", got, AspectOther)
+	}
+	if _, err := Duration(probe); err == nil {
+		t.Error("expected an error for a missing duration")
+	}
+}
@@ -0,0 +1,86 @@
+package media
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// Prober reads what the pipeline needs to know about a media file.
+type Prober interface {
+	Probe(path string) (Info, error)
+}
+
+// Info describes the first video and audio streams of a file. Codecs use
+// ffprobe's names and are empty when the file has no such stream.
+type Info struct {
+	Width      int
+	Height     int
+	Rotation   int // clockwise degrees, 0, 90, 180 or 270
+	Duration   float64
+	VideoCodec string
+	AudioCodec string
+	// AudioLanguages holds the ISO 639-2 language of each audio stream, in
+	// stream order, with "und" for streams that aren't tagged
+	AudioLanguages []string
+}
+
+// DisplayDimensions returns the width and height the video is shown at,
+// swapping the coded dimensions for streams rotated a quarter turn.
+func (i Info) DisplayDimensions() (int, int) {
+	if i.Rotation == 90 || i.Rotation == 270 {
+		return i.Height, i.Width
+	}
+	return i.Width, i.Height
+}
+
+// AspectRatio classifies the video as 16:9, 9:16 or other as it is
+// displayed. Files without a video stream are "other".
+func (i Info) AspectRatio() string {
+	if i.VideoCodec == "" {
+		return AspectOther
+	}
+	return AspectRatioOf(i.DisplayDimensions())
+}
+
+// FFprobe probes files, or URLs, by running the ffprobe binary.
+type FFprobe struct {
+	// Command, when set, builds the ffprobe command in place of
+	// exec.Command, e.g. to run it in a sandbox
+	Command func(name string, args ...string) *exec.Cmd
+	// Finished, when set, is told about every ffprobe process once it
+	// exits, e.g. to account for its resource use
+	Finished func(*os.ProcessState)
+}
+
+func (p FFprobe) Probe(path string) (Info, error) {
+	command := exec.Command
+	if p.Command != nil {
+		command = p.Command
+	}
+	cmd := command("ffprobe",
+		"-v", "error",
+		"-print_format", "json",
+		"-show_streams",
+		"-show_format",
+		path,
+	)
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+
+	err := cmd.Run()
+	if p.Finished != nil && cmd.ProcessState != nil {
+		p.Finished(cmd.ProcessState)
+	}
+	if err != nil {
+		return Info{}, fmt.Errorf("could not run ffprobe: %w", err)
+	}
+
+	probe, err := ParseProbeOutput(out.Bytes())
+	if err != nil {
+		return Info{}, err
+	}
+	return probe.Info(), nil
+}
@@ -0,0 +1,150 @@
+package media
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Delivery modes decide where the URLs of unencrypted objects point.
+const (
+	// DeliveryCDN serves objects from a CDN in front of the bucket.
+	DeliveryCDN = "cdn"
+	// DeliveryS3VirtualHost serves objects straight from a public bucket,
+	// addressed as bucket.s3.region.amazonaws.com.
+	DeliveryS3VirtualHost = "s3-virtual-host"
+	// DeliveryS3Path serves objects straight from a public bucket,
+	// addressed as s3.region.amazonaws.com/bucket.
+	DeliveryS3Path = "s3-path"
+	// DeliveryPresigned points at this server, which redirects to a
+	// short-lived presigned URL, so the bucket can stay private.
+	DeliveryPresigned = "presigned"
+	// DeliveryProxy points at this server, which streams the object from
+	// the bucket itself.
+	DeliveryProxy = "proxy"
+)
+
+// deliveryTemplates are the object URL templates each mode uses unless the
+// deployment supplies its own.
+var deliveryTemplates = map[string]string{
+	DeliveryCDN:           "https://{distribution}/{key}",
+	DeliveryS3VirtualHost: "https://{bucket}.s3.{region}.amazonaws.com/{key}",
+	DeliveryS3Path:        "https://s3.{region}.amazonaws.com/{bucket}/{key}",
+	DeliveryPresigned:     "{server}/media/{key}",
+	DeliveryProxy:         "{server}/media/{key}",
+}
+
+var templatePlaceholder = regexp.MustCompile(`\{[a-z_]+\}`)
+
+// URLConfig describes how a deployment's URLs are built.
+type URLConfig struct {
+	Mode string
+	// ObjectTemplate replaces the mode's object URL template. It may use
+	// {server}, {bucket}, {region} and {distribution}, and must end with
+	// {key}.
+	ObjectTemplate string
+	// ServerURL is this server's public base URL, like
+	// "http://localhost:8091".
+	ServerURL    string
+	Bucket       string
+	Region       string
+	Distribution string
+}
+
+// URLBuilder builds the URLs the app hands to clients: object delivery URLs
+// from the configured template, and links back to this server.
+type URLBuilder struct {
+	mode         string
+	server       string
+	objectPrefix string
+}
+
+// NewURLBuilder expands the object template for config's mode, checking it
+// yields an absolute URL with the key at the end.
+func NewURLBuilder(config URLConfig) (URLBuilder, error) {
+	tmpl := config.ObjectTemplate
+	if tmpl == "" {
+		var ok bool
+		tmpl, ok = deliveryTemplates[config.Mode]
+		if !ok {
+			return URLBuilder{}, fmt.Errorf("unknown delivery mode %q", config.Mode)
+		}
+	} else if _, ok := deliveryTemplates[config.Mode]; !ok {
+		return URLBuilder{}, fmt.Errorf("unknown delivery mode %q", config.Mode)
+	}
+
+	server := strings.TrimSuffix(config.ServerURL, "/")
+	if u, err := url.Parse(server); err != nil || u.Scheme == "" || u.Host == "" {
+		return URLBuilder{}, fmt.Errorf("server URL %q isn't an absolute URL", config.ServerURL)
+	}
+
+	prefix, ok := strings.CutSuffix(tmpl, "{key}")
+	if !ok {
+		return URLBuilder{}, fmt.Errorf("template %q doesn't end with {key}", tmpl)
+	}
+	vars := map[string]string{
+		"{server}":       server,
+		"{bucket}":       config.Bucket,
+		"{region}":       config.Region,
+		"{distribution}": config.Distribution,
+	}
+	var expandErr error
+	prefix = templatePlaceholder.ReplaceAllStringFunc(prefix, func(placeholder string) string {
+		value, ok := vars[placeholder]
+		if !ok {
+			expandErr = fmt.Errorf("template %q uses unknown placeholder %s", tmpl, placeholder)
+		} else if value == "" && expandErr == nil {
+			expandErr = fmt.Errorf("template %q uses %s, which isn't set", tmpl, placeholder)
+		}
+		return value
+	})
+	if expandErr != nil {
+		return URLBuilder{}, expandErr
+	}
+	if u, err := url.Parse(prefix); err != nil || u.Scheme == "" || u.Host == "" {
+		return URLBuilder{}, fmt.Errorf("template %q doesn't give an absolute URL", tmpl)
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		return URLBuilder{}, fmt.Errorf("template %q must have a / before {key}", tmpl)
+	}
+
+	return URLBuilder{mode: config.Mode, server: server, objectPrefix: prefix}, nil
+}
+
+// Mode is the delivery mode the builder was configured with.
+func (b URLBuilder) Mode() string {
+	return b.mode
+}
+
+// Object is the delivery URL for an unencrypted object.
+func (b URLBuilder) Object(key string) string {
+	return b.objectPrefix + key
+}
+
+// ObjectKey recovers the key from a URL built by Object, reporting false for
+// URLs built some other way.
+func (b URLBuilder) ObjectKey(rawURL string) (string, bool) {
+	key, ok := strings.CutPrefix(rawURL, b.objectPrefix)
+	if !ok {
+		return "", false
+	}
+	if i := strings.IndexAny(key, "?#"); i >= 0 {
+		key = key[:i]
+	}
+	if key == "" {
+		return "", false
+	}
+	return key, true
+}
+
+// Stream is the authenticated proxy URL used for encrypted videos, which a
+// CDN or public bucket can't serve.
+func (b URLBuilder) Stream(videoID string) string {
+	return b.server + "/api/videos/" + videoID + "/stream"
+}
+
+// Server is the public URL of a path on this server.
+func (b URLBuilder) Server(path string) string {
+	return b.server + path
+}
@@ -0,0 +1,115 @@
+package media
+
+import "testing"
+
+func testURLConfig(mode string) URLConfig {
+	return URLConfig{
+		Mode:         mode,
+		ServerURL:    "http://localhost:8091",
+		Bucket:       "tubely-123",
+		Region:       "us-east-2",
+		Distribution: "d111111abcdef8.cloudfront.net",
+	}
+}
+
+func TestURLBuilderModes(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     string
+		template string
+		key      string
+		wantURL  string
+	}{
+		{"cdn", DeliveryCDN, "", "landscape/abc.mp4", "https://d111111abcdef8.cloudfront.net/landscape/abc.mp4"},
+		{"cdn domain", DeliveryCDN, "https://videos.example.com/{key}", "portrait/-_-_.mp4", "https://videos.example.com/portrait/-_-_.mp4"},
+		{"cdn domain with path", DeliveryCDN, "https://cdn.example.com/tubely/{key}", "other/x.mp4", "https://cdn.example.com/tubely/other/x.mp4"},
+		{"s3 virtual host", DeliveryS3VirtualHost, "", "landscape/abc.mp4", "https://tubely-123.s3.us-east-2.amazonaws.com/landscape/abc.mp4"},
+		{"s3 path style", DeliveryS3Path, "", "landscape/abc.mp4", "https://s3.us-east-2.amazonaws.com/tubely-123/landscape/abc.mp4"},
+		{"s3 compatible endpoint", DeliveryS3Path, "http://minio.internal:9000/{bucket}/{key}", "thumbnails/a.png", "http://minio.internal:9000/tubely-123/thumbnails/a.png"},
+		{"presigned", DeliveryPresigned, "", "landscape/abc.mp4", "http://localhost:8091/media/landscape/abc.mp4"},
+		{"proxy", DeliveryProxy, "", "landscape/u/v/my-trip-AQ.mp4", "http://localhost:8091/media/landscape/u/v/my-trip-AQ.mp4"},
+		{"proxy with explicit template", DeliveryProxy, "{server}/media/{key}", "other/x.mp4", "http://localhost:8091/media/other/x.mp4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testURLConfig(tt.mode)
+			config.ObjectTemplate = tt.template
+			b, err := NewURLBuilder(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b.Mode() != tt.mode {
+				t.Errorf("Mode() = %q, want %q", b.Mode(), tt.mode)
+			}
+			gotURL := b.Object(tt.key)
+			if gotURL != tt.wantURL {
+				t.Fatalf("Object() = %q, want %q", gotURL, tt.wantURL)
+			}
+			gotKey, ok := b.ObjectKey(gotURL)
+			if !ok || gotKey != tt.key {
+				t.Errorf("ObjectKey(%q) = %q, %v, want %q", gotURL, gotKey, ok, tt.key)
+			}
+			if gotKey, ok := b.ObjectKey(gotURL + "?v=2"); !ok || gotKey != tt.key {
+				t.Errorf("ObjectKey() with a query = %q, %v, want %q", gotKey, ok, tt.key)
+			}
+		})
+	}
+}
+
+func TestURLBuilderObjectKeyElsewhere(t *testing.T) {
+	b, err := NewURLBuilder(testURLConfig(DeliveryS3Path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rawURL := range []string{
+		"https://s3.us-east-2.amazonaws.com/tubely-123/",
+		"https://s3.us-east-2.amazonaws.com/other-bucket/landscape/abc.mp4",
+		"https://d111111abcdef8.cloudfront.net/landscape/abc.mp4",
+		"http://localhost:8091/assets/a.png",
+	} {
+		if key, ok := b.ObjectKey(rawURL); ok {
+			t.Errorf("ObjectKey(%q) = %q, want no key", rawURL, key)
+		}
+	}
+}
+
+func TestNewURLBuilderErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config func(*URLConfig)
+	}{
+		{"unknown mode", func(c *URLConfig) { c.Mode = "ftp" }},
+		{"unknown mode with template", func(c *URLConfig) { c.Mode = "ftp"; c.ObjectTemplate = "https://cdn.example.com/{key}" }},
+		{"key not last", func(c *URLConfig) { c.ObjectTemplate = "https://cdn.example.com/{key}?v=1" }},
+		{"no key", func(c *URLConfig) { c.ObjectTemplate = "https://cdn.example.com/" }},
+		{"no slash before key", func(c *URLConfig) { c.ObjectTemplate = "https://cdn.example.com/v-{key}" }},
+		{"unknown placeholder", func(c *URLConfig) { c.ObjectTemplate = "https://{host}/{key}" }},
+		{"unset placeholder", func(c *URLConfig) { c.Distribution = "" }},
+		{"relative", func(c *URLConfig) { c.ObjectTemplate = "/videos/{key}" }},
+		{"relative server", func(c *URLConfig) { c.ServerURL = "localhost:8091" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testURLConfig(DeliveryCDN)
+			tt.config(&config)
+			if _, err := NewURLBuilder(config); err == nil {
+				t.Errorf("NewURLBuilder(%+v) succeeded, want an error", config)
+			}
+		})
+	}
+}
+
+func TestURLBuilderServer(t *testing.T) {
+	config := testURLConfig(DeliveryCDN)
+	config.ServerURL = "https://tubely.example.com/"
+	b, err := NewURLBuilder(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b.Stream("0b6d4b6c-5c4a-4f4e-9a59-6d3b8e9c1f00"), "https://tubely.example.com/api/videos/0b6d4b6c-5c4a-4f4e-9a59-6d3b8e9c1f00/stream"; got != want {
+		t.Errorf("Stream() = %q, want %q", got, want)
+	}
+	if got, want := b.Server("/api/downloads/abc"), "https://tubely.example.com/api/downloads/abc"; got != want {
+		t.Errorf("Server() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+)
+
+// s3InventoryReportKey is the setting holding the latest reconciliation,
+// as JSON.
+const s3InventoryReportKey = "s3_inventory:report"
+
+// maxInventorySamples bounds how many keys of each kind of problem a report
+// lists; the counts are always complete.
+const maxInventorySamples = 20
+
+type inventoryPrefixStats struct {
+	Objects int64 `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// inventoryReport is what one S3 Inventory report says about the bucket,
+// reconciled with the videos in the database. Videos changed after S3 took
+// the inventory can't be in it, so they're never counted missing.
+type inventoryReport struct {
+	Manifest   string    `json:"manifest"`
+	TakenAt    time.Time `json:"taken_at"`
+	IngestedAt time.Time `json:"ingested_at"`
+	// Prefixes counts every object in the report by its top-level prefix
+	Prefixes map[string]inventoryPrefixStats `json:"prefixes"`
+	// VideoObjects is how many video files the database points at
+	VideoObjects int `json:"video_objects"`
+	// Missing video files are in the database but not the bucket
+	Missing     int      `json:"missing"`
+	MissingKeys []string `json:"missing_keys"`
+	// SizeMismatches are video files whose size differs from the one
+	// recorded when they were stored
+	SizeMismatches    int      `json:"size_mismatches"`
+	SizeMismatchKeys  []string `json:"size_mismatch_keys"`
+	Unreferenced      int      `json:"unreferenced"`
+	UnreferencedBytes int64    `json:"unreferenced_bytes"`
+	UnreferencedKeys  []string `json:"unreferenced_keys"`
+}
+
+// inventoryManifest is the manifest.json S3 writes next to each inventory
+// report, listing the data files that make it up.
+type inventoryManifest struct {
+	CreationTimestamp string `json:"creationTimestamp"`
+	FileFormat        string `json:"fileFormat"`
+	FileSchema        string `json:"fileSchema"`
+	Files             []struct {
+		Key         string `json:"key"`
+		MD5Checksum string `json:"MD5checksum"`
+	} `json:"files"`
+}
+
+// ingestS3Inventory reconciles the newest S3 Inventory report under prefix
+// in bucket with the database, so object counts and sizes can be checked
+// without listing millions of keys. A report that has already been ingested
+// is skipped. Only reports in the CSV format can be read.
+func (cfg *apiConfig) ingestS3Inventory(ctx context.Context, bucket, prefix string) error {
+	manifestKey, err := cfg.latestInventoryManifest(ctx, bucket, prefix)
+	if err != nil {
+		return fmt.Errorf("couldn't find inventory report: %w", err)
+	}
+	if manifestKey == "" {
+		return nil
+	}
+	if previous, found, err := cfg.db.GetSetting(s3InventoryReportKey); err != nil {
+		return err
+	} else if found {
+		var report inventoryReport
+		if err := json.Unmarshal([]byte(previous), &report); err == nil && report.Manifest == manifestKey {
+			return nil
+		}
+	}
+
+	var manifest inventoryManifest
+	if err := cfg.readInventoryObject(ctx, bucket, manifestKey, "", func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(&manifest)
+	}); err != nil {
+		return fmt.Errorf("couldn't read inventory manifest %s: %w", manifestKey, err)
+	}
+	if !strings.EqualFold(manifest.FileFormat, "CSV") {
+		return fmt.Errorf("inventory report %s is in the %s format; configure the inventory to write CSV", manifestKey, manifest.FileFormat)
+	}
+	columns := map[string]int{}
+	for i, name := range strings.Split(manifest.FileSchema, ",") {
+		columns[strings.TrimSpace(name)] = i
+	}
+	keyColumn, hasKey := columns["Key"]
+	sizeColumn, hasSize := columns["Size"]
+	if !hasKey || !hasSize {
+		return fmt.Errorf("inventory report %s has no Key and Size fields", manifestKey)
+	}
+	millis, err := strconv.ParseInt(manifest.CreationTimestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("inventory manifest %s has no valid creationTimestamp", manifestKey)
+	}
+
+	report := inventoryReport{
+		Manifest:         manifestKey,
+		TakenAt:          time.UnixMilli(millis).UTC(),
+		Prefixes:         map[string]inventoryPrefixStats{},
+		MissingKeys:      []string{},
+		SizeMismatchKeys: []string{},
+		UnreferencedKeys: []string{},
+	}
+
+	// Only the database is held in memory; the report is streamed past it
+	refs, err := cfg.db.GetVideoObjectRefs()
+	if err != nil {
+		return err
+	}
+	sizes, err := cfg.db.GetObjectSizes()
+	if err != nil {
+		return err
+	}
+	expected := make(map[string]bool, len(refs))
+	recent := map[string]bool{}
+	for _, ref := range refs {
+		key := ref.S3Key
+		if !ref.Encrypted {
+			if key, err = cfg.s3KeyFromURL(ref.VideoURL); err != nil {
+				continue
+			}
+		}
+		if key == "" {
+			continue
+		}
+		expected[key] = true
+		if ref.UpdatedAt.After(report.TakenAt) {
+			recent[key] = true
+		}
+	}
+	report.VideoObjects = len(expected)
+
+	addRow := func(key string, size int64) {
+		prefix, _, found := strings.Cut(key, "/")
+		if found {
+			prefix += "/"
+		}
+		stats := report.Prefixes[prefix]
+		stats.Objects++
+		stats.Bytes += size
+		report.Prefixes[prefix] = stats
+
+		if expected[key] {
+			delete(expected, key)
+			if recorded, ok := sizes[key]; ok && recorded != size {
+				report.SizeMismatches++
+				if len(report.SizeMismatchKeys) < maxInventorySamples {
+					report.SizeMismatchKeys = append(report.SizeMismatchKeys, key)
+				}
+			}
+			return
+		}
+		if !isVideoObjectKey(key) || recent[key] {
+			return
+		}
+		report.Unreferenced++
+		report.UnreferencedBytes += size
+		if len(report.UnreferencedKeys) < maxInventorySamples {
+			report.UnreferencedKeys = append(report.UnreferencedKeys, key)
+		}
+	}
+
+	for _, file := range manifest.Files {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err := cfg.readInventoryObject(ctx, bucket, file.Key, file.MD5Checksum, func(body io.Reader) error {
+			return readInventoryCSV(body, strings.HasSuffix(file.Key, ".gz"), columns, keyColumn, sizeColumn, addRow)
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't read inventory file %s: %w", file.Key, err)
+		}
+	}
+	for key := range expected {
+		if recent[key] {
+			continue
+		}
+		report.Missing++
+		if len(report.MissingKeys) < maxInventorySamples {
+			report.MissingKeys = append(report.MissingKeys, key)
+		}
+	}
+
+	report.IngestedAt = time.Now().UTC()
+	value, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	if err := cfg.db.PutSetting(s3InventoryReportKey, string(value)); err != nil {
+		return err
+	}
+	for prefix, stats := range report.Prefixes {
+		cfg.metrics.set(`tubely_inventory_objects{prefix="`+prefix+`"}`, float64(stats.Objects))
+		cfg.metrics.set(`tubely_inventory_bytes{prefix="`+prefix+`"}`, float64(stats.Bytes))
+	}
+	cfg.metrics.set("tubely_inventory_missing_objects", float64(report.Missing))
+	cfg.metrics.set("tubely_inventory_size_mismatches", float64(report.SizeMismatches))
+	cfg.metrics.set("tubely_inventory_unreferenced_objects", float64(report.Unreferenced))
+	log.Printf("Ingested inventory %s: %d video files expected, %d missing, %d size mismatches, %d unreferenced",
+		manifestKey, report.VideoObjects, report.Missing, report.SizeMismatches, report.Unreferenced)
+	return nil
+}
+
+// latestInventoryManifest finds the manifest of the newest report. S3 files
+// each report under a folder named for when it was taken, like
+// "2026-10-14T01-00Z/", which sort in date order.
+func (cfg *apiConfig) latestInventoryManifest(ctx context.Context, bucket, prefix string) (string, error) {
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	delimiter := "/"
+	var latest string
+	paginator := s3.NewListObjectsV2Paginator(cfg.s3Client, &s3.ListObjectsV2Input{
+		Bucket:    &bucket,
+		Prefix:    &prefix,
+		Delimiter: &delimiter,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return "", err
+		}
+		for _, p := range page.CommonPrefixes {
+			if p.Prefix == nil {
+				continue
+			}
+			// Skip data/ and hive/
+			folder := strings.TrimPrefix(*p.Prefix, prefix)
+			if folder == "" || folder[0] < '0' || folder[0] > '9' {
+				continue
+			}
+			latest = max(latest, *p.Prefix)
+		}
+	}
+	if latest == "" {
+		return "", nil
+	}
+	return latest + "manifest.json", nil
+}
+
+// readInventoryObject hands an object's body to read, then checks it
+// against the MD5 the manifest lists for it, if any.
+func (cfg *apiConfig) readInventoryObject(ctx context.Context, bucket, key, md5Checksum string, read func(io.Reader) error) error {
+	out, err := cfg.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return err
+	}
+	defer out.Body.Close()
+
+	hash := md5.New()
+	body := io.TeeReader(out.Body, hash)
+	if err := read(body); err != nil {
+		return err
+	}
+	if md5Checksum == "" {
+		return nil
+	}
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != strings.ToLower(md5Checksum) {
+		return errors.New("file doesn't match the MD5 checksum in the manifest")
+	}
+	return nil
+}
+
+// readInventoryCSV calls addRow with the key and size of every current
+// object in an inventory data file. Keys are URL-encoded in the report.
+// Versioned buckets also list old versions and delete markers, which don't
+// count.
+func readInventoryCSV(body io.Reader, gzipped bool, columns map[string]int, keyColumn, sizeColumn int, addRow func(key string, size int64)) error {
+	if gzipped {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		body = gz
+	}
+	isLatestColumn, versioned := columns["IsLatest"]
+	deleteMarkerColumn, hasDeleteMarkers := columns["IsDeleteMarker"]
+
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if keyColumn >= len(record) || sizeColumn >= len(record) {
+			return fmt.Errorf("row has %d fields, fewer than the schema", len(record))
+		}
+		if versioned && isLatestColumn < len(record) && record[isLatestColumn] != "true" {
+			continue
+		}
+		if hasDeleteMarkers && deleteMarkerColumn < len(record) && record[deleteMarkerColumn] == "true" {
+			continue
+		}
+		key, err := url.QueryUnescape(record[keyColumn])
+		if err != nil {
+			return fmt.Errorf("couldn't decode key %q: %w", record[keyColumn], err)
+		}
+		size, err := strconv.ParseInt(record[sizeColumn], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid size %q for %s", record[sizeColumn], key)
+		}
+		addRow(key, size)
+	}
+}
+
+// isVideoObjectKey reports whether key is filed where video files go.
+func isVideoObjectKey(key string) bool {
+	for _, prefix := range media.KeyPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// handlerInventoryGet returns the latest reconciliation of an S3 Inventory
+// report with the database.
+func (cfg *apiConfig) handlerInventoryGet(w http.ResponseWriter, r *http.Request) {
+	if _, ok := cfg.authenticateAdmin(w, r); !ok {
+		return
+	}
+
+	value, found, err := cfg.db.GetSetting(s3InventoryReportKey)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get inventory report", err)
+		return
+	}
+	if !found {
+		respondWithError(w, http.StatusNotFound, "No inventory report has been ingested yet", nil)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, json.RawMessage(value))
+}
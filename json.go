@@ -2,22 +2,40 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 )
 
 func respondWithError(w http.ResponseWriter, code int, msg string, err error) {
+	respondWithErrorCode(w, code, "", msg, err)
+}
+
+// respondWithErrorCode adds a stable machine-readable code to the error body
+// for failures clients are expected to handle programmatically.
+//
+// Any error caused by the database being unreachable is answered with 503
+// instead, so clients retry an outage rather than treating it as a bug.
+func respondWithErrorCode(w http.ResponseWriter, code int, errorCode, msg string, err error) {
 	if err != nil {
 		log.Println(err)
 	}
+	if errors.Is(err, database.ErrUnavailable) {
+		code, errorCode, msg = http.StatusServiceUnavailable, "database_unavailable", "The database is unavailable, try again shortly"
+		w.Header().Set("Retry-After", "5")
+	}
 	if code > 499 {
 		log.Printf("Responding with 5XX error: %s", msg)
 	}
 	type errorResponse struct {
 		Error string `json:"error"`
+		Code  string `json:"code,omitempty"`
 	}
 	respondWithJSON(w, code, errorResponse{
 		Error: msg,
+		Code:  errorCode,
 	})
 }
 
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var errEncryptionDisabled = errors.New("encryption at rest is not configured")
+
+// keyWrapper protects per-video data keys before they are written to the
+// keystore table, so a database dump alone can't decrypt any video.
+type keyWrapper interface {
+	Wrap(ctx context.Context, plaintext []byte) ([]byte, error)
+	Unwrap(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// kmsKeyWrapper wraps data keys with an AWS KMS key.
+type kmsKeyWrapper struct {
+	client *kms.Client
+	keyID  string
+}
+
+func (k kmsKeyWrapper) Wrap(ctx context.Context, plaintext []byte) ([]byte, error) {
+	out, err := k.client.Encrypt(ctx, &kms.EncryptInput{
+		KeyId:     &k.keyID,
+		Plaintext: plaintext,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not wrap data key with KMS: %w", err)
+	}
+	return out.CiphertextBlob, nil
+}
+
+func (k kmsKeyWrapper) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	out, err := k.client.Decrypt(ctx, &kms.DecryptInput{
+		KeyId:          &k.keyID,
+		CiphertextBlob: wrapped,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not unwrap data key with KMS: %w", err)
+	}
+	return out.Plaintext, nil
+}
+
+// localKeyWrapper wraps data keys with AES-256-GCM under a master key from
+// the environment, for deployments without KMS.
+type localKeyWrapper struct {
+	aead cipher.AEAD
+}
+
+func newLocalKeyWrapper(masterKey []byte) (localKeyWrapper, error) {
+	if len(masterKey) != 32 {
+		return localKeyWrapper{}, fmt.Errorf("master key must be 32 bytes, got %d", len(masterKey))
+	}
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return localKeyWrapper{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return localKeyWrapper{}, err
+	}
+	return localKeyWrapper{aead: aead}, nil
+}
+
+func (l localKeyWrapper) Wrap(_ context.Context, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, l.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return l.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (l localKeyWrapper) Unwrap(_ context.Context, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < l.aead.NonceSize() {
+		return nil, errors.New("wrapped key is too short")
+	}
+	nonce, ciphertext := wrapped[:l.aead.NonceSize()], wrapped[l.aead.NonceSize():]
+	return l.aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// newDataKey generates a fresh SSE-C key for one video and returns it along
+// with its wrapped form for the keystore.
+func (cfg *apiConfig) newDataKey(ctx context.Context) ([]byte, []byte, error) {
+	if cfg.keyWrapper == nil {
+		return nil, nil, errEncryptionDisabled
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := cfg.keyWrapper.Wrap(ctx, dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dataKey, wrapped, nil
+}
+
+// sseCustomerKey holds the three SSE-C request parameters S3 expects for a
+// customer-provided AES-256 key.
+type sseCustomerKey struct {
+	algorithm string
+	key       string
+	keyMD5    string
+}
+
+func newSSECustomerKey(dataKey []byte) *sseCustomerKey {
+	sum := md5.Sum(dataKey)
+	return &sseCustomerKey{
+		algorithm: "AES256",
+		key:       base64.StdEncoding.EncodeToString(dataKey),
+		keyMD5:    base64.StdEncoding.EncodeToString(sum[:]),
+	}
+}
+
+func (k *sseCustomerKey) applyToPut(input *s3.PutObjectInput) {
+	if k == nil {
+		return
+	}
+	input.SSECustomerAlgorithm = &k.algorithm
+	input.SSECustomerKey = &k.key
+	input.SSECustomerKeyMD5 = &k.keyMD5
+}
+
+func (k *sseCustomerKey) applyToHead(input *s3.HeadObjectInput) {
+	if k == nil {
+		return
+	}
+	input.SSECustomerAlgorithm = &k.algorithm
+	input.SSECustomerKey = &k.key
+	input.SSECustomerKeyMD5 = &k.keyMD5
+}
+
+func (k *sseCustomerKey) applyToGet(input *s3.GetObjectInput) {
+	if k == nil {
+		return
+	}
+	input.SSECustomerAlgorithm = &k.algorithm
+	input.SSECustomerKey = &k.key
+	input.SSECustomerKeyMD5 = &k.keyMD5
+}
+
+// applyToCopy reads the source with the key and encrypts the copy with it
+// too.
+func (k *sseCustomerKey) applyToCopy(input *s3.CopyObjectInput) {
+	if k == nil {
+		return
+	}
+	input.CopySourceSSECustomerAlgorithm = &k.algorithm
+	input.CopySourceSSECustomerKey = &k.key
+	input.CopySourceSSECustomerKeyMD5 = &k.keyMD5
+	input.SSECustomerAlgorithm = &k.algorithm
+	input.SSECustomerKey = &k.key
+	input.SSECustomerKeyMD5 = &k.keyMD5
+}
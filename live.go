@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// liveListenTimeout is how long a session's RTMP listener waits for the
+// broadcaster to connect before giving up.
+const liveListenTimeout = 10 * time.Minute
+
+// liveSessionRetention is how long a finished session can still be looked
+// up, so the broadcaster can see how it ended, before it's forgotten.
+const liveSessionRetention = 5 * time.Minute
+
+const (
+	liveStatusWaiting    = "waiting"
+	liveStatusProcessing = "processing"
+	liveStatusCompleted  = "completed"
+	liveStatusExpired    = "expired"
+	liveStatusFailed     = "failed"
+)
+
+var errNoFreeIngestPort = errors.New("no free live ingest port")
+
+type liveSession struct {
+	VideoID    uuid.UUID `json:"video_id"`
+	ServerURL  string    `json:"server_url"`
+	StreamName string    `json:"stream_name"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	userID     uuid.UUID
+	port       int
+}
+
+// liveIngest records RTMP broadcasts with ffmpeg in listen mode. Each session
+// borrows a port from a fixed pool for the lifetime of one broadcast. The
+// broadcaster connects to it with the user's stream key as the RTMP app
+// name, which relayLiveBroadcast checks before passing the broadcast on to
+// ffmpeg on loopback.
+type liveIngest struct {
+	mu             sync.Mutex
+	publicHost     string
+	recordingsRoot string
+	freePorts      []int
+	sessions       map[uuid.UUID]*liveSession
+}
+
+// parsePortRange parses "19350-19359" (or a single port) into a port list.
+func parsePortRange(spec string) ([]int, error) {
+	first, last, found := strings.Cut(spec, "-")
+	start, err := strconv.Atoi(strings.TrimSpace(first))
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", first)
+	}
+	end := start
+	if found {
+		end, err = strconv.Atoi(strings.TrimSpace(last))
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", last)
+		}
+	}
+	if start < 1 || end > 65535 || end < start {
+		return nil, fmt.Errorf("invalid port range %q", spec)
+	}
+	var ports []int
+	for port := start; port <= end; port++ {
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+func newLiveIngest(publicHost, recordingsRoot string, ports []int) *liveIngest {
+	return &liveIngest{
+		publicHost:     publicHost,
+		recordingsRoot: recordingsRoot,
+		freePorts:      ports,
+		sessions:       map[uuid.UUID]*liveSession{},
+	}
+}
+
+func (li *liveIngest) session(videoID uuid.UUID) (liveSession, bool) {
+	li.mu.Lock()
+	defer li.mu.Unlock()
+	session, ok := li.sessions[videoID]
+	if !ok {
+		return liveSession{}, false
+	}
+	return *session, true
+}
+
+func (li *liveIngest) setStatus(videoID uuid.UUID, status, errMsg string) {
+	li.mu.Lock()
+	defer li.mu.Unlock()
+	if session, ok := li.sessions[videoID]; ok {
+		session.Status = status
+		session.Error = errMsg
+	}
+}
+
+func (li *liveIngest) releasePort(port int) {
+	li.mu.Lock()
+	defer li.mu.Unlock()
+	li.freePorts = append(li.freePorts, port)
+}
+
+// finish records how a session ended and forgets it after
+// liveSessionRetention.
+func (li *liveIngest) finish(videoID uuid.UUID, status, errMsg string) {
+	li.setStatus(videoID, status, errMsg)
+	time.AfterFunc(liveSessionRetention, func() {
+		li.mu.Lock()
+		defer li.mu.Unlock()
+		delete(li.sessions, videoID)
+	})
+}
+
+// freeLoopbackPort finds a port ffmpeg can listen on, on loopback only.
+func freeLoopbackPort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// startLiveSession starts an RTMP listener for the draft video and returns
+// the connection details for the broadcaster.
+func (cfg *apiConfig) startLiveSession(video database.Video, streamKey string) (liveSession, error) {
+	li := cfg.liveIngest
+
+	li.mu.Lock()
+	if len(li.freePorts) == 0 {
+		li.mu.Unlock()
+		return liveSession{}, errNoFreeIngestPort
+	}
+	port := li.freePorts[0]
+	li.freePorts = li.freePorts[1:]
+	session := &liveSession{
+		VideoID:    video.ID,
+		ServerURL:  fmt.Sprintf("rtmp://%s:%d/%s", li.publicHost, port, streamKey),
+		StreamName: "live",
+		Status:     liveStatusWaiting,
+		StartedAt:  time.Now().UTC(),
+		userID:     video.UserID,
+		port:       port,
+	}
+	li.sessions[video.ID] = session
+	li.mu.Unlock()
+
+	fail := func(err error) (liveSession, error) {
+		li.releasePort(port)
+		li.finish(video.ID, liveStatusFailed, err.Error())
+		return liveSession{}, err
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return fail(fmt.Errorf("could not listen for the broadcaster: %w", err))
+	}
+	listener.(*net.TCPListener).SetDeadline(time.Now().Add(liveListenTimeout))
+	ffmpegPort, err := freeLoopbackPort()
+	if err != nil {
+		listener.Close()
+		return fail(err)
+	}
+
+	recordingPath := filepath.Join(li.recordingsRoot, video.ID.String()+".mkv")
+	cmd := liveMediaCommand("ffmpeg",
+		"-y",
+		"-rtmp_listen", "1",
+		"-timeout", strconv.Itoa(int(liveListenTimeout.Seconds())),
+		"-i", fmt.Sprintf("rtmp://127.0.0.1:%d/live/%s", ffmpegPort, session.StreamName),
+		"-c", "copy",
+		// Matroska stays playable if the broadcaster drops mid-stream,
+		// unlike an MP4 that never got its moov atom written
+		"-f", "matroska",
+		recordingPath,
+	)
+	if err := cmd.Start(); err != nil {
+		listener.Close()
+		return fail(fmt.Errorf("could not start ffmpeg: %w", err))
+	}
+
+	go relayLiveBroadcast(listener, fmt.Sprintf("127.0.0.1:%d", ffmpegPort), streamKey, video.ID)
+	go cfg.finishLiveSession(cmd, listener, video.ID, port, recordingPath)
+
+	return *session, nil
+}
+
+// finishLiveSession waits for the broadcast to end and then runs the
+// recording through the same processing pipeline as an upload, with the
+// user's default upload options.
+func (cfg *apiConfig) finishLiveSession(cmd *mediaCmd, listener net.Listener, videoID uuid.UUID, port int, recordingPath string) {
+	li := cfg.liveIngest
+	defer os.Remove(recordingPath)
+
+	waitErr := cmd.Wait()
+	recordCommand("live_ingest", cmd)
+	listener.Close()
+	li.releasePort(port)
+
+	info, err := os.Stat(recordingPath)
+	if err != nil || info.Size() == 0 {
+		li.finish(videoID, liveStatusExpired, "broadcaster never connected")
+		return
+	}
+	if waitErr != nil {
+		// ffmpeg exits non-zero when the broadcaster disconnects abruptly;
+		// whatever it managed to record is still worth keeping
+		log.Printf("Live session %s ended with: %v", videoID, waitErr)
+	}
+
+	li.setStatus(videoID, liveStatusProcessing, "")
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil || video.ID == uuid.Nil {
+		li.finish(videoID, liveStatusFailed, "video was deleted during the broadcast")
+		return
+	}
+
+	// The pipeline only takes MP4s
+	mp4Path := strings.TrimSuffix(recordingPath, filepath.Ext(recordingPath)) + ".mp4"
+	defer os.Remove(mp4Path)
+	err = runFFmpeg("live_remux",
+		"-y",
+		"-i", recordingPath,
+		"-c", "copy",
+		"-f", "mp4",
+		mp4Path,
+	)
+	if err != nil {
+		li.finish(videoID, liveStatusFailed, err.Error())
+		return
+	}
+
+	session, _ := li.session(videoID)
+	settings, err := cfg.db.GetUserSettings(session.userID)
+	if err != nil {
+		li.finish(videoID, liveStatusFailed, err.Error())
+		return
+	}
+	opts := uploadFlags{}.options(settings.UploadDefaults)
+
+	ctx := context.Background()
+	release, err := cfg.processing.acquire(ctx, session.userID, priorityBackground)
+	if err != nil {
+		li.finish(videoID, liveStatusFailed, err.Error())
+		return
+	}
+	// A recording has no uploaded name; it's saved under the title
+	_, err = cfg.processVideoUpload(ctx, video, session.userID, mp4Path, "", opts)
+	release()
+	var uploadErr *uploadError
+	if errors.As(err, &uploadErr) {
+		li.finish(videoID, liveStatusFailed, uploadErr.msg)
+		return
+	}
+	if err != nil {
+		li.finish(videoID, liveStatusFailed, err.Error())
+		return
+	}
+	li.finish(videoID, liveStatusCompleted, "")
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// rtmpHandshakeSize is the size of the C1, C2, S1 and S2 packets
+	rtmpHandshakeSize = 1536
+	rtmpVersion       = 3
+	// rtmpConnectTimeout is how long a broadcaster has to get from
+	// connecting to sending its connect command
+	rtmpConnectTimeout = 30 * time.Second
+	// rtmpMaxConnectBytes bounds what's read looking for the connect
+	// command, which is the first message a client sends after at most a
+	// chunk size change
+	rtmpMaxConnectBytes = 64 << 10
+	// liveDialTimeout is how long to keep trying to reach ffmpeg's
+	// listener, which may still be starting up
+	liveDialTimeout = 5 * time.Second
+)
+
+var errRTMPNoConnect = errors.New("no connect command")
+
+// relayLiveBroadcast accepts broadcasters on a session's public port and
+// relays the first one whose connect command names the stream key as its
+// app to ffmpeg, which listens on loopback only. ffmpeg never learns the
+// key, so it stays out of the process list, and a broadcaster with the
+// wrong key is dropped without ending the session. It returns once a
+// broadcast is relayed or the listener is closed.
+func relayLiveBroadcast(listener net.Listener, ffmpegAddr, streamKey string, videoID uuid.UUID) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn.SetDeadline(time.Now().Add(rtmpConnectTimeout))
+		br := bufio.NewReader(conn)
+		var consumed bytes.Buffer
+		app, err := acceptRTMPConnect(conn, br, &consumed)
+		if err != nil {
+			log.Printf("Live session %s: dropped broadcaster %s: %v", videoID, conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+		app, _, _ = strings.Cut(app, "?")
+		app = strings.TrimSuffix(app, "/")
+		if subtle.ConstantTimeCompare([]byte(app), []byte(streamKey)) != 1 {
+			log.Printf("Live session %s: dropped broadcaster %s with the wrong stream key", videoID, conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		upstream, err := dialRTMP(ffmpegAddr)
+		if err != nil {
+			log.Printf("Live session %s: couldn't reach ffmpeg: %v", videoID, err)
+			conn.Close()
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		listener.Close()
+		if _, err := upstream.Write(consumed.Bytes()); err != nil {
+			conn.Close()
+			upstream.Close()
+			return
+		}
+		go func() {
+			io.Copy(conn, upstream)
+			conn.Close()
+		}()
+		io.Copy(upstream, br)
+		upstream.Close()
+		return
+	}
+}
+
+// acceptRTMPConnect answers a client's handshake and reads up to its
+// connect command, returning the app it names. The bytes read after the
+// handshake are kept in consumed, to be replayed to ffmpeg.
+func acceptRTMPConnect(conn net.Conn, br *bufio.Reader, consumed *bytes.Buffer) (string, error) {
+	c0c1 := make([]byte, 1+rtmpHandshakeSize)
+	if _, err := io.ReadFull(br, c0c1); err != nil {
+		return "", fmt.Errorf("couldn't read handshake: %w", err)
+	}
+	if c0c1[0] != rtmpVersion {
+		return "", fmt.Errorf("unsupported RTMP version %d", c0c1[0])
+	}
+	s1, err := newRTMPHandshakePacket()
+	if err != nil {
+		return "", err
+	}
+	reply := append([]byte{rtmpVersion}, s1...)
+	// S2 echoes C1
+	reply = append(reply, c0c1[1:]...)
+	if _, err := conn.Write(reply); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(br, make([]byte, rtmpHandshakeSize)); err != nil {
+		return "", fmt.Errorf("couldn't read handshake: %w", err)
+	}
+
+	r := io.TeeReader(io.LimitReader(br, rtmpMaxConnectBytes), consumed)
+	return readRTMPConnectApp(r)
+}
+
+// dialRTMP connects to ffmpeg's listener and performs the client side of
+// the handshake.
+func dialRTMP(addr string) (net.Conn, error) {
+	deadline := time.Now().Add(liveDialTimeout)
+	var conn net.Conn
+	var err error
+	for {
+		conn, err = net.DialTimeout("tcp", addr, time.Second)
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(rtmpConnectTimeout))
+	c1, err := newRTMPHandshakePacket()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := conn.Write(append([]byte{rtmpVersion}, c1...)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s0s1s2 := make([]byte, 1+2*rtmpHandshakeSize)
+	if _, err := io.ReadFull(conn, s0s1s2); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("couldn't read handshake: %w", err)
+	}
+	// C2 echoes S1
+	if _, err := conn.Write(s0s1s2[1 : 1+rtmpHandshakeSize]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// newRTMPHandshakePacket returns a C1 or S1: a timestamp, four zero bytes
+// and random filler.
+func newRTMPHandshakePacket() ([]byte, error) {
+	packet := make([]byte, rtmpHandshakeSize)
+	binary.BigEndian.PutUint32(packet, uint32(time.Now().Unix()))
+	if _, err := rand.Read(packet[8:]); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// readRTMPConnectApp reads RTMP chunks until the connect command is
+// complete and returns its app. Only chunk size changes may come before
+// it.
+func readRTMPConnectApp(r io.Reader) (string, error) {
+	const (
+		typeSetChunkSize = 1
+		typeAMF3Command  = 17
+		typeAMF0Command  = 20
+	)
+
+	chunkSize := 128
+	var length, msgType int
+	var extended bool
+	var payload []byte
+	for {
+		var basic [1]byte
+		if _, err := io.ReadFull(r, basic[:]); err != nil {
+			return "", err
+		}
+		format := basic[0] >> 6
+		switch basic[0] & 0x3f {
+		case 0:
+			if _, err := io.ReadFull(r, make([]byte, 1)); err != nil {
+				return "", err
+			}
+		case 1:
+			if _, err := io.ReadFull(r, make([]byte, 2)); err != nil {
+				return "", err
+			}
+		}
+
+		header := make([]byte, [4]int{11, 7, 3, 0}[format])
+		if _, err := io.ReadFull(r, header); err != nil {
+			return "", err
+		}
+		switch {
+		case format <= 1:
+			if payload != nil {
+				return "", errRTMPNoConnect
+			}
+			length = int(header[3])<<16 | int(header[4])<<8 | int(header[5])
+			if length > rtmpMaxConnectBytes {
+				return "", errRTMPNoConnect
+			}
+			msgType = int(header[6])
+			extended = header[0] == 0xff && header[1] == 0xff && header[2] == 0xff
+			payload = make([]byte, 0, length)
+		case payload == nil:
+			return "", errRTMPNoConnect
+		case format == 2:
+			extended = header[0] == 0xff && header[1] == 0xff && header[2] == 0xff
+		}
+		if extended {
+			if _, err := io.ReadFull(r, make([]byte, 4)); err != nil {
+				return "", err
+			}
+		}
+
+		n := min(chunkSize, length-len(payload))
+		chunk := make([]byte, n)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return "", err
+		}
+		payload = append(payload, chunk...)
+		if len(payload) < length {
+			continue
+		}
+
+		switch msgType {
+		case typeSetChunkSize:
+			if len(payload) < 4 {
+				return "", errRTMPNoConnect
+			}
+			chunkSize = int(binary.BigEndian.Uint32(payload) & 0x7fffffff)
+			if chunkSize < 1 {
+				return "", errRTMPNoConnect
+			}
+			payload = nil
+		case typeAMF3Command:
+			if len(payload) == 0 {
+				return "", errRTMPNoConnect
+			}
+			return amf0ConnectApp(payload[1:])
+		case typeAMF0Command:
+			return amf0ConnectApp(payload)
+		default:
+			return "", errRTMPNoConnect
+		}
+	}
+}
+
+// amf0ConnectApp reads the app property of an AMF0-encoded connect
+// command: the name, a transaction ID and an object of properties.
+func amf0ConnectApp(data []byte) (string, error) {
+	d := &amf0Decoder{data: data}
+	name, err := d.value()
+	if err != nil {
+		return "", err
+	}
+	if name != "connect" {
+		return "", errRTMPNoConnect
+	}
+	if _, err := d.value(); err != nil {
+		return "", err
+	}
+	marker, err := d.next(1)
+	if err != nil {
+		return "", err
+	}
+	if marker[0] != amf0Object {
+		return "", errRTMPNoConnect
+	}
+	for {
+		key, err := d.key()
+		if err != nil {
+			return "", err
+		}
+		if key == "" {
+			return "", errors.New("connect command has no app")
+		}
+		value, err := d.value()
+		if err != nil {
+			return "", err
+		}
+		if app, ok := value.(string); ok && key == "app" {
+			return app, nil
+		}
+	}
+}
+
+const (
+	amf0Number      = 0x00
+	amf0Boolean     = 0x01
+	amf0String      = 0x02
+	amf0Object      = 0x03
+	amf0Null        = 0x05
+	amf0Undefined   = 0x06
+	amf0ECMAArray   = 0x08
+	amf0ObjectEnd   = 0x09
+	amf0StrictArray = 0x0a
+	amf0Date        = 0x0b
+	amf0LongString  = 0x0c
+)
+
+// amf0Decoder reads the few AMF0 types a connect command carries. Only
+// strings are returned; other values are skipped over.
+type amf0Decoder struct {
+	data []byte
+}
+
+func (d *amf0Decoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data) < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b, nil
+}
+
+// key reads a property name. The empty name comes before the end marker
+// of an object, which it also consumes.
+func (d *amf0Decoder) key() (string, error) {
+	size, err := d.next(2)
+	if err != nil {
+		return "", err
+	}
+	key, err := d.next(int(binary.BigEndian.Uint16(size)))
+	if err != nil {
+		return "", err
+	}
+	if len(key) == 0 {
+		end, err := d.next(1)
+		if err != nil {
+			return "", err
+		}
+		if end[0] != amf0ObjectEnd {
+			return "", errors.New("malformed AMF0 object")
+		}
+	}
+	return string(key), nil
+}
+
+func (d *amf0Decoder) value() (any, error) {
+	marker, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	switch marker[0] {
+	case amf0Number:
+		_, err = d.next(8)
+	case amf0Boolean:
+		_, err = d.next(1)
+	case amf0String:
+		var size []byte
+		if size, err = d.next(2); err == nil {
+			var s []byte
+			s, err = d.next(int(binary.BigEndian.Uint16(size)))
+			return string(s), err
+		}
+	case amf0LongString:
+		var size []byte
+		if size, err = d.next(4); err == nil {
+			var s []byte
+			s, err = d.next(int(binary.BigEndian.Uint32(size)))
+			return string(s), err
+		}
+	case amf0Null, amf0Undefined:
+	case amf0Date:
+		_, err = d.next(10)
+	case amf0ECMAArray:
+		if _, err = d.next(4); err == nil {
+			err = d.skipProperties()
+		}
+	case amf0Object:
+		err = d.skipProperties()
+	case amf0StrictArray:
+		var count []byte
+		if count, err = d.next(4); err == nil {
+			for i := uint32(0); i < binary.BigEndian.Uint32(count) && err == nil; i++ {
+				_, err = d.value()
+			}
+		}
+	default:
+		err = fmt.Errorf("unsupported AMF0 type %#x", marker[0])
+	}
+	return nil, err
+}
+
+func (d *amf0Decoder) skipProperties() error {
+	for {
+		key, err := d.key()
+		if err != nil {
+			return err
+		}
+		if key == "" {
+			return nil
+		}
+		if _, err := d.value(); err != nil {
+			return err
+		}
+	}
+}
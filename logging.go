@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requestSampling decides which requests get a line in the request log.
+// Busy routes, like segment and thumbnail fetches, would drown out the rest
+// if every request were logged, so each route prefix can have its own rate.
+type requestSampling struct {
+	defaultRate float64
+	routes      []routeSampleRate
+}
+
+type routeSampleRate struct {
+	prefix string
+	rate   float64
+}
+
+// parseRequestSampling reads the default rate and a "prefix=rate,..." list
+// of per-route overrides. Rates are fractions of requests, from 0 to 1.
+func parseRequestSampling(defaultSpec, routeSpec string) (requestSampling, error) {
+	var sampling requestSampling
+	if defaultSpec != "" {
+		rate, err := strconv.ParseFloat(defaultSpec, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return requestSampling{}, fmt.Errorf("invalid sample rate %q", defaultSpec)
+		}
+		sampling.defaultRate = rate
+	}
+	for _, entry := range strings.Split(routeSpec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, rateString, ok := strings.Cut(entry, "=")
+		rate, err := strconv.ParseFloat(strings.TrimSpace(rateString), 64)
+		if !ok || !strings.HasPrefix(strings.TrimSpace(prefix), "/") || err != nil || rate < 0 || rate > 1 {
+			return requestSampling{}, fmt.Errorf("invalid route sample rate %q", entry)
+		}
+		sampling.routes = append(sampling.routes, routeSampleRate{prefix: strings.TrimSpace(prefix), rate: rate})
+	}
+	// The most specific prefix wins
+	sort.Slice(sampling.routes, func(i, j int) bool {
+		return len(sampling.routes[i].prefix) > len(sampling.routes[j].prefix)
+	})
+	return sampling, nil
+}
+
+func (s requestSampling) enabled() bool {
+	if s.defaultRate > 0 {
+		return true
+	}
+	for _, route := range s.routes {
+		if route.rate > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s requestSampling) rateFor(path string) float64 {
+	for _, route := range s.routes {
+		if strings.HasPrefix(path, route.prefix) {
+			return route.rate
+		}
+	}
+	return s.defaultRate
+}
+
+// requestLogging writes a line per sampled request once it's served. Server
+// errors are always logged, whatever the rate. The query string is left
+// out, as it can carry signatures and tokens.
+func (cfg *apiConfig) requestLogging(sampling requestSampling, next http.Handler) http.Handler {
+	if !sampling.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		lw := &loggingWriter{ResponseWriter: w, status: http.StatusOK}
+		// Escaped, so a name with spaces stays one word for redaction
+		path := r.URL.EscapedPath()
+		next.ServeHTTP(lw, r)
+
+		if lw.status < 500 && rand.Float64() >= sampling.rateFor(path) {
+			return
+		}
+		cfg.metrics.add("tubely_requests_logged_total", 1)
+		log.Printf("%s %s %d %dB %s", r.Method, path, lw.status, lw.written, time.Since(start).Round(time.Millisecond))
+	})
+}
+
+// loggingWriter notes the status and size of a response for the request
+// log.
+type loggingWriter struct {
+	http.ResponseWriter
+	status      int
+	written     int64
+	wroteHeader bool
+}
+
+func (lw *loggingWriter) WriteHeader(code int) {
+	if !lw.wroteHeader {
+		lw.wroteHeader = true
+		lw.status = code
+	}
+	lw.ResponseWriter.WriteHeader(code)
+}
+
+func (lw *loggingWriter) Write(p []byte) (int, error) {
+	lw.wroteHeader = true
+	n, err := lw.ResponseWriter.Write(p)
+	lw.written += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. to extend
+// deadlines.
+func (lw *loggingWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
+
+// logRedactions are the patterns scrubbed from log lines, by kind. Tokens
+// go first, so an email inside a token isn't counted twice.
+var logRedactions = []struct {
+	kind    string
+	pattern *regexp.Regexp
+	replace string
+}{
+	{"token", regexp.MustCompile(`(?i)\b(Bearer|Tubely-HMAC-SHA256) [^\s"']+`), "$1 [token]"},
+	{"token", regexp.MustCompile(`\beyJ[\w-]+\.[\w-]+\.[\w-]+`), "[token]"},
+	{"token", regexp.MustCompile(`(?i)\b(X-Amz-Signature|X-Amz-Credential|X-Amz-Security-Token|token|signature|sig|secret)=[^&\s"',]+`), "$1=[token]"},
+	{"token", regexp.MustCompile(`\b[0-9a-fA-F]{64}\b`), "[token]"},
+	{"email", regexp.MustCompile(`[\w.+-]+@[\w-]+(\.[\w-]+)+`), "[email]"},
+	{"filename", regexp.MustCompile(`(?i)[^\s/\\"'=:]+(\.(mp4|mov|m4v|webm|mkv|avi|png|jpe?g|gif|webp))\b`), "[filename]$1"},
+}
+
+// generatedName matches the base names the app makes up itself: random
+// keys and IDs. They say nothing about the user and are what's needed to
+// trace an object, so they aren't redacted as filenames.
+var generatedName = regexp.MustCompile(`^([\w-]{32,}|[0-9a-fA-F]{8}(-[0-9a-fA-F]{4}){3}-[0-9a-fA-F]{12})(\.\w+)+$`)
+
+// logRedactor scrubs tokens, email addresses and the names users gave
+// their files out of log lines, so logs can be shipped to a third-party
+// store. Each line that lost something says what, like
+// "redacted=email:1,token:2", and the counts go to
+// tubely_log_redactions_total, so it's clear what a log leaves out.
+type logRedactor struct {
+	out     io.Writer
+	metrics *metricsRegistry
+}
+
+// Write handles a single line, as the log package writes each entry in one
+// call.
+func (l *logRedactor) Write(p []byte) (int, error) {
+	line := string(bytes.TrimSuffix(p, []byte("\n")))
+	counts := map[string]int{}
+	for _, redaction := range logRedactions {
+		line = redaction.pattern.ReplaceAllStringFunc(line, func(match string) string {
+			if redaction.kind == "filename" && generatedName.MatchString(match) {
+				return match
+			}
+			counts[redaction.kind]++
+			return redaction.pattern.ReplaceAllString(match, redaction.replace)
+		})
+	}
+	if len(counts) > 0 {
+		kinds := make([]string, 0, len(counts))
+		for kind, n := range counts {
+			kinds = append(kinds, kind+":"+strconv.Itoa(n))
+			l.metrics.add(`tubely_log_redactions_total{kind="`+kind+`"}`, float64(n))
+		}
+		sort.Strings(kinds)
+		line += " redacted=" + strings.Join(kinds, ",")
+	}
+	if _, err := io.WriteString(l.out, line+"\n"); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// captchaVerifier checks a CAPTCHA solved by the client, for sign-ins from
+// accounts or addresses that have failed too often.
+type captchaVerifier interface {
+	Verify(ctx context.Context, token, remoteIP string) (bool, error)
+}
+
+// webhookCaptcha asks a deployment's own service whether a CAPTCHA token
+// is good. It POSTs {"token": ..., "remote_ip": ...} and expects a 2xx
+// answer of {"success": true}, the shape reCAPTCHA, hCaptcha and Turnstile
+// verification already have behind a small adapter.
+type webhookCaptcha struct {
+	httpClient *http.Client
+	url        string
+}
+
+func (c webhookCaptcha) Verify(ctx context.Context, token, remoteIP string) (bool, error) {
+	body, err := json.Marshal(map[string]string{"token": token, "remote_ip": remoteIP})
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return false, fmt.Errorf("CAPTCHA webhook answered %s", resp.Status)
+	}
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	return result.Success, nil
+}
+
+// loginSubjects are what failed sign-ins are counted against: the account
+// being signed in to, whether or not it exists, and the address trying.
+func loginSubjects(r *http.Request, email string) []string {
+	subjects := []string{database.LoginAccountSubject(email)}
+	if addrPort, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		subjects = append(subjects, "ip:"+addrPort.Addr().Unmap().String())
+	}
+	return subjects
+}
+
+// checkLoginThrottle refuses a sign-in while any of its subjects is locked
+// out, and asks for a CAPTCHA once they've failed often enough. It responds
+// and reports false when the sign-in can't go ahead.
+func (cfg *apiConfig) checkLoginThrottle(w http.ResponseWriter, r *http.Request, subjects []string, captchaToken string) bool {
+	now := time.Now()
+	failures := 0
+	for _, subject := range subjects {
+		attempts, err := cfg.db.GetLoginAttempts(subject, cfg.loginThrottle.Window)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check sign-in attempts", err)
+			return false
+		}
+		if attempts.LockedUntil.After(now) {
+			retryAfter := int(math.Ceil(attempts.LockedUntil.Sub(now).Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			respondWithErrorCode(w, http.StatusTooManyRequests, "login_locked", "Too many failed sign-in attempts, try again later", nil)
+			return false
+		}
+		failures = max(failures, attempts.Failures)
+	}
+
+	if cfg.captcha == nil || !cfg.loginThrottle.NeedsCaptcha(failures) {
+		return true
+	}
+	if captchaToken == "" {
+		respondWithErrorCode(w, http.StatusUnauthorized, "captcha_required", "Solve the CAPTCHA to sign in", nil)
+		return false
+	}
+	remoteIP := ""
+	if addrPort, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		remoteIP = addrPort.Addr().Unmap().String()
+	}
+	ok, err := cfg.captcha.Verify(r.Context(), captchaToken, remoteIP)
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't verify CAPTCHA", err)
+		return false
+	}
+	if !ok {
+		respondWithErrorCode(w, http.StatusUnauthorized, "captcha_failed", "The CAPTCHA wasn't solved", nil)
+		return false
+	}
+	return true
+}
+
+// recordLoginFailure counts a failed sign-in against each of its subjects
+// and writes an audit entry for any it locks out.
+func (cfg *apiConfig) recordLoginFailure(subjects []string) {
+	cfg.metrics.add("tubely_login_failures_total", 1)
+	for _, subject := range subjects {
+		attempts, err := cfg.db.RecordLoginFailure(subject, cfg.loginThrottle.Window, cfg.loginThrottle.Lockout)
+		if err != nil {
+			log.Printf("Couldn't record failed sign-in for %s: %v", subject, err)
+			continue
+		}
+		lockout := cfg.loginThrottle.Lockout(attempts.Failures)
+		if lockout == 0 {
+			continue
+		}
+		cfg.metrics.add("tubely_login_lockouts_total", 1)
+		err = cfg.db.CreateAuditEntry(database.AuditEntry{
+			Action:  "login_locked_out",
+			Details: fmt.Sprintf("%s locked out for %s after %d failed sign-ins", subject, lockout, attempts.Failures),
+		})
+		if err != nil {
+			log.Printf("Couldn't write audit entry: %v", err)
+		}
+	}
+}
@@ -2,14 +2,29 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/base64"
+	"flag"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
 	"github.com/google/uuid"
 
 	"github.com/joho/godotenv"
@@ -18,7 +33,7 @@ import (
 
 type apiConfig struct {
 	db               database.Client
-	jwtSecret        string
+	jwtSecret        *rotatingSecret
 	platform         string
 	filepathRoot     string
 	assetsRoot       string
@@ -27,6 +42,60 @@ type apiConfig struct {
 	s3CfDistribution string
 	port             string
 	s3Client         *s3.Client
+	// userS3, when set, writes videos with a role session per user
+	userS3          *userS3Clients
+	watermark       watermarkConfig
+	codecs          codecPolicy
+	frameCacheRoot  string
+	frameLimiter    *rateLimiter
+	viewLimiter     *rateLimiter
+	keyWrapper      keyWrapper
+	backupRetain    int
+	s3ObjectLock    bool
+	liveIngest      *liveIngest
+	metrics         *metricsRegistry
+	bandwidth       bandwidthLimits
+	minUploadRate   int64
+	uploadPartsRoot string
+	maintenance     *maintenanceSwitch
+	s3Uploads       *s3UploadTuner
+	buffers         *bufferPool
+	prober          media.Prober
+	processing      *processingQueue
+	coalesce        *coalescers
+	related         *relatedVideosCache
+	trending        *trendingFeed
+	role            string
+	instanceID      string
+	urls            media.URLBuilder
+	assetsBaseURL   string
+	cdn             cdnInvalidator
+	hook            processingHook
+	geo             geoResolver
+	loginThrottle   auth.LoginThrottle
+	captcha         captchaVerifier
+	passwords       auth.PasswordHasher
+	// reportFlagThreshold is how many users must report a video before
+	// it's flagged for moderators
+	reportFlagThreshold int
+	// webhookSigning, when set, signs the requests of outgoing webhooks
+	webhookSigning *rotatingSecret
+	// receiptKeys, when set, sign receipts for stored uploads
+	receiptKeys      *receiptKeys
+	videoHeaders     mediaClassHeaders
+	s3KeyNaming      string
+	thumbnailStorage string
+	uploadFields     uploadFormFields
+	// thumbnailVariants are the resized copies made of every thumbnail
+	thumbnailVariants []thumbnailVariant
+	// thumbnailCacheControl is sent with thumbnails from either storage
+	thumbnailCacheControl string
+	// assetURLTTL is how long signed thumbnail URLs last; zero leaves
+	// them unsigned
+	assetURLTTL time.Duration
+	// streamCache, when set, keeps blocks of videos streamed through the
+	// proxy on disk
+	streamCache *streamCache
 }
 
 type thumbnail struct {
@@ -37,6 +106,17 @@ type thumbnail struct {
 var videoThumbnails = map[uuid.UUID]thumbnail{}
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == sandboxExecArg {
+		runSandboxExec(os.Args[2:])
+	}
+
+	seed := flag.Bool("seed", false, "create demo users and videos, then exit (dev only)")
+	restoreBackup := flag.String("restore-backup", "", "replace the database with a backup from the bucket, by key or \"latest\", then exit")
+	importSource := flag.String("import", "", "import the MP4s under s3://bucket/prefix as videos of -import-user, then exit")
+	importUser := flag.String("import-user", "", "email of the account -import creates videos for")
+	userAction := flag.String("user", "", "manage an account, e.g. -user disable ada@example.com, then exit; -user help lists the actions")
+	flag.Parse()
+
 	godotenv.Load(".env")
 
 	pathToDB := os.Getenv("DB_PATH")
@@ -44,14 +124,26 @@ func main() {
 		log.Fatal("DB_URL must be set")
 	}
 
-	db, err := database.NewClient(pathToDB)
-	if err != nil {
-		log.Fatalf("Couldn't connect to database: %v", err)
+	// Read replicas are optional: copies of DB_PATH kept current by
+	// something like LiteFS, which take the load of listing and viewing
+	// videos off the primary
+	replicas := database.ReplicaConfig{MaxLag: 2 * time.Second}
+	for _, path := range strings.Split(os.Getenv("DB_REPLICA_PATHS"), ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			replicas.Paths = append(replicas.Paths, path)
+		}
+	}
+	if v := os.Getenv("DB_REPLICA_MAX_LAG"); v != "" {
+		maxLag, err := time.ParseDuration(v)
+		if err != nil || maxLag <= 0 {
+			log.Fatal("DB_REPLICA_MAX_LAG must be a positive duration")
+		}
+		replicas.MaxLag = maxLag
 	}
 
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		log.Fatal("JWT_SECRET environment variable is not set")
+	db, err := database.NewClient(pathToDB, replicas)
+	if err != nil {
+		log.Fatalf("Couldn't connect to database: %v", err)
 	}
 
 	platform := os.Getenv("PLATFORM")
@@ -59,6 +151,35 @@ func main() {
 		log.Fatal("PLATFORM environment variable is not set")
 	}
 
+	// ffmpeg and ffprobe parse untrusted uploads, so deployments can run
+	// them under limits, in a wrapper, without network or as another user
+	sandbox, err = parseMediaSandbox()
+	if err != nil {
+		log.Fatalf("Invalid media sandbox: %v", err)
+	}
+	if sandbox.configured() {
+		if err := sandbox.check(); err != nil {
+			log.Fatalf("Couldn't run media tools in the sandbox: %v", err)
+		}
+	}
+
+	metrics := newMetricsRegistry()
+
+	// S3 calls, ffmpeg runs and database writes can be made to fail or
+	// stall at random, to try out how failures are handled; dev only
+	faultConfig, err := parseFaultInjection(os.Getenv("FAULT_RATES"), os.Getenv("FAULT_DELAYS"))
+	if err != nil {
+		log.Fatalf("Invalid fault injection: %v", err)
+	}
+	if len(faultConfig) > 0 {
+		if platform != "dev" {
+			log.Fatal("FAULT_RATES and FAULT_DELAYS are only allowed with PLATFORM=dev")
+		}
+		faults = &faultInjector{layers: faultConfig, metrics: metrics}
+		db.InjectWriteFaults(faults.failDBWrite)
+		log.Printf("Injecting faults into %d layers", len(faultConfig))
+	}
+
 	filepathRoot := os.Getenv("FILEPATH_ROOT")
 	if filepathRoot == "" {
 		log.Fatal("FILEPATH_ROOT environment variable is not set")
@@ -89,12 +210,622 @@ func main() {
 		log.Fatal("PORT environment variable is not set")
 	}
 
-	// Load AWS config and create S3 client
-	awsConfig, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(s3Region))
+	// Where clients reach this server, and fetch unencrypted videos and
+	// thumbnails from: a CDN by default, the bucket itself, or this server
+	// redirecting to or streaming from the bucket
+	serverBaseURL := strings.TrimSuffix(os.Getenv("SERVER_BASE_URL"), "/")
+	if serverBaseURL == "" && os.Getenv("TLS_CERT_FILE") != "" {
+		serverBaseURL = "https://localhost:" + port
+	} else if serverBaseURL == "" {
+		serverBaseURL = "http://localhost:" + port
+	}
+	videoURLMode := os.Getenv("VIDEO_URL_MODE")
+	if videoURLMode == "" {
+		videoURLMode = media.DeliveryCDN
+	}
+	videoURLTemplate := os.Getenv("VIDEO_URL_TEMPLATE")
+	if videoBaseURL := strings.TrimSuffix(os.Getenv("VIDEO_BASE_URL"), "/"); videoBaseURL != "" && videoURLTemplate == "" {
+		if videoURLMode != media.DeliveryCDN {
+			log.Fatal("VIDEO_BASE_URL only applies to VIDEO_URL_MODE=cdn; use VIDEO_URL_TEMPLATE")
+		}
+		videoURLTemplate = videoBaseURL + "/{key}"
+	}
+	urls, err := media.NewURLBuilder(media.URLConfig{
+		Mode:           videoURLMode,
+		ObjectTemplate: videoURLTemplate,
+		ServerURL:      serverBaseURL,
+		Bucket:         s3Bucket,
+		Region:         s3Region,
+		Distribution:   s3CfDistribution,
+	})
+	if err != nil {
+		log.Fatalf("Invalid video URL settings: %v", err)
+	}
+	assetsBaseURL := strings.TrimSuffix(os.Getenv("ASSETS_BASE_URL"), "/")
+	if assetsBaseURL == "" {
+		assetsBaseURL = serverBaseURL + "/assets"
+	}
+	if u, err := url.Parse(assetsBaseURL); err != nil || u.Host == "" {
+		log.Fatal("ASSETS_BASE_URL must be an absolute URL")
+	}
+
+	watermarksRoot := os.Getenv("WATERMARKS_ROOT")
+	if watermarksRoot == "" {
+		watermarksRoot = "./watermarks"
+	}
+
+	watermarkPosition := os.Getenv("WATERMARK_POSITION")
+	if watermarkPosition == "" {
+		watermarkPosition = "bottom-right"
+	}
+	if _, err := overlayPosition(watermarkPosition); err != nil {
+		log.Fatalf("Invalid WATERMARK_POSITION: %v", err)
+	}
+
+	watermarkOpacity := 0.8
+	if v := os.Getenv("WATERMARK_OPACITY"); v != "" {
+		watermarkOpacity, err = strconv.ParseFloat(v, 64)
+		if err != nil || watermarkOpacity <= 0 || watermarkOpacity > 1 {
+			log.Fatal("WATERMARK_OPACITY must be a number between 0 and 1")
+		}
+	}
+
+	watermarkScale := 0.15
+	if v := os.Getenv("WATERMARK_SCALE"); v != "" {
+		watermarkScale, err = strconv.ParseFloat(v, 64)
+		if err != nil || watermarkScale <= 0 || watermarkScale > 1 {
+			log.Fatal("WATERMARK_SCALE must be a number between 0 and 1")
+		}
+	}
+
+	// Which codecs uploads may use, and what happens to other ones
+	videoCodecs, err := newCodecRule(os.Getenv("ALLOWED_VIDEO_CODECS"), os.Getenv("VIDEO_CODEC_MISMATCH"), defaultVideoCodecs, codecMismatchReject, videoEncoders)
+	if err != nil {
+		log.Fatalf("Invalid video codec policy: %v", err)
+	}
+	audioCodecs, err := newCodecRule(os.Getenv("ALLOWED_AUDIO_CODECS"), os.Getenv("AUDIO_CODEC_MISMATCH"), nil, codecMismatchPassThrough, audioEncoders)
+	if err != nil {
+		log.Fatalf("Invalid audio codec policy: %v", err)
+	}
+
+	frameCacheRoot := os.Getenv("FRAME_CACHE_ROOT")
+	if frameCacheRoot == "" {
+		frameCacheRoot = "./frame_cache"
+	}
+
+	// Disk space for blocks of videos streamed through the proxy; 0 turns
+	// the stream cache off
+	var streamCacheMaxBytes int64
+	if v := os.Getenv("STREAM_CACHE_MAX_BYTES"); v != "" {
+		streamCacheMaxBytes, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || streamCacheMaxBytes < 0 {
+			log.Fatal("STREAM_CACHE_MAX_BYTES must be a non-negative integer")
+		}
+	}
+	streamCacheRoot := os.Getenv("STREAM_CACHE_ROOT")
+	if streamCacheRoot == "" {
+		streamCacheRoot = "./stream_cache"
+	}
+
+	uploadPartsRoot := os.Getenv("UPLOAD_PARTS_ROOT")
+	if uploadPartsRoot == "" {
+		uploadPartsRoot = "./upload_parts"
+	}
+
+	// Per-connection transfer caps in bytes per second; 0 is unlimited
+	bandwidth, err := parseBandwidthLimits(os.Getenv("BANDWIDTH_LIMIT"), os.Getenv("BANDWIDTH_TIER_LIMITS"))
+	if err != nil {
+		log.Fatalf("Invalid bandwidth limits: %v", err)
+	}
+
+	// Fractions of requests written to the request log, overall and per
+	// route prefix. With neither set there is no request log
+	requestSampling, err := parseRequestSampling(os.Getenv("REQUEST_LOG_SAMPLE_RATE"), os.Getenv("REQUEST_LOG_ROUTE_RATES"))
+	if err != nil {
+		log.Fatalf("Invalid request log sampling: %v", err)
+	}
+
+	// Tokens, emails and filenames are scrubbed from the server's logs
+	// unless LOG_REDACT=false
+	logRedact := os.Getenv("LOG_REDACT") != "false"
+
+	// Uploads slower than this are treated as stalled and terminated
+	minUploadRate := int64(8 << 10) // 8 KB/s
+	if v := os.Getenv("MIN_UPLOAD_BYTES_PER_SEC"); v != "" {
+		minUploadRate, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || minUploadRate < 0 {
+			log.Fatal("MIN_UPLOAD_BYTES_PER_SEC must be a non-negative integer")
+		}
+	}
+
+	// ffmpeg jobs allowed to run at once; the rest wait their turn
+	processingConcurrency := runtime.NumCPU()
+	if v := os.Getenv("PROCESSING_CONCURRENCY"); v != "" {
+		processingConcurrency, err = strconv.Atoi(v)
+		if err != nil || processingConcurrency < 1 {
+			log.Fatal("PROCESSING_CONCURRENCY must be a positive integer")
+		}
+	}
+
+	// "api" queues uploads for separate "worker" nodes instead of
+	// processing them in the request
+	role := os.Getenv("ROLE")
+	if role == "" {
+		role = roleAll
+	}
+	if role != roleAll && role != roleAPI && role != roleWorker {
+		log.Fatal("ROLE must be all, api or worker")
+	}
+	workerPollInterval := 2 * time.Second
+	if v := os.Getenv("WORKER_POLL_INTERVAL"); v != "" {
+		workerPollInterval, err = time.ParseDuration(v)
+		if err != nil || workerPollInterval <= 0 {
+			log.Fatal("WORKER_POLL_INTERVAL must be a positive duration")
+		}
+	}
+
+	var s3Tuning s3HTTPTuning
+	if v := os.Getenv("S3_CONNECT_TIMEOUT"); v != "" {
+		s3Tuning.connectTimeout, err = time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid S3_CONNECT_TIMEOUT: %v", err)
+		}
+	}
+	if v := os.Getenv("S3_RESPONSE_HEADER_TIMEOUT"); v != "" {
+		s3Tuning.responseHeaderTimeout, err = time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid S3_RESPONSE_HEADER_TIMEOUT: %v", err)
+		}
+	}
+	if v := os.Getenv("S3_MAX_IDLE_CONNS_PER_HOST"); v != "" {
+		s3Tuning.maxIdleConnsPerHost, err = strconv.Atoi(v)
+		if err != nil || s3Tuning.maxIdleConnsPerHost < 0 {
+			log.Fatal("S3_MAX_IDLE_CONNS_PER_HOST must be a non-negative integer")
+		}
+	}
+
+	// Multipart uploads pick their part size between these bounds
+	s3PartSizeMin := int64(s3MinPartSize)
+	if v := os.Getenv("S3_PART_SIZE_MIN"); v != "" {
+		s3PartSizeMin, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Fatal("S3_PART_SIZE_MIN must be a number of bytes")
+		}
+	}
+	s3PartSizeMax := int64(64 << 20) // 64 MB
+	if v := os.Getenv("S3_PART_SIZE_MAX"); v != "" {
+		s3PartSizeMax, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Fatal("S3_PART_SIZE_MAX must be a number of bytes")
+		}
+	}
+	s3UploadConcurrency := 8
+	if v := os.Getenv("S3_UPLOAD_CONCURRENCY_MAX"); v != "" {
+		s3UploadConcurrency, err = strconv.Atoi(v)
+		if err != nil {
+			log.Fatal("S3_UPLOAD_CONCURRENCY_MAX must be an integer")
+		}
+	}
+	s3Uploads, err := newS3UploadTuner(s3PartSizeMin, s3PartSizeMax, s3UploadConcurrency)
+	if err != nil {
+		log.Fatalf("Invalid multipart upload settings: %v", err)
+	}
+
+	// "auto" uses ffprobe when it is installed and the pure-Go MP4 parser
+	// otherwise
+	ffprobe := media.FFprobe{
+		Command: func(name string, args ...string) *exec.Cmd {
+			return mediaCommand(name, args...).Cmd
+		},
+		Finished: func(state *os.ProcessState) {
+			processUsage.record("ffprobe", "probe", state)
+		},
+	}
+	var prober media.Prober
+	switch mediaProber := os.Getenv("MEDIA_PROBER"); mediaProber {
+	case "", "auto":
+		prober = ffprobe
+		if _, err := exec.LookPath("ffprobe"); err != nil {
+			log.Print("ffprobe not found, probing videos with the native MP4 parser")
+			prober = media.NativeMP4{}
+		}
+	case "ffprobe":
+		prober = ffprobe
+	case "native":
+		prober = media.NativeMP4{}
+	default:
+		log.Fatal("MEDIA_PROBER must be auto, ffprobe or native")
+	}
+
+	// "auto" benchmarks the endpoints at startup and keeps the fastest
+	s3Accelerate := os.Getenv("S3_ACCELERATE")
+	if s3Accelerate != "" && s3Accelerate != "true" && s3Accelerate != "false" && s3Accelerate != "auto" {
+		log.Fatal("S3_ACCELERATE must be true, false or auto")
+	}
+
+	// Load AWS config and create S3 client. AWS_RETRY_MODE and
+	// AWS_MAX_ATTEMPTS are read by the SDK itself
+	awsConfig, err := config.LoadDefaultConfig(context.TODO(),
+		config.WithRegion(s3Region),
+		config.WithHTTPClient(newS3HTTPClient(s3Tuning)),
+	)
 	if err != nil {
 		log.Fatalf("Couldn't load AWS config: %v", err)
 	}
-	s3Client := s3.NewFromConfig(awsConfig)
+
+	// Secrets can be kept in Secrets Manager or SSM Parameter Store rather
+	// than in the environment; those are read again every
+	// SECRETS_REFRESH_INTERVAL, so rotations reach running servers
+	secrets := secretLoader{
+		httpClient:  &http.Client{Timeout: 10 * time.Second},
+		credentials: awsConfig.Credentials,
+		region:      awsConfig.Region,
+	}
+	if region := os.Getenv("SECRETS_REGION"); region != "" {
+		secrets.region = region
+	}
+	refreshable := map[string]*rotatingSecret{}
+	loadSecret := func(name string) string {
+		value, err := secrets.load(context.Background(), name)
+		if err != nil {
+			log.Fatalf("Couldn't load %s: %v", name, err)
+		}
+		return value
+	}
+	jwtSecretValue := loadSecret("JWT_SECRET")
+	if jwtSecretValue == "" {
+		log.Fatal("JWT_SECRET environment variable is not set")
+	}
+	jwtSecret := newRotatingSecret(jwtSecretValue)
+	if isSecretRef(os.Getenv("JWT_SECRET")) {
+		refreshable["JWT_SECRET"] = jwtSecret
+	}
+	var webhookSigning *rotatingSecret
+	if v := loadSecret("WEBHOOK_SIGNING_SECRET"); v != "" {
+		webhookSigning = newRotatingSecret(v)
+		if isSecretRef(os.Getenv("WEBHOOK_SIGNING_SECRET")) {
+			refreshable["WEBHOOK_SIGNING_SECRET"] = webhookSigning
+		}
+	}
+	// Upload receipts are signed with an Ed25519 key given by its 32-byte
+	// seed. Public keys it replaced stay listed so old receipts still verify
+	var receiptKeys *receiptKeys
+	if v := loadSecret("RECEIPT_SIGNING_KEY"); v != "" {
+		seed, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			log.Fatal("RECEIPT_SIGNING_KEY must be a base64 32-byte Ed25519 seed")
+		}
+		var previous []ed25519.PublicKey
+		for _, key := range strings.Split(os.Getenv("RECEIPT_VERIFY_KEYS"), ",") {
+			if key = strings.TrimSpace(key); key == "" {
+				continue
+			}
+			decoded, err := base64.StdEncoding.DecodeString(key)
+			if err != nil || len(decoded) != ed25519.PublicKeySize {
+				log.Fatal("RECEIPT_VERIFY_KEYS must be comma-separated base64 32-byte Ed25519 public keys")
+			}
+			previous = append(previous, ed25519.PublicKey(decoded))
+		}
+		receiptKeys = newReceiptKeys(seed, previous)
+	} else if os.Getenv("RECEIPT_VERIFY_KEYS") != "" {
+		log.Fatal("RECEIPT_VERIFY_KEYS needs RECEIPT_SIGNING_KEY")
+	}
+	secretsRefreshInterval := time.Duration(0)
+	if v := os.Getenv("SECRETS_REFRESH_INTERVAL"); v != "" {
+		secretsRefreshInterval, err = time.ParseDuration(v)
+		if err != nil || secretsRefreshInterval < time.Minute {
+			log.Fatal("SECRETS_REFRESH_INTERVAL must be a duration of at least 1m")
+		}
+	}
+
+	s3ClientEndpoint := s3EndpointStandard
+	if s3Accelerate == "true" {
+		s3ClientEndpoint = s3EndpointAccelerate
+	}
+	s3Client := s3.NewFromConfig(awsConfig, s3ClientEndpoint.apply, faults.applyS3)
+
+	// Encryption at rest is opt-in: a KMS key wins over a local master key,
+	// and with neither configured encrypted uploads are refused
+	var videoKeyWrapper keyWrapper
+	if kmsKeyID := os.Getenv("ENCRYPTION_KMS_KEY_ID"); kmsKeyID != "" {
+		videoKeyWrapper = kmsKeyWrapper{client: kms.NewFromConfig(awsConfig), keyID: kmsKeyID}
+	} else if masterKey := loadSecret("ENCRYPTION_MASTER_KEY"); masterKey != "" {
+		decoded, err := base64.StdEncoding.DecodeString(masterKey)
+		if err != nil {
+			log.Fatalf("ENCRYPTION_MASTER_KEY must be base64: %v", err)
+		}
+		videoKeyWrapper, err = newLocalKeyWrapper(decoded)
+		if err != nil {
+			log.Fatalf("Invalid ENCRYPTION_MASTER_KEY: %v", err)
+		}
+	}
+
+	// Backups are encrypted with a data key wrapped like a video's, so
+	// they need encryption at rest configured
+	backupInterval := time.Duration(0)
+	if v := os.Getenv("BACKUP_INTERVAL"); v != "" {
+		backupInterval, err = time.ParseDuration(v)
+		if err != nil || backupInterval < 0 {
+			log.Fatal("BACKUP_INTERVAL must be a duration")
+		}
+		if backupInterval > 0 && videoKeyWrapper == nil {
+			log.Fatal("BACKUP_INTERVAL needs ENCRYPTION_KMS_KEY_ID or ENCRYPTION_MASTER_KEY to encrypt backups with")
+		}
+	}
+	backupRetain := 14
+	if v := os.Getenv("BACKUP_RETAIN"); v != "" {
+		backupRetain, err = strconv.Atoi(v)
+		if err != nil || backupRetain < 1 {
+			log.Fatal("BACKUP_RETAIN must be a positive number of backups")
+		}
+	}
+
+	// "descriptive" keys name the owner, video and title so the bucket can
+	// be browsed by hand
+	s3KeyNaming := os.Getenv("S3_KEY_NAMING")
+	if s3KeyNaming == "" {
+		s3KeyNaming = keyNamingRandom
+	}
+	if s3KeyNaming != keyNamingRandom && s3KeyNaming != keyNamingDescriptive {
+		log.Fatal("S3_KEY_NAMING must be random or descriptive")
+	}
+
+	// Videos can be written through a role assumed per user, so S3 sees who
+	// they're from; bucket policies find the user in the key, which only
+	// descriptive naming puts there
+	s3UserRoleARN := os.Getenv("S3_USER_ROLE_ARN")
+	if s3UserRoleARN != "" && s3KeyNaming != keyNamingDescriptive {
+		log.Fatal("S3_USER_ROLE_ARN needs S3_KEY_NAMING=descriptive")
+	}
+
+	// Origins whose pages may read thumbnails, streams and downloads
+	mediaOrigins := parseOrigins(os.Getenv("MEDIA_CORS_ORIGINS"))
+
+	// Pages on other origins may only embed media if they're listed. The
+	// app itself is always allowed
+	var hotlinkOrigins []string
+	if v := os.Getenv("HOTLINK_ALLOWED_ORIGINS"); v != "" {
+		serverURL, _ := url.Parse(serverBaseURL)
+		hotlinkOrigins = append(parseOrigins(v), serverURL.Scheme+"://"+serverURL.Host)
+	}
+	var assetURLTTL time.Duration
+	if v := os.Getenv("ASSET_URL_TTL"); v != "" {
+		assetURLTTL, err = time.ParseDuration(v)
+		if err != nil || assetURLTTL < time.Minute {
+			log.Fatal("ASSET_URL_TTL must be a duration of at least a minute")
+		}
+	}
+
+	// Admin routes can be limited to some networks, and to clients holding
+	// a certificate from the admin CA when the server terminates TLS
+	var access adminAccess
+	access.allow, err = parseNetworks(os.Getenv("ADMIN_ALLOWED_NETWORKS"))
+	if err != nil {
+		log.Fatalf("ADMIN_ALLOWED_NETWORKS must be a list of CIDRs: %v", err)
+	}
+	access.deny, err = parseNetworks(os.Getenv("ADMIN_DENIED_NETWORKS"))
+	if err != nil {
+		log.Fatalf("ADMIN_DENIED_NETWORKS must be a list of CIDRs: %v", err)
+	}
+	tlsCertFile := os.Getenv("TLS_CERT_FILE")
+	tlsKeyFile := os.Getenv("TLS_KEY_FILE")
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		log.Fatal("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	var tlsConfig *tls.Config
+	if caFile := os.Getenv("ADMIN_CLIENT_CA_FILE"); caFile != "" {
+		if tlsCertFile == "" {
+			log.Fatal("ADMIN_CLIENT_CA_FILE needs TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		tlsConfig, err = adminClientTLSConfig(caFile)
+		if err != nil {
+			log.Fatalf("Couldn't load ADMIN_CLIENT_CA_FILE: %v", err)
+		}
+		access.requireClientCert = true
+	}
+
+	// Headers CDNs and browsers get with each class of media
+	videoCacheControl := os.Getenv("VIDEO_CACHE_CONTROL")
+	if videoCacheControl == "" {
+		videoCacheControl = defaultImmutableCacheControl
+	}
+	videoDisposition, err := parseDisposition(os.Getenv("VIDEO_CONTENT_DISPOSITION"))
+	if err != nil {
+		log.Fatalf("Invalid VIDEO_CONTENT_DISPOSITION: %v", err)
+	}
+	thumbnailCacheControl := os.Getenv("THUMBNAIL_CACHE_CONTROL")
+	if thumbnailCacheControl == "" {
+		thumbnailCacheControl = defaultImmutableCacheControl
+	}
+
+	// "s3" stores new thumbnails in the bucket, served like videos;
+	// the admin thumbnail migration moves the ones already on disk
+	thumbnailStorage := os.Getenv("THUMBNAIL_STORAGE")
+	if thumbnailStorage == "" {
+		thumbnailStorage = thumbnailStorageDisk
+	}
+	if thumbnailStorage != thumbnailStorageDisk && thumbnailStorage != thumbnailStorageS3 {
+		log.Fatal("THUMBNAIL_STORAGE must be disk or s3")
+	}
+	uploadFields, err := newUploadFormFields(os.Getenv("UPLOAD_VIDEO_FIELD"), os.Getenv("UPLOAD_THUMBNAIL_FIELD"), os.Getenv("UPLOAD_METADATA_FIELD"))
+	if err != nil {
+		log.Fatalf("Invalid upload form fields: %v", err)
+	}
+
+	thumbnailVariants, err := parseThumbnailVariants(os.Getenv("THUMBNAIL_VARIANTS"))
+	if err != nil {
+		log.Fatalf("Invalid THUMBNAIL_VARIANTS: %v", err)
+	}
+
+	thumbnailMigrationRate := 5
+	if v := os.Getenv("THUMBNAIL_MIGRATION_RATE"); v != "" {
+		thumbnailMigrationRate, err = strconv.Atoi(v)
+		if err != nil || thumbnailMigrationRate < 1 {
+			log.Fatal("THUMBNAIL_MIGRATION_RATE must be a positive number of files per second")
+		}
+	}
+
+	// Replaced and deleted content is evicted from the CDN through
+	// CloudFront when a distribution ID is set, or a webhook otherwise
+	var cdn cdnInvalidator
+	if distributionID := os.Getenv("CDN_INVALIDATION_CLOUDFRONT_ID"); distributionID != "" {
+		cdn = cloudFrontInvalidator{
+			httpClient:     &http.Client{Timeout: cdnInvalidationTimeout},
+			credentials:    awsConfig.Credentials,
+			distributionID: distributionID,
+		}
+	} else if webhookURL := os.Getenv("CDN_INVALIDATION_WEBHOOK"); webhookURL != "" {
+		cdn = webhookInvalidator{
+			httpClient: &http.Client{Timeout: cdnInvalidationTimeout},
+			url:        webhookURL,
+		}
+	}
+
+	// Deployments can add their own step to the upload pipeline through a
+	// command or, failing that, a webhook
+	processingHookTimeout := 5 * time.Minute
+	if v := os.Getenv("PROCESSING_HOOK_TIMEOUT"); v != "" {
+		processingHookTimeout, err = time.ParseDuration(v)
+		if err != nil || processingHookTimeout <= 0 {
+			log.Fatal("PROCESSING_HOOK_TIMEOUT must be a positive duration")
+		}
+	}
+	var hook processingHook
+	if command := os.Getenv("PROCESSING_HOOK_COMMAND"); command != "" {
+		hook = commandHook{path: command, timeout: processingHookTimeout}
+	} else if webhookURL := os.Getenv("PROCESSING_HOOK_WEBHOOK"); webhookURL != "" {
+		hook = webhookHook{
+			httpClient:    &http.Client{Timeout: processingHookTimeout},
+			url:           webhookURL,
+			signingSecret: webhookSigning,
+		}
+	}
+
+	// Videos restricted to some countries need to know where viewers are:
+	// from a header the CDN in front sets, or failing that a database of
+	// networks matched against the connecting address
+	var geo geoResolver
+	if header := os.Getenv("GEOIP_HEADER"); header != "" {
+		geo = headerGeoResolver{header: header}
+	} else if path := os.Getenv("GEOIP_CSV"); path != "" {
+		geo, err = loadRangeGeoResolver(path)
+		if err != nil {
+			log.Fatalf("Couldn't load GEOIP_CSV: %v", err)
+		}
+	}
+
+	// Failed sign-ins lock the account and address out for longer each
+	// time, and can make later sign-ins solve a CAPTCHA first
+	loginThrottle := auth.DefaultLoginThrottle
+	if v := os.Getenv("LOGIN_FREE_ATTEMPTS"); v != "" {
+		loginThrottle.FreeAttempts, err = strconv.Atoi(v)
+		if err != nil || loginThrottle.FreeAttempts < 1 {
+			log.Fatal("LOGIN_FREE_ATTEMPTS must be a positive number")
+		}
+	}
+	if v := os.Getenv("LOGIN_CAPTCHA_AFTER"); v != "" {
+		loginThrottle.CaptchaAfter, err = strconv.Atoi(v)
+		if err != nil || loginThrottle.CaptchaAfter < 1 {
+			log.Fatal("LOGIN_CAPTCHA_AFTER must be a positive number")
+		}
+	}
+	// Signed requests are accepted this long either side of their
+	// timestamp, and remembered as long to refuse replays
+	requestSigningWindow := 5 * time.Minute
+	if v := os.Getenv("REQUEST_SIGNING_WINDOW"); v != "" {
+		requestSigningWindow, err = time.ParseDuration(v)
+		if err != nil || requestSigningWindow < 30*time.Second || requestSigningWindow > time.Hour {
+			log.Fatal("REQUEST_SIGNING_WINDOW must be a duration from 30s to 1h")
+		}
+	}
+	// API responses come in {data, error, meta} envelopes by default when
+	// set; clients can choose either way with the Accept profile
+	responseEnvelopeDefault := os.Getenv("RESPONSE_ENVELOPE") == "true"
+	var captcha captchaVerifier
+	if webhookURL := os.Getenv("LOGIN_CAPTCHA_WEBHOOK"); webhookURL != "" {
+		captcha = webhookCaptcha{
+			httpClient: &http.Client{Timeout: 10 * time.Second},
+			url:        webhookURL,
+		}
+	}
+
+	// New passwords are hashed with Argon2id. The pepper is kept out of the
+	// database, either as is or wrapped by the encryption key so it can live
+	// alongside the other settings
+	passwords := auth.PasswordHasher{Params: auth.DefaultArgon2Params}
+	if v := loadSecret("PASSWORD_PEPPER"); v != "" {
+		passwords.Pepper, err = base64.StdEncoding.DecodeString(v)
+		if err != nil || len(passwords.Pepper) < 16 {
+			log.Fatal("PASSWORD_PEPPER must be at least 16 bytes of base64")
+		}
+	} else if v := os.Getenv("PASSWORD_PEPPER_WRAPPED"); v != "" {
+		if videoKeyWrapper == nil {
+			log.Fatal("PASSWORD_PEPPER_WRAPPED needs ENCRYPTION_KMS_KEY_ID or ENCRYPTION_MASTER_KEY to unwrap it")
+		}
+		wrapped, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			log.Fatal("PASSWORD_PEPPER_WRAPPED must be base64")
+		}
+		passwords.Pepper, err = videoKeyWrapper.Unwrap(context.Background(), wrapped)
+		if err != nil {
+			log.Fatalf("Couldn't unwrap PASSWORD_PEPPER_WRAPPED: %v", err)
+		}
+	}
+	// Peppers rotated out still check the hashes made with them, which are
+	// made again with the current pepper at sign-in
+	if v := loadSecret("PASSWORD_PEPPER_PREVIOUS"); v != "" {
+		for _, encoded := range strings.Split(v, ",") {
+			pepper, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+			if err != nil || len(pepper) < 16 {
+				log.Fatal("PASSWORD_PEPPER_PREVIOUS must be a comma-separated list of peppers of at least 16 bytes of base64")
+			}
+			passwords.PreviousPeppers = append(passwords.PreviousPeppers, pepper)
+		}
+	}
+	if v := os.Getenv("PASSWORD_HASH_MEMORY_KIB"); v != "" {
+		memory, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || memory < 8*1024 {
+			log.Fatal("PASSWORD_HASH_MEMORY_KIB must be a number of at least 8192")
+		}
+		passwords.Params.Memory = uint32(memory)
+	}
+	if v := os.Getenv("PASSWORD_HASH_ITERATIONS"); v != "" {
+		iterations, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || iterations < 1 {
+			log.Fatal("PASSWORD_HASH_ITERATIONS must be a positive number")
+		}
+		passwords.Params.Iterations = uint32(iterations)
+	}
+	if v := os.Getenv("PASSWORD_HASH_PARALLELISM"); v != "" {
+		parallelism, err := strconv.ParseUint(v, 10, 8)
+		if err != nil || parallelism < 1 {
+			log.Fatal("PASSWORD_HASH_PARALLELISM must be a number from 1 to 255")
+		}
+		passwords.Params.Parallelism = uint8(parallelism)
+	}
+	// Hashing once at startup shows what a sign-in costs on this machine;
+	// with a target, iterations go up until a hash takes at least that long
+	hashTarget := time.Duration(0)
+	if v := os.Getenv("PASSWORD_HASH_TARGET"); v != "" {
+		hashTarget, err = time.ParseDuration(v)
+		if err != nil || hashTarget <= 0 || hashTarget > 5*time.Second {
+			log.Fatal("PASSWORD_HASH_TARGET must be a duration up to 5s")
+		}
+	}
+	hashTook, err := passwords.Tune(hashTarget)
+	if err != nil {
+		log.Fatalf("Couldn't benchmark password hashing: %v", err)
+	}
+	log.Printf("Password hashing: argon2id m=%dKiB t=%d p=%d takes %s",
+		passwords.Params.Memory, passwords.Params.Iterations, passwords.Params.Parallelism, hashTook.Round(time.Millisecond))
+
+	reportFlagThreshold := 3
+	if v := os.Getenv("REPORT_FLAG_THRESHOLD"); v != "" {
+		reportFlagThreshold, err = strconv.Atoi(v)
+		if err != nil || reportFlagThreshold < 1 {
+			log.Fatal("REPORT_FLAG_THRESHOLD must be a positive number of reporters")
+		}
+	}
 
 	cfg := apiConfig{
 		db:               db,
@@ -107,41 +838,440 @@ func main() {
 		s3CfDistribution: s3CfDistribution,
 		port:             port,
 		s3Client:         s3Client,
+		watermark: watermarkConfig{
+			root:        watermarksRoot,
+			defaultPath: os.Getenv("WATERMARK_PATH"),
+			position:    watermarkPosition,
+			opacity:     watermarkOpacity,
+			scale:       watermarkScale,
+		},
+		codecs:         codecPolicy{video: videoCodecs, audio: audioCodecs},
+		frameCacheRoot: frameCacheRoot,
+		// Frame extraction runs ffmpeg against S3, so each user gets a
+		// small burst and then one new frame per second
+		frameLimiter:    newRateLimiter(1, 10),
+		viewLimiter:     newRateLimiter(1/viewRepeatInterval.Seconds(), 1),
+		keyWrapper:      videoKeyWrapper,
+		backupRetain:    backupRetain,
+		s3ObjectLock:    os.Getenv("S3_OBJECT_LOCK") == "true",
+		metrics:         metrics,
+		bandwidth:       bandwidth,
+		minUploadRate:   minUploadRate,
+		uploadPartsRoot: uploadPartsRoot,
+		maintenance:     &maintenanceSwitch{},
+		s3Uploads:       s3Uploads,
+		buffers:         newBufferPool(metrics),
+		prober:          prober,
+		processing:      newProcessingQueue(processingConcurrency, metrics),
+		coalesce:        &coalescers{},
+		related:         newRelatedVideosCache(),
+		trending:        &trendingFeed{},
+		role:            role,
+		instanceID:      newInstanceID(),
+		urls:            urls,
+		assetsBaseURL:   assetsBaseURL,
+		cdn:             cdn,
+		hook:            hook,
+		geo:             geo,
+		loginThrottle:   loginThrottle,
+		captcha:         captcha,
+		webhookSigning:  webhookSigning,
+		receiptKeys:     receiptKeys,
+		passwords:       passwords,
+		videoHeaders: mediaClassHeaders{
+			cacheControl: videoCacheControl,
+			disposition:  videoDisposition,
+		},
+		s3KeyNaming:           s3KeyNaming,
+		thumbnailStorage:      thumbnailStorage,
+		thumbnailCacheControl: thumbnailCacheControl,
+		uploadFields:          uploadFields,
+		thumbnailVariants:     thumbnailVariants,
+		assetURLTTL:           assetURLTTL,
+		reportFlagThreshold:   reportFlagThreshold,
+	}
+
+	if s3UserRoleARN != "" {
+		cfg.userS3 = newUserS3Clients(awsConfig, s3UserRoleARN, s3Bucket, func() *s3.Client { return cfg.s3Client })
+	}
+
+	if err := cfg.loadMaintenance(); err != nil {
+		log.Fatalf("Couldn't load maintenance settings: %v", err)
+	}
+
+	if s3Accelerate == "auto" {
+		benchCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		s3ClientEndpoint = cfg.chooseS3Endpoint(benchCtx, awsConfig, []s3Endpoint{s3EndpointStandard, s3EndpointDualStack, s3EndpointAccelerate})
+		cancel()
+		log.Printf("Using the %s S3 endpoint", s3ClientEndpoint.name)
+		cfg.s3Client = s3.NewFromConfig(awsConfig, s3ClientEndpoint.apply, faults.applyS3)
+	}
+
+	if rtmpPorts := os.Getenv("RTMP_PORTS"); rtmpPorts != "" && role != roleWorker {
+		ports, err := parsePortRange(rtmpPorts)
+		if err != nil {
+			log.Fatalf("Invalid RTMP_PORTS: %v", err)
+		}
+		rtmpPublicHost := os.Getenv("RTMP_PUBLIC_HOST")
+		if rtmpPublicHost == "" {
+			rtmpPublicHost = "localhost"
+		}
+		recordingsRoot := os.Getenv("RECORDINGS_ROOT")
+		if recordingsRoot == "" {
+			recordingsRoot = "./recordings"
+		}
+		if err := ensureDir(recordingsRoot); err != nil {
+			log.Fatalf("Couldn't create recordings directory: %v", err)
+		}
+		cfg.liveIngest = newLiveIngest(rtmpPublicHost, recordingsRoot, ports)
+	}
+
+	if streamCacheMaxBytes > 0 {
+		cfg.streamCache, err = newStreamCache(streamCacheRoot, streamCacheMaxBytes, metrics)
+		if err != nil {
+			log.Fatalf("Couldn't create stream cache directory: %v", err)
+		}
+	}
+
+	// Users listed in ADMIN_EMAILS are promoted on every start, so a fresh
+	// deployment always has a way in to the admin endpoints
+	for _, email := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		email = strings.TrimSpace(email)
+		if email == "" {
+			continue
+		}
+		found, err := db.SetUserAdmin(email, true)
+		if err != nil {
+			log.Fatalf("Couldn't promote admin %s: %v", email, err)
+		}
+		if !found {
+			log.Printf("ADMIN_EMAILS: no user with email %s yet", email)
+		}
 	}
 
 	err = cfg.ensureAssetsDir()
 	if err != nil {
 		log.Fatalf("Couldn't create assets directory: %v", err)
 	}
+	// Files saved before the assets directory was sharded are still found
+	// where they are, so moving them doesn't hold up startup
+	go func() {
+		if err := cfg.shardAssets(); err != nil {
+			log.Printf("Couldn't move assets into sharded directories: %v", err)
+		}
+	}()
+
+	err = ensureDir(cfg.watermark.root)
+	if err != nil {
+		log.Fatalf("Couldn't create watermarks directory: %v", err)
+	}
+
+	err = ensureDir(cfg.frameCacheRoot)
+	if err != nil {
+		log.Fatalf("Couldn't create frame cache directory: %v", err)
+	}
+
+	err = ensureDir(cfg.uploadPartsRoot)
+	if err != nil {
+		log.Fatalf("Couldn't create upload parts directory: %v", err)
+	}
+
+	if *seed {
+		cfg.runSeedCommand()
+		return
+	}
+	if *restoreBackup != "" {
+		cfg.runRestoreCommand(*restoreBackup, pathToDB)
+		return
+	}
+	if *importSource != "" {
+		cfg.runImportCommand(*importSource, *importUser)
+		return
+	}
+	if *userAction != "" {
+		cfg.runUserCommand(*userAction, flag.Args())
+		return
+	}
+
+	// Commands above talk to the operator, who needs the passwords and
+	// secrets they print; from here on the log may be shipped elsewhere
+	if logRedact {
+		log.SetOutput(&logRedactor{out: os.Stderr, metrics: cfg.metrics})
+	}
+
+	if role == roleWorker {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		log.Printf("Processing jobs with %d workers", processingConcurrency)
+		cfg.runWorkers(ctx, processingConcurrency, workerPollInterval)
+		return
+	}
+
+	multipartCleanupInterval := time.Hour
+	if v := os.Getenv("MULTIPART_CLEANUP_INTERVAL"); v != "" {
+		multipartCleanupInterval, err = time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid MULTIPART_CLEANUP_INTERVAL: %v", err)
+		}
+	}
+	multipartMaxAge := 24 * time.Hour
+	if v := os.Getenv("MULTIPART_MAX_AGE"); v != "" {
+		multipartMaxAge, err = time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid MULTIPART_MAX_AGE: %v", err)
+		}
+	}
+	if multipartCleanupInterval > 0 {
+		cfg.startLeaderTask(context.Background(), "multipart_cleanup", multipartCleanupInterval, func(ctx context.Context) error {
+			return cfg.abortStaleMultipartUploads(ctx, multipartMaxAge)
+		})
+		// Part files live on this node's disk, so every node cleans its own
+		cfg.startPeriodicTask(context.Background(), "upload_parts_cleanup", multipartCleanupInterval, cfg.removeAbandonedUploadParts)
+	}
+	integrityCheckInterval := time.Hour
+	if v := os.Getenv("INTEGRITY_CHECK_INTERVAL"); v != "" {
+		integrityCheckInterval, err = time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid INTEGRITY_CHECK_INTERVAL: %v", err)
+		}
+	}
+	integritySampleSize := 10
+	if v := os.Getenv("INTEGRITY_SAMPLE_SIZE"); v != "" {
+		integritySampleSize, err = strconv.Atoi(v)
+		if err != nil || integritySampleSize < 1 {
+			log.Fatal("INTEGRITY_SAMPLE_SIZE must be a positive number of objects")
+		}
+	}
+	if integrityCheckInterval > 0 {
+		cfg.startLeaderTask(context.Background(), "integrity_check", integrityCheckInterval, func(ctx context.Context) error {
+			return cfg.verifyStoredObjects(ctx, integritySampleSize)
+		})
+	}
+	// S3 Inventory delivers reports at most daily; checking more often
+	// only costs a listing of the report folders
+	if inventoryPrefix := os.Getenv("S3_INVENTORY_PREFIX"); inventoryPrefix != "" {
+		inventoryBucket := os.Getenv("S3_INVENTORY_BUCKET")
+		if inventoryBucket == "" {
+			inventoryBucket = s3Bucket
+		}
+		inventoryInterval := time.Hour
+		if v := os.Getenv("S3_INVENTORY_INTERVAL"); v != "" {
+			inventoryInterval, err = time.ParseDuration(v)
+			if err != nil || inventoryInterval <= 0 {
+				log.Fatal("S3_INVENTORY_INTERVAL must be a positive duration")
+			}
+		}
+		cfg.startLeaderTask(context.Background(), "s3_inventory", inventoryInterval, func(ctx context.Context) error {
+			return cfg.ingestS3Inventory(ctx, inventoryBucket, inventoryPrefix)
+		})
+	}
+	trendingInterval := 10 * time.Minute
+	if v := os.Getenv("TRENDING_INTERVAL"); v != "" {
+		trendingInterval, err = time.ParseDuration(v)
+		if err != nil || trendingInterval < 0 {
+			log.Fatal("TRENDING_INTERVAL must be a duration")
+		}
+	}
+	trendingHalfLife := 24 * time.Hour
+	if v := os.Getenv("TRENDING_HALF_LIFE"); v != "" {
+		trendingHalfLife, err = time.ParseDuration(v)
+		if err != nil || trendingHalfLife < time.Hour {
+			log.Fatal("TRENDING_HALF_LIFE must be a duration of at least 1h")
+		}
+	}
+	if trendingInterval > 0 {
+		cfg.startLeaderTask(context.Background(), "trending", trendingInterval, func(ctx context.Context) error {
+			return cfg.refreshTrending(ctx, trendingHalfLife)
+		})
+	}
+	if backupInterval > 0 {
+		cfg.startLeaderTask(context.Background(), "db_backup", backupInterval, func(ctx context.Context) error {
+			_, err := cfg.backupDatabase(ctx, backupRetain)
+			return err
+		})
+	}
+	// Events are delivered from the table they're recorded in, so the
+	// webhook sees the same history GET /api/videos/{videoID}/history does,
+	// even when a node dies between recording an event and sending it
+	if webhookURL := os.Getenv("VIDEO_EVENTS_WEBHOOK"); webhookURL != "" {
+		client := &http.Client{Timeout: 10 * time.Second}
+		cfg.startLeaderTask(context.Background(), "video_events_delivery", videoEventDeliveryInterval, func(ctx context.Context) error {
+			return cfg.deliverVideoEvents(ctx, client, webhookURL)
+		})
+	}
+	if role == roleAll {
+		// Without separate workers, background jobs like thumbnail
+		// conversions run here; uploads are still processed inline
+		go cfg.runWorkers(context.Background(), 1, workerPollInterval)
+	}
+	// Idle until an admin starts it
+	cfg.startLeaderTask(context.Background(), "thumbnail_migration", thumbnailMigrationInterval, func(ctx context.Context) error {
+		return cfg.migrateThumbnails(ctx, thumbnailMigrationRate, thumbnailMigrationInterval*3/4)
+	})
+	cfg.startLeaderTask(context.Background(), "bucket_import", bucketImportInterval, func(ctx context.Context) error {
+		return cfg.importBucket(ctx, bucketImportInterval*3/4)
+	})
+	if secretsRefreshInterval > 0 && len(refreshable) > 0 {
+		cfg.startPeriodicTask(context.Background(), "secrets_refresh", secretsRefreshInterval, func(ctx context.Context) error {
+			return cfg.refreshSecrets(ctx, secrets, refreshable)
+		})
+	}
+	cfg.startLeaderTask(context.Background(), "request_signatures_cleanup", requestSigningWindow, func(ctx context.Context) error {
+		_, err := cfg.db.DeleteExpiredRequestSignatures()
+		return err
+	})
+	cfg.startLeaderTask(context.Background(), "video_packages_cleanup", time.Hour, cfg.deleteExpiredVideoPackages)
+	cfg.startLeaderTask(context.Background(), "login_attempts_cleanup", time.Hour, func(ctx context.Context) error {
+		_, err := cfg.db.DeleteStaleLoginAttempts(loginThrottle.Window)
+		return err
+	})
 
 	mux := http.NewServeMux()
 	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
 	mux.Handle("/app/", appHandler)
 
-	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
-	mux.Handle("/assets/", noCacheMiddleware(assetsHandler))
+	// Thumbnail filenames are content hashes, so a replaced image is served
+	// under a new URL and the old one can be cached indefinitely
+	mux.Handle("/assets/", mediaCORS(mediaOrigins, hotlinkGuard(hotlinkOrigins, cacheControlMiddleware(thumbnailCacheControl, http.HandlerFunc(cfg.handlerAsset)))))
+
+	mux.HandleFunc("GET /readyz", cfg.handlerReadyz)
 
 	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
 	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
 	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
 
 	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	mux.HandleFunc("DELETE /api/users/me", cfg.handlerUsersDeleteMe)
+	mux.HandleFunc("GET /api/deletion_reports/{reportID}", cfg.handlerDeletionReportGet)
+	mux.HandleFunc("PUT /api/users/me/intro-outro", cfg.handlerUsersIntroOutroUpdate)
+	mux.HandleFunc("GET /api/users/me/settings", cfg.handlerUserSettingsGet)
+	mux.HandleFunc("PATCH /api/users/me/settings", cfg.handlerUserSettingsUpdate)
+	mux.HandleFunc("GET /api/users/me/history", cfg.handlerWatchHistoryRetrieve)
+	mux.HandleFunc("DELETE /api/users/me/history", cfg.handlerWatchHistoryClear)
+	mux.HandleFunc("DELETE /api/users/me/history/{videoID}", cfg.handlerWatchHistoryDelete)
+	mux.HandleFunc("GET /api/users/me/watch_later", cfg.handlerWatchLaterRetrieve)
+	mux.HandleFunc("PUT /api/users/me/watch_later/{videoID}", cfg.handlerWatchLaterAdd)
+	mux.HandleFunc("DELETE /api/users/me/watch_later/{videoID}", cfg.handlerWatchLaterRemove)
+	mux.HandleFunc("POST /api/users/me/stream_key", cfg.handlerStreamKeyRotate)
+	mux.HandleFunc("POST /api/users/me/signing_keys", cfg.handlerSigningKeyCreate)
+	mux.HandleFunc("GET /api/users/me/signing_keys", cfg.handlerSigningKeysRetrieve)
+	mux.HandleFunc("DELETE /api/users/me/signing_keys/{keyID}", cfg.handlerSigningKeyDelete)
+	mux.HandleFunc("POST /api/packages", cfg.handlerVideoPackageCreate)
+	mux.HandleFunc("GET /api/packages", cfg.handlerVideoPackagesRetrieve)
+	mux.HandleFunc("GET /api/packages/{packageID}", cfg.handlerVideoPackageGet)
+	mux.HandleFunc("DELETE /api/packages/{packageID}", cfg.handlerVideoPackageDelete)
+	mux.HandleFunc("GET /api/receipts/keys", cfg.handlerReceiptKeys)
+	mux.HandleFunc("POST /api/receipts/verify", cfg.handlerReceiptVerify)
+	mux.HandleFunc("POST /api/users/me/watermark", cfg.maintenanceGuard(maintenanceScopeUploads, cfg.uploadGuard(cfg.handlerWatermarkUpload)))
+	mux.HandleFunc("GET /api/users/me/watermark", cfg.handlerWatermarkGet)
+	mux.HandleFunc("PATCH /api/users/me/watermark", cfg.handlerWatermarkUpdate)
+	mux.HandleFunc("DELETE /api/users/me/watermark", cfg.handlerWatermarkDelete)
+
+	mux.HandleFunc("POST /api/orgs", cfg.handlerOrgCreate)
+	mux.HandleFunc("GET /api/orgs", cfg.handlerOrgsRetrieve)
+	mux.HandleFunc("GET /api/orgs/{orgID}/members", cfg.handlerOrgMembersRetrieve)
+	mux.HandleFunc("PUT /api/orgs/{orgID}/members", cfg.handlerOrgMemberPut)
+	mux.HandleFunc("DELETE /api/orgs/{orgID}/members/{userID}", cfg.handlerOrgMemberDelete)
 
 	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
-	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
-	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+	mux.HandleFunc("POST /api/videos/batch", cfg.handlerVideosBatch)
+	mux.HandleFunc("POST /api/videos/{videoID}/thumbnail", cfg.maintenanceGuard(maintenanceScopeUploads, cfg.uploadGuard(cfg.handlerUploadThumbnail)))
+	mux.HandleFunc("POST /api/videos/{videoID}/file", cfg.maintenanceGuard(maintenanceScopeUploads, cfg.uploadGuard(cfg.handlerUploadVideo)))
+	mux.HandleFunc("POST /api/videos/{videoID}/thumbnail/convert", cfg.maintenanceGuard(maintenanceScopeProcessing, cfg.handlerThumbnailConvert))
+	mux.HandleFunc("POST /api/videos/{videoID}/audio_description", cfg.maintenanceGuard(maintenanceScopeUploads, cfg.uploadGuard(cfg.handlerAudioDescriptionUpload)))
+	mux.HandleFunc("DELETE /api/videos/{videoID}/audio_description", cfg.maintenanceGuard(maintenanceScopeProcessing, cfg.handlerAudioDescriptionDelete))
+	mux.HandleFunc("PUT /api/videos/{videoID}/geo_restriction", cfg.handlerVideoGeoRestrictionUpdate)
+	mux.HandleFunc("PUT /api/videos/{videoID}/poster_time", cfg.maintenanceGuard(maintenanceScopeProcessing, cfg.handlerVideoPosterTimeUpdate))
+	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.deprecated(legacyUploadRoutes("/api/v1/videos/{videoID}/thumbnail"), cfg.maintenanceGuard(maintenanceScopeUploads, cfg.uploadGuard(cfg.handlerUploadThumbnail))))
+	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.deprecated(legacyUploadRoutes("/api/v1/videos/{videoID}/file"), cfg.maintenanceGuard(maintenanceScopeUploads, cfg.uploadGuard(cfg.handlerUploadVideo))))
+	mux.HandleFunc("POST /api/probe", cfg.handlerProbe)
+	mux.HandleFunc("POST /api/upload-sessions", cfg.maintenanceGuard(maintenanceScopeUploads, cfg.handlerUploadSessionCreate))
+	mux.HandleFunc("GET /api/upload-sessions/{sessionID}", cfg.handlerUploadSessionGet)
+	mux.HandleFunc("PUT /api/upload-sessions/{sessionID}", cfg.maintenanceGuard(maintenanceScopeUploads, cfg.uploadGuard(cfg.handlerUploadSessionUpload)))
+	mux.HandleFunc("PUT /api/upload-sessions/{sessionID}/parts/{n}", cfg.maintenanceGuard(maintenanceScopeUploads, cfg.uploadGuard(cfg.handlerUploadSessionPartPut)))
+	mux.HandleFunc("POST /api/upload-sessions/{sessionID}/complete", cfg.maintenanceGuard(maintenanceScopeUploads, cfg.handlerUploadSessionComplete))
 	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
+	mux.HandleFunc("GET /api/videos/trending", cfg.handlerVideosTrending)
 	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
+	mux.HandleFunc("PATCH /api/videos/{videoID}", cfg.handlerVideoMetaUpdate)
+	mux.HandleFunc("GET /api/videos/{videoID}/metadata", cfg.handlerVideoMetadataGet)
+	mux.HandleFunc("GET /api/videos/{videoID}/history", cfg.handlerVideoHistory)
+	mux.HandleFunc("GET /api/videos/{videoID}/wait", cfg.handlerVideoWait)
+	mux.HandleFunc("GET /api/videos/{videoID}/related", cfg.handlerVideoRelated)
+	mux.HandleFunc("POST /api/videos/{videoID}/views", cfg.handlerVideoView)
+	mux.HandleFunc("PUT /api/videos/{videoID}/like", cfg.handlerVideoLike)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/like", cfg.handlerVideoUnlike)
+	mux.HandleFunc("GET /api/videos/{videoID}/progress", cfg.handlerWatchProgressGet)
+	mux.HandleFunc("PUT /api/videos/{videoID}/progress", cfg.handlerWatchProgressUpdate)
+	mux.HandleFunc("POST /api/videos/{videoID}/report", cfg.handlerVideoReportCreate)
+	mux.HandleFunc("GET /api/videos/{videoID}/receipts", cfg.handlerUploadReceiptsRetrieve)
+	mux.HandleFunc("PATCH /api/videos/{videoID}/metadata", cfg.handlerVideoMetadataUpdate)
 	mux.HandleFunc("GET /api/thumbnails/{videoID}", cfg.handlerThumbnailGet)
 	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	mux.HandleFunc("POST /api/videos/{videoID}/clips", cfg.maintenanceGuard(maintenanceScopeProcessing, cfg.handlerVideoClipCreate))
+	mux.HandleFunc("POST /api/videos/{videoID}/duplicate", cfg.maintenanceGuard(maintenanceScopeProcessing, cfg.handlerVideoDuplicate))
+	mux.HandleFunc("POST /api/videos/{videoID}/transfer", cfg.handlerVideoTransferCreate)
+	mux.HandleFunc("POST /api/videos/{videoID}/download_links", cfg.handlerDownloadLinkCreate)
+	mux.HandleFunc("GET /api/videos/{videoID}/download_links", cfg.handlerDownloadLinksRetrieve)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/download_links/{linkID}", cfg.handlerDownloadLinkRevoke)
+	// GET routes answer HEAD too
+	mux.Handle("GET /api/downloads/{token}", mediaCORS(mediaOrigins, http.HandlerFunc(cfg.handlerDownload)))
+	mux.Handle("OPTIONS /api/downloads/{token}", mediaCORS(mediaOrigins, http.HandlerFunc(cfg.handlerDownload)))
+	mux.HandleFunc("GET /api/transfers", cfg.handlerVideoTransfersRetrieve)
+	mux.HandleFunc("POST /api/transfers/{transferID}/{action}", cfg.handlerVideoTransferResolve)
+	mux.HandleFunc("GET /api/videos/{videoID}/frame", cfg.handlerVideoFrameGet)
+	mux.HandleFunc("POST /api/videos/{videoID}/stream_url", cfg.handlerVideoStreamURLCreate)
+	mux.Handle("GET /api/videos/{videoID}/stream", mediaCORS(mediaOrigins, hotlinkGuard(hotlinkOrigins, http.HandlerFunc(cfg.handlerVideoStream))))
+	mux.Handle("OPTIONS /api/videos/{videoID}/stream", mediaCORS(mediaOrigins, http.HandlerFunc(cfg.handlerVideoStream)))
+	mux.Handle("GET /media/{key...}", mediaCORS(mediaOrigins, hotlinkGuard(hotlinkOrigins, http.HandlerFunc(cfg.handlerMedia))))
+	mux.Handle("OPTIONS /media/{key...}", mediaCORS(mediaOrigins, http.HandlerFunc(cfg.handlerMedia)))
+
+	mux.HandleFunc("POST /api/live_sessions", cfg.maintenanceGuard(maintenanceScopeProcessing, cfg.handlerLiveSessionCreate))
+	mux.HandleFunc("GET /api/live_sessions/{videoID}", cfg.handlerLiveSessionGet)
 
 	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	mux.HandleFunc("POST /admin/seed", cfg.handlerSeed)
+	mux.HandleFunc("GET /admin/metrics", cfg.handlerMetrics)
+	mux.HandleFunc("/admin/debug/pprof/", cfg.handlerPprof)
+	mux.HandleFunc("PUT /admin/users/{userID}/tier", cfg.handlerUserTierUpdate)
+	mux.HandleFunc("PUT /admin/videos/{videoID}/legal_hold", cfg.handlerLegalHoldUpdate)
+	mux.HandleFunc("GET /admin/deletion_reviews", cfg.handlerDeletionReviewsRetrieve)
+	mux.HandleFunc("GET /admin/reports", cfg.handlerReportsRetrieve)
+	mux.HandleFunc("POST /admin/reports/{videoID}/resolve", cfg.handlerReportsResolve)
+	mux.HandleFunc("GET /admin/videos/{videoID}/versions", cfg.handlerVideoVersionsRetrieve)
+	mux.HandleFunc("POST /admin/videos/{videoID}/versions/restore", cfg.handlerVideoVersionRestore)
+	mux.HandleFunc("GET /admin/quarantine", cfg.handlerQuarantineRetrieve)
+	mux.HandleFunc("GET /admin/quarantine/{checksum}", cfg.handlerQuarantineGet)
+	mux.HandleFunc("DELETE /admin/quarantine/{checksum}", cfg.handlerQuarantineDelete)
+	mux.HandleFunc("GET /admin/integrity", cfg.handlerIntegrityRetrieve)
+	mux.HandleFunc("GET /admin/inventory", cfg.handlerInventoryGet)
+	mux.HandleFunc("GET /admin/thumbnail_migration", cfg.handlerThumbnailMigrationGet)
+	mux.HandleFunc("PUT /admin/thumbnail_migration", cfg.handlerThumbnailMigrationUpdate)
+	mux.HandleFunc("GET /admin/maintenance", cfg.handlerMaintenanceRetrieve)
+	mux.HandleFunc("PUT /admin/maintenance/{scope}", cfg.handlerMaintenanceUpdate)
+	mux.HandleFunc("GET /admin/backups", cfg.handlerBackupsRetrieve)
+	mux.HandleFunc("POST /admin/backups", cfg.handlerBackupCreate)
+	mux.HandleFunc("GET /admin/import", cfg.handlerBucketImportGet)
+	mux.HandleFunc("POST /admin/import", cfg.handlerBucketImportCreate)
+	mux.HandleFunc("PUT /admin/import", cfg.handlerBucketImportUpdate)
+	mux.HandleFunc("DELETE /admin/import", cfg.handlerBucketImportDelete)
 
+	// There is deliberately no server-wide ReadTimeout or WriteTimeout: the
+	// stream proxy and frame endpoints legitimately run for a long time.
+	// Request bodies get their own deadlines from bodyReadTimeout and
+	// uploadGuard instead
 	srv := &http.Server{
-		Addr:    ":" + port,
-		Handler: mux,
+		Addr:              ":" + port,
+		Handler:           cfg.requestLogging(requestSampling, cfg.adminAccessGuard(access, bodyReadTimeout(responseEnvelope(responseEnvelopeDefault, cfg.requestSigning(requestSigningWindow, apiVersioning(mux)))))),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		TLSConfig:         tlsConfig,
 	}
 
+	if tlsCertFile != "" {
+		log.Printf("Serving on: https://localhost:%s/app/\n", port)
+		log.Fatal(srv.ListenAndServeTLS(tlsCertFile, tlsKeyFile))
+	}
 	log.Printf("Serving on: http://localhost:%s/app/\n", port)
 	log.Fatal(srv.ListenAndServe())
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// Maintenance scopes group the routes an admin can take offline together.
+// Anything outside a scope, including every read endpoint, stays up.
+const (
+	// maintenanceScopeUploads covers routes that receive files
+	maintenanceScopeUploads = "uploads"
+	// maintenanceScopeProcessing covers routes that create new objects
+	// from existing ones
+	maintenanceScopeProcessing = "processing"
+)
+
+var maintenanceScopes = []string{maintenanceScopeUploads, maintenanceScopeProcessing}
+
+const defaultMaintenanceRetryAfter = 5 * time.Minute
+
+type maintenanceMode struct {
+	Scope             string    `json:"scope"`
+	Enabled           bool      `json:"enabled"`
+	Message           string    `json:"message"`
+	RetryAfterSeconds int       `json:"retry_after_seconds"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// maintenanceSwitch caches the persisted maintenance modes, which are
+// checked on every request to a guarded route.
+type maintenanceSwitch struct {
+	mu    sync.RWMutex
+	modes map[string]maintenanceMode
+}
+
+func maintenanceSettingKey(scope string) string {
+	return "maintenance:" + scope
+}
+
+// loadMaintenance reads the maintenance modes saved by a previous run, so a
+// restart doesn't silently reopen routes an admin closed.
+func (cfg *apiConfig) loadMaintenance() error {
+	modes := map[string]maintenanceMode{}
+	for _, scope := range maintenanceScopes {
+		mode := maintenanceMode{Scope: scope}
+		value, found, err := cfg.db.GetSetting(maintenanceSettingKey(scope))
+		if err != nil {
+			return err
+		}
+		if found {
+			if err := json.Unmarshal([]byte(value), &mode); err != nil {
+				return fmt.Errorf("invalid %s maintenance setting: %w", scope, err)
+			}
+		}
+		modes[scope] = mode
+	}
+
+	cfg.maintenance.mu.Lock()
+	defer cfg.maintenance.mu.Unlock()
+	cfg.maintenance.modes = modes
+	return nil
+}
+
+func (cfg *apiConfig) maintenanceMode(scope string) maintenanceMode {
+	cfg.maintenance.mu.RLock()
+	defer cfg.maintenance.mu.RUnlock()
+	return cfg.maintenance.modes[scope]
+}
+
+// maintenanceGuard answers 503 with a Retry-After while the route's scope is
+// in maintenance. It runs before anything reads the request body.
+func (cfg *apiConfig) maintenanceGuard(scope string, next http.HandlerFunc) http.HandlerFunc {
+	type response struct {
+		Error             string `json:"error"`
+		Code              string `json:"code"`
+		RetryAfterSeconds int    `json:"retry_after_seconds"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		mode := cfg.maintenanceMode(scope)
+		if !mode.Enabled {
+			next(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(mode.RetryAfterSeconds))
+		// The client isn't going to read the rest of a big upload
+		w.Header().Set("Connection", "close")
+		respondWithJSON(w, http.StatusServiceUnavailable, response{
+			Error:             mode.Message,
+			Code:              "maintenance",
+			RetryAfterSeconds: mode.RetryAfterSeconds,
+		})
+	}
+}
+
+func (cfg *apiConfig) handlerMaintenanceRetrieve(w http.ResponseWriter, r *http.Request) {
+	if _, ok := cfg.authenticateAdmin(w, r); !ok {
+		return
+	}
+
+	modes := make([]maintenanceMode, 0, len(maintenanceScopes))
+	for _, scope := range maintenanceScopes {
+		modes = append(modes, cfg.maintenanceMode(scope))
+	}
+	respondWithJSON(w, http.StatusOK, modes)
+}
+
+func (cfg *apiConfig) handlerMaintenanceUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Enabled           bool   `json:"enabled"`
+		Message           string `json:"message" validate:"max=500"`
+		RetryAfterSeconds int    `json:"retry_after_seconds" validate:"min=0,max=86400"`
+	}
+
+	scope := r.PathValue("scope")
+	if !slices.Contains(maintenanceScopes, scope) {
+		respondWithError(w, http.StatusNotFound, "Unknown maintenance scope", nil)
+		return
+	}
+
+	adminID, ok := cfg.authenticateAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+
+	mode := maintenanceMode{
+		Scope:             scope,
+		Enabled:           params.Enabled,
+		Message:           params.Message,
+		RetryAfterSeconds: params.RetryAfterSeconds,
+		UpdatedAt:         time.Now().UTC(),
+	}
+	if mode.Message == "" {
+		mode.Message = fmt.Sprintf("The %s endpoints are temporarily down for maintenance", scope)
+	}
+	if mode.RetryAfterSeconds == 0 {
+		mode.RetryAfterSeconds = int(defaultMaintenanceRetryAfter.Seconds())
+	}
+
+	value, err := json.Marshal(mode)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't encode maintenance mode", err)
+		return
+	}
+	if err := cfg.db.PutSetting(maintenanceSettingKey(scope), string(value)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save maintenance mode", err)
+		return
+	}
+	cfg.maintenance.mu.Lock()
+	cfg.maintenance.modes[scope] = mode
+	cfg.maintenance.mu.Unlock()
+
+	action := "maintenance_disabled"
+	if mode.Enabled {
+		action = "maintenance_enabled"
+	}
+	err = cfg.db.CreateAuditEntry(database.AuditEntry{
+		ActorID: &adminID,
+		Action:  action,
+		Details: scope + ": " + mode.Message,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write audit entry", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, mode)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	// maxTopLevelAtoms bounds the walk over a file's top-level boxes; real
+	// MP4s have a handful, so thousands means the file is garbage.
+	maxTopLevelAtoms = 1024
+	// maxMoovSize caps the metadata box. Even multi-hour videos keep their
+	// sample tables well under this, and players load moov fully into memory.
+	maxMoovSize = 64 << 20 // 64 MB
+)
+
+// checkMP4Atoms walks the top-level boxes of an MP4 file and checks that
+// their declared sizes are consistent with the file: every box fits inside
+// the file, ftyp comes before the media, and there is exactly one moov and
+// at least one mdat.
+func checkMP4Atoms(filePath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := stat.Size()
+
+	var offset int64
+	var sawFtyp bool
+	var moovCount, mdatCount int
+	header := make([]byte, 16)
+	for i := 0; offset < fileSize; i++ {
+		if i == maxTopLevelAtoms {
+			return malformedContainer("too many top-level atoms")
+		}
+		if fileSize-offset < 8 {
+			return malformedContainer(fmt.Sprintf("truncated atom header at offset %d", offset))
+		}
+		if _, err := f.ReadAt(header[:8], offset); err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		atomType := string(header[4:8])
+		headerSize := int64(8)
+
+		switch size {
+		case 0:
+			// The box runs to the end of the file
+			size = fileSize - offset
+		case 1:
+			if _, err := f.ReadAt(header[8:16], offset+8); err != nil {
+				if err == io.EOF {
+					return malformedContainer(fmt.Sprintf("truncated %q atom header", atomType))
+				}
+				return err
+			}
+			largeSize := binary.BigEndian.Uint64(header[8:16])
+			if largeSize > uint64(fileSize) {
+				return malformedContainer(fmt.Sprintf("%q atom extends past end of file", atomType))
+			}
+			size = int64(largeSize)
+			headerSize = 16
+		}
+		if size < headerSize {
+			return malformedContainer(fmt.Sprintf("%q atom declares impossible size %d", atomType, size))
+		}
+		if size > fileSize-offset {
+			return malformedContainer(fmt.Sprintf("%q atom extends past end of file", atomType))
+		}
+
+		switch atomType {
+		case "ftyp":
+			sawFtyp = true
+		case "moov":
+			if !sawFtyp {
+				return malformedContainer("moov atom appears before ftyp")
+			}
+			if size > maxMoovSize {
+				return malformedContainer(fmt.Sprintf("moov atom is %d bytes, more than the limit of %d", size, maxMoovSize))
+			}
+			moovCount++
+		case "mdat":
+			if !sawFtyp {
+				return malformedContainer("mdat atom appears before ftyp")
+			}
+			mdatCount++
+		}
+
+		offset += size
+	}
+
+	if !sawFtyp {
+		return malformedContainer("missing ftyp atom")
+	}
+	if moovCount != 1 {
+		return malformedContainer(fmt.Sprintf("expected exactly one moov atom, found %d", moovCount))
+	}
+	if mdatCount == 0 {
+		return malformedContainer("missing mdat atom")
+	}
+	return nil
+}
+
+func malformedContainer(reason string) error {
+	return &videoValidationError{
+		Code:   "malformed_container",
+		Reason: "Malformed MP4: " + reason,
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+)
+
+// abortStaleMultipartUploads aborts multipart uploads under our key prefixes
+// that were started more than maxAge ago. Parts of an unfinished upload are
+// invisible in the bucket listing but are still billed as storage.
+func (cfg *apiConfig) abortStaleMultipartUploads(ctx context.Context, maxAge time.Duration) error {
+	cutoff := time.Now().Add(-maxAge)
+	var aborted, parts int
+	var bytes int64
+
+	for _, prefix := range media.KeyPrefixes {
+		paginator := s3.NewListMultipartUploadsPaginator(cfg.s3Client, &s3.ListMultipartUploadsInput{
+			Bucket: &cfg.s3Bucket,
+			Prefix: &prefix,
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return fmt.Errorf("couldn't list multipart uploads under %s: %w", prefix, err)
+			}
+
+			for _, upload := range page.Uploads {
+				if upload.Initiated == nil || upload.Initiated.After(cutoff) {
+					continue
+				}
+
+				// Count the parts first so the metrics reflect what the
+				// abort actually reclaimed
+				partPaginator := s3.NewListPartsPaginator(cfg.s3Client, &s3.ListPartsInput{
+					Bucket:   &cfg.s3Bucket,
+					Key:      upload.Key,
+					UploadId: upload.UploadId,
+				})
+				var uploadParts int
+				var uploadBytes int64
+				for partPaginator.HasMorePages() {
+					partPage, err := partPaginator.NextPage(ctx)
+					if err != nil {
+						log.Printf("Couldn't list parts of upload %s: %v", *upload.Key, err)
+						break
+					}
+					for _, part := range partPage.Parts {
+						uploadParts++
+						if part.Size != nil {
+							uploadBytes += *part.Size
+						}
+					}
+				}
+
+				_, err := cfg.s3Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+					Bucket:   &cfg.s3Bucket,
+					Key:      upload.Key,
+					UploadId: upload.UploadId,
+				})
+				if err != nil {
+					log.Printf("Couldn't abort multipart upload %s: %v", *upload.Key, err)
+					continue
+				}
+				if err := cfg.db.DeleteS3MultipartUpload(*upload.UploadId); err != nil {
+					log.Printf("Couldn't forget multipart upload %s: %v", *upload.Key, err)
+				}
+				aborted++
+				parts += uploadParts
+				bytes += uploadBytes
+			}
+		}
+	}
+
+	cfg.metrics.add("tubely_multipart_uploads_aborted_total", float64(aborted))
+	cfg.metrics.add("tubely_multipart_parts_reclaimed_total", float64(parts))
+	cfg.metrics.add("tubely_multipart_bytes_reclaimed_total", float64(bytes))
+	if aborted > 0 {
+		log.Printf("Aborted %d stale multipart uploads, reclaiming %d parts (%d bytes)", aborted, parts, bytes)
+	}
+	return nil
+}
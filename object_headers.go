@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+)
+
+// defaultImmutableCacheControl suits objects whose key or URL changes
+// whenever their content does, which is true of every video key and
+// thumbnail filename this server hands out.
+const defaultImmutableCacheControl = "public, max-age=31536000, immutable"
+
+// mediaClassHeaders are the caching and download headers one class of media
+// is served with, set on the object itself so any CDN in front of the
+// bucket picks them up.
+type mediaClassHeaders struct {
+	cacheControl string
+	// disposition is "inline" or "attachment"
+	disposition string
+}
+
+func parseDisposition(value string) (string, error) {
+	switch value {
+	case "":
+		return "inline", nil
+	case "inline", "attachment":
+		return value, nil
+	default:
+		return "", fmt.Errorf("%q is not inline or attachment", value)
+	}
+}
+
+// applyToPut sets the class's headers on an upload, offering filename
+// (sanitized, with ext) to browsers that save the object.
+func (h mediaClassHeaders) applyToPut(input *s3.PutObjectInput, filename, ext string) {
+	if h.cacheControl != "" {
+		input.CacheControl = &h.cacheControl
+	}
+	disposition := media.ContentDisposition(h.disposition, filename, ext)
+	input.ContentDisposition = &disposition
+}
+
+// sniffFileContentType returns the media type of a file from its contents.
+func sniffFileContentType(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	header := make([]byte, 512)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return media.SniffContentType(header[:n]), nil
+}
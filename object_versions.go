@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// recordStoredVideo keeps track of a file storeVideo just wrote for a video
+// whose record now points at it: the object goes into the video's history,
+// from which it can be restored, and gets an upload receipt. Neither fails
+// the caller, since the file is stored either way.
+func (cfg *apiConfig) recordStoredVideo(video database.Video, userID uuid.UUID, stored storedVideo, wrappedKey []byte) {
+	err := cfg.db.CreateVideoObject(database.VideoObject{
+		ID:              uuid.New(),
+		VideoID:         video.ID,
+		S3Key:           stored.key,
+		VersionID:       stored.versionID,
+		Size:            stored.size,
+		ChecksumSHA256:  stored.checksumSHA256,
+		DurationSeconds: stored.durationSeconds,
+		AudioLanguages:  stored.audioLanguages,
+		Encrypted:       wrappedKey != nil,
+		CreatedAt:       time.Now(),
+	}, wrappedKey)
+	if err != nil {
+		log.Printf("Couldn't record stored object of video %s: %v", video.ID, err)
+	}
+	cfg.issueUploadReceipt(video, userID, stored)
+}
+
+// objectVersion is one S3 version of an object, or a delete marker.
+type objectVersion struct {
+	VersionID    string     `json:"version_id"`
+	IsLatest     bool       `json:"is_latest"`
+	DeleteMarker bool       `json:"delete_marker"`
+	Size         int64      `json:"size"`
+	LastModified *time.Time `json:"last_modified"`
+}
+
+// listObjectVersions returns every version S3 holds of key, newest first.
+// On an unversioned bucket that's the object itself, with the version ID
+// "null".
+func (cfg *apiConfig) listObjectVersions(ctx context.Context, key string) ([]objectVersion, error) {
+	versions := []objectVersion{}
+	paginator := s3.NewListObjectVersionsPaginator(cfg.s3Client, &s3.ListObjectVersionsInput{
+		Bucket: &cfg.s3Bucket,
+		Prefix: &key,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not list versions of %s: %w", key, err)
+		}
+		for _, v := range page.Versions {
+			// The prefix also matches longer keys
+			if aws.ToString(v.Key) != key {
+				continue
+			}
+			versions = append(versions, objectVersion{
+				VersionID:    aws.ToString(v.VersionId),
+				IsLatest:     aws.ToBool(v.IsLatest),
+				Size:         aws.ToInt64(v.Size),
+				LastModified: v.LastModified,
+			})
+		}
+		for _, m := range page.DeleteMarkers {
+			if aws.ToString(m.Key) != key {
+				continue
+			}
+			versions = append(versions, objectVersion{
+				VersionID:    aws.ToString(m.VersionId),
+				IsLatest:     aws.ToBool(m.IsLatest),
+				DeleteMarker: true,
+				LastModified: m.LastModified,
+			})
+		}
+	}
+	return versions, nil
+}
+
+// handlerVideoVersionsRetrieve lists the files a video has been stored as,
+// with what S3 still holds of each, so an admin can pick one to restore.
+func (cfg *apiConfig) handlerVideoVersionsRetrieve(w http.ResponseWriter, r *http.Request) {
+	type object struct {
+		database.VideoObject
+		Current    bool            `json:"current"`
+		S3Versions []objectVersion `json:"s3_versions"`
+	}
+	type response struct {
+		// Versioning is the bucket's versioning status: "Enabled",
+		// "Suspended", or empty if it was never turned on
+		Versioning string   `json:"versioning"`
+		Objects    []object `json:"objects"`
+	}
+
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
+		return
+	}
+
+	if _, ok := cfg.authenticateAdmin(w, r); !ok {
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	currentKey := ""
+	if video.VideoURL != nil {
+		currentKey, err = cfg.videoObjectKey(video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't locate video object", err)
+			return
+		}
+	}
+
+	versioning, err := cfg.s3Client.GetBucketVersioning(r.Context(), &s3.GetBucketVersioningInput{Bucket: &cfg.s3Bucket})
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't get bucket versioning", err)
+		return
+	}
+	stored, err := cfg.db.GetVideoObjects(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video objects", err)
+		return
+	}
+
+	resp := response{Versioning: string(versioning.Status), Objects: []object{}}
+	listed := map[string][]objectVersion{}
+	for _, o := range stored {
+		versions, ok := listed[o.S3Key]
+		if !ok {
+			versions, err = cfg.listObjectVersions(r.Context(), o.S3Key)
+			if err != nil {
+				respondWithError(w, http.StatusBadGateway, "Couldn't list object versions", err)
+				return
+			}
+			listed[o.S3Key] = versions
+		}
+		resp.Objects = append(resp.Objects, object{
+			VideoObject: o,
+			Current:     o.S3Key == currentKey,
+			S3Versions:  versions,
+		})
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// handlerVideoVersionRestore puts back a file a video was stored as before,
+// e.g. after an accidental replace. Any version S3 holds of one of the
+// video's objects can be restored, including one written outside the app.
+// It is copied to a fresh key rather than made current in place, so caches
+// of the file being replaced can't serve the restored one's URL.
+func (cfg *apiConfig) handlerVideoVersionRestore(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		S3Key string `json:"s3_key" validate:"required"`
+		// VersionID defaults to the version the app wrote
+		VersionID string `json:"version_id"`
+	}
+
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
+		return
+	}
+
+	adminID, ok := cfg.authenticateAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.LegalHold {
+		respondWithError(w, http.StatusConflict, "This video is under legal hold and its file can't be replaced", nil)
+		return
+	}
+	source, wrappedKey, err := cfg.db.GetVideoObject(video.ID, params.S3Key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video object", err)
+		return
+	}
+	if source.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "The video was never stored under that key", nil)
+		return
+	}
+	versionID := params.VersionID
+	if versionID == "" {
+		versionID = source.VersionID
+	}
+
+	var sseKey *sseCustomerKey
+	if source.Encrypted {
+		if cfg.keyWrapper == nil {
+			respondWithError(w, http.StatusBadRequest, "Encryption at rest is not enabled on this server", errEncryptionDisabled)
+			return
+		}
+		dataKey, err := cfg.keyWrapper.Unwrap(r.Context(), wrappedKey)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't unwrap video encryption key", err)
+			return
+		}
+		sseKey = newSSECustomerKey(dataKey)
+	}
+
+	prefix, _, _ := strings.Cut(source.S3Key, "/")
+	destKey, err := cfg.newVideoObjectKey(r.Context(), prefix, videoObjectNameOf(video))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't pick a key for the restored video", err)
+		return
+	}
+	copySource := cfg.s3Bucket + "/" + url.PathEscape(source.S3Key)
+	if versionID != "" {
+		copySource += "?versionId=" + url.QueryEscape(versionID)
+	}
+	copyInput := &s3.CopyObjectInput{
+		Bucket:     &cfg.s3Bucket,
+		Key:        &destKey,
+		CopySource: &copySource,
+	}
+	sseKey.applyToCopy(copyInput)
+	if _, err := cfg.s3Client.CopyObject(r.Context(), copyInput); err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't copy the version to restore", err)
+		return
+	}
+
+	head := &s3.HeadObjectInput{Bucket: &cfg.s3Bucket, Key: &destKey}
+	sseKey.applyToHead(head)
+	out, err := cfg.s3Client.HeadObject(r.Context(), head)
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't check restored video", err)
+		return
+	}
+	restored := storedVideo{
+		key:             destKey,
+		durationSeconds: source.DurationSeconds,
+		audioLanguages:  source.AudioLanguages,
+		size:            aws.ToInt64(out.ContentLength),
+		versionID:       aws.ToString(out.VersionId),
+	}
+	// The recorded checksum only vouches for the version the app wrote
+	if versionID == source.VersionID && restored.size == source.Size {
+		restored.checksumSHA256 = source.ChecksumSHA256
+	}
+
+	if source.Encrypted {
+		if err := cfg.db.PutVideoKey(video.ID, destKey, wrappedKey); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't save encryption key", err)
+			return
+		}
+		videoURL := cfg.videoStreamURL(video.ID)
+		video.VideoURL = &videoURL
+	} else {
+		if video.Encrypted {
+			if err := cfg.db.DeleteVideoKey(video.ID); err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Couldn't remove old encryption key", err)
+				return
+			}
+		}
+		videoURL := cfg.videoDeliveryURL(destKey)
+		video.VideoURL = &videoURL
+		if restored.checksumSHA256 != "" {
+			err := cfg.db.PutObjectChecksum(database.ObjectChecksum{
+				S3Key:          destKey,
+				ChecksumSHA256: restored.checksumSHA256,
+				Size:           restored.size,
+			})
+			if err != nil {
+				log.Printf("Couldn't record checksum of %s: %v", destKey, err)
+			}
+		}
+	}
+	video.Encrypted = source.Encrypted
+	restored.describe(&video)
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	cfg.recordStoredVideo(video, video.UserID, restored, wrappedKey)
+
+	err = cfg.db.CreateAuditEntry(database.AuditEntry{
+		ActorID: &adminID,
+		Action:  "video_version_restored",
+		VideoID: &video.ID,
+		Details: fmt.Sprintf("Restored %s version %s as %s", source.S3Key, versionID, destKey),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write audit entry", err)
+		return
+	}
+	cfg.recordVideoEvent(video, database.VideoEventProcessed, adminID, processedEventPayload(video))
+
+	cfg.signVideoAssets(&video)
+	respondWithJSON(w, http.StatusOK, video)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+type videoPermission int
+
+const (
+	// permView covers reading metadata, frames and playback.
+	permView videoPermission = iota
+	// permEdit covers uploads, metadata changes and deriving new videos.
+	permEdit
+	// permDelete covers deleting the video.
+	permDelete
+)
+
+// canAccessVideo decides whether a user may act on a video. Personal videos
+// belong to their uploader alone. For organization videos the member's role
+// decides: viewers can only view, uploaders can also edit and delete what
+// they uploaded themselves, and admins and owners can do everything.
+func (cfg *apiConfig) canAccessVideo(userID uuid.UUID, video database.Video, perm videoPermission) (bool, error) {
+	if video.OrgID == nil {
+		return video.UserID == userID, nil
+	}
+
+	role, err := cfg.db.GetOrgMemberRole(*video.OrgID, userID)
+	if err != nil {
+		return false, err
+	}
+	switch role {
+	case database.OrgRoleOwner, database.OrgRoleAdmin:
+		return true, nil
+	case database.OrgRoleUploader:
+		return perm != permDelete || video.UserID == userID, nil
+	case database.OrgRoleViewer:
+		return perm == permView, nil
+	}
+	return false, nil
+}
+
+// canViewVideo reports whether a user may view a video. Videos that aren't
+// private are for anyone; for the rest canAccessVideo decides.
+func (cfg *apiConfig) canViewVideo(userID uuid.UUID, video database.Video) (bool, error) {
+	if video.Visibility != database.VisibilityPrivate {
+		return true, nil
+	}
+	return cfg.canAccessVideo(userID, video, permView)
+}
+
+// canUploadToOrg reports whether the user may create videos owned by the
+// organization.
+func (cfg *apiConfig) canUploadToOrg(userID, orgID uuid.UUID) (bool, error) {
+	role, err := cfg.db.GetOrgMemberRole(orgID, userID)
+	if err != nil {
+		return false, err
+	}
+	return role == database.OrgRoleOwner || role == database.OrgRoleAdmin || role == database.OrgRoleUploader, nil
+}
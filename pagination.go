@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 100
+)
+
+// videoCursor is the JSON inside a cursor token. Clients must treat tokens
+// as opaque; the encoding is free to change between releases.
+type videoCursor struct {
+	CreatedAt time.Time `json:"t"`
+	ID        uuid.UUID `json:"id"`
+}
+
+func encodeVideoCursor(video database.Video) string {
+	return encodeCursor(video.CreatedAt, video.ID)
+}
+
+// encodeCursor is encodeVideoCursor for listings of videos ordered by
+// another time, like when they were watched.
+func encodeCursor(at time.Time, id uuid.UUID) string {
+	data, _ := json.Marshal(videoCursor{CreatedAt: at, ID: id})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeVideoCursor(token string) (*database.VideoCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	var cursor videoCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, err
+	}
+	if cursor.ID == uuid.Nil {
+		return nil, errors.New("cursor has no position")
+	}
+	return &database.VideoCursor{CreatedAt: cursor.CreatedAt, ID: cursor.ID}, nil
+}
+
+// pageParams reads the limit and cursor query parameters, responding with a
+// 400 and reporting false if either is malformed. A nil cursor means the
+// first page.
+func pageParams(w http.ResponseWriter, r *http.Request) (int, *database.VideoCursor, bool) {
+	query := r.URL.Query()
+	fields := map[string]string{}
+
+	limit := defaultPageSize
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			fields["limit"] = fmt.Sprintf("must be a number from 1 to %d", maxPageSize)
+		}
+		limit = n
+	}
+
+	var cursor *database.VideoCursor
+	if v := query.Get("cursor"); v != "" {
+		var err error
+		cursor, err = decodeVideoCursor(v)
+		if err != nil {
+			fields["cursor"] = "is not a valid cursor token"
+		}
+	}
+
+	if len(fields) > 0 {
+		respondWithValidationError(w, fields, nil)
+		return 0, nil, false
+	}
+	return limit, cursor, true
+}
+
+// setNextPageLink points clients at the page after the last returned item
+// with an RFC 8288 Link header, so the response body keeps its shape.
+func setNextPageLink(w http.ResponseWriter, r *http.Request, limit int, cursor string) {
+	query := url.Values{}
+	query.Set("limit", strconv.Itoa(limit))
+	query.Set("cursor", cursor)
+	w.Header().Add("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, requestPath(r), query.Encode()))
+}
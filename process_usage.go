@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+// processUsage tallies the CPU time and memory of the ffmpeg and ffprobe
+// processes the app spawns, by tool and by the task they ran for, so
+// transcode capacity can be planned from real numbers. The processes belong
+// to the whole OS process, whichever apiConfig started them, so there's one
+// tally, copied into the metrics when they're scraped.
+var processUsage = &processUsageTally{tasks: map[processTask]*processTaskUsage{}}
+
+type processTask struct {
+	tool string
+	task string
+}
+
+type processTaskUsage struct {
+	runs       int64
+	cpuSeconds float64
+	// peakRSS is the most memory any one run held at once, in bytes
+	peakRSS int64
+}
+
+type processUsageTally struct {
+	mu    sync.Mutex
+	tasks map[processTask]*processTaskUsage
+}
+
+// record adds a finished process to the tally. A process that never
+// started has no state and isn't counted.
+func (t *processUsageTally) record(tool, task string, state *os.ProcessState) {
+	if state == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := processTask{tool: tool, task: task}
+	usage, ok := t.tasks[key]
+	if !ok {
+		usage = &processTaskUsage{}
+		t.tasks[key] = usage
+	}
+	usage.runs++
+	usage.cpuSeconds += (state.UserTime() + state.SystemTime()).Seconds()
+	if rss, ok := peakRSS(state); ok && rss > usage.peakRSS {
+		usage.peakRSS = rss
+	}
+}
+
+// recordCommand records a media command that has been waited for.
+func recordCommand(task string, cmd *mediaCmd) {
+	processUsage.record(cmd.tool, task, cmd.ProcessState)
+}
+
+// writeTo copies the tally into metrics.
+func (t *processUsageTally) writeTo(metrics *metricsRegistry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, usage := range t.tasks {
+		label := `{tool="` + key.tool + `",task="` + key.task + `"}`
+		metrics.set("tubely_process_runs"+label, float64(usage.runs))
+		metrics.set("tubely_process_cpu_seconds"+label, usage.cpuSeconds)
+		metrics.set("tubely_process_peak_rss_bytes"+label, float64(usage.peakRSS))
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// jobPriority orders waiting processing jobs; lower values go first.
+type jobPriority int
+
+const (
+	// priorityInteractive is for work someone is waiting on in a request.
+	priorityInteractive jobPriority = iota
+	// priorityBackground is for work nobody is blocked on, like finalizing
+	// live recordings.
+	priorityBackground
+)
+
+var jobPriorityNames = map[jobPriority]string{
+	priorityInteractive: "interactive",
+	priorityBackground:  "background",
+}
+
+type queuedJob struct {
+	userID   uuid.UUID
+	priority jobPriority
+	queuedAt time.Time
+	ready    chan struct{}
+}
+
+// processingQueue limits how many ffmpeg-heavy jobs run at once. When every
+// slot is busy, a freed slot goes to the highest priority class waiting and,
+// within it, to the user with the fewest jobs already running, then to the
+// one served longest ago. Users take turns, so one user submitting hundreds
+// of videos can't hold up everyone else.
+type processingQueue struct {
+	mu      sync.Mutex
+	slots   int
+	active  int
+	running map[uuid.UUID]int
+	// lastServed records the dispatch sequence number of each user's most
+	// recent job. Idle users are forgotten whenever nobody is waiting
+	lastServed map[uuid.UUID]uint64
+	sequence   uint64
+	waiting    []*queuedJob
+	metrics    *metricsRegistry
+}
+
+func newProcessingQueue(slots int, metrics *metricsRegistry) *processingQueue {
+	return &processingQueue{
+		slots:      slots,
+		running:    map[uuid.UUID]int{},
+		lastServed: map[uuid.UUID]uint64{},
+		metrics:    metrics,
+	}
+}
+
+// acquire blocks until the job may run and returns the function that frees
+// its slot. It gives up with the context's error if ctx ends first.
+func (q *processingQueue) acquire(ctx context.Context, userID uuid.UUID, priority jobPriority) (func(), error) {
+	job := &queuedJob{
+		userID:   userID,
+		priority: priority,
+		queuedAt: time.Now(),
+		ready:    make(chan struct{}),
+	}
+
+	q.mu.Lock()
+	q.waiting = append(q.waiting, job)
+	q.dispatch()
+	q.mu.Unlock()
+
+	select {
+	case <-job.ready:
+	case <-ctx.Done():
+		q.mu.Lock()
+		select {
+		case <-job.ready:
+			// Dispatched while we were giving up; hand the slot back
+			q.finish(userID)
+		default:
+			q.waiting = slices.DeleteFunc(q.waiting, func(j *queuedJob) bool { return j == job })
+			q.updateGauges()
+		}
+		q.mu.Unlock()
+		return nil, ctx.Err()
+	}
+
+	q.metrics.add(`tubely_processing_wait_seconds_total{priority="`+jobPriorityNames[priority]+`"}`, time.Since(job.queuedAt).Seconds())
+	q.metrics.add(`tubely_processing_jobs_total{priority="`+jobPriorityNames[priority]+`"}`, 1)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.finish(userID)
+		})
+	}, nil
+}
+
+// finish frees a running job's slot and passes it on. Callers hold q.mu.
+func (q *processingQueue) finish(userID uuid.UUID) {
+	q.active--
+	q.running[userID]--
+	if q.running[userID] <= 0 {
+		delete(q.running, userID)
+	}
+	q.dispatch()
+}
+
+// dispatch starts waiting jobs while there are free slots. Callers hold q.mu.
+func (q *processingQueue) dispatch() {
+	for q.active < q.slots && len(q.waiting) > 0 {
+		next := 0
+		for i, job := range q.waiting[1:] {
+			if q.before(job, q.waiting[next]) {
+				next = i + 1
+			}
+		}
+
+		job := q.waiting[next]
+		q.waiting = slices.Delete(q.waiting, next, next+1)
+		q.active++
+		q.running[job.userID]++
+		q.sequence++
+		q.lastServed[job.userID] = q.sequence
+		close(job.ready)
+	}
+	if len(q.waiting) == 0 {
+		for userID := range q.lastServed {
+			if q.running[userID] == 0 {
+				delete(q.lastServed, userID)
+			}
+		}
+	}
+	q.updateGauges()
+}
+
+// before reports whether job a should start ahead of job b. Jobs that tie
+// on everything keep their arrival order.
+func (q *processingQueue) before(a, b *queuedJob) bool {
+	if a.priority != b.priority {
+		return a.priority < b.priority
+	}
+	if q.running[a.userID] != q.running[b.userID] {
+		return q.running[a.userID] < q.running[b.userID]
+	}
+	return q.lastServed[a.userID] < q.lastServed[b.userID]
+}
+
+func (q *processingQueue) updateGauges() {
+	q.metrics.set("tubely_processing_jobs_running", float64(q.active))
+	q.metrics.set("tubely_processing_jobs_waiting", float64(len(q.waiting)))
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+// handlerPprof serves Go's runtime profiles under /admin/debug/pprof/, for
+// admins chasing CPU or memory use on a live node. The net/http/pprof
+// handlers are wrapped rather than registered on their own, since they'd
+// otherwise be open to anyone who can reach the server.
+func (cfg *apiConfig) handlerPprof(w http.ResponseWriter, r *http.Request) {
+	if _, ok := cfg.authenticateAdmin(w, r); !ok {
+		return
+	}
+
+	switch name := strings.TrimPrefix(r.URL.Path, "/admin/debug/pprof/"); name {
+	case "":
+		pprof.Index(w, r)
+	case "cmdline":
+		pprof.Cmdline(w, r)
+	case "profile":
+		pprof.Profile(w, r)
+	case "symbol":
+		pprof.Symbol(w, r)
+	case "trace":
+		pprof.Trace(w, r)
+	default:
+		// pprof.Index finds named profiles by a fixed path, so it can't
+		// serve them from under /admin/
+		pprof.Handler(name).ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	// ffmpegFailureBudget is how many times ffmpeg may fail on the same file,
+	// across retries and re-uploads, before the file is quarantined.
+	ffmpegFailureBudget = 3
+	quarantinePrefix    = "quarantine/"
+	// quarantineURLTTL is how long the download links in the admin API
+	// stay valid.
+	quarantineURLTTL = 15 * time.Minute
+)
+
+// Names of the objects kept under a quarantined file's prefix
+const (
+	quarantineInputObject  = "input.mp4"
+	quarantineStderrObject = "ffmpeg-stderr.txt"
+	quarantineProbeObject  = "probe.json"
+)
+
+func hashFile(filePath string, buffers *bufferPool) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := buffers.copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func quarantinedUploadError(failure database.InputFailure) *uploadError {
+	return &uploadError{
+		status: http.StatusUnprocessableEntity,
+		code:   "input_quarantined",
+		msg:    "This file has repeatedly failed processing and has been set aside for analysis",
+		err:    fmt.Errorf("input %s is quarantined", failure.ChecksumSHA256),
+	}
+}
+
+// recordFFmpegFailure counts an ffmpeg failure against the file and
+// quarantines it once it has used up its budget. It returns the error the
+// upload should fail with: the original one while the file may still be
+// retried, and a permanent one once it is quarantined.
+func (cfg *apiConfig) recordFFmpegFailure(ctx context.Context, video database.Video, userID uuid.UUID, filePath, checksum string, ffErr *ffmpegError, err error) error {
+	failure, dbErr := cfg.db.RecordInputFailure(checksum, video.ID, userID, ffErr.Error())
+	if dbErr != nil {
+		log.Printf("Couldn't record ffmpeg failure for %s: %v", checksum, dbErr)
+		return err
+	}
+	cfg.metrics.add("tubely_ffmpeg_failures_total", 1)
+	if failure.Failures < ffmpegFailureBudget {
+		return err
+	}
+
+	prefix := quarantinePrefix + checksum + "/"
+	if qErr := cfg.quarantineInput(ctx, prefix, filePath, ffErr.stderr); qErr != nil {
+		// Left unquarantined, the next failure tries again
+		log.Printf("Couldn't quarantine %s: %v", checksum, qErr)
+		return err
+	}
+	if dbErr := cfg.db.MarkInputQuarantined(checksum, prefix); dbErr != nil {
+		log.Printf("Couldn't mark %s quarantined: %v", checksum, dbErr)
+		return err
+	}
+	cfg.metrics.add("tubely_quarantined_inputs_total", 1)
+	log.Printf("Quarantined input %s for video %s after %d ffmpeg failures", checksum, video.ID, failure.Failures)
+	return quarantinedUploadError(failure)
+}
+
+// quarantineInput keeps a copy of the file, ffmpeg's log and what the
+// prober makes of the file. The copies are encrypted at rest, since the
+// upload may have been meant to be.
+func (cfg *apiConfig) quarantineInput(ctx context.Context, prefix, filePath, stderr string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	inputKey := prefix + quarantineInputObject
+	inputType := "video/mp4"
+	err = cfg.putObjectFromFile(ctx, &s3.PutObjectInput{
+		Bucket:               &cfg.s3Bucket,
+		Key:                  &inputKey,
+		ContentType:          &inputType,
+		ServerSideEncryption: types.ServerSideEncryptionAes256,
+	}, file)
+	if err != nil {
+		return err
+	}
+
+	for name, body := range map[string][]byte{
+		quarantineStderrObject: []byte(stderr),
+		quarantineProbeObject:  cfg.probeReport(filePath),
+	} {
+		key := prefix + name
+		contentType := "text/plain; charset=utf-8"
+		if name == quarantineProbeObject {
+			contentType = "application/json"
+		}
+		_, err := cfg.s3Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:               &cfg.s3Bucket,
+			Key:                  &key,
+			Body:                 bytes.NewReader(body),
+			ContentType:          &contentType,
+			ServerSideEncryption: types.ServerSideEncryptionAes256,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// probeReport returns ffprobe's full JSON report on the file, or when
+// ffprobe is unavailable, what the configured prober makes of it.
+func (cfg *apiConfig) probeReport(filePath string) []byte {
+	cmd := mediaCommand("ffprobe",
+		"-v", "error",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		filePath,
+	)
+	out, err := cmd.CombinedOutput()
+	recordCommand("quarantine_report", cmd)
+	if err == nil || len(out) > 0 {
+		return out
+	}
+
+	info, err := cfg.prober.Probe(filePath)
+	if err != nil {
+		out, _ = json.Marshal(map[string]string{"error": err.Error()})
+		return out
+	}
+	out, _ = json.MarshalIndent(info, "", "  ")
+	return out
+}
+
+func (cfg *apiConfig) handlerQuarantineRetrieve(w http.ResponseWriter, r *http.Request) {
+	if _, ok := cfg.authenticateAdmin(w, r); !ok {
+		return
+	}
+
+	failures, err := cfg.db.GetQuarantinedInputs()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve quarantined inputs", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, failures)
+}
+
+func (cfg *apiConfig) handlerQuarantineGet(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		database.InputFailure
+		InputURL  string `json:"input_url"`
+		StderrURL string `json:"stderr_url"`
+		ProbeURL  string `json:"probe_url"`
+	}
+
+	if _, ok := cfg.authenticateAdmin(w, r); !ok {
+		return
+	}
+
+	failure, ok := cfg.quarantinedInput(w, r)
+	if !ok {
+		return
+	}
+
+	resp := response{InputFailure: failure}
+	for name, dest := range map[string]*string{
+		quarantineInputObject:  &resp.InputURL,
+		quarantineStderrObject: &resp.StderrURL,
+		quarantineProbeObject:  &resp.ProbeURL,
+	} {
+		url, err := cfg.presignGetObject(r.Context(), *failure.QuarantinePrefix+name, quarantineURLTTL)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't sign download URL", err)
+			return
+		}
+		*dest = url
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// handlerQuarantineDelete releases a file from quarantine, deleting the kept
+// copies. The next upload of it gets a fresh failure budget.
+func (cfg *apiConfig) handlerQuarantineDelete(w http.ResponseWriter, r *http.Request) {
+	adminID, ok := cfg.authenticateAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	failure, ok := cfg.quarantinedInput(w, r)
+	if !ok {
+		return
+	}
+
+	for _, name := range []string{quarantineInputObject, quarantineStderrObject, quarantineProbeObject} {
+		key := *failure.QuarantinePrefix + name
+		_, err := cfg.s3Client.DeleteObject(r.Context(), &s3.DeleteObjectInput{Bucket: &cfg.s3Bucket, Key: &key})
+		if err != nil {
+			respondWithError(w, http.StatusBadGateway, "Couldn't delete quarantined object", err)
+			return
+		}
+	}
+	if err := cfg.db.DeleteInputFailure(failure.ChecksumSHA256); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't release quarantined input", err)
+		return
+	}
+
+	err := cfg.db.CreateAuditEntry(database.AuditEntry{
+		ActorID: &adminID,
+		Action:  "input_quarantine_released",
+		Details: fmt.Sprintf("input %s released after %d failures", failure.ChecksumSHA256, failure.Failures),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write audit entry", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) quarantinedInput(w http.ResponseWriter, r *http.Request) (database.InputFailure, bool) {
+	failure, err := cfg.db.GetInputFailure(r.PathValue("checksum"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get quarantined input", err)
+		return database.InputFailure{}, false
+	}
+	if failure.QuarantinedAt == nil {
+		respondWithError(w, http.StatusNotFound, "Input is not quarantined", nil)
+		return database.InputFailure{}, false
+	}
+	return failure, true
+}
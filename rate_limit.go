@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxRateLimiterKeys bounds how many buckets a limiter tracks before it
+// forgets the ones that have fully refilled.
+const maxRateLimiterKeys = 10000
+
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// rateLimiter is an in-memory token bucket per key (usually a user ID or IP).
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens added per second
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(ratePerSecond float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    ratePerSecond,
+		burst:   float64(burst),
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// allow takes a token from the key's bucket, reporting false when it's empty.
+func (rl *rateLimiter) allow(key string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		if len(rl.buckets) >= maxRateLimiterKeys {
+			rl.prune(now)
+		}
+		bucket = &tokenBucket{tokens: rl.burst, lastSeen: now}
+		rl.buckets[key] = bucket
+	}
+
+	bucket.tokens = min(rl.burst, bucket.tokens+now.Sub(bucket.lastSeen).Seconds()*rl.rate)
+	bucket.lastSeen = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// prune drops buckets that would be full by now, since forgetting them is
+// indistinguishable from keeping them.
+func (rl *rateLimiter) prune(now time.Time) {
+	for key, bucket := range rl.buckets {
+		if bucket.tokens+now.Sub(bucket.lastSeen).Seconds()*rl.rate >= rl.burst {
+			delete(rl.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// receiptKeys signs upload receipts with an Ed25519 key. Keys it was rotated
+// from are kept for verifying, and all of them are published so integrators
+// can check receipts without asking the server.
+type receiptKeys struct {
+	signing ed25519.PrivateKey
+	verify  []ed25519.PublicKey
+}
+
+func newReceiptKeys(seed []byte, previous []ed25519.PublicKey) *receiptKeys {
+	signing := ed25519.NewKeyFromSeed(seed)
+	return &receiptKeys{
+		signing: signing,
+		verify:  append([]ed25519.PublicKey{signing.Public().(ed25519.PublicKey)}, previous...),
+	}
+}
+
+// issueUploadReceipt signs a receipt for the object a video's file was just
+// stored as and keeps it with the video. Receipts are off without a signing
+// key, and failing to make one doesn't fail the upload: the file is stored
+// either way.
+func (cfg *apiConfig) issueUploadReceipt(video database.Video, userID uuid.UUID, stored storedVideo) {
+	if cfg.receiptKeys == nil {
+		return
+	}
+	receipt, err := auth.MakeUploadReceipt(auth.UploadReceipt{
+		VideoID:        video.ID,
+		UserID:         userID,
+		Bucket:         cfg.s3Bucket,
+		Key:            stored.key,
+		VersionID:      stored.versionID,
+		ChecksumSHA256: stored.checksumSHA256,
+		Size:           stored.size,
+	}, cfg.urls.Server(""), cfg.receiptKeys.signing)
+	if err != nil {
+		log.Printf("Couldn't sign upload receipt for video %s: %v", video.ID, err)
+		return
+	}
+	err = cfg.db.CreateUploadReceipt(database.UploadReceipt{
+		ID:        uuid.New(),
+		VideoID:   video.ID,
+		Receipt:   receipt,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		log.Printf("Couldn't save upload receipt for video %s: %v", video.ID, err)
+		return
+	}
+	cfg.metrics.add("tubely_upload_receipts_total", 1)
+}
+
+// latestUploadReceipt returns the receipt of a video's current file for an
+// upload response, or nil if there isn't one.
+func (cfg *apiConfig) latestUploadReceipt(videoID uuid.UUID) *string {
+	if cfg.receiptKeys == nil {
+		return nil
+	}
+	receipts, err := cfg.db.GetUploadReceiptsForVideo(videoID)
+	if err != nil {
+		log.Printf("Couldn't get upload receipt for video %s: %v", videoID, err)
+		return nil
+	}
+	if len(receipts) == 0 {
+		return nil
+	}
+	return &receipts[0].Receipt
+}
+
+func (cfg *apiConfig) handlerUploadReceiptsRetrieve(w http.ResponseWriter, r *http.Request) {
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't find video", err)
+		return
+	}
+	allowed, err := cfg.canAccessVideo(userID, video, permView)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video access", err)
+		return
+	}
+	if !allowed {
+		respondWithError(w, http.StatusForbidden, "You can't view this video", nil)
+		return
+	}
+
+	receipts, err := cfg.db.GetUploadReceiptsForVideo(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload receipts", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, receipts)
+}
+
+// handlerReceiptKeys publishes the receipt verification keys as a JWK set.
+// It needs no authentication: the keys are public, and receipts are meant to
+// be checked by whoever an integrator shows them to.
+func (cfg *apiConfig) handlerReceiptKeys(w http.ResponseWriter, r *http.Request) {
+	type jwk struct {
+		KeyType string `json:"kty"`
+		Curve   string `json:"crv"`
+		X       string `json:"x"`
+		KeyID   string `json:"kid"`
+		Alg     string `json:"alg"`
+		Use     string `json:"use"`
+	}
+	type response struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	if cfg.receiptKeys == nil {
+		respondWithErrorCode(w, http.StatusNotFound, "receipts_disabled", "Upload receipts are not enabled on this server", nil)
+		return
+	}
+	keys := []jwk{}
+	for _, key := range cfg.receiptKeys.verify {
+		keys = append(keys, jwk{
+			KeyType: "OKP",
+			Curve:   "Ed25519",
+			X:       base64.RawURLEncoding.EncodeToString(key),
+			KeyID:   auth.ReceiptKeyID(key),
+			Alg:     "EdDSA",
+			Use:     "sig",
+		})
+	}
+	respondWithJSON(w, http.StatusOK, response{Keys: keys})
+}
+
+// handlerReceiptVerify checks a receipt's signature and then whether the
+// object it describes is still in the bucket as it was. With a version ID
+// that exact version is checked, and it also has to still be the current
+// one; without, only the object's current size can be compared unless the
+// caller asks for its content to be hashed too.
+func (cfg *apiConfig) handlerReceiptVerify(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Receipt      string `json:"receipt" validate:"required"`
+		CheckContent bool   `json:"check_content"`
+	}
+	type response struct {
+		Receipt          auth.UploadReceipt `json:"receipt"`
+		Exists           bool               `json:"exists"`
+		SizeMatches      bool               `json:"size_matches"`
+		ChecksumMatches  *bool              `json:"checksum_matches,omitempty"`
+		IsCurrentVersion bool               `json:"is_current_version"`
+		CurrentVersionID string             `json:"current_version_id,omitempty"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+	if cfg.receiptKeys == nil {
+		respondWithErrorCode(w, http.StatusNotFound, "receipts_disabled", "Upload receipts are not enabled on this server", nil)
+		return
+	}
+	receipt, err := auth.ParseUploadReceipt(params.Receipt, cfg.receiptKeys.verify)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnprocessableEntity, "receipt_invalid", "The receipt's signature doesn't check out", err)
+		return
+	}
+	if receipt.Bucket != cfg.s3Bucket {
+		respondWithErrorCode(w, http.StatusUnprocessableEntity, "receipt_invalid", "The receipt is for another bucket", nil)
+		return
+	}
+
+	// A receipt says what a video's owner stored, so only those who can
+	// see the video may look behind it
+	video, err := cfg.db.GetVideo(receipt.VideoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't find video", err)
+		return
+	}
+	allowed, err := cfg.canAccessVideo(userID, video, permView)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video access", err)
+		return
+	}
+	if !allowed {
+		respondWithError(w, http.StatusForbidden, "You can't view this video", nil)
+		return
+	}
+	sseKey, err := cfg.receiptSSEKey(r.Context(), video, receipt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video encryption key", err)
+		return
+	}
+
+	resp := response{Receipt: receipt}
+	head := &s3.HeadObjectInput{Bucket: &cfg.s3Bucket, Key: &receipt.Key}
+	if receipt.VersionID != "" {
+		head.VersionId = &receipt.VersionID
+	}
+	sseKey.applyToHead(head)
+	out, err := cfg.s3Client.HeadObject(r.Context(), head)
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		respondWithJSON(w, http.StatusOK, resp)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't check stored object", err)
+		return
+	}
+	resp.Exists = true
+	resp.SizeMatches = aws.ToInt64(out.ContentLength) == receipt.Size
+
+	resp.IsCurrentVersion = true
+	if receipt.VersionID != "" {
+		latest := &s3.HeadObjectInput{Bucket: &cfg.s3Bucket, Key: &receipt.Key}
+		sseKey.applyToHead(latest)
+		out, err := cfg.s3Client.HeadObject(r.Context(), latest)
+		if err != nil && !errors.As(err, &notFound) {
+			respondWithError(w, http.StatusBadGateway, "Couldn't check stored object", err)
+			return
+		}
+		if err == nil {
+			resp.CurrentVersionID = aws.ToString(out.VersionId)
+		}
+		resp.IsCurrentVersion = resp.CurrentVersionID == receipt.VersionID
+	}
+
+	if params.CheckContent && resp.SizeMatches {
+		checksum, err := cfg.hashStoredObject(r.Context(), receipt, sseKey)
+		if err != nil {
+			respondWithError(w, http.StatusBadGateway, "Couldn't read stored object", err)
+			return
+		}
+		matches := checksum == receipt.ChecksumSHA256
+		resp.ChecksumMatches = &matches
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// receiptSSEKey returns the key an encrypted video's object is read with.
+// Only the video's current object has one on record; older versions were
+// encrypted with keys since replaced.
+func (cfg *apiConfig) receiptSSEKey(ctx context.Context, video database.Video, receipt auth.UploadReceipt) (*sseCustomerKey, error) {
+	if !video.Encrypted || cfg.keyWrapper == nil {
+		return nil, nil
+	}
+	videoKey, err := cfg.db.GetVideoKey(video.ID)
+	if err != nil {
+		return nil, err
+	}
+	if videoKey.S3Key != receipt.Key {
+		return nil, nil
+	}
+	dataKey, err := cfg.keyWrapper.Unwrap(ctx, videoKey.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	return newSSECustomerKey(dataKey), nil
+}
+
+// hashStoredObject streams the object a receipt describes through SHA-256.
+func (cfg *apiConfig) hashStoredObject(ctx context.Context, receipt auth.UploadReceipt, sseKey *sseCustomerKey) (string, error) {
+	input := &s3.GetObjectInput{Bucket: &cfg.s3Bucket, Key: &receipt.Key}
+	if receipt.VersionID != "" {
+		input.VersionId = &receipt.VersionID
+	}
+	sseKey.applyToGet(input)
+	out, err := cfg.s3Client.GetObject(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("could not get object %s: %w", receipt.Key, err)
+	}
+	defer out.Body.Close()
+	hash := sha256.New()
+	if _, err := cfg.buffers.copy(hash, out.Body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultRelatedVideos = 10
+	maxRelatedVideos     = 50
+	// relatedCandidates is how many of the best tag and uploader matches
+	// are scored, before recency reorders them
+	relatedCandidates = 200
+	// relatedVideosTTL is how long a video's related videos are served
+	// from memory, so a changed tag or a new upload can take this long to
+	// show up
+	relatedVideosTTL = 5 * time.Minute
+	// maxRelatedCacheEntries bounds the cache; when it's full of live
+	// entries it's emptied and refills with what's asked for next
+	maxRelatedCacheEntries = 10000
+	// relatedRecencyHalfLife is the age at which a video's recency bonus
+	// has halved
+	relatedRecencyHalfLife = 30 * 24 * time.Hour
+)
+
+// Weights of what makes a video related. A shared tag counts for more than
+// a shared uploader, and a brand-new video gets a bonus worth less than one
+// shared tag, so recency mostly breaks ties.
+const (
+	relatedTagWeight      = 3.0
+	relatedUploaderWeight = 2.0
+	relatedRecencyWeight  = 2.0
+)
+
+// relatedVideo is a video in a related videos list, with its score.
+type relatedVideo struct {
+	database.RelatedVideo
+	Score float64 `json:"score"`
+}
+
+// relatedVideosCache keeps each viewer's related videos of a video for
+// relatedVideosTTL, so a sidebar shown on every play doesn't rerun the
+// query. The results differ by viewer, who may see private videos, so
+// they're kept per viewer. Misses for the same key share one query.
+type relatedVideosCache struct {
+	mu      sync.Mutex
+	entries map[string]relatedVideosEntry
+	flights flightGroup[[]relatedVideo]
+}
+
+type relatedVideosEntry struct {
+	videos    []relatedVideo
+	expiresAt time.Time
+}
+
+func newRelatedVideosCache() *relatedVideosCache {
+	return &relatedVideosCache{entries: map[string]relatedVideosEntry{}}
+}
+
+func (c *relatedVideosCache) get(key string, now time.Time) ([]relatedVideo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || now.After(entry.expiresAt) {
+		return nil, false
+	}
+	return entry.videos, true
+}
+
+func (c *relatedVideosCache) put(key string, videos []relatedVideo, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxRelatedCacheEntries {
+		for k, entry := range c.entries {
+			if now.After(entry.expiresAt) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxRelatedCacheEntries {
+			clear(c.entries)
+		}
+	}
+	c.entries[key] = relatedVideosEntry{videos: videos, expiresAt: now.Add(relatedVideosTTL)}
+}
+
+// scoreRelatedVideos ranks candidates by shared tags, a shared uploader
+// and how recently they were made, best first, keeping at most
+// maxRelatedVideos. Popularity plays no part; it's what ranks the
+// trending feed.
+func scoreRelatedVideos(candidates []database.RelatedVideo, now time.Time) []relatedVideo {
+	scored := make([]relatedVideo, 0, len(candidates))
+	for _, candidate := range candidates {
+		score := relatedTagWeight * float64(candidate.SharedTags)
+		if candidate.SameUploader {
+			score += relatedUploaderWeight
+		}
+		age := max(now.Sub(candidate.CreatedAt), 0)
+		score += relatedRecencyWeight * math.Pow(0.5, float64(age)/float64(relatedRecencyHalfLife))
+		scored = append(scored, relatedVideo{RelatedVideo: candidate, Score: math.Round(score*1000) / 1000})
+	}
+	sort.SliceStable(scored, func(i, j int) bool {
+		return scored[i].Score > scored[j].Score
+	})
+	if len(scored) > maxRelatedVideos {
+		scored = scored[:maxRelatedVideos]
+	}
+	return scored
+}
+
+// relatedVideos returns the ranked related videos of video as viewerID
+// sees them, from the cache when it can.
+func (cfg *apiConfig) relatedVideos(video database.Video, viewerID uuid.UUID) ([]relatedVideo, error) {
+	key := video.ID.String() + ":" + viewerID.String()
+	if videos, ok := cfg.related.get(key, time.Now()); ok {
+		cfg.metrics.add(`tubely_related_cache_total{result="hit"}`, 1)
+		return videos, nil
+	}
+	cfg.metrics.add(`tubely_related_cache_total{result="miss"}`, 1)
+	videos, err, _ := cfg.related.flights.do(key, func() ([]relatedVideo, error) {
+		candidates, err := cfg.db.GetRelatedVideos(video, viewerID, relatedCandidates)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		videos := scoreRelatedVideos(candidates, now)
+		cfg.related.put(key, videos, now)
+		return videos, nil
+	})
+	return videos, err
+}
+
+// handlerVideoRelated lists videos related to one the caller can view, for
+// a player's sidebar: public videos and the caller's own and organizations'
+// videos that share its tags or uploader, ranked by how much they share and
+// how recent they are. Videos the caller's country can't play are left out.
+// limit is from 1 to 50 and defaults to 10.
+func (cfg *apiConfig) handlerVideoRelated(w http.ResponseWriter, r *http.Request) {
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	limit := defaultRelatedVideos
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxRelatedVideos {
+			respondWithValidationError(w, map[string]string{"limit": fmt.Sprintf("must be a number from 1 to %d", maxRelatedVideos)}, nil)
+			return
+		}
+		limit = n
+	}
+
+	video, err := cfg.getVideoShared(videoID, false)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	allowed := false
+	if video.ID != uuid.Nil {
+		allowed, err = cfg.canViewVideo(userID, video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check video permissions", err)
+			return
+		}
+	}
+	if !allowed {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	videos, err := cfg.relatedVideos(video, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find related videos", err)
+		return
+	}
+	// The cached list is shared, so signing works on a copy
+	related := make([]relatedVideo, 0, min(limit, len(videos)))
+	for _, candidate := range videos {
+		if len(related) == limit {
+			break
+		}
+		if _, permitted := cfg.checkGeoRestriction(r, candidate.Video); !permitted {
+			continue
+		}
+		cfg.signVideoAssets(&candidate.Video)
+		related = append(related, candidate)
+	}
+	respondWithJSON(w, http.StatusOK, related)
+}
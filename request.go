@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// maxJSONBodySize caps every JSON request body decoded through decodeJSON.
+const maxJSONBodySize = 1 << 20 // 1 MB
+
+// respondWithValidationError sends the shared 400 payload for malformed
+// requests. fields maps each offending JSON field to what's wrong with it.
+func respondWithValidationError(w http.ResponseWriter, fields map[string]string, err error) {
+	type validationResponse struct {
+		Error  string            `json:"error"`
+		Code   string            `json:"code"`
+		Fields map[string]string `json:"fields,omitempty"`
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	problems := make([]string, 0, len(names))
+	for _, name := range names {
+		problems = append(problems, name+" "+fields[name])
+	}
+	msg := "Invalid request"
+	if len(problems) > 0 {
+		msg += ": " + strings.Join(problems, "; ")
+	}
+
+	if err != nil {
+		log.Println(err)
+	}
+	respondWithJSON(w, http.StatusBadRequest, validationResponse{
+		Error:  msg,
+		Code:   "invalid_request",
+		Fields: fields,
+	})
+}
+
+// decodeJSON reads a size-limited JSON body into T and checks the struct's
+// validate tags, responding with a 400 and reporting false when either
+// fails. Supported rules are required, uuid, min=N and max=N, where min and
+// max bound the value of numbers and the length of strings and slices.
+func decodeJSON[T any](w http.ResponseWriter, r *http.Request) (T, bool) {
+	var params T
+	r.Body = http.MaxBytesReader(w, r.Body, maxJSONBodySize)
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &maxBytesErr):
+			respondWithErrorCode(w, http.StatusRequestEntityTooLarge, "request_too_large", "Request body is too large", err)
+		case errors.As(err, &typeErr) && typeErr.Field != "":
+			respondWithValidationError(w, map[string]string{typeErr.Field: "must be a " + typeErr.Type.String()}, err)
+		default:
+			respondWithValidationError(w, map[string]string{"body": "must be valid JSON"}, err)
+		}
+		return params, false
+	}
+
+	if fields := validateStruct(reflect.ValueOf(params)); len(fields) > 0 {
+		respondWithValidationError(w, fields, nil)
+		return params, false
+	}
+	return params, true
+}
+
+// validateStruct applies validate tags to the fields of a struct, including
+// those of embedded structs.
+func validateStruct(v reflect.Value) map[string]string {
+	fields := map[string]string{}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		value := v.Field(i)
+		if field.Anonymous && value.Kind() == reflect.Struct {
+			for name, problem := range validateStruct(value) {
+				fields[name] = problem
+			}
+			continue
+		}
+
+		rules := field.Tag.Get("validate")
+		if rules == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" {
+			name = field.Name
+		}
+		if problem := validateField(value, strings.Split(rules, ",")); problem != "" {
+			fields[name] = problem
+		}
+	}
+	return fields
+}
+
+func validateField(value reflect.Value, rules []string) string {
+	if value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			if slices.Contains(rules, "required") {
+				return "is required"
+			}
+			return ""
+		}
+		value = value.Elem()
+	}
+
+	for _, rule := range rules {
+		name, arg, _ := strings.Cut(rule, "=")
+		switch name {
+		case "required":
+			if value.IsZero() {
+				return "is required"
+			}
+		case "uuid":
+			if value.Kind() == reflect.String && value.String() != "" {
+				if _, err := uuid.Parse(value.String()); err != nil {
+					return "must be a UUID"
+				}
+			}
+		case "min", "max":
+			limit, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				panic(fmt.Sprintf("invalid validate rule %q", rule))
+			}
+			if problem := checkBound(value, name, limit); problem != "" {
+				return problem
+			}
+		default:
+			panic(fmt.Sprintf("unknown validate rule %q", rule))
+		}
+	}
+	return ""
+}
+
+func checkBound(value reflect.Value, bound string, limit float64) string {
+	var n float64
+	var unit string
+	switch value.Kind() {
+	case reflect.String:
+		n = float64(utf8.RuneCountInString(value.String()))
+		unit = " characters"
+	case reflect.Slice:
+		n = float64(value.Len())
+		unit = " items"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n = float64(value.Int())
+	case reflect.Float32, reflect.Float64:
+		n = value.Float()
+	default:
+		return ""
+	}
+
+	limitString := strconv.FormatFloat(limit, 'f', -1, 64)
+	switch {
+	case bound == "min" && n < limit:
+		return "must be at least " + limitString + unit
+	case bound == "max" && n > limit:
+		return "must be at most " + limitString + unit
+	}
+	return ""
+}
+
+// pathUUID parses a UUID path parameter, responding with a 400 and
+// reporting false when it's malformed.
+func pathUUID(w http.ResponseWriter, r *http.Request, name string) (uuid.UUID, bool) {
+	id, err := uuid.Parse(r.PathValue(name))
+	if err != nil {
+		respondWithValidationError(w, map[string]string{name: "must be a UUID"}, err)
+		return uuid.Nil, false
+	}
+	return id, true
+}
+
+// formFile reads a file field from a size-limited multipart body and checks
+// its declared media type against the allowed list. It responds with the
+// appropriate error and reports false on failure; on success the caller
+// owns the returned file.
+func formFile(w http.ResponseWriter, r *http.Request, field string, maxBytes int64, allowedTypes ...string) (multipart.File, string, bool) {
+	const maxMemory = 10 << 20 // 10 MB
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+	if err := r.ParseMultipartForm(maxMemory); err != nil {
+		respondWithMultipartError(w, err)
+		return nil, "", false
+	}
+
+	file, header, err := r.FormFile(field)
+	if err != nil {
+		respondWithValidationError(w, map[string]string{field: "is required"}, err)
+		return nil, "", false
+	}
+
+	mediaType, problem := partMediaType(header, allowedTypes...)
+	if problem != "" {
+		file.Close()
+		respondWithValidationError(w, map[string]string{field: problem}, nil)
+		return nil, "", false
+	}
+	return file, mediaType, true
+}
+
+// streamFormFile is formFile for files that shouldn't be held in memory.
+// It reads the multipart body part by part and copies the field's file to a
+// temporary file as it arrives, so the size limit is enforced while
+// receiving rather than after. If inspect is set, it sees the start of the
+// file as it's copied and can reject it, e.g. from its header, before the
+// rest is received. On success the caller owns the returned file, rewound,
+// and removes it when done.
+func streamFormFile(w http.ResponseWriter, r *http.Request, field string, maxBytes int64, inspect func(head io.Reader, mediaType string) error, allowedTypes ...string) (*os.File, string, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		respondWithValidationError(w, map[string]string{"body": "must be multipart form data"}, err)
+		return nil, "", false
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			respondWithValidationError(w, map[string]string{field: "is required"}, nil)
+			return nil, "", false
+		}
+		if err != nil {
+			respondWithMultipartError(w, err)
+			return nil, "", false
+		}
+		if part.FormName() != field || part.FileName() == "" {
+			// NextPart skips whatever is left of it
+			continue
+		}
+
+		mediaType, problem := mediaTypeOf(part.Header.Get("Content-Type"), allowedTypes...)
+		if problem != "" {
+			respondWithValidationError(w, map[string]string{field: problem}, nil)
+			return nil, "", false
+		}
+
+		file, err := os.CreateTemp("", "tubely-form-*")
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't create temp file", err)
+			return nil, "", false
+		}
+		fail := func() (*os.File, string, bool) {
+			file.Close()
+			os.Remove(file.Name())
+			return nil, "", false
+		}
+
+		if inspect != nil {
+			if err := inspect(io.TeeReader(part, file), mediaType); err != nil {
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					respondWithMultipartError(w, err)
+				} else {
+					respondWithValidationError(w, map[string]string{field: err.Error()}, err)
+				}
+				return fail()
+			}
+		}
+		if _, err := io.Copy(file, part); err != nil {
+			respondWithMultipartError(w, err)
+			return fail()
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't read uploaded file", err)
+			return fail()
+		}
+		return file, mediaType, true
+	}
+}
+
+// respondWithMultipartError reports a failure reading a multipart body,
+// which is either the body exceeding its size limit or a malformed body.
+func respondWithMultipartError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		respondWithErrorCode(w, http.StatusRequestEntityTooLarge, "request_too_large", "Request body is too large", err)
+		return
+	}
+	respondWithValidationError(w, map[string]string{"body": "must be multipart form data"}, err)
+}
+
+// partMediaType checks a multipart file's declared media type against the
+// allowed list. It returns the media type, or what's wrong with it.
+func partMediaType(header *multipart.FileHeader, allowedTypes ...string) (string, string) {
+	return mediaTypeOf(header.Header.Get("Content-Type"), allowedTypes...)
+}
+
+func mediaTypeOf(contentType string, allowedTypes ...string) (string, string) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", "has a missing or malformed Content-Type"
+	}
+	if !slices.Contains(allowedTypes, mediaType) {
+		return "", fmt.Sprintf("must be one of %s, got %s", strings.Join(allowedTypes, ", "), mediaType)
+	}
+	return mediaType, ""
+}
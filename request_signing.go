@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// signedRequestScheme is the Authorization scheme of signed requests:
+//
+//	Authorization: Tubely-HMAC-SHA256 key=<key ID>,ts=<unix time>,sig=<hex>
+//
+// sig is the HMAC-SHA256, under the key's secret, of the method, the
+// request URI, ts and the hex SHA-256 of the body, joined by newlines. The
+// body's hash is sent in X-Tubely-Content-SHA256, and may be left out for
+// an empty body.
+const signedRequestScheme = "Tubely-HMAC-SHA256"
+
+const contentSHA256Header = "X-Tubely-Content-SHA256"
+
+// emptySHA256 is the hex SHA-256 of an empty body.
+var emptySHA256 = hex.EncodeToString(sha256.New().Sum(nil))
+
+var errBodyHashMismatch = errors.New("request body doesn't match " + contentSHA256Header)
+
+// maxSignedBodySize bounds what a signed request can send, since its body
+// is read in full before the handler's own limit applies. It leaves room
+// for a form around the largest video upload.
+const maxSignedBodySize = maxVideoUploadSize + maxJSONBodySize
+
+// signedRequestString is what a request's signature covers.
+func signedRequestString(method, requestURI, timestamp, bodyHash string) string {
+	return method + "\n" + requestURI + "\n" + timestamp + "\n" + bodyHash
+}
+
+// requestSigning authenticates requests signed with a signing key, for
+// integrations that would rather not have a bearer token in their logs. A
+// request it verifies reaches the handlers with a short-lived access token
+// for the key's owner in place of its signature, so they authenticate it
+// like any other. Requests without a signature pass through untouched.
+func (cfg *apiConfig) requestSigning(window time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		credentials, ok := strings.CutPrefix(r.Header.Get("Authorization"), signedRequestScheme+" ")
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		userID, ok := cfg.verifyRequestSignature(w, r, credentials, window)
+		if !ok {
+			cfg.metrics.add("tubely_signed_requests_rejected_total", 1)
+			return
+		}
+		// The server only closes the body it read the request into
+		defer r.Body.Close()
+		token, err := auth.MakeJWT(userID, cfg.jwtSecret.get(), time.Minute)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't create access JWT", err)
+			return
+		}
+		r.Header.Set("Authorization", "Bearer "+token)
+		cfg.metrics.add("tubely_signed_requests_total", 1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// verifyRequestSignature checks a signed request's credentials and body,
+// responding and reporting false if they don't hold up.
+func (cfg *apiConfig) verifyRequestSignature(w http.ResponseWriter, r *http.Request, credentials string, window time.Duration) (uuid.UUID, bool) {
+	fields := map[string]string{}
+	for _, field := range strings.Split(credentials, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		fields[name] = value
+	}
+	keyID, err := uuid.Parse(fields["key"])
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, "signature_invalid", "Malformed request signature", err)
+		return uuid.Nil, false
+	}
+	timestamp, err := strconv.ParseInt(fields["ts"], 10, 64)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, "signature_invalid", "Malformed request signature", err)
+		return uuid.Nil, false
+	}
+	signedAt := time.Unix(timestamp, 0)
+	if math.Abs(time.Since(signedAt).Seconds()) > window.Seconds() {
+		respondWithErrorCode(w, http.StatusUnauthorized, "signature_expired", "The request was signed too long ago, or the client's clock is off", nil)
+		return uuid.Nil, false
+	}
+	signature, err := hex.DecodeString(fields["sig"])
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, "signature_invalid", "Malformed request signature", err)
+		return uuid.Nil, false
+	}
+	bodyHash := strings.ToLower(r.Header.Get(contentSHA256Header))
+	if bodyHash == "" {
+		bodyHash = emptySHA256
+	}
+	expectedBody, err := hex.DecodeString(bodyHash)
+	if err != nil || len(expectedBody) != sha256.Size {
+		respondWithErrorCode(w, http.StatusUnauthorized, "signature_invalid", contentSHA256Header+" must be a hex SHA-256", err)
+		return uuid.Nil, false
+	}
+
+	key, secret, err := cfg.db.GetSigningKey(keyID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get signing key", err)
+		return uuid.Nil, false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signedRequestString(r.Method, r.RequestURI, fields["ts"], bodyHash)))
+	// An unknown key is checked against an empty secret, so the answer
+	// doesn't say whether the key exists
+	if key.ID == uuid.Nil || !hmac.Equal(signature, mac.Sum(nil)) {
+		respondWithErrorCode(w, http.StatusUnauthorized, "signature_invalid", "The request signature doesn't match", nil)
+		return uuid.Nil, false
+	}
+
+	body, err := spoolSignedBody(w, r.Body, expectedBody)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Signed request body is too large", err)
+		return uuid.Nil, false
+	case errors.Is(err, errBodyHashMismatch):
+		respondWithErrorCode(w, http.StatusUnauthorized, "signature_invalid", "The request body doesn't match its signature", err)
+		return uuid.Nil, false
+	case err != nil:
+		respondWithError(w, http.StatusBadRequest, "Couldn't read request body", err)
+		return uuid.Nil, false
+	}
+
+	fresh, err := cfg.db.RecordRequestSignature(fields["sig"], signedAt.Add(window))
+	if err != nil {
+		body.Close()
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record request signature", err)
+		return uuid.Nil, false
+	}
+	if !fresh {
+		body.Close()
+		respondWithErrorCode(w, http.StatusUnauthorized, "signature_replayed", "This signed request was already received", nil)
+		return uuid.Nil, false
+	}
+	if err := cfg.db.TouchSigningKey(key.ID); err != nil {
+		log.Printf("Couldn't record use of signing key %s: %v", key.ID, err)
+	}
+	r.Body = body
+	return key.UserID, true
+}
+
+// spoolSignedBody reads a signed request's whole body and checks it
+// against the signed hash before any handler sees it. Handlers often stop
+// reading before the end, as a JSON decoder does, so the check can't wait
+// for them. Small bodies are kept in memory and larger ones in a temporary
+// file, which is removed when the body is closed.
+func spoolSignedBody(w http.ResponseWriter, body io.ReadCloser, expected []byte) (io.ReadCloser, error) {
+	defer body.Close()
+	hash := sha256.New()
+	src := io.TeeReader(http.MaxBytesReader(w, body, maxSignedBodySize), hash)
+
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, src, maxJSONBodySize+1); err == io.EOF {
+		if !hmac.Equal(hash.Sum(nil), expected) {
+			return nil, errBodyHashMismatch
+		}
+		return io.NopCloser(&buf), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	spool, err := os.CreateTemp("", "tubely-signed-body-*")
+	if err != nil {
+		return nil, err
+	}
+	spooled := &spooledBody{File: spool}
+	if _, err := io.Copy(spool, io.MultiReader(&buf, src)); err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	if !hmac.Equal(hash.Sum(nil), expected) {
+		spooled.Close()
+		return nil, errBodyHashMismatch
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	return spooled, nil
+}
+
+type spooledBody struct {
+	*os.File
+}
+
+func (s *spooledBody) Close() error {
+	err := s.File.Close()
+	os.Remove(s.File.Name())
+	return err
+}
+
+func (cfg *apiConfig) handlerSigningKeyCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name string `json:"name" validate:"required,max=100"`
+	}
+	type response struct {
+		database.SigningKey
+		Secret string `json:"secret"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+
+	secret, err := auth.MakeRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate signing key", err)
+		return
+	}
+	key, err := cfg.db.CreateSigningKey(userID, params.Name, secret)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save signing key", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, response{SigningKey: key, Secret: secret})
+}
+
+func (cfg *apiConfig) handlerSigningKeysRetrieve(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	keys, err := cfg.db.GetSigningKeysForUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get signing keys", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, keys)
+}
+
+func (cfg *apiConfig) handlerSigningKeyDelete(w http.ResponseWriter, r *http.Request) {
+	keyID, ok := pathUUID(w, r, "keyID")
+	if !ok {
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	found, err := cfg.db.DeleteSigningKey(userID, keyID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete signing key", err)
+		return
+	}
+	if !found {
+		respondWithError(w, http.StatusNotFound, "Signing key not found", nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// peakRSS isn't available where there's no getrusage.
+func peakRSS(state *os.ProcessState) (int64, bool) {
+	return 0, false
+}
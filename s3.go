@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+	"github.com/google/uuid"
+)
+
+// newObjectKey returns a fresh random key under the given prefix.
+func newObjectKey(prefix string) (string, error) {
+	randBytes := make([]byte, 32)
+	if _, err := rand.Read(randBytes); err != nil {
+		return "", fmt.Errorf("could not generate random filename for S3 key: %w", err)
+	}
+	return media.ObjectKey(prefix, randBytes), nil
+}
+
+const (
+	keyNamingRandom      = "random"
+	keyNamingDescriptive = "descriptive"
+)
+
+// descriptiveKeyAttempts bounds how often a descriptive key is redrawn when
+// it turns out to be taken.
+const descriptiveKeyAttempts = 3
+
+// videoObjectName is what a video object's key and download name can be
+// derived from.
+type videoObjectName struct {
+	userID  uuid.UUID
+	videoID uuid.UUID
+	title   string
+	// filename is what browsers are offered to save the object as
+	filename string
+}
+
+func videoObjectNameOf(video database.Video) videoObjectName {
+	return videoObjectName{userID: video.UserID, videoID: video.ID, title: video.Title, filename: videoDownloadName(video)}
+}
+
+// videoDownloadName is the name a video's file is saved under: the name it
+// was uploaded with, or failing that its title.
+func videoDownloadName(video database.Video) string {
+	if video.OriginalFilename != nil {
+		return *video.OriginalFilename
+	}
+	return video.Title
+}
+
+// newVideoObjectKey returns a fresh key for a video object under prefix.
+// With descriptive naming the key embeds the owner, video and title, and is
+// checked against the bucket, since its random part is short enough to be
+// worth checking.
+func (cfg *apiConfig) newVideoObjectKey(ctx context.Context, prefix string, name videoObjectName) (string, error) {
+	if cfg.s3KeyNaming != keyNamingDescriptive {
+		return newObjectKey(prefix)
+	}
+
+	randBytes := make([]byte, 6)
+	for range descriptiveKeyAttempts {
+		if _, err := rand.Read(randBytes); err != nil {
+			return "", fmt.Errorf("could not generate random suffix for S3 key: %w", err)
+		}
+		key := media.DescriptiveObjectKey(prefix, name.userID.String(), name.videoID.String(), name.title, randBytes)
+		_, err := cfg.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: &cfg.s3Bucket,
+			Key:    &key,
+		})
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return key, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("could not check S3 key %s: %w", key, err)
+		}
+		cfg.metrics.add("tubely_s3_key_collisions_total", 1)
+	}
+	return "", fmt.Errorf("no free S3 key after %d attempts", descriptiveKeyAttempts)
+}
+
+// copyS3Object duplicates an object within the bucket without downloading
+// it, returning the new key under the same prefix as the source.
+func (cfg *apiConfig) copyS3Object(ctx context.Context, sourceKey string, name videoObjectName) (string, error) {
+	prefix, _, _ := strings.Cut(sourceKey, "/")
+	destKey, err := cfg.newVideoObjectKey(ctx, prefix, name)
+	if err != nil {
+		return "", err
+	}
+	if err := cfg.copyS3ObjectTo(ctx, sourceKey, destKey); err != nil {
+		return "", err
+	}
+	return destKey, nil
+}
+
+// copyS3ObjectTo copies an object within the bucket to a chosen key.
+func (cfg *apiConfig) copyS3ObjectTo(ctx context.Context, sourceKey, destKey string) error {
+	copySource := cfg.s3Bucket + "/" + url.PathEscape(sourceKey)
+	_, err := cfg.s3Client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     &cfg.s3Bucket,
+		Key:        &destKey,
+		CopySource: &copySource,
+	})
+	if err != nil {
+		return fmt.Errorf("could not copy object %s: %w", sourceKey, err)
+	}
+	return nil
+}
+
+// copyS3ObjectAs copies sourceKey to the key in input, replacing the
+// source's headers with the ones input would have uploaded with.
+func (cfg *apiConfig) copyS3ObjectAs(ctx context.Context, sourceKey string, input *s3.PutObjectInput) error {
+	copySource := cfg.s3Bucket + "/" + url.PathEscape(sourceKey)
+	_, err := cfg.s3Client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:             input.Bucket,
+		Key:                input.Key,
+		CopySource:         &copySource,
+		MetadataDirective:  types.MetadataDirectiveReplace,
+		ContentType:        input.ContentType,
+		CacheControl:       input.CacheControl,
+		ContentDisposition: input.ContentDisposition,
+	})
+	if err != nil {
+		return fmt.Errorf("could not copy object %s: %w", sourceKey, err)
+	}
+	return nil
+}
+
+// s3KeyFromURL recovers the object key from a stored delivery URL. URLs
+// stored before the delivery template last changed don't match it, and
+// fall back to the key being the URL path.
+func (cfg *apiConfig) s3KeyFromURL(rawURL string) (string, error) {
+	if key, ok := cfg.urls.ObjectKey(rawURL); ok {
+		return key, nil
+	}
+	return media.KeyFromURL(rawURL)
+}
+
+// videoObjectKey returns the S3 key of a video's file. Encrypted videos are
+// served through the stream proxy, so their key lives in the keystore rather
+// than in the URL.
+func (cfg *apiConfig) videoObjectKey(video database.Video) (string, error) {
+	if video.VideoURL == nil {
+		return "", fmt.Errorf("video %s has no uploaded file", video.ID)
+	}
+	if !video.Encrypted {
+		return cfg.s3KeyFromURL(*video.VideoURL)
+	}
+	videoKey, err := cfg.db.GetVideoKey(video.ID)
+	if err != nil {
+		return "", err
+	}
+	if videoKey.S3Key == "" {
+		return "", fmt.Errorf("no keystore entry for video %s", video.ID)
+	}
+	return videoKey.S3Key, nil
+}
+
+// downloadS3Object copies an object from the bucket into a new temp file and
+// returns its path. The caller is responsible for removing it.
+func (cfg *apiConfig) downloadS3Object(ctx context.Context, key string) (string, error) {
+	return cfg.downloadObject(ctx, &s3.GetObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &key,
+	})
+}
+
+// downloadObject is downloadS3Object for any bucket, or part of an object
+// when the input has a Range.
+func (cfg *apiConfig) downloadObject(ctx context.Context, input *s3.GetObjectInput) (string, error) {
+	key := *input.Key
+	out, err := cfg.s3Client.GetObject(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("could not get object %s: %w", key, err)
+	}
+	defer out.Body.Close()
+
+	tempFile, err := os.CreateTemp("", "tubely-download-*.mp4")
+	if err != nil {
+		return "", err
+	}
+	defer tempFile.Close()
+
+	if _, err := cfg.buffers.copy(tempFile, out.Body); err != nil {
+		os.Remove(tempFile.Name())
+		return "", fmt.Errorf("could not download object %s: %w", key, err)
+	}
+
+	return tempFile.Name(), nil
+}
+
+// presignGetObject returns a short-lived URL that ffmpeg/ffprobe can read
+// directly, so only the byte ranges they need leave the bucket.
+func (cfg *apiConfig) presignGetObject(ctx context.Context, key string, expiresIn time.Duration) (string, error) {
+	presignClient := s3.NewPresignClient(cfg.s3Client)
+	req, err := presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &key,
+	}, s3.WithPresignExpires(expiresIn))
+	if err != nil {
+		return "", fmt.Errorf("could not presign object %s: %w", key, err)
+	}
+	return req.URL, nil
+}
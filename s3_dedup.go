@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// storeObjectDeduplicated stores a file like putObjectFromFile, except that
+// when the bucket already holds an object with identical content it is
+// copied server-side instead of uploaded from this host. Each key still
+// gets its own object, so deleting one video never affects another.
+// Encrypted objects are always uploaded, since their bytes at rest differ
+// per key. Nor are objects written as a user, whose role may not read
+// another tenant's copy.
+func (cfg *apiConfig) storeObjectDeduplicated(ctx context.Context, input *s3.PutObjectInput, file *os.File) error {
+	if input.SSECustomerKey != nil || cfg.s3For(ctx) != cfg.s3Client {
+		return cfg.putObjectFromFile(ctx, input, file)
+	}
+
+	hash := sha256.New()
+	size, err := cfg.buffers.copy(hash, file)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+
+	existing, err := cfg.db.GetObjectByChecksum(checksum, size)
+	if err != nil {
+		return err
+	}
+	copied := false
+	if existing.S3Key != "" && existing.S3Key != *input.Key {
+		if err := cfg.copyS3ObjectAs(ctx, existing.S3Key, input); err != nil {
+			// Most likely the original was deleted since; forget it and
+			// upload after all
+			log.Printf("Couldn't reuse %s for %s, uploading instead: %v", existing.S3Key, *input.Key, err)
+			if err := cfg.db.DeleteObjectChecksum(existing.S3Key); err != nil {
+				return err
+			}
+		} else {
+			copied = true
+			cfg.metrics.add("tubely_s3_dedup_copies_total", 1)
+			cfg.metrics.add("tubely_s3_dedup_bytes_saved_total", float64(size))
+		}
+	}
+	if !copied {
+		if err := cfg.putObjectFromFile(ctx, input, file); err != nil {
+			return err
+		}
+	}
+
+	return cfg.db.PutObjectChecksum(database.ObjectChecksum{
+		S3Key:          *input.Key,
+		ChecksumSHA256: checksum,
+		Size:           size,
+	})
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	// s3MinPartSize and s3MaxParts are hard limits of the S3 API.
+	s3MinPartSize = 5 << 20 // 5 MB
+	s3MaxParts    = 10000
+	// targetPartDuration is roughly how long one part should take on one
+	// connection: long enough to amortize request overhead, short enough
+	// that retrying a failed part is cheap.
+	targetPartDuration = 4 * time.Second
+	// throughputSmoothing weighs the newest measurement in the moving
+	// per-connection throughput estimate.
+	throughputSmoothing = 0.3
+)
+
+// s3UploadTuner picks part size and parallelism for multipart uploads from
+// the file size and the throughput measured on earlier uploads, within the
+// configured floor and ceiling.
+type s3UploadTuner struct {
+	minPartSize    int64
+	maxPartSize    int64
+	maxConcurrency int
+
+	mu sync.Mutex
+	// connBytesPerSec is the smoothed throughput of a single connection;
+	// zero until the first multipart upload finishes.
+	connBytesPerSec float64
+}
+
+func newS3UploadTuner(minPartSize, maxPartSize int64, maxConcurrency int) (*s3UploadTuner, error) {
+	if minPartSize < s3MinPartSize {
+		return nil, fmt.Errorf("minimum part size must be at least %d bytes", s3MinPartSize)
+	}
+	if maxPartSize < minPartSize {
+		return nil, errors.New("maximum part size is below the minimum")
+	}
+	if maxConcurrency < 1 {
+		return nil, errors.New("concurrency must be at least 1")
+	}
+	return &s3UploadTuner{minPartSize: minPartSize, maxPartSize: maxPartSize, maxConcurrency: maxConcurrency}, nil
+}
+
+// multipartThreshold is the size from which splitting a file beats a
+// single PutObject.
+func (t *s3UploadTuner) multipartThreshold() int64 {
+	return 2 * t.minPartSize
+}
+
+// plan chooses the part size and number of concurrent part uploads for a
+// file. Slow connections get small parts and, with more of them in flight,
+// more parallelism; fast ones get large parts and fewer requests.
+func (t *s3UploadTuner) plan(size int64) (partSize int64, concurrency int) {
+	t.mu.Lock()
+	rate := t.connBytesPerSec
+	t.mu.Unlock()
+
+	partSize = t.minPartSize
+	if rate > 0 {
+		partSize = int64(rate * targetPartDuration.Seconds())
+	}
+	partSize = min(max(partSize, t.minPartSize), t.maxPartSize)
+	// The part count limit wins over the configured ceiling
+	partSize = max(partSize, (size+s3MaxParts-1)/s3MaxParts)
+
+	parts := (size + partSize - 1) / partSize
+	concurrency = int(min(parts, int64(t.maxConcurrency)))
+	return partSize, max(concurrency, 1)
+}
+
+func (t *s3UploadTuner) observe(bytes int64, elapsed time.Duration, concurrency int) {
+	if elapsed <= 0 || concurrency < 1 {
+		return
+	}
+	rate := float64(bytes) / elapsed.Seconds() / float64(concurrency)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.connBytesPerSec == 0 {
+		t.connBytesPerSec = rate
+		return
+	}
+	t.connBytesPerSec = throughputSmoothing*rate + (1-throughputSmoothing)*t.connBytesPerSec
+}
+
+// putObjectFromFile uploads a file to the key described by input, splitting
+// it into concurrently uploaded parts once it's big enough. input carries
+// the bucket, key, content type and SSE-C settings; its Body is ignored.
+func (cfg *apiConfig) putObjectFromFile(ctx context.Context, input *s3.PutObjectInput, file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	if size < cfg.s3Uploads.multipartThreshold() {
+		input.Body = file
+		_, err := cfg.s3For(ctx).PutObject(ctx, input)
+		return err
+	}
+
+	partSize, concurrency := cfg.s3Uploads.plan(size)
+	start := time.Now()
+	partSize, sent, err := cfg.multipartUpload(ctx, input, file, size, partSize, concurrency)
+	if err != nil {
+		return err
+	}
+	elapsed := time.Since(start)
+	// Parts kept from an interrupted upload say nothing about throughput
+	if sent > 0 {
+		cfg.s3Uploads.observe(sent, elapsed, concurrency)
+		cfg.metrics.set("tubely_s3_upload_throughput_bytes_per_second", float64(sent)/elapsed.Seconds())
+	}
+
+	cfg.metrics.set("tubely_s3_upload_part_size_bytes", float64(partSize))
+	cfg.metrics.set("tubely_s3_upload_concurrency", float64(concurrency))
+	log.Printf("Multipart upload of %s: %d bytes in %d-byte parts, %d at a time, took %s",
+		*input.Key, size, partSize, concurrency, elapsed.Round(time.Millisecond))
+	if sent < size {
+		log.Printf("Resumed multipart upload of %s with %d bytes already uploaded", *input.Key, size-sent)
+	}
+	return nil
+}
+
+// multipartUpload uploads file in parts, resuming an unfinished upload of it
+// when there is one. Every part S3 accepts is recorded in the database as it
+// goes. It returns the part size used, which is the resumed upload's rather
+// than partSize, and how many bytes it sent.
+func (cfg *apiConfig) multipartUpload(ctx context.Context, input *s3.PutObjectInput, file io.ReaderAt, size, partSize int64, concurrency int) (int64, int64, error) {
+	upload, completed, err := cfg.resumeMultipartUpload(input, file, size)
+	if err != nil {
+		return 0, 0, fmt.Errorf("couldn't check for an upload to resume: %w", err)
+	}
+	if upload.UploadID == "" {
+		created, err := cfg.s3For(ctx).CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+			Bucket:               input.Bucket,
+			Key:                  input.Key,
+			ContentType:          input.ContentType,
+			CacheControl:         input.CacheControl,
+			ContentDisposition:   input.ContentDisposition,
+			ServerSideEncryption: input.ServerSideEncryption,
+			ChecksumAlgorithm:    types.ChecksumAlgorithmCrc32,
+			SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+			SSECustomerKey:       input.SSECustomerKey,
+			SSECustomerKeyMD5:    input.SSECustomerKeyMD5,
+		})
+		if err != nil {
+			return 0, 0, fmt.Errorf("couldn't start multipart upload: %w", err)
+		}
+		upload = database.S3MultipartUpload{
+			UploadID:          *created.UploadId,
+			Key:               *input.Key,
+			Size:              size,
+			PartSize:          partSize,
+			SSECustomerKeyMD5: aws.ToString(input.SSECustomerKeyMD5),
+		}
+		// Without the record the upload can still finish, it just can't
+		// be resumed
+		if err := cfg.db.CreateS3MultipartUpload(upload); err != nil {
+			log.Printf("Couldn't record multipart upload of %s: %v", *input.Key, err)
+		}
+		completed = make([]types.CompletedPart, (size+partSize-1)/partSize)
+	}
+	partSize = upload.PartSize
+	uploadID := &upload.UploadID
+
+	var sent atomic.Int64
+	uploadCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	partNumbers := make(chan int)
+	var wg sync.WaitGroup
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range partNumbers {
+				offset := int64(n-1) * partSize
+				length := min(partSize, size-offset)
+				partNumber := int32(n)
+				out, err := cfg.s3For(uploadCtx).UploadPart(uploadCtx, &s3.UploadPartInput{
+					Bucket:               input.Bucket,
+					Key:                  input.Key,
+					UploadId:             uploadID,
+					PartNumber:           &partNumber,
+					Body:                 io.NewSectionReader(file, offset, length),
+					ContentLength:        &length,
+					ChecksumAlgorithm:    types.ChecksumAlgorithmCrc32,
+					SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+					SSECustomerKey:       input.SSECustomerKey,
+					SSECustomerKeyMD5:    input.SSECustomerKeyMD5,
+				})
+				if err != nil {
+					cancel(fmt.Errorf("couldn't upload part %d: %w", n, err))
+					continue
+				}
+				sent.Add(length)
+				completed[n-1] = types.CompletedPart{
+					PartNumber:    &partNumber,
+					ETag:          out.ETag,
+					ChecksumCRC32: out.ChecksumCRC32,
+				}
+				if err := cfg.db.PutS3MultipartPart(upload.UploadID, database.S3MultipartPart{
+					PartNumber:    n,
+					ETag:          aws.ToString(out.ETag),
+					ChecksumCRC32: aws.ToString(out.ChecksumCRC32),
+				}); err != nil {
+					log.Printf("Couldn't record part %d of %s: %v", n, *input.Key, err)
+				}
+			}
+		}()
+	}
+	for n := 1; n <= len(completed) && uploadCtx.Err() == nil; n++ {
+		if completed[n-1].ETag != nil {
+			continue
+		}
+		select {
+		case partNumbers <- n:
+		case <-uploadCtx.Done():
+		}
+	}
+	close(partNumbers)
+	wg.Wait()
+
+	if err := context.Cause(uploadCtx); err != nil {
+		cfg.abortMultipartUpload(input, uploadID)
+		return 0, 0, err
+	}
+	_, err = cfg.s3For(ctx).CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          input.Bucket,
+		Key:             input.Key,
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+		// CompleteMultipartUpload has to repeat the key for SSE-C uploads
+		SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+		SSECustomerKey:       input.SSECustomerKey,
+		SSECustomerKeyMD5:    input.SSECustomerKeyMD5,
+	})
+	if err != nil {
+		cfg.abortMultipartUpload(input, uploadID)
+		return 0, 0, fmt.Errorf("couldn't complete multipart upload: %w", err)
+	}
+	if err := cfg.db.DeleteS3MultipartUpload(upload.UploadID); err != nil {
+		log.Printf("Couldn't forget multipart upload of %s: %v", *input.Key, err)
+	}
+	return partSize, sent.Load(), nil
+}
+
+// resumeMultipartUpload finds the unfinished upload of a file to the same
+// key that a restart left behind, and returns it with the parts worth
+// keeping: those whose checksum matches the file's bytes at their offset.
+// An upload of a different size or under a different SSE-C key is aborted
+// instead. It returns an empty upload when there's nothing to resume.
+func (cfg *apiConfig) resumeMultipartUpload(input *s3.PutObjectInput, file io.ReaderAt, size int64) (database.S3MultipartUpload, []types.CompletedPart, error) {
+	upload, err := cfg.db.GetS3MultipartUpload(*input.Key)
+	if err != nil || upload.UploadID == "" {
+		return database.S3MultipartUpload{}, nil, err
+	}
+	if upload.Size != size || upload.SSECustomerKeyMD5 != aws.ToString(input.SSECustomerKeyMD5) {
+		cfg.abortMultipartUpload(input, &upload.UploadID)
+		return database.S3MultipartUpload{}, nil, nil
+	}
+
+	completed := make([]types.CompletedPart, (size+upload.PartSize-1)/upload.PartSize)
+	for _, part := range upload.Parts {
+		if part.PartNumber < 1 || part.PartNumber > len(completed) {
+			continue
+		}
+		offset := int64(part.PartNumber-1) * upload.PartSize
+		hash := crc32.NewIEEE()
+		if _, err := cfg.buffers.copy(hash, io.NewSectionReader(file, offset, min(upload.PartSize, size-offset))); err != nil {
+			return database.S3MultipartUpload{}, nil, err
+		}
+		if base64.StdEncoding.EncodeToString(hash.Sum(nil)) != part.ChecksumCRC32 {
+			continue
+		}
+		partNumber := int32(part.PartNumber)
+		completed[part.PartNumber-1] = types.CompletedPart{
+			PartNumber:    &partNumber,
+			ETag:          aws.String(part.ETag),
+			ChecksumCRC32: aws.String(part.ChecksumCRC32),
+		}
+	}
+	return upload, completed, nil
+}
+
+// abortMultipartUpload discards the parts of a failed upload. It uses its
+// own context, since the upload's is usually the one that was cancelled;
+// anything it misses is reclaimed by abortStaleMultipartUploads.
+func (cfg *apiConfig) abortMultipartUpload(input *s3.PutObjectInput, uploadID *string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := cfg.s3Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   input.Bucket,
+		Key:      input.Key,
+		UploadId: uploadID,
+	})
+	if err != nil {
+		log.Printf("Couldn't abort multipart upload of %s: %v", *input.Key, err)
+	}
+	if err := cfg.db.DeleteS3MultipartUpload(*uploadID); err != nil {
+		log.Printf("Couldn't forget multipart upload of %s: %v", *input.Key, err)
+	}
+}
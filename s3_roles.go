@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	ststypes "github.com/aws/aws-sdk-go-v2/service/sts/types"
+	"github.com/google/uuid"
+)
+
+// userS3ClientLimit bounds how many users' S3 clients are kept at once;
+// past it they're all dropped and made again as needed.
+const userS3ClientLimit = 1000
+
+// userS3Clients hands out S3 clients that act as a single user, through a
+// session of a role assumed for them. Each session is tagged with the
+// user's ID, named after it, and limited by a session policy to objects
+// whose key has the ID as its second segment, which is where descriptive
+// key naming puts it. CloudTrail then attributes every write to the user,
+// and the bucket policy can hold each tenant to their own prefix with the
+// aws:PrincipalTag/user_id condition key.
+type userS3Clients struct {
+	sts     *sts.Client
+	roleARN string
+	bucket  string
+	// base supplies everything but the credentials, so user clients use
+	// the same endpoint and HTTP settings as the service's own
+	base func() *s3.Client
+
+	mu      sync.Mutex
+	clients map[uuid.UUID]*s3.Client
+}
+
+func newUserS3Clients(awsConfig aws.Config, roleARN, bucket string, base func() *s3.Client) *userS3Clients {
+	return &userS3Clients{
+		sts:     sts.NewFromConfig(awsConfig),
+		roleARN: roleARN,
+		bucket:  bucket,
+		base:    base,
+		clients: map[uuid.UUID]*s3.Client{},
+	}
+}
+
+func (u *userS3Clients) client(userID uuid.UUID) *s3.Client {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if client, ok := u.clients[userID]; ok {
+		return client
+	}
+	if len(u.clients) >= userS3ClientLimit {
+		clear(u.clients)
+	}
+
+	policy := u.sessionPolicy(userID)
+	provider := stscreds.NewAssumeRoleProvider(u.sts, u.roleARN, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = "tubely-" + userID.String()
+		o.Duration = 15 * time.Minute
+		o.Policy = &policy
+		o.Tags = []ststypes.Tag{{Key: aws.String("user_id"), Value: aws.String(userID.String())}}
+	})
+	options := u.base().Options()
+	options.Credentials = aws.NewCredentialsCache(provider)
+	client := s3.New(options)
+	u.clients[userID] = client
+	return client
+}
+
+// sessionPolicy narrows the role to writing the user's own objects, even
+// if its permissions policy covers the whole bucket.
+func (u *userS3Clients) sessionPolicy(userID uuid.UUID) string {
+	policy, _ := json.Marshal(map[string]any{
+		"Version": "2012-10-17",
+		"Statement": []map[string]any{{
+			"Effect":   "Allow",
+			"Action":   "s3:PutObject",
+			"Resource": "arn:aws:s3:::" + u.bucket + "/*/" + userID.String() + "/*",
+		}},
+	})
+	return string(policy)
+}
+
+type s3PrincipalKey struct{}
+
+// withS3Principal marks S3 writes made with ctx as done on behalf of the
+// user.
+func withS3Principal(ctx context.Context, userID uuid.UUID) context.Context {
+	return context.WithValue(ctx, s3PrincipalKey{}, userID)
+}
+
+func s3PrincipalFrom(ctx context.Context) uuid.UUID {
+	userID, _ := ctx.Value(s3PrincipalKey{}).(uuid.UUID)
+	return userID
+}
+
+// s3For returns the client to write with under ctx: the acting user's when
+// per-user roles are configured and ctx names one, the service's otherwise.
+func (cfg *apiConfig) s3For(ctx context.Context) *s3.Client {
+	if cfg.userS3 == nil {
+		return cfg.s3Client
+	}
+	if userID := s3PrincipalFrom(ctx); userID != uuid.Nil {
+		return cfg.userS3.client(userID)
+	}
+	return cfg.s3Client
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// s3HTTPTuning adjusts the HTTP client the AWS SDK uses. There's
+// deliberately no overall request timeout, because it would also cut off
+// the long object bodies the stream proxy relays.
+type s3HTTPTuning struct {
+	connectTimeout        time.Duration
+	responseHeaderTimeout time.Duration
+	maxIdleConnsPerHost   int
+}
+
+// s3TransportWriteBufferSize sizes the per-connection buffer request bodies
+// are copied through on their way to S3. The transport's 4 KB default means
+// one small write syscall after another while uploading video parts.
+const s3TransportWriteBufferSize = 256 << 10 // 256 KB
+
+func newS3HTTPClient(tuning s3HTTPTuning) *awshttp.BuildableClient {
+	return awshttp.NewBuildableClient().
+		WithDialerOptions(func(d *net.Dialer) {
+			if tuning.connectTimeout > 0 {
+				d.Timeout = tuning.connectTimeout
+			}
+		}).
+		WithTransportOptions(func(t *http.Transport) {
+			t.WriteBufferSize = s3TransportWriteBufferSize
+			if tuning.responseHeaderTimeout > 0 {
+				t.ResponseHeaderTimeout = tuning.responseHeaderTimeout
+			}
+			if tuning.maxIdleConnsPerHost > 0 {
+				t.MaxIdleConnsPerHost = tuning.maxIdleConnsPerHost
+				t.MaxIdleConns = max(t.MaxIdleConns, tuning.maxIdleConnsPerHost)
+			}
+		})
+}
+
+// s3Endpoint is one way of reaching the bucket.
+type s3Endpoint struct {
+	name  string
+	apply func(*s3.Options)
+}
+
+var (
+	s3EndpointStandard   = s3Endpoint{name: "standard", apply: func(*s3.Options) {}}
+	s3EndpointAccelerate = s3Endpoint{name: "accelerate", apply: func(o *s3.Options) { o.UseAccelerate = true }}
+	s3EndpointDualStack  = s3Endpoint{name: "dualstack", apply: func(o *s3.Options) {
+		o.EndpointOptions.UseDualStackEndpoint = aws.DualStackEndpointStateEnabled
+	}}
+)
+
+// s3EndpointLatency is the median round trip to one endpoint, or the error
+// that made it unusable.
+type s3EndpointLatency struct {
+	endpoint s3Endpoint
+	median   time.Duration
+	err      error
+}
+
+const s3BenchmarkSamples = 5
+
+// benchmarkS3Endpoints times a HeadObject on a missing key against each
+// candidate endpoint and returns the results fastest first, unusable ones
+// last. A 404 is a successful round trip; it only measures latency.
+func benchmarkS3Endpoints(ctx context.Context, awsConfig aws.Config, bucket string, candidates []s3Endpoint) []s3EndpointLatency {
+	probeKey := "tubely-endpoint-benchmark"
+	results := make([]s3EndpointLatency, 0, len(candidates))
+
+	for _, endpoint := range candidates {
+		client := s3.NewFromConfig(awsConfig, endpoint.apply)
+		probe := func() (time.Duration, error) {
+			start := time.Now()
+			_, err := client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &bucket, Key: &probeKey})
+			var notFound *types.NotFound
+			if err != nil && !errors.As(err, &notFound) {
+				return 0, err
+			}
+			return time.Since(start), nil
+		}
+
+		// The first request pays for DNS and the TLS handshake
+		if _, err := probe(); err != nil {
+			results = append(results, s3EndpointLatency{endpoint: endpoint, err: err})
+			continue
+		}
+		samples := make([]time.Duration, 0, s3BenchmarkSamples)
+		var sampleErr error
+		for range s3BenchmarkSamples {
+			d, err := probe()
+			if err != nil {
+				sampleErr = err
+				break
+			}
+			samples = append(samples, d)
+		}
+		if sampleErr != nil {
+			results = append(results, s3EndpointLatency{endpoint: endpoint, err: sampleErr})
+			continue
+		}
+		slices.Sort(samples)
+		results = append(results, s3EndpointLatency{endpoint: endpoint, median: samples[len(samples)/2]})
+	}
+
+	slices.SortStableFunc(results, func(a, b s3EndpointLatency) int {
+		switch {
+		case (a.err == nil) != (b.err == nil):
+			if a.err == nil {
+				return -1
+			}
+			return 1
+		case a.median < b.median:
+			return -1
+		case a.median > b.median:
+			return 1
+		}
+		return 0
+	})
+	return results
+}
+
+// chooseS3Endpoint benchmarks the candidate endpoints, logs and records the
+// results, and returns the fastest usable one, falling back to the standard
+// endpoint if none answered.
+func (cfg *apiConfig) chooseS3Endpoint(ctx context.Context, awsConfig aws.Config, candidates []s3Endpoint) s3Endpoint {
+	results := benchmarkS3Endpoints(ctx, awsConfig, cfg.s3Bucket, candidates)
+	for _, result := range results {
+		if result.err != nil {
+			log.Printf("S3 endpoint %s unusable: %v", result.endpoint.name, result.err)
+			continue
+		}
+		log.Printf("S3 endpoint %s: median round trip %s", result.endpoint.name, result.median)
+		cfg.metrics.set(fmt.Sprintf("tubely_s3_endpoint_latency_seconds{endpoint=%q}", result.endpoint.name), result.median.Seconds())
+	}
+	if len(results) == 0 || results[0].err != nil {
+		return s3EndpointStandard
+	}
+	return results[0].endpoint
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// sandboxExecArg is the first argument of the app re-executing itself to
+// set resource limits before it becomes ffmpeg or ffprobe. Go can't set
+// limits for just one child process, so the child sets its own.
+const sandboxExecArg = "-media-sandbox-exec"
+
+// mediaSandbox confines the ffmpeg and ffprobe processes the app spawns.
+// They parse whatever users upload, so a crafted file that exploits a
+// decoder bug should find itself with little to take and nowhere to send
+// it. The zero value runs them unconfined.
+type mediaSandbox struct {
+	// wrapper is a command the tools run under, like bwrap or nsjail with
+	// a seccomp policy
+	wrapper []string
+	limits  mediaLimits
+	// noNetwork runs the tools in a network namespace of their own, with
+	// no interfaces up
+	noNetwork bool
+	// uid and gid, when set, are the user and group the tools run as,
+	// which needs the app to run as root
+	uid, gid *uint32
+	// self is the app's own binary, re-executed to apply limits
+	self string
+}
+
+// mediaLimits are resource limits in the units of setrlimit. Zero is no
+// limit.
+type mediaLimits struct {
+	cpuSeconds  uint64
+	memoryBytes uint64
+	fileBytes   uint64
+}
+
+func (l mediaLimits) any() bool {
+	return l.cpuSeconds > 0 || l.memoryBytes > 0 || l.fileBytes > 0
+}
+
+func (l mediaLimits) String() string {
+	return fmt.Sprintf("cpu=%d,as=%d,fsize=%d", l.cpuSeconds, l.memoryBytes, l.fileBytes)
+}
+
+func parseMediaLimits(spec string) (mediaLimits, error) {
+	var limits mediaLimits
+	for _, field := range strings.Split(spec, ",") {
+		name, value, _ := strings.Cut(field, "=")
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return mediaLimits{}, fmt.Errorf("invalid limit %q", field)
+		}
+		switch name {
+		case "cpu":
+			limits.cpuSeconds = n
+		case "as":
+			limits.memoryBytes = n
+		case "fsize":
+			limits.fileBytes = n
+		default:
+			return mediaLimits{}, fmt.Errorf("unknown limit %q", name)
+		}
+	}
+	return limits, nil
+}
+
+// sandbox is package-level since the tools are started from free functions
+// throughout the pipeline, and from the media package's prober.
+var sandbox mediaSandbox
+
+// mediaCmd is a command running ffmpeg or ffprobe, however it's wrapped.
+type mediaCmd struct {
+	*exec.Cmd
+	// tool is the confined binary, for the process usage metrics
+	tool string
+}
+
+// mediaCommand returns a command that runs ffmpeg or ffprobe on local
+// files, confined by the sandbox.
+func mediaCommand(tool string, args ...string) *mediaCmd {
+	return sandbox.command(sandbox.limits, sandbox.noNetwork, sandbox.wrapper, tool, args)
+}
+
+// remoteMediaCommand is mediaCommand for tools that read their input
+// straight from the bucket through a presigned URL, and so keep the
+// network.
+func remoteMediaCommand(tool string, args ...string) *mediaCmd {
+	return sandbox.command(sandbox.limits, false, sandbox.wrapper, tool, args)
+}
+
+// liveMediaCommand is mediaCommand for live ingest. ffmpeg has to listen
+// for the broadcaster there, and runs as long as the broadcast does, so it
+// keeps the network, has no CPU limit, and skips the wrapper, whose policy
+// is meant for files.
+func liveMediaCommand(tool string, args ...string) *mediaCmd {
+	limits := sandbox.limits
+	limits.cpuSeconds = 0
+	return sandbox.command(limits, false, nil, tool, args)
+}
+
+func (s mediaSandbox) command(limits mediaLimits, noNetwork bool, wrapper []string, tool string, args []string) *mediaCmd {
+	argv := append([]string{}, wrapper...)
+	argv = append(argv, tool)
+	argv = append(argv, args...)
+	if limits.any() {
+		argv = append([]string{s.self, sandboxExecArg, limits.String(), "--"}, argv...)
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	s.confine(cmd, noNetwork)
+	return &mediaCmd{Cmd: cmd, tool: tool}
+}
+
+// configured reports whether anything confines the tools.
+func (s mediaSandbox) configured() bool {
+	return len(s.wrapper) > 0 || s.limits.any() || s.noNetwork || s.uid != nil
+}
+
+// check runs ffprobe, or ffmpeg, through the sandbox once, so a sandbox
+// that can't work on this host stops the app at startup rather than
+// failing every upload.
+func (s mediaSandbox) check() error {
+	for _, tool := range []string{"ffprobe", "ffmpeg"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			continue
+		}
+		out, err := s.command(s.limits, s.noNetwork, s.wrapper, tool, []string{"-version"}).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s doesn't run in the sandbox: %w: %s", tool, err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	return nil
+}
+
+// parseMediaSandbox reads the sandbox settings from the environment.
+func parseMediaSandbox() (mediaSandbox, error) {
+	var s mediaSandbox
+	s.wrapper = strings.Fields(os.Getenv("MEDIA_SANDBOX_WRAPPER"))
+
+	for _, limit := range []struct {
+		env  string
+		dest *uint64
+	}{
+		{"MEDIA_SANDBOX_CPU_SECONDS", &s.limits.cpuSeconds},
+		{"MEDIA_SANDBOX_MEMORY_BYTES", &s.limits.memoryBytes},
+		{"MEDIA_SANDBOX_FILE_BYTES", &s.limits.fileBytes},
+	} {
+		if v := os.Getenv(limit.env); v != "" {
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return mediaSandbox{}, fmt.Errorf("%s must be a non-negative integer", limit.env)
+			}
+			*limit.dest = n
+		}
+	}
+
+	switch network := os.Getenv("MEDIA_SANDBOX_NETWORK"); network {
+	case "", "host":
+	case "none":
+		s.noNetwork = true
+	default:
+		return mediaSandbox{}, errors.New("MEDIA_SANDBOX_NETWORK must be host or none")
+	}
+
+	if v := os.Getenv("MEDIA_SANDBOX_USER"); v != "" {
+		uidString, gidString, ok := strings.Cut(v, ":")
+		uid, uidErr := strconv.ParseUint(uidString, 10, 32)
+		gid, gidErr := strconv.ParseUint(gidString, 10, 32)
+		if !ok || uidErr != nil || gidErr != nil {
+			return mediaSandbox{}, errors.New("MEDIA_SANDBOX_USER must be uid:gid, like 65534:65534")
+		}
+		uid32, gid32 := uint32(uid), uint32(gid)
+		s.uid, s.gid = &uid32, &gid32
+	}
+
+	if err := s.supported(); err != nil {
+		return mediaSandbox{}, err
+	}
+	if s.limits.any() {
+		self, err := os.Executable()
+		if err != nil {
+			return mediaSandbox{}, fmt.Errorf("couldn't find the app's binary to apply limits with: %w", err)
+		}
+		s.self = self
+	}
+	return s, nil
+}
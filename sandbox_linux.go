@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+func (s mediaSandbox) supported() error {
+	return nil
+}
+
+// confine puts the command in its own network namespace and drops it to
+// the sandbox user, as configured. Without root, the network namespace
+// comes inside a user namespace that maps the app's own user.
+func (s mediaSandbox) confine(cmd *exec.Cmd, noNetwork bool) {
+	if !noNetwork && s.uid == nil {
+		return
+	}
+	attr := &syscall.SysProcAttr{}
+	if noNetwork {
+		attr.Cloneflags = syscall.CLONE_NEWNET
+		if os.Geteuid() != 0 {
+			attr.Cloneflags |= syscall.CLONE_NEWUSER
+			attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Geteuid(), HostID: os.Geteuid(), Size: 1}}
+			attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getegid(), HostID: os.Getegid(), Size: 1}}
+		}
+	}
+	if s.uid != nil {
+		attr.Credential = &syscall.Credential{Uid: *s.uid, Gid: *s.gid}
+	}
+	cmd.SysProcAttr = attr
+}
+
+// runSandboxExec is the re-executed app: it sets the limits it was given
+// on itself and then becomes the command, which inherits them. It never
+// returns.
+func runSandboxExec(args []string) {
+	if len(args) < 3 || args[1] != "--" {
+		log.Fatalf("%s: want limits -- command", sandboxExecArg)
+	}
+	limits, err := parseMediaLimits(args[0])
+	if err != nil {
+		log.Fatalf("%s: %v", sandboxExecArg, err)
+	}
+	for _, limit := range []struct {
+		resource int
+		value    uint64
+	}{
+		{syscall.RLIMIT_CPU, limits.cpuSeconds},
+		{syscall.RLIMIT_AS, limits.memoryBytes},
+		{syscall.RLIMIT_FSIZE, limits.fileBytes},
+	} {
+		if limit.value == 0 {
+			continue
+		}
+		rlimit := syscall.Rlimit{Cur: limit.value, Max: limit.value}
+		if err := syscall.Setrlimit(limit.resource, &rlimit); err != nil {
+			log.Fatalf("%s: couldn't set limit %d: %v", sandboxExecArg, limit.resource, err)
+		}
+	}
+
+	command := args[2:]
+	path, err := exec.LookPath(command[0])
+	if err != nil {
+		log.Fatalf("%s: %v", sandboxExecArg, err)
+	}
+	err = syscall.Exec(path, command, os.Environ())
+	log.Fatal(fmt.Errorf("%s: couldn't run %s: %w", sandboxExecArg, path, err))
+}
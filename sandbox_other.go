@@ -0,0 +1,24 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"log"
+	"os/exec"
+)
+
+// supported refuses what needs Linux: setting limits, namespaces and
+// switching users. A wrapper works anywhere.
+func (s mediaSandbox) supported() error {
+	if s.limits.any() || s.noNetwork || s.uid != nil {
+		return errors.New("media sandbox limits, MEDIA_SANDBOX_NETWORK and MEDIA_SANDBOX_USER need Linux; use MEDIA_SANDBOX_WRAPPER")
+	}
+	return nil
+}
+
+func (s mediaSandbox) confine(cmd *exec.Cmd, noNetwork bool) {}
+
+func runSandboxExec(args []string) {
+	log.Fatalf("%s needs Linux", sandboxExecArg)
+}
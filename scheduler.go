@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// startPeriodicTask runs fn every interval until ctx is cancelled. A failed
+// run is logged and counted but doesn't stop later runs.
+func (cfg *apiConfig) startPeriodicTask(ctx context.Context, name string, interval time.Duration, fn func(context.Context) error) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			start := time.Now()
+			err := fn(ctx)
+			cfg.metrics.set("tubely_task_last_run_seconds{task=\""+name+"\"}", time.Since(start).Seconds())
+			if err != nil {
+				cfg.metrics.add("tubely_task_failures_total{task=\""+name+"\"}", 1)
+				log.Printf("Periodic task %s failed: %v", name, err)
+			}
+		}
+	}()
+}
+
+// startLeaderTask is startPeriodicTask for work that must happen once per
+// interval across the whole deployment rather than on every instance. Each
+// run first takes the task's lease in the database; the instance holding it
+// keeps renewing it, and the others skip their runs until it stops doing so
+// for half an interval, for example because it went away.
+func (cfg *apiConfig) startLeaderTask(ctx context.Context, name string, interval time.Duration, fn func(context.Context) error) {
+	leaseName := "task:" + name
+	leaseTTL := interval + interval/2
+	cfg.startPeriodicTask(ctx, name, interval, func(ctx context.Context) error {
+		leader, err := cfg.db.AcquireTaskLease(leaseName, cfg.instanceID, leaseTTL)
+		if err != nil {
+			return fmt.Errorf("couldn't acquire task lease: %w", err)
+		}
+		if !leader {
+			cfg.metrics.set("tubely_task_leader{task=\""+name+"\"}", 0)
+			return nil
+		}
+		cfg.metrics.set("tubely_task_leader{task=\""+name+"\"}", 1)
+		return fn(ctx)
+	})
+}
+
+// newInstanceID names this process in leases and job claims. The random
+// suffix keeps a restarted container that reuses its hostname and PID from
+// being mistaken for its predecessor.
+func newInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "tubely"
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s:%d:%s", hostname, os.Getpid(), hex.EncodeToString(suffix))
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/google/uuid"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+)
+
+// secretLoader reads settings that may be kept in AWS instead of the
+// environment. A variable set to "secretsmanager:<secret-id>" is read from
+// Secrets Manager, with "#<key>" picking one field of a JSON secret, and
+// one set to "ssm:<parameter-name>" from SSM Parameter Store, decrypted.
+// Anything else is used as is.
+type secretLoader struct {
+	httpClient  *http.Client
+	credentials aws.CredentialsProvider
+	region      string
+}
+
+// isSecretRef reports whether value points at AWS rather than being the
+// secret itself, so it's worth reading again to pick up rotations.
+func isSecretRef(value string) bool {
+	return strings.HasPrefix(value, "secretsmanager:") || strings.HasPrefix(value, "ssm:")
+}
+
+// load returns the value of the environment variable name, fetched from
+// AWS if it refers there.
+func (l secretLoader) load(ctx context.Context, name string) (string, error) {
+	value := os.Getenv(name)
+	switch {
+	case strings.HasPrefix(value, "secretsmanager:"):
+		id, key, _ := strings.Cut(strings.TrimPrefix(value, "secretsmanager:"), "#")
+		secret, err := l.getSecretValue(ctx, id)
+		if err != nil || key == "" {
+			return secret, err
+		}
+		var fields map[string]any
+		if err := json.Unmarshal([]byte(secret), &fields); err != nil {
+			return "", fmt.Errorf("secret %s isn't a JSON object: %w", id, err)
+		}
+		field, ok := fields[key].(string)
+		if !ok {
+			return "", fmt.Errorf("secret %s has no string field %q", id, key)
+		}
+		return field, nil
+	case strings.HasPrefix(value, "ssm:"):
+		return l.getParameter(ctx, strings.TrimPrefix(value, "ssm:"))
+	default:
+		return value, nil
+	}
+}
+
+func (l secretLoader) getSecretValue(ctx context.Context, id string) (string, error) {
+	var out struct {
+		SecretString *string `json:"SecretString"`
+	}
+	err := l.call(ctx, "secretsmanager", "AWS_ENDPOINT_URL_SECRETS_MANAGER", "secretsmanager.GetSecretValue",
+		map[string]any{"SecretId": id}, &out)
+	if err != nil {
+		return "", fmt.Errorf("couldn't read secret %s: %w", id, err)
+	}
+	if out.SecretString == nil {
+		return "", fmt.Errorf("secret %s is binary, not a string", id)
+	}
+	return *out.SecretString, nil
+}
+
+func (l secretLoader) getParameter(ctx context.Context, name string) (string, error) {
+	var out struct {
+		Parameter struct {
+			Value string `json:"Value"`
+		} `json:"Parameter"`
+	}
+	err := l.call(ctx, "ssm", "AWS_ENDPOINT_URL_SSM", "AmazonSSM.GetParameter",
+		map[string]any{"Name": name, "WithDecryption": true}, &out)
+	if err != nil {
+		return "", fmt.Errorf("couldn't read parameter %s: %w", name, err)
+	}
+	return out.Parameter.Value, nil
+}
+
+// call makes a signed request to an AWS JSON API. Both services are only a
+// single call each here, which doesn't justify two more SDK modules.
+func (l secretLoader) call(ctx context.Context, service, endpointEnv, target string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	endpoint := os.Getenv(endpointEnv)
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.%s.amazonaws.com", service, l.region)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(endpoint, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", target)
+
+	creds, err := l.credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get AWS credentials: %w", err)
+	}
+	payloadHash := sha256.Sum256(body)
+	if err := v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(payloadHash[:]), service, l.region, time.Now()); err != nil {
+		return fmt.Errorf("could not sign request: %w", err)
+	}
+
+	resp, err := l.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s returned %s: %s", service, resp.Status, detail)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// rotatingSecret holds a secret that can be replaced while the server runs.
+// The value it replaced is kept, so what was signed with it just before a
+// rotation can still be checked.
+type rotatingSecret struct {
+	mu       sync.RWMutex
+	current  string
+	previous string
+}
+
+func newRotatingSecret(value string) *rotatingSecret {
+	return &rotatingSecret{current: value}
+}
+
+func (s *rotatingSecret) get() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.current
+}
+
+// candidates returns the current value, then the previous one if any.
+func (s *rotatingSecret) candidates() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.previous == "" {
+		return []string{s.current}
+	}
+	return []string{s.current, s.previous}
+}
+
+// set replaces the value, reporting whether it changed.
+func (s *rotatingSecret) set(value string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if value == s.current {
+		return false
+	}
+	s.previous, s.current = s.current, value
+	return true
+}
+
+// refreshSecrets reads the secrets that live in AWS again, so rotating
+// them there reaches running servers without a restart.
+func (cfg *apiConfig) refreshSecrets(ctx context.Context, loader secretLoader, secrets map[string]*rotatingSecret) error {
+	for name, secret := range secrets {
+		value, err := loader.load(ctx, name)
+		if err != nil {
+			return err
+		}
+		if value == "" {
+			return fmt.Errorf("%s came back empty", name)
+		}
+		if secret.set(value) {
+			cfg.metrics.add("tubely_secret_rotations_total", 1)
+			log.Printf("Picked up a new value of %s", name)
+		}
+	}
+	return nil
+}
+
+// validateJWT checks an access token against the JWT secret, and the one it
+// was rotated from so sessions survive the rotation. Tokens of disabled or
+// deleted accounts are refused, so either ends their sessions at once.
+func (cfg *apiConfig) validateJWT(token string) (uuid.UUID, error) {
+	var err error
+	for _, secret := range cfg.jwtSecret.candidates() {
+		var userID uuid.UUID
+		userID, err = auth.ValidateJWT(token, secret)
+		if err != nil {
+			continue
+		}
+		disabled, err := cfg.db.IsUserDisabled(userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			// A replica may not have caught up with a brand new account
+			disabled, err = cfg.db.Primary().IsUserDisabled(userID)
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			return uuid.Nil, errUserDeleted
+		}
+		if err != nil {
+			return uuid.Nil, err
+		}
+		if disabled {
+			return uuid.Nil, errUserDisabled
+		}
+		return userID, nil
+	}
+	return uuid.Nil, err
+}
+
+// signWebhook adds an X-Tubely-Signature header to an outgoing webhook
+// request: "t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">".
+// Receivers should check v1 with the signing secret and reject stale times.
+func signWebhook(req *http.Request, body []byte, secret *rotatingSecret) {
+	if secret == nil {
+		return
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret.get()))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	req.Header.Set("X-Tubely-Signature", "t="+timestamp+",v1="+hex.EncodeToString(mac.Sum(nil)))
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// seedPassword is shared by every demo account so it can be printed next to
+// them. Seeding is refused outside dev, so it never guards anything real.
+const seedPassword = "tubely-demo"
+
+type seedVideo struct {
+	title       string
+	description string
+	// Passed to ffmpeg's testsrc2 source; portrait sizes exercise the
+	// aspect-ratio prefixes
+	size  string
+	color color.RGBA
+}
+
+type seedUser struct {
+	email  string
+	videos []seedVideo
+}
+
+var demoSeed = []seedUser{
+	{
+		email: "ada@demo.tubely",
+		videos: []seedVideo{
+			{title: "Boots learns to fly", description: "A very short landscape test card.", size: "640x360", color: color.RGBA{0x2b, 0x6c, 0xb0, 0xff}},
+			{title: "Why bears love S3", description: "Portrait clip for checking vertical layouts.", size: "360x640", color: color.RGBA{0xc0, 0x39, 0x2b, 0xff}},
+		},
+	},
+	{
+		email: "grace@demo.tubely",
+		videos: []seedVideo{
+			{title: "CloudFront in 3 seconds", description: "Square-ish clip that lands under other/.", size: "480x480", color: color.RGBA{0x27, 0xae, 0x60, 0xff}},
+		},
+	},
+}
+
+type seedReport struct {
+	Password string      `json:"password"`
+	Users    []string    `json:"users"`
+	Videos   []uuid.UUID `json:"videos"`
+	// Accounts that already existed are left alone, videos and all
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+func (cfg *apiConfig) handlerSeed(w http.ResponseWriter, r *http.Request) {
+	if cfg.platform != "dev" {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Seeding is only allowed in dev environment."))
+		return
+	}
+
+	report, err := cfg.seedDemoData(r.Context())
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't seed demo data", err)
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, report)
+}
+
+// seedDemoData creates the demo accounts and pushes a generated clip and
+// thumbnail for each of their videos through the same code uploads use.
+// Running it again only fills in accounts that don't exist yet.
+func (cfg *apiConfig) seedDemoData(ctx context.Context) (seedReport, error) {
+	report := seedReport{Password: seedPassword}
+
+	// Checked up front so a missing ffmpeg doesn't leave a half-seeded
+	// account behind that later runs would skip
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return report, fmt.Errorf("seeding renders its sample clips with ffmpeg: %w", err)
+	}
+
+	hashedPassword, err := cfg.passwords.Hash(seedPassword)
+	if err != nil {
+		return report, err
+	}
+
+	for _, demo := range demoSeed {
+		existing, err := cfg.db.GetUserByEmail(demo.email)
+		if err != nil {
+			return report, err
+		}
+		if existing.ID != uuid.Nil {
+			report.Skipped = append(report.Skipped, demo.email)
+			continue
+		}
+
+		user, err := cfg.db.CreateUser(database.CreateUserParams{
+			Email:    demo.email,
+			Password: hashedPassword,
+		})
+		if err != nil {
+			return report, fmt.Errorf("could not create %s: %w", demo.email, err)
+		}
+		report.Users = append(report.Users, demo.email)
+
+		for _, sv := range demo.videos {
+			video, err := cfg.seedOneVideo(ctx, user.ID, sv)
+			if err != nil {
+				return report, fmt.Errorf("could not seed %q: %w", sv.title, err)
+			}
+			report.Videos = append(report.Videos, video.ID)
+		}
+	}
+	return report, nil
+}
+
+func (cfg *apiConfig) seedOneVideo(ctx context.Context, userID uuid.UUID, sv seedVideo) (database.Video, error) {
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{
+		Title:       sv.title,
+		Description: sv.description,
+		UserID:      userID,
+	})
+	if err != nil {
+		return database.Video{}, err
+	}
+
+	thumbnail, err := seedThumbnail(sv.color)
+	if err != nil {
+		return database.Video{}, err
+	}
+	thumbnailURL, err := cfg.storeThumbnail(ctx, bytes.NewReader(thumbnail), ".png")
+	if err != nil {
+		return database.Video{}, err
+	}
+	video.ThumbnailURL = &thumbnailURL
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		return database.Video{}, err
+	}
+
+	clipPath, err := generateSeedClip(sv.size)
+	if err != nil {
+		return database.Video{}, err
+	}
+	defer os.Remove(clipPath)
+
+	release, err := cfg.processing.acquire(ctx, userID, priorityBackground)
+	if err != nil {
+		return database.Video{}, err
+	}
+	defer release()
+	return cfg.processVideoUpload(ctx, video, userID, clipPath, "", database.UploadOptions{})
+}
+
+// generateSeedClip renders a three-second test card with a tone into a temp
+// MP4, so the repo doesn't have to carry binary fixtures.
+func generateSeedClip(size string) (string, error) {
+	clipFile, err := os.CreateTemp("", "tubely-seed-*.mp4")
+	if err != nil {
+		return "", err
+	}
+	clipFile.Close()
+
+	cmd := mediaCommand("ffmpeg",
+		"-y",
+		"-f", "lavfi", "-i", "testsrc2=size="+size+":rate=24:duration=3",
+		"-f", "lavfi", "-i", "sine=frequency=440:duration=3",
+		"-c:v", "libx264",
+		"-pix_fmt", "yuv420p",
+		"-c:a", "aac",
+		"-shortest",
+		"-f", "mp4",
+		clipFile.Name(),
+	)
+	err = cmd.Run()
+	recordCommand("seed", cmd)
+	if err != nil {
+		os.Remove(clipFile.Name())
+		return "", fmt.Errorf("could not run ffmpeg: %w", err)
+	}
+	return clipFile.Name(), nil
+}
+
+// seedThumbnail draws a 16:9 PNG fading from c to black.
+func seedThumbnail(c color.RGBA) ([]byte, error) {
+	const width, height = 320, 180
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		shade := uint32(height - y)
+		row := color.RGBA{
+			R: uint8(uint32(c.R) * shade / height),
+			G: uint8(uint32(c.G) * shade / height),
+			B: uint8(uint32(c.B) * shade / height),
+			A: 0xff,
+		}
+		for x := range width {
+			img.SetRGBA(x, y, row)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// runSeedCommand backs the -seed flag: it seeds the database and exits
+// without starting the server.
+func (cfg *apiConfig) runSeedCommand() {
+	if cfg.platform != "dev" {
+		log.Fatal("-seed is only allowed with PLATFORM=dev")
+	}
+	report, err := cfg.seedDemoData(context.Background())
+	if err != nil {
+		log.Fatalf("Couldn't seed demo data: %v", err)
+	}
+	for _, email := range report.Users {
+		log.Printf("Created %s with password %q", email, report.Password)
+	}
+	for _, email := range report.Skipped {
+		log.Printf("Skipped %s, which already exists", email)
+	}
+	log.Printf("Seeded %d videos", len(report.Videos))
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+var errNoVideoStream = errors.New("file has no video stream")
+
+type streamInfo struct {
+	videoCodec string
+	width      int
+	height     int
+	audioCodec string // empty when the file has no audio stream
+	duration   float64
+	// audioLanguages are the languages of every audio stream
+	audioLanguages []string
+}
+
+// probeStreamInfo reads the codecs and dimensions of the first video and
+// audio streams in a file.
+func (cfg *apiConfig) probeStreamInfo(filePath string) (streamInfo, error) {
+	probed, err := cfg.prober.Probe(filePath)
+	if err != nil {
+		return streamInfo{}, err
+	}
+	if probed.VideoCodec == "" {
+		return streamInfo{}, fmt.Errorf("%s: %w", filePath, errNoVideoStream)
+	}
+	return streamInfo{
+		videoCodec:     probed.VideoCodec,
+		width:          probed.Width,
+		height:         probed.Height,
+		audioCodec:     probed.AudioCodec,
+		duration:       probed.Duration,
+		audioLanguages: probed.AudioLanguages,
+	}, nil
+}
+
+// stitchVideo concatenates the intro, the main video and the outro into a new
+// file. Either clip may be empty. Inputs that share codecs and dimensions are
+// joined without re-encoding; otherwise everything is scaled to the main
+// video's frame size and re-encoded.
+func (cfg *apiConfig) stitchVideo(mainPath, introPath, outroPath string) (string, error) {
+	var paths []string
+	if introPath != "" {
+		paths = append(paths, introPath)
+	}
+	paths = append(paths, mainPath)
+	if outroPath != "" {
+		paths = append(paths, outroPath)
+	}
+	if len(paths) == 1 {
+		return mainPath, nil
+	}
+
+	infos := make([]streamInfo, len(paths))
+	var mainInfo streamInfo
+	for i, path := range paths {
+		info, err := cfg.probeStreamInfo(path)
+		if err != nil {
+			return "", err
+		}
+		infos[i] = info
+		if path == mainPath {
+			mainInfo = info
+		}
+	}
+
+	stitchedFilePath := mainPath + ".stitched"
+	if streamsCompatible(infos) {
+		return stitchedFilePath, concatCopy(paths, stitchedFilePath)
+	}
+	return stitchedFilePath, concatReencode(paths, infos, mainInfo, stitchedFilePath)
+}
+
+func streamsCompatible(infos []streamInfo) bool {
+	for _, info := range infos[1:] {
+		if info.videoCodec != infos[0].videoCodec ||
+			info.width != infos[0].width ||
+			info.height != infos[0].height ||
+			info.audioCodec != infos[0].audioCodec {
+			return false
+		}
+	}
+	return true
+}
+
+// concatCopy joins the inputs with ffmpeg's concat demuxer, copying streams.
+func concatCopy(paths []string, outputPath string) error {
+	listFile, err := os.CreateTemp("", "tubely-concat-*.txt")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(listFile.Name())
+
+	for _, path := range paths {
+		escaped := strings.ReplaceAll(path, "'", `'\''`)
+		if _, err := fmt.Fprintf(listFile, "file '%s'\n", escaped); err != nil {
+			listFile.Close()
+			return err
+		}
+	}
+	if err := listFile.Close(); err != nil {
+		return err
+	}
+
+	return runFFmpeg("stitch",
+		"-f", "concat",
+		"-safe", "0",
+		"-i", listFile.Name(),
+		"-c", "copy",
+		"-f", "mp4",
+		outputPath,
+	)
+}
+
+// concatReencode joins the inputs with ffmpeg's concat filter, scaling and
+// padding each one to the main video's frame size. Inputs without audio get
+// a silent track when any other input has audio, since the filter needs the
+// same streams in every segment.
+func concatReencode(paths []string, infos []streamInfo, mainInfo streamInfo, outputPath string) error {
+	withAudio := false
+	for _, info := range infos {
+		if info.audioCodec != "" {
+			withAudio = true
+		}
+	}
+
+	var args []string
+	for _, path := range paths {
+		args = append(args, "-i", path)
+	}
+
+	var filter strings.Builder
+	nextInput := len(paths)
+	for i, info := range infos {
+		fmt.Fprintf(&filter,
+			"[%d:v]scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1[v%d];",
+			i, mainInfo.width, mainInfo.height, mainInfo.width, mainInfo.height, i,
+		)
+		if !withAudio {
+			continue
+		}
+		audioInput := fmt.Sprintf("%d:a", i)
+		if info.audioCodec == "" {
+			args = append(args,
+				"-f", "lavfi",
+				"-t", strconv.FormatFloat(info.duration, 'f', 3, 64),
+				"-i", "anullsrc=channel_layout=stereo:sample_rate=48000",
+			)
+			audioInput = fmt.Sprintf("%d:a", nextInput)
+			nextInput++
+		}
+		fmt.Fprintf(&filter, "[%s]aresample=48000,aformat=channel_layouts=stereo[a%d];", audioInput, i)
+	}
+	for i := range infos {
+		fmt.Fprintf(&filter, "[v%d]", i)
+		if withAudio {
+			fmt.Fprintf(&filter, "[a%d]", i)
+		}
+	}
+	audioStreams := 0
+	if withAudio {
+		audioStreams = 1
+	}
+	fmt.Fprintf(&filter, "concat=n=%d:v=1:a=%d[outv]", len(infos), audioStreams)
+	if withAudio {
+		filter.WriteString("[outa]")
+	}
+
+	args = append(args, "-filter_complex", filter.String(), "-map", "[outv]")
+	if withAudio {
+		args = append(args, "-map", "[outa]", "-c:a", "aac")
+	}
+	args = append(args, "-c:v", "libx264", "-f", "mp4", outputPath)
+
+	return runFFmpeg("stitch", args...)
+}
+
+var errInvalidStitchClip = errors.New("invalid intro/outro clip")
+
+// stitchClipKey resolves one side of the intro/outro pair to an S3 key. A
+// non-empty override from the upload form wins over the user's default, and
+// "none" disables the clip for this upload. An empty key means no clip.
+func (cfg *apiConfig) stitchClipKey(userID uuid.UUID, override string, defaultID *uuid.UUID) (string, error) {
+	clipID := defaultID
+	switch override {
+	case "":
+	case "none":
+		clipID = nil
+	default:
+		parsed, err := uuid.Parse(override)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", errInvalidStitchClip, err)
+		}
+		clipID = &parsed
+	}
+	if clipID == nil {
+		return "", nil
+	}
+
+	clip, err := cfg.db.GetVideo(*clipID)
+	if err != nil {
+		return "", err
+	}
+	if clip.ID == uuid.Nil && override == "" {
+		// The user's default clip was deleted since they picked it
+		return "", nil
+	}
+	if clip.UserID != userID {
+		return "", fmt.Errorf("%w: video %s not found", errInvalidStitchClip, clipID)
+	}
+	if clip.VideoURL == nil {
+		return "", fmt.Errorf("%w: video %s has no uploaded file", errInvalidStitchClip, clipID)
+	}
+	if clip.Encrypted {
+		return "", fmt.Errorf("%w: video %s is encrypted", errInvalidStitchClip, clipID)
+	}
+	return cfg.s3KeyFromURL(*clip.VideoURL)
+}
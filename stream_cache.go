@@ -0,0 +1,389 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// streamCacheBlockSize is the unit the stream cache fetches and keeps
+// objects in. A range request is served from the blocks it overlaps, so a
+// seek only fetches the blocks around the new position, and viewers of a
+// popular video share the blocks they've all watched.
+const streamCacheBlockSize = 4 << 20 // 4 MB
+
+var errRangeUnsatisfiable = errors.New("range starts past the end of the object")
+
+// streamCache keeps recently streamed blocks of video objects on disk, up
+// to maxBytes, evicting the least recently used. Blocks of encrypted videos
+// are sealed with the video's data key, so the cache doesn't undo
+// encryption at rest. The index lives in memory: the cache starts empty,
+// clearing blocks left by a previous run.
+type streamCache struct {
+	root     string
+	maxBytes int64
+	metrics  *metricsRegistry
+
+	mu      sync.Mutex
+	lru     *list.List // of *streamCacheBlock, most recently used first
+	blocks  map[string]*list.Element
+	objects map[string]*streamCacheObject
+	size    int64
+}
+
+type streamCacheBlock struct {
+	name     string
+	objectID string
+	size     int64
+}
+
+// streamCacheObject is what the cache knows of an object while any of its
+// blocks are cached: its size and headers, as HEAD reports them.
+type streamCacheObject struct {
+	head   *s3.GetObjectOutput
+	blocks int
+}
+
+func newStreamCache(root string, maxBytes int64, metrics *metricsRegistry) (*streamCache, error) {
+	if err := ensureDir(root); err != nil {
+		return nil, err
+	}
+	stale, err := filepath.Glob(filepath.Join(root, "*.block*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range stale {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return &streamCache{
+		root:     root,
+		maxBytes: maxBytes,
+		metrics:  metrics,
+		lru:      list.New(),
+		blocks:   map[string]*list.Element{},
+		objects:  map[string]*streamCacheObject{},
+	}, nil
+}
+
+// streamCacheObjectID names an object in the cache. Video keys are never
+// reused for different content, so the key identifies the bytes.
+func streamCacheObjectID(bucket, key string) string {
+	sum := sha256.Sum256([]byte(bucket + "/" + key))
+	return hex.EncodeToString(sum[:16])
+}
+
+func streamCacheBlockName(objectID string, index int64) string {
+	return fmt.Sprintf("%s-%d.block", objectID, index)
+}
+
+// objectHead returns what HEAD said of an object if any of its blocks are
+// cached.
+func (c *streamCache) objectHead(objectID string) (*s3.GetObjectOutput, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	obj, ok := c.objects[objectID]
+	if !ok {
+		return nil, false
+	}
+	return obj.head, true
+}
+
+// get reads a cached block, opening it with seal if it was sealed.
+func (c *streamCache) get(name string, seal cipher.AEAD) ([]byte, bool) {
+	c.mu.Lock()
+	elem, ok := c.blocks[name]
+	if ok {
+		c.lru.MoveToFront(elem)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	data, err := os.ReadFile(filepath.Join(c.root, name))
+	if err == nil && seal != nil {
+		data, err = openStreamCacheBlock(seal, name, data)
+	}
+	if err != nil {
+		log.Printf("Couldn't read stream cache block %s: %v", name, err)
+		c.mu.Lock()
+		if elem, ok := c.blocks[name]; ok {
+			c.remove(elem)
+		}
+		c.mu.Unlock()
+		return nil, false
+	}
+	return data, true
+}
+
+// put caches a block of an object, evicting the least recently used blocks
+// to make room. Failing to cache it is only logged.
+func (c *streamCache) put(objectID string, head *s3.GetObjectOutput, name string, data []byte, seal cipher.AEAD) {
+	if int64(len(data)) > c.maxBytes {
+		return
+	}
+	stored := data
+	if seal != nil {
+		var err error
+		stored, err = sealStreamCacheBlock(seal, name, data)
+		if err != nil {
+			log.Printf("Couldn't seal stream cache block %s: %v", name, err)
+			return
+		}
+	}
+
+	// Another request may be writing the same block; each renames its own
+	// complete file into place
+	tmp, err := os.CreateTemp(c.root, name+".*.tmp")
+	if err != nil {
+		log.Printf("Couldn't cache stream block %s: %v", name, err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(stored)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(c.root, name))
+	}
+	if err != nil {
+		log.Printf("Couldn't cache stream block %s: %v", name, err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.blocks[name]; ok {
+		c.lru.MoveToFront(elem)
+		return
+	}
+	block := &streamCacheBlock{name: name, objectID: objectID, size: int64(len(stored))}
+	c.blocks[name] = c.lru.PushFront(block)
+	c.size += block.size
+	obj, ok := c.objects[objectID]
+	if !ok {
+		obj = &streamCacheObject{head: head}
+		c.objects[objectID] = obj
+	}
+	obj.blocks++
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+	c.metrics.set("tubely_stream_cache_bytes", float64(c.size))
+}
+
+// remove drops a block from the cache and the disk. The caller holds mu.
+func (c *streamCache) remove(elem *list.Element) {
+	block := c.lru.Remove(elem).(*streamCacheBlock)
+	delete(c.blocks, block.name)
+	c.size -= block.size
+	if obj := c.objects[block.objectID]; obj != nil {
+		obj.blocks--
+		if obj.blocks == 0 {
+			delete(c.objects, block.objectID)
+		}
+	}
+	if err := os.Remove(filepath.Join(c.root, block.name)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Couldn't remove stream cache block %s: %v", block.name, err)
+	}
+	c.metrics.add("tubely_stream_cache_evictions_total", 1)
+	c.metrics.set("tubely_stream_cache_bytes", float64(c.size))
+}
+
+// streamCacheSeal returns the AEAD blocks of an object are sealed with: the
+// SSE-C key it's read with, or nil for an unencrypted object.
+func streamCacheSeal(input *s3.GetObjectInput) (cipher.AEAD, error) {
+	if input.SSECustomerKey == nil {
+		return nil, nil
+	}
+	dataKey, err := base64.StdEncoding.DecodeString(*input.SSECustomerKey)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealStreamCacheBlock encrypts a block under a fresh nonce, which it
+// prepends. The block's name is authenticated too, so a sealed block can't
+// be passed off as another.
+func sealStreamCacheBlock(seal cipher.AEAD, name string, data []byte) ([]byte, error) {
+	nonce := make([]byte, seal.NonceSize(), seal.NonceSize()+len(data)+seal.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return seal.Seal(nonce, nonce, data, []byte(name)), nil
+}
+
+func openStreamCacheBlock(seal cipher.AEAD, name string, sealed []byte) ([]byte, error) {
+	if len(sealed) < seal.NonceSize() {
+		return nil, errors.New("sealed block is too short")
+	}
+	nonce, ciphertext := sealed[:seal.NonceSize()], sealed[seal.NonceSize():]
+	return seal.Open(nil, nonce, ciphertext, []byte(name))
+}
+
+// parseByteRange resolves a Range header asking for a single byte range
+// against an object's size, returning the inclusive span it covers. It
+// returns errRangeUnsatisfiable for a range that starts past the end, and
+// another error for anything it doesn't parse, such as multiple ranges.
+func parseByteRange(header string, size int64) (start, end int64, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("unsupported range %q", header)
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("malformed range %q", header)
+	}
+
+	if first == "" {
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix < 0 {
+			return 0, 0, fmt.Errorf("malformed range %q", header)
+		}
+		if suffix == 0 || size == 0 {
+			return 0, 0, errRangeUnsatisfiable
+		}
+		return max(size-suffix, 0), size - 1, nil
+	}
+
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("malformed range %q", header)
+	}
+	end = size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, fmt.Errorf("malformed range %q", header)
+		}
+	}
+	if start >= size {
+		return 0, 0, errRangeUnsatisfiable
+	}
+	return start, min(end, size-1), nil
+}
+
+// streamFromCache answers a GET of an object through the stream cache,
+// fetching from S3 only the blocks it doesn't have. setHeaders adds the
+// caller's headers, like Content-Type, from what HEAD says of the object.
+// It reports false, having written nothing, for a request it can't serve
+// from blocks, such as one for several ranges, which the caller then
+// proxies as is. An error is from reaching the object, before anything is
+// written, and is the caller's to answer.
+func (cfg *apiConfig) streamFromCache(w http.ResponseWriter, r *http.Request, input *s3.GetObjectInput, rate int64, setHeaders func(head *s3.GetObjectOutput)) (bool, error) {
+	seal, err := streamCacheSeal(input)
+	if err != nil {
+		return false, err
+	}
+	objectID := streamCacheObjectID(aws.ToString(input.Bucket), aws.ToString(input.Key))
+
+	head, ok := cfg.streamCache.objectHead(objectID)
+	if !ok {
+		headInput := *input
+		headInput.Range = nil
+		head, err = cfg.getVideoObject(r.Context(), http.MethodHead, &headInput)
+		if err != nil {
+			return false, err
+		}
+	}
+	size := aws.ToInt64(head.ContentLength)
+
+	start, end := int64(0), size-1
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader != "" {
+		start, end, err = parseByteRange(rangeHeader, size)
+		if errors.Is(err, errRangeUnsatisfiable) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			respondWithError(w, http.StatusRequestedRangeNotSatisfiable, "Requested range is past the end of the object", nil)
+			return true, nil
+		}
+		if err != nil {
+			return false, nil
+		}
+	}
+
+	setHeaders(head)
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	status := http.StatusOK
+	if rangeHeader != "" {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+	if size == 0 {
+		return true, nil
+	}
+
+	dst := throttleResponse(w, rate)
+	for index := start / streamCacheBlockSize; index <= end/streamCacheBlockSize; index++ {
+		block, err := cfg.streamCacheBlock(r.Context(), input, objectID, head, index, seal)
+		if err != nil {
+			// The status is sent; cutting the body short is all that's left
+			log.Printf("Couldn't fetch block %d of %s: %v", index, aws.ToString(input.Key), err)
+			return true, nil
+		}
+		blockStart := index * streamCacheBlockSize
+		lo := max(start-blockStart, 0)
+		hi := min(end-blockStart+1, int64(len(block)))
+		if _, err := dst.Write(block[lo:hi]); err != nil {
+			// Players routinely abort range requests mid-body; nothing to report
+			return true, nil
+		}
+	}
+	return true, nil
+}
+
+// streamCacheBlock returns one block of an object, from the cache or else
+// from S3, caching it.
+func (cfg *apiConfig) streamCacheBlock(ctx context.Context, input *s3.GetObjectInput, objectID string, head *s3.GetObjectOutput, index int64, seal cipher.AEAD) ([]byte, error) {
+	name := streamCacheBlockName(objectID, index)
+	if block, ok := cfg.streamCache.get(name, seal); ok {
+		cfg.metrics.add("tubely_stream_cache_hits_total", 1)
+		return block, nil
+	}
+	cfg.metrics.add("tubely_stream_cache_misses_total", 1)
+
+	blockStart := index * streamCacheBlockSize
+	blockEnd := min(blockStart+streamCacheBlockSize, aws.ToInt64(head.ContentLength)) - 1
+	get := *input
+	get.Range = aws.String(fmt.Sprintf("bytes=%d-%d", blockStart, blockEnd))
+	out, err := cfg.s3Client.GetObject(ctx, &get)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	block := make([]byte, blockEnd-blockStart+1)
+	if _, err := io.ReadFull(out.Body, block); err != nil {
+		return nil, fmt.Errorf("could not read block: %w", err)
+	}
+
+	cfg.streamCache.put(objectID, head, name, block, seal)
+	return block, nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// The thumbnail migration moves thumbnails from the assets directory to the
+// bucket, for deployments switching THUMBNAIL_STORAGE to s3. It walks the
+// distinct thumbnail URLs in order and remembers how far it got, so it can
+// be paused, and survives restarts and failover, without redoing work.
+const (
+	thumbnailMigrationIdle      = "idle"
+	thumbnailMigrationRunning   = "running"
+	thumbnailMigrationPaused    = "paused"
+	thumbnailMigrationCompleted = "completed"
+
+	// Admins own the state; the migration task owns the progress, so
+	// neither overwrites the other's writes
+	thumbnailMigrationStateKey    = "thumbnail_migration:state"
+	thumbnailMigrationProgressKey = "thumbnail_migration:progress"
+
+	thumbnailMigrationBatch = 100
+	// thumbnailMigrationInterval is how often the task checks whether the
+	// migration is running. Each run works for most of an interval.
+	thumbnailMigrationInterval = 10 * time.Second
+)
+
+type thumbnailMigrationProgress struct {
+	// Cursor is the last thumbnail URL dealt with
+	Cursor    string    `json:"cursor"`
+	Migrated  int       `json:"migrated"`
+	Failed    int       `json:"failed"`
+	LastError string    `json:"last_error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type thumbnailMigrationStatus struct {
+	State string `json:"state"`
+	thumbnailMigrationProgress
+}
+
+func (cfg *apiConfig) thumbnailMigrationStatus() (thumbnailMigrationStatus, error) {
+	status := thumbnailMigrationStatus{State: thumbnailMigrationIdle}
+	state, found, err := cfg.db.GetSetting(thumbnailMigrationStateKey)
+	if err != nil {
+		return status, err
+	}
+	if found {
+		status.State = state
+	}
+	value, found, err := cfg.db.GetSetting(thumbnailMigrationProgressKey)
+	if err != nil {
+		return status, err
+	}
+	if found {
+		if err := json.Unmarshal([]byte(value), &status.thumbnailMigrationProgress); err != nil {
+			return status, fmt.Errorf("invalid thumbnail migration progress: %w", err)
+		}
+	}
+	return status, nil
+}
+
+func (cfg *apiConfig) saveThumbnailMigrationProgress(progress thumbnailMigrationProgress) error {
+	progress.UpdatedAt = time.Now().UTC()
+	value, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	return cfg.db.PutSetting(thumbnailMigrationProgressKey, string(value))
+}
+
+// migrateThumbnails is the migration's periodic task. Each run moves files
+// one at a time, at most rate per second, for up to budget, and stops early
+// as soon as an admin pauses the migration.
+func (cfg *apiConfig) migrateThumbnails(ctx context.Context, rate int, budget time.Duration) error {
+	status, err := cfg.thumbnailMigrationStatus()
+	if err != nil || status.State != thumbnailMigrationRunning {
+		return err
+	}
+	progress := status.thumbnailMigrationProgress
+
+	throttle := time.NewTicker(time.Second / time.Duration(rate))
+	defer throttle.Stop()
+	deadline := time.Now().Add(budget)
+
+	for time.Now().Before(deadline) {
+		urls, err := cfg.db.GetThumbnailURLsAfter(progress.Cursor, thumbnailMigrationBatch)
+		if err != nil {
+			return err
+		}
+		if len(urls) == 0 {
+			if err := cfg.saveThumbnailMigrationProgress(progress); err != nil {
+				return err
+			}
+			log.Printf("Thumbnail migration completed: %d migrated, %d failed", progress.Migrated, progress.Failed)
+			return cfg.db.PutSetting(thumbnailMigrationStateKey, thumbnailMigrationCompleted)
+		}
+
+		for _, thumbnailURL := range urls {
+			if !time.Now().Before(deadline) {
+				return cfg.saveThumbnailMigrationProgress(progress)
+			}
+			state, _, err := cfg.db.GetSetting(thumbnailMigrationStateKey)
+			if err != nil {
+				return err
+			}
+			if state != thumbnailMigrationRunning {
+				return cfg.saveThumbnailMigrationProgress(progress)
+			}
+
+			path, ok := cfg.assetPathFromURL(thumbnailURL)
+			if ok {
+				select {
+				case <-ctx.Done():
+					return cfg.saveThumbnailMigrationProgress(progress)
+				case <-throttle.C:
+				}
+				if err := cfg.migrateThumbnail(ctx, thumbnailURL, path); err != nil {
+					log.Printf("Couldn't migrate thumbnail %s: %v", thumbnailURL, err)
+					cfg.metrics.add(`tubely_thumbnail_migration_total{result="error"}`, 1)
+					progress.Failed++
+					progress.LastError = fmt.Sprintf("%s: %v", thumbnailURL, err)
+				} else {
+					cfg.metrics.add(`tubely_thumbnail_migration_total{result="ok"}`, 1)
+					progress.Migrated++
+				}
+			}
+			progress.Cursor = thumbnailURL
+			if err := cfg.saveThumbnailMigrationProgress(progress); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migrateThumbnail moves one file. Every step can safely be repeated, so a
+// run cut short at any point is simply finished by the next attempt.
+func (cfg *apiConfig) migrateThumbnail(ctx context.Context, thumbnailURL, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	filename := filepath.Base(path)
+	if err := cfg.putThumbnailObject(ctx, file, filename); err != nil {
+		return fmt.Errorf("couldn't upload: %w", err)
+	}
+	key := thumbnailKeyPrefix + filename
+	head, err := cfg.s3Client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &cfg.s3Bucket, Key: &key})
+	if err != nil {
+		return fmt.Errorf("couldn't verify upload: %w", err)
+	}
+	if head.ContentLength == nil || *head.ContentLength != info.Size() {
+		return errors.New("uploaded object doesn't match the file on disk")
+	}
+
+	newURL := cfg.urls.Object(key)
+	if _, err := cfg.db.ReplaceThumbnailURL(thumbnailURL, newURL); err != nil {
+		return fmt.Errorf("couldn't update videos: %w", err)
+	}
+	file.Close()
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("couldn't remove local copy: %w", err)
+	}
+	cfg.invalidateCDN(thumbnailURL)
+	return nil
+}
+
+func (cfg *apiConfig) handlerThumbnailMigrationGet(w http.ResponseWriter, r *http.Request) {
+	if _, ok := cfg.authenticateAdmin(w, r); !ok {
+		return
+	}
+
+	status, err := cfg.thumbnailMigrationStatus()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get thumbnail migration", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, status)
+}
+
+// handlerThumbnailMigrationUpdate starts, pauses and resumes the migration.
+// Starting it again after it completed walks every thumbnail from the top,
+// picking up anything uploaded to disk in the meantime.
+func (cfg *apiConfig) handlerThumbnailMigrationUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		State string `json:"state" validate:"required"`
+	}
+
+	adminID, ok := cfg.authenticateAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+	if params.State != thumbnailMigrationRunning && params.State != thumbnailMigrationPaused {
+		respondWithValidationError(w, map[string]string{"state": "must be running or paused"}, nil)
+		return
+	}
+	if params.State == thumbnailMigrationRunning && cfg.thumbnailStorage != thumbnailStorageS3 {
+		respondWithError(w, http.StatusConflict, "Set THUMBNAIL_STORAGE=s3 before migrating thumbnails, or new uploads will keep landing on disk", nil)
+		return
+	}
+
+	status, err := cfg.thumbnailMigrationStatus()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get thumbnail migration", err)
+		return
+	}
+	if params.State == thumbnailMigrationRunning && (status.State == thumbnailMigrationIdle || status.State == thumbnailMigrationCompleted) {
+		status.thumbnailMigrationProgress = thumbnailMigrationProgress{}
+		if err := cfg.saveThumbnailMigrationProgress(status.thumbnailMigrationProgress); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't reset thumbnail migration", err)
+			return
+		}
+	}
+	if err := cfg.db.PutSetting(thumbnailMigrationStateKey, params.State); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update thumbnail migration", err)
+		return
+	}
+	status.State = params.State
+
+	err = cfg.db.CreateAuditEntry(database.AuditEntry{
+		ActorID: &adminID,
+		Action:  "thumbnail_migration_" + params.State,
+		Details: fmt.Sprintf("%d migrated, %d failed so far", status.Migrated, status.Failed),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write audit entry", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, status)
+}
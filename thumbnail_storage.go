@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Thumbnails are stored either in the assets directory and served by this
+// app, or in the bucket under thumbnailKeyPrefix and served from the video
+// base URL like videos are. Either way the filename is the content hash.
+const (
+	thumbnailStorageDisk = "disk"
+	thumbnailStorageS3   = "s3"
+	thumbnailKeyPrefix   = "thumbnails/"
+)
+
+// storeThumbnail stores an image where the deployment keeps thumbnails and
+// returns its URL. Storing the same image twice gives the same URL.
+func (cfg *apiConfig) storeThumbnail(ctx context.Context, src io.Reader, fileExt string) (string, error) {
+	if cfg.thumbnailStorage != thumbnailStorageS3 {
+		filename, err := cfg.saveThumbnailFile(src, fileExt)
+		if err != nil {
+			return "", err
+		}
+		return cfg.assetsBaseURL + "/" + filename, nil
+	}
+
+	tmp, err := os.CreateTemp("", "tubely-thumbnail-*"+fileExt)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	if _, err := cfg.buffers.copy(io.MultiWriter(tmp, hash), src); err != nil {
+		return "", err
+	}
+	filename := base64.RawURLEncoding.EncodeToString(hash.Sum(nil)) + fileExt
+	if err := cfg.putThumbnailObject(ctx, tmp, filename); err != nil {
+		return "", err
+	}
+	return cfg.urls.Object(thumbnailKeyPrefix + filename), nil
+}
+
+// putThumbnailObject uploads a thumbnail file to the bucket under its
+// content-hashed filename, unless an object of the same size is already
+// there, which given the name means the same image.
+func (cfg *apiConfig) putThumbnailObject(ctx context.Context, file *os.File, filename string) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	key := thumbnailKeyPrefix + filename
+	head, err := cfg.s3Client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &cfg.s3Bucket, Key: &key})
+	if err == nil && head.ContentLength != nil && *head.ContentLength == info.Size() {
+		return nil
+	}
+	var notFound *types.NotFound
+	if err != nil && !errors.As(err, &notFound) {
+		return err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(filename))
+	return cfg.putObjectFromFile(ctx, &s3.PutObjectInput{
+		Bucket:       &cfg.s3Bucket,
+		Key:          &key,
+		ContentType:  &contentType,
+		CacheControl: &cfg.thumbnailCacheControl,
+	}, file)
+}
+
+// thumbnailKeyFromURL maps a thumbnail URL served from the bucket back to
+// its object key. It reports false for URLs that point anywhere else.
+func (cfg *apiConfig) thumbnailKeyFromURL(rawURL string) (string, bool) {
+	key, ok := cfg.urls.ObjectKey(rawURL)
+	if !ok {
+		return "", false
+	}
+	rest, ok := strings.CutPrefix(key, thumbnailKeyPrefix)
+	if !ok || rest == "" || strings.Contains(rest, "/") {
+		return "", false
+	}
+	return key, true
+}
+
+// deleteThumbnail removes a thumbnail stored by this app, from disk or from
+// the bucket, along with its variants. It reports false, and does nothing,
+// for any other URL.
+func (cfg *apiConfig) deleteThumbnail(ctx context.Context, thumbnailURL string) (bool, error) {
+	if path, ok := cfg.assetPathFromURL(thumbnailURL); ok {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return true, err
+		}
+		return true, cfg.deleteThumbnailVariants(ctx, thumbnailURL)
+	}
+	if key, ok := cfg.thumbnailKeyFromURL(thumbnailURL); ok {
+		if err := cfg.deleteS3ObjectVerified(ctx, key); err != nil {
+			return true, err
+		}
+		return true, cfg.deleteThumbnailVariants(ctx, thumbnailURL)
+	}
+	return false, nil
+}
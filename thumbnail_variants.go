@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// thumbnailVariant is a resized copy of a thumbnail that pages can pick
+// instead of the original, named like "640.jpg": at most 640 pixels wide,
+// encoded as JPEG. Images narrower than that are re-encoded at their own
+// size rather than scaled up.
+type thumbnailVariant struct {
+	width int
+	ext   string
+}
+
+func (v thumbnailVariant) name() string {
+	return strconv.Itoa(v.width) + v.ext
+}
+
+// parseThumbnailVariants reads a comma-separated list like
+// "320.jpg,640.jpg,640.png".
+func parseThumbnailVariants(s string) ([]thumbnailVariant, error) {
+	var variants []thumbnailVariant
+	seen := map[string]bool{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		width, format, ok := strings.Cut(item, ".")
+		w, err := strconv.Atoi(width)
+		if !ok || err != nil || w < 1 || w > maxImageSide {
+			return nil, fmt.Errorf("%q must be a width of 1-%d pixels and a format, like 640.jpg", item, maxImageSide)
+		}
+		if format != "jpg" && format != "png" {
+			return nil, fmt.Errorf("%q must use the jpg or png format", item)
+		}
+		variant := thumbnailVariant{width: w, ext: "." + format}
+		if !seen[variant.name()] {
+			seen[variant.name()] = true
+			variants = append(variants, variant)
+		}
+	}
+	return variants, nil
+}
+
+var (
+	errNoThumbnail        = errors.New("video has no thumbnail")
+	errThumbnailNotStored = errors.New("thumbnail isn't stored by this server")
+	errNoVariantsEnabled  = errors.New("no thumbnail variants are enabled")
+)
+
+// ensureThumbnailVariants generates whichever enabled variants the
+// thumbnail at sourceURL doesn't have yet, from its image in src, and
+// returns all of its variants. Variants that already exist are left alone,
+// so running it again only does the work for newly enabled ones.
+func (cfg *apiConfig) ensureThumbnailVariants(ctx context.Context, sourceURL string, src io.ReadSeeker, fileExt string) (map[string]string, error) {
+	existing, err := cfg.db.GetThumbnailVariants(sourceURL)
+	if err != nil {
+		return nil, err
+	}
+	var missing []thumbnailVariant
+	for _, variant := range cfg.thumbnailVariants {
+		if _, ok := existing[variant.name()]; !ok {
+			missing = append(missing, variant)
+		}
+	}
+	if len(missing) == 0 {
+		return existing, nil
+	}
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var img image.Image
+	if fileExt == ".gif" {
+		// Variants are stills, like the poster
+		img, err = gifFirstFrame(src)
+	} else {
+		img, _, err = image.Decode(src)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode thumbnail: %w", err)
+	}
+
+	for _, variant := range missing {
+		var buf bytes.Buffer
+		if err := encodeThumbnailVariant(&buf, resizeImage(img, variant.width), variant.ext); err != nil {
+			return nil, fmt.Errorf("couldn't encode variant %s: %w", variant.name(), err)
+		}
+		url, err := cfg.storeThumbnail(ctx, &buf, variant.ext)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't store variant %s: %w", variant.name(), err)
+		}
+		if err := cfg.db.PutThumbnailVariant(sourceURL, variant.name(), url); err != nil {
+			return nil, err
+		}
+		existing[variant.name()] = url
+	}
+	return existing, nil
+}
+
+// convertVideoThumbnail generates the enabled variants that a video's
+// current thumbnail is missing, reading the thumbnail back from storage.
+func (cfg *apiConfig) convertVideoThumbnail(ctx context.Context, video database.Video) (map[string]string, error) {
+	if len(cfg.thumbnailVariants) == 0 {
+		return nil, errNoVariantsEnabled
+	}
+	if video.ThumbnailURL == nil {
+		return nil, errNoThumbnail
+	}
+	thumbnailURL := *video.ThumbnailURL
+
+	var path string
+	if assetPath, ok := cfg.assetPathFromURL(thumbnailURL); ok {
+		path = assetPath
+	} else if key, ok := cfg.thumbnailKeyFromURL(thumbnailURL); ok {
+		tmpPath, err := cfg.downloadS3Object(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't fetch thumbnail: %w", err)
+		}
+		defer os.Remove(tmpPath)
+		path = tmpPath
+	} else {
+		return nil, errThumbnailNotStored
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return cfg.ensureThumbnailVariants(ctx, thumbnailURL, file, filepath.Ext(thumbnailURL))
+}
+
+// deleteThumbnailVariants removes the variants of a thumbnail that's being
+// deleted, unless the same image is still in use as a video's thumbnail or
+// another thumbnail's variant.
+func (cfg *apiConfig) deleteThumbnailVariants(ctx context.Context, sourceURL string) error {
+	variants, err := cfg.db.GetThumbnailVariants(sourceURL)
+	if err != nil || len(variants) == 0 {
+		return err
+	}
+	var deletedURLs []string
+	for _, url := range variants {
+		if count, err := cfg.db.CountVideosWithThumbnail(url); err != nil || count > 0 {
+			continue
+		}
+		if count, err := cfg.db.CountOtherThumbnailVariants(url, sourceURL); err != nil || count > 0 {
+			continue
+		}
+		stored, err := cfg.deleteThumbnail(ctx, url)
+		if err != nil {
+			return err
+		}
+		if stored {
+			deletedURLs = append(deletedURLs, url)
+		}
+	}
+	cfg.invalidateCDN(deletedURLs...)
+	return cfg.db.DeleteThumbnailVariants(sourceURL)
+}
+
+// runThumbnailVariantsJob converts the current thumbnail of the job's video.
+// A video that was deleted or lost its thumbnail in the meantime leaves
+// nothing to do.
+func (cfg *apiConfig) runThumbnailVariantsJob(ctx context.Context, job database.Job) string {
+	video, err := cfg.db.GetVideo(job.SubjectID)
+	if err != nil {
+		return cfg.retryOrFailJob(ctx, job, database.UploadSession{}, &uploadError{msg: "Couldn't get video", err: err, retryable: true})
+	}
+	_, err = cfg.convertVideoThumbnail(ctx, video)
+	if err != nil && !errors.Is(err, errNoThumbnail) && !errors.Is(err, errThumbnailNotStored) {
+		retryable := !errors.Is(err, errNoVariantsEnabled)
+		return cfg.retryOrFailJob(ctx, job, database.UploadSession{}, &uploadError{msg: "Couldn't convert thumbnail", err: err, retryable: retryable})
+	}
+	if err := cfg.db.CompleteJob(job.ID); err != nil {
+		log.Printf("Couldn't mark job %s completed: %v", job.ID, err)
+	}
+	return "completed"
+}
+
+// resizeImage scales an image down to width pixels, keeping its aspect
+// ratio, by averaging each block of source pixels. Images already that
+// narrow are returned as they are.
+func resizeImage(src image.Image, width int) image.Image {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	if srcW <= width {
+		return src
+	}
+	height := max(1, (srcH*width+srcW/2)/srcW)
+
+	// Averaging premultiplied pixels keeps transparent ones from bleeding
+	// their color into the edges
+	rgba := image.NewRGBA(image.Rect(0, 0, srcW, srcH))
+	draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for dy := range height {
+		y0, y1 := dy*srcH/height, max((dy+1)*srcH/height, dy*srcH/height+1)
+		for dx := range width {
+			x0, x1 := dx*srcW/width, max((dx+1)*srcW/width, dx*srcW/width+1)
+			var r, g, b, a, n int
+			for y := y0; y < y1; y++ {
+				row := rgba.Pix[y*rgba.Stride:]
+				for x := x0; x < x1; x++ {
+					p := row[x*4 : x*4+4]
+					r += int(p[0])
+					g += int(p[1])
+					b += int(p[2])
+					a += int(p[3])
+					n++
+				}
+			}
+			i := dst.PixOffset(dx, dy)
+			dst.Pix[i] = uint8((r + n/2) / n)
+			dst.Pix[i+1] = uint8((g + n/2) / n)
+			dst.Pix[i+2] = uint8((b + n/2) / n)
+			dst.Pix[i+3] = uint8((a + n/2) / n)
+		}
+	}
+	return dst
+}
+
+// encodeThumbnailVariant writes an image as a JPEG or PNG. JPEGs have no
+// transparency, so transparent areas are drawn over white first rather
+// than coming out black.
+func encodeThumbnailVariant(w io.Writer, img image.Image, fileExt string) error {
+	if fileExt == ".png" {
+		return png.Encode(w, img)
+	}
+	if opaque, ok := img.(interface{ Opaque() bool }); !ok || !opaque.Opaque() {
+		flat := image.NewRGBA(img.Bounds())
+		draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+		img = flat
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+}
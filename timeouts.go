@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// requestReadTimeout bounds reading the body of ordinary API requests.
+	// Upload routes replace it with uploadGuard's deadlines.
+	requestReadTimeout = 30 * time.Second
+	// uploadStallWindow is how long an upload may go without delivering its
+	// minimum byte rate before the connection is dropped.
+	uploadStallWindow = 30 * time.Second
+)
+
+var errUploadTooSlow = errors.New("upload is progressing below the minimum rate")
+
+// deadlineBody clears the connection's read deadline once the body has been
+// read in full. The server keeps reading the connection in the background
+// while the handler runs, and a deadline left in place would cancel the
+// request context of handlers that work long after reading their input.
+type deadlineBody struct {
+	io.ReadCloser
+	rc *http.ResponseController
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.rc.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
+
+// bodyReadTimeout gives every request with a body requestReadTimeout to
+// deliver it. A server-wide ReadTimeout can't be used because it would also
+// cut off long-running responses like the stream proxy.
+func bodyReadTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(time.Now().Add(requestReadTimeout))
+		r.Body = &deadlineBody{ReadCloser: r.Body, rc: rc}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// minRateReader enforces a minimum throughput on a request body. Every read
+// pushes the connection's read deadline out by one stall window, capped by
+// an overall deadline scaled to the declared size, and each completed window
+// must have delivered at least minRate bytes per second.
+type minRateReader struct {
+	io.ReadCloser
+	rc          *http.ResponseController
+	path        string
+	minRate     int64
+	deadline    time.Time
+	windowStart time.Time
+	windowBytes int64
+}
+
+func (r *minRateReader) Read(p []byte) (int, error) {
+	next := time.Now().Add(uploadStallWindow)
+	if !r.deadline.IsZero() && r.deadline.Before(next) {
+		next = r.deadline
+	}
+	r.rc.SetReadDeadline(next)
+
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		r.rc.SetReadDeadline(time.Time{})
+		return n, err
+	}
+	r.windowBytes += int64(n)
+
+	elapsed := time.Since(r.windowStart)
+	if elapsed >= uploadStallWindow {
+		if float64(r.windowBytes) < float64(r.minRate)*elapsed.Seconds() {
+			// Drop the connection rather than keep a trickling client's temp
+			// file open
+			log.Printf("Terminating upload to %s: %d bytes in %s", r.path, r.windowBytes, elapsed.Round(time.Second))
+			r.rc.SetReadDeadline(time.Now())
+			return n, errUploadTooSlow
+		}
+		r.windowStart = time.Now()
+		r.windowBytes = 0
+	}
+	return n, err
+}
+
+// uploadGuard replaces the default body read timeout on upload routes with a
+// deadline scaled to the request's declared size, and terminates uploads
+// that stall or trickle in below cfg.minUploadRate.
+func (cfg *apiConfig) uploadGuard(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.minUploadRate <= 0 {
+			next(w, r)
+			return
+		}
+
+		now := time.Now()
+		reader := &minRateReader{
+			ReadCloser:  r.Body,
+			rc:          http.NewResponseController(w),
+			path:        r.URL.Path,
+			minRate:     cfg.minUploadRate,
+			windowStart: now,
+		}
+		if r.ContentLength > 0 {
+			allowed := time.Duration(float64(r.ContentLength) / float64(cfg.minUploadRate) * float64(time.Second))
+			reader.deadline = now.Add(requestReadTimeout + allowed)
+		}
+		r.Body = reader
+
+		next(w, r)
+	}
+}
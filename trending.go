@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultTrendingVideos = 20
+	// maxTrendingVideos is how long the computed feed is, and so the most
+	// a request can ask for
+	maxTrendingVideos = 100
+	// trendingFeedTTL is how long each server keeps the feed in memory
+	// between reads of the table the aggregation job fills
+	trendingFeedTTL = time.Minute
+	// trendingHalfLives is how many half-lives of activity count toward a
+	// score; older activity would add under 2% and isn't read, and view
+	// counts that old are deleted
+	trendingHalfLives = 6
+	// trendingLikeWeight is how many views a like is worth
+	trendingLikeWeight = 5.0
+	// viewRepeatInterval is how often one address can add a view of the
+	// same video, so a reloading page or a script doesn't pad the count
+	viewRepeatInterval = 10 * time.Minute
+)
+
+// trendingFeed keeps the ranked feed in memory for trendingFeedTTL, so a
+// homepage shown to every visitor doesn't query the database for each.
+// Misses share one query.
+type trendingFeed struct {
+	mu        sync.Mutex
+	videos    []database.TrendingVideo
+	expiresAt time.Time
+	flights   flightGroup[[]database.TrendingVideo]
+}
+
+func (f *trendingFeed) get(now time.Time) ([]database.TrendingVideo, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.videos == nil || now.After(f.expiresAt) {
+		return nil, false
+	}
+	return f.videos, true
+}
+
+func (f *trendingFeed) put(videos []database.TrendingVideo, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.videos = videos
+	f.expiresAt = now.Add(trendingFeedTTL)
+}
+
+// trendingVideos returns the whole ranked feed, from memory when it can.
+func (cfg *apiConfig) trendingVideos() ([]database.TrendingVideo, error) {
+	if videos, ok := cfg.trending.get(time.Now()); ok {
+		cfg.metrics.add(`tubely_trending_cache_total{result="hit"}`, 1)
+		return videos, nil
+	}
+	cfg.metrics.add(`tubely_trending_cache_total{result="miss"}`, 1)
+	videos, err, _ := cfg.trending.flights.do("", func() ([]database.TrendingVideo, error) {
+		videos, err := cfg.db.GetTrendingVideos(maxTrendingVideos)
+		if err != nil {
+			return nil, err
+		}
+		cfg.trending.put(videos, time.Now())
+		return videos, nil
+	})
+	return videos, err
+}
+
+// scoreTrendingVideos adds up each video's views and likes, each halving in
+// weight every halfLife since it happened, and ranks the videos best first,
+// keeping at most maxTrendingVideos.
+func scoreTrendingVideos(activity []database.TrendingActivity, halfLife time.Duration, now time.Time) []database.TrendingScore {
+	totals := map[uuid.UUID]float64{}
+	for _, a := range activity {
+		age := max(now.Sub(a.At), 0)
+		weight := float64(a.Views) + trendingLikeWeight*float64(a.Likes)
+		totals[a.VideoID] += weight * math.Pow(0.5, float64(age)/float64(halfLife))
+	}
+	scores := make([]database.TrendingScore, 0, len(totals))
+	for videoID, total := range totals {
+		scores = append(scores, database.TrendingScore{VideoID: videoID, Score: math.Round(total*1000) / 1000})
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].Score != scores[j].Score {
+			return scores[i].Score > scores[j].Score
+		}
+		return scores[i].VideoID.String() < scores[j].VideoID.String()
+	})
+	if len(scores) > maxTrendingVideos {
+		scores = scores[:maxTrendingVideos]
+	}
+	return scores
+}
+
+// refreshTrending recomputes the trending feed from recent views and likes
+// of public videos, and forgets view counts too old to matter.
+func (cfg *apiConfig) refreshTrending(ctx context.Context, halfLife time.Duration) error {
+	now := time.Now()
+	since := now.Add(-trendingHalfLives * halfLife)
+	if _, err := cfg.db.DeleteVideoViewsBefore(since); err != nil {
+		return fmt.Errorf("couldn't delete old view counts: %w", err)
+	}
+	activity, err := cfg.db.GetTrendingActivity(since)
+	if err != nil {
+		return fmt.Errorf("couldn't get views and likes: %w", err)
+	}
+	scores := scoreTrendingVideos(activity, halfLife, now)
+	if err := cfg.db.ReplaceTrendingVideos(scores, now); err != nil {
+		return fmt.Errorf("couldn't save the trending feed: %w", err)
+	}
+	cfg.metrics.set("tubely_trending_videos", float64(len(scores)))
+	return nil
+}
+
+// handlerVideosTrending lists the public videos with the most recent views
+// and likes, for a homepage feed. It needs no sign-in. Videos the caller's
+// country can't play are left out. limit is from 1 to 100 and defaults to
+// 20.
+func (cfg *apiConfig) handlerVideosTrending(w http.ResponseWriter, r *http.Request) {
+	limit := defaultTrendingVideos
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTrendingVideos {
+			respondWithValidationError(w, map[string]string{"limit": fmt.Sprintf("must be a number from 1 to %d", maxTrendingVideos)}, nil)
+			return
+		}
+		limit = n
+	}
+
+	videos, err := cfg.trendingVideos()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get trending videos", err)
+		return
+	}
+	// The cached feed is shared, so signing works on a copy
+	feed := make([]database.TrendingVideo, 0, min(limit, len(videos)))
+	for _, video := range videos {
+		if len(feed) == limit {
+			break
+		}
+		if _, permitted := cfg.checkGeoRestriction(r, video.Video); !permitted {
+			continue
+		}
+		cfg.signVideoAssets(&video.Video)
+		feed = append(feed, video)
+	}
+	respondWithJSON(w, http.StatusOK, feed)
+}
+
+// handlerVideoView counts a play of a video toward trending. Players call
+// it without signing in. Private videos can't trend and aren't counted.
+// Repeat views from the same address within viewRepeatInterval are
+// accepted but not counted.
+func (cfg *apiConfig) handlerVideoView(w http.ResponseWriter, r *http.Request) {
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
+		return
+	}
+
+	video, err := cfg.getVideoShared(videoID, false)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.Visibility == database.VisibilityPrivate || video.VideoURL == nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	viewer := r.RemoteAddr
+	if addrPort, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		viewer = addrPort.Addr().Unmap().String()
+	}
+	if !cfg.viewLimiter.allow(viewer + ":" + videoID.String()) {
+		cfg.metrics.add(`tubely_video_views_total{result="repeat"}`, 1)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err := cfg.db.RecordVideoView(videoID, time.Now()); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't count view", err)
+		return
+	}
+	cfg.metrics.add(`tubely_video_views_total{result="counted"}`, 1)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerVideoLike likes a video the caller can view.
+func (cfg *apiConfig) handlerVideoLike(w http.ResponseWriter, r *http.Request) {
+	cfg.setVideoLike(w, r, true)
+}
+
+// handlerVideoUnlike withdraws the caller's like of a video.
+func (cfg *apiConfig) handlerVideoUnlike(w http.ResponseWriter, r *http.Request) {
+	cfg.setVideoLike(w, r, false)
+}
+
+func (cfg *apiConfig) setVideoLike(w http.ResponseWriter, r *http.Request, liked bool) {
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.getVideoShared(videoID, true)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	allowed := false
+	if video.ID != uuid.Nil {
+		allowed, err = cfg.canViewVideo(userID, video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check video permissions", err)
+			return
+		}
+	}
+	if !allowed {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	if err := cfg.db.SetVideoLike(videoID, userID, liked); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save like", err)
+		return
+	}
+	likes, liked, err := cfg.db.GetVideoLikes(videoID, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't count likes", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct {
+		Likes int  `json:"likes"`
+		Liked bool `json:"liked"`
+	}{likes, liked})
+}
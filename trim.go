@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// deadAirMinDuration is the shortest run of silence or black frames, in
+// seconds, that is treated as dead air.
+const deadAirMinDuration = 1.0
+
+// deadAirEdgeTolerance is how close to the start or end of the file a dead
+// air span must be for it to count as leading or trailing.
+const deadAirEdgeTolerance = 0.1
+
+var (
+	silenceStartRegexp = regexp.MustCompile(`silence_start: (-?[0-9.]+)`)
+	silenceEndRegexp   = regexp.MustCompile(`silence_end: (-?[0-9.]+)`)
+	blackRegexp        = regexp.MustCompile(`black_start:(-?[0-9.]+) black_end:(-?[0-9.]+)`)
+)
+
+type deadAirSpan struct {
+	start float64
+	end   float64
+}
+
+// trimDeadAir detects leading and trailing silence or black frames and, if
+// any is found, writes a trimmed copy of the video. It returns the path of the
+// file to keep processing (the original path when nothing was trimmed) along
+// with the number of seconds removed from the start and the end.
+func (cfg *apiConfig) trimDeadAir(filePath string) (string, float64, float64, error) {
+	duration, err := cfg.getVideoDuration(filePath)
+	if err != nil {
+		return "", 0, 0, err
+	}
+
+	spans, err := detectDeadAir(filePath, duration)
+	if err != nil {
+		return "", 0, 0, err
+	}
+
+	lead, trail := deadAirOffsets(spans, duration)
+	if lead == 0 && trail == 0 {
+		return filePath, 0, 0, nil
+	}
+	if lead+trail >= duration {
+		// The whole file is dead air; leave it alone rather than produce an
+		// empty video.
+		return filePath, 0, 0, nil
+	}
+
+	trimmedFilePath := filePath + ".trimmed"
+	err = runFFmpeg("trim",
+		"-ss", strconv.FormatFloat(lead, 'f', 3, 64),
+		"-i", filePath,
+		"-t", strconv.FormatFloat(duration-lead-trail, 'f', 3, 64),
+		"-c:v", "libx264",
+		"-c:a", "aac",
+		"-f", "mp4",
+		trimmedFilePath,
+	)
+	if err != nil {
+		return "", 0, 0, err
+	}
+
+	return trimmedFilePath, lead, trail, nil
+}
+
+// detectDeadAir runs ffmpeg's silencedetect and blackdetect filters over the
+// file and returns every span they report.
+func detectDeadAir(filePath string, duration float64) ([]deadAirSpan, error) {
+	if err := faults.inject(faultLayerFFmpeg); err != nil {
+		return nil, &ffmpegError{err: err}
+	}
+	cmd := mediaCommand("ffmpeg",
+		"-hide_banner",
+		"-nostats",
+		"-i", filePath,
+		"-af", fmt.Sprintf("silencedetect=noise=-50dB:d=%g", deadAirMinDuration),
+		"-vf", fmt.Sprintf("blackdetect=d=%g:pix_th=0.10", deadAirMinDuration),
+		"-f", "null",
+		"-",
+	)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	recordCommand("detect_dead_air", cmd)
+	if err != nil {
+		return nil, newFFmpegError(err, stderr.String())
+	}
+
+	return parseDeadAir(stderr.String(), duration), nil
+}
+
+// parseDeadAir extracts silence and black spans from ffmpeg's log output. A
+// silence that runs to the end of the file may have no silence_end line, in
+// which case it is closed at duration.
+func parseDeadAir(output string, duration float64) []deadAirSpan {
+	var spans []deadAirSpan
+
+	starts := silenceStartRegexp.FindAllStringSubmatch(output, -1)
+	ends := silenceEndRegexp.FindAllStringSubmatch(output, -1)
+	for i, m := range starts {
+		start, err := strconv.ParseFloat(m[1], 64)
+		if err != nil {
+			continue
+		}
+		end := duration
+		if i < len(ends) {
+			if parsed, err := strconv.ParseFloat(ends[i][1], 64); err == nil {
+				end = parsed
+			}
+		}
+		spans = append(spans, deadAirSpan{start: max(start, 0), end: end})
+	}
+
+	for _, m := range blackRegexp.FindAllStringSubmatch(output, -1) {
+		start, err := strconv.ParseFloat(m[1], 64)
+		if err != nil {
+			continue
+		}
+		end, err := strconv.ParseFloat(m[2], 64)
+		if err != nil {
+			continue
+		}
+		spans = append(spans, deadAirSpan{start: max(start, 0), end: end})
+	}
+
+	return spans
+}
+
+// deadAirOffsets returns how many seconds of dead air touch the start and
+// the end of a file of the given duration.
+func deadAirOffsets(spans []deadAirSpan, duration float64) (float64, float64) {
+	var lead, trail float64
+	for _, span := range spans {
+		if span.start <= deadAirEdgeTolerance {
+			lead = max(lead, span.end)
+		}
+		if span.end >= duration-deadAirEdgeTolerance {
+			trail = max(trail, duration-span.start)
+		}
+	}
+	return lead, trail
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// maxThumbnailSize caps an uploaded thumbnail, on its own or as part of a
+// combined video upload.
+const maxThumbnailSize = 10 << 20 // 10 MB
+
+// uploadFormFields names the multipart fields the upload endpoints read, so
+// they can match whatever an existing upload UI already sends.
+type uploadFormFields struct {
+	video     string
+	thumbnail string
+	metadata  string
+}
+
+func newUploadFormFields(video, thumbnail, metadata string) (uploadFormFields, error) {
+	fields := uploadFormFields{video: "video", thumbnail: "thumbnail", metadata: "metadata"}
+	for _, field := range []struct {
+		dest  *string
+		value string
+	}{
+		{&fields.video, video},
+		{&fields.thumbnail, thumbnail},
+		{&fields.metadata, metadata},
+	} {
+		if value := strings.TrimSpace(field.value); value != "" {
+			*field.dest = value
+		}
+	}
+	if fields.video == fields.thumbnail || fields.video == fields.metadata || fields.thumbnail == fields.metadata {
+		return fields, errors.New("the video, thumbnail and metadata fields must have different names")
+	}
+	return fields, nil
+}
+
+// uploadMetadata is the JSON metadata part of a combined video upload.
+// Omitted fields are left as they are.
+type uploadMetadata struct {
+	Title       *string `json:"title" validate:"min=1,max=200"`
+	Description *string `json:"description" validate:"max=5000"`
+	Language    *string `json:"language"`
+}
+
+// uploadExtras are the optional parts sent alongside a video in a combined
+// upload, already validated.
+type uploadExtras struct {
+	thumbnail    multipart.File
+	thumbnailExt string
+	metadata     *uploadMetadata
+}
+
+func (e uploadExtras) Close() {
+	if e.thumbnail != nil {
+		e.thumbnail.Close()
+	}
+}
+
+// readUploadExtras validates the thumbnail and metadata parts of a parsed
+// multipart form, if present. Problems are added to fields, keyed by the
+// part's name, so one response can report every bad part at once.
+func (cfg *apiConfig) readUploadExtras(form *multipart.Form, fields map[string]string) uploadExtras {
+	var extras uploadExtras
+
+	if headers := form.File[cfg.uploadFields.thumbnail]; len(headers) > 0 {
+		name := cfg.uploadFields.thumbnail
+		file, ext, problem := openThumbnailPart(headers[0])
+		if problem != "" {
+			fields[name] = problem
+		} else {
+			extras.thumbnail, extras.thumbnailExt = file, ext
+		}
+	}
+
+	if raw, ok := formPart(form, cfg.uploadFields.metadata); ok {
+		name := cfg.uploadFields.metadata
+		var metadata uploadMetadata
+		if err := json.Unmarshal(raw, &metadata); err != nil {
+			fields[name] = "must be a JSON object"
+		} else if problems := validateStruct(reflect.ValueOf(metadata)); len(problems) > 0 {
+			for field, problem := range problems {
+				fields[name+"."+field] = problem
+			}
+		} else if _, ok := parseVideoLanguage(aws.ToString(metadata.Language)); !ok {
+			fields[name+".language"] = videoLanguageProblem
+		} else {
+			extras.metadata = &metadata
+		}
+	}
+	return extras
+}
+
+// openThumbnailPart applies the thumbnail endpoint's checks to a form part
+// and opens it. It returns the file and its extension, or what's wrong.
+func openThumbnailPart(header *multipart.FileHeader) (multipart.File, string, string) {
+	mediaType, problem := partMediaType(header, thumbnailMediaTypes...)
+	if problem != "" {
+		return nil, "", problem
+	}
+	if header.Size > maxThumbnailSize {
+		return nil, "", fmt.Sprintf("must be at most %d bytes", maxThumbnailSize)
+	}
+	fileExt, err := getFileExtension(mediaType)
+	if err != nil {
+		return nil, "", err.Error()
+	}
+	file, err := header.Open()
+	if err != nil {
+		return nil, "", "couldn't be read"
+	}
+	if err := checkImageDimensions(file, strings.TrimPrefix(mediaType, "image/")); err != nil {
+		file.Close()
+		return nil, "", err.Error()
+	}
+	return file, fileExt, ""
+}
+
+// formPart returns a field sent either as a plain form value or as a file
+// part, which is what browsers send for a JSON Blob.
+func formPart(form *multipart.Form, name string) ([]byte, bool) {
+	if values := form.Value[name]; len(values) > 0 {
+		return []byte(values[0]), true
+	}
+	headers := form.File[name]
+	if len(headers) == 0 {
+		return nil, false
+	}
+	file, err := headers[0].Open()
+	if err != nil {
+		return nil, true
+	}
+	defer file.Close()
+	raw, err := io.ReadAll(io.LimitReader(file, maxJSONBodySize))
+	if err != nil {
+		return nil, true
+	}
+	return raw, true
+}
+
+// applyUploadExtras stores the thumbnail and metadata of a combined upload on
+// the video before its file is processed, so the stored object is already
+// named after the new title. It returns the updated video.
+func (cfg *apiConfig) applyUploadExtras(r *http.Request, video database.Video, extras uploadExtras) (database.Video, error) {
+	if extras.thumbnail == nil && extras.metadata == nil {
+		return video, nil
+	}
+
+	var superseded []string
+	if extras.thumbnail != nil {
+		var err error
+		superseded, _, err = cfg.setVideoThumbnail(r.Context(), &video, extras.thumbnail, extras.thumbnailExt)
+		if err != nil {
+			return video, fmt.Errorf("couldn't store thumbnail: %w", err)
+		}
+	}
+	if extras.metadata != nil {
+		if extras.metadata.Title != nil {
+			video.Title = *extras.metadata.Title
+		}
+		if extras.metadata.Description != nil {
+			video.Description = *extras.metadata.Description
+		}
+		if extras.metadata.Language != nil {
+			video.Language, _ = parseVideoLanguage(*extras.metadata.Language)
+		}
+	}
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		return video, fmt.Errorf("couldn't update video metadata: %w", err)
+	}
+
+	for _, previousURL := range superseded {
+		cfg.removeUnusedThumbnail(previousURL)
+	}
+	return video, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// videoUploadLockTTL is how long a video stays locked for an upload whose
+// node stops renewing the lock, for example because it crashed.
+const videoUploadLockTTL = 2 * time.Minute
+
+// lockVideoUpload takes the video's upload lock for the current request, so
+// two uploads for one video can't both write its file, with the loser's
+// object left orphaned. The lock is renewed until the returned release is
+// called. When the video is taken, it responds 409 with what the upload in
+// progress is doing and reports false.
+//
+// Uploads handed to a worker keep the video locked through their job, so
+// the caller can release as soon as the job is queued.
+func (cfg *apiConfig) lockVideoUpload(w http.ResponseWriter, videoID uuid.UUID, sessionID *uuid.UUID) (func(), bool) {
+	holder := uuid.NewString()
+	acquired, err := cfg.db.AcquireVideoUploadLock(videoID, holder, sessionID, videoUploadLockTTL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't lock video for upload", err)
+		return nil, false
+	}
+	if !acquired {
+		cfg.metrics.add("tubely_upload_conflicts_total", 1)
+		cfg.respondWithUploadInProgress(w, videoID)
+		return nil, false
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		ticker := time.NewTicker(videoUploadLockTTL / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			held, err := cfg.db.ExtendVideoUploadLock(videoID, holder, videoUploadLockTTL)
+			if err != nil {
+				log.Printf("Couldn't extend upload lock on video %s: %v", videoID, err)
+				continue
+			}
+			if !held {
+				log.Printf("Lost upload lock on video %s", videoID)
+				return
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		if err := cfg.db.ReleaseVideoUploadLock(videoID, holder); err != nil {
+			log.Printf("Couldn't release upload lock on video %s: %v", videoID, err)
+		}
+	}, true
+}
+
+// respondWithUploadInProgress answers an upload that lost the race for a
+// video with the status of the one that won. Clients can follow a session
+// at GET /api/upload-sessions/{sessionID}.
+func (cfg *apiConfig) respondWithUploadInProgress(w http.ResponseWriter, videoID uuid.UUID) {
+	type jobStatus struct {
+		ID       uuid.UUID `json:"id"`
+		Status   string    `json:"status"`
+		Attempts int       `json:"attempts"`
+		RunAfter time.Time `json:"run_after"`
+	}
+	type uploadInProgress struct {
+		VideoID   uuid.UUID  `json:"video_id"`
+		SessionID *uuid.UUID `json:"session_id"`
+		Status    string     `json:"status"`
+		StartedAt time.Time  `json:"started_at"`
+		Job       *jobStatus `json:"job"`
+	}
+	type response struct {
+		Error  string           `json:"error"`
+		Code   string           `json:"code"`
+		Upload uploadInProgress `json:"upload"`
+	}
+
+	upload := uploadInProgress{VideoID: videoID, Status: database.UploadStatusProcessing}
+	job, err := cfg.db.GetActiveVideoUploadJob(videoID)
+	if err != nil {
+		log.Printf("Couldn't get upload job for video %s: %v", videoID, err)
+		job = database.Job{}
+	}
+	if job.ID != uuid.Nil {
+		upload.SessionID = &job.SubjectID
+		upload.Status = job.Status
+		upload.StartedAt = job.CreatedAt
+		upload.Job = &jobStatus{ID: job.ID, Status: job.Status, Attempts: job.Attempts, RunAfter: job.RunAfter}
+	} else {
+		lock, err := cfg.db.GetVideoUploadLock(videoID)
+		if err != nil {
+			log.Printf("Couldn't get upload lock for video %s: %v", videoID, err)
+			lock = database.VideoUploadLock{}
+		}
+		upload.SessionID = lock.SessionID
+		upload.StartedAt = lock.AcquiredAt
+	}
+
+	respondWithJSON(w, http.StatusConflict, response{
+		Error:  "Another upload for this video is in progress",
+		Code:   "upload_in_progress",
+		Upload: upload,
+	})
+}
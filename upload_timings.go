@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// uploadStep is a kind of work an upload spends its time on. Slow uploads
+// are usually slow at exactly one of these: the client's connection while
+// parsing, the disk while copying, ffmpeg while remuxing, or the bucket.
+type uploadStep int
+
+const (
+	stepParse uploadStep = iota
+	stepCopy
+	stepProbe
+	stepRemux
+	stepS3
+	stepDB
+	numUploadSteps
+)
+
+var uploadStepNames = [numUploadSteps]string{"parse", "copy", "probe", "remux", "s3", "db"}
+
+// uploadTimings adds up how long one upload spends on each step. It travels
+// in the upload's context, so the pipeline can record steps without every
+// helper taking it as an argument. A nil *uploadTimings records nothing,
+// which is what uploads other than video files get.
+type uploadTimings struct {
+	mu    sync.Mutex
+	steps [numUploadSteps]time.Duration
+}
+
+type uploadTimingsKey struct{}
+
+// withUploadTimings starts timing an upload, continuing from earlier
+// timings when an upload session already has some, as it does once an API
+// node hands it to a worker.
+func withUploadTimings(ctx context.Context, earlier json.RawMessage) (context.Context, *uploadTimings) {
+	timings := &uploadTimings{}
+	if len(earlier) > 0 {
+		var millis map[string]int64
+		if err := json.Unmarshal(earlier, &millis); err == nil {
+			for step, name := range uploadStepNames {
+				timings.steps[step] = time.Duration(millis[name+"_ms"]) * time.Millisecond
+			}
+		}
+	}
+	return context.WithValue(ctx, uploadTimingsKey{}, timings), timings
+}
+
+func uploadTimingsFrom(ctx context.Context) *uploadTimings {
+	timings, _ := ctx.Value(uploadTimingsKey{}).(*uploadTimings)
+	return timings
+}
+
+// track starts timing a step; calling the returned func stops it.
+func (t *uploadTimings) track(step uploadStep) func() {
+	if t == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		t.mu.Lock()
+		t.steps[step] += time.Since(start)
+		t.mu.Unlock()
+	}
+}
+
+// MarshalJSON reports every step in whole milliseconds, as parse_ms,
+// copy_ms and so on.
+func (t *uploadTimings) MarshalJSON() ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var b strings.Builder
+	b.WriteByte('{')
+	for step, name := range uploadStepNames {
+		if step > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%q:%d", name+"_ms", t.steps[step].Milliseconds())
+	}
+	b.WriteByte('}')
+	return []byte(b.String()), nil
+}
+
+func (t *uploadTimings) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	parts := make([]string, 0, numUploadSteps)
+	for step, name := range uploadStepNames {
+		parts = append(parts, fmt.Sprintf("%s=%dms", name, t.steps[step].Milliseconds()))
+	}
+	return strings.Join(parts, " ")
+}
+
+// recordUploadTimings logs how an upload spent its time and, for uploads
+// that have a session, stores it where GET /api/upload-sessions/{sessionID}
+// shows it.
+func (cfg *apiConfig) recordUploadTimings(videoID, sessionID uuid.UUID, timings *uploadTimings) {
+	if timings == nil {
+		return
+	}
+	log.Printf("Upload timings for video %s: %s", videoID, timings)
+	if sessionID == uuid.Nil {
+		return
+	}
+	value, err := json.Marshal(timings)
+	if err != nil {
+		return
+	}
+	if err := cfg.db.SetUploadSessionTimings(sessionID, value); err != nil {
+		log.Printf("Couldn't record timings for upload session %s: %v", sessionID, err)
+	}
+}
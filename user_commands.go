@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+var (
+	errUserDisabled = errors.New("user is disabled")
+	errUserDeleted  = errors.New("user no longer exists")
+)
+
+// userCommandUsage lists the actions of the -user flag and their arguments.
+const userCommandUsage = `usage: -user <action> <email> [args]
+  create <email>                  create an account with a generated password
+  disable <email>                 lock the account out and end its sessions
+  enable <email>                  let a disabled account sign in again
+  promote <email>                 make the account an admin
+  demote <email>                  take away its admin rights
+  reset-password <email>          set a new generated password and end its sessions
+  set-tier <email> <tier>         move the account to a tier, which sets its bandwidth quota
+  issue-key <email> <name>        create a signing key for server-side integrations`
+
+// runUserCommand backs the -user flag, so operators can manage accounts
+// without SQL. Each change is written to the audit log with no actor, as
+// there is no signed-in admin to blame. Generated passwords and secrets are
+// only printed this once.
+func (cfg *apiConfig) runUserCommand(action string, args []string) {
+	wantArgs := map[string]int{
+		"create":         1,
+		"disable":        1,
+		"enable":         1,
+		"promote":        1,
+		"demote":         1,
+		"reset-password": 1,
+		"set-tier":       2,
+		"issue-key":      2,
+	}
+	if n, ok := wantArgs[action]; !ok || len(args) != n {
+		log.Fatal(userCommandUsage)
+	}
+	email := strings.TrimSpace(args[0])
+
+	if action == "create" {
+		password, err := generatePassword()
+		if err != nil {
+			log.Fatalf("Couldn't generate password: %v", err)
+		}
+		hashedPassword, err := cfg.passwords.Hash(password)
+		if err != nil {
+			log.Fatalf("Couldn't hash password: %v", err)
+		}
+		existing, err := cfg.db.GetUserByEmail(email)
+		if err != nil {
+			log.Fatalf("Couldn't get user: %v", err)
+		}
+		if existing.ID != uuid.Nil {
+			log.Fatalf("There is already a user with email %s", email)
+		}
+		user, err := cfg.db.CreateUser(database.CreateUserParams{Email: email, Password: hashedPassword})
+		if err != nil {
+			log.Fatalf("Couldn't create user: %v", err)
+		}
+		cfg.auditUserCommand("user_created", fmt.Sprintf("user %s created for %s", user.ID, email))
+		log.Printf("Created %s (%s) with password %q", email, user.ID, password)
+		return
+	}
+
+	user, err := cfg.db.GetUserByEmail(email)
+	if err != nil {
+		log.Fatalf("Couldn't get user: %v", err)
+	}
+	if user.ID == uuid.Nil {
+		log.Fatalf("There is no user with email %s", email)
+	}
+
+	switch action {
+	case "disable", "enable":
+		disabled := action == "disable"
+		if _, err := cfg.db.SetUserDisabled(user.ID, disabled); err != nil {
+			log.Fatalf("Couldn't %s user: %v", action, err)
+		}
+		if disabled {
+			cfg.endUserSessions(user.ID)
+		}
+		cfg.auditUserCommand("user_"+action+"d", fmt.Sprintf("user %s %sd", user.ID, action))
+		log.Printf("%s is now %sd", email, action)
+
+	case "promote", "demote":
+		if _, err := cfg.db.SetUserAdmin(email, action == "promote"); err != nil {
+			log.Fatalf("Couldn't %s user: %v", action, err)
+		}
+		cfg.auditUserCommand("user_"+action+"d", fmt.Sprintf("user %s %sd", user.ID, action))
+		if action == "demote" && isAdminEmail(email) {
+			log.Printf("%s is listed in ADMIN_EMAILS and will be promoted again at the next start", email)
+		}
+		log.Printf("%s is now %sd", email, action)
+
+	case "reset-password":
+		password, err := generatePassword()
+		if err != nil {
+			log.Fatalf("Couldn't generate password: %v", err)
+		}
+		hashedPassword, err := cfg.passwords.Hash(password)
+		if err != nil {
+			log.Fatalf("Couldn't hash password: %v", err)
+		}
+		if err := cfg.db.UpdateUserPassword(user.ID, hashedPassword); err != nil {
+			log.Fatalf("Couldn't update password: %v", err)
+		}
+		cfg.endUserSessions(user.ID)
+		cfg.auditUserCommand("user_password_reset", fmt.Sprintf("password of user %s reset", user.ID))
+		log.Printf("Reset the password of %s to %q", email, password)
+
+	case "set-tier":
+		tier := strings.TrimSpace(args[1])
+		if tier == "" || len(tier) > 50 {
+			log.Fatal("The tier must be 1 to 50 characters")
+		}
+		if _, err := cfg.db.SetUserTier(user.ID, tier); err != nil {
+			log.Fatalf("Couldn't update tier: %v", err)
+		}
+		cfg.auditUserCommand("user_tier_changed", fmt.Sprintf("user %s moved to tier %s", user.ID, tier))
+		log.Printf("%s is now on tier %s, with a bandwidth quota of %s", email, tier, describeRate(cfg.bandwidth.forTier(tier)))
+
+	case "issue-key":
+		secret, err := auth.MakeRefreshToken()
+		if err != nil {
+			log.Fatalf("Couldn't generate signing key: %v", err)
+		}
+		key, err := cfg.db.CreateSigningKey(user.ID, args[1], secret)
+		if err != nil {
+			log.Fatalf("Couldn't save signing key: %v", err)
+		}
+		cfg.auditUserCommand("signing_key_issued", fmt.Sprintf("signing key %s issued to user %s", key.ID, user.ID))
+		log.Printf("Issued signing key %s to %s with secret %s", key.ID, email, secret)
+	}
+}
+
+// endUserSessions revokes a user's refresh tokens, so they have to sign in
+// again. Their access tokens stop working once the account is disabled.
+func (cfg *apiConfig) endUserSessions(userID uuid.UUID) {
+	if _, err := cfg.db.DeleteRefreshTokensForUser(userID); err != nil {
+		log.Fatalf("Couldn't revoke refresh tokens: %v", err)
+	}
+}
+
+func (cfg *apiConfig) auditUserCommand(action, details string) {
+	err := cfg.db.CreateAuditEntry(database.AuditEntry{
+		Action:  action,
+		Details: details + " from the command line",
+	})
+	if err != nil {
+		log.Fatalf("Couldn't write audit entry: %v", err)
+	}
+}
+
+// generatePassword makes a random password for accounts an operator sets
+// up, to be handed to the user and changed.
+func generatePassword() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// isAdminEmail reports whether ADMIN_EMAILS lists the email.
+func isAdminEmail(email string) bool {
+	for _, listed := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if strings.EqualFold(strings.TrimSpace(listed), email) {
+			return true
+		}
+	}
+	return false
+}
+
+func describeRate(rate int64) string {
+	if rate == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d bytes/s", rate)
+}
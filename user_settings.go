@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// uploadFlags are the processing options an upload request may set. Those
+// it leaves out come from the uploader's settings.
+type uploadFlags struct {
+	TrimDeadAir *bool `json:"trim_dead_air"`
+	Watermark   *bool `json:"watermark"`
+	Encrypt     *bool `json:"encrypt"`
+}
+
+// formUploadFlags reads the processing options of a multipart upload. An
+// empty field is left out; one that isn't a boolean is false.
+func formUploadFlags(r *http.Request) uploadFlags {
+	flag := func(name string) *bool {
+		v := r.FormValue(name)
+		if v == "" {
+			return nil
+		}
+		b, _ := strconv.ParseBool(v)
+		return &b
+	}
+	return uploadFlags{
+		TrimDeadAir: flag("trim_dead_air"),
+		Watermark:   flag("watermark"),
+		Encrypt:     flag("encrypt"),
+	}
+}
+
+// options fills in the flags left out from defaults.
+func (f uploadFlags) options(defaults database.UploadDefaults) database.UploadOptions {
+	opts := database.UploadOptions{
+		TrimDeadAir: defaults.TrimDeadAir,
+		Watermark:   defaults.Watermark,
+		Encrypt:     defaults.Encrypt,
+	}
+	if f.TrimDeadAir != nil {
+		opts.TrimDeadAir = *f.TrimDeadAir
+	}
+	if f.Watermark != nil {
+		opts.Watermark = *f.Watermark
+	}
+	if f.Encrypt != nil {
+		opts.Encrypt = *f.Encrypt
+	}
+	return opts
+}
+
+// createVideo creates a video for params.UserID with the visibility given,
+// or the user's default visibility if it's empty, and records its
+// creation: as published too when it starts out public.
+func (cfg *apiConfig) createVideo(params database.CreateVideoParams, visibility string, actorID uuid.UUID, payload any) (database.Video, error) {
+	if visibility == "" {
+		settings, err := cfg.db.GetUserSettings(params.UserID)
+		if err != nil {
+			return database.Video{}, err
+		}
+		visibility = settings.DefaultVisibility
+	}
+	video, err := cfg.db.CreateVideo(params)
+	if err != nil {
+		return database.Video{}, err
+	}
+	if video.Visibility != visibility {
+		video.Visibility = visibility
+		if err := cfg.db.UpdateVideo(video); err != nil {
+			return database.Video{}, err
+		}
+	}
+	cfg.recordVideoEvent(video, database.VideoEventCreated, actorID, payload)
+	if video.Visibility == database.VisibilityPublic {
+		cfg.recordVideoEvent(video, database.VideoEventPublished, actorID, nil)
+	}
+	return video, nil
+}
+
+func (cfg *apiConfig) handlerUserSettingsGet(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	settings, err := cfg.db.GetUserSettings(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get settings", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, settings)
+}
+
+// handlerUserSettingsUpdate changes the caller's settings. Fields left out
+// keep their values. Turning on a default that every upload would fail
+// with, like encryption on a server without it, is refused up front.
+func (cfg *apiConfig) handlerUserSettingsUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		DefaultVisibility *string      `json:"default_visibility"`
+		UploadDefaults    *uploadFlags `json:"upload_defaults"`
+		WatchHistory      *bool        `json:"watch_history"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+	if params.DefaultVisibility != nil && !database.ValidVisibility(*params.DefaultVisibility) {
+		respondWithValidationError(w, map[string]string{"default_visibility": "must be private, unlisted or public"}, nil)
+		return
+	}
+
+	settings, err := cfg.db.GetUserSettings(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get settings", err)
+		return
+	}
+	if params.DefaultVisibility != nil {
+		settings.DefaultVisibility = *params.DefaultVisibility
+	}
+	if params.WatchHistory != nil {
+		settings.WatchHistory = *params.WatchHistory
+	}
+	if flags := params.UploadDefaults; flags != nil {
+		// Only what this request turns on is checked, so settings made
+		// before a watermark was removed can still be changed
+		if flags.Encrypt != nil && *flags.Encrypt && cfg.keyWrapper == nil {
+			respondWithError(w, http.StatusBadRequest, "Encryption at rest is not enabled on this server", errEncryptionDisabled)
+			return
+		}
+		if flags.Watermark != nil && *flags.Watermark {
+			if _, err := cfg.resolveWatermark(userID); errors.Is(err, errNoWatermark) {
+				respondWithError(w, http.StatusBadRequest, "No watermark image is configured for this account", err)
+				return
+			} else if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Couldn't find watermark image", err)
+				return
+			}
+		}
+		opts := flags.options(settings.UploadDefaults)
+		settings.UploadDefaults = database.UploadDefaults{
+			TrimDeadAir: opts.TrimDeadAir,
+			Watermark:   opts.Watermark,
+			Encrypt:     opts.Encrypt,
+		}
+	}
+
+	if err := cfg.db.UpdateUserSettings(userID, settings); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update settings", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, settings)
+}
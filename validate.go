@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+)
+
+// videoValidationError explains why an upload isn't a usable video. Code is
+// returned to the client so it can react without parsing the message.
+type videoValidationError struct {
+	Code   string
+	Reason string
+}
+
+func (e *videoValidationError) Error() string {
+	return e.Reason
+}
+
+// validateVideoFile rejects files that would not play as a video: malformed
+// containers, audio-only files, files with no duration and files with a
+// codec the deployment's codec policy rejects. It returns what it probed.
+func (cfg *apiConfig) validateVideoFile(filePath string) (streamInfo, error) {
+	if err := checkMP4Atoms(filePath); err != nil {
+		return streamInfo{}, err
+	}
+	// Only ffprobe reports recoverable container errors; the native prober
+	// fails outright on anything it can't parse
+	if _, ok := cfg.prober.(media.FFprobe); ok {
+		if err := probeContainerErrors(filePath); err != nil {
+			return streamInfo{}, err
+		}
+	}
+
+	info, err := cfg.probeStreamInfo(filePath)
+	if errors.Is(err, errNoVideoStream) {
+		return info, &videoValidationError{Code: "no_video_stream", Reason: "File doesn't contain a video stream"}
+	}
+	if err != nil {
+		return info, err
+	}
+	return info, cfg.checkStreamInfo(info)
+}
+
+// checkStreamInfo applies the checks that need only the probed streams,
+// which a file's first few megabytes can be enough for.
+func (cfg *apiConfig) checkStreamInfo(info streamInfo) error {
+	if info.width <= 0 || info.height <= 0 {
+		return &videoValidationError{Code: "undecodable_video_stream", Reason: "Video stream has no decodable frames"}
+	}
+	if info.duration <= 0 {
+		return &videoValidationError{Code: "zero_duration", Reason: "Video has no duration"}
+	}
+	return cfg.codecs.checkCodecs(info)
+}
+
+// probeContainerErrors has ffprobe parse the container and treats anything it
+// reports at error level as a malformed file, even when it manages to
+// recover enough to print stream information.
+func probeContainerErrors(filePath string) error {
+	cmd := mediaCommand("ffprobe",
+		"-v", "error",
+		"-show_format",
+		"-show_streams",
+		filePath,
+	)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	runErr := cmd.Run()
+	recordCommand("validate", cmd)
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		firstLine, _, _ := strings.Cut(msg, "\n")
+		return malformedContainer(firstLine)
+	}
+	if runErr != nil {
+		return fmt.Errorf("could not run ffprobe: %w", runErr)
+	}
+	return nil
+}
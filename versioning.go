@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// currentAPIVersion is the only API version so far. Versions only change
+// for breaking changes; see the API section of the README for what counts
+// as one.
+const currentAPIVersion = "1"
+
+var supportedAPIVersions = []string{"1"}
+
+var versionedAPIPath = regexp.MustCompile(`^/api/v(\d+)(/.*)$`)
+
+type requestPathKey struct{}
+
+// apiVersioning serves /api/v{N}/... from the same routes as /api/... and
+// negotiates the version of unversioned requests from Accept-Version. Every
+// API response says which version produced it.
+func apiVersioning(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		version := currentAPIVersion
+		if m := versionedAPIPath.FindStringSubmatch(r.URL.Path); m != nil {
+			version = m[1]
+			if !slices.Contains(supportedAPIVersions, version) {
+				respondWithErrorCode(w, http.StatusNotFound, "unsupported_version", fmt.Sprintf("API version %s doesn't exist", version), nil)
+				return
+			}
+			// Handlers build links from the path the client actually used
+			r = r.WithContext(context.WithValue(r.Context(), requestPathKey{}, r.URL.Path))
+			r.URL.Path = "/api" + m[2]
+			r.URL.RawPath = ""
+		} else if requested := strings.TrimPrefix(strings.TrimSpace(r.Header.Get("Accept-Version")), "v"); requested != "" {
+			if !slices.Contains(supportedAPIVersions, requested) {
+				w.Header().Set("API-Version", currentAPIVersion)
+				respondWithErrorCode(w, http.StatusNotAcceptable, "unsupported_version", fmt.Sprintf("API version %s isn't supported; use one of %s", requested, strings.Join(supportedAPIVersions, ", ")), nil)
+				return
+			}
+			version = requested
+		}
+
+		w.Header().Set("API-Version", version)
+		w.Header().Add("Vary", "Accept-Version")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestPath is the path as the client sent it, before apiVersioning
+// stripped any version prefix.
+func requestPath(r *http.Request) string {
+	if path, ok := r.Context().Value(requestPathKey{}).(string); ok {
+		return path
+	}
+	return r.URL.Path
+}
+
+// deprecation describes a route that still works but is on its way out.
+// successor may use the route's path wildcards, e.g. /api/videos/{videoID}.
+type deprecation struct {
+	since     time.Time
+	sunset    time.Time
+	successor string
+}
+
+// legacyUploadRoutes is the deprecation of the original upload endpoints,
+// which predate the /api/videos/{videoID}/... layout.
+func legacyUploadRoutes(successor string) deprecation {
+	return deprecation{
+		since:     time.Date(2026, time.October, 15, 0, 0, 0, 0, time.UTC),
+		successor: successor,
+	}
+}
+
+var pathWildcard = regexp.MustCompile(`\{(\w+)\}`)
+
+// deprecated marks every response of a route with the Deprecation header
+// (RFC 9745), and with Sunset and a successor-version link when known, and
+// counts remaining callers so the route can be removed once traffic stops.
+func (cfg *apiConfig) deprecated(d deprecation, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", fmt.Sprintf("@%d", d.since.Unix()))
+		if !d.sunset.IsZero() {
+			w.Header().Set("Sunset", d.sunset.UTC().Format(http.TimeFormat))
+		}
+		if d.successor != "" {
+			successor := pathWildcard.ReplaceAllStringFunc(d.successor, func(wildcard string) string {
+				return r.PathValue(wildcard[1 : len(wildcard)-1])
+			})
+			w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, successor))
+		}
+		cfg.metrics.add(`tubely_deprecated_requests_total{route="`+r.Pattern+`"}`, 1)
+		next(w, r)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	// videoEventBatchSize is how many events one delivery run sends at most.
+	videoEventBatchSize = 100
+	// videoEventDeliveryInterval is how often new events are looked for.
+	videoEventDeliveryInterval = 5 * time.Second
+)
+
+// recordVideoEvent adds a transition to the video's history. actorID is
+// uuid.Nil for changes the app makes on its own, like a worker finishing
+// an upload. The change itself has already happened, so a failure to
+// record it is logged rather than failing the request.
+func (cfg *apiConfig) recordVideoEvent(video database.Video, eventType string, actorID uuid.UUID, payload any) {
+	event := database.VideoEvent{VideoID: video.ID, OwnerID: video.UserID, Type: eventType}
+	if actorID != uuid.Nil {
+		event.ActorID = &actorID
+	}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			log.Printf("Couldn't encode %s event for video %s: %v", eventType, video.ID, err)
+			return
+		}
+		event.Payload = data
+	}
+	if err := cfg.db.CreateVideoEvent(event); err != nil {
+		log.Printf("Couldn't record %s event for video %s: %v", eventType, video.ID, err)
+		return
+	}
+	cfg.metrics.add(`tubely_video_events_total{type="`+eventType+`"}`, 1)
+}
+
+// processedEventPayload describes the stored file of a video that has just
+// become playable.
+func processedEventPayload(video database.Video) map[string]any {
+	return map[string]any{
+		"video_url":        video.VideoURL,
+		"duration_seconds": video.DurationSeconds,
+	}
+}
+
+// deliverVideoEvents posts recorded events to the events webhook, one at a
+// time and in order. Delivery stops at the first failure, so the webhook
+// never sees an event before the ones that came earlier; the failed event
+// is retried on the next run.
+func (cfg *apiConfig) deliverVideoEvents(ctx context.Context, client *http.Client, webhookURL string) error {
+	events, err := cfg.db.GetUndeliveredVideoEvents(videoEventBatchSize)
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		body, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		signWebhook(req, body, cfg.webhookSigning)
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("couldn't deliver video event %d: %w", event.ID, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("events webhook returned %s for video event %d", resp.Status, event.ID)
+		}
+		if err := cfg.db.MarkVideoEventDelivered(event.ID); err != nil {
+			return err
+		}
+		cfg.metrics.add("tubely_video_events_delivered_total", 1)
+	}
+	return nil
+}
+
+// handlerVideoHistory lists a video's lifecycle events to its owner or, for
+// an organization's video, its members, and to its last owner after it has
+// been deleted.
+func (cfg *apiConfig) handlerVideoHistory(w http.ResponseWriter, r *http.Request) {
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	events, err := cfg.db.GetVideoEvents(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video history", err)
+		return
+	}
+	allowed := false
+	if video.ID != uuid.Nil {
+		allowed, err = cfg.canAccessVideo(userID, video, permView)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check video permissions", err)
+			return
+		}
+	} else if len(events) > 0 {
+		// A deleted video's owner is whoever owned it when it was deleted
+		allowed = events[len(events)-1].OwnerID == userID
+	}
+	if !allowed {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, events)
+}
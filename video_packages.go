@@ -0,0 +1,518 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+	"github.com/google/uuid"
+)
+
+const (
+	videoPackagePrefix = "packages/"
+	// videoPackageRetention is how long a built zip is kept for download
+	videoPackageRetention = 7 * 24 * time.Hour
+	// videoPackageLinkTTL is how long a download link to a zip works
+	videoPackageLinkTTL = time.Hour
+	// videoPackagePartSize is the size of the parts a zip is uploaded in.
+	// The zip's size isn't known up front, so each part is held in memory
+	// until it's sent; 10,000 of them allow a zip of over 300 GB.
+	videoPackagePartSize = 32 << 20
+)
+
+var (
+	errPackageVideoGone        = errors.New("a video in the package was deleted or has no file")
+	errPackageVideoUnavailable = errors.New("a video in the package can no longer be packaged by its owner")
+)
+
+// packageRestricted reports whether a video must be kept out of packages.
+// A zip sits unencrypted in the bucket and its download link works from
+// anywhere, so encrypted videos, which may only be played through the
+// proxy, and geo-restricted ones can't go in one.
+func packageRestricted(video database.Video) bool {
+	return video.Encrypted || len(video.GeoAllow) > 0 || len(video.GeoDeny) > 0
+}
+
+// videoPackageManifest is written into each zip as manifest.json,
+// describing its files in playlist order.
+type videoPackageManifest struct {
+	Title     string                      `json:"title"`
+	CreatedAt time.Time                   `json:"created_at"`
+	Videos    []videoPackageManifestEntry `json:"videos"`
+}
+
+type videoPackageManifestEntry struct {
+	Position        int       `json:"position"`
+	VideoID         uuid.UUID `json:"video_id"`
+	Title           string    `json:"title"`
+	Description     string    `json:"description"`
+	File            string    `json:"file"`
+	Size            int64     `json:"size"`
+	ChecksumSHA256  string    `json:"checksum_sha256"`
+	DurationSeconds *float64  `json:"duration_seconds"`
+}
+
+// packageFileName is the name a video has inside a package's zip. The
+// position keeps the files in playlist order and two equal titles apart.
+func packageFileName(position int, title string) string {
+	name := media.SanitizeFilename(title)
+	if name == "" {
+		name = "video"
+	}
+	return fmt.Sprintf("%03d - %s.mp4", position, name)
+}
+
+// buildVideoPackage zips the package's videos straight from the bucket into
+// a new object, without staging anything on disk: each file is streamed
+// into the zip as it's read, and the zip is uploaded in parts as it's
+// written. The manifest comes last, once every checksum is known. Videos
+// are stored rather than compressed, since MP4s don't compress. Access is
+// checked again, since it may have changed while the job was queued.
+func (cfg *apiConfig) buildVideoPackage(ctx context.Context, pkg database.VideoPackage) (string, int64, error) {
+	videos := make([]database.Video, 0, len(pkg.VideoIDs))
+	for _, id := range pkg.VideoIDs {
+		video, err := cfg.db.Primary().GetVideo(id)
+		if err != nil {
+			return "", 0, err
+		}
+		if video.ID == uuid.Nil || video.VideoURL == nil {
+			return "", 0, errPackageVideoGone
+		}
+		allowed, err := cfg.canAccessVideo(pkg.UserID, video, permView)
+		if err != nil {
+			return "", 0, err
+		}
+		if !allowed || packageRestricted(video) {
+			return "", 0, errPackageVideoUnavailable
+		}
+		videos = append(videos, video)
+	}
+
+	key := videoPackagePrefix + pkg.UserID.String() + "/" + pkg.ID.String() + ".zip"
+	contentType := "application/zip"
+	input := &s3.PutObjectInput{
+		Bucket:      &cfg.s3Bucket,
+		Key:         &key,
+		ContentType: &contentType,
+	}
+
+	pr, pw := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		err := cfg.writeVideoPackage(ctx, pw, pkg, videos)
+		pw.CloseWithError(err)
+		written <- err
+	}()
+	size, err := cfg.putObjectFromStream(ctx, input, pr)
+	// Unblocks the writer if the upload gave up first
+	pr.CloseWithError(err)
+	if writeErr := <-written; writeErr != nil {
+		return "", 0, writeErr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return key, size, nil
+}
+
+func (cfg *apiConfig) writeVideoPackage(ctx context.Context, w io.Writer, pkg database.VideoPackage, videos []database.Video) error {
+	zw := zip.NewWriter(w)
+	manifest := videoPackageManifest{Title: pkg.Title, CreatedAt: pkg.CreatedAt, Videos: []videoPackageManifestEntry{}}
+	for i, video := range videos {
+		entry := videoPackageManifestEntry{
+			Position:        i + 1,
+			VideoID:         video.ID,
+			Title:           video.Title,
+			Description:     video.Description,
+			File:            packageFileName(i+1, video.Title),
+			DurationSeconds: video.DurationSeconds,
+		}
+		key, err := cfg.videoObjectKey(video)
+		if err != nil {
+			return err
+		}
+		out, err := cfg.s3Client.GetObject(ctx, &s3.GetObjectInput{Bucket: &cfg.s3Bucket, Key: &key})
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return errPackageVideoGone
+		}
+		if err != nil {
+			return fmt.Errorf("could not get video %s: %w", video.ID, err)
+		}
+		file, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     entry.File,
+			Method:   zip.Store,
+			Modified: video.UpdatedAt,
+		})
+		if err != nil {
+			out.Body.Close()
+			return err
+		}
+		hash := sha256.New()
+		entry.Size, err = cfg.buffers.copy(io.MultiWriter(file, hash), out.Body)
+		out.Body.Close()
+		if err != nil {
+			return fmt.Errorf("could not copy video %s: %w", video.ID, err)
+		}
+		entry.ChecksumSHA256 = hex.EncodeToString(hash.Sum(nil))
+		manifest.Videos = append(manifest.Videos, entry)
+	}
+
+	file, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     "manifest.json",
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// putObjectFromStream uploads whatever r yields, for objects whose size
+// isn't known until they're written. Anything that fits in one part is a
+// single PutObject; the rest goes up in parts one at a time, so memory use
+// stays at one part.
+func (cfg *apiConfig) putObjectFromStream(ctx context.Context, input *s3.PutObjectInput, r io.Reader) (int64, error) {
+	buf := make([]byte, videoPackagePartSize)
+	n, err := io.ReadFull(r, buf)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		input.Body = bytes.NewReader(buf[:n])
+		if _, err := cfg.s3Client.PutObject(ctx, input); err != nil {
+			return 0, fmt.Errorf("could not put object %s: %w", *input.Key, err)
+		}
+		return int64(n), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	created, err := cfg.s3Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      input.Bucket,
+		Key:         input.Key,
+		ContentType: input.ContentType,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not start multipart upload of %s: %w", *input.Key, err)
+	}
+	var parts []types.CompletedPart
+	var size int64
+	for partNumber := int32(1); ; partNumber++ {
+		if partNumber > s3MaxParts {
+			cfg.abortMultipartUpload(input, created.UploadId)
+			return 0, fmt.Errorf("object %s needs more than %d parts", *input.Key, s3MaxParts)
+		}
+		part, err := cfg.s3Client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     input.Bucket,
+			Key:        input.Key,
+			UploadId:   created.UploadId,
+			PartNumber: &partNumber,
+			Body:       bytes.NewReader(buf[:n]),
+		})
+		if err != nil {
+			cfg.abortMultipartUpload(input, created.UploadId)
+			return 0, fmt.Errorf("could not upload part %d of %s: %w", partNumber, *input.Key, err)
+		}
+		parts = append(parts, types.CompletedPart{ETag: part.ETag, PartNumber: &partNumber})
+		size += int64(n)
+
+		n, err = io.ReadFull(r, buf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			cfg.abortMultipartUpload(input, created.UploadId)
+			return 0, err
+		}
+	}
+	_, err = cfg.s3Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          input.Bucket,
+		Key:             input.Key,
+		UploadId:        created.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		cfg.abortMultipartUpload(input, created.UploadId)
+		return 0, fmt.Errorf("could not complete multipart upload of %s: %w", *input.Key, err)
+	}
+	return size, nil
+}
+
+// runVideoPackageJob builds the job's package. A package deleted in the
+// meantime leaves nothing to do.
+func (cfg *apiConfig) runVideoPackageJob(ctx context.Context, job database.Job) string {
+	pkg, err := cfg.db.GetVideoPackage(job.SubjectID)
+	if err != nil {
+		return cfg.retryOrFailJob(ctx, job, database.UploadSession{}, &uploadError{msg: "Couldn't get video package", err: err, retryable: true})
+	}
+	if pkg.ID == uuid.Nil || pkg.Status == database.PackageStatusReady {
+		if err := cfg.db.CompleteJob(job.ID); err != nil {
+			log.Printf("Couldn't mark job %s completed: %v", job.ID, err)
+		}
+		return "completed"
+	}
+	if err := cfg.db.SetVideoPackageBuilding(pkg.ID); err != nil {
+		return cfg.retryOrFailJob(ctx, job, database.UploadSession{}, &uploadError{msg: "Couldn't update video package", err: err, retryable: true})
+	}
+
+	key, size, err := cfg.buildVideoPackage(ctx, pkg)
+	if err == nil {
+		err = cfg.db.CompleteVideoPackage(pkg.ID, key, size, time.Now().Add(videoPackageRetention))
+	}
+	if err != nil {
+		outcome := cfg.retryOrFailJob(ctx, job, database.UploadSession{}, &uploadError{
+			msg:       "Couldn't build video package",
+			err:       err,
+			retryable: !errors.Is(err, errPackageVideoGone) && !errors.Is(err, errPackageVideoUnavailable),
+		})
+		if outcome == "failed" {
+			if err := cfg.db.FailVideoPackage(pkg.ID, err.Error()); err != nil {
+				log.Printf("Couldn't mark video package %s failed: %v", pkg.ID, err)
+			}
+		}
+		return outcome
+	}
+	if err := cfg.db.CompleteJob(job.ID); err != nil {
+		log.Printf("Couldn't mark job %s completed: %v", job.ID, err)
+	}
+	cfg.metrics.add("tubely_video_packages_built_total", 1)
+	cfg.metrics.add("tubely_video_package_bytes_total", float64(size))
+	return "completed"
+}
+
+// deleteExpiredVideoPackages removes zips past their retention, along with
+// their packages.
+func (cfg *apiConfig) deleteExpiredVideoPackages(ctx context.Context) error {
+	packages, err := cfg.db.GetExpiredVideoPackages()
+	if err != nil {
+		return err
+	}
+	for _, pkg := range packages {
+		if pkg.S3Key != nil {
+			_, err := cfg.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: &cfg.s3Bucket, Key: pkg.S3Key})
+			if err != nil {
+				return fmt.Errorf("could not delete package %s: %w", pkg.ID, err)
+			}
+		}
+		if err := cfg.db.DeleteVideoPackage(pkg.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// videoPackageResponse is a package with a fresh download link once its zip
+// is ready.
+type videoPackageResponse struct {
+	database.VideoPackage
+	DownloadURL       *string    `json:"download_url"`
+	DownloadExpiresAt *time.Time `json:"download_expires_at"`
+}
+
+func (cfg *apiConfig) videoPackageResponse(ctx context.Context, pkg database.VideoPackage) (videoPackageResponse, error) {
+	resp := videoPackageResponse{VideoPackage: pkg}
+	if pkg.Status != database.PackageStatusReady || pkg.S3Key == nil {
+		return resp, nil
+	}
+	disposition := media.ContentDisposition("attachment", pkg.Title, ".zip")
+	presigned, err := s3.NewPresignClient(cfg.s3Client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket:                     &cfg.s3Bucket,
+		Key:                        pkg.S3Key,
+		ResponseContentDisposition: &disposition,
+	}, s3.WithPresignExpires(videoPackageLinkTTL))
+	if err != nil {
+		return resp, err
+	}
+	expiresAt := time.Now().Add(videoPackageLinkTTL)
+	resp.DownloadURL = &presigned.URL
+	resp.DownloadExpiresAt = &expiresAt
+	return resp, nil
+}
+
+// handlerVideoPackageCreate queues a zip of a playlist: the videos, in the
+// order given, plus a manifest describing them. The caller must be able to
+// view every video, and none may be encrypted or geo-restricted. Building it happens in the background; the package's
+// status says when it's ready.
+func (cfg *apiConfig) handlerVideoPackageCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Title    string      `json:"title" validate:"required,max=200"`
+		VideoIDs []uuid.UUID `json:"video_ids" validate:"required,min=1,max=200"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+
+	for _, id := range params.VideoIDs {
+		video, err := cfg.db.GetVideo(id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+			return
+		}
+		if video.ID == uuid.Nil {
+			respondWithError(w, http.StatusNotFound, fmt.Sprintf("Video %s not found", id), nil)
+			return
+		}
+		allowed, err := cfg.canAccessVideo(userID, video, permView)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check video permissions", err)
+			return
+		}
+		if !allowed {
+			respondWithError(w, http.StatusForbidden, fmt.Sprintf("You can't view video %s", id), nil)
+			return
+		}
+		if video.VideoURL == nil {
+			respondWithErrorCode(w, http.StatusConflict, "video_not_uploaded", fmt.Sprintf("Video %s has no file yet", id), nil)
+			return
+		}
+		if packageRestricted(video) {
+			respondWithErrorCode(w, http.StatusConflict, "video_restricted", fmt.Sprintf("Video %s is encrypted or geo-restricted and can't be packaged", id), nil)
+			return
+		}
+	}
+
+	pkg, err := cfg.db.CreateVideoPackage(userID, params.Title, params.VideoIDs)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create video package", err)
+		return
+	}
+	if _, err := cfg.db.EnqueueJob(database.JobKindVideoPackage, pkg.ID, userID, int(priorityBackground)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue video package", err)
+		return
+	}
+	cfg.metrics.add(`tubely_jobs_enqueued_total{kind="`+database.JobKindVideoPackage+`"}`, 1)
+
+	respondWithJSON(w, http.StatusAccepted, videoPackageResponse{VideoPackage: pkg})
+}
+
+func (cfg *apiConfig) handlerVideoPackagesRetrieve(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	packages, err := cfg.db.GetVideoPackagesForUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video packages", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, packages)
+}
+
+// handlerVideoPackageGet reports a package's progress and, once it's ready,
+// a download link valid for videoPackageLinkTTL. Asking again gives a new
+// link for as long as the zip is kept.
+func (cfg *apiConfig) handlerVideoPackageGet(w http.ResponseWriter, r *http.Request) {
+	packageID, ok := pathUUID(w, r, "packageID")
+	if !ok {
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	// Workers update the package as they go
+	pkg, err := cfg.db.Primary().GetVideoPackage(packageID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video package", err)
+		return
+	}
+	if pkg.ID == uuid.Nil || pkg.UserID != userID {
+		respondWithError(w, http.StatusNotFound, "Video package not found", nil)
+		return
+	}
+
+	resp, err := cfg.videoPackageResponse(r.Context(), pkg)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create download URL", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (cfg *apiConfig) handlerVideoPackageDelete(w http.ResponseWriter, r *http.Request) {
+	packageID, ok := pathUUID(w, r, "packageID")
+	if !ok {
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	pkg, err := cfg.db.GetVideoPackage(packageID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video package", err)
+		return
+	}
+	if pkg.ID == uuid.Nil || pkg.UserID != userID {
+		respondWithError(w, http.StatusNotFound, "Video package not found", nil)
+		return
+	}
+	if pkg.S3Key != nil {
+		if err := cfg.deleteS3ObjectVerified(r.Context(), *pkg.S3Key); err != nil {
+			respondWithError(w, http.StatusBadGateway, "Couldn't delete package zip", err)
+			return
+		}
+	}
+	if err := cfg.db.DeleteVideoPackage(pkg.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video package", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
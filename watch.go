@@ -0,0 +1,327 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// watchedThrough is the fraction of a video after which it counts as
+// finished, so playing it again starts over rather than at the credits.
+const watchedThrough = 0.95
+
+// resumeSeconds is where playback should pick up from a saved position.
+func resumeSeconds(position float64, duration *float64) float64 {
+	if duration != nil && *duration > 0 && position >= *duration*watchedThrough {
+		return 0
+	}
+	return position
+}
+
+type historyEntry struct {
+	database.HistoryEntry
+	ResumeSeconds float64 `json:"resume_seconds"`
+}
+
+type watchLaterEntry struct {
+	database.WatchLaterEntry
+	ResumeSeconds float64 `json:"resume_seconds"`
+}
+
+// viewableVideo authenticates the caller and looks up the video in the
+// path, responding with a 404 if it doesn't exist or they can't view it.
+func (cfg *apiConfig) viewableVideo(w http.ResponseWriter, r *http.Request) (uuid.UUID, database.Video, bool) {
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
+		return uuid.Nil, database.Video{}, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return uuid.Nil, database.Video{}, false
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return uuid.Nil, database.Video{}, false
+	}
+
+	video, err := cfg.getVideoShared(videoID, false)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return uuid.Nil, database.Video{}, false
+	}
+	allowed := false
+	if video.ID != uuid.Nil {
+		allowed, err = cfg.canViewVideo(userID, video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check video permissions", err)
+			return uuid.Nil, database.Video{}, false
+		}
+	}
+	if !allowed {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return uuid.Nil, database.Video{}, false
+	}
+	return userID, video, true
+}
+
+// handlerWatchProgressUpdate saves where the caller is in a video. Players
+// call it every so often during playback. Nothing is kept for users who
+// haven't turned on watch_history in their settings, but the request still
+// succeeds so players needn't know.
+func (cfg *apiConfig) handlerWatchProgressUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		PositionSeconds float64 `json:"position_seconds" validate:"min=0"`
+	}
+
+	userID, video, ok := cfg.viewableVideo(w, r)
+	if !ok {
+		return
+	}
+	params, ok := decodeJSON[parameters](w, r)
+	if !ok {
+		return
+	}
+
+	settings, err := cfg.db.GetUserSettings(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get settings", err)
+		return
+	}
+	if !settings.WatchHistory {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	position := params.PositionSeconds
+	if video.DurationSeconds != nil {
+		position = min(position, *video.DurationSeconds)
+	}
+	if err := cfg.db.RecordWatchProgress(userID, video.ID, position); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save progress", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerWatchProgressGet returns where the caller left off in a video and
+// where playback should resume. Both positions are zero if it isn't in
+// their history.
+func (cfg *apiConfig) handlerWatchProgressGet(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		PositionSeconds float64    `json:"position_seconds"`
+		WatchedAt       *time.Time `json:"watched_at"`
+		ResumeSeconds   float64    `json:"resume_seconds"`
+	}
+
+	userID, video, ok := cfg.viewableVideo(w, r)
+	if !ok {
+		return
+	}
+
+	progress, err := cfg.db.GetWatchProgress(userID, video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get progress", err)
+		return
+	}
+	if progress == nil {
+		respondWithJSON(w, http.StatusOK, response{})
+		return
+	}
+	respondWithJSON(w, http.StatusOK, response{
+		PositionSeconds: progress.PositionSeconds,
+		WatchedAt:       &progress.WatchedAt,
+		ResumeSeconds:   resumeSeconds(progress.PositionSeconds, video.DurationSeconds),
+	})
+}
+
+// handlerWatchHistoryRetrieve lists the videos the caller has watched, most
+// recent first, a page at a time. Videos they can no longer view are left
+// out, and those their country can't play come without a video_url.
+func (cfg *apiConfig) handlerWatchHistoryRetrieve(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	limit, cursor, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+	entries, err := cfg.db.GetWatchHistoryPage(userID, cursor, limit+1)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve history", err)
+		return
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		last := entries[limit-1]
+		setNextPageLink(w, r, limit, encodeCursor(last.WatchedAt, last.ID))
+	}
+
+	history := make([]historyEntry, 0, len(entries))
+	for _, entry := range entries {
+		if _, permitted := cfg.checkGeoRestriction(r, entry.Video); !permitted {
+			entry.VideoURL = nil
+		}
+		cfg.signVideoAssets(&entry.Video)
+		history = append(history, historyEntry{
+			HistoryEntry:  entry,
+			ResumeSeconds: resumeSeconds(entry.PositionSeconds, entry.DurationSeconds),
+		})
+	}
+	respondWithJSON(w, http.StatusOK, history)
+}
+
+// handlerWatchHistoryClear forgets everything the caller has watched. It
+// doesn't turn watch_history off.
+func (cfg *apiConfig) handlerWatchHistoryClear(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	if err := cfg.db.ClearWatchHistory(userID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't clear history", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerWatchHistoryDelete removes one video from the caller's history,
+// along with where they left off in it.
+func (cfg *apiConfig) handlerWatchHistoryDelete(w http.ResponseWriter, r *http.Request) {
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	deleted, err := cfg.db.DeleteWatchHistoryEntry(userID, videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete history entry", err)
+		return
+	}
+	if !deleted {
+		respondWithError(w, http.StatusNotFound, "Video not in history", nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerWatchLaterRetrieve lists the caller's watch-later videos, most
+// recently added first, a page at a time, with where to resume any they've
+// started. Videos their country can't play come without a video_url.
+func (cfg *apiConfig) handlerWatchLaterRetrieve(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	limit, cursor, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+	entries, err := cfg.db.GetWatchLaterPage(userID, cursor, limit+1)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve watch later", err)
+		return
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		last := entries[limit-1]
+		setNextPageLink(w, r, limit, encodeCursor(last.AddedAt, last.ID))
+	}
+
+	list := make([]watchLaterEntry, 0, len(entries))
+	for _, entry := range entries {
+		if _, permitted := cfg.checkGeoRestriction(r, entry.Video); !permitted {
+			entry.VideoURL = nil
+		}
+		cfg.signVideoAssets(&entry.Video)
+		item := watchLaterEntry{WatchLaterEntry: entry}
+		if entry.Progress != nil {
+			item.ResumeSeconds = resumeSeconds(entry.Progress.PositionSeconds, entry.DurationSeconds)
+		}
+		list = append(list, item)
+	}
+	respondWithJSON(w, http.StatusOK, list)
+}
+
+// handlerWatchLaterAdd puts a video the caller can view on their
+// watch-later list. Adding one that's already there leaves it in place.
+func (cfg *apiConfig) handlerWatchLaterAdd(w http.ResponseWriter, r *http.Request) {
+	userID, video, ok := cfg.viewableVideo(w, r)
+	if !ok {
+		return
+	}
+
+	if err := cfg.db.AddToWatchLater(userID, video.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't add to watch later", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerWatchLaterRemove takes a video off the caller's watch-later list.
+func (cfg *apiConfig) handlerWatchLaterRemove(w http.ResponseWriter, r *http.Request) {
+	videoID, ok := pathUUID(w, r, "videoID")
+	if !ok {
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	removed, err := cfg.db.RemoveFromWatchLater(userID, videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't remove from watch later", err)
+		return
+	}
+	if !removed {
+		respondWithError(w, http.StatusNotFound, "Video not in watch later", nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// watermarkMargin is the gap in pixels between the watermark and the frame
+// edge for the corner positions.
+const watermarkMargin = 10
+
+var errNoWatermark = errors.New("no watermark image configured")
+
+// watermarkConfig is where watermark images are kept, and the deployment's
+// default image and settings, used by users who haven't set their own.
+type watermarkConfig struct {
+	root        string
+	defaultPath string
+	position    string
+	opacity     float64
+	scale       float64
+}
+
+// overlayPosition returns the ffmpeg overlay x:y expression for a named
+// position.
+func overlayPosition(position string) (string, error) {
+	switch position {
+	case "top-left":
+		return fmt.Sprintf("%d:%d", watermarkMargin, watermarkMargin), nil
+	case "top-right":
+		return fmt.Sprintf("W-w-%d:%d", watermarkMargin, watermarkMargin), nil
+	case "bottom-left":
+		return fmt.Sprintf("%d:H-h-%d", watermarkMargin, watermarkMargin), nil
+	case "bottom-right":
+		return fmt.Sprintf("W-w-%d:H-h-%d", watermarkMargin, watermarkMargin), nil
+	case "center":
+		return "(W-w)/2:(H-h)/2", nil
+	default:
+		return "", fmt.Errorf("unsupported watermark position: %s", position)
+	}
+}
+
+// userWatermarkPath is where a user's uploaded watermark image is stored.
+func (cfg apiConfig) userWatermarkPath(userID uuid.UUID) string {
+	return filepath.Join(cfg.watermark.root, userID.String()+".png")
+}
+
+// resolveWatermark picks the user's own watermark if they uploaded one and
+// falls back to the deployment-wide default.
+func (cfg apiConfig) resolveWatermark(userID uuid.UUID) (string, error) {
+	userPath := cfg.userWatermarkPath(userID)
+	if _, err := os.Stat(userPath); err == nil {
+		return userPath, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	if cfg.watermark.defaultPath == "" {
+		return "", errNoWatermark
+	}
+	return cfg.watermark.defaultPath, nil
+}
+
+// watermarkSettings returns how the user's watermark is laid over their
+// videos: their own settings, or the deployment's if they have none.
+func (cfg apiConfig) watermarkSettings(userID uuid.UUID) (database.WatermarkSettings, error) {
+	settings, err := cfg.db.GetWatermarkSettings(userID)
+	if err != nil {
+		return database.WatermarkSettings{}, err
+	}
+	if settings == nil {
+		return database.WatermarkSettings{
+			Position: cfg.watermark.position,
+			Opacity:  cfg.watermark.opacity,
+			Scale:    cfg.watermark.scale,
+		}, nil
+	}
+	return *settings, nil
+}
+
+// watermarkSettingsProblems checks watermark settings sent by a user, with
+// the same limits as the deployment's.
+func watermarkSettingsProblems(settings database.WatermarkSettings) map[string]string {
+	problems := map[string]string{}
+	if _, err := overlayPosition(settings.Position); err != nil {
+		problems["position"] = "must be top-left, top-right, bottom-left, bottom-right or center"
+	}
+	if settings.Opacity <= 0 || settings.Opacity > 1 {
+		problems["opacity"] = "must be more than 0 and at most 1"
+	}
+	if settings.Scale <= 0 || settings.Scale > 1 {
+		problems["scale"] = "must be more than 0 and at most 1"
+	}
+	return problems
+}
+
+// applyWatermark re-encodes the video with the watermark image overlaid,
+// scaled to a fraction of the video width at the opacity settings give.
+func (cfg apiConfig) applyWatermark(filePath, watermarkPath string, settings database.WatermarkSettings) (string, error) {
+	position, err := overlayPosition(settings.Position)
+	if err != nil {
+		return "", err
+	}
+
+	filter := fmt.Sprintf(
+		"[1:v][0:v]scale2ref=w=main_w*%g:h=ow/a[wm][base];"+
+			"[wm]format=rgba,colorchannelmixer=aa=%g[wmo];"+
+			"[base][wmo]overlay=%s[out]",
+		settings.Scale,
+		settings.Opacity,
+		position,
+	)
+
+	watermarkedFilePath := filePath + ".watermarked"
+	err = runFFmpeg("watermark",
+		"-i", filePath,
+		"-i", watermarkPath,
+		"-filter_complex", filter,
+		"-map", "[out]",
+		"-map", "0:a?",
+		"-c:v", "libx264",
+		"-c:a", "copy",
+		"-f", "mp4",
+		watermarkedFilePath,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return watermarkedFilePath, nil
+}
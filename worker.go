@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// A deployment can run every node as roleAll, or split the HTTP frontend
+// (roleAPI) from the machines that run ffmpeg (roleWorker). Split nodes hand
+// uploads over through the jobs table and the upload's staged S3 object, so
+// they need the same database and bucket but nothing else in common.
+const (
+	roleAll    = "all"
+	roleAPI    = "api"
+	roleWorker = "worker"
+)
+
+const (
+	// workerJobLease is how long a claimed job stays with its worker without
+	// a heartbeat before another worker may take it over.
+	workerJobLease = 2 * time.Minute
+	// workerMaxAttempts bounds how often a job that keeps failing for
+	// transient reasons is retried before its upload is failed.
+	workerMaxAttempts = 5
+	// workerRetryBackoff is the delay before the first retry, doubled for
+	// each one after it.
+	workerRetryBackoff = 30 * time.Second
+)
+
+// queueUploadSession stages a claimed session's file in S3 and queues it for
+// a worker, responding 202 with the session. An empty filePath means the
+// file is already staged, as it is for presigned sessions.
+func (cfg *apiConfig) queueUploadSession(w http.ResponseWriter, r *http.Request, session database.UploadSession, filePath string) error {
+	timings := uploadTimingsFrom(r.Context())
+	if filePath != "" {
+		stopS3 := timings.track(stepS3)
+		err := cfg.stageUpload(r.Context(), session, filePath)
+		stopS3()
+		if err != nil {
+			cfg.releaseUploadSession(session)
+			respondWithError(w, http.StatusBadGateway, "Couldn't stage upload for processing", err)
+			return &uploadError{status: http.StatusBadGateway, msg: "Couldn't stage upload for processing", err: err, retryable: true}
+		}
+	}
+
+	// The worker carries on timing from here
+	cfg.recordUploadTimings(session.VideoID, session.ID, timings)
+	if _, err := cfg.db.EnqueueJob(database.JobKindUploadSession, session.ID, session.UserID, int(priorityInteractive)); err != nil {
+		cfg.releaseUploadSession(session)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue upload for processing", err)
+		return &uploadError{status: http.StatusInternalServerError, msg: "Couldn't queue upload for processing", err: err, retryable: true}
+	}
+	cfg.metrics.add(`tubely_jobs_enqueued_total{kind="`+database.JobKindUploadSession+`"}`, 1)
+
+	session.Status = database.UploadStatusProcessing
+	respondWithJSON(w, http.StatusAccepted, session)
+	return nil
+}
+
+// stageUpload puts a file received by this node where a worker can fetch
+// it. Files meant to be encrypted are at least encrypted at rest by S3
+// until the worker stores them under their own key.
+func (cfg *apiConfig) stageUpload(ctx context.Context, session database.UploadSession, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stagingKey := uploadSessionStagingKey(session.ID)
+	input := &s3.PutObjectInput{
+		Bucket:      &cfg.s3Bucket,
+		Key:         &stagingKey,
+		ContentType: &session.ContentType,
+	}
+	if session.Encrypt {
+		input.ServerSideEncryption = types.ServerSideEncryptionAes256
+	}
+	return cfg.putObjectFromFile(ctx, input, file)
+}
+
+// queueDirectUpload gives a file sent to the plain upload endpoint an upload
+// session of its own, so an API node can hand it to a worker and the client
+// can follow it like any other session.
+func (cfg *apiConfig) queueDirectUpload(w http.ResponseWriter, r *http.Request, video database.Video, userID uuid.UUID, filename, filePath string, opts database.UploadOptions) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open received file", err)
+		return
+	}
+	hash := sha256.New()
+	size, err := cfg.buffers.copy(hash, file)
+	file.Close()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read received file", err)
+		return
+	}
+
+	session, err := cfg.db.CreateUploadSession(database.UploadSession{
+		ExpiresAt:      time.Now().Add(uploadSessionTTL),
+		UserID:         userID,
+		VideoID:        video.ID,
+		Filename:       filename,
+		Size:           size,
+		ContentType:    "video/mp4",
+		ChecksumSHA256: hex.EncodeToString(hash.Sum(nil)),
+		Target:         database.UploadTargetProxy,
+		UploadOptions:  opts,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload session", err)
+		return
+	}
+	if !cfg.claimUploadSession(w, session) {
+		return
+	}
+	cfg.queueUploadSession(w, r, session, filePath)
+}
+
+// runWorkers processes queued jobs with n concurrent workers until ctx is
+// cancelled. Jobs already running when that happens are finished first.
+func (cfg *apiConfig) runWorkers(ctx context.Context, n int, pollInterval time.Duration) {
+	var wg sync.WaitGroup
+	for i := range n {
+		workerID := fmt.Sprintf("%s/%d", cfg.instanceID, i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cfg.workerLoop(ctx, workerID, pollInterval)
+		}()
+	}
+	wg.Wait()
+}
+
+func (cfg *apiConfig) workerLoop(ctx context.Context, workerID string, pollInterval time.Duration) {
+	for ctx.Err() == nil {
+		job, err := cfg.db.ClaimJob(workerID, workerJobLease)
+		if err != nil {
+			log.Printf("Worker %s couldn't claim a job: %v", workerID, err)
+		}
+		if err != nil || job.ID == uuid.Nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(pollInterval):
+			}
+			continue
+		}
+		cfg.runJob(context.WithoutCancel(ctx), workerID, job)
+	}
+}
+
+// runJob runs one claimed job, renewing its lease while it works. Losing
+// the lease means another worker has taken the job over, so the result of
+// this run is discarded.
+func (cfg *apiConfig) runJob(ctx context.Context, workerID string, job database.Job) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		ticker := time.NewTicker(workerJobLease / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			held, err := cfg.db.ExtendJobLease(job.ID, workerID, workerJobLease)
+			if err != nil {
+				log.Printf("Couldn't extend lease on job %s: %v", job.ID, err)
+				continue
+			}
+			if !held {
+				cancel()
+				return
+			}
+		}
+	}()
+
+	// Only a lost lease cancels ctx before the job is done
+	var outcome string
+	switch job.Kind {
+	case database.JobKindUploadSession:
+		outcome = cfg.runUploadSessionJob(ctx, job)
+	case database.JobKindThumbnailVariants:
+		outcome = cfg.runThumbnailVariantsJob(ctx, job)
+	case database.JobKindAutoThumbnail:
+		outcome = cfg.runAutoThumbnailJob(ctx, job)
+	case database.JobKindVideoPackage:
+		outcome = cfg.runVideoPackageJob(ctx, job)
+	default:
+		outcome = "failed"
+		if err := cfg.db.FailJob(job.ID, "unknown job kind "+job.Kind); err != nil {
+			log.Printf("Couldn't mark job %s failed: %v", job.ID, err)
+		}
+	}
+	if ctx.Err() != nil {
+		outcome = "lease_lost"
+	}
+
+	cfg.metrics.add(`tubely_jobs_total{kind="`+job.Kind+`",outcome="`+outcome+`"}`, 1)
+}
+
+// runUploadSessionJob processes a queued upload session from its staged
+// object and records the outcome on both the session and the job.
+func (cfg *apiConfig) runUploadSessionJob(ctx context.Context, job database.Job) string {
+	session, err := cfg.db.GetUploadSession(job.SubjectID)
+	if err != nil {
+		return cfg.retryOrFailJob(ctx, job, database.UploadSession{}, &uploadError{msg: "Couldn't get upload session", err: err, retryable: true})
+	}
+	if session.Status == database.UploadStatusCompleted {
+		// A worker that lost the lease finished the job after all
+		if err := cfg.db.CompleteJob(job.ID); err != nil {
+			log.Printf("Couldn't mark job %s completed: %v", job.ID, err)
+		}
+		return "completed"
+	}
+	if session.ID == uuid.Nil || session.Status != database.UploadStatusProcessing {
+		if err := cfg.db.FailJob(job.ID, "upload session is no longer waiting to be processed"); err != nil {
+			log.Printf("Couldn't mark job %s failed: %v", job.ID, err)
+		}
+		return "failed"
+	}
+
+	ctx, timings := withUploadTimings(ctx, session.Timings)
+	stopS3 := timings.track(stepS3)
+	filePath, err := cfg.downloadS3Object(ctx, uploadSessionStagingKey(session.ID))
+	stopS3()
+	if err != nil {
+		return cfg.retryOrFailJob(ctx, job, session, &uploadError{msg: "Couldn't fetch staged upload", err: err, retryable: true})
+	}
+	defer os.Remove(filePath)
+
+	_, err = cfg.processUploadSession(ctx, session, filePath)
+	cfg.recordUploadTimings(session.VideoID, session.ID, timings)
+	if err != nil {
+		return cfg.retryOrFailJob(ctx, job, session, err)
+	}
+
+	if err := cfg.db.SetUploadSessionStatus(session.ID, database.UploadStatusCompleted, nil); err != nil {
+		log.Printf("Couldn't mark upload session %s completed: %v", session.ID, err)
+	}
+	if err := cfg.db.CompleteJob(job.ID); err != nil {
+		log.Printf("Couldn't mark job %s completed: %v", job.ID, err)
+	}
+	cfg.deleteStagedUpload(ctx, session.ID)
+	return "completed"
+}
+
+// retryOrFailJob requeues a job that failed for a transient reason, with
+// exponential backoff, until it runs out of attempts. Anything else fails
+// the job and its upload session for good.
+func (cfg *apiConfig) retryOrFailJob(ctx context.Context, job database.Job, session database.UploadSession, err error) string {
+	log.Printf("Job %s attempt %d failed: %v", job.ID, job.Attempts, err)
+	if ctx.Err() != nil {
+		// The job belongs to another worker now
+		return "lease_lost"
+	}
+
+	if isRetryableUpload(err) && job.Attempts < workerMaxAttempts {
+		runAfter := time.Now().Add(workerRetryBackoff << (job.Attempts - 1))
+		if err := cfg.db.RetryJob(job.ID, err.Error(), runAfter); err != nil {
+			log.Printf("Couldn't requeue job %s: %v", job.ID, err)
+		}
+		return "retried"
+	}
+
+	if err := cfg.db.FailJob(job.ID, err.Error()); err != nil {
+		log.Printf("Couldn't mark job %s failed: %v", job.ID, err)
+	}
+	if session.ID != uuid.Nil {
+		cfg.recordUploadSessionFailure(session, err)
+		cfg.deleteStagedUpload(ctx, session.ID)
+	}
+	return "failed"
+}